@@ -0,0 +1,328 @@
+package aperture
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/freebie"
+	"github.com/lightninglabs/aperture/l402"
+	"github.com/lightninglabs/aperture/proxy"
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	// adminFreebiesPath is the path of the admin endpoint to inspect and
+	// reset the free requests of a client.
+	adminFreebiesPath = "/admin/freebies"
+
+	// adminTokenPath is the path of the admin endpoint to decode an L402.
+	adminTokenPath = "/admin/token"
+
+	// maxTokenSize is the maximum size of a request to decode an L402.
+	maxTokenSize = 64 * 1024
+)
+
+// freebieAdmin is the part of the proxy the admin endpoint manages the free
+// requests of clients with.
+type freebieAdmin interface {
+	// FreebieCount returns the number of free requests the given IP
+	// address made to the service with the given name.
+	FreebieCount(serviceName string, ip net.IP) (freebie.Count, error)
+
+	// ResetFreebies grants the given IP address the full number of free
+	// requests to the service with the given name again. Free requests
+	// counted by token ID are not reset.
+	ResetFreebies(serviceName string, ip net.IP) error
+}
+
+// freebieStatus is the response of the admin endpoint for the free requests
+// of a client.
+type freebieStatus struct {
+	Service string `json:"service"`
+	IP      string `json:"ip"`
+	Count   uint16 `json:"count"`
+}
+
+// tokenInfo is the response of the admin endpoint for a decoded L402.
+type tokenInfo struct {
+	Version           uint16            `json:"version"`
+	PaymentHash       string            `json:"payment_hash"`
+	TokenID           string            `json:"token_id"`
+	Location          string            `json:"location"`
+	Services          []tokenService    `json:"services,omitempty"`
+	Expiry            map[string]string `json:"expiry,omitempty"`
+	Caveats           []tokenCaveat     `json:"caveats"`
+	ThirdPartyCaveats int               `json:"third_party_caveats"`
+}
+
+// tokenService is a service an L402 grants access to.
+type tokenService struct {
+	Name string `json:"name"`
+	Tier uint8  `json:"tier"`
+}
+
+// tokenCaveat is a first-party caveat of an L402. Caveats that can't be
+// decoded are returned as they are, together with the error.
+type tokenCaveat struct {
+	Condition string `json:"condition,omitempty"`
+	Value     string `json:"value"`
+	Error     string `json:"error,omitempty"`
+}
+
+// newAdminService creates a local service that lets operators inspect and
+// reset the free requests of a client to a service and decode L402s. Requests
+// must present the given bearer token. The admin is looked up on each request,
+// as the proxy that manages the free requests is only created after its local
+// services.
+func newAdminService(bearerToken string,
+	getAdmin func() freebieAdmin) proxy.LocalService {
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		token, ok := strings.CutPrefix(
+			r.Header.Get("Authorization"), "Bearer ",
+		)
+		if !ok || !secureCompare(token, bearerToken) {
+			w.Header().Set(
+				"WWW-Authenticate", `Bearer realm="admin"`,
+			)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case adminFreebiesPath:
+			serveFreebies(w, r, getAdmin())
+
+		case adminTokenPath:
+			serveTokenInfo(w, r)
+		}
+	})
+
+	return proxy.NewLocalService(handler, func(r *http.Request) bool {
+		return r.URL.Path == adminFreebiesPath ||
+			r.URL.Path == adminTokenPath
+	})
+}
+
+// serveFreebies serves a request to inspect or reset the free requests of a
+// client to a service.
+func serveFreebies(w http.ResponseWriter, r *http.Request,
+	admin freebieAdmin) {
+
+	var (
+		serviceName = r.URL.Query().Get("service")
+		ip          = net.ParseIP(r.URL.Query().Get("ip"))
+	)
+	if serviceName == "" || ip == nil {
+		http.Error(
+			w, "service and valid ip parameters required",
+			http.StatusBadRequest,
+		)
+		return
+	}
+
+	var (
+		count freebie.Count
+		err   error
+	)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		count, err = admin.FreebieCount(serviceName, ip)
+
+	case http.MethodDelete:
+		err = admin.ResetFreebies(serviceName, ip)
+		if err == nil {
+			log.Infof("Reset free requests of %v to service %s",
+				ip, serviceName)
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		http.Error(
+			w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed,
+		)
+		return
+	}
+
+	switch {
+	case errors.Is(err, proxy.ErrUnknownService),
+		errors.Is(err, proxy.ErrNoFreebies):
+
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+
+	case err != nil:
+		log.Errorf("Unable to manage free requests of %v to service "+
+			"%s: %v", ip, serviceName, err)
+		http.Error(
+			w, "freebie DB failure", http.StatusInternalServerError,
+		)
+		return
+	}
+
+	writeAdminJSON(w, &freebieStatus{
+		Service: serviceName,
+		IP:      ip.String(),
+		Count:   uint16(count),
+	})
+}
+
+// serveTokenInfo serves a request to decode the L402 in the request body.
+func serveTokenInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(
+			w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed,
+		)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxTokenSize))
+	if err != nil {
+		http.Error(w, "unable to read body", http.StatusBadRequest)
+		return
+	}
+
+	info, err := decodeToken(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeAdminJSON(w, info)
+}
+
+// writeAdminJSON writes the given value as the JSON response to an admin
+// request.
+func writeAdminJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Unable to encode admin response: %v", err)
+	}
+}
+
+// decodeToken decodes the given L402 macaroon. The macaroon may be hex or
+// base64 encoded and may be passed as the value of an Authorization header
+// field, in which case the scheme and the preimage are ignored.
+func decodeToken(token string) (*tokenInfo, error) {
+	token = strings.TrimSpace(token)
+	for _, scheme := range []string{"L402 ", "LSAT "} {
+		token = strings.TrimPrefix(token, scheme)
+	}
+	token, _, _ = strings.Cut(token, ":")
+
+	macBytes, err := hex.DecodeString(token)
+	if err != nil {
+		macBytes, err = base64.StdEncoding.DecodeString(token)
+	}
+	if err != nil {
+		macBytes, err = base64.URLEncoding.DecodeString(token)
+	}
+	if err != nil {
+		return nil, errors.New("macaroon must be hex or base64 encoded")
+	}
+
+	mac := &macaroon.Macaroon{}
+	if err := mac.UnmarshalBinary(macBytes); err != nil {
+		return nil, fmt.Errorf("invalid macaroon: %w", err)
+	}
+
+	id, err := l402.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid L402 identifier: %w", err)
+	}
+
+	info := &tokenInfo{
+		Version:     id.Version,
+		PaymentHash: id.PaymentHash.String(),
+		TokenID:     id.TokenID.String(),
+		Location:    mac.Location(),
+		Caveats:     []tokenCaveat{},
+	}
+
+	expiries := make(map[string]time.Time)
+	for _, rawCaveat := range mac.Caveats() {
+		// Third-party caveats are discharged by other parties, so
+		// there is nothing we could show about them.
+		if len(rawCaveat.VerificationId) > 0 {
+			info.ThirdPartyCaveats++
+			continue
+		}
+
+		caveat, err := l402.DecodeCaveat(string(rawCaveat.Id))
+		if err != nil {
+			info.Caveats = append(info.Caveats, tokenCaveat{
+				Value: string(rawCaveat.Id),
+				Error: err.Error(),
+			})
+			continue
+		}
+
+		info.Caveats = append(info.Caveats, tokenCaveat{
+			Condition: caveat.Condition,
+			Value:     caveat.Value,
+		})
+
+		switch {
+		// Only the first services caveat is shown, later ones can
+		// only restrict access further.
+		case caveat.Condition == l402.CondServices &&
+			info.Services == nil:
+
+			services, err := l402.DecodeServicesCaveat(caveat)
+			if err != nil {
+				break
+			}
+			for _, service := range services {
+				info.Services = append(
+					info.Services, tokenService{
+						Name: service.Name,
+						Tier: uint8(service.Tier),
+					},
+				)
+			}
+
+		// The earliest timeout of a service is the one that applies.
+		case strings.HasSuffix(
+			caveat.Condition, l402.CondTimeoutSuffix,
+		):
+			timestamp, err := strconv.ParseInt(caveat.Value, 10, 64)
+			if err != nil {
+				break
+			}
+
+			service := strings.TrimSuffix(
+				caveat.Condition, l402.CondTimeoutSuffix,
+			)
+			expiry := time.Unix(timestamp, 0).UTC()
+			prev, ok := expiries[service]
+			if !ok || expiry.Before(prev) {
+				expiries[service] = expiry
+			}
+		}
+	}
+
+	if len(expiries) > 0 {
+		info.Expiry = make(map[string]string, len(expiries))
+		for service, expiry := range expiries {
+			info.Expiry[service] = expiry.Format(time.RFC3339)
+		}
+	}
+
+	return info, nil
+}
@@ -0,0 +1,209 @@
+package aperture
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/freebie"
+	"github.com/lightninglabs/aperture/l402"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+// mockFreebieAdmin is a freebieAdmin that keeps the free requests of a single
+// service in memory.
+type mockFreebieAdmin struct {
+	counts map[string]freebie.Count
+}
+
+func (m *mockFreebieAdmin) FreebieCount(serviceName string,
+	ip net.IP) (freebie.Count, error) {
+
+	if serviceName != "freebie" {
+		return 0, proxy.ErrUnknownService
+	}
+
+	return m.counts[ip.String()], nil
+}
+
+func (m *mockFreebieAdmin) ResetFreebies(serviceName string,
+	ip net.IP) error {
+
+	if serviceName != "freebie" {
+		return errors.New("failure")
+	}
+
+	delete(m.counts, ip.String())
+
+	return nil
+}
+
+// TestAdminService makes sure the admin endpoint requires authentication and
+// lets operators inspect and reset the free requests of a client.
+func TestAdminService(t *testing.T) {
+	admin := &mockFreebieAdmin{
+		counts: map[string]freebie.Count{"192.0.2.1": 3},
+	}
+	service := newAdminService("secret", func() freebieAdmin {
+		return admin
+	})
+
+	serve := func(method, query, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			method, "http://localhost"+adminFreebiesPath+query, nil,
+		)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		require.True(t, service.IsHandling(req))
+
+		rec := httptest.NewRecorder()
+		service.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	const query = "?service=freebie&ip=192.0.2.1"
+
+	// Requests without the right token are rejected.
+	rec := serve(http.MethodGet, query, "")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+	rec = serve(http.MethodGet, query, "wrong")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	status := func() freebieStatus {
+		rec := serve(http.MethodGet, query, "secret")
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var status freebieStatus
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+
+		return status
+	}
+	require.Equal(t, freebieStatus{
+		Service: "freebie",
+		IP:      "192.0.2.1",
+		Count:   3,
+	}, status())
+
+	rec = serve(http.MethodDelete, query, "secret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Zero(t, status().Count)
+
+	// Invalid requests are rejected.
+	rec = serve(http.MethodGet, "?service=freebie&ip=foo", "secret")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = serve(http.MethodPost, query, "secret")
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	rec = serve(http.MethodGet, "?service=other&ip=192.0.2.1", "secret")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	rec = serve(http.MethodDelete, "?service=other&ip=192.0.2.1", "secret")
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+// TestAdminTokenInfo makes sure the admin endpoint decodes the identifier and
+// caveats of an L402.
+func TestAdminTokenInfo(t *testing.T) {
+	id := &l402.Identifier{
+		PaymentHash: lntypes.Hash{1, 2, 3},
+		TokenID:     l402.TokenID{4, 5, 6},
+	}
+	var idBytes bytes.Buffer
+	require.NoError(t, l402.EncodeIdentifier(&idBytes, id))
+
+	mac, err := macaroon.New(
+		[]byte("secret"), idBytes.Bytes(), "aperture",
+		macaroon.LatestVersion,
+	)
+	require.NoError(t, err)
+
+	servicesCaveat, err := l402.NewServicesCaveat(l402.Service{
+		Name: "svc", Tier: l402.BaseTier,
+	})
+	require.NoError(t, err)
+
+	now := func() time.Time {
+		return time.Unix(1700000000, 0)
+	}
+	require.NoError(t, l402.AddFirstPartyCaveats(
+		mac, servicesCaveat,
+		l402.NewTimeoutCaveat("svc", 60, now),
+		l402.NewTimeoutCaveat("svc", 30, now),
+	))
+	require.NoError(t, mac.AddFirstPartyCaveat([]byte("invalid")))
+
+	macBytes, err := mac.MarshalBinary()
+	require.NoError(t, err)
+
+	service := newAdminService("secret", nil)
+	serve := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			method, "http://localhost"+adminTokenPath,
+			strings.NewReader(body),
+		)
+		req.Header.Set("Authorization", "Bearer secret")
+		require.True(t, service.IsHandling(req))
+
+		rec := httptest.NewRecorder()
+		service.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	expected := tokenInfo{
+		PaymentHash: id.PaymentHash.String(),
+		TokenID:     id.TokenID.String(),
+		Location:    "aperture",
+		Services:    []tokenService{{Name: "svc"}},
+		Expiry: map[string]string{
+			"svc": "2023-11-14T22:13:50Z",
+		},
+		Caveats: []tokenCaveat{{
+			Condition: l402.CondServices,
+			Value:     "svc:0",
+		}, {
+			Condition: "svc_valid_until",
+			Value:     "1700000060",
+		}, {
+			Condition: "svc_valid_until",
+			Value:     "1700000030",
+		}, {
+			Value: "invalid",
+			Error: l402.ErrInvalidCaveat.Error(),
+		}},
+	}
+
+	// Hex and base64 encoded macaroons are accepted, as well as the value
+	// of an Authorization header field.
+	for _, token := range []string{
+		hex.EncodeToString(macBytes),
+		base64.StdEncoding.EncodeToString(macBytes),
+		"L402 " + base64.StdEncoding.EncodeToString(macBytes) +
+			":" + lntypes.Preimage{}.String(),
+	} {
+		rec := serve(http.MethodPost, token)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var info tokenInfo
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&info))
+		require.Equal(t, expected, info)
+	}
+
+	rec := serve(http.MethodPost, "not a macaroon")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = serve(http.MethodGet, "")
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
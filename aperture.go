@@ -7,8 +7,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	_ "net/http/pprof" // Blank import to set up profiling HTTP handlers.
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -22,6 +24,8 @@ import (
 	"github.com/lightninglabs/aperture/aperturedb"
 	"github.com/lightninglabs/aperture/auth"
 	"github.com/lightninglabs/aperture/challenger"
+	"github.com/lightninglabs/aperture/freebie"
+	"github.com/lightninglabs/aperture/l402"
 	"github.com/lightninglabs/aperture/lnc"
 	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightninglabs/aperture/proxy"
@@ -31,12 +35,11 @@ import (
 	"github.com/lightningnetwork/lnd/build"
 	"github.com/lightningnetwork/lnd/cert"
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
 	"github.com/lightningnetwork/lnd/signal"
 	"github.com/lightningnetwork/lnd/tor"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"golang.org/x/crypto/acme/autocert"
-	"golang.org/x/net/http2"
-	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
@@ -83,6 +86,18 @@ const (
 	// to the target lnd node.
 	invoiceMacaroonName = "invoice.macaroon"
 
+	// defaultInvoiceMemo is the memo of invoices for services that don't
+	// configure their own.
+	defaultInvoiceMemo = "L402"
+
+	// l402AuthenticatorName is the name services select the L402
+	// authenticator by.
+	l402AuthenticatorName = "l402"
+
+	// apiKeyAuthenticatorName is the name services select the API key
+	// authenticator by.
+	apiKeyAuthenticatorName = "apikey"
+
 	// defaultMailboxAddress is the default address of the mailbox server
 	// that will be used if none is specified.
 	defaultMailboxAddress = "mailbox.terminal.lightning.today:443"
@@ -179,6 +194,22 @@ type Aperture struct {
 	proxy         *proxy.Proxy
 	proxyCleanup  func()
 
+	// grpcHealth is the gRPC health service that reports NOT_SERVING as
+	// soon as aperture shuts down.
+	grpcHealth *grpcHealthServer
+
+	// serviceConfigs holds the serialized configuration of the services
+	// the proxy currently uses, to log what changed on a reload.
+	serviceConfigs serviceConfigs
+
+	// services holds the services the proxy currently uses, for all
+	// components that look up service settings outside of the proxy.
+	services *serviceRegistry
+
+	// serviceLimiter provides the caveats of the current services to the
+	// mint.
+	serviceLimiter *staticServiceLimiter
+
 	wg   sync.WaitGroup
 	quit chan struct{}
 }
@@ -220,9 +251,11 @@ func (a *Aperture) Start(errChan chan error) error {
 	}
 
 	var (
-		secretStore mint.SecretStore
-		onionStore  tor.OnionStore
-		lncStore    lnc.Store
+		secretStore     mint.SecretStore
+		onionStore      tor.OnionStore
+		lncStore        lnc.Store
+		hashMailStreams hashMailStreamStore
+		freebieStore    freebie.CounterStore
 	)
 
 	// Connect to the chosen database backend.
@@ -242,6 +275,13 @@ func (a *Aperture) Start(errChan chan error) error {
 		secretStore = newSecretStore(a.etcdClient)
 		onionStore = newOnionStore(a.etcdClient)
 
+	case "memory":
+		log.Warnf("Using the in-memory database backend, all L402 " +
+			"secrets are lost on shutdown, invalidating every " +
+			"L402 issued before")
+
+		secretStore = mint.NewInMemorySecretStore()
+
 	case "postgres":
 		db, err := aperturedb.NewPostgresStore(a.cfg.Postgres)
 		if err != nil {
@@ -250,6 +290,18 @@ func (a *Aperture) Start(errChan chan error) error {
 		}
 		a.db = db.DB
 
+		// Make sure the database is reachable and migrated before we
+		// start serving.
+		ctxt, cancel := context.WithTimeout(
+			context.Background(), aperturedb.DefaultStoreTimeout,
+		)
+		err = db.PingAndVerify(ctxt)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("postgres database not ready: %w",
+				err)
+		}
+
 		dbSecretTxer := aperturedb.NewTransactionExecutor(db,
 			func(tx *sql.Tx) aperturedb.SecretsDB {
 				return db.WithTx(tx)
@@ -271,6 +323,22 @@ func (a *Aperture) Start(errChan chan error) error {
 		)
 		lncStore = aperturedb.NewLNCSessionsStore(dbLNCTxer)
 
+		dbHashMailTxer := aperturedb.NewTransactionExecutor(db,
+			func(tx *sql.Tx) aperturedb.HashMailStreamsDB {
+				return db.WithTx(tx)
+			},
+		)
+		hashMailStreams = aperturedb.NewHashMailStreamsStore(
+			dbHashMailTxer,
+		)
+
+		dbFreebiesTxer := aperturedb.NewTransactionExecutor(db,
+			func(tx *sql.Tx) aperturedb.FreebiesDB {
+				return db.WithTx(tx)
+			},
+		)
+		freebieStore = aperturedb.NewFreebiesStore(dbFreebiesTxer)
+
 	case "sqlite":
 		db, err := aperturedb.NewSqliteStore(a.cfg.Sqlite)
 		if err != nil {
@@ -279,6 +347,18 @@ func (a *Aperture) Start(errChan chan error) error {
 		}
 		a.db = db.DB
 
+		// Make sure the database is reachable and migrated before we
+		// start serving.
+		ctxt, cancel := context.WithTimeout(
+			context.Background(), aperturedb.DefaultStoreTimeout,
+		)
+		err = db.PingAndVerify(ctxt)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("sqlite database not ready: %w",
+				err)
+		}
+
 		dbSecretTxer := aperturedb.NewTransactionExecutor(db,
 			func(tx *sql.Tx) aperturedb.SecretsDB {
 				return db.WithTx(tx)
@@ -300,6 +380,22 @@ func (a *Aperture) Start(errChan chan error) error {
 		)
 		lncStore = aperturedb.NewLNCSessionsStore(dbLNCTxer)
 
+		dbHashMailTxer := aperturedb.NewTransactionExecutor(db,
+			func(tx *sql.Tx) aperturedb.HashMailStreamsDB {
+				return db.WithTx(tx)
+			},
+		)
+		hashMailStreams = aperturedb.NewHashMailStreamsStore(
+			dbHashMailTxer,
+		)
+
+		dbFreebiesTxer := aperturedb.NewTransactionExecutor(db,
+			func(tx *sql.Tx) aperturedb.FreebiesDB {
+				return db.WithTx(tx)
+			},
+		)
+		freebieStore = aperturedb.NewFreebiesStore(dbFreebiesTxer)
+
 	default:
 		return fmt.Errorf("unknown database backend: %s",
 			a.cfg.DatabaseBackend)
@@ -307,23 +403,24 @@ func (a *Aperture) Start(errChan chan error) error {
 
 	log.Infof("Using %v as database backend", a.cfg.DatabaseBackend)
 
+	// The timeouts of services are relative to the mint's clock.
+	a.services = newServiceRegistry(a.cfg.Services)
+	a.serviceLimiter = newStaticServiceLimiter(a.cfg.Services, time.Now)
+
 	if !a.cfg.Authenticator.Disable {
 		authCfg := a.cfg.Authenticator
-		genInvoiceReq := func(price int64) (*lnrpc.Invoice, error) {
-			return &lnrpc.Invoice{
-				Memo:  "L402",
-				Value: price,
-			}, nil
-		}
+		genInvoiceReq := newInvoiceRequestGenerator(a.services)
 
 		switch {
 		case authCfg.Passphrase != "":
 			log.Infof("Using lnc's authenticator config")
 
-			if a.cfg.DatabaseBackend == "etcd" {
-				return fmt.Errorf("etcd is not supported as " +
-					"a database backend for lnc " +
-					"connections")
+			if a.cfg.DatabaseBackend == "etcd" ||
+				a.cfg.DatabaseBackend == "memory" {
+
+				return fmt.Errorf("%v is not supported as "+
+					"a database backend for lnc "+
+					"connections", a.cfg.DatabaseBackend)
 			}
 
 			session, err := lnc.NewSession(
@@ -335,33 +432,107 @@ func (a *Aperture) Start(errChan chan error) error {
 					"session: %w", err)
 			}
 
-			a.challenger, err = challenger.NewLNCChallenger(
+			// With a direct lnd fallback configured, a failing LNC
+			// connection must not force a shutdown, so we don't
+			// hand it the main error channel.
+			lncErrChan := errChan
+			if authCfg.LndFallback {
+				lncErrChan = nil
+			}
+
+			lncChallenger, err := challenger.NewLNCChallenger(
 				session, lncStore, a.cfg.InvoiceBatchSize,
-				genInvoiceReq, errChan,
+				genInvoiceReq, lncErrChan,
 			)
-			if err != nil {
+			switch {
+			case err != nil && !authCfg.LndFallback:
 				return fmt.Errorf("unable to start lnc "+
 					"challenger: %w", err)
+
+			case err != nil:
+				log.Warnf("Unable to start lnc challenger, "+
+					"using lnd fallback only: %v", err)
+
+				a.challenger, err = newLndChallenger(
+					authCfg, a.cfg.InvoiceBatchSize,
+					genInvoiceReq,
+					a.cfg.HoldInvoiceHashSource, errChan,
+				)
+				if err != nil {
+					return err
+				}
+
+			case authCfg.LndFallback:
+				log.Infof("Using lnd's authenticator config " +
+					"as lnc fallback")
+
+				lndChallenger, err := newLndChallenger(
+					authCfg, a.cfg.InvoiceBatchSize,
+					genInvoiceReq,
+					a.cfg.HoldInvoiceHashSource, errChan,
+				)
+				if err != nil {
+					lncChallenger.Stop()
+					return err
+				}
+
+				a.challenger = challenger.NewFallbackChallenger(
+					lncChallenger, lndChallenger,
+				)
+
+			default:
+				a.challenger = lncChallenger
 			}
 
-		case authCfg.LndHost != "":
-			log.Infof("Using lnd's authenticator config")
+		case authCfg.LNURL != "":
+			log.Infof("Using LNURL-pay endpoint %s as "+
+				"authenticator backend", authCfg.LNURL)
 
-			authCfg := a.cfg.Authenticator
-			client, err := lndclient.NewBasicClient(
-				authCfg.LndHost, authCfg.TLSPath,
-				authCfg.MacDir, authCfg.Network,
-				lndclient.MacFilename(
-					invoiceMacaroonName,
-				),
+			chainParams, err := lndclient.Network(
+				authCfg.Network,
+			).ChainParams()
+			if err != nil {
+				return err
+			}
+
+			var lnurlOpts []challenger.LNURLChallengerOption
+			if authCfg.LNURLTimeout != 0 {
+				lnurlOpts = append(
+					lnurlOpts, challenger.WithLNURLTimeout(
+						authCfg.LNURLTimeout,
+					),
+				)
+			}
+			if authCfg.LNURLSettledRetention != 0 {
+				lnurlOpts = append(
+					lnurlOpts,
+					challenger.WithLNURLSettledRetention(
+						authCfg.LNURLSettledRetention,
+					),
+				)
+			}
+			if authCfg.LNURLProxy != "" {
+				// The proxy URL was validated with the config.
+				proxyURL, _ := url.Parse(authCfg.LNURLProxy)
+				lnurlOpts = append(
+					lnurlOpts,
+					challenger.WithLNURLProxy(proxyURL),
+				)
+			}
+
+			a.challenger, err = challenger.NewLNURLChallenger(
+				authCfg.LNURL, chainParams, lnurlOpts...,
 			)
 			if err != nil {
 				return err
 			}
 
-			a.challenger, err = challenger.NewLndChallenger(
-				client, a.cfg.InvoiceBatchSize, genInvoiceReq,
-				context.Background, errChan,
+		case authCfg.LndHost != "":
+			log.Infof("Using lnd's authenticator config")
+
+			a.challenger, err = newLndChallenger(
+				authCfg, a.cfg.InvoiceBatchSize, genInvoiceReq,
+				a.cfg.HoldInvoiceHashSource, errChan,
 			)
 			if err != nil {
 				return err
@@ -369,16 +540,64 @@ func (a *Aperture) Start(errChan chan error) error {
 		}
 	}
 
-	// Create the proxy and connect it to lnd.
+	// Only L402s with a timeout expire, so their secrets can be pruned.
+	// The etcd backend attaches such secrets to leases, which makes etcd
+	// remove them itself.
+	if a.cfg.SecretPruneInterval > 0 {
+		pruner, ok := secretStore.(mint.SecretPruner)
+		if ok {
+			a.wg.Add(1)
+			go a.pruneSecrets(pruner, a.cfg.SecretPruneInterval)
+		} else {
+			log.Infof("The %v database backend removes expired "+
+				"L402 secrets itself, ignoring the secret "+
+				"prune interval", a.cfg.DatabaseBackend)
+		}
+	}
+
+	// The free request counters are only stored by the SQL backends, which
+	// keep them until they are pruned.
+	if a.cfg.FreebieRetention > 0 {
+		retention := a.cfg.FreebieRetention
+		pruner, ok := freebieStore.(freebie.CounterPruner)
+		if ok {
+			a.wg.Add(1)
+			go a.pruneFreebies(
+				pruner, freebiePruneInterval(retention),
+				retention,
+			)
+		}
+	}
+
+	// LNC sessions are only stored by the SQL backends, which don't remove
+	// expired sessions on their own.
+	if lncStore != nil && a.cfg.LNCSessionPruneInterval > 0 {
+		a.wg.Add(1)
+		go a.pruneLNCSessions(lncStore, a.cfg.LNCSessionPruneInterval)
+	}
+
+	// Operators can keep an eye on the stored LNC sessions and their
+	// expiry through Prometheus. Only the SQL backends store them.
+	if lncStore != nil && a.cfg.Prometheus != nil &&
+		a.cfg.Prometheus.Enabled {
+
+		a.wg.Add(1)
+		go a.trackLNCSessions(lncStore)
+	}
+
+	// Create the proxy and connect it to lnd. We need to remember the
+	// service configurations before the proxy fills in default values.
+	a.serviceConfigs = newServiceConfigs(a.cfg.Services)
+	a.grpcHealth = newGRPCHealthServer(a.challenger)
 	a.proxy, a.proxyCleanup, err = createProxy(
-		a.cfg, a.challenger, secretStore,
+		a.cfg, a.challenger, secretStore, hashMailStreams,
+		freebieStore, a.grpcHealth, a.services, a.serviceLimiter,
 	)
 	if err != nil {
 		return err
 	}
 	handler := http.HandlerFunc(a.proxy.ServeHTTP)
 	a.httpsServer = &http.Server{
-		Addr:         a.cfg.ListenAddr,
 		Handler:      handler,
 		IdleTimeout:  a.cfg.IdleTimeout,
 		ReadTimeout:  a.cfg.ReadTimeout,
@@ -391,15 +610,17 @@ func (a *Aperture) Start(errChan chan error) error {
 
 	// Create TLS configuration by either creating new self-signed certs or
 	// trying to obtain one through Let's Encrypt.
-	var serveFn func() error
+	var serveFn func(net.Listener) error
 	if a.cfg.Insecure {
 		// Normally, HTTP/2 only works with TLS. But there is a special
 		// version called HTTP/2 Cleartext (h2c) that some clients
 		// support and that gRPC uses when the grpc.WithInsecure()
 		// option is used. The default HTTP handler doesn't support it
 		// though so we need to add a special h2c handler here.
-		serveFn = a.httpsServer.ListenAndServe
-		a.httpsServer.Handler = h2c.NewHandler(handler, &http2.Server{})
+		serveFn = a.httpsServer.Serve
+		a.httpsServer.Handler = newH2CHandler(
+			handler, !a.cfg.DisableH2CUpgrade,
+		)
 	} else {
 		a.httpsServer.TLSConfig, err = getTLSConfig(
 			a.cfg.ServerName, a.cfg.BaseDir, a.cfg.AutoCert,
@@ -407,26 +628,43 @@ func (a *Aperture) Start(errChan chan error) error {
 		if err != nil {
 			return err
 		}
-		serveFn = func() error {
+		serveFn = func(lis net.Listener) error {
 			// The httpsServer.TLSConfig contains certificates at
 			// this point so we don't need to pass in certificate
 			// and key file names.
-			return a.httpsServer.ListenAndServeTLS("", "")
+			return a.httpsServer.ServeTLS(lis, "", "")
 		}
 	}
 
-	// Finally run the server.
-	log.Infof("Starting the server, listening on %s.", a.cfg.ListenAddr)
+	// Bind all listen addresses before serving on any of them, so we fail
+	// early if one of them is unavailable. Until we serve on them, the
+	// listeners must be closed if any of the following steps fails.
+	listeners, err := listen(a.cfg.listenAddrs())
+	if err != nil {
+		return err
+	}
+	closeListeners := func() {
+		for _, lis := range listeners {
+			_ = lis.Close()
+		}
+	}
 
-	a.wg.Add(1)
-	go func() {
-		defer a.wg.Done()
+	// Connections from trusted upstreams carry the real client address in
+	// a PROXY protocol header, which must be read before any TLS or HTTP
+	// data.
+	if a.cfg.ProxyProtocol {
+		upstreams, err := parseUpstreams(a.cfg.ProxyProtocolUpstreams)
+		if err != nil {
+			closeListeners()
+			return err
+		}
 
-		select {
-		case errChan <- serveFn():
-		case <-a.quit:
+		for i := range listeners {
+			listeners[i] = newProxyProtocolListener(
+				listeners[i], upstreams,
+			)
 		}
-	}()
+	}
 
 	// If we need to listen over Tor as well, we'll set up the onion
 	// services now. We're not able to use TLS for onion services since they
@@ -438,16 +676,37 @@ func (a *Aperture) Start(errChan chan error) error {
 	if a.cfg.Tor.V3 {
 		torController, err := initTorListener(a.cfg, onionStore)
 		if err != nil {
+			closeListeners()
 			return err
 		}
 		defer func() {
 			_ = torController.Stop()
 		}()
 
+		torHandler := newH2CHandler(handler, !a.cfg.DisableH2CUpgrade)
 		a.torHTTPServer = &http.Server{
 			Addr:    fmt.Sprintf("localhost:%d", a.cfg.Tor.ListenPort),
-			Handler: h2c.NewHandler(handler, &http2.Server{}),
+			Handler: torHandler,
 		}
+	}
+
+	// Finally run the server. All listeners share the same server, so
+	// shutting it down closes all of them.
+	for _, lis := range listeners {
+		log.Infof("Starting the server, listening on %s.", lis.Addr())
+
+		a.wg.Add(1)
+		go func(lis net.Listener) {
+			defer a.wg.Done()
+
+			select {
+			case errChan <- serveFn(lis):
+			case <-a.quit:
+			}
+		}(lis)
+	}
+
+	if a.torHTTPServer != nil {
 		a.wg.Add(1)
 		go func() {
 			defer a.wg.Done()
@@ -459,6 +718,10 @@ func (a *Aperture) Start(errChan chan error) error {
 		}()
 	}
 
+	// Reload the services and the blocklist from the configuration file
+	// whenever we receive a SIGHUP signal.
+	a.notifyReload()
+
 	return nil
 }
 
@@ -473,16 +736,30 @@ func (a *Aperture) UpdateServices(services []*proxy.Service) error {
 func (a *Aperture) Stop() error {
 	var returnErr error
 
-	if a.challenger != nil {
-		a.challenger.Stop()
+	// Let gRPC health checks know we're going away before we stop
+	// anything.
+	if a.grpcHealth != nil {
+		a.grpcHealth.Shutdown()
+	}
+
+	// Stop accepting new connections and give the requests in flight the
+	// chance to complete. This causes the server goroutines to quit. The
+	// challenger and the database are still needed until then.
+	if err := a.shutdownServers(); err != nil {
+		returnErr = err
 	}
 
 	// Stop everything that was started alongside the proxy, for example the
-	// gRPC and REST servers.
+	// gRPC and REST servers. Requests in flight may still use them, so we
+	// only do so once the servers are drained.
 	if a.proxyCleanup != nil {
 		a.proxyCleanup()
 	}
 
+	if a.challenger != nil {
+		a.challenger.Stop()
+	}
+
 	if a.etcdClient != nil {
 		if err := a.etcdClient.Close(); err != nil {
 			log.Errorf("Error terminating etcd client: %v", err)
@@ -497,18 +774,8 @@ func (a *Aperture) Stop() error {
 		}
 	}
 
-	// Shut down our client and server connections now. This should cause
-	// the first goroutine to quit.
-	cleanup(a.httpsServer, a.proxy)
-
-	// If we started a tor server as well, shut it down now too to cause the
-	// second goroutine to quit.
-	if a.torHTTPServer != nil {
-		if err := a.torHTTPServer.Close(); err != nil {
-			log.Errorf("Error stopping tor server: %v", err)
-			returnErr = err
-		}
-	}
+	// Shut down our client connections now.
+	cleanup(a.proxy)
 
 	// Now we wait for the goroutines to exit before we return. The defers
 	// will take care of the rest of our started resources.
@@ -518,6 +785,84 @@ func (a *Aperture) Stop() error {
 	return returnErr
 }
 
+// shutdownServers shuts down the HTTPS server and, if started, the Tor server.
+// They stop accepting new connections right away, while requests in flight
+// get up to the configured shutdown timeout to complete. Any connections that
+// are still open after that are closed.
+func (a *Aperture) shutdownServers() error {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), a.cfg.ShutdownTimeout,
+	)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		errMtx    sync.Mutex
+		returnErr error
+	)
+	shutdown := func(name string, server *http.Server) {
+		defer wg.Done()
+
+		if a.cfg.ShutdownTimeout > 0 {
+			err := server.Shutdown(ctx)
+			if err == nil {
+				return
+			}
+
+			log.Warnf("Unable to gracefully shut down %s server, "+
+				"closing remaining connections: %v", name, err)
+		}
+
+		if err := server.Close(); err != nil {
+			log.Errorf("Error closing %s server: %v", name, err)
+
+			errMtx.Lock()
+			returnErr = err
+			errMtx.Unlock()
+		}
+	}
+
+	if a.cfg.ShutdownTimeout > 0 {
+		log.Infof("Waiting up to %v for requests in flight to complete",
+			a.cfg.ShutdownTimeout)
+	}
+
+	// Both servers are shut down concurrently, so the total time is
+	// bounded by the shutdown timeout.
+	if a.httpsServer != nil {
+		wg.Add(1)
+		go shutdown("https", a.httpsServer)
+	}
+	if a.torHTTPServer != nil {
+		wg.Add(1)
+		go shutdown("tor", a.torHTTPServer)
+	}
+	wg.Wait()
+
+	return returnErr
+}
+
+// listen binds all of the given TCP addresses. If any of them can't be bound,
+// the listeners created so far are closed again.
+func listen(addrs []string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+
+			return nil, fmt.Errorf("unable to listen on %s: %w",
+				addr, err)
+		}
+
+		listeners = append(listeners, lis)
+	}
+
+	return listeners, nil
+}
+
 // fileExists reports whether the named file or directory exists.
 // This function is taken from https://github.com/btcsuite/btcd
 func fileExists(name string) bool {
@@ -792,6 +1137,22 @@ func initTorListener(cfg *Config, store tor.OnionStore) (*tor.Controller,
 		TargetPorts: []int{int(cfg.Tor.ListenPort)},
 		Store:       store,
 	}
+
+	// Only authorized clients can connect to the onion service if any are
+	// configured.
+	if len(cfg.Tor.AuthorizedClients) > 0 {
+		authStore, err := newClientAuthOnionStore(
+			store, cfg.Tor.AuthorizedClients,
+		)
+		if err != nil {
+			return nil, err
+		}
+		onionCfg.Store = authStore
+
+		log.Infof("Restricting onion service to %d authorized clients",
+			len(cfg.Tor.AuthorizedClients))
+	}
+
 	torController := tor.NewController(cfg.Tor.Control, "", "")
 	if err := torController.Start(); err != nil {
 		return nil, err
@@ -799,6 +1160,7 @@ func initTorListener(cfg *Config, store tor.OnionStore) (*tor.Controller,
 
 	if cfg.Tor.V3 {
 		onionCfg.Type = tor.V3
+
 		addr, err := torController.AddOnion(onionCfg)
 		if err != nil {
 			return nil, err
@@ -810,38 +1172,133 @@ func initTorListener(cfg *Config, store tor.OnionStore) (*tor.Controller,
 	return torController, nil
 }
 
+// newLndChallenger creates a new challenger that is directly connected to the
+// lnd node of the given auth config.
+func newLndChallenger(authCfg *AuthConfig, batchSize int,
+	genInvoiceReq challenger.InvoiceRequestGenerator,
+	hashSource challenger.PaymentHashSource,
+	errChan chan<- error) (*challenger.LndChallenger, error) {
+
+	conn, err := lndclient.NewBasicConn(
+		authCfg.LndHost, authCfg.TLSPath, authCfg.MacDir,
+		authCfg.Network, lndclient.MacFilename(invoiceMacaroonName),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hold invoices are managed through the invoices sub-server, which the
+	// invoice macaroon grants access to as well.
+	var opts []challenger.LndChallengerOption
+	if hashSource != nil {
+		opts = append(opts, challenger.WithHoldInvoices(
+			invoicesrpc.NewInvoicesClient(conn), hashSource,
+		))
+	}
+
+	return challenger.NewLndChallenger(
+		lnrpc.NewLightningClient(conn), batchSize, genInvoiceReq,
+		context.Background, errChan, opts...,
+	)
+}
+
 // createProxy creates the proxy with all the services it needs.
 func createProxy(cfg *Config, challenger challenger.Challenger,
-	store mint.SecretStore) (*proxy.Proxy, func(), error) {
+	store mint.SecretStore, hashMailStreams hashMailStreamStore,
+	freebieStore freebie.CounterStore, grpcHealth *grpcHealthServer,
+	services *serviceRegistry,
+	serviceLimiter *staticServiceLimiter) (*proxy.Proxy, func(), error) {
 
-	minter := mint.New(&mint.Config{
-		Challenger:     challenger,
-		Secrets:        store,
-		ServiceLimiter: newStaticServiceLimiter(cfg.Services),
-		Now:            time.Now,
-	})
-	authenticator := auth.NewL402Authenticator(minter, challenger)
+	revocationAuditor := newRevocationAuditor(
+		cfg.Authenticator.RevocationWebhook,
+	)
+	// Secrets never change, so they can be cached to save a database round
+	// trip for each verification.
+	if cfg.Authenticator.SecretCacheSize > 0 {
+		store = mint.NewCachingSecretStore(
+			store, cfg.Authenticator.SecretCacheSize,
+			cfg.Authenticator.SecretCacheTTL,
+		)
+	}
 
-	// By default the static file server only returns 404 answers for
-	// security reasons. Serving files from the staticRoot directory has to
-	// be enabled intentionally.
-	staticServer := http.NotFoundHandler()
-	if cfg.ServeStatic {
-		if len(strings.TrimSpace(cfg.StaticRoot)) == 0 {
-			return nil, nil, fmt.Errorf("staticroot cannot be " +
-				"empty, must contain path to directory that " +
-				"contains index.html")
+	mintCfg := &mint.Config{
+		Challenger:            challenger,
+		Secrets:               store,
+		ServiceLimiter:        serviceLimiter,
+		RequireServicesCaveat: cfg.Authenticator.RequireServicesCaveat,
+		StrictPreimage:        cfg.Authenticator.StrictPreimage,
+		StrictCaveatChains:    cfg.Authenticator.StrictCaveatChains,
+		RevocationAuditor:     revocationAuditor,
+		CustomSatisfiers:      cfg.CustomSatisfiers,
+		Location:              cfg.Authenticator.MacaroonLocation,
+		Now:                   serviceLimiter.now,
+	}
+	if cfg.Authenticator.VerifyPaymentHash && challenger != nil {
+		verifier, ok := challenger.(mint.PaymentHashVerifier)
+		if ok {
+			mintCfg.PaymentHashVerifier = verifier
+		} else {
+			log.Warnf("Challenger can't verify payment hashes, " +
+				"minting L402s without verifying them")
 		}
-		staticServer = http.FileServer(http.Dir(cfg.StaticRoot))
+	}
+	minter := mint.New(mintCfg)
+	authOpts := []auth.L402AuthenticatorOption{
+		auth.WithMinInvoiceState(newMinInvoiceStateFunc(services)),
+		auth.WithCapability(newCapabilityFunc(services)),
+	}
+	if cfg.Authenticator.CacheChallengeHeaders {
+		authOpts = append(authOpts, auth.WithChallengeHeaderCache())
+	}
+	if cfg.Authenticator.DualHeaderPolicy != "" {
+		policy := l402.DualHeaderPolicy(
+			cfg.Authenticator.DualHeaderPolicy,
+		)
+		authOpts = append(authOpts, auth.WithDualHeaderPolicy(policy))
+	}
+	if cfg.Prometheus != nil && cfg.Prometheus.Enabled &&
+		cfg.Prometheus.MacaroonSizeMetrics {
+
+		authOpts = append(authOpts, auth.WithMacaroonSizeMetric())
+	}
+	authenticator := auth.NewL402Authenticator(
+		minter, challenger, authOpts...,
+	)
+
+	// Services can select which authenticators apply to them by name. The
+	// API key authenticator is only available if keys are configured.
+	authenticators := map[string]auth.Authenticator{
+		l402AuthenticatorName: authenticator,
+	}
+	if cfg.APIKey != nil && len(cfg.APIKey.Keys) > 0 {
+		apiKeyAuth, err := auth.NewAPIKeyAuthenticator(
+			cfg.APIKey.Header, cfg.APIKey.Keys,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		authenticators[apiKeyAuthenticatorName] = apiKeyAuth
+	}
+
+	// By default requests that no service handles are answered with a
+	// 404 for security reasons. Serving files from the staticRoot
+	// directory has to be enabled intentionally.
+	if cfg.ServeStatic && len(strings.TrimSpace(cfg.StaticRoot)) == 0 {
+		return nil, nil, fmt.Errorf("staticroot cannot be empty, " +
+			"must contain path to directory that contains " +
+			"index.html")
 	}
 
 	var (
 		localServices []proxy.LocalService
 		proxyCleanup  = func() {}
+		prxy          *proxy.Proxy
 	)
 
 	if cfg.HashMail.Enabled {
-		hashMailServices, cleanup, err := createHashMailServer(cfg)
+		hashMailServices, cleanup, err := createHashMailServer(
+			cfg, hashMailStreams,
+		)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -850,24 +1307,82 @@ func createProxy(cfg *Config, challenger challenger.Challenger,
 		proxyCleanup = cleanup
 	}
 
-	// The static file server must be last since it will match all calls
-	// that make it to it.
-	localServices = append(localServices, proxy.NewLocalService(
-		staticServer, func(r *http.Request) bool {
-			return true
-		},
-	))
+	// The health endpoints are always available, so orchestrators can
+	// probe aperture without paying.
+	localServices = append(
+		localServices, newHealthService(challenger),
+		newGRPCHealthService(grpcHealth),
+	)
+
+	if cfg.ServeMintInfo {
+		localServices = append(localServices, newMintInfoService(
+			minter.VerificationInfo(), services,
+		))
+	}
+
+	if cfg.Admin != nil && cfg.Admin.Enabled {
+		localServices = append(localServices, newAdminService(
+			cfg.Admin.BearerToken, func() freebieAdmin {
+				return prxy
+			},
+		))
+	}
+
+	// The static file server is last, so the other local services take
+	// precedence over files with the same path.
+	if cfg.ServeStatic {
+		staticService := proxy.NewStaticFileService(cfg.StaticRoot)
+		localServices = append(localServices, staticService)
+	}
 
-	prxy, err := proxy.New(authenticator, cfg.Services, localServices...)
+	// Backend metrics are only recorded if they are exported.
+	backendMetrics := cfg.Prometheus != nil && cfg.Prometheus.Enabled &&
+		cfg.Prometheus.BackendMetrics
+
+	proxyCfg := &proxy.Config{
+		MaxRequestRate:             cfg.MaxRequestRate,
+		MaxRequestBurst:            cfg.MaxRequestBurst,
+		MaxConcurrentRequests:      cfg.MaxConcurrentRequests,
+		MaxConcurrentVerifications: cfg.MaxConcurrentVerifications,
+		VerificationQueueTimeout:   cfg.VerificationQueueTimeout,
+		AccessLogFormat:            cfg.AccessLogFormat,
+		BackendSourceAddr:          cfg.BackendSourceAddr,
+		TrustedProxies:             cfg.TrustedProxies,
+		RealIPHeader:               cfg.RealIPHeader,
+		Blocklist:                  cfg.Blocklist,
+		RejectHostMismatch:         cfg.RejectHostMismatch,
+		MaxInjectedHeaders:         cfg.MaxInjectedHeaders,
+		MaxJSONChallengeSize:       cfg.MaxJSONChallengeSize,
+		PaywallTemplate:            cfg.PaywallTemplate,
+		BackendMetrics:             backendMetrics,
+		Authenticators:             authenticators,
+		FreebieStore:               freebieStore,
+		CORS:                       cfg.CORS,
+	}
+
+	var err error
+	prxy, err = proxy.NewWithConfig(
+		proxyCfg, authenticator, cfg.Services, localServices...,
+	)
 	return prxy, proxyCleanup, err
 }
 
 // createHashMailServer creates the gRPC server for the hash mail message
 // gateway and an additional REST and WebSocket capable proxy for that gRPC
 // server.
-func createHashMailServer(cfg *Config) ([]proxy.LocalService, func(), error) {
+func createHashMailServer(cfg *Config,
+	streamStore hashMailStreamStore) ([]proxy.LocalService, func(), error) {
 	var localServices []proxy.LocalService
 
+	// Streams are attributed to the real IP address of their clients, like
+	// the requests of the proxy.
+	realIP, err := proxy.NewRealIPResolver(
+		cfg.TrustedProxies, cfg.RealIPHeader,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	serverOpts := []grpc.ServerOption{
 		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
 			MinTime: time.Minute,
@@ -890,11 +1405,40 @@ func createHashMailServer(cfg *Config) ([]proxy.LocalService, func(), error) {
 	}
 
 	// Create a gRPC server for the hashmail server.
-	hashMailServer := newHashMailServer(hashMailServerConfig{
-		msgRate:           cfg.HashMail.MessageRate,
-		msgBurstAllowance: cfg.HashMail.MessageBurstAllowance,
-		staleTimeout:      cfg.HashMail.StaleTimeout,
-	})
+	hashMailCfg := hashMailServerConfig{
+		msgRate:                cfg.HashMail.MessageRate,
+		readMsgRate:            cfg.HashMail.ReadMessageRate,
+		writeMsgRate:           cfg.HashMail.WriteMessageRate,
+		msgBurstAllowance:      cfg.HashMail.MessageBurstAllowance,
+		readMsgBurstAllowance:  cfg.HashMail.ReadMessageBurstAllowance,
+		writeMsgBurstAllowance: cfg.HashMail.WriteMessageBurstAllowance,
+		staleTimeout:           cfg.HashMail.StaleTimeout,
+		maxMessageSize:         cfg.HashMail.MaxMessageSize,
+		tearDownPairs:          cfg.HashMail.TearDownPairs,
+		reclaimStreams:         cfg.HashMail.ReclaimStreams,
+		activeReadRate:         cfg.HashMail.ActiveReadRate,
+		maxStreamsPerClient:    cfg.HashMail.MaxStreamsPerClient,
+		realIP:                 realIP,
+		requireSignatures:      cfg.HashMail.RequireSignatures,
+		streamAcquireTimeout:   cfg.HashMail.StreamAcquireTimeout,
+	}
+	if cfg.HashMail.Persist {
+		hashMailCfg.streamStore = streamStore
+	}
+	hashMailServer := newHashMailServer(hashMailCfg)
+
+	// Restore any streams that were persisted before the last shutdown so
+	// clients can reconnect to them.
+	ctxt, cancelRestore := context.WithTimeout(
+		context.Background(), aperturedb.DefaultStoreTimeout,
+	)
+	err = hashMailServer.restoreStreams(ctxt)
+	cancelRestore()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to restore hashmail "+
+			"streams: %w", err)
+	}
+
 	hashMailGRPC := grpc.NewServer(serverOpts...)
 	hashmailrpc.RegisterHashMailServer(hashMailGRPC, hashMailServer)
 	localServices = append(localServices, proxy.NewLocalService(
@@ -926,7 +1470,15 @@ func createHashMailServer(cfg *Config) ([]proxy.LocalService, func(), error) {
 	// through REST.
 	ctxc, cancel := context.WithCancel(context.Background())
 	proxyCleanup := func() {
-		hashMailServer.Stop()
+		if cfg.HashMail.DrainTimeout > 0 {
+			ctxt, cancelDrain := context.WithTimeout(
+				context.Background(), cfg.HashMail.DrainTimeout,
+			)
+			hashMailServer.StopGracefully(ctxt)
+			cancelDrain()
+		} else {
+			hashMailServer.Stop()
+		}
 		cancel()
 	}
 
@@ -945,8 +1497,8 @@ func createHashMailServer(cfg *Config) ([]proxy.LocalService, func(), error) {
 	}
 
 	mux := gateway.NewServeMux(customMarshalerOption)
-	err := hashmailrpc.RegisterHashMailHandlerFromEndpoint(
-		ctxc, mux, cfg.ListenAddr, []grpc.DialOption{
+	err = hashmailrpc.RegisterHashMailHandlerFromEndpoint(
+		ctxc, mux, cfg.listenAddrs()[0], []grpc.DialOption{
 			restProxyTLSOpt,
 		},
 	)
@@ -974,17 +1526,13 @@ func createHashMailServer(cfg *Config) ([]proxy.LocalService, func(), error) {
 	return localServices, proxyCleanup, nil
 }
 
-// cleanup closes the given server and shuts down the log rotator.
-func cleanup(server io.Closer, proxy io.Closer) {
+// cleanup closes the given proxy and shuts down the log rotator.
+func cleanup(proxy io.Closer) {
 	if err := proxy.Close(); err != nil {
 		log.Errorf("Error terminating proxy: %v", err)
 	}
-	err := server.Close()
-	if err != nil {
-		log.Errorf("Error closing server: %v", err)
-	}
 	log.Info("Shutdown complete")
-	err = logWriter.Close()
+	err := logWriter.Close()
 	if err != nil {
 		log.Errorf("Could not close log rotator: %v", err)
 	}
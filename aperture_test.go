@@ -0,0 +1,123 @@
+package aperture
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestShutdownServers makes sure requests in flight can complete during the
+// shutdown timeout, while connections that are still busy after it are
+// closed.
+func TestShutdownServers(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	newServer := func() (*http.Server, string) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		server := &http.Server{
+			Handler: http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					started <- struct{}{}
+					select {
+					case <-release:
+					case <-r.Context().Done():
+					}
+					_, _ = w.Write([]byte("done"))
+				},
+			),
+		}
+		go func() {
+			_ = server.Serve(lis)
+		}()
+
+		return server, "http://" + lis.Addr().String()
+	}
+
+	request := func(url string) chan error {
+		errChan := make(chan error, 1)
+		go func() {
+			resp, err := http.Get(url)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			defer resp.Body.Close()
+
+			_, err = io.ReadAll(resp.Body)
+			errChan <- err
+		}()
+		<-started
+
+		return errChan
+	}
+
+	// A request that completes within the timeout is served.
+	server, url := newServer()
+	a := &Aperture{
+		cfg:         &Config{ShutdownTimeout: 5 * time.Second},
+		httpsServer: server,
+	}
+	errChan := request(url)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+	}()
+	require.NoError(t, a.shutdownServers())
+	require.NoError(t, <-errChan)
+
+	// New connections are refused after the shutdown.
+	_, err := http.Get(url)
+	require.Error(t, err)
+
+	// A request that doesn't complete within the timeout is cut off.
+	release = make(chan struct{})
+	defer close(release)
+	server, url = newServer()
+	a = &Aperture{
+		cfg:         &Config{ShutdownTimeout: 100 * time.Millisecond},
+		httpsServer: server,
+	}
+	errChan = request(url)
+	start := time.Now()
+	require.NoError(t, a.shutdownServers())
+	require.Less(t, time.Since(start), 2*time.Second)
+	require.Error(t, <-errChan)
+}
+
+// TestListenAddrs makes sure multiple comma separated listen addresses are
+// all bound, and that no listener is left open if one of them is taken.
+func TestListenAddrs(t *testing.T) {
+	cfg := &Config{ListenAddr: "127.0.0.1:0"}
+	require.Equal(t, []string{"127.0.0.1:0"}, cfg.listenAddrs())
+
+	cfg.ListenAddr = " 127.0.0.1:0, [::1]:0,"
+	require.Equal(t, []string{"127.0.0.1:0", "[::1]:0"}, cfg.listenAddrs())
+
+	cfg.ListenAddr = " , "
+	require.Empty(t, cfg.listenAddrs())
+
+	listeners, err := listen([]string{"127.0.0.1:0", "127.0.0.1:0"})
+	require.NoError(t, err)
+	require.Len(t, listeners, 2)
+
+	// Binding an address that is already in use fails and releases the
+	// listeners bound before it.
+	first := listeners[0].Addr().String()
+	_ = listeners[1].Close()
+	listeners2, err := listen(
+		[]string{listeners[1].Addr().String(), first},
+	)
+	require.ErrorContains(t, err, "unable to listen on "+first)
+	require.Nil(t, listeners2)
+
+	lis, err := net.Listen("tcp", listeners[1].Addr().String())
+	require.NoError(t, err)
+	_ = lis.Close()
+	_ = listeners[0].Close()
+}
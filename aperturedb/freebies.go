@@ -0,0 +1,217 @@
+package aperturedb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/lightninglabs/aperture/aperturedb/sqlc"
+	"github.com/lightninglabs/aperture/freebie"
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+type (
+	FreebieCountKey = sqlc.GetFreebieCountParams
+
+	NewFreebie = sqlc.IncrementFreebieCountParams
+
+	DeleteFreebieCountKey = sqlc.DeleteFreebieCountParams
+)
+
+// FreebiesDB is an interface that defines the set of operations that can be
+// executed against the freebies database.
+type FreebiesDB interface {
+	// GetFreebieCount returns the number of free requests counted under
+	// the given key for a service.
+	GetFreebieCount(ctx context.Context, arg FreebieCountKey) (int64,
+		error)
+
+	// IncrementFreebieCount increments the number of free requests
+	// counted under the given key for a service, creating the counter if
+	// it doesn't exist yet.
+	IncrementFreebieCount(ctx context.Context, arg NewFreebie) error
+
+	// DeleteFreebieCount deletes the counter of the given key for a
+	// service.
+	DeleteFreebieCount(ctx context.Context,
+		arg DeleteFreebieCountKey) error
+
+	// DeleteStaleFreebies deletes all counters that were last incremented
+	// before the given time and returns the number of deleted counters.
+	DeleteStaleFreebies(ctx context.Context, lastSeen time.Time) (int64,
+		error)
+}
+
+// FreebiesDBTxOptions defines the set of db txn options the FreebiesDB
+// understands.
+type FreebiesDBTxOptions struct {
+	// readOnly governs if a read only transaction is needed or not.
+	readOnly bool
+}
+
+// ReadOnly returns true if the transaction should be read only.
+//
+// NOTE: This implements the TxOptions
+func (a *FreebiesDBTxOptions) ReadOnly() bool {
+	return a.readOnly
+}
+
+// NewFreebiesDBReadTx creates a new read transaction option set.
+func NewFreebiesDBReadTx() FreebiesDBTxOptions {
+	return FreebiesDBTxOptions{
+		readOnly: true,
+	}
+}
+
+// BatchedFreebiesDB is a version of the FreebiesDB that's capable of batched
+// database operations.
+type BatchedFreebiesDB interface {
+	FreebiesDB
+
+	BatchedTx[FreebiesDB]
+}
+
+// FreebiesStore represents a storage backend.
+type FreebiesStore struct {
+	db    BatchedFreebiesDB
+	clock clock.Clock
+}
+
+// A compile time flag to ensure the FreebiesStore satisfies the
+// freebie.CounterStore and freebie.CounterPruner interfaces.
+var _ freebie.CounterStore = (*FreebiesStore)(nil)
+var _ freebie.CounterPruner = (*FreebiesStore)(nil)
+
+// NewFreebiesStore creates a new FreebiesStore instance given an open
+// BatchedFreebiesDB storage backend.
+func NewFreebiesStore(db BatchedFreebiesDB) *FreebiesStore {
+	return &FreebiesStore{
+		db:    db,
+		clock: clock.NewDefaultClock(),
+	}
+}
+
+// FreebieCount returns the number of free requests counted under the given
+// key for the given service. Unknown keys have a count of zero.
+//
+// NOTE: This is part of the freebie.CounterStore interface.
+func (f *FreebiesStore) FreebieCount(ctx context.Context, serviceName,
+	key string) (freebie.Count, error) {
+
+	ctxt, cancel := context.WithTimeout(ctx, DefaultStoreTimeout)
+	defer cancel()
+
+	var count int64
+	readTx := NewFreebiesDBReadTx()
+	err := f.db.ExecTx(ctxt, &readTx, func(tx FreebiesDB) error {
+		var err error
+		count, err = tx.GetFreebieCount(ctxt, FreebieCountKey{
+			ServiceName: serviceName,
+			CounterKey:  key,
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			count = 0
+			return nil
+		}
+
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get freebie count of %s for "+
+			"service %s: %w", key, serviceName, err)
+	}
+
+	if count > math.MaxUint16 {
+		return math.MaxUint16, nil
+	}
+
+	return freebie.Count(count), nil
+}
+
+// IncrementFreebies increments the counters of all given keys for the given
+// service by one.
+//
+// NOTE: This is part of the freebie.CounterStore interface.
+func (f *FreebiesStore) IncrementFreebies(ctx context.Context,
+	serviceName string, keys []string) error {
+
+	ctxt, cancel := context.WithTimeout(ctx, DefaultStoreTimeout)
+	defer cancel()
+
+	lastSeen := f.clock.Now().UTC().Truncate(time.Microsecond)
+
+	var writeTxOpts FreebiesDBTxOptions
+	err := f.db.ExecTx(ctxt, &writeTxOpts, func(tx FreebiesDB) error {
+		for _, key := range keys {
+			err := tx.IncrementFreebieCount(ctxt, NewFreebie{
+				ServiceName: serviceName,
+				CounterKey:  key,
+				LastSeen:    lastSeen,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to increment freebie counts for "+
+			"service %s: %w", serviceName, err)
+	}
+
+	return nil
+}
+
+// ResetFreebies removes the counter of the given key for the given service.
+//
+// NOTE: This is part of the freebie.CounterStore interface.
+func (f *FreebiesStore) ResetFreebies(ctx context.Context, serviceName,
+	key string) error {
+
+	ctxt, cancel := context.WithTimeout(ctx, DefaultStoreTimeout)
+	defer cancel()
+
+	var writeTxOpts FreebiesDBTxOptions
+	err := f.db.ExecTx(ctxt, &writeTxOpts, func(tx FreebiesDB) error {
+		return tx.DeleteFreebieCount(ctxt, DeleteFreebieCountKey{
+			ServiceName: serviceName,
+			CounterKey:  key,
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reset freebie count of %s for "+
+			"service %s: %w", key, serviceName, err)
+	}
+
+	return nil
+}
+
+// PruneFreebies removes the counters of all clients that didn't make a free
+// request since the given time and returns the number of removed counters.
+//
+// NOTE: This is part of the freebie.CounterPruner interface.
+func (f *FreebiesStore) PruneFreebies(ctx context.Context,
+	before time.Time) (int64, error) {
+
+	var (
+		writeTxOpts FreebiesDBTxOptions
+		numPruned   int64
+	)
+	err := f.db.ExecTx(ctx, &writeTxOpts, func(tx FreebiesDB) error {
+		var err error
+		numPruned, err = tx.DeleteStaleFreebies(
+			ctx, before.UTC().Truncate(time.Microsecond),
+		)
+
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("unable to prune freebie counts: %w", err)
+	}
+
+	return numPruned, nil
+}
@@ -0,0 +1,104 @@
+package aperturedb
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/clock"
+	"github.com/stretchr/testify/require"
+)
+
+func newFreebiesStoreWithDB(db *BaseDB) *FreebiesStore {
+	dbTxer := NewTransactionExecutor(db,
+		func(tx *sql.Tx) FreebiesDB {
+			return db.WithTx(tx)
+		},
+	)
+
+	return NewFreebiesStore(dbTxer)
+}
+
+func TestFreebiesDB(t *testing.T) {
+	ctx := context.Background()
+
+	// First, create a new test database.
+	db := NewTestDB(t)
+	store := newFreebiesStoreWithDB(db.BaseDB)
+
+	// Unknown counters have a count of zero.
+	count, err := store.FreebieCount(ctx, "service", "10.0.0.0")
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	// Counters are incremented per service and key.
+	keys := []string{"10.0.0.0", "token:01"}
+	require.NoError(t, store.IncrementFreebies(ctx, "service", keys))
+	require.NoError(t, store.IncrementFreebies(ctx, "service", keys[:1]))
+	require.NoError(t, store.IncrementFreebies(ctx, "other", keys[:1]))
+
+	count, err = store.FreebieCount(ctx, "service", "10.0.0.0")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, count)
+
+	count, err = store.FreebieCount(ctx, "service", "token:01")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, count)
+
+	count, err = store.FreebieCount(ctx, "other", "10.0.0.0")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, count)
+
+	// A reset only removes the counter of the given service and key.
+	require.NoError(t, store.ResetFreebies(ctx, "service", "10.0.0.0"))
+
+	count, err = store.FreebieCount(ctx, "service", "10.0.0.0")
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	count, err = store.FreebieCount(ctx, "other", "10.0.0.0")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, count)
+}
+
+// TestFreebiesDBPrune tests that only the counters of clients that didn't make
+// a free request since the given time are pruned.
+func TestFreebiesDBPrune(t *testing.T) {
+	ctx := context.Background()
+
+	db := NewTestDB(t)
+	store := newFreebiesStoreWithDB(db.BaseDB)
+
+	now := time.Now()
+	testClock := clock.NewTestClock(now.Add(-time.Hour))
+	store.clock = testClock
+
+	require.NoError(t, store.IncrementFreebies(
+		ctx, "service", []string{"10.0.0.0", "10.0.1.0"},
+	))
+
+	// The second client makes another free request later on, which keeps
+	// its counter from being pruned.
+	testClock.SetTime(now)
+	require.NoError(t, store.IncrementFreebies(
+		ctx, "service", []string{"10.0.1.0"},
+	))
+
+	numPruned, err := store.PruneFreebies(ctx, now.Add(-time.Minute))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, numPruned)
+
+	count, err := store.FreebieCount(ctx, "service", "10.0.0.0")
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	count, err = store.FreebieCount(ctx, "service", "10.0.1.0")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, count)
+
+	// Nothing is left to prune.
+	numPruned, err = store.PruneFreebies(ctx, now.Add(-time.Minute))
+	require.NoError(t, err)
+	require.Zero(t, numPruned)
+}
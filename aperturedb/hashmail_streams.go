@@ -0,0 +1,140 @@
+package aperturedb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lightninglabs/aperture/aperturedb/sqlc"
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+type (
+	NewHashMailStream = sqlc.UpsertHashMailStreamParams
+
+	// HashMailStream is the persisted descriptor of a hashmail stream.
+	HashMailStream = sqlc.HashmailStream
+)
+
+// HashMailStreamsDB is an interface that defines the set of operations that
+// can be executed against the hashmail streams database.
+type HashMailStreamsDB interface {
+	// UpsertHashMailStream inserts a new stream descriptor into the
+	// database. If a stream with the same ID already exists, its auth,
+	// creation time and creator are updated.
+	UpsertHashMailStream(ctx context.Context, arg NewHashMailStream) error
+
+	// ListHashMailStreams returns all stream descriptors stored in the
+	// database.
+	ListHashMailStreams(ctx context.Context) ([]HashMailStream, error)
+
+	// DeleteHashMailStream deletes the stream descriptor with the given
+	// ID from the database.
+	DeleteHashMailStream(ctx context.Context, streamID []byte) error
+}
+
+// HashMailStreamsDBTxOptions defines the set of db txn options the
+// HashMailStreamsDB understands.
+type HashMailStreamsDBTxOptions struct {
+	// readOnly governs if a read only transaction is needed or not.
+	readOnly bool
+}
+
+// ReadOnly returns true if the transaction should be read only.
+//
+// NOTE: This implements the TxOptions
+func (a *HashMailStreamsDBTxOptions) ReadOnly() bool {
+	return a.readOnly
+}
+
+// NewHashMailStreamsDBReadTx creates a new read transaction option set.
+func NewHashMailStreamsDBReadTx() HashMailStreamsDBTxOptions {
+	return HashMailStreamsDBTxOptions{
+		readOnly: true,
+	}
+}
+
+// BatchedHashMailStreamsDB is a version of the HashMailStreamsDB that's
+// capable of batched database operations.
+type BatchedHashMailStreamsDB interface {
+	HashMailStreamsDB
+
+	BatchedTx[HashMailStreamsDB]
+}
+
+// HashMailStreamsStore represents a storage backend.
+type HashMailStreamsStore struct {
+	db    BatchedHashMailStreamsDB
+	clock clock.Clock
+}
+
+// NewHashMailStreamsStore creates a new HashMailStreamsStore instance given an
+// open BatchedHashMailStreamsDB storage backend.
+func NewHashMailStreamsStore(
+	db BatchedHashMailStreamsDB) *HashMailStreamsStore {
+
+	return &HashMailStreamsStore{
+		db:    db,
+		clock: clock.NewDefaultClock(),
+	}
+}
+
+// AddStream stores the descriptor of a new stream. The creator is the public
+// key that signed the stream ID and may be nil.
+func (h *HashMailStreamsStore) AddStream(ctx context.Context, streamID, auth,
+	creator []byte) error {
+
+	createdAt := h.clock.Now().UTC().Truncate(time.Microsecond)
+
+	var writeTxOpts HashMailStreamsDBTxOptions
+	err := h.db.ExecTx(ctx, &writeTxOpts, func(tx HashMailStreamsDB) error {
+		return tx.UpsertHashMailStream(ctx, NewHashMailStream{
+			StreamID:  streamID,
+			Auth:      auth,
+			CreatedAt: createdAt,
+			Creator:   creator,
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store stream(%x): %w", streamID,
+			err)
+	}
+
+	return nil
+}
+
+// ListStreams returns the descriptors of all stored streams.
+func (h *HashMailStreamsStore) ListStreams(
+	ctx context.Context) ([]HashMailStream, error) {
+
+	var streams []HashMailStream
+
+	readTx := NewHashMailStreamsDBReadTx()
+	err := h.db.ExecTx(ctx, &readTx, func(tx HashMailStreamsDB) error {
+		var err error
+		streams, err = tx.ListHashMailStreams(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list streams: %w", err)
+	}
+
+	return streams, nil
+}
+
+// DeleteStream removes the descriptor of a stream. This is a NOP if the stream
+// isn't stored.
+func (h *HashMailStreamsStore) DeleteStream(ctx context.Context,
+	streamID []byte) error {
+
+	var writeTxOpts HashMailStreamsDBTxOptions
+	err := h.db.ExecTx(ctx, &writeTxOpts, func(tx HashMailStreamsDB) error {
+		return tx.DeleteHashMailStream(ctx, streamID)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete stream(%x): %w", streamID,
+			err)
+	}
+
+	return nil
+}
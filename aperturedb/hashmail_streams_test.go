@@ -0,0 +1,72 @@
+package aperturedb
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newHashMailStreamsStoreWithDB(db *BaseDB) *HashMailStreamsStore {
+	dbTxer := NewTransactionExecutor(db,
+		func(tx *sql.Tx) HashMailStreamsDB {
+			return db.WithTx(tx)
+		},
+	)
+
+	return NewHashMailStreamsStore(dbTxer)
+}
+
+func TestHashMailStreamsDB(t *testing.T) {
+	ctx := context.Background()
+
+	// First, create a new test database.
+	db := NewTestDB(t)
+	store := newHashMailStreamsStoreWithDB(db.BaseDB)
+
+	// Initially, there are no streams stored.
+	streams, err := store.ListStreams(ctx)
+	require.NoError(t, err)
+	require.Empty(t, streams)
+
+	// Store two streams.
+	id1, id2 := []byte("stream 1"), []byte("stream 2")
+	require.NoError(t, store.AddStream(ctx, id1, []byte("auth 1"), nil))
+	require.NoError(t, store.AddStream(
+		ctx, id2, []byte("auth 2"), []byte("creator 2"),
+	))
+
+	streams, err = store.ListStreams(ctx)
+	require.NoError(t, err)
+	require.Len(t, streams, 2)
+
+	// Storing an existing stream again updates its auth and creator.
+	require.NoError(t, store.AddStream(
+		ctx, id1, []byte("new auth"), []byte("creator 1"),
+	))
+
+	streams, err = store.ListStreams(ctx)
+	require.NoError(t, err)
+	require.Len(t, streams, 2)
+
+	auths := make(map[string][]byte)
+	creators := make(map[string][]byte)
+	for _, stream := range streams {
+		auths[string(stream.StreamID)] = stream.Auth
+		creators[string(stream.StreamID)] = stream.Creator
+	}
+	require.Equal(t, []byte("new auth"), auths[string(id1)])
+	require.Equal(t, []byte("auth 2"), auths[string(id2)])
+	require.Equal(t, []byte("creator 1"), creators[string(id1)])
+	require.Equal(t, []byte("creator 2"), creators[string(id2)])
+
+	// Deleting a stream removes it, deleting an unknown one is a NOP.
+	require.NoError(t, store.DeleteStream(ctx, id1))
+	require.NoError(t, store.DeleteStream(ctx, []byte("unknown")))
+
+	streams, err = store.ListStreams(ctx)
+	require.NoError(t, err)
+	require.Len(t, streams, 1)
+	require.Equal(t, id2, streams[0].StreamID)
+}
@@ -164,55 +164,30 @@ func (t *TransactionExecutor[Q]) ExecTx(ctx context.Context,
 	txOptions TxOptions, txBody func(Q) error) error {
 
 	for i := 0; i < t.opts.numRetries; i++ {
-		// Create the db transaction.
-		tx, err := t.BatchedQuerier.BeginTx(ctx, txOptions)
-		if err != nil {
-			return err
+		dbErr := MapSQLError(t.execTxOnce(ctx, txOptions, txBody))
+		if dbErr == nil {
+			return nil
 		}
 
-		// Rollback is safe to call even if the tx is already closed,
-		// so if the tx commits successfully, this is a no-op.
-		defer func() {
-			_ = tx.Rollback()
-		}()
-
-		if err := txBody(t.createQuery(tx)); err != nil {
-			dbErr := MapSQLError(err)
-
-			// At this point, we know the DB wasn't able to
-			// properly serialize the error, so we'll re-execute
-			// everything to try once again.
-			var serializationErr *ErrSerializationError
-			if errors.As(dbErr, &serializationErr) {
-				// Roll back the transaction, then pop back up
-				// to try once again.
-				_ = tx.Rollback()
-
-				retryDelay := t.opts.randRetryDelay()
-
-				log.Tracef("Retrying transaction due to tx "+
-					"serialization error, "+
-					"attempt_number=%v, delay=%v", i,
-					retryDelay)
-
-				// Before we try again, we'll wait with a
-				// random backoff based on the retry delay.
-				time.Sleep(retryDelay)
-
-				continue
-			} else {
-				return dbErr
-			}
+		// If the DB wasn't able to properly serialize the transaction
+		// or was locked by a concurrent writer, we'll re-execute
+		// everything to try once again. This applies to failures to
+		// begin or commit the transaction as well, as SQLite reports
+		// a busy database at those points.
+		var serializationErr *ErrSerializationError
+		if !errors.As(dbErr, &serializationErr) {
+			return dbErr
 		}
 
-		// Commit transaction.
-		//
-		// TODO(roasbeef): need to handle SQLITE_BUSY here?
-		if err = tx.Commit(); err != nil {
-			return MapSQLError(err)
-		}
+		retryDelay := t.opts.randRetryDelay()
+
+		log.Tracef("Retrying transaction due to tx serialization "+
+			"error, attempt_number=%v, delay=%v: %v", i, retryDelay,
+			dbErr)
 
-		return nil
+		// Before we try again, we'll wait with a random backoff based
+		// on the retry delay.
+		time.Sleep(retryDelay)
 	}
 
 	// If we get to this point, then we weren't able to successfully commit
@@ -220,6 +195,30 @@ func (t *TransactionExecutor[Q]) ExecTx(ctx context.Context,
 	return ErrRetriesExceeded
 }
 
+// execTxOnce executes the passed txBody in a single new transaction and
+// commits it. The transaction is rolled back if anything fails.
+func (t *TransactionExecutor[Q]) execTxOnce(ctx context.Context,
+	txOptions TxOptions, txBody func(Q) error) error {
+
+	// Create the db transaction.
+	tx, err := t.BatchedQuerier.BeginTx(ctx, txOptions)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is safe to call even if the tx is already closed, so if the
+	// tx commits successfully, this is a no-op.
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err := txBody(t.createQuery(tx)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 // BaseDB is the base database struct that each implementation can embed to
 // gain some common functionality.
 type BaseDB struct {
@@ -0,0 +1,98 @@
+package aperturedb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// newSqliteBusyError creates a real SQLITE_BUSY error by trying to start a
+// write transaction on a database another connection holds a write lock on.
+func newSqliteBusyError(t *testing.T) error {
+	dbFile := filepath.Join(t.TempDir(), "busy.db")
+
+	lockDB, err := sql.Open("sqlite", dbFile+"?"+sqliteTxLockImmediate)
+	require.NoError(t, err)
+	defer lockDB.Close()
+
+	lockTx, err := lockDB.Begin()
+	require.NoError(t, err)
+	defer func() {
+		_ = lockTx.Rollback()
+	}()
+
+	busyDB, err := sql.Open(
+		"sqlite", dbFile+"?_pragma=busy_timeout(0)&"+
+			sqliteTxLockImmediate,
+	)
+	require.NoError(t, err)
+	defer busyDB.Close()
+
+	_, err = busyDB.Begin()
+	require.Error(t, err)
+
+	var sqliteErr *sqlite.Error
+	require.ErrorAs(t, err, &sqliteErr)
+	require.Equal(t, sqlite3.SQLITE_BUSY, sqliteErr.Code()&0xff)
+
+	return err
+}
+
+// TestExecTxRetrySqliteBusy makes sure transactions that fail because the
+// SQLite database is busy are retried until they succeed or the retries are
+// exceeded.
+func TestExecTxRetrySqliteBusy(t *testing.T) {
+	busyErr := newSqliteBusyError(t)
+
+	var serializationErr *ErrSerializationError
+	require.ErrorAs(t, MapSQLError(busyErr), &serializationErr)
+
+	db := NewTestDB(t)
+	const numRetries = 5
+	executor := NewTransactionExecutor(
+		db.BaseDB, func(tx *sql.Tx) *sql.Tx {
+			return tx
+		}, WithTxRetries(numRetries),
+		WithTxRetryDelay(time.Millisecond),
+	)
+
+	// A transaction that is busy on all but the last attempt succeeds.
+	ctx := context.Background()
+	var txOpts OnionDBTxOptions
+	attempts := 0
+	err := executor.ExecTx(ctx, &txOpts, func(*sql.Tx) error {
+		attempts++
+		if attempts < numRetries {
+			return busyErr
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, numRetries, attempts)
+
+	// A transaction that is always busy eventually gives up.
+	attempts = 0
+	err = executor.ExecTx(ctx, &txOpts, func(*sql.Tx) error {
+		attempts++
+		return busyErr
+	})
+	require.ErrorIs(t, err, ErrRetriesExceeded)
+	require.Equal(t, numRetries, attempts)
+
+	// Other errors aren't retried.
+	attempts = 0
+	err = executor.ExecTx(ctx, &txOpts, func(*sql.Tx) error {
+		attempts++
+		return errors.New("permanent")
+	})
+	require.ErrorContains(t, err, "permanent")
+	require.Equal(t, 1, attempts)
+}
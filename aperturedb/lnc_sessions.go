@@ -31,12 +31,20 @@ type LNCSessionsDB interface {
 	GetSession(ctx context.Context,
 		passphraseEntropy []byte) (sqlc.LncSession, error)
 
+	// ListSessions returns all sessions.
+	ListSessions(ctx context.Context) ([]sqlc.LncSession, error)
+
 	// SetRemotePubKey sets the remote public key for the session.
 	SetRemotePubKey(ctx context.Context,
 		arg SetRemoteParams) error
 
 	// SetExpiry sets the expiry for the session.
 	SetExpiry(ctx context.Context, arg SetExpiryParams) error
+
+	// DeleteExpiredSessions deletes all sessions that expired before the
+	// given time and returns the number of deleted sessions.
+	DeleteExpiredSessions(ctx context.Context,
+		expiry sql.NullTime) (int64, error)
 }
 
 // LNCSessionsDBTxOptions defines the set of db txn options the LNCSessionsDB
@@ -134,40 +142,75 @@ func (l *LNCSessionsStore) GetSession(ctx context.Context,
 
 		}
 
-		privKey, _ := btcec.PrivKeyFromBytes(
-			dbSession.LocalStaticPrivKey,
-		)
-		session = &lnc.Session{
-			PassphraseWords:    dbSession.PassphraseWords,
-			PassphraseEntropy:  dbSession.PassphraseEntropy,
-			LocalStaticPrivKey: privKey,
-			MailboxAddr:        dbSession.MailboxAddr,
-			CreatedAt:          dbSession.CreatedAt,
-			DevServer:          dbSession.DevServer,
-		}
+		session, err = unmarshalSession(dbSession)
 
-		if dbSession.RemoteStaticPubKey != nil {
-			pubKey, err := btcec.ParsePubKey(
-				dbSession.RemoteStaticPubKey,
-			)
-			if err != nil {
-				return fmt.Errorf("failed to parse remote "+
-					"public key for session(%x): %w",
-					dbSession.PassphraseEntropy, err)
-			}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+
+	return session, nil
+}
+
+// ListSessions returns all stored sessions.
+func (l *LNCSessionsStore) ListSessions(ctx context.Context) ([]*lnc.Session,
+	error) {
 
-			session.RemoteStaticPubKey = pubKey
+	var sessions []*lnc.Session
+
+	readTx := NewLNCSessionsDBReadTx()
+	err := l.db.ExecTx(ctx, &readTx, func(tx LNCSessionsDB) error {
+		dbSessions, err := tx.ListSessions(ctx)
+		if err != nil {
+			return err
 		}
 
-		if dbSession.Expiry.Valid {
-			expiry := dbSession.Expiry.Time
-			session.Expiry = &expiry
+		sessions = make([]*lnc.Session, 0, len(dbSessions))
+		for _, dbSession := range dbSessions {
+			session, err := unmarshalSession(dbSession)
+			if err != nil {
+				return err
+			}
+			sessions = append(sessions, session)
 		}
 
 		return nil
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get session: %w", err)
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	return sessions, nil
+}
+
+// unmarshalSession converts a session as stored in the database into an LNC
+// session.
+func unmarshalSession(dbSession sqlc.LncSession) (*lnc.Session, error) {
+	privKey, _ := btcec.PrivKeyFromBytes(dbSession.LocalStaticPrivKey)
+	session := &lnc.Session{
+		PassphraseWords:    dbSession.PassphraseWords,
+		PassphraseEntropy:  dbSession.PassphraseEntropy,
+		LocalStaticPrivKey: privKey,
+		MailboxAddr:        dbSession.MailboxAddr,
+		CreatedAt:          dbSession.CreatedAt,
+		DevServer:          dbSession.DevServer,
+	}
+
+	if dbSession.RemoteStaticPubKey != nil {
+		pubKey, err := btcec.ParsePubKey(dbSession.RemoteStaticPubKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse remote public "+
+				"key for session(%x): %w",
+				dbSession.PassphraseEntropy, err)
+		}
+
+		session.RemoteStaticPubKey = pubKey
+	}
+
+	if dbSession.Expiry.Valid {
+		expiry := dbSession.Expiry.Time
+		session.Expiry = &expiry
 	}
 
 	return session, nil
@@ -202,7 +245,7 @@ func (l *LNCSessionsStore) SetExpiry(ctx context.Context,
 		params := SetExpiryParams{
 			PassphraseEntropy: passphraseEntropy,
 			Expiry: sql.NullTime{
-				Time:  expiry,
+				Time:  expiry.UTC(),
 				Valid: true,
 			},
 		}
@@ -216,3 +259,30 @@ func (l *LNCSessionsStore) SetExpiry(ctx context.Context,
 
 	return nil
 }
+
+// DeleteExpiredSessions deletes all sessions that expired before the given
+// time and returns the number of deleted sessions. Sessions without an expiry
+// are kept.
+func (l *LNCSessionsStore) DeleteExpiredSessions(ctx context.Context,
+	before time.Time) (int64, error) {
+
+	var (
+		writeTxOpts LNCSessionsDBTxOptions
+		numDeleted  int64
+	)
+	err := l.db.ExecTx(ctx, &writeTxOpts, func(tx LNCSessionsDB) error {
+		var err error
+		numDeleted, err = tx.DeleteExpiredSessions(ctx, sql.NullTime{
+			Time:  before.UTC(),
+			Valid: true,
+		})
+
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired sessions: %w",
+			err)
+	}
+
+	return numDeleted, nil
+}
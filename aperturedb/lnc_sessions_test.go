@@ -95,3 +95,108 @@ func TestLNCSessionsDB(t *testing.T) {
 	_, err = store.GetSession(ctxt, []byte("non-existent"))
 	require.ErrorIs(t, err, lnc.ErrSessionNotFound)
 }
+
+// TestLNCSessionsDBListSessions tests that all stored sessions are listed.
+func TestLNCSessionsDBListSessions(t *testing.T) {
+	t.Parallel()
+
+	ctxt, cancel := context.WithTimeout(
+		context.Background(), defaultTestTimeout,
+	)
+	defer cancel()
+
+	db := NewTestDB(t)
+	store := newLNCSessionsStoreWithDB(db.BaseDB)
+
+	sessions, err := store.ListSessions(ctxt)
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+
+	newSession := func() *lnc.Session {
+		words, _, err := mailbox.NewPassphraseEntropy()
+		require.NoError(t, err)
+
+		session, err := lnc.NewSession(
+			strings.Join(words[:], " "), "test-mailbox", false,
+		)
+		require.NoError(t, err)
+
+		session.LocalStaticPrivKey, err = btcec.NewPrivateKey()
+		require.NoError(t, err)
+		require.NoError(t, store.AddSession(ctxt, session))
+
+		return session
+	}
+
+	session1 := newSession()
+	session2 := newSession()
+
+	expiry := session2.CreatedAt.Add(time.Hour).Truncate(time.Millisecond)
+	session2.Expiry = &expiry
+	err = store.SetExpiry(ctxt, session2.PassphraseEntropy, expiry)
+	require.NoError(t, err)
+
+	sessions, err = store.ListSessions(ctxt)
+	require.NoError(t, err)
+	require.Equal(t, []*lnc.Session{session1, session2}, sessions)
+}
+
+// TestLNCSessionsDBDeleteExpiredSessions tests that only sessions that expired
+// before the given time are deleted.
+func TestLNCSessionsDBDeleteExpiredSessions(t *testing.T) {
+	t.Parallel()
+
+	ctxt, cancel := context.WithTimeout(
+		context.Background(), defaultTestTimeout,
+	)
+	defer cancel()
+
+	db := NewTestDB(t)
+	store := newLNCSessionsStoreWithDB(db.BaseDB)
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	newSession := func(expiry *time.Time) *lnc.Session {
+		words, _, err := mailbox.NewPassphraseEntropy()
+		require.NoError(t, err)
+
+		session, err := lnc.NewSession(
+			strings.Join(words[:], " "), "test-mailbox", false,
+		)
+		require.NoError(t, err)
+
+		session.LocalStaticPrivKey, err = btcec.NewPrivateKey()
+		require.NoError(t, err)
+		require.NoError(t, store.AddSession(ctxt, session))
+
+		if expiry != nil {
+			session.Expiry = expiry
+			err := store.SetExpiry(
+				ctxt, session.PassphraseEntropy, *expiry,
+			)
+			require.NoError(t, err)
+		}
+
+		return session
+	}
+
+	expired := now.Add(-time.Minute)
+	live := now.Add(time.Hour)
+	newSession(&expired)
+	liveSession := newSession(&live)
+	noExpirySession := newSession(nil)
+
+	numDeleted, err := store.DeleteExpiredSessions(ctxt, now)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, numDeleted)
+
+	sessions, err := store.ListSessions(ctxt)
+	require.NoError(t, err)
+	require.Equal(
+		t, []*lnc.Session{liveSession, noExpirySession}, sessions,
+	)
+
+	// Nothing is left to delete until the live session expires.
+	numDeleted, err = store.DeleteExpiredSessions(ctxt, now)
+	require.NoError(t, err)
+	require.Zero(t, numDeleted)
+}
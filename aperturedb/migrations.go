@@ -2,9 +2,14 @@ package aperturedb
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/golang-migrate/migrate/v4"
@@ -44,6 +49,81 @@ func applyMigrations(fs fs.FS, driver database.Driver, path,
 	return nil
 }
 
+// latestMigrationVersion returns the version of the latest migration that is
+// embedded in the binary, which is the schema version of a fully migrated
+// database.
+func latestMigrationVersion() (uint, error) {
+	entries, err := fs.ReadDir(sqlSchemas, "sqlc/migrations")
+	if err != nil {
+		return 0, err
+	}
+
+	var latest uint
+	for _, entry := range entries {
+		// Migration files are named <version>_<title>.up.sql.
+		prefix, _, _ := strings.Cut(entry.Name(), "_")
+		version, err := strconv.ParseUint(prefix, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid migration file name "+
+				"%v: %w", entry.Name(), err)
+		}
+
+		if uint(version) > latest {
+			latest = uint(version)
+		}
+	}
+
+	return latest, nil
+}
+
+// PingAndVerify makes sure the database is reachable and its schema version
+// matches the latest migration embedded in the binary. This catches databases
+// that weren't migrated, for example because migrations were skipped, before
+// the first query fails.
+func (s *BaseDB) PingAndVerify(ctx context.Context) error {
+	if err := s.DB.PingContext(ctx); err != nil {
+		return fmt.Errorf("unable to reach database: %w", err)
+	}
+
+	expected, err := latestMigrationVersion()
+	if err != nil {
+		return fmt.Errorf("unable to determine expected schema "+
+			"version: %w", err)
+	}
+
+	// The migration library keeps the current version in this table.
+	var (
+		actual uint
+		dirty  bool
+	)
+	err = s.DB.QueryRowContext(
+		ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1",
+	).Scan(&actual, &dirty)
+	switch {
+	// The table exists, but no migration was applied yet.
+	case errors.Is(err, sql.ErrNoRows):
+
+	case err != nil:
+		return fmt.Errorf("unable to read schema version, expected "+
+			"version %d, migrations might not have been applied: "+
+			"%w", expected, err)
+	}
+
+	switch {
+	case dirty:
+		return fmt.Errorf("database schema version %d is dirty, a "+
+			"previous migration failed and needs to be fixed "+
+			"manually", actual)
+
+	case actual != expected:
+		return fmt.Errorf("database schema version mismatch: "+
+			"expected version %d, actual version %d", expected,
+			actual)
+	}
+
+	return nil
+}
+
 // replacerFS is an implementation of a fs.FS virtual file system that wraps an
 // existing file system but does a search-and-replace operation on each file
 // when it is opened.
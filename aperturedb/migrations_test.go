@@ -0,0 +1,42 @@
+package aperturedb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestPingAndVerify makes sure a migrated database passes the check while a
+// database with an outdated or dirty schema is rejected.
+func TestPingAndVerify(t *testing.T) {
+	ctx := context.Background()
+	db := NewTestDB(t)
+
+	expected, err := latestMigrationVersion()
+	require.NoError(t, err)
+	require.Positive(t, expected)
+
+	require.NoError(t, db.PingAndVerify(ctx))
+
+	// An outdated schema is reported with both versions.
+	_, err = db.ExecContext(ctx, "UPDATE schema_migrations SET version = 1")
+	require.NoError(t, err)
+	err = db.PingAndVerify(ctx)
+	require.ErrorContains(t, err, "actual version 1")
+	require.ErrorContains(t, err, "expected version")
+
+	// A failed migration leaves the schema dirty.
+	_, err = db.ExecContext(
+		ctx, "UPDATE schema_migrations SET dirty = true",
+	)
+	require.NoError(t, err)
+	require.ErrorContains(t, db.PingAndVerify(ctx), "is dirty")
+
+	// Without the migration table, the database was never migrated.
+	_, err = db.ExecContext(ctx, "DROP TABLE schema_migrations")
+	require.NoError(t, err)
+	require.ErrorContains(
+		t, db.PingAndVerify(ctx), "migrations might not have been",
+	)
+}
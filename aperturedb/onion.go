@@ -127,7 +127,7 @@ func (o *OnionStore) PrivateKey() ([]byte, error) {
 
 	var readTxOpts OnionDBTxOptions
 	err := o.db.ExecTx(ctxt, &readTxOpts, func(tx OnionDB) error {
-		row, err := o.db.SelectOnionPrivateKey(ctxt)
+		row, err := tx.SelectOnionPrivateKey(ctxt)
 		switch {
 		case err == sql.ErrNoRows:
 			return tor.ErrNoPrivateKey
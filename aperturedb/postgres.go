@@ -15,6 +15,13 @@ import (
 
 const (
 	dsnTemplate = "postgres://%v:%v@%v:%d/%v?sslmode=%v"
+
+	// defaultMaxConns is the default number of permitted active
+	// connections. We want to limit this so it isn't unlimited. By default
+	// we use the same value for the number of idle connections, as this
+	// can speed up queries given a new connection doesn't need to be
+	// established each time.
+	defaultMaxConns = 25
 )
 
 var (
@@ -36,6 +43,20 @@ type PostgresConfig struct {
 	DBName             string `long:"dbname" description:"Database name to use."`
 	MaxOpenConnections int32  `long:"maxconnections" description:"Max open connections to keep alive to the database server."`
 	RequireSSL         bool   `long:"requiressl" description:"Whether to require using SSL (mode: require) when connecting to the server."`
+
+	// MaxIdleConnections is the maximum number of idle connections kept
+	// in the pool. If zero, the maximum number of open connections is
+	// used.
+	MaxIdleConnections int32 `long:"maxidleconnections" description:"Max idle connections to keep in the pool, defaults to the max open connections."`
+
+	// ConnMaxLifetime is the maximum time a connection is reused before it
+	// is closed. If zero, connections are closed after five minutes.
+	ConnMaxLifetime time.Duration `long:"connmaxlifetime" description:"The maximum time a connection may be reused, defaults to 5m."`
+
+	// ConnMaxIdleTime is the maximum time a connection may be idle before
+	// it is closed. If zero, idle connections are only closed once they
+	// reached their maximum lifetime.
+	ConnMaxIdleTime time.Duration `long:"connmaxidletime" description:"The maximum time a connection may be idle, unlimited if zero."`
 }
 
 // DSN returns the dns to connect to the database.
@@ -77,10 +98,19 @@ func NewPostgresStore(cfg *PostgresConfig) (*PostgresStore, error) {
 	if cfg.MaxOpenConnections > 0 {
 		maxConns = int(cfg.MaxOpenConnections)
 	}
+	maxIdleConns := maxConns
+	if cfg.MaxIdleConnections > 0 {
+		maxIdleConns = int(cfg.MaxIdleConnections)
+	}
+	connMaxLifetime := connIdleLifetime
+	if cfg.ConnMaxLifetime > 0 {
+		connMaxLifetime = cfg.ConnMaxLifetime
+	}
 
 	rawDB.SetMaxOpenConns(maxConns)
-	rawDB.SetMaxIdleConns(maxConns)
-	rawDB.SetConnMaxLifetime(connIdleLifetime)
+	rawDB.SetMaxIdleConns(maxIdleConns)
+	rawDB.SetConnMaxLifetime(connMaxLifetime)
+	rawDB.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
 
 	if !cfg.SkipMigrations {
 		// Now that the database is open, populate the database with
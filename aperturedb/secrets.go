@@ -5,7 +5,9 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/lightninglabs/aperture/aperturedb/sqlc"
 	"github.com/lightninglabs/aperture/l402"
@@ -32,6 +34,11 @@ type SecretsDB interface {
 	// DeleteSecretByHash removes the secret that corresponds to the given
 	// hash.
 	DeleteSecretByHash(ctx context.Context, hash []byte) (int64, error)
+
+	// DeleteExpiredSecrets removes all secrets that expired before the
+	// given time.
+	DeleteExpiredSecrets(ctx context.Context,
+		expiresAt sql.NullTime) (int64, error)
 }
 
 // SecretsTxOptions defines the set of db txn options the SecretsStore
@@ -63,6 +70,12 @@ type BatchedSecretsDB interface {
 	BatchedTx[SecretsDB]
 }
 
+// A compile-time constraint to ensure SecretsStore can record the expiry of
+// secrets, revoke secrets in batches and prune expired secrets.
+var _ mint.ExpiringSecretStore = (*SecretsStore)(nil)
+var _ mint.BatchSecretRevoker = (*SecretsStore)(nil)
+var _ mint.SecretPruner = (*SecretsStore)(nil)
+
 // SecretsStore represents a storage backend.
 type SecretsStore struct {
 	db    BatchedSecretsDB
@@ -79,10 +92,20 @@ func NewSecretsStore(db BatchedSecretsDB) *SecretsStore {
 }
 
 // NewSecret creates a new cryptographically random secret which is
-// keyed by the given hash.
+// keyed by the given hash. If there already is a secret for the hash,
+// mint.ErrSecretExists is returned and the existing secret is kept.
 func (s *SecretsStore) NewSecret(ctx context.Context,
 	hash [sha256.Size]byte) ([l402.SecretSize]byte, error) {
 
+	return s.NewExpiringSecret(ctx, hash, time.Time{})
+}
+
+// NewExpiringSecret creates a new secret like NewSecret that can be pruned
+// after the given expiry, unless it is zero.
+func (s *SecretsStore) NewExpiringSecret(ctx context.Context,
+	hash [sha256.Size]byte, expiry time.Time) ([l402.SecretSize]byte,
+	error) {
+
 	var secret [l402.SecretSize]byte
 	if _, err := rand.Read(secret[:]); err != nil {
 		return [l402.SecretSize]byte{}, err
@@ -90,10 +113,25 @@ func (s *SecretsStore) NewSecret(ctx context.Context,
 
 	var writeTxOpts SecretsDBTxOptions
 	err := s.db.ExecTx(ctx, &writeTxOpts, func(tx SecretsDB) error {
-		_, err := tx.InsertSecret(ctx, NewSecret{
+		// Never add a second secret for the same hash, as it would be
+		// ambiguous which one is used for verification.
+		_, err := tx.GetSecretByHash(ctx, hash[:])
+		switch {
+		case err == nil:
+			return mint.ErrSecretExists
+
+		case !errors.Is(err, sql.ErrNoRows):
+			return err
+		}
+
+		_, err = tx.InsertSecret(ctx, NewSecret{
 			Hash:      hash[:],
 			Secret:    secret[:],
 			CreatedAt: s.clock.Now().UTC(),
+			ExpiresAt: sql.NullTime{
+				Time:  expiry.UTC(),
+				Valid: !expiry.IsZero(),
+			},
 		})
 		if err != nil {
 			return err
@@ -121,7 +159,7 @@ func (s *SecretsStore) GetSecret(ctx context.Context,
 	err := s.db.ExecTx(ctx, &readOpts, func(db SecretsDB) error {
 		secretRow, err := db.GetSecretByHash(ctx, hash[:])
 		switch {
-		case err == sql.ErrNoRows:
+		case errors.Is(err, sql.ErrNoRows):
 			return mint.ErrSecretNotFound
 
 		case err != nil:
@@ -169,3 +207,57 @@ func (s *SecretsStore) RevokeSecret(ctx context.Context,
 
 	return nil
 }
+
+// RevokeSecrets removes the cryptographically random secrets that correspond
+// to the given hashes within a single transaction. Either all of them are
+// removed or none. Hashes without a secret are ignored.
+func (s *SecretsStore) RevokeSecrets(ctx context.Context,
+	hashes [][sha256.Size]byte) error {
+
+	var writeTxOpts SecretsDBTxOptions
+	err := s.db.ExecTx(ctx, &writeTxOpts, func(tx SecretsDB) error {
+		for _, hash := range hashes {
+			_, err := tx.DeleteSecretByHash(ctx, hash[:])
+			if err != nil {
+				return fmt.Errorf("hash(%x): %w", hash, err)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("unable to revoke %d secrets: %w",
+			len(hashes), err)
+	}
+
+	return nil
+}
+
+// PruneSecrets removes all secrets whose expiry is before the given time and
+// returns the number of removed secrets. Secrets without an expiry are kept.
+//
+// NOTE: This is part of the mint.SecretPruner interface.
+func (s *SecretsStore) PruneSecrets(ctx context.Context,
+	before time.Time) (int64, error) {
+
+	var (
+		writeTxOpts SecretsDBTxOptions
+		numPruned   int64
+	)
+	err := s.db.ExecTx(ctx, &writeTxOpts, func(tx SecretsDB) error {
+		var err error
+		numPruned, err = tx.DeleteExpiredSecrets(ctx, sql.NullTime{
+			Time:  before.UTC(),
+			Valid: true,
+		})
+
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("unable to prune expired secrets: %w",
+			err)
+	}
+
+	return numPruned, nil
+}
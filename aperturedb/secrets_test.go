@@ -54,6 +54,15 @@ func TestSecretDB(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, secret, dbSecret)
 
+	// Creating another secret for the same hash should fail and leave the
+	// existing secret in place.
+	_, err = store.NewSecret(ctxt, hash)
+	require.ErrorIs(t, err, mint.ErrSecretExists)
+
+	dbSecret, err = store.GetSecret(ctxt, hash)
+	require.NoError(t, err)
+	require.Equal(t, secret, dbSecret)
+
 	// Revoke the secret.
 	err = store.RevokeSecret(ctxt, hash)
 	require.NoError(t, err)
@@ -62,3 +71,68 @@ func TestSecretDB(t *testing.T) {
 	_, err = store.GetSecret(ctxt, hash)
 	require.ErrorIs(t, err, mint.ErrSecretNotFound)
 }
+
+// TestSecretDBRevokeSecrets makes sure a batch of secrets is revoked at once.
+func TestSecretDBRevokeSecrets(t *testing.T) {
+	ctxt, cancel := context.WithTimeout(
+		context.Background(), defaultTestTimeout,
+	)
+	defer cancel()
+
+	db := NewTestDB(t)
+	store := newSecretsStoreWithDB(db.BaseDB)
+
+	hashes := make([][sha256.Size]byte, 3)
+	for i := range hashes {
+		_, err := rand.Read(hashes[i][:])
+		require.NoError(t, err)
+	}
+
+	// Only the first two hashes have a secret, the missing one is
+	// ignored.
+	for _, hash := range hashes[:2] {
+		_, err := store.NewSecret(ctxt, hash)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, store.RevokeSecrets(ctxt, hashes))
+	for _, hash := range hashes {
+		_, err := store.GetSecret(ctxt, hash)
+		require.ErrorIs(t, err, mint.ErrSecretNotFound)
+	}
+}
+
+// TestSecretDBPruneSecrets makes sure only the secrets that expired are pruned.
+func TestSecretDBPruneSecrets(t *testing.T) {
+	ctxt, cancel := context.WithTimeout(
+		context.Background(), defaultTestTimeout,
+	)
+	defer cancel()
+
+	db := NewTestDB(t)
+	store := newSecretsStoreWithDB(db.BaseDB)
+
+	now := time.Unix(1000, 0)
+	expiries := []time.Time{
+		now.Add(-time.Hour), now.Add(time.Hour), {},
+	}
+	hashes := make([][sha256.Size]byte, len(expiries))
+	for i, expiry := range expiries {
+		_, err := rand.Read(hashes[i][:])
+		require.NoError(t, err)
+
+		_, err = store.NewExpiringSecret(ctxt, hashes[i], expiry)
+		require.NoError(t, err)
+	}
+
+	numPruned, err := store.PruneSecrets(ctxt, now)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, numPruned)
+
+	_, err = store.GetSecret(ctxt, hashes[0])
+	require.ErrorIs(t, err, mint.ErrSecretNotFound)
+	for _, hash := range hashes[1:] {
+		_, err := store.GetSecret(ctxt, hash)
+		require.NoError(t, err)
+	}
+}
@@ -11,6 +11,19 @@ import (
 	"time"
 )
 
+const deleteExpiredSessions = `-- name: DeleteExpiredSessions :execrows
+DELETE FROM lnc_sessions
+WHERE expiry IS NOT NULL AND expiry < $1
+`
+
+func (q *Queries) DeleteExpiredSessions(ctx context.Context, expiry sql.NullTime) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteExpiredSessions, expiry)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const getSession = `-- name: GetSession :one
 SELECT id, passphrase_words, passphrase_entropy, remote_static_pub_key, local_static_priv_key, mailbox_addr, created_at, expiry, dev_server
 FROM lnc_sessions
@@ -66,6 +79,45 @@ func (q *Queries) InsertSession(ctx context.Context, arg InsertSessionParams) er
 	return err
 }
 
+const listSessions = `-- name: ListSessions :many
+SELECT id, passphrase_words, passphrase_entropy, remote_static_pub_key, local_static_priv_key, mailbox_addr, created_at, expiry, dev_server
+FROM lnc_sessions
+ORDER BY id
+`
+
+func (q *Queries) ListSessions(ctx context.Context) ([]LncSession, error) {
+	rows, err := q.db.QueryContext(ctx, listSessions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []LncSession
+	for rows.Next() {
+		var i LncSession
+		if err := rows.Scan(
+			&i.ID,
+			&i.PassphraseWords,
+			&i.PassphraseEntropy,
+			&i.RemoteStaticPubKey,
+			&i.LocalStaticPrivKey,
+			&i.MailboxAddr,
+			&i.CreatedAt,
+			&i.Expiry,
+			&i.DevServer,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const setExpiry = `-- name: SetExpiry :exec
 UPDATE lnc_sessions
 SET expiry=$1
@@ -0,0 +1,13 @@
+-- hashmail_streams is used to store the descriptors of the hashmail streams
+-- so they can be restored after a restart.
+CREATE TABLE IF NOT EXISTS hashmail_streams (
+    -- stream_id is the unique ID of the stream.
+    stream_id BLOB NOT NULL UNIQUE,
+
+    -- auth is the serialized authentication that was used to create the
+    -- stream.
+    auth BLOB NOT NULL,
+
+    -- created_at is the time the stream was created.
+    created_at TIMESTAMP NOT NULL
+);
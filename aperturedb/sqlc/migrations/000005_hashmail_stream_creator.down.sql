@@ -0,0 +1 @@
+ALTER TABLE hashmail_streams DROP COLUMN creator;
@@ -0,0 +1,4 @@
+-- creator is the compressed public key that signed the ID of the stream when
+-- it was created. It is NULL for streams that were created without a
+-- signature.
+ALTER TABLE hashmail_streams ADD COLUMN creator BLOB;
@@ -0,0 +1,19 @@
+-- freebies is used to store the number of free requests that clients made to
+-- a service, so they can't gain additional free requests through a restart.
+CREATE TABLE IF NOT EXISTS freebies (
+    -- service_name is the name of the service the free requests were made
+    -- to.
+    service_name TEXT NOT NULL,
+
+    -- counter_key is the masked IP address or the token ID the free
+    -- requests are counted by.
+    counter_key TEXT NOT NULL,
+
+    -- num_requests is the number of free requests that were counted.
+    num_requests BIGINT NOT NULL,
+
+    -- last_seen is the time the last free request was counted.
+    last_seen TIMESTAMP NOT NULL,
+
+    UNIQUE (service_name, counter_key)
+);
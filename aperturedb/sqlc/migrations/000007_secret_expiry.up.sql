@@ -0,0 +1,6 @@
+-- expires_at is the time after which the L402 the secret belongs to no longer
+-- grants access to any service, so the secret can be pruned. It is NULL for
+-- secrets of L402s that never expire.
+ALTER TABLE secrets ADD COLUMN expires_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS secrets_expires_at_idx ON secrets (expires_at);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS lnc_sessions_expiry_idx;
@@ -0,0 +1,3 @@
+-- Expired sessions are pruned by their expiry, so we index it to avoid a full
+-- table scan each time.
+CREATE INDEX IF NOT EXISTS lnc_sessions_expiry_idx ON lnc_sessions (expiry);
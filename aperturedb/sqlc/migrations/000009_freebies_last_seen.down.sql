@@ -0,0 +1 @@
+DROP INDEX IF EXISTS freebies_last_seen_idx;
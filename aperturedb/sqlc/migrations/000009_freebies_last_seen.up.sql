@@ -0,0 +1,3 @@
+-- The counters of clients that haven't made a free request in a while are
+-- pruned by their last_seen time.
+CREATE INDEX IF NOT EXISTS freebies_last_seen_idx ON freebies (last_seen);
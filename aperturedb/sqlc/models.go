@@ -9,6 +9,20 @@ import (
 	"time"
 )
 
+type Freeby struct {
+	ServiceName string
+	CounterKey  string
+	NumRequests int64
+	LastSeen    time.Time
+}
+
+type HashmailStream struct {
+	StreamID  []byte
+	Auth      []byte
+	CreatedAt time.Time
+	Creator   []byte
+}
+
 type LncSession struct {
 	ID                 int32
 	PassphraseWords    string
@@ -31,4 +45,5 @@ type Secret struct {
 	Hash      []byte
 	Secret    []byte
 	CreatedAt time.Time
+	ExpiresAt sql.NullTime
 }
@@ -6,18 +6,30 @@ package sqlc
 
 import (
 	"context"
+	"database/sql"
+	"time"
 )
 
 type Querier interface {
+	DeleteExpiredSecrets(ctx context.Context, expiresAt sql.NullTime) (int64, error)
+	DeleteExpiredSessions(ctx context.Context, expiry sql.NullTime) (int64, error)
+	DeleteFreebieCount(ctx context.Context, arg DeleteFreebieCountParams) error
+	DeleteHashMailStream(ctx context.Context, streamID []byte) error
 	DeleteOnionPrivateKey(ctx context.Context) error
 	DeleteSecretByHash(ctx context.Context, hash []byte) (int64, error)
+	DeleteStaleFreebies(ctx context.Context, lastSeen time.Time) (int64, error)
+	GetFreebieCount(ctx context.Context, arg GetFreebieCountParams) (int64, error)
 	GetSecretByHash(ctx context.Context, hash []byte) ([]byte, error)
 	GetSession(ctx context.Context, passphraseEntropy []byte) (LncSession, error)
+	IncrementFreebieCount(ctx context.Context, arg IncrementFreebieCountParams) error
 	InsertSecret(ctx context.Context, arg InsertSecretParams) (int32, error)
 	InsertSession(ctx context.Context, arg InsertSessionParams) error
+	ListHashMailStreams(ctx context.Context) ([]HashmailStream, error)
+	ListSessions(ctx context.Context) ([]LncSession, error)
 	SelectOnionPrivateKey(ctx context.Context) ([]byte, error)
 	SetExpiry(ctx context.Context, arg SetExpiryParams) error
 	SetRemotePubKey(ctx context.Context, arg SetRemotePubKeyParams) error
+	UpsertHashMailStream(ctx context.Context, arg UpsertHashMailStreamParams) error
 	UpsertOnion(ctx context.Context, arg UpsertOnionParams) error
 }
 
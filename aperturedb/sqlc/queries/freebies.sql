@@ -0,0 +1,22 @@
+-- name: GetFreebieCount :one
+SELECT num_requests
+FROM freebies
+WHERE service_name = $1 AND counter_key = $2;
+
+-- name: IncrementFreebieCount :exec
+INSERT INTO freebies (
+    service_name, counter_key, num_requests, last_seen
+) VALUES (
+    $1, $2, 1, $3
+) ON CONFLICT (
+    service_name, counter_key
+) DO UPDATE SET num_requests = freebies.num_requests + 1,
+    last_seen = excluded.last_seen;
+
+-- name: DeleteFreebieCount :exec
+DELETE FROM freebies
+WHERE service_name = $1 AND counter_key = $2;
+
+-- name: DeleteStaleFreebies :execrows
+DELETE FROM freebies
+WHERE last_seen < $1;
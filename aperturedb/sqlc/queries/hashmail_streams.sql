@@ -0,0 +1,17 @@
+-- name: UpsertHashMailStream :exec
+INSERT INTO hashmail_streams (
+    stream_id, auth, created_at, creator
+) VALUES (
+    $1, $2, $3, $4
+) ON CONFLICT (
+    stream_id
+) DO UPDATE SET auth = excluded.auth, created_at = excluded.created_at,
+    creator = excluded.creator;
+
+-- name: ListHashMailStreams :many
+SELECT stream_id, auth, created_at, creator
+FROM hashmail_streams;
+
+-- name: DeleteHashMailStream :exec
+DELETE FROM hashmail_streams
+WHERE stream_id = $1;
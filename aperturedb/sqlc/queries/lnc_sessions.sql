@@ -6,11 +6,20 @@ INSERT INTO lnc_sessions (
     $1, $2, $3, $4, $5, $6, $7
 );
 
+-- name: DeleteExpiredSessions :execrows
+DELETE FROM lnc_sessions
+WHERE expiry IS NOT NULL AND expiry < $1;
+
 -- name: GetSession :one
 SELECT *
 FROM lnc_sessions
 WHERE passphrase_entropy = $1;
 
+-- name: ListSessions :many
+SELECT *
+FROM lnc_sessions
+ORDER BY id;
+
 -- name: SetRemotePubKey :exec
 UPDATE lnc_sessions
 SET remote_static_pub_key=$1
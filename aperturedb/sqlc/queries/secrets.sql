@@ -1,8 +1,8 @@
 -- name: InsertSecret :one
 INSERT INTO secrets (
-    hash, secret, created_at
+    hash, secret, created_at, expires_at
 ) VALUES (
-    $1, $2, $3
+    $1, $2, $3, $4
 ) RETURNING id;
 
 -- name: GetSecretByHash :one
@@ -13,3 +13,7 @@ WHERE hash = $1;
 -- name: DeleteSecretByHash :execrows
 DELETE FROM secrets
 WHERE hash = $1;
+
+-- name: DeleteExpiredSecrets :execrows
+DELETE FROM secrets
+WHERE expires_at IS NOT NULL AND expires_at < $1;
@@ -7,9 +7,23 @@ package sqlc
 
 import (
 	"context"
+	"database/sql"
 	"time"
 )
 
+const deleteExpiredSecrets = `-- name: DeleteExpiredSecrets :execrows
+DELETE FROM secrets
+WHERE expires_at IS NOT NULL AND expires_at < $1
+`
+
+func (q *Queries) DeleteExpiredSecrets(ctx context.Context, expiresAt sql.NullTime) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteExpiredSecrets, expiresAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const deleteSecretByHash = `-- name: DeleteSecretByHash :execrows
 DELETE FROM secrets
 WHERE hash = $1
@@ -38,9 +52,9 @@ func (q *Queries) GetSecretByHash(ctx context.Context, hash []byte) ([]byte, err
 
 const insertSecret = `-- name: InsertSecret :one
 INSERT INTO secrets (
-    hash, secret, created_at
+    hash, secret, created_at, expires_at
 ) VALUES (
-    $1, $2, $3
+    $1, $2, $3, $4
 ) RETURNING id
 `
 
@@ -48,10 +62,16 @@ type InsertSecretParams struct {
 	Hash      []byte
 	Secret    []byte
 	CreatedAt time.Time
+	ExpiresAt sql.NullTime
 }
 
 func (q *Queries) InsertSecret(ctx context.Context, arg InsertSecretParams) (int32, error) {
-	row := q.db.QueryRowContext(ctx, insertSecret, arg.Hash, arg.Secret, arg.CreatedAt)
+	row := q.db.QueryRowContext(ctx, insertSecret,
+		arg.Hash,
+		arg.Secret,
+		arg.CreatedAt,
+		arg.ExpiresAt,
+	)
 	var id int32
 	err := row.Scan(&id)
 	return id, err
@@ -45,6 +45,17 @@ func parseSqliteError(sqliteErr *sqlite.Error) error {
 		return &ErrSQLUniqueConstraintViolation{
 			DBError: sqliteErr,
 		}
+	}
+
+	// The lower byte of extended result codes contains the primary result
+	// code, so we also catch errors like SQLITE_BUSY_SNAPSHOT here.
+	switch sqliteErr.Code() & 0xff {
+	// The database is locked by a concurrent writer, so just like with a
+	// serialization failure, we'll need to try again.
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return &ErrSerializationError{
+			DBError: sqliteErr,
+		}
 
 	default:
 		return fmt.Errorf("unknown sqlite error: %w", sqliteErr)
@@ -24,12 +24,11 @@ const (
 	// transactions are started immediately.
 	sqliteTxLockImmediate = "_txlock=immediate"
 
-	// defaultMaxConns is the number of permitted active and idle
-	// connections. We want to limit this so it isn't unlimited. We use the
-	// same value for the number of idle connections as, this can speed up
-	// queries given a new connection doesn't need to be established each
-	// time.
-	defaultMaxConns = 25
+	// sqliteMaxConns is the number of permitted active and idle
+	// connections to a SQLite database. SQLite only allows a single writer
+	// at a time, so additional connections would only fail with
+	// SQLITE_BUSY once the busy timeout is reached.
+	sqliteMaxConns = 1
 
 	// connIdleLifetime is the amount of time a connection can be idle.
 	connIdleLifetime = 5 * time.Minute
@@ -113,8 +112,8 @@ func NewSqliteStore(cfg *SqliteConfig) (*SqliteStore, error) {
 		return nil, err
 	}
 
-	db.SetMaxOpenConns(defaultMaxConns)
-	db.SetMaxIdleConns(defaultMaxConns)
+	db.SetMaxOpenConns(sqliteMaxConns)
+	db.SetMaxIdleConns(sqliteMaxConns)
 	db.SetConnMaxLifetime(connIdleLifetime)
 
 	if !cfg.SkipMigrations {
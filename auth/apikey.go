@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+const (
+	// DefaultAPIKeyHeader is the default header field clients send their
+	// API key in.
+	DefaultAPIKeyHeader = "X-Api-Key"
+)
+
+var (
+	// ErrNoChallenge is returned by authenticators that can't issue
+	// challenges, because their credentials can't be obtained by paying.
+	ErrNoChallenge = errors.New("authenticator can't issue challenges")
+)
+
+// APIKeyAuthenticator is an authenticator that accepts requests carrying one
+// of a set of static API keys in a header field. It is meant for trusted
+// callers and is usually combined with an L402Authenticator through a
+// CompositeAuthenticator, as it can't issue challenges itself.
+type APIKeyAuthenticator struct {
+	header string
+	keys   [][]byte
+}
+
+// A compile time flag to ensure the APIKeyAuthenticator satisfies the
+// Authenticator interface.
+var _ Authenticator = (*APIKeyAuthenticator)(nil)
+
+// NewAPIKeyAuthenticator creates a new authenticator that accepts requests
+// with any of the given keys in the given header field. If the header is
+// empty, DefaultAPIKeyHeader is used.
+func NewAPIKeyAuthenticator(header string,
+	keys []string) (*APIKeyAuthenticator, error) {
+
+	if header == "" {
+		header = DefaultAPIKeyHeader
+	}
+
+	a := &APIKeyAuthenticator{
+		header: header,
+		keys:   make([][]byte, 0, len(keys)),
+	}
+	for _, key := range keys {
+		if key == "" {
+			return nil, errors.New("API keys must not be empty")
+		}
+
+		a.keys = append(a.keys, []byte(key))
+	}
+
+	return a, nil
+}
+
+// Accept returns whether or not the header contains one of the API keys. The
+// keys are compared in constant time so they can't be guessed by timing the
+// responses.
+//
+// NOTE: This is part of the Authenticator interface.
+func (a *APIKeyAuthenticator) Accept(header *http.Header, _ string) bool {
+	value := []byte(header.Get(a.header))
+	if len(value) == 0 {
+		return false
+	}
+
+	accepted := 0
+	for _, key := range a.keys {
+		accepted |= subtle.ConstantTimeCompare(value, key)
+	}
+
+	return accepted == 1
+}
+
+// FreshChallengeHeader always returns ErrNoChallenge, as API keys can't be
+// obtained by completing a challenge.
+//
+// NOTE: This is part of the Authenticator interface.
+func (a *APIKeyAuthenticator) FreshChallengeHeader(string, int64) (http.Header,
+	error) {
+
+	return nil, ErrNoChallenge
+}
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"fmt"
@@ -9,66 +10,277 @@ import (
 	"github.com/lightninglabs/aperture/l402"
 	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
 )
 
 // L402Authenticator is an authenticator that uses the L402 protocol to
 // authenticate requests.
 type L402Authenticator struct {
-	minter  Minter
-	checker InvoiceChecker
+	minter          Minter
+	checker         InvoiceChecker
+	minInvoiceState MinInvoiceStateFunc
+
+	// capability determines the capability a request accesses. It is nil
+	// if capability downgrades aren't enforced.
+	capability CapabilityFunc
+
+	// cacheChallengeHeader is true if the challenge header is built from
+	// its precomputed constant parts.
+	cacheChallengeHeader bool
+
+	// dualHeaderPolicy defines how the credentials are chosen if a client
+	// sends both an LSAT and an L402 authorization header.
+	dualHeaderPolicy l402.DualHeaderPolicy
+
+	// macaroonSizeMetric is true if the size of each verified macaroon is
+	// recorded.
+	macaroonSizeMetric bool
+}
+
+// MinInvoiceStateFunc returns the minimum state the invoice of an L402 must
+// have reached for the token to grant access to the given service. Only
+// lnrpc.Invoice_ACCEPTED and lnrpc.Invoice_SETTLED are meaningful, any other
+// value is treated as lnrpc.Invoice_SETTLED.
+type MinInvoiceStateFunc func(serviceName string) lnrpc.Invoice_InvoiceState
+
+// CapabilityFunc returns the capability of the given service that the given
+// request accesses. If empty, capability downgrades of L402s aren't enforced
+// for the request.
+type CapabilityFunc func(r *http.Request, serviceName string) string
+
+// L402AuthenticatorOption is a functional option that can be used to modify
+// the behavior of an L402Authenticator.
+type L402AuthenticatorOption func(*L402Authenticator)
+
+// WithMinInvoiceState sets the function that is used to look up the minimum
+// invoice state required for each service. Without this option, all services
+// require the invoice to be settled. Services that accept an ACCEPTED invoice
+// also accept L402s with a zero preimage, as the payer of a hold invoice only
+// learns its preimage once it's settled.
+func WithMinInvoiceState(f MinInvoiceStateFunc) L402AuthenticatorOption {
+	return func(l *L402Authenticator) {
+		l.minInvoiceState = f
+	}
+}
+
+// WithCapability sets the function that is used to determine the capability a
+// request accesses, so the capability downgrade caveats of L402s are enforced.
+// Without this option, capability downgrades aren't enforced.
+func WithCapability(f CapabilityFunc) L402AuthenticatorOption {
+	return func(l *L402Authenticator) {
+		l.capability = f
+	}
 }
 
 // A compile time flag to ensure the L402Authenticator satisfies the
-// Authenticator interface.
-var _ Authenticator = (*L402Authenticator)(nil)
+// IdentityAuthenticator and TieredAuthenticator interfaces.
+var (
+	_ IdentityAuthenticator = (*L402Authenticator)(nil)
+	_ TieredAuthenticator   = (*L402Authenticator)(nil)
+)
+
+// WithChallengeHeaderCache enables caching the parts of the challenge header
+// that are the same for every challenge, so only the invoice and macaroon need
+// to be encoded for each 402 response.
+func WithChallengeHeaderCache() L402AuthenticatorOption {
+	return func(l *L402Authenticator) {
+		l.cacheChallengeHeader = true
+	}
+}
+
+// WithDualHeaderPolicy sets the policy that defines how the credentials are
+// chosen if a client sends both an LSAT and an L402 authorization header.
+// Without this option, the L402 header is preferred.
+func WithDualHeaderPolicy(
+	policy l402.DualHeaderPolicy) L402AuthenticatorOption {
+
+	return func(l *L402Authenticator) {
+		l.dualHeaderPolicy = policy
+	}
+}
+
+// WithMacaroonSizeMetric enables recording the serialized size of each
+// macaroon that is successfully verified in a Prometheus histogram, so
+// services issuing bloated tokens can be spotted.
+func WithMacaroonSizeMetric() L402AuthenticatorOption {
+	return func(l *L402Authenticator) {
+		l.macaroonSizeMetric = true
+	}
+}
 
 // NewL402Authenticator creates a new authenticator that authenticates requests
 // based on L402 tokens.
-func NewL402Authenticator(minter Minter,
-	checker InvoiceChecker) *L402Authenticator {
+func NewL402Authenticator(minter Minter, checker InvoiceChecker,
+	opts ...L402AuthenticatorOption) *L402Authenticator {
 
-	return &L402Authenticator{
+	l := &L402Authenticator{
 		minter:  minter,
 		checker: checker,
+		minInvoiceState: func(string) lnrpc.Invoice_InvoiceState {
+			return lnrpc.Invoice_SETTLED
+		},
+		dualHeaderPolicy: l402.DualHeaderPreferL402,
 	}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	return l
 }
 
 // Accept returns whether or not the header successfully authenticates the user
-// to a given backend service.
+// to a given backend service. As the request method is unknown, L402s that are
+// restricted to certain methods are rejected.
 //
 // NOTE: This is part of the Authenticator interface.
 func (l *L402Authenticator) Accept(header *http.Header, serviceName string) bool {
+	_, accepted := l.accept(header, serviceName, "", "")
+	return accepted
+}
+
+// AcceptRequest returns whether or not the request successfully authenticates
+// the user to a given backend service.
+//
+// NOTE: This is part of the RequestAuthenticator interface.
+func (l *L402Authenticator) AcceptRequest(r *http.Request,
+	serviceName string) bool {
+
+	_, accepted := l.AcceptRequestIdentity(r, serviceName)
+	return accepted
+}
+
+// AcceptRequestIdentity returns whether or not the request successfully
+// authenticates the user to a given backend service, together with the
+// identifier of the verified L402.
+//
+// NOTE: This is part of the IdentityAuthenticator interface.
+func (l *L402Authenticator) AcceptRequestIdentity(r *http.Request,
+	serviceName string) (*l402.Identifier, bool) {
+
+	var capability string
+	if l.capability != nil {
+		capability = l.capability(r, serviceName)
+	}
+
+	return l.accept(&r.Header, serviceName, r.Method, capability)
+}
+
+// accept returns whether or not the header of a request with the given method
+// that accesses the given capability successfully authenticates the user to a
+// given backend service and, if so, the identifier of the verified L402.
+func (l *L402Authenticator) accept(header *http.Header, serviceName, method,
+	capability string) (*l402.Identifier, bool) {
+
 	// Try reading the macaroon and preimage from the HTTP header. This can
 	// be in different header fields depending on the implementation and/or
 	// protocol.
-	mac, preimage, err := l402.FromHeader(header)
+	mac, preimage, err := l402.FromHeaderWithPolicy(
+		header, l.dualHeaderPolicy,
+	)
 	if err != nil {
 		log.Debugf("Deny: %v", err)
-		return false
+		return nil, false
 	}
 
+	discharges, err := l402.DischargesFromHeader(header)
+	if err != nil {
+		log.Debugf("Deny: %v", err)
+		return nil, false
+	}
+
+	// The payer of a hold invoice only learns its preimage once the
+	// invoice is settled, so services that accept L402s with an accepted
+	// invoice also accept the zero preimage clients send while their
+	// payment is pending. The invoice state check below proves the payment
+	// instead.
+	minState := l.minInvoiceState(serviceName)
 	verificationParams := &mint.VerificationParams{
-		Macaroon:      mac,
-		Preimage:      preimage,
-		TargetService: serviceName,
+		Macaroon:             mac,
+		Preimage:             preimage,
+		AllowPendingPreimage: minState == lnrpc.Invoice_ACCEPTED,
+		Discharges:           discharges,
+		TargetService:        serviceName,
+		TargetCapability:     capability,
+		TargetMethod:         method,
+		Header:               *header,
 	}
 	err = l.minter.VerifyL402(context.Background(), verificationParams)
 	if err != nil {
 		log.Debugf("Deny: L402 validation failed: %v", err)
-		return false
+		return nil, false
 	}
 
-	// Make sure the backend has the invoice recorded as settled.
-	err = l.checker.VerifyInvoiceStatus(
-		preimage.Hash(), lnrpc.Invoice_SETTLED,
-		DefaultInvoiceLookupTimeout,
-	)
+	if l.macaroonSizeMetric {
+		recordMacaroonSize(mac, serviceName)
+	}
+
+	// The minter already decoded the identifier during verification, so
+	// this only fails for minters that don't use L402 identifiers, in
+	// which case there's no identity to report and the payment hash is
+	// derived from the preimage.
+	hash := preimage.Hash()
+	id, err := l402.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		log.Debugf("Unable to decode identifier of accepted L402: %v",
+			err)
+		id = nil
+	} else {
+		hash = id.PaymentHash
+	}
+
+	// Make sure the backend has the invoice recorded in at least the state
+	// the service requires.
+	err = l.verifyInvoiceState(hash, minState)
 	if err != nil {
 		log.Debugf("Deny: Invoice status mismatch: %v", err)
-		return false
+		return nil, false
+	}
+
+	return id, true
+}
+
+// verifyInvoiceState makes sure the invoice with the given hash has reached at
+// least the given minimum state. If the minimum state is ACCEPTED, an invoice
+// that has already been settled is accepted as well.
+func (l *L402Authenticator) verifyInvoiceState(hash lntypes.Hash,
+	minState lnrpc.Invoice_InvoiceState) error {
+
+	if minState != lnrpc.Invoice_ACCEPTED {
+		return l.checker.VerifyInvoiceStatus(
+			hash, lnrpc.Invoice_SETTLED, DefaultInvoiceLookupTimeout,
+		)
 	}
 
-	return true
+	// The checker can only wait for an exact state, so we wait for both
+	// acceptable states in parallel and succeed as soon as one of them is
+	// reached. The other check is canceled then, if the checker supports
+	// it.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	states := []lnrpc.Invoice_InvoiceState{
+		lnrpc.Invoice_ACCEPTED, lnrpc.Invoice_SETTLED,
+	}
+	errChan := make(chan error, len(states))
+	for _, state := range states {
+		go func(state lnrpc.Invoice_InvoiceState) {
+			errChan <- VerifyInvoiceStatus(
+				ctx, l.checker, hash, state,
+				DefaultInvoiceLookupTimeout,
+			)
+		}(state)
+	}
+
+	var lastErr error
+	for range states {
+		err := <-errChan
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+	}
+
+	return lastErr
 }
 
 const (
@@ -86,9 +298,21 @@ const (
 func (l *L402Authenticator) FreshChallengeHeader(serviceName string,
 	servicePrice int64) (http.Header, error) {
 
+	return l.FreshTierChallengeHeader(
+		serviceName, l402.BaseTier, servicePrice,
+	)
+}
+
+// FreshTierChallengeHeader returns a header containing a challenge for an L402
+// of the given tier of a service.
+//
+// NOTE: This is part of the TieredAuthenticator interface.
+func (l *L402Authenticator) FreshTierChallengeHeader(serviceName string,
+	tier l402.ServiceTier, servicePrice int64) (http.Header, error) {
+
 	service := l402.Service{
 		Name:  serviceName,
-		Tier:  l402.BaseTier,
+		Tier:  tier,
 		Price: servicePrice,
 	}
 	mac, paymentRequest, err := l.minter.MintL402(
@@ -103,6 +327,10 @@ func (l *L402Authenticator) FreshChallengeHeader(serviceName string,
 		log.Errorf("Error serializing L402: %v", err)
 	}
 
+	if l.cacheChallengeHeader {
+		return cachedChallengeHeader(macBytes, paymentRequest), nil
+	}
+
 	header := http.Header{
 		"Content-Type": []string{"application/grpc"},
 	}
@@ -1,14 +1,19 @@
 package auth_test
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/lightninglabs/aperture/auth"
 	"github.com/lightninglabs/aperture/l402"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/macaroon.v2"
 )
 
@@ -172,3 +177,263 @@ func TestL402Authenticator(t *testing.T) {
 		}
 	}
 }
+
+// TestL402AuthenticatorMinInvoiceState tests that the minimum invoice state of
+// a service is enforced when verifying an L402.
+func TestL402AuthenticatorMinInvoiceState(t *testing.T) {
+	var (
+		testPreimage = "49349dfea4abed3cd14f6d356afa83de" +
+			"9787b609f088c8df09bacc7b4bd21b39"
+		header = &http.Header{
+			l402.HeaderMacaroon: []string{
+				createDummyMacHex(testPreimage),
+			},
+		}
+		minStates = map[string]lnrpc.Invoice_InvoiceState{
+			"strict":  lnrpc.Invoice_SETTLED,
+			"lenient": lnrpc.Invoice_ACCEPTED,
+		}
+		minStateFunc = func(name string) lnrpc.Invoice_InvoiceState {
+			return minStates[name]
+		}
+	)
+
+	testCases := []struct {
+		name    string
+		state   lnrpc.Invoice_InvoiceState
+		service string
+		result  bool
+	}{{
+		name:    "strict service, settled invoice",
+		state:   lnrpc.Invoice_SETTLED,
+		service: "strict",
+		result:  true,
+	}, {
+		name:    "strict service, accepted invoice",
+		state:   lnrpc.Invoice_ACCEPTED,
+		service: "strict",
+		result:  false,
+	}, {
+		name:    "lenient service, settled invoice",
+		state:   lnrpc.Invoice_SETTLED,
+		service: "lenient",
+		result:  true,
+	}, {
+		name:    "lenient service, accepted invoice",
+		state:   lnrpc.Invoice_ACCEPTED,
+		service: "lenient",
+		result:  true,
+	}, {
+		name:    "lenient service, open invoice",
+		state:   lnrpc.Invoice_OPEN,
+		service: "lenient",
+		result:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := auth.NewL402Authenticator(
+				&mockMint{}, &mockStateChecker{state: tc.state},
+				auth.WithMinInvoiceState(minStateFunc),
+			)
+			result := a.Accept(header, tc.service)
+			require.Equal(t, tc.result, result)
+		})
+	}
+
+	// Without the option, all services require a settled invoice.
+	a := auth.NewL402Authenticator(
+		&mockMint{}, &mockStateChecker{state: lnrpc.Invoice_ACCEPTED},
+	)
+	require.False(t, a.Accept(header, "lenient"))
+}
+
+// TestL402AuthenticatorCancelStateCheck makes sure the check for the other
+// acceptable invoice state is canceled once an invoice reached one of them.
+func TestL402AuthenticatorCancelStateCheck(t *testing.T) {
+	header := &http.Header{
+		l402.HeaderMacaroon: []string{createDummyMacHex(
+			"49349dfea4abed3cd14f6d356afa83de" +
+				"9787b609f088c8df09bacc7b4bd21b39",
+		)},
+	}
+	checker := &blockingStateChecker{
+		canceled: make(chan lnrpc.Invoice_InvoiceState, 1),
+	}
+	a := auth.NewL402Authenticator(
+		&mockMint{}, checker, auth.WithMinInvoiceState(
+			func(string) lnrpc.Invoice_InvoiceState {
+				return lnrpc.Invoice_ACCEPTED
+			},
+		),
+	)
+	require.True(t, a.Accept(header, "svc"))
+
+	select {
+	case state := <-checker.canceled:
+		require.Equal(t, lnrpc.Invoice_SETTLED, state)
+
+	case <-time.After(time.Second):
+		t.Fatal("settled state check wasn't canceled")
+	}
+}
+
+// TestL402AuthenticatorPendingPreimage makes sure an L402 with a zero
+// preimage, as sent while the payment of a hold invoice is pending, is only
+// accepted by services that accept L402s with an accepted invoice, and that
+// the invoice of the L402's payment hash is checked.
+func TestL402AuthenticatorPendingPreimage(t *testing.T) {
+	preimage := lntypes.Preimage{1}
+	hash := preimage.Hash()
+	var id bytes.Buffer
+	err := l402.EncodeIdentifier(&id, &l402.Identifier{
+		PaymentHash: hash,
+		TokenID:     l402.TokenID{1},
+	})
+	require.NoError(t, err)
+	mac, err := macaroon.New(
+		[]byte("key"), id.Bytes(), "aperture", macaroon.LatestVersion,
+	)
+	require.NoError(t, err)
+
+	header := &http.Header{}
+	require.NoError(t, l402.SetHeader(header, mac, lntypes.Preimage{}))
+
+	minStateFunc := func(name string) lnrpc.Invoice_InvoiceState {
+		if name == "lenient" {
+			return lnrpc.Invoice_ACCEPTED
+		}
+
+		return lnrpc.Invoice_SETTLED
+	}
+	minter := &mockMint{}
+	a := auth.NewL402Authenticator(
+		minter, &mockStateChecker{
+			state: lnrpc.Invoice_ACCEPTED,
+			hash:  &hash,
+		}, auth.WithMinInvoiceState(minStateFunc),
+	)
+
+	require.True(t, a.Accept(header, "lenient"))
+	require.True(t, minter.verified.AllowPendingPreimage)
+
+	require.False(t, a.Accept(header, "strict"))
+	require.False(t, minter.verified.AllowPendingPreimage)
+
+	// The invoice of the L402's payment hash must have been paid.
+	otherHash := lntypes.Hash{2}
+	a = auth.NewL402Authenticator(
+		minter, &mockStateChecker{
+			state: lnrpc.Invoice_ACCEPTED,
+			hash:  &otherHash,
+		}, auth.WithMinInvoiceState(minStateFunc),
+	)
+	require.False(t, a.Accept(header, "lenient"))
+}
+
+// TestL402AuthenticatorAcceptRequest makes sure the method and capability of
+// the request are passed on for verification.
+func TestL402AuthenticatorAcceptRequest(t *testing.T) {
+	preimage := "49349dfea4abed3cd14f6d356afa83de" +
+		"9787b609f088c8df09bacc7b4bd21b39"
+
+	minter := &mockMint{}
+	a := auth.NewL402Authenticator(minter, &mockChecker{})
+
+	req, err := http.NewRequest("POST", "http://service.com/", nil)
+	require.NoError(t, err)
+	req.Header.Set(l402.HeaderMacaroon, createDummyMacHex(preimage))
+
+	require.True(t, a.AcceptRequest(req, "test"))
+	require.Equal(t, "POST", minter.verified.TargetMethod)
+
+	// Without the request, the method is unknown.
+	require.True(t, a.Accept(&req.Header, "test"))
+	require.Empty(t, minter.verified.TargetMethod)
+
+	// The capability the request accesses is verified as well, if the
+	// authenticator can determine it.
+	a = auth.NewL402Authenticator(
+		minter, &mockChecker{}, auth.WithCapability(
+			func(r *http.Request, serviceName string) string {
+				return serviceName + "-capability"
+			},
+		),
+	)
+	require.True(t, a.AcceptRequest(req, "test"))
+	require.Equal(t, "test-capability", minter.verified.TargetCapability)
+}
+
+// newStaticMint creates a minter that always mints the same dummy L402.
+func newStaticMint(t testing.TB) *staticMint {
+	macBytes, err := hex.DecodeString(createDummyMacHex(
+		"49349dfea4abed3cd14f6d356afa83de" +
+			"9787b609f088c8df09bacc7b4bd21b39",
+	))
+	require.NoError(t, err)
+
+	mac := &macaroon.Macaroon{}
+	require.NoError(t, mac.UnmarshalBinary(macBytes))
+
+	paymentRequest := "lnbc1500n1pw5kjhmpp5fu6xhthlt2vucmzkx6c7wtlh2r6" +
+		"25r30cyjsfqhu8rsx4xpz5lwqdpa2fjkzep6yptksct5yp5hxgrrv96hx6tw" +
+		"vusycn3qv9jx7ur5d9hkugr5dusx6cqzpgxqr23s79r"
+
+	return &staticMint{
+		mac:            mac,
+		paymentRequest: paymentRequest,
+	}
+}
+
+// TestChallengeHeaderCache makes sure the cached challenge header is identical
+// to the uncached one.
+func TestChallengeHeaderCache(t *testing.T) {
+	minter := newStaticMint(t)
+	uncached := auth.NewL402Authenticator(minter, &mockChecker{})
+	cached := auth.NewL402Authenticator(
+		minter, &mockChecker{}, auth.WithChallengeHeaderCache(),
+	)
+
+	for _, service := range []string{"foo", "bar", "foo"} {
+		want, err := uncached.FreshChallengeHeader(service, 21)
+		require.NoError(t, err)
+
+		got, err := cached.FreshChallengeHeader(service, 21)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+}
+
+// BenchmarkFreshChallengeHeader compares the allocations of creating a new
+// challenge header with and without the challenge header cache.
+func BenchmarkFreshChallengeHeader(b *testing.B) {
+	minter := newStaticMint(b)
+
+	benchmarks := []struct {
+		name string
+		opts []auth.L402AuthenticatorOption
+	}{{
+		name: "uncached",
+	}, {
+		name: "cached",
+		opts: []auth.L402AuthenticatorOption{
+			auth.WithChallengeHeaderCache(),
+		},
+	}}
+
+	for _, bm := range benchmarks {
+		a := auth.NewL402Authenticator(
+			minter, &mockChecker{}, bm.opts...,
+		)
+
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := a.FreshChallengeHeader("service", 21)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
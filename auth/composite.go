@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/lightninglabs/aperture/l402"
+)
+
+// CompositeAuthenticator is an authenticator that combines several other
+// authenticators. A request is accepted if any of them accepts it, while
+// challenges are issued by the first one that can issue them.
+type CompositeAuthenticator struct {
+	authenticators []Authenticator
+}
+
+// A compile time flag to ensure the CompositeAuthenticator satisfies the
+// IdentityAuthenticator and TieredAuthenticator interfaces.
+var (
+	_ IdentityAuthenticator = (*CompositeAuthenticator)(nil)
+	_ TieredAuthenticator   = (*CompositeAuthenticator)(nil)
+)
+
+// NewCompositeAuthenticator creates a new authenticator that accepts requests
+// that any of the given authenticators accepts. At least one authenticator
+// must be given.
+func NewCompositeAuthenticator(
+	authenticators ...Authenticator) (*CompositeAuthenticator, error) {
+
+	if len(authenticators) == 0 {
+		return nil, errors.New("at least one authenticator required")
+	}
+
+	return &CompositeAuthenticator{
+		authenticators: authenticators,
+	}, nil
+}
+
+// Accept returns whether or not the header successfully authenticates the user
+// to a given backend service with any of the authenticators.
+//
+// NOTE: This is part of the Authenticator interface.
+func (c *CompositeAuthenticator) Accept(header *http.Header,
+	serviceName string) bool {
+
+	for _, a := range c.authenticators {
+		if a.Accept(header, serviceName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AcceptRequest returns whether or not the request successfully authenticates
+// the user to a given backend service with any of the authenticators.
+// Authenticators that support it get to check the whole request.
+//
+// NOTE: This is part of the RequestAuthenticator interface.
+func (c *CompositeAuthenticator) AcceptRequest(r *http.Request,
+	serviceName string) bool {
+
+	_, accepted := c.AcceptRequestIdentity(r, serviceName)
+	return accepted
+}
+
+// AcceptRequestIdentity returns whether or not the request successfully
+// authenticates the user to a given backend service with any of the
+// authenticators. The identifier of the L402 is only returned if the
+// authenticator that accepted the request verified one.
+//
+// NOTE: This is part of the IdentityAuthenticator interface.
+func (c *CompositeAuthenticator) AcceptRequestIdentity(r *http.Request,
+	serviceName string) (*l402.Identifier, bool) {
+
+	for _, a := range c.authenticators {
+		switch a := a.(type) {
+		case IdentityAuthenticator:
+			id, accepted := a.AcceptRequestIdentity(r, serviceName)
+			if accepted {
+				return id, true
+			}
+
+		case RequestAuthenticator:
+			if a.AcceptRequest(r, serviceName) {
+				return nil, true
+			}
+
+		default:
+			if a.Accept(&r.Header, serviceName) {
+				return nil, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// FreshChallengeHeader returns a header containing a challenge of the first
+// authenticator that can issue one for the user to complete. If none of them
+// can, ErrNoChallenge is returned.
+//
+// NOTE: This is part of the Authenticator interface.
+func (c *CompositeAuthenticator) FreshChallengeHeader(serviceName string,
+	servicePrice int64) (http.Header, error) {
+
+	for _, a := range c.authenticators {
+		header, err := a.FreshChallengeHeader(serviceName, servicePrice)
+		if errors.Is(err, ErrNoChallenge) {
+			continue
+		}
+
+		return header, err
+	}
+
+	return nil, ErrNoChallenge
+}
+
+// FreshTierChallengeHeader returns a header containing a challenge of the
+// first authenticator that can issue one for an L402 of the given tier of a
+// service. Challenges for tiers other than the base tier require that
+// authenticator to support tiers. If none of the authenticators can issue a
+// challenge, ErrNoChallenge is returned.
+//
+// NOTE: This is part of the TieredAuthenticator interface.
+func (c *CompositeAuthenticator) FreshTierChallengeHeader(serviceName string,
+	tier l402.ServiceTier, servicePrice int64) (http.Header, error) {
+
+	for _, a := range c.authenticators {
+		header, err := freshTierChallengeHeader(
+			a, serviceName, tier, servicePrice,
+		)
+		if errors.Is(err, ErrNoChallenge) {
+			continue
+		}
+
+		return header, err
+	}
+
+	return nil, ErrNoChallenge
+}
+
+// freshTierChallengeHeader returns a challenge of the given authenticator for
+// an L402 of the given tier of a service.
+func freshTierChallengeHeader(a Authenticator, serviceName string,
+	tier l402.ServiceTier, servicePrice int64) (http.Header, error) {
+
+	if ta, ok := a.(TieredAuthenticator); ok {
+		return ta.FreshTierChallengeHeader(
+			serviceName, tier, servicePrice,
+		)
+	}
+
+	header, err := a.FreshChallengeHeader(serviceName, servicePrice)
+	if err != nil {
+		return nil, err
+	}
+
+	if tier != l402.BaseTier {
+		return nil, fmt.Errorf("authenticator doesn't support tiers")
+	}
+
+	return header, nil
+}
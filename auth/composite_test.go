@@ -0,0 +1,149 @@
+package auth_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/l402"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+// TestAPIKeyAuthenticator makes sure only requests with one of the configured
+// keys in the configured header field are accepted.
+func TestAPIKeyAuthenticator(t *testing.T) {
+	_, err := auth.NewAPIKeyAuthenticator("", []string{"key", ""})
+	require.Error(t, err)
+
+	a, err := auth.NewAPIKeyAuthenticator("", []string{"key1", "key2"})
+	require.NoError(t, err)
+
+	header := &http.Header{}
+	require.False(t, a.Accept(header, "svc"))
+
+	header.Set(auth.DefaultAPIKeyHeader, "key2")
+	require.True(t, a.Accept(header, "svc"))
+
+	header.Set(auth.DefaultAPIKeyHeader, "key")
+	require.False(t, a.Accept(header, "svc"))
+
+	// Keys are only accepted in the configured header field.
+	a, err = auth.NewAPIKeyAuthenticator("X-Custom", []string{"key1"})
+	require.NoError(t, err)
+	header.Set(auth.DefaultAPIKeyHeader, "key1")
+	require.False(t, a.Accept(header, "svc"))
+	header.Set("X-Custom", "key1")
+	require.True(t, a.Accept(header, "svc"))
+
+	_, err = a.FreshChallengeHeader("svc", 10)
+	require.ErrorIs(t, err, auth.ErrNoChallenge)
+}
+
+// TestCompositeAuthenticator makes sure a request is accepted if any of the
+// combined authenticators accepts it and that challenges are issued by the
+// first one that can issue them.
+func TestCompositeAuthenticator(t *testing.T) {
+	_, err := auth.NewCompositeAuthenticator()
+	require.Error(t, err)
+
+	apiKeyAuth, err := auth.NewAPIKeyAuthenticator("", []string{"key"})
+	require.NoError(t, err)
+
+	a, err := auth.NewCompositeAuthenticator(
+		auth.NewMockAuthenticator(), apiKeyAuth,
+	)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	require.NoError(t, err)
+	require.False(t, a.Accept(&req.Header, "svc"))
+	require.False(t, a.AcceptRequest(req, "svc"))
+
+	req.Header.Set(auth.DefaultAPIKeyHeader, "key")
+	require.True(t, a.Accept(&req.Header, "svc"))
+	require.True(t, a.AcceptRequest(req, "svc"))
+
+	req.Header.Del(auth.DefaultAPIKeyHeader)
+	req.Header.Set("Authorization", "L402 token")
+	require.True(t, a.AcceptRequest(req, "svc"))
+
+	header, err := a.FreshChallengeHeader("svc", 10)
+	require.NoError(t, err)
+	require.NotEmpty(t, header.Values("WWW-Authenticate"))
+
+	// The first authenticator doesn't support tiers, so only challenges for
+	// the base tier can be issued.
+	_, err = a.FreshTierChallengeHeader("svc", l402.BaseTier, 10)
+	require.NoError(t, err)
+	_, err = a.FreshTierChallengeHeader("svc", 1, 10)
+	require.Error(t, err)
+
+	// With the API key authenticator first, the challenges are issued by
+	// the second one.
+	a, err = auth.NewCompositeAuthenticator(
+		apiKeyAuth, auth.NewMockAuthenticator(),
+	)
+	require.NoError(t, err)
+	header, err = a.FreshChallengeHeader("svc", 10)
+	require.NoError(t, err)
+	require.NotEmpty(t, header.Values("WWW-Authenticate"))
+	_, err = a.FreshTierChallengeHeader("svc", l402.BaseTier, 10)
+	require.NoError(t, err)
+
+	// Without any authenticator that can issue challenges, none are
+	// issued.
+	a, err = auth.NewCompositeAuthenticator(apiKeyAuth)
+	require.NoError(t, err)
+	_, err = a.FreshChallengeHeader("svc", 10)
+	require.ErrorIs(t, err, auth.ErrNoChallenge)
+	_, err = a.FreshTierChallengeHeader("svc", l402.BaseTier, 10)
+	require.ErrorIs(t, err, auth.ErrNoChallenge)
+}
+
+// TestCompositeAuthenticatorIdentity makes sure the identity of an L402 is
+// only reported if the L402 authenticator accepted the request, not if it was
+// accepted by an API key.
+func TestCompositeAuthenticatorIdentity(t *testing.T) {
+	preimage := lntypes.Preimage{1}
+	wantID := &l402.Identifier{
+		PaymentHash: preimage.Hash(),
+		TokenID:     l402.TokenID{1, 2, 3},
+	}
+	var id bytes.Buffer
+	require.NoError(t, l402.EncodeIdentifier(&id, wantID))
+	mac, err := macaroon.New(
+		[]byte("key"), id.Bytes(), "aperture", macaroon.LatestVersion,
+	)
+	require.NoError(t, err)
+
+	l402Auth := auth.NewL402Authenticator(&mockMint{}, &mockChecker{})
+	apiKeyAuth, err := auth.NewAPIKeyAuthenticator("", []string{"key"})
+	require.NoError(t, err)
+	a, err := auth.NewCompositeAuthenticator(l402Auth, apiKeyAuth)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	require.NoError(t, err)
+	require.NoError(t, l402.SetHeader(&req.Header, mac, preimage))
+
+	gotID, accepted := a.AcceptRequestIdentity(req, "svc")
+	require.True(t, accepted)
+	require.Equal(t, wantID, gotID)
+
+	// If the L402 doesn't verify, the request is accepted because of its
+	// API key, so there's no identity.
+	l402Auth = auth.NewL402Authenticator(
+		&mockMint{}, &mockChecker{err: errors.New("not paid")},
+	)
+	a, err = auth.NewCompositeAuthenticator(l402Auth, apiKeyAuth)
+	require.NoError(t, err)
+	req.Header.Set(auth.DefaultAPIKeyHeader, "key")
+
+	gotID, accepted = a.AcceptRequestIdentity(req, "svc")
+	require.True(t, accepted)
+	require.Nil(t, gotID)
+}
@@ -11,6 +11,10 @@ import (
 const (
 	// LevelOff is the default level where no authentication is required.
 	LevelOff Level = "off"
+
+	// LevelAudit is the level where requests are evaluated as if
+	// authentication was required, but are always let through.
+	LevelAudit Level = "audit"
 )
 
 type Level string
@@ -40,6 +44,10 @@ func (l Level) FreebieCount() freebie.Count {
 	return freebie.Count(count)
 }
 
+func (l Level) IsAudit() bool {
+	return l.lower() == string(LevelAudit)
+}
+
 func (l Level) IsOff() bool {
 	lower := l.lower()
 	return lower == "off" || lower == "false"
@@ -30,6 +30,39 @@ type Authenticator interface {
 	FreshChallengeHeader(string, int64) (http.Header, error)
 }
 
+// RequestAuthenticator is an Authenticator that can also take attributes of the
+// request other than its header into account, such as its method.
+type RequestAuthenticator interface {
+	Authenticator
+
+	// AcceptRequest returns whether or not the request successfully
+	// authenticates the user to a given backend service.
+	AcceptRequest(*http.Request, string) bool
+}
+
+// IdentityAuthenticator is a RequestAuthenticator that can also tell which L402
+// a request was authenticated with.
+type IdentityAuthenticator interface {
+	RequestAuthenticator
+
+	// AcceptRequestIdentity returns whether or not the request
+	// successfully authenticates the user to a given backend service. If
+	// it was authenticated with an L402, the identifier of the verified
+	// L402 is returned as well, otherwise the identifier is nil.
+	AcceptRequestIdentity(*http.Request, string) (*l402.Identifier, bool)
+}
+
+// TieredAuthenticator is an Authenticator that can also issue challenges for
+// the higher tiers of a service.
+type TieredAuthenticator interface {
+	Authenticator
+
+	// FreshTierChallengeHeader returns a header containing a challenge
+	// for an L402 of the given tier of a service with the given price.
+	FreshTierChallengeHeader(string, l402.ServiceTier, int64) (http.Header,
+		error)
+}
+
 // Minter is an entity that is able to mint and verify L402s for a set of
 // services.
 type Minter interface {
@@ -50,3 +83,29 @@ type InvoiceChecker interface {
 	VerifyInvoiceStatus(lntypes.Hash, lnrpc.Invoice_InvoiceState,
 		time.Duration) error
 }
+
+// ContextInvoiceChecker is an InvoiceChecker that can also stop waiting for
+// the status of an invoice once a context is canceled.
+type ContextInvoiceChecker interface {
+	InvoiceChecker
+
+	// VerifyInvoiceStatusContext checks the status of an invoice like
+	// VerifyInvoiceStatus, but gives up as soon as the context is
+	// canceled.
+	VerifyInvoiceStatusContext(context.Context, lntypes.Hash,
+		lnrpc.Invoice_InvoiceState, time.Duration) error
+}
+
+// VerifyInvoiceStatus checks the status of an invoice with the given checker.
+// If the checker supports it, it gives up as soon as the context is canceled,
+// otherwise it waits until the timeout is reached at most.
+func VerifyInvoiceStatus(ctx context.Context, checker InvoiceChecker,
+	hash lntypes.Hash, state lnrpc.Invoice_InvoiceState,
+	timeout time.Duration) error {
+
+	if c, ok := checker.(ContextInvoiceChecker); ok {
+		return c.VerifyInvoiceStatusContext(ctx, hash, state, timeout)
+	}
+
+	return checker.VerifyInvoiceStatus(hash, state, timeout)
+}
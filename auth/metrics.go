@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/macaroon.v2"
+)
+
+// serviceLabel is the metric label that holds the service name.
+const serviceLabel = "service"
+
+var (
+	// macaroonSizeBytes measures the serialized size of the macaroons that
+	// were successfully verified, labeled by the service they were
+	// presented to.
+	macaroonSizeBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "aperture",
+			Name:      "macaroon_size_bytes",
+			Buckets:   prometheus.ExponentialBuckets(128, 2, 8),
+		}, []string{serviceLabel},
+	)
+)
+
+// RegisterMetrics registers all metrics of the authenticator with the default
+// Prometheus registry.
+func RegisterMetrics() {
+	prometheus.MustRegister(macaroonSizeBytes)
+}
+
+// recordMacaroonSize records the serialized size of the given macaroon that
+// was presented to the given service.
+func recordMacaroonSize(mac *macaroon.Macaroon, serviceName string) {
+	macBytes, err := mac.MarshalBinary()
+	if err != nil {
+		log.Debugf("Unable to serialize macaroon: %v", err)
+		return
+	}
+
+	macaroonSizeBytes.WithLabelValues(serviceName).Observe(
+		float64(len(macBytes)),
+	)
+}
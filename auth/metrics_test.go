@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/l402"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+// acceptingMint is a minter that accepts every L402.
+type acceptingMint struct{}
+
+func (acceptingMint) MintL402(context.Context,
+	...l402.Service) (*macaroon.Macaroon, string, error) {
+
+	return nil, "", nil
+}
+
+func (acceptingMint) VerifyL402(context.Context,
+	*mint.VerificationParams) error {
+
+	return nil
+}
+
+// acceptingChecker is an invoice checker that reports every invoice as being
+// in the requested state.
+type acceptingChecker struct{}
+
+func (acceptingChecker) VerifyInvoiceStatus(lntypes.Hash,
+	lnrpc.Invoice_InvoiceState, time.Duration) error {
+
+	return nil
+}
+
+// TestMacaroonSizeMetric makes sure the size of each verified macaroon is
+// observed in the histogram if the metric is enabled.
+func TestMacaroonSizeMetric(t *testing.T) {
+	macaroonSizeBytes.Reset()
+
+	preimage := lntypes.Preimage{1, 2, 3}
+
+	// newHeader creates an authorization header with a macaroon that has
+	// a caveat with a value of the given size.
+	newHeader := func(caveatSize int) (*http.Header, int) {
+		mac, err := macaroon.New(
+			[]byte("key"), []byte("id"), "aperture",
+			macaroon.LatestVersion,
+		)
+		require.NoError(t, err)
+
+		err = l402.AddFirstPartyCaveats(mac, l402.Caveat{
+			Condition: l402.PreimageKey,
+			Value:     preimage.String(),
+		}, l402.Caveat{
+			Condition: "padding",
+			Value:     strings.Repeat("a", caveatSize),
+		})
+		require.NoError(t, err)
+
+		macBytes, err := mac.MarshalBinary()
+		require.NoError(t, err)
+
+		return &http.Header{
+			l402.HeaderMacaroon: []string{
+				hex.EncodeToString(macBytes),
+			},
+		}, len(macBytes)
+	}
+
+	smallHeader, smallSize := newHeader(10)
+	largeHeader, largeSize := newHeader(1000)
+
+	// Without the option, nothing is recorded.
+	a := NewL402Authenticator(acceptingMint{}, acceptingChecker{})
+	require.True(t, a.Accept(smallHeader, "svc"))
+	require.Zero(t, testutil.CollectAndCount(macaroonSizeBytes))
+
+	a = NewL402Authenticator(
+		acceptingMint{}, acceptingChecker{}, WithMacaroonSizeMetric(),
+	)
+	require.True(t, a.Accept(smallHeader, "svc"))
+	require.True(t, a.Accept(largeHeader, "svc"))
+
+	// Both sizes are observed and sum up to the total size.
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(macaroonSizeBytes))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 1)
+	require.Len(t, families[0].GetMetric(), 1)
+
+	histogram := families[0].GetMetric()[0].GetHistogram()
+	require.EqualValues(t, 2, histogram.GetSampleCount())
+	require.EqualValues(t, smallSize+largeSize, histogram.GetSampleSum())
+
+	// The large macaroon falls into a higher bucket than the small one.
+	for _, bucket := range histogram.GetBucket() {
+		switch {
+		case bucket.GetUpperBound() < float64(smallSize):
+			require.Zero(t, bucket.GetCumulativeCount())
+
+		case bucket.GetUpperBound() < float64(largeSize):
+			require.EqualValues(t, 1, bucket.GetCumulativeCount())
+
+		default:
+			require.EqualValues(t, 2, bucket.GetCumulativeCount())
+		}
+	}
+}
@@ -2,6 +2,7 @@ package auth_test
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/lightninglabs/aperture/auth"
@@ -13,6 +14,8 @@ import (
 )
 
 type mockMint struct {
+	// verified holds the parameters of the last verified L402.
+	verified *mint.VerificationParams
 }
 
 var _ auth.Minter = (*mockMint)(nil)
@@ -24,6 +27,7 @@ func (m *mockMint) MintL402(_ context.Context,
 }
 
 func (m *mockMint) VerifyL402(_ context.Context, p *mint.VerificationParams) error {
+	m.verified = p
 	return nil
 }
 
@@ -38,3 +42,74 @@ func (m *mockChecker) VerifyInvoiceStatus(lntypes.Hash,
 
 	return m.err
 }
+
+// mockStateChecker is an invoice checker that reports a fixed invoice state.
+type mockStateChecker struct {
+	state lnrpc.Invoice_InvoiceState
+
+	// hash is the optional payment hash of the only known invoice.
+	hash *lntypes.Hash
+}
+
+var _ auth.InvoiceChecker = (*mockStateChecker)(nil)
+
+func (m *mockStateChecker) VerifyInvoiceStatus(hash lntypes.Hash,
+	state lnrpc.Invoice_InvoiceState, _ time.Duration) error {
+
+	if m.hash != nil && hash != *m.hash {
+		return fmt.Errorf("unknown invoice %v", hash)
+	}
+	if state != m.state {
+		return fmt.Errorf("invoice in state %v, wanted %v", m.state,
+			state)
+	}
+
+	return nil
+}
+
+// staticMint is a minter that always mints the same L402.
+type staticMint struct {
+	mockMint
+
+	mac            *macaroon.Macaroon
+	paymentRequest string
+}
+
+var _ auth.Minter = (*staticMint)(nil)
+
+func (m *staticMint) MintL402(_ context.Context,
+	_ ...l402.Service) (*macaroon.Macaroon, string, error) {
+
+	return m.mac, m.paymentRequest, nil
+}
+
+// blockingStateChecker is an invoice checker that immediately reports the
+// accepted state and blocks checks for any other state until their context is
+// canceled.
+type blockingStateChecker struct {
+	canceled chan lnrpc.Invoice_InvoiceState
+}
+
+var _ auth.ContextInvoiceChecker = (*blockingStateChecker)(nil)
+
+func (m *blockingStateChecker) VerifyInvoiceStatus(hash lntypes.Hash,
+	state lnrpc.Invoice_InvoiceState, timeout time.Duration) error {
+
+	return m.VerifyInvoiceStatusContext(
+		context.Background(), hash, state, timeout,
+	)
+}
+
+func (m *blockingStateChecker) VerifyInvoiceStatusContext(ctx context.Context,
+	_ lntypes.Hash, state lnrpc.Invoice_InvoiceState,
+	_ time.Duration) error {
+
+	if state == lnrpc.Invoice_ACCEPTED {
+		return nil
+	}
+
+	<-ctx.Done()
+	m.canceled <- state
+
+	return ctx.Err()
+}
@@ -0,0 +1,189 @@
+package challenger
+
+import (
+	"context"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+// maxTrackedChallenges is the number of payment hashes the FallbackChallenger
+// remembers the creating challenger of.
+const maxTrackedChallenges = 10000
+
+// FallbackChallenger is a challenger that prefers its primary challenger but
+// falls back to a secondary one whenever the primary is unable to serve a
+// request. This is used to keep creating challenges through a direct lnd
+// connection while an LNC mailbox is unavailable.
+type FallbackChallenger struct {
+	primary  Challenger
+	fallback Challenger
+
+	// creators maps the payment hashes of recent challenges to the
+	// challenger that created them, so their invoices are only looked up
+	// there.
+	creators *lru.Cache[lntypes.Hash, Challenger]
+}
+
+// A compile time flag to ensure the FallbackChallenger satisfies the
+// Challenger interface.
+var _ Challenger = (*FallbackChallenger)(nil)
+var _ mint.ServiceChallenger = (*FallbackChallenger)(nil)
+var _ auth.ContextInvoiceChecker = (*FallbackChallenger)(nil)
+var _ mint.PaymentHashVerifier = (*FallbackChallenger)(nil)
+
+// NewFallbackChallenger creates a new challenger that uses the primary
+// challenger while it is healthy and the fallback challenger otherwise.
+func NewFallbackChallenger(primary,
+	fallback Challenger) *FallbackChallenger {
+
+	// The size is constant and positive, so creating the cache can't
+	// fail.
+	creators, _ := lru.New[lntypes.Hash, Challenger](maxTrackedChallenges)
+
+	return &FallbackChallenger{
+		primary:  primary,
+		fallback: fallback,
+		creators: creators,
+	}
+}
+
+// Stop shuts down both the primary and the fallback challenger.
+func (f *FallbackChallenger) Stop() {
+	f.primary.Stop()
+	f.fallback.Stop()
+}
+
+// NewChallenge creates a new L402 payment challenge, returning a payment
+// request (invoice) and the corresponding payment hash. The primary challenger
+// is always tried first.
+//
+// NOTE: This is part of the mint.Challenger interface.
+func (f *FallbackChallenger) NewChallenge(price int64) (string, lntypes.Hash,
+	error) {
+
+	return f.NewServiceChallenge("", price)
+}
+
+// NewServiceChallenge creates a new L402 payment challenge for the given
+// service, returning a payment request (invoice) and the corresponding payment
+// hash. The primary challenger is always tried first.
+//
+// NOTE: This is part of the mint.ServiceChallenger interface.
+func (f *FallbackChallenger) NewServiceChallenge(service string,
+	price int64) (string, lntypes.Hash, error) {
+
+	payReq, hash, err := mint.NewServiceChallenge(f.primary, service, price)
+	if err == nil {
+		f.creators.Add(hash, f.primary)
+		return payReq, hash, nil
+	}
+
+	log.Warnf("Primary challenger unable to create challenge, using "+
+		"fallback: %v", err)
+
+	payReq, hash, err = mint.NewServiceChallenge(f.fallback, service, price)
+	if err != nil {
+		return "", lntypes.Hash{}, err
+	}
+	f.creators.Add(hash, f.fallback)
+
+	return payReq, hash, nil
+}
+
+// VerifyPaymentHash makes sure either the primary or the fallback node knows
+// about an invoice with the given payment hash. If the challenger that created
+// the invoice is known, only it is asked. Challengers that can't verify payment
+// hashes accept every hash.
+//
+// NOTE: This is part of the mint.PaymentHashVerifier interface.
+func (f *FallbackChallenger) VerifyPaymentHash(ctx context.Context,
+	hash lntypes.Hash) error {
+
+	if creator, ok := f.creators.Get(hash); ok {
+		return verifyPaymentHash(ctx, creator, hash)
+	}
+
+	err := verifyPaymentHash(ctx, f.primary, hash)
+	if err == nil {
+		return nil
+	}
+
+	return verifyPaymentHash(ctx, f.fallback, hash)
+}
+
+// VerifyInvoiceStatus checks that an invoice identified by a payment hash has
+// the desired status. If the challenger that created the invoice is known, only
+// it is queried. Otherwise the invoice may have been created by either of the
+// challengers, so both are queried concurrently and the check succeeds as soon
+// as one of them reports the desired status.
+//
+// NOTE: This is part of the auth.InvoiceChecker interface.
+func (f *FallbackChallenger) VerifyInvoiceStatus(hash lntypes.Hash,
+	state lnrpc.Invoice_InvoiceState, timeout time.Duration) error {
+
+	return f.VerifyInvoiceStatusContext(
+		context.Background(), hash, state, timeout,
+	)
+}
+
+// VerifyInvoiceStatusContext checks that an invoice identified by a payment
+// hash has the desired status like VerifyInvoiceStatus, but gives up as soon
+// as the given context is canceled. Once one of the challengers reports the
+// desired status, the check of the other one is canceled.
+//
+// NOTE: This is part of the auth.ContextInvoiceChecker interface.
+func (f *FallbackChallenger) VerifyInvoiceStatusContext(ctx context.Context,
+	hash lntypes.Hash, state lnrpc.Invoice_InvoiceState,
+	timeout time.Duration) error {
+
+	// There's no need to wait for the challenger that doesn't know the
+	// invoice if we know which one created it.
+	if creator, ok := f.creators.Get(hash); ok {
+		return auth.VerifyInvoiceStatus(
+			ctx, creator, hash, state, timeout,
+		)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	challengers := []Challenger{f.primary, f.fallback}
+	errChan := make(chan error, len(challengers))
+	for _, c := range challengers {
+		go func(c Challenger) {
+			errChan <- auth.VerifyInvoiceStatus(
+				ctx, c, hash, state, timeout,
+			)
+		}(c)
+	}
+
+	var firstErr error
+	for range challengers {
+		err := <-errChan
+		if err == nil {
+			return nil
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Ready returns an error if neither the primary nor the fallback challenger is
+// ready.
+func (f *FallbackChallenger) Ready() error {
+	err := CheckReady(f.primary)
+	if err == nil {
+		return nil
+	}
+
+	return CheckReady(f.fallback)
+}
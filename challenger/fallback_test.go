@@ -0,0 +1,123 @@
+package challenger
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+)
+
+// mockChallenger is a simple challenger that either hands out challenges for a
+// fixed payment hash or fails if it is marked as down. If stateErr is set, the
+// state of its invoice can't be verified.
+type mockChallenger struct {
+	hash     lntypes.Hash
+	down     bool
+	stateErr error
+}
+
+var _ Challenger = (*mockChallenger)(nil)
+
+func (m *mockChallenger) Stop() {}
+
+func (m *mockChallenger) NewChallenge(int64) (string, lntypes.Hash, error) {
+	if m.down {
+		return "", lntypes.ZeroHash, fmt.Errorf("challenger down")
+	}
+
+	return fmt.Sprintf("invoice-%v", m.hash), m.hash, nil
+}
+
+func (m *mockChallenger) VerifyPaymentHash(_ context.Context,
+	hash lntypes.Hash) error {
+
+	if m.down || hash != m.hash {
+		return fmt.Errorf("unknown payment hash")
+	}
+
+	return nil
+}
+
+func (m *mockChallenger) VerifyInvoiceStatus(hash lntypes.Hash,
+	_ lnrpc.Invoice_InvoiceState, timeout time.Duration) error {
+
+	if m.down || hash != m.hash {
+		time.Sleep(timeout)
+		return fmt.Errorf("no invoice found for hash=%v", hash)
+	}
+
+	return m.stateErr
+}
+
+// TestFallbackChallenger makes sure the primary challenger is preferred while
+// it is healthy and the fallback serves challenges while it is not.
+func TestFallbackChallenger(t *testing.T) {
+	t.Parallel()
+
+	primary := &mockChallenger{hash: lntypes.Hash{1}}
+	fallback := &mockChallenger{hash: lntypes.Hash{2}}
+	c := NewFallbackChallenger(primary, fallback)
+	ctx := context.Background()
+
+	// With a healthy primary, it should be used for new challenges.
+	_, hash, err := c.NewChallenge(1)
+	require.NoError(t, err)
+	require.Equal(t, primary.hash, hash)
+	require.NoError(t, c.VerifyPaymentHash(ctx, hash))
+	require.NoError(t, c.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_SETTLED, defaultTimeout,
+	))
+
+	// Once the primary goes down, the fallback takes over.
+	primary.down = true
+	_, hash, err = c.NewChallenge(1)
+	require.NoError(t, err)
+	require.Equal(t, fallback.hash, hash)
+	require.NoError(t, c.VerifyPaymentHash(ctx, hash))
+	require.NoError(t, c.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_SETTLED, defaultTimeout,
+	))
+
+	// Invoices unknown to both should still be rejected.
+	require.Error(t, c.VerifyPaymentHash(ctx, lntypes.Hash{3}))
+	require.Error(t, c.VerifyInvoiceStatus(
+		lntypes.Hash{3}, lnrpc.Invoice_SETTLED, defaultTimeout,
+	))
+
+	// If both are down, no challenge can be created.
+	fallback.down = true
+	_, _, err = c.NewChallenge(1)
+	require.Error(t, err)
+
+	// And the primary is preferred again once it recovers.
+	primary.down = false
+	_, hash, err = c.NewChallenge(1)
+	require.NoError(t, err)
+	require.Equal(t, primary.hash, hash)
+}
+
+// TestFallbackChallengerCreator makes sure the state of an invoice is only
+// looked up with the challenger that created it, so a failure isn't delayed
+// by the other challenger waiting for an invoice it doesn't know.
+func TestFallbackChallengerCreator(t *testing.T) {
+	t.Parallel()
+
+	primary := &mockChallenger{hash: lntypes.Hash{1}}
+	fallback := &mockChallenger{hash: lntypes.Hash{2}}
+	c := NewFallbackChallenger(primary, fallback)
+
+	_, hash, err := c.NewChallenge(1)
+	require.NoError(t, err)
+
+	stateErr := fmt.Errorf("invoice canceled")
+	primary.stateErr = stateErr
+
+	start := time.Now()
+	err = c.VerifyInvoiceStatus(hash, lnrpc.Invoice_SETTLED, time.Minute)
+	require.ErrorIs(t, err, stateErr)
+	require.Less(t, time.Since(start), time.Second)
+}
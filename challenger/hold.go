@@ -0,0 +1,120 @@
+package challenger
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"google.golang.org/grpc"
+)
+
+// HoldInvoiceClient is an interface that only implements the part of lnd's
+// invoices sub-server client that is needed to manage hold invoices.
+type HoldInvoiceClient interface {
+	// AddHoldInvoice adds a new hold invoice for the given payment hash.
+	AddHoldInvoice(ctx context.Context,
+		in *invoicesrpc.AddHoldInvoiceRequest,
+		opts ...grpc.CallOption) (*invoicesrpc.AddHoldInvoiceResp,
+		error)
+
+	// SettleInvoice settles an accepted hold invoice with its preimage.
+	SettleInvoice(ctx context.Context, in *invoicesrpc.SettleInvoiceMsg,
+		opts ...grpc.CallOption) (*invoicesrpc.SettleInvoiceResp, error)
+
+	// CancelInvoice cancels an invoice, which returns the HTLCs of an
+	// accepted hold invoice to the payer.
+	CancelInvoice(ctx context.Context, in *invoicesrpc.CancelInvoiceMsg,
+		opts ...grpc.CallOption) (*invoicesrpc.CancelInvoiceResp, error)
+}
+
+// PaymentHashSource returns the payment hash of a new hold invoice for the
+// given price. Whoever supplies the hash knows its preimage and decides when
+// the invoice is settled, for example once the backend fulfilled the request
+// that was paid for.
+type PaymentHashSource func(price int64) (lntypes.Hash, error)
+
+// WithHoldInvoices makes the challenger create hold invoices for payment hashes
+// of the given source instead of regular invoices. Such invoices reach the
+// ACCEPTED state once paid and stay there until they are settled or canceled,
+// so services need to accept L402s with an accepted invoice. Until then, the
+// payer doesn't know the preimage and presents the L402 with a zero preimage.
+func WithHoldInvoices(client HoldInvoiceClient,
+	hashSource PaymentHashSource) LndChallengerOption {
+
+	return func(l *LndChallenger) {
+		l.holdClient = client
+		l.hashSource = hashSource
+	}
+}
+
+// newHoldChallenge adds a new hold invoice for the given service and price and
+// returns its payment request and hash.
+func (l *LndChallenger) newHoldChallenge(service string,
+	price int64) (string, lntypes.Hash, error) {
+
+	hash, err := l.hashSource(price)
+	if err != nil {
+		return "", lntypes.ZeroHash, fmt.Errorf("unable to get "+
+			"payment hash of hold invoice: %w", err)
+	}
+
+	// The invoice request generator still determines all other fields of
+	// the invoice.
+	invoice, err := l.genInvoiceReq(price, service)
+	if err != nil {
+		return "", lntypes.ZeroHash, err
+	}
+
+	response, err := l.holdClient.AddHoldInvoice(
+		l.clientCtx(), &invoicesrpc.AddHoldInvoiceRequest{
+			Memo:            invoice.Memo,
+			Hash:            hash[:],
+			Value:           invoice.Value,
+			ValueMsat:       invoice.ValueMsat,
+			DescriptionHash: invoice.DescriptionHash,
+			Expiry:          invoice.Expiry,
+			FallbackAddr:    invoice.FallbackAddr,
+			CltvExpiry:      invoice.CltvExpiry,
+			RouteHints:      invoice.RouteHints,
+			Private:         invoice.Private,
+		},
+	)
+	if err != nil {
+		return "", lntypes.ZeroHash, fmt.Errorf("unable to add hold "+
+			"invoice: %w", err)
+	}
+
+	return response.PaymentRequest, hash, nil
+}
+
+// SettleInvoice settles the accepted hold invoice with the given preimage.
+func (l *LndChallenger) SettleInvoice(preimage lntypes.Preimage) error {
+	if l.holdClient == nil {
+		return fmt.Errorf("challenger doesn't create hold invoices")
+	}
+
+	_, err := l.holdClient.SettleInvoice(
+		l.clientCtx(), &invoicesrpc.SettleInvoiceMsg{
+			Preimage: preimage[:],
+		},
+	)
+
+	return err
+}
+
+// CancelInvoice cancels the hold invoice with the given payment hash, which
+// returns the payment to the payer if the invoice was accepted.
+func (l *LndChallenger) CancelInvoice(hash lntypes.Hash) error {
+	if l.holdClient == nil {
+		return fmt.Errorf("challenger doesn't create hold invoices")
+	}
+
+	_, err := l.holdClient.CancelInvoice(
+		l.clientCtx(), &invoicesrpc.CancelInvoiceMsg{
+			PaymentHash: hash[:],
+		},
+	)
+
+	return err
+}
@@ -6,12 +6,15 @@ import (
 	"github.com/lightninglabs/aperture/auth"
 	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
 	"google.golang.org/grpc"
 )
 
 // InvoiceRequestGenerator is a function type that returns a new request for the
-// lnrpc.AddInvoice call.
-type InvoiceRequestGenerator func(price int64) (*lnrpc.Invoice, error)
+// lnrpc.AddInvoice call. The service is the name of the service the invoice is
+// created for, which is empty if it isn't known.
+type InvoiceRequestGenerator func(price int64, service string) (*lnrpc.Invoice,
+	error)
 
 // InvoiceClient is an interface that only implements part of a full lnd client,
 // namely the part around the invoices we need for the challenger to work.
@@ -30,9 +33,52 @@ type InvoiceClient interface {
 		opts ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error)
 }
 
+// InvoiceLookupClient is an optional interface of an InvoiceClient that can
+// look up a single invoice. It's needed to verify the payment hash of a new
+// challenge.
+type InvoiceLookupClient interface {
+	// LookupInvoice looks up an invoice by its payment hash.
+	LookupInvoice(ctx context.Context, in *lnrpc.PaymentHash,
+		opts ...grpc.CallOption) (*lnrpc.Invoice, error)
+}
+
 // Challenger is an interface that combines the mint.Challenger and the
 // auth.InvoiceChecker interfaces.
 type Challenger interface {
 	mint.Challenger
 	auth.InvoiceChecker
 }
+
+// ReadinessChecker is an optional interface of a Challenger that reports
+// whether it is ready to create challenges and verify invoices.
+type ReadinessChecker interface {
+	// Ready returns an error if the challenger isn't ready yet or isn't
+	// able to serve requests anymore.
+	Ready() error
+}
+
+// verifyPaymentHash verifies the given payment hash with the challenger if it
+// implements the mint.PaymentHashVerifier interface. Challengers that don't
+// implement it can't rule out any payment hash, so nil is returned for them.
+func verifyPaymentHash(ctx context.Context, c Challenger,
+	hash lntypes.Hash) error {
+
+	verifier, ok := c.(mint.PaymentHashVerifier)
+	if !ok {
+		return nil
+	}
+
+	return verifier.VerifyPaymentHash(ctx, hash)
+}
+
+// CheckReady returns an error if the given challenger implements the
+// ReadinessChecker interface and isn't ready. Challengers that don't implement
+// it are always considered ready.
+func CheckReady(c Challenger) error {
+	checker, ok := c.(ReadinessChecker)
+	if !ok {
+		return nil
+	}
+
+	return checker.Ready()
+}
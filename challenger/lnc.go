@@ -1,6 +1,7 @@
 package challenger
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -62,6 +63,16 @@ func (l *LNCChallenger) Stop() {
 	l.lndChallenger.Stop()
 }
 
+// Ready returns an error if the challenger isn't able to verify invoices
+// through its LNC connection.
+func (l *LNCChallenger) Ready() error {
+	if err := l.nodeConn.Health(); err != nil {
+		return fmt.Errorf("lnc connection unhealthy: %w", err)
+	}
+
+	return l.lndChallenger.Ready()
+}
+
 // NewChallenge creates a new L402 payment challenge, returning a payment
 // request (invoice) and the corresponding payment hash.
 //
@@ -72,6 +83,27 @@ func (l *LNCChallenger) NewChallenge(price int64) (string, lntypes.Hash,
 	return l.lndChallenger.NewChallenge(price)
 }
 
+// NewServiceChallenge creates a new L402 payment challenge for the given
+// service, returning a payment request (invoice) and the corresponding payment
+// hash.
+//
+// NOTE: This is part of the mint.ServiceChallenger interface.
+func (l *LNCChallenger) NewServiceChallenge(service string,
+	price int64) (string, lntypes.Hash, error) {
+
+	return l.lndChallenger.NewServiceChallenge(service, price)
+}
+
+// VerifyPaymentHash makes sure the backing lnd node knows about an invoice with
+// the given payment hash.
+//
+// NOTE: This is part of the mint.PaymentHashVerifier interface.
+func (l *LNCChallenger) VerifyPaymentHash(ctx context.Context,
+	hash lntypes.Hash) error {
+
+	return l.lndChallenger.VerifyPaymentHash(ctx, hash)
+}
+
 // VerifyInvoiceStatus checks that an invoice identified by a payment
 // hash has the desired status. To make sure we don't fail while the
 // invoice update is still on its way, we try several times until either
@@ -83,3 +115,17 @@ func (l *LNCChallenger) VerifyInvoiceStatus(hash lntypes.Hash,
 
 	return l.lndChallenger.VerifyInvoiceStatus(hash, state, timeout)
 }
+
+// VerifyInvoiceStatusContext checks that an invoice identified by a payment
+// hash has the desired status like VerifyInvoiceStatus, but gives up as soon
+// as the given context is canceled.
+//
+// NOTE: This is part of the auth.ContextInvoiceChecker interface.
+func (l *LNCChallenger) VerifyInvoiceStatusContext(ctx context.Context,
+	hash lntypes.Hash, state lnrpc.Invoice_InvoiceState,
+	timeout time.Duration) error {
+
+	return l.lndChallenger.VerifyInvoiceStatusContext(
+		ctx, hash, state, timeout,
+	)
+}
@@ -1,6 +1,7 @@
 package challenger
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -8,8 +9,23 @@ import (
 	"sync"
 	"time"
 
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/lightningnetwork/lnd/lntypes"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// DefaultInvoiceReconnects is the default number of times the
+	// challenger tries to resubscribe to invoice updates after the
+	// subscription failed, before it gives up.
+	DefaultInvoiceReconnects = 5
+
+	// DefaultInvoiceReconnectBackoff is the default time the challenger
+	// waits before its first attempt to resubscribe to invoice updates.
+	// The time is doubled after every failed attempt.
+	DefaultInvoiceReconnectBackoff = time.Second
 )
 
 // LndChallenger is a challenger that uses an lnd backend to create new L402
@@ -20,10 +36,29 @@ type LndChallenger struct {
 	clientCtx     func() context.Context
 	genInvoiceReq InvoiceRequestGenerator
 
-	invoiceStates  map[lntypes.Hash]lnrpc.Invoice_InvoiceState
-	invoicesMtx    *sync.Mutex
+	// holdClient and hashSource are only set if the challenger creates
+	// hold invoices.
+	holdClient HoldInvoiceClient
+	hashSource PaymentHashSource
+
+	invoiceStates map[lntypes.Hash]lnrpc.Invoice_InvoiceState
+	invoicesMtx   *sync.Mutex
+	invoicesCond  *sync.Cond
+
+	// invoicesCancel cancels the current invoice subscription. It is
+	// guarded by invoicesMtx.
 	invoicesCancel func()
-	invoicesCond   *sync.Cond
+
+	// maxReconnects is the number of times the challenger tries to
+	// resubscribe to invoice updates after a failure, waiting
+	// reconnectBackoff before the first attempt.
+	maxReconnects    int
+	reconnectBackoff time.Duration
+
+	// subscribed is true while the invoice subscription is active, which
+	// also means the initial load of all invoices is complete. It is
+	// guarded by invoicesMtx.
+	subscribed bool
 
 	errChan chan<- error
 
@@ -34,13 +69,33 @@ type LndChallenger struct {
 // A compile time flag to ensure the LndChallenger satisfies the Challenger
 // interface.
 var _ Challenger = (*LndChallenger)(nil)
+var _ mint.ServiceChallenger = (*LndChallenger)(nil)
+var _ auth.ContextInvoiceChecker = (*LndChallenger)(nil)
+var _ mint.PaymentHashVerifier = (*LndChallenger)(nil)
+
+// LndChallengerOption is a functional option that can be used to modify the
+// behavior of an LndChallenger.
+type LndChallengerOption func(*LndChallenger)
+
+// WithInvoiceReconnects sets how many times the challenger tries to
+// resubscribe to invoice updates after the subscription failed and how long it
+// waits before the first attempt. Only once all attempts failed, the error is
+// reported on the challenger's error channel.
+func WithInvoiceReconnects(attempts int,
+	backoff time.Duration) LndChallengerOption {
+
+	return func(l *LndChallenger) {
+		l.maxReconnects = attempts
+		l.reconnectBackoff = backoff
+	}
+}
 
 // NewLndChallenger creates a new challenger that uses the given connection to
 // an lnd backend to create payment challenges.
 func NewLndChallenger(client InvoiceClient, batchSize int,
 	genInvoiceReq InvoiceRequestGenerator,
-	ctxFunc func() context.Context,
-	errChan chan<- error) (*LndChallenger, error) {
+	ctxFunc func() context.Context, errChan chan<- error,
+	opts ...LndChallengerOption) (*LndChallenger, error) {
 
 	// Make sure we have a valid context function. This will be called to
 	// create a new context for each call to the lnd client.
@@ -63,6 +118,12 @@ func NewLndChallenger(client InvoiceClient, batchSize int,
 		invoicesCond:  sync.NewCond(invoicesMtx),
 		quit:          make(chan struct{}),
 		errChan:       errChan,
+
+		maxReconnects:    DefaultInvoiceReconnects,
+		reconnectBackoff: DefaultInvoiceReconnectBackoff,
+	}
+	for _, opt := range opts {
+		opt(challenger)
 	}
 
 	err := challenger.Start()
@@ -78,6 +139,65 @@ func NewLndChallenger(client InvoiceClient, batchSize int,
 // invoices on startup and a subscription to all subsequent invoice updates
 // is created.
 func (l *LndChallenger) Start() error {
+	log.Debugf("Starting LND challenger")
+
+	stream, err := l.subscribe()
+	if err != nil {
+		return err
+	}
+
+	l.wg.Add(1)
+	go l.watchInvoices(stream)
+
+	return nil
+}
+
+// subscribe loads all invoices of the backing lnd node into the cache and
+// subscribes to all subsequent invoice updates.
+func (l *LndChallenger) subscribe() (lnrpc.Lightning_SubscribeInvoicesClient,
+	error) {
+
+	addIndex, settleIndex, err := l.loadInvoices()
+	if err != nil {
+		return nil, err
+	}
+
+	// We need to be able to cancel any subscription we make.
+	ctxc, cancel := context.WithCancel(l.clientCtx())
+
+	stream, err := l.client.SubscribeInvoices(
+		ctxc, &lnrpc.InvoiceSubscription{
+			AddIndex:    addIndex,
+			SettleIndex: settleIndex,
+		},
+	)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	l.invoicesMtx.Lock()
+	defer l.invoicesMtx.Unlock()
+
+	// If we're shutting down, Stop might have canceled the previous
+	// subscription already, so we need to cancel this one ourselves.
+	select {
+	case <-l.quit:
+		cancel()
+		return nil, fmt.Errorf("challenger shutting down")
+	default:
+	}
+
+	l.invoicesCancel = cancel
+	l.subscribed = true
+
+	return stream, nil
+}
+
+// loadInvoices paginates through all invoices of the backing lnd node, adds
+// them to our cache and returns the highest add and settle index. We need to
+// keep track of all invoices to ensure tokens are valid.
+func (l *LndChallenger) loadInvoices() (uint64, uint64, error) {
 	// These are the default values for the subscription. In case there are
 	// no invoices yet, this will instruct lnd to just send us all updates.
 	// If there are existing invoices, these indices will be updated to
@@ -85,10 +205,6 @@ func (l *LndChallenger) Start() error {
 	addIndex := uint64(0)
 	settleIndex := uint64(0)
 
-	log.Debugf("Starting LND challenger")
-	// Paginate through all existing invoices on startup and add them to our
-	// cache. We need to keep track of all invoices to ensure tokens are
-	// valid.
 	ctx := l.clientCtx()
 	indexOffset := uint64(0)
 	for {
@@ -100,7 +216,7 @@ func (l *LndChallenger) Start() error {
 			},
 		)
 		if err != nil {
-			return err
+			return 0, 0, err
 		}
 
 		// If there are no more invoices, stop pagination.
@@ -126,17 +242,24 @@ func (l *LndChallenger) Start() error {
 			hash, err := lntypes.MakeHash(invoice.RHash)
 			if err != nil {
 				l.invoicesMtx.Unlock()
-				return fmt.Errorf("error parsing invoice "+
-					"hash: %v", err)
+				return 0, 0, fmt.Errorf("error parsing "+
+					"invoice hash: %v", err)
 			}
 
-			// Skip tracking the state of canceled or expired
-			// invoices.
+			// Don't track the state of canceled or expired
+			// invoices. When reloading the invoices after a
+			// reconnect, this also drops invoices that were
+			// canceled while we weren't subscribed.
 			if invoiceIrrelevant(invoice) {
+				delete(l.invoiceStates, hash)
 				continue
 			}
 			l.invoiceStates[hash] = invoice.State
 		}
+
+		// Invoices might have been settled while we weren't
+		// subscribed, so we notify anyone waiting for updates.
+		l.invoicesCond.Broadcast()
 		l.invoicesMtx.Unlock()
 
 		// Update the index offset for the next batch.
@@ -144,43 +267,118 @@ func (l *LndChallenger) Start() error {
 	}
 	log.Debugf("Finished querying invoices")
 
-	// We need to be able to cancel any subscription we make.
-	ctxc, cancel := context.WithCancel(l.clientCtx())
-	l.invoicesCancel = cancel
+	return addIndex, settleIndex, nil
+}
 
-	subscriptionResp, err := l.client.SubscribeInvoices(
-		ctxc, &lnrpc.InvoiceSubscription{
-			AddIndex:    addIndex,
-			SettleIndex: settleIndex,
-		},
-	)
-	if err != nil {
-		cancel()
-		return err
+// watchInvoices reads invoice updates from the given stream and resubscribes
+// if the stream fails. If resubscribing fails as well, the error is signaled
+// to the main goroutine to force a shutdown/restart.
+//
+// NOTE: This must be run as a goroutine.
+func (l *LndChallenger) watchInvoices(
+	stream lnrpc.Lightning_SubscribeInvoicesClient) {
+
+	defer l.wg.Done()
+
+	for {
+		streamErr := l.readInvoiceStream(stream)
+
+		l.invoicesMtx.Lock()
+		l.invoicesCancel()
+		l.subscribed = false
+		l.invoicesMtx.Unlock()
+
+		if streamErr == nil {
+			return
+		}
+
+		// Our cache stays as it is while we reconnect, so anyone
+		// waiting for an invoice update just keeps waiting.
+		var err error
+		stream, err = l.resubscribe(streamErr)
+		switch {
+		case err != nil:
+			log.Errorf("Unable to resubscribe to invoices: %v", err)
+
+			select {
+			case l.errChan <- err:
+			case <-l.quit:
+			default:
+			}
+
+			return
+
+		case stream == nil:
+			return
+		}
 	}
+}
 
-	l.wg.Add(1)
-	go func() {
-		defer l.wg.Done()
-		defer cancel()
+// resubscribe tries to subscribe to invoice updates again after the previous
+// subscription failed with the given error, backing off exponentially between
+// attempts. Nil is returned for both the stream and the error if the
+// challenger is shutting down.
+func (l *LndChallenger) resubscribe(streamErr error) (
+	lnrpc.Lightning_SubscribeInvoicesClient, error) {
 
-		l.readInvoiceStream(subscriptionResp)
-	}()
+	err := streamErr
+	backoff := l.reconnectBackoff
+	for attempt := 1; attempt <= l.maxReconnects; attempt++ {
+		log.Warnf("Invoice subscription failed, resubscribing in %v "+
+			"(attempt %d of %d): %v", backoff, attempt,
+			l.maxReconnects, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-l.quit:
+			return nil, nil
+		}
+
+		var stream lnrpc.Lightning_SubscribeInvoicesClient
+		stream, err = l.subscribe()
+		if err == nil {
+			log.Infof("Resubscribed to invoices")
+			return stream, nil
+		}
+
+		select {
+		case <-l.quit:
+			return nil, nil
+		default:
+		}
+
+		backoff *= 2
+	}
+
+	return nil, err
+}
+
+// Ready returns an error if the challenger isn't able to verify invoices,
+// because the initial load of all invoices isn't complete yet or the invoice
+// subscription to lnd was lost.
+func (l *LndChallenger) Ready() error {
+	l.invoicesMtx.Lock()
+	defer l.invoicesMtx.Unlock()
+
+	if !l.subscribed {
+		return fmt.Errorf("invoice subscription to lnd not active")
+	}
 
 	return nil
 }
 
 // readInvoiceStream reads the invoice update messages sent on the stream until
-// the stream is aborted or the challenger is shutting down.
+// the stream is aborted or the challenger is shutting down. An error is only
+// returned if the stream failed.
 func (l *LndChallenger) readInvoiceStream(
-	stream lnrpc.Lightning_SubscribeInvoicesClient) {
+	stream lnrpc.Lightning_SubscribeInvoicesClient) error {
 
 	for {
 		// In case we receive the shutdown signal right after receiving
 		// an update, we can exit early.
 		select {
 		case <-l.quit:
-			return
+			return nil
 		default:
 		}
 
@@ -191,16 +389,9 @@ func (l *LndChallenger) readInvoiceStream(
 		switch {
 
 		case err == io.EOF:
-			// The connection is shutting down, we can't continue
-			// to function properly. Signal the error to the main
-			// goroutine to force a shutdown/restart.
-			select {
-			case l.errChan <- err:
-			case <-l.quit:
-			default:
-			}
-
-			return
+			// The connection is shutting down, we need to
+			// resubscribe.
+			return err
 
 		case err != nil && strings.Contains(
 			err.Error(), context.Canceled.Error(),
@@ -209,22 +400,14 @@ func (l *LndChallenger) readInvoiceStream(
 			// The context has been canceled, we are shutting down.
 			// So no need to forward the error to the main
 			// goroutine.
-			return
+			return nil
 
 		case err != nil:
 			log.Errorf("Received error from invoice subscription: "+
 				"%v", err)
 
-			// The connection is faulty, we can't continue to
-			// function properly. Signal the error to the main
-			// goroutine to force a shutdown/restart.
-			select {
-			case l.errChan <- err:
-			case <-l.quit:
-			default:
-			}
-
-			return
+			// The connection is faulty, we need to resubscribe.
+			return err
 
 		default:
 		}
@@ -238,7 +421,7 @@ func (l *LndChallenger) readInvoiceStream(
 		hash, err := lntypes.MakeHash(invoice.RHash)
 		if err != nil {
 			log.Errorf("Error parsing invoice hash: %v", err)
-			return
+			return nil
 		}
 
 		l.invoicesMtx.Lock()
@@ -258,8 +441,16 @@ func (l *LndChallenger) readInvoiceStream(
 
 // Stop shuts down the challenger.
 func (l *LndChallenger) Stop() {
-	l.invoicesCancel()
+	// Closing the quit channel first makes sure no new subscription is
+	// created after we canceled the current one.
 	close(l.quit)
+
+	l.invoicesMtx.Lock()
+	if l.invoicesCancel != nil {
+		l.invoicesCancel()
+	}
+	l.invoicesMtx.Unlock()
+
 	l.wg.Wait()
 }
 
@@ -270,9 +461,24 @@ func (l *LndChallenger) Stop() {
 func (l *LndChallenger) NewChallenge(price int64) (string, lntypes.Hash,
 	error) {
 
+	return l.NewServiceChallenge("", price)
+}
+
+// NewServiceChallenge creates a new L402 payment challenge for the given
+// service, returning a payment request (invoice) and the corresponding payment
+// hash. The service is passed on to the invoice request generator.
+//
+// NOTE: This is part of the mint.ServiceChallenger interface.
+func (l *LndChallenger) NewServiceChallenge(service string,
+	price int64) (string, lntypes.Hash, error) {
+
+	if l.holdClient != nil {
+		return l.newHoldChallenge(service, price)
+	}
+
 	// Obtain a new invoice from lnd first. We need to know the payment hash
 	// so we can add it as a caveat to the macaroon.
-	invoice, err := l.genInvoiceReq(price)
+	invoice, err := l.genInvoiceReq(price, service)
 	if err != nil {
 		log.Errorf("Error generating invoice request: %v", err)
 		return "", lntypes.ZeroHash, err
@@ -294,6 +500,44 @@ func (l *LndChallenger) NewChallenge(price int64) (string, lntypes.Hash,
 	return response.PaymentRequest, paymentHash, nil
 }
 
+// VerifyPaymentHash makes sure the backing lnd node knows about an invoice with
+// the given payment hash. If the invoice client can't look up invoices, the
+// payment hash isn't verified.
+//
+// NOTE: This is part of the mint.PaymentHashVerifier interface.
+func (l *LndChallenger) VerifyPaymentHash(ctx context.Context,
+	hash lntypes.Hash) error {
+
+	lookupClient, ok := l.client.(InvoiceLookupClient)
+	if !ok {
+		log.Debugf("Invoice client can't look up invoices, not "+
+			"verifying payment hash %v", hash)
+
+		return nil
+	}
+
+	// The client context might carry call metadata such as the macaroon
+	// used for LNC connections, so we pass that on while still honoring
+	// the caller's context.
+	if md, ok := metadata.FromOutgoingContext(l.clientCtx()); ok {
+		ctx = metadata.NewOutgoingContext(ctx, md)
+	}
+
+	invoice, err := lookupClient.LookupInvoice(ctx, &lnrpc.PaymentHash{
+		RHash: hash[:],
+	})
+	if err != nil {
+		return fmt.Errorf("unable to look up invoice: %w", err)
+	}
+
+	if !bytes.Equal(invoice.RHash, hash[:]) {
+		return fmt.Errorf("node returned invoice with unexpected "+
+			"payment hash %x", invoice.RHash)
+	}
+
+	return nil
+}
+
 // VerifyInvoiceStatus checks that an invoice identified by a payment
 // hash has the desired status. To make sure we don't fail while the
 // invoice update is still on its way, we try several times until either
@@ -303,6 +547,20 @@ func (l *LndChallenger) NewChallenge(price int64) (string, lntypes.Hash,
 func (l *LndChallenger) VerifyInvoiceStatus(hash lntypes.Hash,
 	state lnrpc.Invoice_InvoiceState, timeout time.Duration) error {
 
+	return l.VerifyInvoiceStatusContext(
+		context.Background(), hash, state, timeout,
+	)
+}
+
+// VerifyInvoiceStatusContext checks that an invoice identified by a payment
+// hash has the desired status like VerifyInvoiceStatus, but gives up as soon
+// as the given context is canceled.
+//
+// NOTE: This is part of the auth.ContextInvoiceChecker interface.
+func (l *LndChallenger) VerifyInvoiceStatusContext(ctx context.Context,
+	hash lntypes.Hash, state lnrpc.Invoice_InvoiceState,
+	timeout time.Duration) error {
+
 	// Prevent the challenger to be shut down while we're still waiting for
 	// status updates.
 	l.wg.Add(1)
@@ -327,6 +585,7 @@ func (l *LndChallenger) VerifyInvoiceStatus(hash lntypes.Hash,
 		select {
 		case <-doneChan:
 		case <-time.After(timeout):
+		case <-ctx.Done():
 		case <-l.quit:
 		}
 
@@ -1,13 +1,16 @@
 package challenger
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
 	"github.com/lightningnetwork/lnd/lntypes"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
@@ -45,6 +48,11 @@ type mockInvoiceClient struct {
 	quit       chan struct{}
 
 	lastAddIndex uint64
+
+	// subscribeErr is returned by SubscribeInvoices if set. Otherwise each
+	// subscription is signaled on subscribed if that is set.
+	subscribeErr error
+	subscribed   chan struct{}
 }
 
 // ListInvoices returns a paginated list of all invoices known to lnd.
@@ -72,7 +80,14 @@ func (m *mockInvoiceClient) SubscribeInvoices(_ context.Context,
 	in *lnrpc.InvoiceSubscription, _ ...grpc.CallOption) (
 	lnrpc.Lightning_SubscribeInvoicesClient, error) {
 
+	if m.subscribeErr != nil {
+		return nil, m.subscribeErr
+	}
+
 	m.lastAddIndex = in.AddIndex
+	if m.subscribed != nil {
+		m.subscribed <- struct{}{}
+	}
 
 	return &invoiceStreamMock{
 		updateChan: m.updateChan,
@@ -94,6 +109,19 @@ func (m *mockInvoiceClient) AddInvoice(_ context.Context, in *lnrpc.Invoice,
 	}, nil
 }
 
+// LookupInvoice looks up an invoice by its payment hash.
+func (m *mockInvoiceClient) LookupInvoice(_ context.Context,
+	in *lnrpc.PaymentHash, _ ...grpc.CallOption) (*lnrpc.Invoice, error) {
+
+	for _, invoice := range m.invoices {
+		if bytes.Equal(invoice.RHash, in.RHash) {
+			return invoice, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unable to locate invoice")
+}
+
 func (m *mockInvoiceClient) stop() {
 	close(m.quit)
 }
@@ -104,7 +132,7 @@ func newChallenger() (*LndChallenger, *mockInvoiceClient, chan error) {
 		errChan:    make(chan error, 1),
 		quit:       make(chan struct{}),
 	}
-	genInvoiceReq := func(price int64) (*lnrpc.Invoice, error) {
+	genInvoiceReq := func(int64, string) (*lnrpc.Invoice, error) {
 		return newInvoice(lntypes.ZeroHash, 99, lnrpc.Invoice_OPEN),
 			nil
 	}
@@ -157,11 +185,15 @@ func TestLndChallenger(t *testing.T) {
 	require.Equal(t, 1, len(invoiceMock.invoices))
 	require.Equal(t, uint64(0), invoiceMock.lastAddIndex)
 
+	// The challenger isn't ready before its initial load is complete.
+	require.Error(t, c.Ready())
+
 	// Now we already have an invoice in our lnd mock. When starting the
 	// challenger, we should have that invoice in the cache and a
 	// subscription that only starts at our faked addIndex.
 	err = c.Start()
 	require.NoError(t, err)
+	require.NoError(t, c.Ready())
 	require.Equal(t, 1, len(c.invoiceStates))
 	require.Equal(t, lnrpc.Invoice_OPEN, c.invoiceStates[lntypes.ZeroHash])
 	require.Equal(t, uint64(99), invoiceMock.lastAddIndex)
@@ -256,6 +288,10 @@ func TestLndChallenger(t *testing.T) {
 			t.Fatalf("wait group didn't finish before timeout")
 		}
 
+		// Without the subscription, the challenger isn't ready
+		// anymore.
+		require.Error(t, c.Ready())
+
 	case <-time.After(defaultTimeout):
 		t.Fatalf("error not received on main chan before the timeout")
 	}
@@ -263,3 +299,197 @@ func TestLndChallenger(t *testing.T) {
 	invoiceMock.stop()
 	c.Stop()
 }
+
+// TestLndChallengerReconnect makes sure the challenger resubscribes to invoice
+// updates after the subscription failed and only reports an error once all
+// attempts failed.
+func TestLndChallengerReconnect(t *testing.T) {
+	t.Parallel()
+
+	c, invoiceMock, mainErrChan := newChallenger()
+	invoiceMock.subscribed = make(chan struct{}, 1)
+	WithInvoiceReconnects(2, time.Millisecond)(c)
+
+	require.NoError(t, c.Start())
+	<-invoiceMock.subscribed
+	require.NoError(t, c.Ready())
+
+	// Someone waits for an invoice to be settled while the subscription
+	// fails and the invoice is settled before we resubscribed.
+	hash := lntypes.Hash{1, 2, 3}
+	verifyErr := make(chan error, 1)
+	go func() {
+		verifyErr <- c.VerifyInvoiceStatus(
+			hash, lnrpc.Invoice_SETTLED, time.Second,
+		)
+	}()
+
+	invoice := newInvoice(hash, 1, lnrpc.Invoice_SETTLED)
+	invoiceMock.invoices = append(invoiceMock.invoices, invoice)
+	invoiceMock.errChan <- io.EOF
+
+	// The reloaded invoices satisfy the waiting check and the challenger
+	// is subscribed again without reporting an error.
+	<-invoiceMock.subscribed
+	require.NoError(t, <-verifyErr)
+	require.Eventually(t, func() bool {
+		return c.Ready() == nil
+	}, time.Second, time.Millisecond)
+	require.Equal(t, uint64(1), invoiceMock.lastAddIndex)
+
+	select {
+	case err := <-mainErrChan:
+		t.Fatalf("unexpected error on main chan: %v", err)
+	default:
+	}
+
+	// If resubscribing fails as well, the error is reported once all
+	// attempts are used up.
+	invoiceMock.subscribeErr = fmt.Errorf("lnd still down")
+	invoiceMock.errChan <- fmt.Errorf("an expected error")
+
+	select {
+	case err := <-mainErrChan:
+		require.ErrorContains(t, err, "lnd still down")
+
+	case <-time.After(time.Second):
+		t.Fatalf("error not received on main chan before the timeout")
+	}
+	require.Error(t, c.Ready())
+
+	invoiceMock.stop()
+	c.Stop()
+}
+
+// TestLndChallengerVerifyPaymentHash makes sure only payment hashes of invoices
+// known to the lnd backend are accepted.
+func TestLndChallengerVerifyPaymentHash(t *testing.T) {
+	t.Parallel()
+
+	c, _, _ := newChallenger()
+	ctx := context.Background()
+
+	// The mock generates all invoices with the zero hash, so that one
+	// shouldn't be known before we created a challenge.
+	require.Error(t, c.VerifyPaymentHash(ctx, lntypes.ZeroHash))
+
+	_, hash, err := c.NewChallenge(1337)
+	require.NoError(t, err)
+	require.NoError(t, c.VerifyPaymentHash(ctx, hash))
+
+	// A hash of an invoice that was never added must be rejected.
+	unknownHash := lntypes.Hash{1, 2, 3}
+	require.Error(t, c.VerifyPaymentHash(ctx, unknownHash))
+
+	// An invoice client that can't look up invoices doesn't verify
+	// payment hashes.
+	c.client = struct{ InvoiceClient }{c.client}
+	require.NoError(t, c.VerifyPaymentHash(ctx, unknownHash))
+}
+
+// mockHoldInvoiceClient adds hold invoices to the invoices of an lnd mock and
+// records which of them were settled or canceled.
+type mockHoldInvoiceClient struct {
+	invoiceClient *mockInvoiceClient
+
+	settled  []lntypes.Preimage
+	canceled []lntypes.Hash
+}
+
+// AddHoldInvoice adds a new hold invoice to lnd.
+func (m *mockHoldInvoiceClient) AddHoldInvoice(_ context.Context,
+	in *invoicesrpc.AddHoldInvoiceRequest,
+	_ ...grpc.CallOption) (*invoicesrpc.AddHoldInvoiceResp, error) {
+
+	m.invoiceClient.invoices = append(
+		m.invoiceClient.invoices, &lnrpc.Invoice{
+			Memo:  in.Memo,
+			RHash: in.Hash,
+			Value: in.Value,
+			State: lnrpc.Invoice_OPEN,
+		},
+	)
+
+	return &invoicesrpc.AddHoldInvoiceResp{
+		PaymentRequest: "hold",
+	}, nil
+}
+
+// SettleInvoice settles an accepted hold invoice.
+func (m *mockHoldInvoiceClient) SettleInvoice(_ context.Context,
+	in *invoicesrpc.SettleInvoiceMsg,
+	_ ...grpc.CallOption) (*invoicesrpc.SettleInvoiceResp, error) {
+
+	preimage, err := lntypes.MakePreimage(in.Preimage)
+	if err != nil {
+		return nil, err
+	}
+	m.settled = append(m.settled, preimage)
+
+	return &invoicesrpc.SettleInvoiceResp{}, nil
+}
+
+// CancelInvoice cancels an invoice.
+func (m *mockHoldInvoiceClient) CancelInvoice(_ context.Context,
+	in *invoicesrpc.CancelInvoiceMsg,
+	_ ...grpc.CallOption) (*invoicesrpc.CancelInvoiceResp, error) {
+
+	hash, err := lntypes.MakeHash(in.PaymentHash)
+	if err != nil {
+		return nil, err
+	}
+	m.canceled = append(m.canceled, hash)
+
+	return &invoicesrpc.CancelInvoiceResp{}, nil
+}
+
+// TestLndChallengerHoldInvoices makes sure hold invoices are created for the
+// externally supplied payment hashes and their accepted state is tracked.
+func TestLndChallengerHoldInvoices(t *testing.T) {
+	t.Parallel()
+
+	c, invoiceMock, _ := newChallenger()
+	holdMock := &mockHoldInvoiceClient{invoiceClient: invoiceMock}
+
+	// Without hold invoices, nothing can be settled or canceled.
+	preimage := lntypes.Preimage{1, 2, 3}
+	require.Error(t, c.SettleInvoice(preimage))
+	require.Error(t, c.CancelInvoice(preimage.Hash()))
+
+	var prices []int64
+	hashSource := func(price int64) (lntypes.Hash, error) {
+		prices = append(prices, price)
+		return preimage.Hash(), nil
+	}
+	WithHoldInvoices(holdMock, hashSource)(c)
+
+	// The hold invoice uses the supplied hash and the fields of the
+	// generated invoice request.
+	req, hash, err := c.NewChallenge(1337)
+	require.NoError(t, err)
+	require.Equal(t, "hold", req)
+	require.Equal(t, preimage.Hash(), hash)
+	require.Equal(t, []int64{1337}, prices)
+	require.Len(t, invoiceMock.invoices, 1)
+	require.Equal(t, hash[:], invoiceMock.invoices[0].RHash)
+	require.NoError(t, c.VerifyPaymentHash(context.Background(), hash))
+
+	// Once paid, the invoice is accepted but not settled.
+	require.NoError(t, c.Start())
+	invoiceMock.updateChan <- newInvoice(hash, 1, lnrpc.Invoice_ACCEPTED)
+	require.NoError(t, c.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_ACCEPTED, defaultTimeout,
+	))
+	require.Error(t, c.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_SETTLED, defaultTimeout,
+	))
+
+	// Settling and canceling is passed on to lnd.
+	require.NoError(t, c.SettleInvoice(preimage))
+	require.Equal(t, []lntypes.Preimage{preimage}, holdMock.settled)
+	require.NoError(t, c.CancelInvoice(hash))
+	require.Equal(t, []lntypes.Hash{hash}, holdMock.canceled)
+
+	invoiceMock.stop()
+	c.Stop()
+}
@@ -0,0 +1,492 @@
+package challenger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+)
+
+const (
+	// lnurlPayTag is the tag of an LNURL-pay response.
+	lnurlPayTag = "payRequest"
+
+	// lnurlStatusError is the status of an LNURL error response.
+	lnurlStatusError = "ERROR"
+
+	// maxLNURLResponseSize is the maximum size of a response of an LNURL
+	// endpoint that is read.
+	maxLNURLResponseSize = 1 << 16
+
+	// DefaultLNURLTimeout is the default timeout of each request to an
+	// LNURL endpoint.
+	DefaultLNURLTimeout = 15 * time.Second
+
+	// DefaultLNURLSettledRetention is the default time a settled invoice
+	// is kept after it was last used to verify an L402.
+	DefaultLNURLSettledRetention = 30 * 24 * time.Hour
+
+	// defaultVerifyInterval is the time that is waited between two polls
+	// of the LNURL-verify endpoint of an invoice.
+	defaultVerifyInterval = 500 * time.Millisecond
+)
+
+// PayResponse is the response of an LNURL-pay endpoint as defined by LUD-06.
+type PayResponse struct {
+	// Status is set to ERROR if the request failed.
+	Status string `json:"status,omitempty"`
+
+	// Reason is the reason of a failed request.
+	Reason string `json:"reason,omitempty"`
+
+	// Tag identifies the response as an LNURL-pay response.
+	Tag string `json:"tag"`
+
+	// Callback is the URL invoices are requested from.
+	Callback string `json:"callback"`
+
+	// MinSendable is the minimum amount in millisatoshis an invoice can
+	// be requested for.
+	MinSendable int64 `json:"minSendable"`
+
+	// MaxSendable is the maximum amount in millisatoshis an invoice can
+	// be requested for.
+	MaxSendable int64 `json:"maxSendable"`
+
+	// Metadata is the JSON encoded metadata of the payment.
+	Metadata string `json:"metadata"`
+}
+
+// InvoiceResponse is the response of the callback of an LNURL-pay endpoint as
+// defined by LUD-06, extended by the verify URL of LUD-21.
+type InvoiceResponse struct {
+	// Status is set to ERROR if the request failed.
+	Status string `json:"status,omitempty"`
+
+	// Reason is the reason of a failed request.
+	Reason string `json:"reason,omitempty"`
+
+	// PR is the requested payment request.
+	PR string `json:"pr"`
+
+	// Verify is the optional URL the settlement of the invoice can be
+	// polled from as defined by LUD-21.
+	Verify string `json:"verify,omitempty"`
+}
+
+// VerifyResponse is the response of an LNURL-verify endpoint as defined by
+// LUD-21.
+type VerifyResponse struct {
+	// Status is set to ERROR if the request failed and to OK otherwise.
+	Status string `json:"status"`
+
+	// Reason is the reason of a failed request.
+	Reason string `json:"reason,omitempty"`
+
+	// Settled is true once the invoice was paid.
+	Settled bool `json:"settled"`
+
+	// Preimage is the hex encoded preimage of a settled invoice.
+	Preimage string `json:"preimage,omitempty"`
+
+	// PR is the payment request of the invoice.
+	PR string `json:"pr"`
+}
+
+// lnurlInvoice is an invoice that was requested from the LNURL-pay endpoint.
+type lnurlInvoice struct {
+	// verifyURL is the LUD-21 URL the settlement can be polled from. It is
+	// empty if the endpoint doesn't support LNURL-verify.
+	verifyURL string
+
+	// expiry is the time the invoice expires at.
+	expiry time.Time
+
+	// settled is true once the invoice is known to be paid.
+	settled bool
+
+	// lastUsed is the last time the settlement of the invoice was
+	// verified.
+	lastUsed time.Time
+}
+
+// LNURLChallenger is a challenger that requests invoices from an LNURL-pay
+// endpoint (LUD-06), such as one of a Lightning Address, instead of a node of
+// its own. The settlement of invoices can only be verified if the endpoint
+// supports LNURL-verify (LUD-21). As the invoices are only known to the
+// challenger that requested them, L402s issued before a restart can't be
+// verified afterwards.
+type LNURLChallenger struct {
+	payURL         string
+	chainParams    *chaincfg.Params
+	client         *http.Client
+	verifyInterval time.Duration
+	retention      time.Duration
+
+	mu       sync.Mutex
+	invoices map[lntypes.Hash]*lnurlInvoice
+
+	quit     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// A compile time flag to ensure the LNURLChallenger satisfies the Challenger
+// and mint.PaymentHashVerifier interfaces.
+var _ Challenger = (*LNURLChallenger)(nil)
+var _ mint.PaymentHashVerifier = (*LNURLChallenger)(nil)
+
+// LNURLChallengerOption is a functional option that can be used to modify the
+// behavior of an LNURLChallenger. The options are applied in the given order.
+type LNURLChallengerOption func(*LNURLChallenger)
+
+// WithLNURLHTTPClient sets the HTTP client that is used for all requests to
+// the LNURL endpoints. It replaces the default client with a timeout of
+// DefaultLNURLTimeout. The challenger uses a copy of the client, so options
+// applied after this one don't modify the given client. The client must not
+// be nil.
+func WithLNURLHTTPClient(client *http.Client) LNURLChallengerOption {
+	return func(l *LNURLChallenger) {
+		if client == nil {
+			l.client = nil
+			return
+		}
+
+		clientCopy := *client
+		l.client = &clientCopy
+	}
+}
+
+// WithLNURLTimeout sets the timeout of each request to an LNURL endpoint.
+func WithLNURLTimeout(timeout time.Duration) LNURLChallengerOption {
+	return func(l *LNURLChallenger) {
+		if l.client != nil {
+			l.client.Timeout = timeout
+		}
+	}
+}
+
+// WithLNURLProxy sends all requests to the LNURL endpoints through the proxy
+// with the given URL. For a SOCKS5 proxy such as Tor, host names are resolved
+// by the proxy, so onion services can be reached as well.
+func WithLNURLProxy(proxyURL *url.URL) LNURLChallengerOption {
+	return func(l *LNURLChallenger) {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyURL(proxyURL)
+		if l.client != nil {
+			l.client.Transport = transport
+		}
+	}
+}
+
+// WithLNURLSettledRetention sets the time a settled invoice is kept after it
+// was last used to verify an L402. The L402s of a pruned invoice are rejected
+// afterwards.
+func WithLNURLSettledRetention(
+	retention time.Duration) LNURLChallengerOption {
+
+	return func(l *LNURLChallenger) {
+		l.retention = retention
+	}
+}
+
+// NewLNURLChallenger creates a new challenger that requests invoices from the
+// LNURL-pay endpoint at the given URL. The invoices must be for the chain with
+// the given parameters.
+func NewLNURLChallenger(payURL string, chainParams *chaincfg.Params,
+	opts ...LNURLChallengerOption) (*LNURLChallenger, error) {
+
+	parsed, err := url.Parse(payURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LNURL-pay URL: %w", err)
+	}
+	if parsed.Scheme != "https" && parsed.Scheme != "http" {
+		return nil, fmt.Errorf("invalid LNURL-pay URL scheme %s",
+			parsed.Scheme)
+	}
+
+	challenger := &LNURLChallenger{
+		payURL:         payURL,
+		chainParams:    chainParams,
+		client:         &http.Client{Timeout: DefaultLNURLTimeout},
+		verifyInterval: defaultVerifyInterval,
+		retention:      DefaultLNURLSettledRetention,
+		invoices:       make(map[lntypes.Hash]*lnurlInvoice),
+		quit:           make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(challenger)
+	}
+	if challenger.client == nil {
+		return nil, errors.New("LNURL HTTP client must not be nil")
+	}
+
+	return challenger, nil
+}
+
+// Stop shuts down the challenger.
+//
+// NOTE: This is part of the mint.Challenger interface.
+func (l *LNURLChallenger) Stop() {
+	l.stopOnce.Do(func() {
+		close(l.quit)
+	})
+	l.wg.Wait()
+}
+
+// NewChallenge requests a new invoice for the given price from the LNURL-pay
+// endpoint and returns it together with its payment hash.
+//
+// NOTE: This is part of the mint.Challenger interface.
+func (l *LNURLChallenger) NewChallenge(price int64) (string, lntypes.Hash,
+	error) {
+
+	var payResp PayResponse
+	if err := l.get(l.payURL, &payResp); err != nil {
+		return "", lntypes.ZeroHash, fmt.Errorf("unable to query "+
+			"LNURL-pay endpoint: %w", err)
+	}
+	if payResp.Tag != lnurlPayTag {
+		return "", lntypes.ZeroHash, fmt.Errorf("unexpected LNURL "+
+			"tag %s", payResp.Tag)
+	}
+
+	amount := lnwire.NewMSatFromSatoshis(btcutil.Amount(price))
+	if int64(amount) < payResp.MinSendable ||
+		int64(amount) > payResp.MaxSendable {
+
+		return "", lntypes.ZeroHash, fmt.Errorf("price of %d msat "+
+			"outside of sendable range [%d, %d] of LNURL-pay "+
+			"endpoint", amount, payResp.MinSendable,
+			payResp.MaxSendable)
+	}
+
+	callback, err := url.Parse(payResp.Callback)
+	if err != nil {
+		return "", lntypes.ZeroHash, fmt.Errorf("invalid LNURL-pay "+
+			"callback: %w", err)
+	}
+	query := callback.Query()
+	query.Set("amount", strconv.FormatInt(int64(amount), 10))
+	callback.RawQuery = query.Encode()
+
+	var invoiceResp InvoiceResponse
+	if err := l.get(callback.String(), &invoiceResp); err != nil {
+		return "", lntypes.ZeroHash, fmt.Errorf("unable to request "+
+			"invoice: %w", err)
+	}
+
+	// We never trust the endpoint to return the invoice we asked for.
+	invoice, err := zpay32.Decode(invoiceResp.PR, l.chainParams)
+	if err != nil {
+		return "", lntypes.ZeroHash, fmt.Errorf("unable to decode "+
+			"invoice: %w", err)
+	}
+	switch {
+	case invoice.PaymentHash == nil:
+		return "", lntypes.ZeroHash, errors.New("invoice without " +
+			"payment hash")
+
+	case invoice.MilliSat == nil || *invoice.MilliSat != amount:
+		return "", lntypes.ZeroHash, fmt.Errorf("invoice amount "+
+			"doesn't match price of %d msat", amount)
+	}
+
+	hash := lntypes.Hash(*invoice.PaymentHash)
+	if invoiceResp.Verify == "" {
+		log.Warnf("LNURL-pay endpoint doesn't support LNURL-verify, "+
+			"unable to verify settlement of invoice %v", hash)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.pruneInvoices()
+	l.invoices[hash] = &lnurlInvoice{
+		verifyURL: invoiceResp.Verify,
+		expiry:    invoice.Timestamp.Add(invoice.Expiry()),
+	}
+
+	return invoiceResp.PR, hash, nil
+}
+
+// pruneInvoices removes all invoices that expired without being paid and all
+// settled invoices that weren't used for longer than the retention. The mutex
+// must be held when calling this method.
+func (l *LNURLChallenger) pruneInvoices() {
+	now := time.Now()
+	for hash, invoice := range l.invoices {
+		switch {
+		case !invoice.settled && now.After(invoice.expiry):
+			delete(l.invoices, hash)
+
+		case invoice.settled &&
+			now.Sub(invoice.lastUsed) > l.retention:
+
+			delete(l.invoices, hash)
+		}
+	}
+}
+
+// VerifyPaymentHash returns an error if the given payment hash doesn't belong
+// to an invoice this challenger requested.
+//
+// NOTE: This is part of the mint.PaymentHashVerifier interface.
+func (l *LNURLChallenger) VerifyPaymentHash(_ context.Context,
+	hash lntypes.Hash) error {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.invoices[hash]; !ok {
+		return fmt.Errorf("unknown invoice with payment hash %v", hash)
+	}
+
+	return nil
+}
+
+// VerifyInvoiceStatus checks that an invoice identified by a payment hash has
+// the desired status by polling its LNURL-verify endpoint until either the
+// invoice is settled or the given timeout is reached. LNURL-verify only
+// reports whether an invoice is settled, so no other status can be verified.
+//
+// NOTE: This is part of the auth.InvoiceChecker interface.
+func (l *LNURLChallenger) VerifyInvoiceStatus(hash lntypes.Hash,
+	state lnrpc.Invoice_InvoiceState, timeout time.Duration) error {
+
+	if state != lnrpc.Invoice_SETTLED {
+		return fmt.Errorf("unable to verify invoice status %v through "+
+			"LNURL-verify", state)
+	}
+
+	l.mu.Lock()
+	invoice, ok := l.invoices[hash]
+	var verifyURL string
+	if ok {
+		verifyURL = invoice.verifyURL
+	}
+	settled := ok && invoice.settled
+	if settled {
+		invoice.lastUsed = time.Now()
+	}
+	l.mu.Unlock()
+
+	switch {
+	case !ok:
+		return fmt.Errorf("no invoice found for hash=%v", hash)
+
+	case settled:
+		return nil
+
+	case verifyURL == "":
+		return fmt.Errorf("no LNURL-verify URL for invoice with "+
+			"hash=%v", hash)
+	}
+
+	// Prevent the challenger to be shut down while we're still polling.
+	l.wg.Add(1)
+	defer l.wg.Done()
+
+	deadline := time.After(timeout)
+	for {
+		var verifyResp VerifyResponse
+		err := l.get(verifyURL, &verifyResp)
+		switch {
+		case err != nil:
+			log.Debugf("Unable to poll LNURL-verify endpoint of "+
+				"invoice %v: %v", hash, err)
+
+		case verifyResp.Settled:
+			if err := checkPreimage(verifyResp, hash); err != nil {
+				return err
+			}
+
+			l.mu.Lock()
+			invoice.settled = true
+			invoice.lastUsed = time.Now()
+			l.mu.Unlock()
+
+			return nil
+		}
+
+		select {
+		case <-time.After(l.verifyInterval):
+		case <-deadline:
+			return fmt.Errorf("invoice not settled before "+
+				"timeout, hash=%v", hash)
+		case <-l.quit:
+			return errors.New("challenger shutting down")
+		}
+	}
+}
+
+// checkPreimage makes sure the preimage of a settled invoice reported by an
+// LNURL-verify endpoint, if any, matches the payment hash.
+func checkPreimage(resp VerifyResponse, hash lntypes.Hash) error {
+	if resp.Preimage == "" {
+		return nil
+	}
+
+	preimage, err := lntypes.MakePreimageFromStr(resp.Preimage)
+	if err != nil {
+		return fmt.Errorf("invalid preimage of invoice %v: %w", hash,
+			err)
+	}
+	if !preimage.Matches(hash) {
+		return fmt.Errorf("preimage doesn't match invoice %v", hash)
+	}
+
+	return nil
+}
+
+// get sends a GET request to the given LNURL endpoint and decodes its JSON
+// response into the given value. LNURL error responses are returned as error.
+func (l *LNURLChallenger) get(endpoint string, v interface{}) error {
+	resp, err := l.client.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxLNURLResponseSize))
+	if err != nil {
+		return err
+	}
+
+	// Some endpoints send their LNURL error responses with an error status
+	// code, so we look for the reason before rejecting the response.
+	var errResp struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	err = json.Unmarshal(body, &errResp)
+	isErrResp := err == nil && errResp.Status == lnurlStatusError
+
+	switch {
+	case isErrResp:
+		return fmt.Errorf("LNURL endpoint returned error: %s",
+			errResp.Reason)
+
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+
+	case err != nil:
+		return fmt.Errorf("invalid response: %w", err)
+	}
+
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,367 @@
+package challenger
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"github.com/stretchr/testify/require"
+)
+
+// lnurlServerMock is an LNURL-pay endpoint with LNURL-verify support.
+type lnurlServerMock struct {
+	t           *testing.T
+	server      *httptest.Server
+	privKey     *btcec.PrivateKey
+	chainParams *chaincfg.Params
+	withVerify  bool
+
+	mu        sync.Mutex
+	preimages map[lntypes.Hash]lntypes.Preimage
+	settled   map[lntypes.Hash]bool
+}
+
+func newLNURLServerMock(t *testing.T, chainParams *chaincfg.Params,
+	withVerify bool) *lnurlServerMock {
+
+	privKey, err := btcec.NewPrivateKey()
+	require.NoError(t, err)
+
+	m := &lnurlServerMock{
+		t:           t,
+		privKey:     privKey,
+		chainParams: chainParams,
+		withVerify:  withVerify,
+		preimages:   make(map[lntypes.Hash]lntypes.Preimage),
+		settled:     make(map[lntypes.Hash]bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pay", m.pay)
+	mux.HandleFunc("/callback", m.callback)
+	mux.HandleFunc("/verify", m.verify)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+
+	return m
+}
+
+func (m *lnurlServerMock) pay(w http.ResponseWriter, _ *http.Request) {
+	_ = json.NewEncoder(w).Encode(&PayResponse{
+		Tag:         lnurlPayTag,
+		Callback:    m.server.URL + "/callback",
+		MinSendable: 1000,
+		MaxSendable: 1000000,
+		Metadata:    `[["text/plain","aperture"]]`,
+	})
+}
+
+func (m *lnurlServerMock) callback(w http.ResponseWriter, r *http.Request) {
+	amount, err := strconv.ParseInt(r.URL.Query().Get("amount"), 10, 64)
+	require.NoError(m.t, err)
+
+	var preimage lntypes.Preimage
+	m.mu.Lock()
+	copy(preimage[:], strconv.Itoa(len(m.preimages)))
+	m.mu.Unlock()
+	hash := preimage.Hash()
+
+	invoice, err := zpay32.NewInvoice(
+		m.chainParams, hash, time.Now(),
+		zpay32.Description("aperture"),
+		zpay32.Amount(lnwire.MilliSatoshi(amount)),
+	)
+	require.NoError(m.t, err)
+
+	payReq, err := invoice.Encode(zpay32.MessageSigner{
+		SignCompact: func(msg []byte) ([]byte, error) {
+			return ecdsa.SignCompact(m.privKey, msg, true), nil
+		},
+	})
+	require.NoError(m.t, err)
+
+	m.mu.Lock()
+	m.preimages[hash] = preimage
+	m.mu.Unlock()
+
+	resp := &InvoiceResponse{PR: payReq}
+	if m.withVerify {
+		resp.Verify = m.server.URL + "/verify?hash=" + hash.String()
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (m *lnurlServerMock) verify(w http.ResponseWriter, r *http.Request) {
+	hash, err := lntypes.MakeHashFromStr(r.URL.Query().Get("hash"))
+	require.NoError(m.t, err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	resp := &VerifyResponse{Status: "OK", Settled: m.settled[hash]}
+	if resp.Settled {
+		resp.Preimage = m.preimages[hash].String()
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (m *lnurlServerMock) settle(hash lntypes.Hash) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.settled[hash] = true
+}
+
+// TestLNURLChallenger makes sure invoices are requested from the LNURL-pay
+// endpoint and their settlement is verified through LNURL-verify.
+func TestLNURLChallenger(t *testing.T) {
+	server := newLNURLServerMock(t, &chaincfg.RegressionNetParams, true)
+	c, err := NewLNURLChallenger(
+		server.server.URL+"/pay", &chaincfg.RegressionNetParams,
+	)
+	require.NoError(t, err)
+	c.verifyInterval = 10 * time.Millisecond
+	defer c.Stop()
+
+	// Prices outside of the sendable range are rejected.
+	_, _, err = c.NewChallenge(2000)
+	require.ErrorContains(t, err, "outside of sendable range")
+
+	payReq, hash, err := c.NewChallenge(10)
+	require.NoError(t, err)
+
+	invoice, err := zpay32.Decode(payReq, &chaincfg.RegressionNetParams)
+	require.NoError(t, err)
+	require.Equal(t, lnwire.MilliSatoshi(10000), *invoice.MilliSat)
+	require.Equal(t, hash[:], invoice.PaymentHash[:])
+
+	ctx := context.Background()
+	require.NoError(t, c.VerifyPaymentHash(ctx, hash))
+	require.Error(t, c.VerifyPaymentHash(ctx, lntypes.ZeroHash))
+
+	// Until the invoice is paid, the verification times out. Only the
+	// settled state can be verified.
+	err = c.VerifyInvoiceStatus(hash, lnrpc.Invoice_SETTLED, defaultTimeout)
+	require.ErrorContains(t, err, "not settled before timeout")
+	err = c.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_ACCEPTED, defaultTimeout,
+	)
+	require.Error(t, err)
+
+	// An invoice that is paid while we wait is verified.
+	go func() {
+		time.Sleep(defaultTimeout / 2)
+		server.settle(hash)
+	}()
+	err = c.VerifyInvoiceStatus(hash, lnrpc.Invoice_SETTLED, time.Second)
+	require.NoError(t, err)
+
+	// Once settled, the status is known without polling again.
+	server.server.Close()
+	err = c.VerifyInvoiceStatus(hash, lnrpc.Invoice_SETTLED, defaultTimeout)
+	require.NoError(t, err)
+}
+
+// TestLNURLChallengerWithoutVerify makes sure invoices of an endpoint without
+// LNURL-verify support can't be verified.
+func TestLNURLChallengerWithoutVerify(t *testing.T) {
+	server := newLNURLServerMock(t, &chaincfg.RegressionNetParams, false)
+	c, err := NewLNURLChallenger(
+		server.server.URL+"/pay", &chaincfg.RegressionNetParams,
+	)
+	require.NoError(t, err)
+	defer c.Stop()
+
+	_, hash, err := c.NewChallenge(10)
+	require.NoError(t, err)
+
+	err = c.VerifyInvoiceStatus(hash, lnrpc.Invoice_SETTLED, defaultTimeout)
+	require.ErrorContains(t, err, "no LNURL-verify URL")
+
+	// Invoices for another chain are rejected.
+	c, err = NewLNURLChallenger(
+		server.server.URL+"/pay", &chaincfg.MainNetParams,
+	)
+	require.NoError(t, err)
+	defer c.Stop()
+
+	_, _, err = c.NewChallenge(10)
+	require.ErrorContains(t, err, "unable to decode invoice")
+}
+
+// TestLNURLChallengerPrune makes sure unpaid invoices are pruned once they
+// expired and settled ones once they weren't used for the retention.
+func TestLNURLChallengerPrune(t *testing.T) {
+	const retention = time.Hour
+
+	server := newLNURLServerMock(t, &chaincfg.RegressionNetParams, true)
+	c, err := NewLNURLChallenger(
+		server.server.URL+"/pay", &chaincfg.RegressionNetParams,
+		WithLNURLSettledRetention(retention),
+	)
+	require.NoError(t, err)
+	defer c.Stop()
+
+	_, unpaid, err := c.NewChallenge(10)
+	require.NoError(t, err)
+	_, paid, err := c.NewChallenge(10)
+	require.NoError(t, err)
+
+	server.settle(paid)
+	err = c.VerifyInvoiceStatus(paid, lnrpc.Invoice_SETTLED, time.Second)
+	require.NoError(t, err)
+
+	// Move the unpaid invoice's expiry and the last use of the settled
+	// one into the past, but keep the latter within the retention.
+	c.mu.Lock()
+	c.invoices[unpaid].expiry = time.Now().Add(-time.Second)
+	c.invoices[paid].lastUsed = time.Now().Add(-retention / 2)
+	c.mu.Unlock()
+
+	_, _, err = c.NewChallenge(10)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.Error(t, c.VerifyPaymentHash(ctx, unpaid))
+	require.NoError(t, c.VerifyPaymentHash(ctx, paid))
+
+	// Using the settled invoice extends its retention.
+	err = c.VerifyInvoiceStatus(paid, lnrpc.Invoice_SETTLED, time.Second)
+	require.NoError(t, err)
+	c.mu.Lock()
+	require.WithinDuration(t, time.Now(), c.invoices[paid].lastUsed,
+		time.Second)
+
+	// Once it wasn't used for longer than the retention, it's pruned.
+	c.invoices[paid].lastUsed = time.Now().Add(-2 * retention)
+	c.mu.Unlock()
+
+	_, _, err = c.NewChallenge(10)
+	require.NoError(t, err)
+	require.Error(t, c.VerifyPaymentHash(ctx, paid))
+}
+
+// TestLNURLChallengerHTTPClient makes sure the HTTP client of the challenger
+// honors the configured timeout and proxy and rejects error responses.
+func TestLNURLChallengerHTTPClient(t *testing.T) {
+	hang := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/hang":
+				<-hang
+
+			case "/html":
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte("<html>oops</html>"))
+
+			case "/error":
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(
+					`{"status":"ERROR","reason":"no"}`,
+				))
+			}
+		},
+	))
+	defer server.Close()
+	defer close(hang)
+
+	newChallenge := func(path string,
+		opts ...LNURLChallengerOption) error {
+
+		c, err := NewLNURLChallenger(
+			server.URL+path, &chaincfg.RegressionNetParams,
+			opts...,
+		)
+		require.NoError(t, err)
+		defer c.Stop()
+
+		_, _, err = c.NewChallenge(10)
+		return err
+	}
+
+	// A hanging endpoint is given up on after the timeout.
+	start := time.Now()
+	err := newChallenge("/hang", WithLNURLTimeout(defaultTimeout))
+	require.Error(t, err)
+	require.Less(t, time.Since(start), time.Second)
+
+	// The status code is checked before the body is decoded, unless the
+	// body is an LNURL error response.
+	err = newChallenge("/html")
+	require.ErrorContains(t, err, "unexpected status code 500")
+
+	err = newChallenge("/error")
+	require.ErrorContains(t, err, "LNURL endpoint returned error: no")
+
+	// All requests are sent through the proxy.
+	proxy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(
+				`{"status":"ERROR","reason":"proxied"}`,
+			))
+		},
+	))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+
+	err = newChallenge("/html", WithLNURLProxy(proxyURL))
+	require.ErrorContains(t, err, "proxied")
+
+	// A client passed in isn't modified by the other options.
+	client := &http.Client{Timeout: time.Minute}
+	err = newChallenge(
+		"/html", WithLNURLHTTPClient(client),
+		WithLNURLTimeout(defaultTimeout), WithLNURLProxy(proxyURL),
+	)
+	require.ErrorContains(t, err, "proxied")
+	require.Equal(t, time.Minute, client.Timeout)
+	require.Nil(t, client.Transport)
+
+	// A nil client is rejected.
+	_, err = NewLNURLChallenger(
+		server.URL+"/pay", &chaincfg.RegressionNetParams,
+		WithLNURLHTTPClient(nil), WithLNURLTimeout(defaultTimeout),
+	)
+	require.ErrorContains(t, err, "must not be nil")
+}
+
+// TestLNURLChallengerNetworks makes sure invoices of every network aperture
+// supports are accepted with the chain parameters of the configured network.
+func TestLNURLChallengerNetworks(t *testing.T) {
+	networks := []lndclient.Network{
+		lndclient.NetworkMainnet, lndclient.NetworkTestnet,
+		lndclient.NetworkRegtest, lndclient.NetworkSimnet,
+		lndclient.NetworkSignet,
+	}
+	for _, network := range networks {
+		chainParams, err := network.ChainParams()
+		require.NoError(t, err)
+
+		server := newLNURLServerMock(t, chainParams, false)
+		c, err := NewLNURLChallenger(
+			server.server.URL+"/pay", chainParams,
+		)
+		require.NoError(t, err)
+
+		_, _, err = c.NewChallenge(10)
+		require.NoError(t, err, network)
+		c.Stop()
+	}
+}
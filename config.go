@@ -3,11 +3,15 @@ package aperture
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/lightninglabs/aperture/aperturedb"
+	"github.com/lightninglabs/aperture/challenger"
+	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightninglabs/aperture/proxy"
 )
 
@@ -66,6 +70,65 @@ type AuthConfig struct {
 	// DevServer set to true to skip verification of the mailbox server's
 	// tls cert.
 	DevServer bool `long:"devserver" description:"set to true to skip verification of the server's tls cert."`
+
+	// LNURL is the URL of an LNURL-pay endpoint that invoices are
+	// requested from instead of an lnd node.
+	LNURL string `long:"lnurl" description:"The URL of an LNURL-pay endpoint to request invoices from instead of an lnd node. Payments can only be verified if the endpoint supports LNURL-verify (LUD-21)."`
+
+	// LNURLTimeout is the timeout of each request to the LNURL endpoints.
+	LNURLTimeout time.Duration `long:"lnurltimeout" description:"The timeout of each request to the LNURL endpoints. Set to 0 to use the default of 15s."`
+
+	// LNURLProxy is the URL of an optional proxy, such as Tor, that all
+	// requests to the LNURL endpoints are sent through.
+	LNURLProxy string `long:"lnurlproxy" description:"The URL of a proxy to send all requests to the LNURL endpoints through, e.g. socks5://127.0.0.1:9050 for Tor to reach onion services."`
+
+	// LNURLSettledRetention is the time a settled invoice is kept after
+	// it was last used to verify an L402.
+	LNURLSettledRetention time.Duration `long:"lnurlsettledretention" description:"The time a paid invoice is kept in memory after it was last used to verify an L402. L402s of invoices that weren't used for longer are rejected. Set to 0 to use the default of 720h."`
+
+	// LndFallback set to true to use the direct lnd connection as a
+	// fallback whenever the LNC connection is unavailable. Both the LNC and
+	// the direct lnd fields need to be set in that case.
+	LndFallback bool `long:"lndfallback" description:"Whether to fall back to the direct lnd connection when the LNC connection is unavailable."`
+
+	// RequireServicesCaveat set to true to reject L402s that don't have a
+	// services caveat instead of granting them access to all services.
+	RequireServicesCaveat bool `long:"requireservicescaveat" description:"Whether to reject L402s without a services caveat instead of treating them as admin tokens with access to all services."`
+
+	// StrictPreimage set to true to reject all-zero preimages of pending
+	// payments with a distinct error before verifying an L402.
+	StrictPreimage bool `long:"strictpreimage" description:"Whether to reject L402s with an all-zero preimage of a pending payment before any further verification."`
+
+	// StrictCaveatChains set to true to reject L402s with multiple caveats
+	// of a custom condition if its satisfier can't verify that each of
+	// them only narrows the access granted by the previous one.
+	StrictCaveatChains bool `long:"strictcaveatchains" description:"Whether to reject L402s with a chain of custom caveats whose satisfier can't verify that they only narrow access."`
+
+	// VerifyPaymentHash set to true to make sure the payment hash of each
+	// new challenge is known to the lnd node before an L402 is minted.
+	VerifyPaymentHash bool `long:"verifypaymenthash" description:"Whether to check that the payment hash of each new challenge belongs to an invoice known to the lnd node before minting an L402."`
+
+	// RevocationWebhook is an optional URL each revoked L402 secret is
+	// posted to as an audit event.
+	RevocationWebhook string `long:"revocationwebhook" description:"URL to post an audit event to for each revoked L402 secret. Revocations are always logged."`
+
+	// CacheChallengeHeaders enables caching the constant parts of the
+	// challenge header.
+	CacheChallengeHeaders bool `long:"cachechallengeheaders" description:"Whether to precompute and cache the constant parts of the challenge header to reduce the work done for each 402 response."`
+
+	// DualHeaderPolicy defines how the credentials are chosen if a client
+	// sends both an LSAT and an L402 Authorization header.
+	DualHeaderPolicy string `long:"dualheaderpolicy" description:"How to handle clients that send both an LSAT and an L402 Authorization header. Either preferl402 to use the L402 header or requirematch to reject requests whose headers contain different credentials." choice:"preferl402" choice:"requirematch"`
+
+	// MacaroonLocation is the location hint set on every minted macaroon.
+	MacaroonLocation string `long:"macaroonlocation" description:"The location hint set on every minted macaroon, for example the domain of the operator. Defaults to lsat."`
+
+	// SecretCacheSize is the number of L402 secrets kept in memory to
+	// avoid a round trip to the database for each verification.
+	SecretCacheSize int `long:"secretcachesize" description:"The number of L402 secrets to cache in memory to avoid a database round trip for each verification. Set to 0 to disable the cache."`
+
+	// SecretCacheTTL is the time a secret is kept in the cache.
+	SecretCacheTTL time.Duration `long:"secretcachettl" description:"The time an L402 secret is kept in the cache. A revoked L402 may still be accepted by other instances sharing the database for this long. Set to 0 to use the default of 1m."`
 }
 
 func (a *AuthConfig) validate() error {
@@ -74,7 +137,63 @@ func (a *AuthConfig) validate() error {
 		return nil
 	}
 
+	if a.SecretCacheSize < 0 || a.SecretCacheTTL < 0 {
+		return errors.New("secret cache size and TTL must not be " +
+			"negative")
+	}
+
 	switch {
+	// Invoices are either requested from an LNURL-pay endpoint or created
+	// by an lnd node, not both.
+	case a.LNURL != "" && (a.LndHost != "" || a.Passphrase != ""):
+		return errors.New("lnurl cannot be combined with an lnd or " +
+			"lnc connection")
+
+	// If an LNURL-pay endpoint is set, we request the invoices from it.
+	case a.LNURL != "":
+		log.Info("Validating LNURL configuration")
+
+		if a.Network == "" {
+			return errors.New("lnurl network required")
+		}
+
+		if a.LNURLTimeout < 0 {
+			return errors.New("lnurl timeout must not be negative")
+		}
+
+		if a.LNURLSettledRetention < 0 {
+			return errors.New("lnurl settled retention must not " +
+				"be negative")
+		}
+
+		if a.LNURLProxy != "" {
+			proxyURL, err := url.Parse(a.LNURLProxy)
+			if err != nil {
+				return fmt.Errorf("invalid lnurl proxy: %w",
+					err)
+			}
+
+			switch proxyURL.Scheme {
+			case "socks5", "socks5h", "http", "https":
+			default:
+				return fmt.Errorf("unsupported lnurl proxy "+
+					"scheme %s", proxyURL.Scheme)
+			}
+		}
+
+		return nil
+
+	// If both are set and the fallback is enabled, we connect through LNC
+	// and use the direct connection to the LND node as a fallback.
+	case a.LndHost != "" && a.Passphrase != "" && a.LndFallback:
+		log.Info("Validating lnc configuration with lnd fallback")
+
+		if err := a.validateLNCAuth(); err != nil {
+			return err
+		}
+
+		return a.validateLNDAuth()
+
 	// If LndHost is set we connect directly to the LND node.
 	case a.LndHost != "":
 		log.Info("Validating lnd configuration")
@@ -130,10 +249,23 @@ func (a *AuthConfig) validateLNCAuth() error {
 }
 
 type HashMailConfig struct {
-	Enabled               bool          `long:"enabled"`
-	MessageRate           time.Duration `long:"messagerate" description:"The average minimum time that should pass between each message."`
-	MessageBurstAllowance int           `long:"messageburstallowance" description:"The burst rate we allow for messages."`
-	StaleTimeout          time.Duration `long:"staletimeout" description:"The time after the last activity that a mailbox should be removed. Set to -1s to disable. "`
+	Enabled                    bool          `long:"enabled"`
+	MessageRate                time.Duration `long:"messagerate" description:"The average minimum time that should pass between each message."`
+	MessageBurstAllowance      int           `long:"messageburstallowance" description:"The burst rate we allow for messages."`
+	ReadMessageRate            time.Duration `long:"readmessagerate" description:"The average minimum time that should pass between each message read from a mailbox. Defaults to messagerate."`
+	ReadMessageBurstAllowance  int           `long:"readmessageburstallowance" description:"The burst rate we allow for messages read from a mailbox. Defaults to messageburstallowance."`
+	WriteMessageRate           time.Duration `long:"writemessagerate" description:"The average minimum time that should pass between each message written to a mailbox. Defaults to messagerate."`
+	WriteMessageBurstAllowance int           `long:"writemessageburstallowance" description:"The burst rate we allow for messages written to a mailbox. Defaults to messageburstallowance."`
+	StaleTimeout               time.Duration `long:"staletimeout" description:"The time after the last activity that a mailbox should be removed. Set to -1s to disable. "`
+	TearDownPairs              bool          `long:"teardownpairs" description:"Tear down both streams of a bidirectional pair when a client deletes one of them."`
+	MaxMessageSize             uint64        `long:"maxmessagesize" description:"The maximum size in bytes of a single message sent through a mailbox. Streams exceeding it are torn down. Defaults to 64MB."`
+	ReclaimStreams             bool          `long:"reclaimstreams" description:"Allow the creator of a mailbox to reclaim it by creating it again, instead of failing because it already exists."`
+	DrainTimeout               time.Duration `long:"draintimeout" description:"The maximum time to wait for active mailboxes to become idle on shutdown before tearing them down. Set to 0 to tear them down immediately."`
+	Persist                    bool          `long:"persist" description:"Persist the descriptors of active mailboxes in the database so they can be restored after a restart."`
+	ActiveReadRate             float64       `long:"activereadrate" description:"The minimum number of reads per second a mailbox session needs to be counted as active instead of standby. Defaults to 0.5."`
+	RequireSignatures          bool          `long:"requiresignatures" description:"Require every request to create or delete a mailbox to be signed with lnd's SignMessage RPC over the operation, stream ID and timestamp."`
+	MaxStreamsPerClient        int           `long:"maxstreamsperclient" description:"The maximum number of mailboxes a single client IP address may have active at the same time. Set to 0 to disable."`
+	StreamAcquireTimeout       time.Duration `long:"streamacquiretimeout" description:"The maximum time to wait for the read or write end of a mailbox to be released by another client before the request for it fails. Set to 0 to fail right away."`
 }
 
 type TorConfig struct {
@@ -141,12 +273,39 @@ type TorConfig struct {
 	ListenPort  uint16 `long:"listenport" description:"The port we should listen on for client requests over Tor. Note that this port should not be exposed to the outside world, it is only intended to be reached by clients through the onion service."`
 	VirtualPort uint16 `long:"virtualport" description:"The port through which the onion services created can be reached at."`
 	V3          bool   `long:"v3" description:"Whether we should listen for client requests through a v3 onion service."`
+
+	// AuthorizedClients is the list of base32 encoded x25519 public keys
+	// of the clients that are allowed to connect to the v3 onion service.
+	// If empty, anyone who knows the onion address can connect.
+	AuthorizedClients []string `long:"authorizedclients" description:"The base32 encoded x25519 public key of a client that is authorized to connect to the v3 onion service. Can be specified multiple times. If none is set, the onion service is reachable by anyone."`
+}
+
+// APIKeyConfig is the configuration of the static API keys trusted callers
+// can authenticate with instead of an L402.
+type APIKeyConfig struct {
+	// Header is the header field clients send their API key in.
+	Header string `long:"header" description:"The header field clients send their API key in. Defaults to X-Api-Key."`
+
+	// Keys is the set of API keys that are accepted.
+	Keys []string `long:"keys" description:"An API key that is accepted by services that select the apikey authenticator. Can be specified multiple times."`
+}
+
+// AdminConfig is the configuration of the admin endpoint operators can manage
+// aperture's state at runtime with.
+type AdminConfig struct {
+	// Enabled, if true, serves the admin endpoint.
+	Enabled bool `long:"enabled" description:"Serve the admin endpoint under /admin/ on the main listen address, e.g. to inspect and reset the free requests of a client."`
+
+	// BearerToken is the token that requests to the admin endpoint must
+	// present in the Authorization header as "Bearer <token>".
+	BearerToken string `long:"bearertoken" description:"The token requests to the admin endpoint must authenticate with as a bearer token. Required if the admin endpoint is enabled."`
 }
 
 type Config struct {
 	// ListenAddr is the listening address that we should use to allow Aperture
-	// to listen for requests.
-	ListenAddr string `long:"listenaddr" description:"The interface we should listen on for client requests."`
+	// to listen for requests. Multiple addresses can be separated by
+	// commas, for example to listen on both an IPv4 and an IPv6 interface.
+	ListenAddr string `long:"listenaddr" description:"The interface we should listen on for client requests. Multiple addresses can be separated by commas."`
 
 	// ServerName can be set to a fully qualifying domain name that should
 	// be used while creating a certificate through Let's Encrypt.
@@ -159,6 +318,11 @@ type Config struct {
 	// Insecure can be set to disable TLS on incoming connections.
 	Insecure bool `long:"insecure" description:"Listen on an insecure connection, disabling TLS for incoming connections."`
 
+	// DisableH2CUpgrade can be set to only allow HTTP/2 Cleartext (h2c)
+	// connections with prior knowledge and reject requests that upgrade
+	// an HTTP/1.1 connection to h2c.
+	DisableH2CUpgrade bool `long:"disableh2cupgrade" description:"Reject requests that upgrade an HTTP/1.1 connection to HTTP/2 Cleartext (h2c). Clients that speak h2c with prior knowledge, like gRPC, are still served. Only applies to insecure and Tor listeners."`
+
 	// StaticRoot is the folder where the static content served by the proxy
 	// is located.
 	StaticRoot string `long:"staticroot" description:"The folder where the static content is located."`
@@ -167,8 +331,12 @@ type Config struct {
 	// directory defined by StaticRoot.
 	ServeStatic bool `long:"servestatic" description:"Flag to enable or disable static content serving."`
 
+	// ServeMintInfo defines if the mint's verification metadata and the
+	// catalog of services should be served on the well-known L402 path.
+	ServeMintInfo bool `long:"servemintinfo" description:"Serve the mint's verification metadata and service catalog on /.well-known/l402."`
+
 	// DatabaseBackend is the database backend to be used by the server.
-	DatabaseBackend string `long:"dbbackend" description:"The database backend to use for storing all asset related data." choice:"sqlite" choice:"postgres" yaml:"dbbackend"`
+	DatabaseBackend string `long:"dbbackend" description:"The database backend to use for storing all asset related data." choice:"sqlite" choice:"postgres" choice:"memory" yaml:"dbbackend"`
 
 	// Sqlite is the configuration section for the SQLite database backend.
 	Sqlite *aperturedb.SqliteConfig `group:"sqlite" namespace:"sqlite"`
@@ -185,6 +353,17 @@ type Config struct {
 
 	Tor *TorConfig `group:"tor" namespace:"tor"`
 
+	// APIKey is the configuration section for the static API keys that
+	// services can accept through the apikey authenticator.
+	APIKey *APIKeyConfig `group:"apikey" namespace:"apikey"`
+
+	// Admin is the configuration section for the admin endpoint.
+	Admin *AdminConfig `group:"admin" namespace:"admin"`
+
+	// CORS is the Cross Origin Resource Sharing policy applied to the
+	// responses of the proxy.
+	CORS *proxy.CORSConfig `group:"cors" namespace:"cors"`
+
 	// Services is a list of JSON objects in string format, which specify
 	// each backend service to Aperture.
 	Services []*proxy.Service `long:"service" description:"Configurations for each Aperture backend service."`
@@ -221,9 +400,122 @@ type Config struct {
 	// be fully written.
 	WriteTimeout time.Duration `long:"writetimeout" description:"The maximum amount of time to wait for a response to be fully written."`
 
+	// ShutdownTimeout is the maximum amount of time to wait for in-flight
+	// requests to complete when shutting down.
+	ShutdownTimeout time.Duration `long:"shutdowntimeout" description:"The maximum amount of time to wait for in-flight requests to complete on shutdown before closing all connections. Set to 0 to close them immediately."`
+
+	// SecretPruneInterval is the interval at which the secrets of expired
+	// L402s are removed from the database. If zero, secrets are never
+	// pruned.
+	SecretPruneInterval time.Duration `long:"secretpruneinterval" description:"The interval at which the secrets of expired L402s are removed from the database. Set to 0 to disable pruning."`
+
+	// LNCSessionPruneInterval is the interval at which expired LNC
+	// sessions are removed from the database. If zero, sessions are never
+	// pruned.
+	LNCSessionPruneInterval time.Duration `long:"lncsessionpruneinterval" description:"The interval at which expired LNC sessions are removed from the database. Set to 0 to disable pruning."`
+
+	// FreebieRetention is the time after which the free request counters
+	// of clients that didn't make any free request since are removed from
+	// the database. If zero, counters are never pruned.
+	FreebieRetention time.Duration `long:"freebieretention" description:"The time after which the free request counters of clients without any further free request are removed from the database, granting them their free requests again. Set to 0 to disable pruning."`
+
 	// InvoiceBatchSize is the number of invoices to fetch in a single
 	// request.
 	InvoiceBatchSize int `long:"invoicebatchsize" description:"The number of invoices to fetch in a single request."`
+
+	// MaxRequestRate is the maximum number of requests per second that
+	// aperture admits in total, across all services.
+	MaxRequestRate float64 `long:"maxrequestrate" description:"The maximum number of requests per second admitted across all services. Excess requests are rejected with 503. Set to 0 to disable."`
+
+	// MaxRequestBurst is the number of requests that are admitted in a
+	// burst above MaxRequestRate.
+	MaxRequestBurst int `long:"maxrequestburst" description:"The number of requests admitted in a burst above maxrequestrate. Defaults to one second's worth of requests."`
+
+	// MaxConcurrentRequests is the maximum number of requests aperture
+	// handles concurrently, across all services.
+	MaxConcurrentRequests int `long:"maxconcurrentrequests" description:"The maximum number of requests handled concurrently across all services. Excess requests are rejected with 503. Set to 0 to disable."`
+
+	// MaxConcurrentVerifications is the maximum number of authentication
+	// verifications aperture runs concurrently.
+	MaxConcurrentVerifications int `long:"maxconcurrentverifications" description:"The maximum number of authentication verifications that run concurrently. Excess requests are queued for up to verificationqueuetimeout and then rejected with 429. Set to 0 to disable."`
+
+	// VerificationQueueTimeout is the maximum time a request waits for a
+	// free verification slot.
+	VerificationQueueTimeout time.Duration `long:"verificationqueuetimeout" description:"The maximum time a request waits for a free verification slot before it is rejected. Set to 0 to reject right away."`
+
+	// AccessLogFormat is the format in which the proxy logs each request.
+	AccessLogFormat string `long:"accesslogformat" description:"The format in which each proxied request is logged. Either text for an apache-like log line or json for a structured log line." choice:"text" choice:"json"`
+
+	// BackendSourceAddr is the local address that connections to the
+	// backend services originate from.
+	BackendSourceAddr string `long:"backendsourceaddr" description:"The local IP address (optionally with port) that connections to the backend services originate from. Useful on multi-homed hosts. If empty, the operating system chooses the address."`
+
+	// TrustedProxies is a list of proxies that are trusted to report the
+	// real client IP address in the RealIPHeader.
+	TrustedProxies []string `long:"trustedproxies" description:"The IP address or subnet in CIDR notation of a proxy, such as a load balancer, that is trusted to report the real client IP address. Can be specified multiple times."`
+
+	// ProxyProtocol can be set to read the real client address of
+	// connections from the ProxyProtocolUpstreams from the PROXY protocol
+	// header they start with.
+	ProxyProtocol bool `long:"proxyprotocol" description:"Read the real client address from the PROXY protocol (v1 or v2) header that connections from the proxyprotocolupstreams start with, for example when running behind HAProxy or an AWS NLB."`
+
+	// ProxyProtocolUpstreams is a list of upstreams that are trusted to
+	// send PROXY protocol headers.
+	ProxyProtocolUpstreams []string `long:"proxyprotocolupstreams" description:"The IP address or subnet in CIDR notation of an upstream, such as a load balancer, that is trusted to send PROXY protocol headers. Connections from other peers are served as they are. Can be specified multiple times."`
+
+	// RealIPHeader is the header field trusted proxies report the real
+	// client IP address in.
+	RealIPHeader string `long:"realipheader" description:"The header field trusted proxies report the real client IP address in, e.g. X-Forwarded-For (the default) or X-Real-IP."`
+
+	// RejectHostMismatch can be set to reject HTTP/2 requests with a Host
+	// header field that conflicts with their :authority pseudo-header.
+	RejectHostMismatch bool `long:"rejecthostmismatch" description:"Reject HTTP/2 and gRPC requests with a Host header field that doesn't match their :authority pseudo-header, which is used to match the service."`
+
+	// MaxInjectedHeaders is the maximum number of header fields a service
+	// may add to each backend request.
+	MaxInjectedHeaders int `long:"maxinjectedheaders" description:"The maximum number of header fields a service may add to each backend request through its headers option. Services that exceed it are rejected. Set to 0 to use the default of 32."`
+
+	// MaxJSONChallengeSize is the maximum size in bytes of the JSON body
+	// of a 402 response.
+	MaxJSONChallengeSize int `long:"maxjsonchallengesize" description:"The maximum size in bytes of the JSON body of a 402 response. Optional fields are left out of larger bodies, and if the challenge still doesn't fit, it is only sent in the header fields. Set to 0 to use the default of 8192."`
+
+	// PaywallTemplate is the optional path of a template for the paywall
+	// page of services with paywallpage set.
+	PaywallTemplate string `long:"paywalltemplate" description:"The path of an html/template file to render the paywall page of services with paywallpage set. If empty, a minimal built-in page is used."`
+
+	// Blocklist is a list of remote IP addresses and subnets that are
+	// denied access to the proxy.
+	Blocklist []string `long:"blocklist" description:"A remote IP address or subnet in CIDR notation (e.g. 192.0.2.0/24) that is denied access. Can be specified multiple times."`
+
+	// CustomSatisfiers is an optional registry of satisfiers for custom
+	// caveat conditions, keyed by the condition they claim. The caveats
+	// are added to new L402s through the constraints of each service. This
+	// can only be set when aperture is used as a library.
+	CustomSatisfiers map[string]mint.SatisfierFactory `yaml:"-"`
+
+	// HoldInvoiceHashSource is an optional source of payment hashes that
+	// makes aperture's lnd backend create hold invoices for them. The
+	// invoices are never settled by aperture, that is left to the owner
+	// of the preimages, so services need to accept L402s of accepted
+	// invoices. Payers only learn the preimage once the invoice is settled,
+	// so such services accept L402s with a zero preimage as long as their
+	// invoice is accepted. This can only be set when aperture is used as a
+	// library.
+	HoldInvoiceHashSource challenger.PaymentHashSource `yaml:"-"`
+}
+
+// listenAddrs returns the addresses of the comma separated ListenAddr the
+// server listens on.
+func (c *Config) listenAddrs() []string {
+	var addrs []string
+	for _, addr := range strings.Split(c.ListenAddr, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
 }
 
 func (c *Config) validate() error {
@@ -233,14 +525,88 @@ func (c *Config) validate() error {
 		}
 	}
 
-	if c.ListenAddr == "" {
+	if len(c.listenAddrs()) == 0 {
 		return fmt.Errorf("missing listen address for server")
 	}
 
+	if c.Admin != nil && c.Admin.Enabled && c.Admin.BearerToken == "" {
+		return fmt.Errorf("admin endpoint requires a bearer token")
+	}
+
+	if c.ProxyProtocol && len(c.ProxyProtocolUpstreams) == 0 {
+		return fmt.Errorf("PROXY protocol requires at least one " +
+			"trusted upstream")
+	}
+
+	if c.SecretPruneInterval < 0 {
+		return fmt.Errorf("secret prune interval must not be negative")
+	}
+
+	if c.FreebieRetention < 0 {
+		return fmt.Errorf("freebie retention must not be negative")
+	}
+
+	if c.LNCSessionPruneInterval < 0 {
+		return fmt.Errorf("LNC session prune interval must not be " +
+			"negative")
+	}
+
 	if c.InvoiceBatchSize <= 0 {
 		return fmt.Errorf("invoice batch size must be greater than 0")
 	}
 
+	if c.HashMail != nil && c.HashMail.Persist &&
+		(c.DatabaseBackend == "etcd" || c.DatabaseBackend == "memory") {
+
+		return fmt.Errorf("hashmail persistence is not supported "+
+			"with the %v database backend", c.DatabaseBackend)
+	}
+
+	if c.Tor != nil && c.Tor.V3 && c.DatabaseBackend == "memory" {
+		return fmt.Errorf("tor onion services are not supported with " +
+			"the memory database backend")
+	}
+
+	if c.HashMail != nil && c.HashMail.ActiveReadRate < 0 {
+		return fmt.Errorf("hashmail active read rate must not be " +
+			"negative")
+	}
+
+	if c.HashMail != nil && c.HashMail.StreamAcquireTimeout < 0 {
+		return fmt.Errorf("hashmail stream acquire timeout must not " +
+			"be negative")
+	}
+
+	if c.MaxRequestRate < 0 || c.MaxRequestBurst < 0 ||
+		c.MaxConcurrentRequests < 0 {
+
+		return fmt.Errorf("admission control limits must not be " +
+			"negative")
+	}
+
+	if c.MaxConcurrentVerifications < 0 ||
+		c.VerificationQueueTimeout < 0 {
+
+		return fmt.Errorf("verification limits must not be negative")
+	}
+
+	switch c.AccessLogFormat {
+	case "", proxy.AccessLogFormatText, proxy.AccessLogFormatJSON:
+	default:
+		return fmt.Errorf("invalid access log format %s",
+			c.AccessLogFormat)
+	}
+
+	if c.MaxInjectedHeaders < 0 {
+		return fmt.Errorf("maximum number of injected headers must " +
+			"not be negative")
+	}
+
+	if c.MaxJSONChallengeSize < 0 {
+		return fmt.Errorf("maximum JSON challenge size must not be " +
+			"negative")
+	}
+
 	return nil
 }
 
@@ -261,6 +627,9 @@ func NewConfig() *Config {
 		Postgres:         &aperturedb.PostgresConfig{},
 		Authenticator:    &AuthConfig{},
 		Tor:              &TorConfig{},
+		APIKey:           &APIKeyConfig{},
+		Admin:            &AdminConfig{},
+		CORS:             &proxy.CORSConfig{},
 		HashMail:         &HashMailConfig{},
 		Prometheus:       &PrometheusConfig{},
 		IdleTimeout:      defaultIdleTimeout,
@@ -12,4 +12,15 @@ type DB interface {
 	CanPass(*http.Request, net.IP) (bool, error)
 
 	TallyFreebie(*http.Request, net.IP) (bool, error)
+
+	// Count returns the number of free requests that were counted for the
+	// given IP address.
+	Count(net.IP) (Count, error)
+
+	// Reset resets the number of free requests that were counted for the
+	// given IP address, granting it the full number of free requests
+	// again. Counters kept by token ID aren't tied to an IP address and
+	// are left untouched, so requests carrying a token that used up its
+	// free requests stay limited.
+	Reset(net.IP) error
 }
@@ -1,50 +1,191 @@
 package freebie
 
 import (
+	"bytes"
 	"net"
 	"net/http"
+	"sync"
+
+	"github.com/lightninglabs/aperture/l402"
 )
 
-var (
-	defaultIPMask = net.IPv4Mask(0xff, 0xff, 0xff, 0x00)
+const (
+	// DefaultIPv4Prefix is the default prefix length IPv4 addresses are
+	// masked with, so a /24 network shares its free requests.
+	DefaultIPv4Prefix = 24
+
+	// DefaultIPv6Prefix is the default prefix length IPv6 addresses are
+	// masked with, so a /64 network, which is usually assigned to a single
+	// subscriber, shares its free requests.
+	DefaultIPv6Prefix = 64
 )
 
 type Count uint16
 
+// storeOptions holds the behavior of a freebie store that can be modified
+// with options.
+type storeOptions struct {
+	// tokenIDKey is true if requests that carry an L402 are counted by
+	// the token ID of the L402 in addition to their IP address.
+	tokenIDKey bool
+
+	// ipv4Mask and ipv6Mask are the masks IPv4 and IPv6 addresses are
+	// masked with before they are counted.
+	ipv4Mask net.IPMask
+	ipv6Mask net.IPMask
+}
+
+// newStoreOptions returns the store options with the given options applied
+// to the defaults.
+func newStoreOptions(opts []MemStoreOption) storeOptions {
+	o := storeOptions{
+		ipv4Mask: net.CIDRMask(DefaultIPv4Prefix, 8*net.IPv4len),
+		ipv6Mask: net.CIDRMask(DefaultIPv6Prefix, 8*net.IPv6len),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
 type memStore struct {
-	numFreebies    Count
+	storeOptions
+
+	numFreebies Count
+
+	// mtx guards the freebieCounter, which is accessed by concurrent
+	// requests.
+	mtx            sync.Mutex
 	freebieCounter map[string]Count
 }
 
-func (m *memStore) getKey(ip net.IP) string {
-	return ip.Mask(defaultIPMask).String()
+// MemStoreOption is a functional option that can be used to modify the
+// behavior of an in-memory or persistent freebie store.
+type MemStoreOption func(*storeOptions)
+
+// WithTokenIDKey makes the store count the free requests that carry an L402 by
+// its token ID as well, so a client is limited consistently no matter which IP
+// address it uses. As the L402 of a request that is counted as a freebie isn't
+// valid, its token ID could be chosen freely. The free requests of the IP
+// address are therefore still limited, so changing the token ID doesn't grant
+// additional free requests either.
+func WithTokenIDKey() MemStoreOption {
+	return func(o *storeOptions) {
+		o.tokenIDKey = true
+	}
+}
+
+// WithIPv4Prefix sets the prefix length IPv4 addresses are masked with, so
+// all addresses of a network of that size share the same free requests.
+func WithIPv4Prefix(prefixLen int) MemStoreOption {
+	return func(o *storeOptions) {
+		o.ipv4Mask = net.CIDRMask(prefixLen, 8*net.IPv4len)
+	}
+}
+
+// WithIPv6Prefix sets the prefix length IPv6 addresses are masked with, so
+// all addresses of a network of that size share the same free requests.
+func WithIPv6Prefix(prefixLen int) MemStoreOption {
+	return func(o *storeOptions) {
+		o.ipv6Mask = net.CIDRMask(prefixLen, 8*net.IPv6len)
+	}
+}
+
+// getKey returns the key of the counter of the given IP address, which is
+// masked so a whole network shares the same counter.
+func (o *storeOptions) getKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(o.ipv4Mask).String()
+	}
+
+	return ip.Mask(o.ipv6Mask).String()
+}
+
+// getKeys returns the keys of all counters the request is counted by.
+func (o *storeOptions) getKeys(r *http.Request, ip net.IP) []string {
+	keys := []string{o.getKey(ip)}
+	if !o.tokenIDKey {
+		return keys
+	}
+
+	if tokenID, ok := requestTokenID(r); ok {
+		keys = append(keys, "token:"+tokenID.String())
+	}
+
+	return keys
 }
 
-func (m *memStore) currentCount(ip net.IP) Count {
-	counter, ok := m.freebieCounter[m.getKey(ip)]
-	if !ok {
-		return 0
+// requestTokenID returns the token ID of the L402 the request carries, if any.
+func requestTokenID(r *http.Request) (l402.TokenID, bool) {
+	mac, _, err := l402.FromHeader(&r.Header)
+	if err != nil {
+		return l402.TokenID{}, false
 	}
-	return counter
+
+	id, err := l402.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return l402.TokenID{}, false
+	}
+
+	return id.TokenID, true
 }
 
 func (m *memStore) CanPass(r *http.Request, ip net.IP) (bool, error) {
-	return m.currentCount(ip) < m.numFreebies, nil
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, key := range m.getKeys(r, ip) {
+		if m.freebieCounter[key] >= m.numFreebies {
+			return false, nil
+		}
+	}
+
+	return true, nil
 }
 
 func (m *memStore) TallyFreebie(r *http.Request, ip net.IP) (bool, error) {
-	counter := m.currentCount(ip) + 1
-	m.freebieCounter[m.getKey(ip)] = counter
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, key := range m.getKeys(r, ip) {
+		m.freebieCounter[key]++
+	}
+
 	return true, nil
 }
 
-// NewMemIPMaskStore creates a new in-memory freebie store that masks the last
-// byte of an IP address to keep track of free requests. The last byte of the
-// address is discarded for the mapping to reduce risk of abuse by users that
-// have a whole range of IPs at their disposal.
-func NewMemIPMaskStore(numFreebies Count) DB {
-	return &memStore{
+// Count returns the number of free requests that were counted for the masked
+// IP address.
+func (m *memStore) Count(ip net.IP) (Count, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.freebieCounter[m.getKey(ip)], nil
+}
+
+// Reset resets the number of free requests that were counted for the masked
+// IP address. The counters of token IDs are kept, as the store doesn't know
+// which tokens the address used.
+func (m *memStore) Reset(ip net.IP) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	delete(m.freebieCounter, m.getKey(ip))
+
+	return nil
+}
+
+// NewMemIPMaskStore creates a new in-memory freebie store that masks IP
+// addresses to keep track of free requests. By default, IPv4 addresses are
+// masked to their /24 and IPv6 addresses to their /64 network, which reduces
+// the risk of abuse by users that have a whole range of IPs at their disposal.
+func NewMemIPMaskStore(numFreebies Count, opts ...MemStoreOption) DB {
+	m := &memStore{
+		storeOptions:   newStoreOptions(opts),
 		numFreebies:    numFreebies,
 		freebieCounter: make(map[string]Count),
 	}
+
+	return m
 }
@@ -0,0 +1,212 @@
+package freebie
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/lightninglabs/aperture/l402"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+// newTokenRequest creates a request that carries an L402 with the given token
+// ID.
+func newTokenRequest(t *testing.T, tokenID l402.TokenID) *http.Request {
+	var (
+		preimage lntypes.Preimage
+		idBuf    bytes.Buffer
+	)
+	err := l402.EncodeIdentifier(&idBuf, &l402.Identifier{
+		Version:     l402.LatestVersion,
+		PaymentHash: preimage.Hash(),
+		TokenID:     tokenID,
+	})
+	require.NoError(t, err)
+
+	mac, err := macaroon.New(
+		[]byte("key"), idBuf.Bytes(), "aperture",
+		macaroon.LatestVersion,
+	)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", "http://service.com/", nil)
+	require.NoError(t, err)
+	require.NoError(t, l402.SetHeader(&req.Header, mac, preimage))
+
+	return req
+}
+
+// TestMemStoreTokenIDKey makes sure requests with the same token ID share
+// their free requests across IP addresses, while the free requests of each IP
+// address are still limited.
+func TestMemStoreTokenIDKey(t *testing.T) {
+	var (
+		ip1 = net.ParseIP("10.0.1.1")
+		ip2 = net.ParseIP("10.0.2.1")
+		ip3 = net.ParseIP("10.0.3.1")
+
+		tokenReq      = newTokenRequest(t, l402.TokenID{1})
+		otherTokenReq = newTokenRequest(t, l402.TokenID{2})
+	)
+
+	pass := func(db DB, r *http.Request, ip net.IP) bool {
+		ok, err := db.CanPass(r, ip)
+		require.NoError(t, err)
+		if ok {
+			_, err = db.TallyFreebie(r, ip)
+			require.NoError(t, err)
+		}
+
+		return ok
+	}
+
+	// Without the option, each IP address has its own free requests.
+	db := NewMemIPMaskStore(1)
+	require.True(t, pass(db, tokenReq, ip1))
+	require.True(t, pass(db, tokenReq, ip2))
+	require.False(t, pass(db, tokenReq, ip2))
+
+	// With the option, the same token ID shares its free requests across
+	// IP addresses.
+	db = NewMemIPMaskStore(1, WithTokenIDKey())
+	require.True(t, pass(db, tokenReq, ip1))
+	require.False(t, pass(db, tokenReq, ip2))
+
+	// Another token ID doesn't grant more free requests to the same IP
+	// address, but it does from a fresh one.
+	require.False(t, pass(db, otherTokenReq, ip1))
+	require.True(t, pass(db, otherTokenReq, ip3))
+
+	// Requests without a token are counted by IP address only.
+	plainReq, err := http.NewRequest("GET", "http://service.com/", nil)
+	require.NoError(t, err)
+	require.True(t, pass(db, plainReq, ip2))
+	require.False(t, pass(db, plainReq, ip2))
+
+	// Resetting an IP address doesn't reset the token IDs it used.
+	require.NoError(t, db.Reset(ip2))
+	require.False(t, pass(db, tokenReq, ip2))
+	require.True(t, pass(db, plainReq, ip2))
+}
+
+// TestMemStoreCountReset makes sure the free requests of an IP address can be
+// inspected and reset.
+func TestMemStoreCountReset(t *testing.T) {
+	var (
+		ip        = net.ParseIP("10.0.1.1")
+		sameMask  = net.ParseIP("10.0.1.2")
+		otherMask = net.ParseIP("10.0.2.1")
+	)
+
+	req, err := http.NewRequest("GET", "http://service.com/", nil)
+	require.NoError(t, err)
+
+	db := NewMemIPMaskStore(2)
+	count, err := db.Count(ip)
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	for i := 0; i < 2; i++ {
+		_, err = db.TallyFreebie(req, ip)
+		require.NoError(t, err)
+	}
+	_, err = db.TallyFreebie(req, otherMask)
+	require.NoError(t, err)
+
+	// Addresses are counted by their mask.
+	count, err = db.Count(sameMask)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, count)
+
+	ok, err := db.CanPass(req, ip)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// A reset grants the free requests again, but only to the mask of the
+	// given address.
+	require.NoError(t, db.Reset(ip))
+	count, err = db.Count(ip)
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	ok, err = db.CanPass(req, ip)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	count, err = db.Count(otherMask)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, count)
+}
+
+// TestMemStoreIPPrefix makes sure IPv4 and IPv6 addresses are masked with the
+// configured prefix lengths before they are counted.
+func TestMemStoreIPPrefix(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://service.com/", nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		opts    []MemStoreOption
+		ip      string
+		sameNet string
+		diffNet string
+	}{{
+		name:    "ipv4 default",
+		ip:      "10.0.1.1",
+		sameNet: "10.0.1.254",
+		diffNet: "10.0.2.1",
+	}, {
+		name:    "ipv4 /16",
+		opts:    []MemStoreOption{WithIPv4Prefix(16)},
+		ip:      "10.0.1.1",
+		sameNet: "10.0.200.1",
+		diffNet: "10.1.0.1",
+	}, {
+		name:    "ipv4 /32",
+		opts:    []MemStoreOption{WithIPv4Prefix(32)},
+		ip:      "10.0.1.1",
+		sameNet: "10.0.1.1",
+		diffNet: "10.0.1.2",
+	}, {
+		name:    "ipv4 in ipv6",
+		ip:      "::ffff:10.0.1.1",
+		sameNet: "10.0.1.2",
+		diffNet: "10.0.2.1",
+	}, {
+		name:    "ipv6 default",
+		ip:      "2001:db8:0:1::1",
+		sameNet: "2001:db8:0:1:ffff::1",
+		diffNet: "2001:db8:0:2::1",
+	}, {
+		name:    "ipv6 /48",
+		opts:    []MemStoreOption{WithIPv6Prefix(48)},
+		ip:      "2001:db8:0:1::1",
+		sameNet: "2001:db8:0:ffff::1",
+		diffNet: "2001:db8:1::1",
+	}, {
+		name:    "ipv6 /128",
+		opts:    []MemStoreOption{WithIPv6Prefix(128)},
+		ip:      "2001:db8::1",
+		sameNet: "2001:db8::1",
+		diffNet: "2001:db8::2",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := NewMemIPMaskStore(1, tc.opts...)
+			_, err := db.TallyFreebie(req, net.ParseIP(tc.ip))
+			require.NoError(t, err)
+
+			ok, err := db.CanPass(req, net.ParseIP(tc.sameNet))
+			require.NoError(t, err)
+			require.False(t, ok)
+
+			ok, err = db.CanPass(req, net.ParseIP(tc.diffNet))
+			require.NoError(t, err)
+			require.True(t, ok)
+		})
+	}
+}
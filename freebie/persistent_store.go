@@ -0,0 +1,124 @@
+package freebie
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// storeTimeout is the maximum time a lookup or reset of a counter that
+	// isn't bound to a request may take.
+	storeTimeout = 10 * time.Second
+)
+
+// CounterStore is a persistent storage backend for the free request counters
+// of services.
+type CounterStore interface {
+	// FreebieCount returns the number of free requests counted under the
+	// given key for the given service. Unknown keys have a count of zero.
+	FreebieCount(ctx context.Context, serviceName, key string) (Count,
+		error)
+
+	// IncrementFreebies increments the counters of all given keys for the
+	// given service by one.
+	IncrementFreebies(ctx context.Context, serviceName string,
+		keys []string) error
+
+	// ResetFreebies removes the counter of the given key for the given
+	// service.
+	ResetFreebies(ctx context.Context, serviceName, key string) error
+}
+
+// CounterPruner is an optional interface of a CounterStore that is able to
+// remove the counters of clients that haven't made a free request in a while.
+type CounterPruner interface {
+	// PruneFreebies removes the counters of all clients that didn't make
+	// a free request since the given time and returns the number of
+	// removed counters.
+	PruneFreebies(ctx context.Context, before time.Time) (int64, error)
+}
+
+// persistentStore is a freebie store that keeps its counters in a persistent
+// storage backend, so they survive restarts.
+type persistentStore struct {
+	storeOptions
+
+	store       CounterStore
+	serviceName string
+	numFreebies Count
+}
+
+// NewPersistentIPMaskStore creates a new freebie store for the given service
+// that keeps track of free requests in the given storage backend. Like the
+// in-memory store, it masks IP addresses to their network.
+func NewPersistentIPMaskStore(store CounterStore, serviceName string,
+	numFreebies Count, opts ...MemStoreOption) DB {
+
+	return &persistentStore{
+		storeOptions: newStoreOptions(opts),
+		store:        store,
+		serviceName:  serviceName,
+		numFreebies:  numFreebies,
+	}
+}
+
+// CanPass returns true if the request hasn't used up any of its free requests
+// yet.
+//
+// NOTE: This is part of the DB interface.
+func (p *persistentStore) CanPass(r *http.Request, ip net.IP) (bool, error) {
+	for _, key := range p.getKeys(r, ip) {
+		count, err := p.store.FreebieCount(
+			r.Context(), p.serviceName, key,
+		)
+		if err != nil {
+			return false, err
+		}
+
+		if count >= p.numFreebies {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// TallyFreebie counts the request as a free request.
+//
+// NOTE: This is part of the DB interface.
+func (p *persistentStore) TallyFreebie(r *http.Request,
+	ip net.IP) (bool, error) {
+
+	err := p.store.IncrementFreebies(
+		r.Context(), p.serviceName, p.getKeys(r, ip),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Count returns the number of free requests that were counted for the masked
+// IP address.
+//
+// NOTE: This is part of the DB interface.
+func (p *persistentStore) Count(ip net.IP) (Count, error) {
+	ctxt, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	return p.store.FreebieCount(ctxt, p.serviceName, p.getKey(ip))
+}
+
+// Reset resets the number of free requests that were counted for the masked
+// IP address. Rows of token IDs are kept until they are pruned.
+//
+// NOTE: This is part of the DB interface.
+func (p *persistentStore) Reset(ip net.IP) error {
+	ctxt, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	return p.store.ResetFreebies(ctxt, p.serviceName, p.getKey(ip))
+}
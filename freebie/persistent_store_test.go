@@ -0,0 +1,85 @@
+package freebie
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/lightninglabs/aperture/l402"
+	"github.com/stretchr/testify/require"
+)
+
+// mockCounterStore is an in-memory CounterStore.
+type mockCounterStore struct {
+	counts map[string]Count
+}
+
+func (m *mockCounterStore) FreebieCount(_ context.Context, serviceName,
+	key string) (Count, error) {
+
+	return m.counts[serviceName+"/"+key], nil
+}
+
+func (m *mockCounterStore) IncrementFreebies(_ context.Context,
+	serviceName string, keys []string) error {
+
+	for _, key := range keys {
+		m.counts[serviceName+"/"+key]++
+	}
+
+	return nil
+}
+
+func (m *mockCounterStore) ResetFreebies(_ context.Context, serviceName,
+	key string) error {
+
+	delete(m.counts, serviceName+"/"+key)
+	return nil
+}
+
+// TestPersistentStore makes sure the persistent store counts free requests by
+// the same keys as the in-memory store, separately for each service.
+func TestPersistentStore(t *testing.T) {
+	var (
+		ip       = net.ParseIP("10.0.1.1")
+		sameMask = net.ParseIP("10.0.1.2")
+		tokenID  = l402.TokenID{1}
+		tokenReq = newTokenRequest(t, tokenID)
+		counts   = &mockCounterStore{counts: make(map[string]Count)}
+	)
+
+	pass := func(db DB, r *http.Request, ip net.IP) bool {
+		ok, err := db.CanPass(r, ip)
+		require.NoError(t, err)
+		if ok {
+			_, err = db.TallyFreebie(r, ip)
+			require.NoError(t, err)
+		}
+
+		return ok
+	}
+
+	db := NewPersistentIPMaskStore(counts, "service", 1, WithTokenIDKey())
+	require.True(t, pass(db, tokenReq, ip))
+	require.False(t, pass(db, tokenReq, sameMask))
+	require.Equal(t, map[string]Count{
+		"service/10.0.1.0":                  1,
+		"service/token:" + tokenID.String(): 1,
+	}, counts.counts)
+
+	// A store of another service has its own counters, while a new store
+	// of the same service picks up the existing ones.
+	otherDB := NewPersistentIPMaskStore(counts, "other", 1)
+	require.True(t, pass(otherDB, tokenReq, ip))
+
+	db = NewPersistentIPMaskStore(counts, "service", 2)
+	count, err := db.Count(sameMask)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, count)
+	require.True(t, pass(db, tokenReq, ip))
+	require.False(t, pass(db, tokenReq, ip))
+
+	require.NoError(t, db.Reset(ip))
+	require.True(t, pass(db, tokenReq, ip))
+}
@@ -0,0 +1,65 @@
+package aperture
+
+import (
+	"context"
+	"time"
+
+	"github.com/lightninglabs/aperture/aperturedb"
+	"github.com/lightninglabs/aperture/freebie"
+)
+
+// maxFreebiePruneInterval is the maximum interval at which the free request
+// counters are pruned.
+const maxFreebiePruneInterval = time.Hour
+
+// freebiePruneInterval returns the interval at which free request counters are
+// pruned for the given retention, so counters aren't kept much longer than
+// the retention.
+func freebiePruneInterval(retention time.Duration) time.Duration {
+	if retention < maxFreebiePruneInterval {
+		return retention
+	}
+
+	return maxFreebiePruneInterval
+}
+
+// pruneFreebies periodically removes the free request counters of clients that
+// didn't make a free request within the given retention from the given store
+// until aperture shuts down.
+//
+// NOTE: This must be run as a goroutine.
+func (a *Aperture) pruneFreebies(pruner freebie.CounterPruner, interval,
+	retention time.Duration) {
+
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctxt, cancel := context.WithTimeout(
+				context.Background(),
+				aperturedb.DefaultStoreTimeout,
+			)
+			numPruned, err := pruner.PruneFreebies(
+				ctxt, time.Now().Add(-retention),
+			)
+			cancel()
+			if err != nil {
+				log.Errorf("Unable to prune freebie counters: "+
+					"%v", err)
+				continue
+			}
+
+			if numPruned > 0 {
+				log.Infof("Pruned %d stale freebie counters",
+					numPruned)
+			}
+
+		case <-a.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package aperture
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mockFreebiePruner is a freebie counter pruner that records the cut-off times
+// it was called with.
+type mockFreebiePruner struct {
+	mu      sync.Mutex
+	cutoffs []time.Time
+}
+
+// PruneFreebies records the given cut-off time.
+func (m *mockFreebiePruner) PruneFreebies(_ context.Context,
+	before time.Time) (int64, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cutoffs = append(m.cutoffs, before)
+
+	return 1, nil
+}
+
+// TestPruneFreebies makes sure the counters of clients that didn't make a free
+// request within the retention are pruned in the background until aperture
+// shuts down.
+func TestPruneFreebies(t *testing.T) {
+	const retention = time.Hour
+
+	pruner := &mockFreebiePruner{}
+	a := &Aperture{quit: make(chan struct{})}
+	a.wg.Add(1)
+	start := time.Now()
+	go a.pruneFreebies(pruner, 10*time.Millisecond, retention)
+
+	require.Eventually(t, func() bool {
+		pruner.mu.Lock()
+		defer pruner.mu.Unlock()
+
+		return len(pruner.cutoffs) >= 2
+	}, time.Second, 10*time.Millisecond)
+
+	close(a.quit)
+	a.wg.Wait()
+
+	for _, cutoff := range pruner.cutoffs {
+		require.False(t, cutoff.Before(start.Add(-retention)))
+		require.True(t, cutoff.Before(time.Now().Add(-retention)))
+	}
+
+	// Counters aren't kept much longer than the retention.
+	require.Equal(t, time.Minute, freebiePruneInterval(time.Minute))
+	require.Equal(
+		t, maxFreebiePruneInterval, freebiePruneInterval(48*time.Hour),
+	)
+}
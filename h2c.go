@@ -0,0 +1,50 @@
+package aperture
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newH2CHandler wraps the given handler so it also serves HTTP/2 Cleartext
+// (h2c) requests. Clients can either speak HTTP/2 right away (prior knowledge)
+// or upgrade an HTTP/1.1 connection. If allowUpgrade is false, upgrade requests
+// are rejected, as the upgrade mechanism is prone to request smuggling when
+// aperture sits behind other proxies.
+func newH2CHandler(handler http.Handler, allowUpgrade bool) http.Handler {
+	h2cHandler := h2c.NewHandler(handler, &http2.Server{})
+	if allowUpgrade {
+		return h2cHandler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isH2CUpgrade(r) {
+			log.Debugf("Rejecting h2c upgrade request from %v",
+				r.RemoteAddr)
+			http.Error(
+				w, "h2c upgrade not allowed",
+				http.StatusBadRequest,
+			)
+			return
+		}
+
+		h2cHandler.ServeHTTP(w, r)
+	})
+}
+
+// isH2CUpgrade returns true if the request asks to upgrade the connection to
+// h2c.
+func isH2CUpgrade(r *http.Request) bool {
+	for _, value := range r.Header.Values("Upgrade") {
+		for _, protocol := range strings.Split(value, ",") {
+			protocol = strings.TrimSpace(protocol)
+			if strings.EqualFold(protocol, "h2c") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
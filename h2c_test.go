@@ -0,0 +1,85 @@
+package aperture
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+// TestH2CUpgrade makes sure h2c upgrade requests are only rejected if
+// disabled, while prior knowledge h2c is always served.
+func TestH2CUpgrade(t *testing.T) {
+	handler := http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprint(w, r.Proto)
+		},
+	)
+
+	// upgrade sends an h2c upgrade request and returns the status code of
+	// the response.
+	upgrade := func(addr string) int {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"Connection: Upgrade, HTTP2-Settings\r\n" +
+			"Upgrade: h2c\r\n" +
+			"HTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA\r\n\r\n"))
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+
+		return resp.StatusCode
+	}
+
+	// priorKnowledge sends an HTTP/2 request without any upgrade and
+	// returns the protocol the handler saw.
+	priorKnowledge := func(url string) string {
+		// Dial without TLS, even though the transport asks for it.
+		dial := func(ctx context.Context, network, addr string,
+			_ *tls.Config) (net.Conn, error) {
+
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}
+		client := &http.Client{
+			Transport: &http2.Transport{
+				AllowHTTP:      true,
+				DialTLSContext: dial,
+			},
+		}
+		resp, err := client.Get(url)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp.Proto
+	}
+
+	for _, allowUpgrade := range []bool{true, false} {
+		server := httptest.NewServer(
+			newH2CHandler(handler, allowUpgrade),
+		)
+
+		expectedStatus := http.StatusSwitchingProtocols
+		if !allowUpgrade {
+			expectedStatus = http.StatusBadRequest
+		}
+		addr := server.Listener.Addr().String()
+		require.Equal(t, expectedStatus, upgrade(addr))
+		require.Equal(t, "HTTP/2.0", priorKnowledge(server.URL))
+
+		server.Close()
+	}
+}
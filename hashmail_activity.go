@@ -0,0 +1,132 @@
+package aperture
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultActiveReadRate is the default minimum number of reads per
+	// second a mailbox session needs to be classified as active.
+	DefaultActiveReadRate = 0.5
+
+	// activityClassifyInterval is the interval in which the mailbox
+	// sessions are classified by their read activity.
+	activityClassifyInterval = time.Minute
+)
+
+// sessionCounts is the number of mailbox sessions in each activity class.
+type sessionCounts struct {
+	// active is the number of sessions that were read from at least at
+	// the active read rate.
+	active int
+
+	// standby is the number of sessions that were read from, but less
+	// often than the active read rate, for example to keep the session
+	// alive.
+	standby int
+
+	// inUse is the number of sessions that were read from at all, which is
+	// the sum of active and standby sessions.
+	inUse int
+}
+
+// streamActivity keeps track of the reads of each mailbox session to classify
+// the sessions by how actively they are used.
+type streamActivity struct {
+	sync.Mutex
+
+	// reads is the number of reads of each session since the last
+	// classification, keyed by the session's base stream ID.
+	reads map[[16]byte]uint64
+
+	// since is the time of the last classification.
+	since time.Time
+
+	// activeReadRate is the minimum number of reads per second a session
+	// needs to be classified as active.
+	activeReadRate float64
+
+	now func() time.Time
+}
+
+// newStreamActivity creates a new activity tracker that classifies sessions as
+// active at or above the given read rate.
+func newStreamActivity(activeReadRate float64,
+	now func() time.Time) *streamActivity {
+
+	if activeReadRate <= 0 {
+		activeReadRate = DefaultActiveReadRate
+	}
+
+	return &streamActivity{
+		reads:          make(map[[16]byte]uint64),
+		since:          now(),
+		activeReadRate: activeReadRate,
+		now:            now,
+	}
+}
+
+// recordRead records a single read of the session with the given base stream
+// ID.
+func (a *streamActivity) recordRead(baseID [16]byte) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.reads[baseID]++
+}
+
+// ClassifyAndReset classifies all sessions by their read rate since the last
+// classification and starts a new classification period.
+func (a *streamActivity) ClassifyAndReset() sessionCounts {
+	a.Lock()
+	defer a.Unlock()
+
+	now := a.now()
+	elapsed := now.Sub(a.since).Seconds()
+
+	var counts sessionCounts
+	for _, reads := range a.reads {
+		counts.inUse++
+
+		if elapsed > 0 && float64(reads)/elapsed >= a.activeReadRate {
+			counts.active++
+		} else {
+			counts.standby++
+		}
+	}
+
+	a.reads = make(map[[16]byte]uint64)
+	a.since = now
+
+	return counts
+}
+
+// classifyActivity periodically classifies the mailbox sessions and exports
+// the number of sessions in each class until the server is stopped.
+func (h *hashMailServer) classifyActivity() {
+	ticker := time.NewTicker(activityClassifyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			counts := h.activity.ClassifyAndReset()
+			setSessionGauges(counts)
+
+			log.Debugf("HashMail sessions: active=%d, standby=%d, "+
+				"in_use=%d", counts.active, counts.standby,
+				counts.inUse)
+
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+// setSessionGauges exports the given session counts.
+func setSessionGauges(counts sessionCounts) {
+	sessionsActive.Set(float64(counts.active))
+	sessionsStandby.Set(float64(counts.standby))
+	sessionsInUse.Set(float64(counts.inUse))
+}
@@ -5,15 +5,26 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/lightninglabs/aperture/aperturedb"
+	"github.com/lightninglabs/aperture/proxy"
 	"github.com/lightninglabs/lightning-node-connect/hashmailrpc"
 	"github.com/lightningnetwork/lnd/tlv"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tv42/zbase32"
 	"golang.org/x/time/rate"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -34,6 +45,49 @@ const (
 	// DefaultBufSize is the default number of bytes that are read in a
 	// single operation.
 	DefaultBufSize = 4096
+
+	// DefaultMaxMessageSize is the default maximum size in bytes of a
+	// single message sent through a stream.
+	DefaultMaxMessageSize = 64 * 1024 * 1024
+
+	// maxVarIntSize is the maximum number of bytes used by the length
+	// prefix of a message.
+	maxVarIntSize = 9
+
+	// drainPollInterval is the interval in which we check whether all
+	// streams have become idle while draining the server.
+	drainPollInterval = 100 * time.Millisecond
+
+	// streamSignatureKey is the gRPC metadata key clients send their
+	// signature of a stream operation in. REST clients can send it in the
+	// Grpc-Metadata-Hashmail-Signature header field.
+	streamSignatureKey = "hashmail-signature"
+
+	// streamSignatureTimestampKey is the gRPC metadata key clients send
+	// the unix timestamp in seconds they signed a stream operation at in.
+	// REST clients can send it in the
+	// Grpc-Metadata-Hashmail-Signature-Timestamp header field.
+	streamSignatureTimestampKey = "hashmail-signature-timestamp"
+
+	// streamSignatureDomain separates the messages signed to authorize
+	// stream operations from any other message signed with the same key.
+	streamSignatureDomain = "aperture-hashmail"
+
+	// streamSignatureMaxAge is the maximum difference between the time a
+	// stream operation was signed at and the time it's received, so a
+	// signature can't be replayed later on.
+	streamSignatureMaxAge = 5 * time.Minute
+
+	// streamOpCreate and streamOpDelete are the stream operations a
+	// signature can authorize.
+	streamOpCreate = "create"
+	streamOpDelete = "delete"
+)
+
+var (
+	// signedMsgPrefix is the prefix lnd's SignMessage RPC prepends to each
+	// message before signing it.
+	signedMsgPrefix = []byte("Lightning Signed Message:")
 )
 
 // streamID is the identifier of a stream.
@@ -60,6 +114,22 @@ func (s *streamID) isOdd() bool {
 	return s[63]&0x01 == 0x01
 }
 
+// sibling returns the ID of the other stream in a bidirectional pair, which
+// only differs in the last bit.
+func (s *streamID) sibling() streamID {
+	sibling := *s
+	sibling[63] ^= 0x01
+
+	return sibling
+}
+
+// metricsLabel returns the label used to record metrics of the session the
+// stream belongs to.
+func (s *streamID) metricsLabel() string {
+	baseID := s.baseID()
+	return fmt.Sprintf("%x", baseID)
+}
+
 // readStream is the read side of the read pipe, which is implemented a
 // buffered wrapper around the core reader.
 type readStream struct {
@@ -76,6 +146,13 @@ type readStream struct {
 //
 // NOTE: This will *block* until a new message is available.
 func (r *readStream) ReadNextMsg(ctx context.Context) ([]byte, error) {
+	// Wait until we have enough available event slots to read from the
+	// stream. This'll return an error if the referenced context has been
+	// cancelled.
+	if err := r.parentStream.readLimiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
 	var reader io.Reader
 	select {
 	case b := <-r.parentStream.readBytesChan:
@@ -85,6 +162,10 @@ func (r *readStream) ReadNextMsg(ctx context.Context) ([]byte, error) {
 		return nil, ctx.Err()
 
 	case err := <-r.parentStream.readErrChan:
+		if status.Code(err) == codes.ResourceExhausted {
+			r.parentStream.onMsgTooLarge()
+		}
+
 		return nil, err
 	}
 
@@ -95,11 +176,25 @@ func (r *readStream) ReadNextMsg(ctx context.Context) ([]byte, error) {
 		return nil, err
 	}
 
+	if msgLen > r.parentStream.maxMsgSize {
+		r.parentStream.onMsgTooLarge()
+		return nil, errMsgTooLarge(r.parentStream.maxMsgSize)
+	}
+
 	// Now that we know the length of the message, we'll make a limit
 	// reader, then read all the encoded bytes until the EOF is emitted by
 	// the reader.
 	msgReader := io.LimitReader(reader, int64(msgLen))
-	return io.ReadAll(msgReader)
+	msg, err := io.ReadAll(msgReader)
+	if err != nil {
+		return nil, err
+	}
+
+	mailboxBytesRead.WithLabelValues(
+		r.parentStream.id.metricsLabel(),
+	).Add(float64(len(msg)))
+
+	return msg, nil
 }
 
 // ReturnStream gives up the read stream by passing it back up through the
@@ -129,10 +224,18 @@ type writeStream struct {
 // NOTE: If the buffer is full, then this call will block until the reader
 // consumes bytes from the other end.
 func (w *writeStream) WriteMsg(ctx context.Context, msg []byte) error {
+	// We refuse to buffer messages that exceed the maximum size and tear
+	// down the stream, as the client is clearly misbehaving.
+	msgSize := uint64(len(msg))
+	if msgSize > w.parentStream.maxMsgSize {
+		w.parentStream.onMsgTooLarge()
+		return errMsgTooLarge(w.parentStream.maxMsgSize)
+	}
+
 	// Wait until until we have enough available event slots to write to
 	// the stream. This'll return an error if the referneded context has
 	// been cancelled.
-	if err := w.parentStream.limiter.Wait(ctx); err != nil {
+	if err := w.parentStream.writeLimiter.Wait(ctx); err != nil {
 		return err
 	}
 
@@ -140,7 +243,6 @@ func (w *writeStream) WriteMsg(ctx context.Context, msg []byte) error {
 	// length prefix so the reader knows how many bytes to consume for each
 	// message.
 	var buf bytes.Buffer
-	msgSize := uint64(len(msg))
 	if err := tlv.WriteVarInt(&buf, msgSize, &w.scratchBuf); err != nil {
 		return err
 	}
@@ -154,6 +256,10 @@ func (w *writeStream) WriteMsg(ctx context.Context, msg []byte) error {
 		return err
 	}
 
+	mailboxBytesWritten.WithLabelValues(
+		w.parentStream.id.metricsLabel(),
+	).Add(float64(len(msg)))
+
 	return nil
 }
 
@@ -162,6 +268,13 @@ func (w *writeStream) ReturnStream() {
 	w.parentStream.ReturnWriteStream(w)
 }
 
+// errMsgTooLarge returns the error sent to clients that write or read a message
+// exceeding the given maximum message size.
+func errMsgTooLarge(maxMsgSize uint64) error {
+	return status.Errorf(codes.ResourceExhausted, "message exceeds "+
+		"maximum size of %d bytes", maxMsgSize)
+}
+
 // stream is a unique pipe implemented using a subscription server, and expose
 // over gRPC. Only a single writer and reader can exist within the stream at
 // any given time.
@@ -187,15 +300,43 @@ type stream struct {
 
 	wg sync.WaitGroup
 
-	limiter *rate.Limiter
+	// readLimiter and writeLimiter limit the rate at which messages can
+	// be read from and written to the stream respectively.
+	readLimiter  *rate.Limiter
+	writeLimiter *rate.Limiter
+
+	// maxMsgSize is the maximum size in bytes of a single message written
+	// to or read from the stream.
+	maxMsgSize uint64
+
+	// onMsgTooLarge is called if a message exceeding the maximum message
+	// size is written to or read from the stream.
+	onMsgTooLarge func()
 
 	status *streamStatus
+
+	// restored is true if the stream was restored from its persisted
+	// descriptor after a restart and neither of its sub-streams have been
+	// requested since. Such a stream can be re-initialized by its
+	// original creator.
+	restored bool
+
+	// creator is the compressed public key that signed the stream ID when
+	// the stream was created. If set, only requests signed by the same key
+	// can tear down or reclaim the stream.
+	creator []byte
+
+	// client is the IP address of the client that created the stream. It
+	// is empty for streams that weren't created through a client request,
+	// such as restored streams.
+	client string
 }
 
 // newStream creates a new stream independent of any given stream ID.
-func newStream(id streamID, limiter *rate.Limiter,
+func newStream(id streamID, readLimiter, writeLimiter *rate.Limiter,
 	equivAuth func(auth *hashmailrpc.CipherBoxAuth) error,
-	onStale func() error, staleTimeout time.Duration) *stream {
+	onStale func() error, staleTimeout time.Duration, maxMsgSize uint64,
+	onMsgTooLarge func()) *stream {
 
 	// Our stream is actually just a plain io.Pipe. This allows us to avoid
 	// having to do things like rate limiting, etc as we can limit the
@@ -209,7 +350,10 @@ func newStream(id streamID, limiter *rate.Limiter,
 		writeStreamChan: make(chan *writeStream, 1),
 		id:              id,
 		equivAuth:       equivAuth,
-		limiter:         limiter,
+		readLimiter:     readLimiter,
+		writeLimiter:    writeLimiter,
+		maxMsgSize:      maxMsgSize,
+		onMsgTooLarge:   onMsgTooLarge,
 		status:          newStreamStatus(onStale, staleTimeout),
 		readBytesChan:   make(chan []byte),
 		readErrChan:     make(chan error, 1),
@@ -267,6 +411,15 @@ func newStream(id streamID, limiter *rate.Limiter,
 					return
 				}
 				c = append(c, buf[0:numBytes]...)
+
+				// Make sure we don't keep on buffering bytes
+				// beyond what a single message may take up.
+				if uint64(len(c)) > maxMsgSize+maxVarIntSize {
+					err := errMsgTooLarge(maxMsgSize)
+					_ = readReadPipe.CloseWithError(err)
+					s.readErrChan <- err
+					return
+				}
 			}
 
 			select {
@@ -303,32 +456,199 @@ func (s *stream) ReturnWriteStream(w *writeStream) {
 }
 
 // RequestReadStream attempts to request the read stream from the main backing
-// stream. If we're unable to obtain it before the timeout, then an error is
-// returned.
-func (s *stream) RequestReadStream() (*readStream, error) {
+// stream. If the read stream is occupied, we wait for it to be returned until
+// the given context is done, at which point an error is returned.
+func (s *stream) RequestReadStream(ctx context.Context) (*readStream, error) {
 	log.Tracef("HashMailStream(%x): requesting read stream", s.id[:])
 
+	// A free stream is always handed out right away, even if the context
+	// is already done.
+	var r *readStream
 	select {
-	case r := <-s.readStreamChan:
-		s.status.streamTaken(true)
-		return r, nil
+	case r = <-s.readStreamChan:
 	default:
-		return nil, fmt.Errorf("read stream occupied")
+		select {
+		case r = <-s.readStreamChan:
+		case <-s.quit:
+			return nil, fmt.Errorf("stream torn down")
+		case <-ctx.Done():
+			return nil, fmt.Errorf("read stream occupied")
+		}
 	}
+
+	s.status.streamTaken(true)
+	s.markUsed()
+
+	return r, nil
 }
 
-// RequestWriteStream attempts to request the read stream from the main backing
-// stream. If we're unable to obtain it before the timeout, then an error is
-// returned.
-func (s *stream) RequestWriteStream() (*writeStream, error) {
+// RequestWriteStream attempts to request the write stream from the main backing
+// stream. If the write stream is occupied, we wait for it to be returned until
+// the given context is done, at which point an error is returned.
+func (s *stream) RequestWriteStream(ctx context.Context) (*writeStream, error) {
 	log.Tracef("HashMailStream(%x): requesting write stream", s.id[:])
 
+	// A free stream is always handed out right away, even if the context
+	// is already done.
+	var w *writeStream
 	select {
-	case w := <-s.writeStreamChan:
-		s.status.streamTaken(false)
-		return w, nil
+	case w = <-s.writeStreamChan:
 	default:
-		return nil, fmt.Errorf("write stream occupied")
+		select {
+		case w = <-s.writeStreamChan:
+		case <-s.quit:
+			return nil, fmt.Errorf("stream torn down")
+		case <-ctx.Done():
+			return nil, fmt.Errorf("write stream occupied")
+		}
+	}
+
+	s.status.streamTaken(false)
+	s.markUsed()
+
+	return w, nil
+}
+
+// occupied returns true if either of the sub-streams is currently in use. We
+// look at the holding channels directly rather than the stream status, as the
+// latter doesn't track occupancy if stale timeouts are disabled.
+func (s *stream) occupied() bool {
+	return len(s.readStreamChan) == 0 || len(s.writeStreamChan) == 0
+}
+
+// markUsed marks a restored stream as being used again.
+func (s *stream) markUsed() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.restored = false
+}
+
+// isUnusedRestore returns true if the stream was restored after a restart and
+// hasn't been used since.
+func (s *stream) isUnusedRestore() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.restored
+}
+
+// verifyCreator checks that the given auth and signer are the ones the stream
+// was created with, so only the creator of the stream can tear it down or
+// reclaim it. Streams that were created without a signature only require an
+// equivalent auth.
+func (s *stream) verifyCreator(auth *hashmailrpc.CipherBoxAuth,
+	signer []byte) error {
+
+	if err := s.equivAuth(auth); err != nil {
+		return err
+	}
+
+	if s.creator != nil && !bytes.Equal(s.creator, signer) {
+		return fmt.Errorf("signer not equivalent to stream creator")
+	}
+
+	return nil
+}
+
+// authFingerprint returns a canonical serialization of the authentication
+// mechanism of the given auth, ignoring its stream descriptor.
+func authFingerprint(auth *hashmailrpc.CipherBoxAuth) ([]byte, error) {
+	authOnly, ok := proto.Clone(auth).(*hashmailrpc.CipherBoxAuth)
+	if !ok {
+		return nil, fmt.Errorf("unexpected auth type %T", auth)
+	}
+	authOnly.Desc = nil
+
+	return proto.MarshalOptions{Deterministic: true}.Marshal(authOnly)
+}
+
+// newEquivAuth returns a function that checks whether an authentication
+// mechanism is equivalent to the one a stream was originally created with.
+func newEquivAuth(orig *hashmailrpc.CipherBoxAuth) (
+	func(auth *hashmailrpc.CipherBoxAuth) error, error) {
+
+	origFingerprint, err := authFingerprint(orig)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(auth *hashmailrpc.CipherBoxAuth) error {
+		fingerprint, err := authFingerprint(auth)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(origFingerprint, fingerprint) {
+			return fmt.Errorf("auth not equivalent to stream " +
+				"creation auth")
+		}
+
+		return nil
+	}, nil
+}
+
+// hashMailStreamStore is used to persist the descriptors of hashmail streams
+// so they can be restored after a restart.
+type hashMailStreamStore interface {
+	// AddStream stores the descriptor of a new stream, including the
+	// public key of its creator, which may be nil.
+	AddStream(ctx context.Context, streamID, auth, creator []byte) error
+
+	// ListStreams returns the descriptors of all stored streams.
+	ListStreams(ctx context.Context) ([]aperturedb.HashMailStream, error)
+
+	// DeleteStream removes the descriptor of a stream.
+	DeleteStream(ctx context.Context, streamID []byte) error
+}
+
+// persistQueue runs the persistence operations of streams outside of the
+// server's lock, but in the order they were scheduled while holding it. That
+// way, slow store operations don't block the whole server, and the persisted
+// streams still end up in the same state as the ones in memory.
+type persistQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// next is the ticket that is handed out next.
+	next uint64
+
+	// turn is the ticket whose operation may run now.
+	turn uint64
+}
+
+// newPersistQueue creates a new, empty persistence queue.
+func newPersistQueue() *persistQueue {
+	q := &persistQueue{}
+	q.cond = sync.NewCond(&q.mu)
+
+	return q
+}
+
+// schedule reserves the next place in the queue. The returned function must
+// be called exactly once with the operation to run, otherwise all operations
+// scheduled afterwards block forever.
+//
+// NOTE: The caller must hold the server's lock.
+func (q *persistQueue) schedule() func(op func()) {
+	q.mu.Lock()
+	ticket := q.next
+	q.next++
+	q.mu.Unlock()
+
+	return func(op func()) {
+		q.mu.Lock()
+		for q.turn != ticket {
+			q.cond.Wait()
+		}
+		q.mu.Unlock()
+
+		op()
+
+		q.mu.Lock()
+		q.turn++
+		q.cond.Broadcast()
+		q.mu.Unlock()
 	}
 }
 
@@ -337,6 +657,51 @@ type hashMailServerConfig struct {
 	msgRate           time.Duration
 	msgBurstAllowance int
 	staleTimeout      time.Duration
+	maxMessageSize    uint64
+
+	// readMsgRate, readMsgBurstAllowance, writeMsgRate and
+	// writeMsgBurstAllowance are the direction specific message rate
+	// limits. If unset, msgRate and msgBurstAllowance are used.
+	readMsgRate            time.Duration
+	readMsgBurstAllowance  int
+	writeMsgRate           time.Duration
+	writeMsgBurstAllowance int
+
+	// tearDownPairs indicates that tearing down a stream also tears down
+	// the sibling stream of its bidirectional pair.
+	tearDownPairs bool
+
+	// reclaimStreams indicates that the creator of a stream may reclaim
+	// it by initializing it again, which tears down the existing stream
+	// and creates a fresh one.
+	reclaimStreams bool
+
+	// streamStore is an optional store used to persist stream
+	// descriptors. If nil, streams only live in memory.
+	streamStore hashMailStreamStore
+
+	// activeReadRate is the minimum number of reads per second a session
+	// needs to be classified as active.
+	activeReadRate float64
+
+	// requireSignatures indicates that every request to create or tear
+	// down a stream must be signed.
+	requireSignatures bool
+
+	// maxStreamsPerClient is the maximum number of streams a single client
+	// IP address may have active at the same time. If zero, the number is
+	// unlimited.
+	maxStreamsPerClient int
+
+	// realIP is used to determine the real IP address of clients that
+	// connect through trusted proxies. If nil, the address of the gRPC
+	// peer is used.
+	realIP *proxy.RealIPResolver
+
+	// streamAcquireTimeout is the maximum time to wait for an occupied
+	// read or write stream to be returned before the request for it
+	// fails. If zero, the request fails right away.
+	streamAcquireTimeout time.Duration
 }
 
 // hashMailServer is an implementation of the HashMailServer gRPC service that
@@ -348,9 +713,24 @@ type hashMailServer struct {
 	sync.RWMutex
 	streams map[streamID]*stream
 
-	// TODO(roasbeef): index to keep track of total stream tallies
+	// clientStreams tracks the number of active streams created by each
+	// client IP address.
+	clientStreams map[string]int
+
+	// draining is set once the server is being gracefully stopped. No new
+	// streams are accepted while draining.
+	draining bool
 
-	quit chan struct{}
+	// activity tracks the reads of each session to classify the sessions
+	// by how actively they are used.
+	activity *streamActivity
+
+	// persistQueue orders the operations on the stream store, which are
+	// run without holding the server's lock.
+	persistQueue *persistQueue
+
+	quit     chan struct{}
+	quitOnce sync.Once
 
 	cfg hashMailServerConfig
 }
@@ -363,15 +743,36 @@ func newHashMailServer(cfg hashMailServerConfig) *hashMailServer {
 	if cfg.msgBurstAllowance == 0 {
 		cfg.msgBurstAllowance = DefaultMsgBurstAllowance
 	}
+	if cfg.readMsgRate == 0 {
+		cfg.readMsgRate = cfg.msgRate
+	}
+	if cfg.readMsgBurstAllowance == 0 {
+		cfg.readMsgBurstAllowance = cfg.msgBurstAllowance
+	}
+	if cfg.writeMsgRate == 0 {
+		cfg.writeMsgRate = cfg.msgRate
+	}
+	if cfg.writeMsgBurstAllowance == 0 {
+		cfg.writeMsgBurstAllowance = cfg.msgBurstAllowance
+	}
 	if cfg.staleTimeout == 0 {
 		cfg.staleTimeout = DefaultStaleTimeout
 	}
+	if cfg.maxMessageSize == 0 {
+		cfg.maxMessageSize = DefaultMaxMessageSize
+	}
 
-	return &hashMailServer{
-		streams: make(map[streamID]*stream),
-		quit:    make(chan struct{}),
-		cfg:     cfg,
+	h := &hashMailServer{
+		streams:       make(map[streamID]*stream),
+		clientStreams: make(map[string]int),
+		activity:      newStreamActivity(cfg.activeReadRate, time.Now),
+		persistQueue:  newPersistQueue(),
+		quit:          make(chan struct{}),
+		cfg:           cfg,
 	}
+	go h.classifyActivity()
+
+	return h
 }
 
 // Stop attempts to gracefully stop the server by cancelling all pending user
@@ -386,91 +787,526 @@ func (h *hashMailServer) Stop() {
 		}
 	}
 
+	h.quitOnce.Do(func() {
+		close(h.quit)
+	})
+}
+
+// StopGracefully stops accepting new streams and waits for all currently
+// occupied streams to become idle before tearing down all streams. If the
+// context expires before that, the remaining streams are torn down anyway.
+func (h *hashMailServer) StopGracefully(ctx context.Context) {
+	h.Lock()
+	h.draining = true
+	h.Unlock()
+
+	log.Infof("Draining HashMail server")
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for h.hasOccupiedStreams() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Warnf("Tearing down occupied HashMail streams after "+
+				"drain timeout: %v", ctx.Err())
+
+			h.Stop()
+			return
+		}
+	}
+
+	h.Stop()
+}
+
+// hasOccupiedStreams returns true if the read or write sub-stream of any of
+// the server's streams is currently in use.
+func (h *hashMailServer) hasOccupiedStreams() bool {
+	h.RLock()
+	defer h.RUnlock()
+
+	for _, stream := range h.streams {
+		if stream.occupied() {
+			return true
+		}
+	}
+
+	return false
 }
 
 // tearDownStaleStream can be used to tear down a stale mailbox stream.
 func (h *hashMailServer) tearDownStaleStream(id streamID) error {
 	log.Debugf("Tearing down stale HashMail stream: id=%x", id)
 
+	if err := h.removeStream(id); err != nil {
+		return err
+	}
+
+	staleTeardownsTotal.Inc()
+
+	return nil
+}
+
+// tearDownOversizedStream tears down a mailbox stream a message exceeding the
+// maximum message size was sent through.
+func (h *hashMailServer) tearDownOversizedStream(id streamID) {
+	log.Debugf("Tearing down HashMail stream with oversized message: "+
+		"id=%x", id)
+
+	if err := h.removeStream(id); err != nil {
+		log.Warnf("Unable to tear down HashMail stream %x: %v", id,
+			err)
+	}
+}
+
+// removeStream tears down the given mailbox stream and removes it from the
+// server.
+func (h *hashMailServer) removeStream(id streamID) error {
 	h.Lock()
-	defer h.Unlock()
 
 	stream, ok := h.streams[id]
 	if !ok {
+		h.Unlock()
 		return fmt.Errorf("stream not found")
 	}
 
 	if err := stream.tearDown(); err != nil {
+		h.Unlock()
 		return err
 	}
 
+	h.deleteStream(id)
+	h.pruneStreamMetrics(id)
+
+	mailboxCount.Set(float64(len(h.streams)))
+
+	deleteStored := h.scheduleDeleteStoredStreams(id)
+	h.Unlock()
+
+	deleteStored()
+
+	return nil
+}
+
+// deleteStream removes the given stream from the server and releases it from
+// the stream count of the client that created it.
+//
+// NOTE: The caller must hold the server's lock.
+func (h *hashMailServer) deleteStream(id streamID) {
+	stream, ok := h.streams[id]
+	if !ok {
+		return
+	}
 	delete(h.streams, id)
 
+	if stream.client == "" {
+		return
+	}
+
+	h.clientStreams[stream.client]--
+	if h.clientStreams[stream.client] <= 0 {
+		delete(h.clientStreams, stream.client)
+	}
+}
+
+// pruneStreamMetrics removes the byte gauges of the session the given stream
+// belongs to once neither of its streams exist anymore, so we don't leak label
+// cardinality.
+//
+// NOTE: The caller must hold the server's lock.
+func (h *hashMailServer) pruneStreamMetrics(id streamID) {
+	if _, ok := h.streams[id.sibling()]; ok {
+		return
+	}
+
+	label := id.metricsLabel()
+	mailboxBytesRead.DeleteLabelValues(label)
+	mailboxBytesWritten.DeleteLabelValues(label)
+}
+
+// scheduleDeleteStoredStreams schedules the removal of the persisted
+// descriptors of the given streams, if stream persistence is enabled. The
+// returned function removes them and must be called once the server's lock is
+// released. Failures are only logged as the streams themselves are already
+// gone.
+//
+// NOTE: The caller must hold the server's lock.
+func (h *hashMailServer) scheduleDeleteStoredStreams(ids ...streamID) func() {
+	if h.cfg.streamStore == nil || len(ids) == 0 {
+		return func() {}
+	}
+
+	persist := h.persistQueue.schedule()
+
+	return func() {
+		persist(func() {
+			for _, id := range ids {
+				h.deleteStoredStream(id)
+			}
+		})
+	}
+}
+
+// deleteStoredStream removes the persisted descriptor of a stream.
+func (h *hashMailServer) deleteStoredStream(id streamID) {
+	ctxt, cancel := context.WithTimeout(
+		context.Background(), aperturedb.DefaultStoreTimeout,
+	)
+	defer cancel()
+
+	if err := h.cfg.streamStore.DeleteStream(ctxt, id[:]); err != nil {
+		log.Warnf("Unable to delete persisted HashMail stream %x: %v",
+			id, err)
+	}
+}
+
+// restoreStreams re-creates all streams whose descriptors were persisted
+// before the server was last stopped. Only the existence of the streams is
+// restored, any messages that were in flight are lost.
+func (h *hashMailServer) restoreStreams(ctx context.Context) error {
+	if h.cfg.streamStore == nil {
+		return nil
+	}
+
+	storedStreams, err := h.cfg.streamStore.ListStreams(ctx)
+	if err != nil {
+		return err
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	for _, storedStream := range storedStreams {
+		sid := newStreamID(storedStream.StreamID)
+		if _, ok := h.streams[sid]; ok {
+			continue
+		}
+
+		// We restore the creation auth as well, so only the original
+		// creator can tear down or re-initialize the stream.
+		var auth hashmailrpc.CipherBoxAuth
+		err := proto.Unmarshal(storedStream.Auth, &auth)
+		if err != nil {
+			log.Warnf("Skipping persisted HashMail stream %x with "+
+				"invalid auth: %v", sid, err)
+			continue
+		}
+		equivAuth, err := newEquivAuth(&auth)
+		if err != nil {
+			log.Warnf("Skipping persisted HashMail stream %x: %v",
+				sid, err)
+			continue
+		}
+
+		restoredStream := h.newStream(sid, equivAuth)
+		restoredStream.restored = true
+		restoredStream.creator = storedStream.Creator
+		h.streams[sid] = restoredStream
+	}
+
 	mailboxCount.Set(float64(len(h.streams)))
 
+	log.Infof("Restored %d persisted HashMail streams",
+		len(storedStreams))
+
 	return nil
 }
 
+// newStream creates a new stream with the server's configured limits.
+func (h *hashMailServer) newStream(sid streamID,
+	equivAuth func(auth *hashmailrpc.CipherBoxAuth) error) *stream {
+
+	readLimiter := rate.NewLimiter(
+		rate.Every(h.cfg.readMsgRate), h.cfg.readMsgBurstAllowance,
+	)
+	writeLimiter := rate.NewLimiter(
+		rate.Every(h.cfg.writeMsgRate), h.cfg.writeMsgBurstAllowance,
+	)
+
+	return newStream(
+		sid, readLimiter, writeLimiter, equivAuth, func() error {
+			return h.tearDownStaleStream(sid)
+		}, h.cfg.staleTimeout, h.cfg.maxMessageSize, func() {
+			h.tearDownOversizedStream(sid)
+		},
+	)
+}
+
+// streamSignatureMsg returns the message clients sign to authorize the given
+// operation on the stream with the given ID at the given unix timestamp.
+func streamSignatureMsg(op string, streamID []byte, timestamp int64) []byte {
+	return []byte(fmt.Sprintf(
+		"%s:%s:%x:%d", streamSignatureDomain, op, streamID, timestamp,
+	))
+}
+
 // ValidateStreamAuth attempts to validate the authentication mechanism that is
-// being used to claim or revoke a stream within the mail server.
+// being used to claim or revoke a stream within the mail server. Clients prove
+// their identity by signing the message returned by streamSignatureMsg for the
+// operation with lnd's SignMessage RPC. They send the zbase32 encoded
+// signature in the hashmail-signature metadata and the timestamp they signed
+// at in the hashmail-signature-timestamp metadata. The compressed public key
+// of the signer is returned. If the request isn't signed and signatures aren't
+// required, nil is returned.
 func (h *hashMailServer) ValidateStreamAuth(ctx context.Context,
-	init *hashmailrpc.CipherBoxAuth) error {
+	init *hashmailrpc.CipherBoxAuth, op string) ([]byte, error) {
 
-	// TODO(guggero): Implement auth.
-	if true {
-		return nil
+	sigs := metadata.ValueFromIncomingContext(ctx, streamSignatureKey)
+	if len(sigs) == 0 {
+		if h.cfg.requireSignatures {
+			return nil, status.Error(codes.Unauthenticated,
+				"stream signature required")
+		}
+
+		return nil, nil
 	}
 
-	// TODO(roasbeef): throttle the number of streams a given
-	// ticket/account can have
+	sig, err := zbase32.DecodeString(sigs[0])
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid "+
+			"stream signature encoding: %v", err)
+	}
 
-	return nil
+	timestamps := metadata.ValueFromIncomingContext(
+		ctx, streamSignatureTimestampKey,
+	)
+	if len(timestamps) == 0 {
+		return nil, status.Error(codes.Unauthenticated,
+			"stream signature timestamp required")
+	}
+	timestamp, err := strconv.ParseInt(timestamps[0], 10, 64)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid "+
+			"stream signature timestamp: %v", err)
+	}
+
+	// Signatures are only valid around the time they were made, so they
+	// can't be replayed later on.
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > streamSignatureMaxAge || age < -streamSignatureMaxAge {
+		return nil, status.Error(codes.Unauthenticated,
+			"stream signature expired")
+	}
+
+	// The signature is over the double SHA256 hash of the prefixed
+	// message. Recovering the public key also validates the signature.
+	msg := append(
+		append([]byte{}, signedMsgPrefix...),
+		streamSignatureMsg(op, init.Desc.StreamId, timestamp)...,
+	)
+	pubKey, _, err := ecdsa.RecoverCompact(sig, chainhash.DoubleHashB(msg))
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid "+
+			"stream signature: %v", err)
+	}
+
+	return pubKey.SerializeCompressed(), nil
 }
 
-// InitStream attempts to initialize a new stream given a valid descriptor.
-func (h *hashMailServer) InitStream(
-	init *hashmailrpc.CipherBoxAuth) (*hashmailrpc.CipherInitResp, error) {
+// streamClient returns the IP address of the client of the given request
+// context. If the gRPC peer is a trusted proxy of the given resolver, the
+// address it reports in the request metadata is used instead. This includes
+// requests of the REST proxy, which are sent by aperture itself over the
+// loopback interface and carry the address of the REST client in the
+// X-Forwarded-For metadata, if the loopback address is trusted. An empty
+// string is returned if the client is unknown.
+func streamClient(ctx context.Context, realIP *proxy.RealIPResolver) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	client := p.Addr.String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+
+	ip := net.ParseIP(client)
+	if ip == nil || realIP == nil {
+		return client
+	}
+
+	// The resolver expects the fields of an HTTP header, which the gRPC
+	// metadata is made of.
+	md, _ := metadata.FromIncomingContext(ctx)
+	header := make(http.Header, len(md))
+	for key, values := range md {
+		header[http.CanonicalHeaderKey(key)] = values
+	}
+
+	return realIP.ClientIP(ip, header).String()
+}
+
+// clientLimitReached returns true if the given client can't create another
+// stream with the given ID without exceeding the maximum number of streams per
+// client. A stream with the same ID that the client would replace isn't
+// counted.
+//
+// NOTE: The caller must hold the server's lock.
+func (h *hashMailServer) clientLimitReached(client string,
+	sid streamID) bool {
+
+	if h.cfg.maxStreamsPerClient <= 0 || client == "" {
+		return false
+	}
+
+	count := h.clientStreams[client]
+	if existing, ok := h.streams[sid]; ok && existing.client == client {
+		count--
+	}
+
+	return count >= h.cfg.maxStreamsPerClient
+}
+
+// InitStream attempts to initialize a new stream given a valid descriptor. The
+// creator is the public key that signed the request, if any.
+func (h *hashMailServer) InitStream(ctx context.Context,
+	init *hashmailrpc.CipherBoxAuth,
+	creator []byte) (*hashmailrpc.CipherInitResp, error) {
+
+	// If enabled, we persist the stream's descriptor so it can be restored
+	// after a restart.
+	var storedAuth []byte
+	if h.cfg.streamStore != nil {
+		var err error
+		storedAuth, err = proto.Marshal(init)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	streamID := newStreamID(init.Desc.StreamId)
+	created, persist, err := h.addStream(ctx, streamID, init, creator)
+	if err != nil {
+		return nil, err
+	}
+
+	// The descriptor is persisted without holding the server's lock. If
+	// that fails, the stream is removed again.
+	if persist != nil {
+		persist(func() {
+			err = h.cfg.streamStore.AddStream(
+				ctx, streamID[:], storedAuth, creator,
+			)
+		})
+		if err != nil {
+			log.Errorf("Unable to persist HashMail stream %x: %v",
+				streamID, err)
+			h.abortStream(streamID, created)
+
+			return nil, status.Error(codes.Internal, "unable to "+
+				"persist stream")
+		}
+	}
+
+	streamsCreatedTotal.Inc()
+
+	return &hashmailrpc.CipherInitResp{
+		Resp: &hashmailrpc.CipherInitResp_Success{},
+	}, nil
+}
+
+// addStream creates the stream with the given ID in memory. If stream
+// persistence is enabled, a place in the persistence queue is returned as
+// well, which must be used to persist the stream.
+func (h *hashMailServer) addStream(ctx context.Context, streamID streamID,
+	init *hashmailrpc.CipherBoxAuth, creator []byte) (*stream,
+	func(op func()), error) {
 
 	h.Lock()
 	defer h.Unlock()
 
-	streamID := newStreamID(init.Desc.StreamId)
+	// We don't accept any new streams while we're draining.
+	if h.draining {
+		return nil, nil, status.Error(codes.Unavailable, "server is "+
+			"shutting down")
+	}
 
 	log.Debugf("Creating new HashMail Stream: %x", streamID)
 
+	// A single client may only have a limited number of streams, so it
+	// can't exhaust the server's resources.
+	client := streamClient(ctx, h.cfg.realIP)
+	if h.clientLimitReached(client, streamID) {
+		log.Debugf("Rejecting HashMail stream %x of client %s with "+
+			"too many streams", streamID, client)
+
+		return nil, nil, status.Error(codes.ResourceExhausted, "too "+
+			"many active streams")
+	}
+
+	equivAuth, err := newEquivAuth(init)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// The stream is already active, and we only allow a single session for
-	// a given stream to exist.
-	if _, ok := h.streams[streamID]; ok {
-		return nil, status.Error(codes.AlreadyExists, "stream "+
-			"already active")
+	// a given stream to exist. The only exceptions are a stream that was
+	// restored after a restart and not used since, or any stream if
+	// reclaiming is enabled, which its original creator may cleanly
+	// re-initialize.
+	if existing, ok := h.streams[streamID]; ok {
+		reclaimable := h.cfg.reclaimStreams ||
+			existing.isUnusedRestore()
+		sameCreator := existing.verifyCreator(init, creator) == nil
+		if !reclaimable || !sameCreator {
+			return nil, nil, status.Error(codes.AlreadyExists,
+				"stream already active")
+		}
+
+		log.Debugf("Re-initializing existing HashMail stream: %x",
+			streamID)
+
+		if err := existing.tearDown(); err != nil {
+			return nil, nil, err
+		}
+		h.deleteStream(streamID)
 	}
 
 	// TODO(roasbeef): validate that ticket or node doesn't already have
 	// the same stream going
 
-	limiter := rate.NewLimiter(
-		rate.Every(h.cfg.msgRate), h.cfg.msgBurstAllowance,
-	)
-	freshStream := newStream(
-		streamID, limiter, func(auth *hashmailrpc.CipherBoxAuth) error {
-			return nil
-		}, func() error {
-			return h.tearDownStaleStream(streamID)
-		}, h.cfg.staleTimeout,
-	)
-
-	h.streams[streamID] = freshStream
+	created := h.newStream(streamID, equivAuth)
+	created.creator = creator
+	created.client = client
+	h.streams[streamID] = created
+	if client != "" {
+		h.clientStreams[client]++
+	}
 
 	mailboxCount.Set(float64(len(h.streams)))
 
-	return &hashmailrpc.CipherInitResp{
-		Resp: &hashmailrpc.CipherInitResp_Success{},
-	}, nil
+	var persist func(op func())
+	if h.cfg.streamStore != nil {
+		persist = h.persistQueue.schedule()
+	}
+
+	return created, persist, nil
+}
+
+// abortStream removes the given stream that couldn't be persisted, unless it
+// was already replaced or removed in the meantime.
+func (h *hashMailServer) abortStream(id streamID, aborted *stream) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.streams[id] != aborted {
+		return
+	}
+
+	if err := aborted.tearDown(); err != nil {
+		log.Warnf("Unable to tear down HashMail stream %x: %v", id,
+			err)
+	}
+	h.deleteStream(id)
+	h.pruneStreamMetrics(id)
+
+	mailboxCount.Set(float64(len(h.streams)))
 }
 
-// LookUpReadStream attempts to loop up a new stream. If the stream is found, then
-// the stream is marked as being active. Otherwise, an error is returned.
-func (h *hashMailServer) LookUpReadStream(streamID []byte) (*readStream, error) {
+// lookUpStream returns the stream with the given ID.
+func (h *hashMailServer) lookUpStream(streamID []byte) (*stream, error) {
 	h.RLock()
 	defer h.RUnlock()
 
@@ -479,64 +1315,121 @@ func (h *hashMailServer) LookUpReadStream(streamID []byte) (*readStream, error)
 		return nil, fmt.Errorf("stream not found")
 	}
 
-	return stream.RequestReadStream()
+	return stream, nil
 }
 
-// LookUpWriteStream attempts to loop up a new stream. If the stream is found,
+// LookUpReadStream attempts to loop up a new stream. If the stream is found,
 // then the stream is marked as being active. Otherwise, an error is returned.
-func (h *hashMailServer) LookUpWriteStream(streamID []byte) (*writeStream, error) {
+// If the read stream is occupied, we wait up to the configured stream acquire
+// timeout for it to be returned. The server's lock isn't held while waiting.
+func (h *hashMailServer) LookUpReadStream(ctx context.Context,
+	streamID []byte) (*readStream, error) {
 
-	h.RLock()
-	defer h.RUnlock()
+	stream, err := h.lookUpStream(streamID)
+	if err != nil {
+		return nil, err
+	}
 
-	stream, ok := h.streams[newStreamID(streamID)]
-	if !ok {
-		return nil, fmt.Errorf("stream not found")
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.streamAcquireTimeout)
+	defer cancel()
+
+	return stream.RequestReadStream(ctx)
+}
+
+// LookUpWriteStream attempts to loop up a new stream. If the stream is found,
+// then the stream is marked as being active. Otherwise, an error is returned.
+// If the write stream is occupied, we wait up to the configured stream acquire
+// timeout for it to be returned. The server's lock isn't held while waiting.
+func (h *hashMailServer) LookUpWriteStream(ctx context.Context,
+	streamID []byte) (*writeStream, error) {
+
+	stream, err := h.lookUpStream(streamID)
+	if err != nil {
+		return nil, err
 	}
 
-	return stream.RequestWriteStream()
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.streamAcquireTimeout)
+	defer cancel()
+
+	return stream.RequestWriteStream(ctx)
 }
 
 // TearDownStream attempts to tear down a stream which renders both sides of
-// the stream unusable and also reclaims resources.
-func (h *hashMailServer) TearDownStream(ctx context.Context, streamID []byte,
+// the stream unusable and also reclaims resources. If configured, the sibling
+// stream of a bidirectional pair is torn down in the same operation.
+func (h *hashMailServer) TearDownStream(ctx context.Context, rawID []byte,
 	auth *hashmailrpc.CipherBoxAuth) error {
 
+	// First, we validate the authentication mechanism to find out who
+	// signed the request, if anyone.
+	signer, err := h.ValidateStreamAuth(ctx, auth, streamOpDelete)
+	if err != nil {
+		return err
+	}
+
+	deleteStored, err := h.tearDownStreams(newStreamID(rawID), auth, signer)
+
+	// The persisted descriptors of the streams that were torn down are
+	// removed without holding the server's lock.
+	deleteStored()
+
+	return err
+}
+
+// tearDownStreams tears down the stream with the given ID and, if configured,
+// its sibling. The returned function removes the persisted descriptors of the
+// streams that were torn down, even if an error is returned, and must be
+// called once the server's lock is released.
+func (h *hashMailServer) tearDownStreams(sid streamID,
+	auth *hashmailrpc.CipherBoxAuth, signer []byte) (func(), error) {
+
 	h.Lock()
 	defer h.Unlock()
 
-	sid := newStreamID(streamID)
 	stream, ok := h.streams[sid]
 	if !ok {
-		return fmt.Errorf("stream not found")
+		return func() {}, fmt.Errorf("stream not found")
 	}
 
-	// We'll ensure that the same authentication type is used, to ensure
-	// only the creator can tear down a stream they created.
-	if err := stream.equivAuth(auth); err != nil {
-		return fmt.Errorf("invalid auth: %v", err)
+	// We'll ensure that the same authentication type and signer are used,
+	// to ensure only the creator can tear down a stream they created.
+	if err := stream.verifyCreator(auth, signer); err != nil {
+		return func() {}, fmt.Errorf("invalid auth: %v", err)
 	}
 
-	// Now that we know the auth type has matched up, we'll validate the
-	// authentication mechanism as normal.
-	if err := h.ValidateStreamAuth(ctx, auth); err != nil {
-		return err
+	// If we tear down pairs, the sibling stream with the last bit of the
+	// ID flipped goes as well. The sibling is usually created by the peer
+	// with its own key, so proving to be the creator of one side of the
+	// pair is enough to tear down both.
+	sids := []streamID{sid}
+	if h.cfg.tearDownPairs {
+		siblingID := sid.sibling()
+		if _, ok := h.streams[siblingID]; ok {
+			sids = append(sids, siblingID)
+		}
 	}
 
-	log.Debugf("Tearing down HashMail stream: id=%x, auth=%v",
-		auth.Desc.StreamId, auth.Auth)
-
 	// At this point we know the auth was valid, so we'll tear down the
-	// stream.
-	if err := stream.tearDown(); err != nil {
-		return err
-	}
+	// stream(s).
+	var deleted []streamID
+	for _, id := range sids {
+		log.Debugf("Tearing down HashMail stream: id=%x, auth=%v", id,
+			auth.Auth)
+
+		if err := h.streams[id].tearDown(); err != nil {
+			return h.scheduleDeleteStoredStreams(deleted...), err
+		}
 
-	delete(h.streams, sid)
+		h.deleteStream(id)
+		h.pruneStreamMetrics(id)
+		deleted = append(deleted, id)
+
+		streamsDeletedTotal.Inc()
+	}
 
 	mailboxCount.Set(float64(len(h.streams)))
 
-	return nil
+	return h.scheduleDeleteStoredStreams(deleted...), nil
 }
 
 // validateAuthReq does some basic sanity checks on incoming auth methods.
@@ -571,13 +1464,14 @@ func (h *hashMailServer) NewCipherBox(ctx context.Context,
 	log.Debugf("New HashMail stream init: id=%x, auth=%v",
 		init.Desc.StreamId, init.Auth)
 
-	if err := h.ValidateStreamAuth(ctx, init); err != nil {
+	creator, err := h.ValidateStreamAuth(ctx, init, streamOpCreate)
+	if err != nil {
 		log.Debugf("Stream creation validation failed (id=%x): %v",
 			init.Desc.StreamId, err)
 		return nil, err
 	}
 
-	resp, err := h.InitStream(init)
+	resp, err := h.InitStream(ctx, init, creator)
 	if err != nil {
 		return nil, err
 	}
@@ -634,7 +1528,9 @@ func (h *hashMailServer) SendStream(readStream hashmailrpc.HashMail_SendStreamSe
 
 	// Now that we have the first message, we can attempt to look up the
 	// given stream.
-	writeStream, err := h.LookUpWriteStream(cipherBox.Desc.StreamId)
+	writeStream, err := h.LookUpWriteStream(
+		readStream.Context(), cipherBox.Desc.StreamId,
+	)
 	if err != nil {
 		return err
 	}
@@ -691,7 +1587,7 @@ func (h *hashMailServer) RecvStream(desc *hashmailrpc.CipherBoxDesc,
 
 	// First, we'll attempt to locate the stream. We allow any single
 	// entity that knows of the full stream ID to access the read end.
-	readStream, err := h.LookUpReadStream(desc.StreamId)
+	readStream, err := h.LookUpReadStream(reader.Context(), desc.StreamId)
 	if err != nil {
 		return err
 	}
@@ -735,6 +1631,7 @@ func (h *hashMailServer) RecvStream(desc *hashmailrpc.CipherBoxDesc,
 			mailboxReadCount.With(prometheus.Labels{
 				streamIDLabel: fmt.Sprintf("%x", baseID),
 			}).Inc()
+			h.activity.recordRead(baseID)
 		}
 
 		err = reader.Send(&hashmailrpc.CipherBox{
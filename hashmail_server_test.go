@@ -3,22 +3,38 @@ package aperture
 import (
 	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"math"
 	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/lightninglabs/aperture/aperturedb"
+	"github.com/lightninglabs/aperture/proxy"
 	"github.com/lightninglabs/lightning-node-connect/hashmailrpc"
 	"github.com/lightningnetwork/lnd/build"
 	"github.com/lightningnetwork/lnd/lntest/wait"
 	"github.com/lightningnetwork/lnd/signal"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/tv42/zbase32"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
 )
 
 var (
@@ -175,6 +191,10 @@ func setupAperture(t *testing.T) {
 			Enabled:               true,
 			MessageRate:           time.Millisecond,
 			MessageBurstAllowance: math.MaxUint32,
+
+			// Give the read stream a client just hung up on the
+			// chance to be returned before it's requested again.
+			StreamAcquireTimeout: time.Second,
 		},
 		Prometheus: &PrometheusConfig{},
 		Tor:        &TorConfig{},
@@ -182,6 +202,9 @@ func setupAperture(t *testing.T) {
 	aperture := NewAperture(apertureCfg)
 	errChan := make(chan error)
 	require.NoError(t, aperture.Start(errChan))
+	t.Cleanup(func() {
+		require.NoError(t, aperture.Stop())
+	})
 
 	// Any error while starting?
 	select {
@@ -311,6 +334,10 @@ func TestStaleMailboxCleanup(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 			ctx := context.Background()
 
+			staleTeardowns := testutil.ToFloat64(
+				staleTeardownsTotal,
+			)
+
 			// Set up a new hashmail server.
 			hm := newHashMailHarness(t, hashMailServerConfig{
 				staleTimeout: test.staleTimeout,
@@ -379,8 +406,874 @@ func TestStaleMailboxCleanup(t *testing.T) {
 
 			// Assert that the stream is torn down.
 			hm.assertStreamExists(!test.expectStaleMailboxRemoval)
+
+			// Only stale teardowns are counted as such.
+			if test.expectStaleMailboxRemoval {
+				staleTeardowns++
+			}
+			require.Equal(
+				t, staleTeardowns,
+				testutil.ToFloat64(staleTeardownsTotal),
+			)
+		})
+	}
+}
+
+// TestHashMailPersistence tests that a persisted stream survives a restart of
+// the hashmail server and can be used again after it.
+func TestHashMailPersistence(t *testing.T) {
+	ctx := context.Background()
+	store := newMockHashMailStreamStore()
+	cfg := hashMailServerConfig{
+		staleTimeout: -1,
+		streamStore:  store,
+	}
+
+	// Create a stream on the first server instance. Its descriptor should
+	// be persisted.
+	hm := newHashMailHarness(t, cfg)
+	client := hashmailrpc.NewHashMailClient(hm.newClientConn())
+	auth := &hashmailrpc.CipherBoxAuth{
+		Auth: &hashmailrpc.CipherBoxAuth_LndAuth{},
+		Desc: testStreamDesc,
+	}
+	_, err := client.NewCipherBox(ctx, auth)
+	require.NoError(t, err)
+	require.Len(t, store.streams, 1)
+
+	// Simulate a restart by stopping the server and starting a new one
+	// with the same store.
+	hm.server.Stop()
+
+	hm = newHashMailHarness(t, cfg)
+	hm.assertStreamExists(false)
+	require.NoError(t, hm.server.restoreStreams(ctx))
+	hm.assertStreamExists(true)
+
+	// Clients should be able to reconnect to the restored stream.
+	client = hashmailrpc.NewHashMailClient(hm.newClientConn())
+	require.NoError(t, sendToStream(client))
+	require.NoError(t, recvFromStream(client))
+
+	// Deleting the stream also removes its persisted descriptor.
+	_, err = client.DelCipherBox(ctx, auth)
+	require.NoError(t, err)
+	hm.assertStreamExists(false)
+	require.Empty(t, store.streams)
+}
+
+// blockingStreamStore is a stream store that blocks adding streams until it
+// is released and can be made to fail adding them.
+type blockingStreamStore struct {
+	*mockHashMailStreamStore
+
+	addStarted chan struct{}
+	release    chan struct{}
+	addErr     error
+}
+
+func (b *blockingStreamStore) AddStream(ctx context.Context, id, auth,
+	creator []byte) error {
+
+	b.addStarted <- struct{}{}
+	<-b.release
+
+	if b.addErr != nil {
+		return b.addErr
+	}
+
+	return b.mockHashMailStreamStore.AddStream(ctx, id, auth, creator)
+}
+
+// TestHashMailPersistOutsideLock tests that streams are persisted without
+// holding the server's lock and that streams that can't be persisted are
+// removed again.
+func TestHashMailPersistOutsideLock(t *testing.T) {
+	ctx := context.Background()
+	store := &blockingStreamStore{
+		mockHashMailStreamStore: newMockHashMailStreamStore(),
+		addStarted:              make(chan struct{}),
+		release:                 make(chan struct{}),
+	}
+	h := newHashMailServer(hashMailServerConfig{
+		staleTimeout: -1,
+		streamStore:  store,
+	})
+	defer h.Stop()
+
+	auth := &hashmailrpc.CipherBoxAuth{
+		Auth: &hashmailrpc.CipherBoxAuth_LndAuth{},
+		Desc: testStreamDesc,
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := h.InitStream(ctx, auth, nil)
+		errChan <- err
+	}()
+
+	// While the stream is being persisted, the server isn't locked.
+	<-store.addStarted
+	require.True(t, h.TryLock())
+	h.Unlock()
+
+	close(store.release)
+	require.NoError(t, <-errChan)
+	require.Len(t, store.streams, 1)
+
+	_, err := h.lookUpStream(testStreamDesc.StreamId)
+	require.NoError(t, err)
+
+	// If the stream can't be persisted, it's removed again.
+	require.NoError(t, h.TearDownStream(ctx, testStreamDesc.StreamId, auth))
+	require.Empty(t, store.streams)
+
+	store.addErr = errors.New("store unavailable")
+	go func() {
+		<-store.addStarted
+	}()
+	_, err = h.InitStream(ctx, auth, nil)
+	require.Error(t, err)
+
+	_, err = h.lookUpStream(testStreamDesc.StreamId)
+	require.Error(t, err)
+	require.Empty(t, store.streams)
+}
+
+// TestHashMailRestoredStreamReinit tests that a restored stream can only be
+// re-initialized by its original creator and only before it is used again.
+func TestHashMailRestoredStreamReinit(t *testing.T) {
+	ctx := context.Background()
+	store := newMockHashMailStreamStore()
+	cfg := hashMailServerConfig{
+		staleTimeout: -1,
+		streamStore:  store,
+	}
+
+	hm := newHashMailHarness(t, cfg)
+	client := hashmailrpc.NewHashMailClient(hm.newClientConn())
+	auth := &hashmailrpc.CipherBoxAuth{
+		Auth: &hashmailrpc.CipherBoxAuth_LndAuth{},
+		Desc: testStreamDesc,
+	}
+	_, err := client.NewCipherBox(ctx, auth)
+	require.NoError(t, err)
+	hm.server.Stop()
+
+	// After a restart, the original creator can re-initialize the
+	// restored stream.
+	hm = newHashMailHarness(t, cfg)
+	require.NoError(t, hm.server.restoreStreams(ctx))
+	client = hashmailrpc.NewHashMailClient(hm.newClientConn())
+	_, err = client.NewCipherBox(ctx, auth)
+	require.NoError(t, err)
+	hm.assertStreamExists(true)
+
+	// Once the stream is used, re-initializing it is no longer allowed.
+	require.NoError(t, sendToStream(client))
+	require.NoError(t, recvFromStream(client))
+	_, err = client.NewCipherBox(ctx, auth)
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	hm.server.Stop()
+
+	// A stream that was persisted with a different auth can't be
+	// re-initialized either.
+	storedAuth, err := proto.Marshal(&hashmailrpc.CipherBoxAuth{
+		Desc: testStreamDesc,
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.AddStream(
+		ctx, testStreamDesc.StreamId, storedAuth, nil,
+	))
+
+	hm = newHashMailHarness(t, cfg)
+	require.NoError(t, hm.server.restoreStreams(ctx))
+	client = hashmailrpc.NewHashMailClient(hm.newClientConn())
+	_, err = client.NewCipherBox(ctx, auth)
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+// TestHashMailByteMetrics tests that the per-session byte gauges are updated
+// when messages flow through a stream and removed once it is torn down.
+func TestHashMailByteMetrics(t *testing.T) {
+	ctx := context.Background()
+	label := testSID.metricsLabel()
+	mailboxBytesRead.DeleteLabelValues(label)
+	mailboxBytesWritten.DeleteLabelValues(label)
+
+	hm := newHashMailHarness(t, hashMailServerConfig{
+		staleTimeout: -1,
+	})
+	client := hashmailrpc.NewHashMailClient(hm.newClientConn())
+	auth := &hashmailrpc.CipherBoxAuth{
+		Auth: &hashmailrpc.CipherBoxAuth_LndAuth{},
+		Desc: testStreamDesc,
+	}
+	_, err := client.NewCipherBox(ctx, auth)
+	require.NoError(t, err)
+
+	require.NoError(t, sendToStream(client))
+	require.NoError(t, recvFromStream(client))
+
+	msgLen := float64(len(testMessage))
+	require.Equal(t, msgLen, testutil.ToFloat64(
+		mailboxBytesWritten.WithLabelValues(label),
+	))
+	require.Equal(t, msgLen, testutil.ToFloat64(
+		mailboxBytesRead.WithLabelValues(label),
+	))
+
+	// Once the stream is gone, its gauges should be removed too.
+	_, err = client.DelCipherBox(ctx, auth)
+	require.NoError(t, err)
+	require.False(t, mailboxBytesRead.DeleteLabelValues(label))
+	require.False(t, mailboxBytesWritten.DeleteLabelValues(label))
+}
+
+// TestHashMailMaxMessageSize tests that a stream a message exceeding the
+// maximum message size is sent through is torn down.
+func TestHashMailMaxMessageSize(t *testing.T) {
+	ctx := context.Background()
+	hm := newHashMailHarness(t, hashMailServerConfig{
+		staleTimeout:   -1,
+		maxMessageSize: uint64(len(testMessage)),
+	})
+	client := hashmailrpc.NewHashMailClient(hm.newClientConn())
+	_, err := client.NewCipherBox(ctx, &hashmailrpc.CipherBoxAuth{
+		Auth: &hashmailrpc.CipherBoxAuth_LndAuth{},
+		Desc: testStreamDesc,
+	})
+	require.NoError(t, err)
+
+	writeStream, err := client.SendStream(ctx)
+	require.NoError(t, err)
+	err = writeStream.Send(&hashmailrpc.CipherBox{
+		Desc: testStreamDesc,
+		Msg:  make([]byte, len(testMessage)+1),
+	})
+	require.NoError(t, err)
+
+	_, err = writeStream.CloseAndRecv()
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	hm.assertStreamExists(false)
+}
+
+// TestHashMailTearDownPairs tests that both streams of a bidirectional pair
+// are torn down together if configured, also if each peer signed its own
+// stream with a different key.
+func TestHashMailTearDownPairs(t *testing.T) {
+	ctx := context.Background()
+	hm := newHashMailHarness(t, hashMailServerConfig{
+		staleTimeout:  -1,
+		tearDownPairs: true,
+	})
+	client := hashmailrpc.NewHashMailClient(hm.newClientConn())
+
+	siblingSID := testSID.sibling()
+	auth := &hashmailrpc.CipherBoxAuth{
+		Auth: &hashmailrpc.CipherBoxAuth_LndAuth{},
+		Desc: testStreamDesc,
+	}
+	siblingAuth := &hashmailrpc.CipherBoxAuth{
+		Auth: &hashmailrpc.CipherBoxAuth_LndAuth{},
+		Desc: &hashmailrpc.CipherBoxDesc{
+			StreamId: siblingSID[:],
+		},
+	}
+	created := testutil.ToFloat64(streamsCreatedTotal)
+	deleted := testutil.ToFloat64(streamsDeletedTotal)
+
+	_, err := client.NewCipherBox(ctx, auth)
+	require.NoError(t, err)
+	_, err = client.NewCipherBox(ctx, siblingAuth)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, testutil.ToFloat64(mailboxCount))
+	require.Equal(t, created+2, testutil.ToFloat64(streamsCreatedTotal))
+
+	// Deleting one half of the pair removes both.
+	_, err = client.DelCipherBox(ctx, auth)
+	require.NoError(t, err)
+	hm.assertStreamExists(false)
+	require.Empty(t, hm.server.streams)
+	require.EqualValues(t, 0, testutil.ToFloat64(mailboxCount))
+	require.Equal(t, deleted+2, testutil.ToFloat64(streamsDeletedTotal))
+
+	// If each peer signed its own stream, the creator of either side can
+	// tear down the pair.
+	key1, err := btcec.NewPrivateKey()
+	require.NoError(t, err)
+	key2, err := btcec.NewPrivateKey()
+	require.NoError(t, err)
+
+	_, err = client.NewCipherBox(
+		signStreamOp(key1, streamOpCreate, testSID, time.Now()), auth,
+	)
+	require.NoError(t, err)
+	_, err = client.NewCipherBox(
+		signStreamOp(key2, streamOpCreate, siblingSID, time.Now()),
+		siblingAuth,
+	)
+	require.NoError(t, err)
+
+	// The peer can't tear down the pair through the stream it didn't
+	// create.
+	_, err = client.DelCipherBox(
+		signStreamOp(key2, streamOpDelete, testSID, time.Now()), auth,
+	)
+	require.ErrorContains(t, err, "signer not equivalent")
+	require.Len(t, hm.server.streams, 2)
+
+	_, err = client.DelCipherBox(
+		signStreamOp(key2, streamOpDelete, siblingSID, time.Now()),
+		siblingAuth,
+	)
+	require.NoError(t, err)
+	hm.assertStreamExists(false)
+	require.Empty(t, hm.server.streams)
+}
+
+// TestHashMailStreamAcquireTimeout tests that a request for an occupied stream
+// waits for the stream to be returned if a stream acquire timeout is
+// configured, and fails right away otherwise.
+func TestHashMailStreamAcquireTimeout(t *testing.T) {
+	ctx := context.Background()
+	newServer := func(timeout time.Duration) *hashMailServer {
+		hm := newHashMailServer(hashMailServerConfig{
+			staleTimeout:         -1,
+			streamAcquireTimeout: timeout,
+		})
+		hm.streams[testSID] = hm.newStream(testSID, nil)
+
+		return hm
+	}
+
+	// Without a timeout, an occupied stream can't be requested.
+	hm := newServer(0)
+	readStream, err := hm.LookUpReadStream(ctx, testSID[:])
+	require.NoError(t, err)
+	_, err = hm.LookUpReadStream(ctx, testSID[:])
+	require.ErrorContains(t, err, "read stream occupied")
+
+	// A free stream is handed out even if the context is done already.
+	readStream.ReturnStream()
+	doneCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	readStream, err = hm.LookUpReadStream(doneCtx, testSID[:])
+	require.NoError(t, err)
+	readStream.ReturnStream()
+
+	// With a timeout, the request waits for the stream to be returned.
+	hm = newServer(time.Minute)
+	writeStream, err := hm.LookUpWriteStream(ctx, testSID[:])
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		writeStream.ReturnStream()
+	}()
+	writeStream, err = hm.LookUpWriteStream(ctx, testSID[:])
+	require.NoError(t, err)
+
+	// The wait ends once the client's context is done or the stream is
+	// torn down.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = hm.LookUpWriteStream(timeoutCtx, testSID[:])
+	require.ErrorContains(t, err, "write stream occupied")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, hm.removeStream(testSID))
+	}()
+	_, err = hm.LookUpWriteStream(ctx, testSID[:])
+	require.ErrorContains(t, err, "stream torn down")
+}
+
+// TestHashMailDirectionalRateLimits tests that the read and write rate limits
+// of a stream can be configured independently and default to the common rate
+// limit.
+func TestHashMailDirectionalRateLimits(t *testing.T) {
+	hm := newHashMailServer(hashMailServerConfig{
+		msgRate:                time.Second,
+		msgBurstAllowance:      5,
+		writeMsgRate:           time.Minute,
+		writeMsgBurstAllowance: 1,
+	})
+
+	s := hm.newStream(testSID, nil)
+	defer func() {
+		require.NoError(t, s.tearDown())
+	}()
+
+	require.Equal(t, rate.Every(time.Second), s.readLimiter.Limit())
+	require.Equal(t, 5, s.readLimiter.Burst())
+	require.Equal(t, rate.Every(time.Minute), s.writeLimiter.Limit())
+	require.Equal(t, 1, s.writeLimiter.Burst())
+}
+
+// TestHashMailSessionActivity tests that mailbox sessions are classified by
+// their read rate according to the configured threshold and that the gauges
+// reflect the counts.
+func TestHashMailSessionActivity(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time {
+		return now
+	}
+
+	busySession := [16]byte{1}
+	idleSession := [16]byte{2}
+	recordReads := func(a *streamActivity) {
+		// Over a minute, the busy session is read from twice per
+		// second and the idle one every other second.
+		for i := 0; i < 120; i++ {
+			a.recordRead(busySession)
+		}
+		for i := 0; i < 30; i++ {
+			a.recordRead(idleSession)
+		}
+		now = now.Add(time.Minute)
+	}
+
+	// With the default threshold of 0.5 reads per second, both sessions
+	// are active.
+	activity := newStreamActivity(0, clock)
+	recordReads(activity)
+	require.Equal(t, sessionCounts{
+		active: 2,
+		inUse:  2,
+	}, activity.ClassifyAndReset())
+
+	// With a higher threshold, only the busy session is.
+	activity = newStreamActivity(1, clock)
+	recordReads(activity)
+	counts := activity.ClassifyAndReset()
+	require.Equal(t, sessionCounts{
+		active:  1,
+		standby: 1,
+		inUse:   2,
+	}, counts)
+
+	setSessionGauges(counts)
+	require.Equal(t, float64(1), testutil.ToFloat64(sessionsActive))
+	require.Equal(t, float64(1), testutil.ToFloat64(sessionsStandby))
+	require.Equal(t, float64(2), testutil.ToFloat64(sessionsInUse))
+
+	// The reads are reset after each classification.
+	now = now.Add(time.Minute)
+	require.Equal(t, sessionCounts{}, activity.ClassifyAndReset())
+}
+
+// TestHashMailStopGracefully tests that a draining server rejects new streams
+// and waits for occupied streams to become idle or the context to expire.
+func TestHashMailStopGracefully(t *testing.T) {
+	ctx := context.Background()
+	auth := &hashmailrpc.CipherBoxAuth{
+		Auth: &hashmailrpc.CipherBoxAuth_LndAuth{},
+		Desc: testStreamDesc,
+	}
+
+	hm := newHashMailHarness(t, hashMailServerConfig{
+		staleTimeout: -1,
+	})
+	conn := hm.newClientConn()
+	client := hashmailrpc.NewHashMailClient(conn)
+	_, err := client.NewCipherBox(ctx, auth)
+	require.NoError(t, err)
+
+	// Occupy the write stream, then start draining.
+	require.NoError(t, sendToStream(client))
+	require.Eventually(t, hm.server.hasOccupiedStreams, time.Second,
+		10*time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		hm.server.StopGracefully(ctx)
+	}()
+
+	// No new streams are accepted while draining.
+	otherSID := streamID{4, 5, 6}
+	err = wait.NoError(func() error {
+		_, err := client.NewCipherBox(ctx, &hashmailrpc.CipherBoxAuth{
+			Auth: &hashmailrpc.CipherBoxAuth_LndAuth{},
+			Desc: &hashmailrpc.CipherBoxDesc{
+				StreamId: otherSID[:],
+			},
 		})
+		if status.Code(err) != codes.Unavailable {
+			return fmt.Errorf("expected unavailable, got %v", err)
+		}
+
+		return nil
+	}, time.Second)
+	require.NoError(t, err)
+
+	select {
+	case <-done:
+		t.Fatalf("server stopped with occupied stream")
+	default:
+	}
+
+	// Once the client disconnects, the stream becomes idle and the server
+	// is stopped.
+	require.NoError(t, conn.Close())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server not stopped after stream became idle")
+	}
+
+	// If the stream doesn't become idle, the server is stopped once the
+	// context expires.
+	hm = newHashMailHarness(t, hashMailServerConfig{
+		staleTimeout: -1,
+	})
+	client = hashmailrpc.NewHashMailClient(hm.newClientConn())
+	_, err = client.NewCipherBox(ctx, auth)
+	require.NoError(t, err)
+	require.NoError(t, sendToStream(client))
+	require.Eventually(t, hm.server.hasOccupiedStreams, time.Second,
+		10*time.Millisecond)
+
+	ctxt, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	hm.server.StopGracefully(ctxt)
+	require.ErrorIs(t, ctxt.Err(), context.DeadlineExceeded)
+}
+
+// TestHashMailReclaimStreams tests that the creator of a stream can reclaim it
+// if enabled, while a different auth still results in AlreadyExists.
+func TestHashMailReclaimStreams(t *testing.T) {
+	ctx := context.Background()
+	auth := &hashmailrpc.CipherBoxAuth{
+		Auth: &hashmailrpc.CipherBoxAuth_LndAuth{},
+		Desc: testStreamDesc,
+	}
+
+	// Without reclaiming, creating an existing stream fails.
+	hm := newHashMailHarness(t, hashMailServerConfig{
+		staleTimeout: -1,
+	})
+	client := hashmailrpc.NewHashMailClient(hm.newClientConn())
+	_, err := client.NewCipherBox(ctx, auth)
+	require.NoError(t, err)
+	_, err = client.NewCipherBox(ctx, auth)
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	// With reclaiming, the same auth can reclaim the stream even after it
+	// was used.
+	hm = newHashMailHarness(t, hashMailServerConfig{
+		staleTimeout:   -1,
+		reclaimStreams: true,
+	})
+	client = hashmailrpc.NewHashMailClient(hm.newClientConn())
+	_, err = client.NewCipherBox(ctx, auth)
+	require.NoError(t, err)
+	require.NoError(t, sendToStream(client))
+	require.NoError(t, recvFromStream(client))
+
+	hm.server.Lock()
+	oldStream := hm.server.streams[testSID]
+	hm.server.Unlock()
+
+	_, err = client.NewCipherBox(ctx, auth)
+	require.NoError(t, err)
+
+	hm.server.Lock()
+	require.NotSame(t, oldStream, hm.server.streams[testSID])
+	hm.server.Unlock()
+
+	// A stream created with a different auth can't be reclaimed.
+	equivAuth, err := newEquivAuth(&hashmailrpc.CipherBoxAuth{})
+	require.NoError(t, err)
+	hm.server.Lock()
+	require.NoError(t, hm.server.streams[testSID].tearDown())
+	hm.server.streams[testSID] = hm.server.newStream(testSID, equivAuth)
+	hm.server.Unlock()
+
+	_, err = client.NewCipherBox(ctx, auth)
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+// signStreamOp returns a context that carries the signature of the given key
+// over the given operation on the given stream at the given time, in the
+// format of lnd's SignMessage RPC.
+func signStreamOp(privKey *btcec.PrivateKey, op string, sid streamID,
+	at time.Time) context.Context {
+
+	msg := append(
+		append([]byte{}, signedMsgPrefix...),
+		streamSignatureMsg(op, sid[:], at.Unix())...,
+	)
+	sig := ecdsa.SignCompact(privKey, chainhash.DoubleHashB(msg), true)
+
+	return metadata.AppendToOutgoingContext(
+		context.Background(), streamSignatureKey,
+		zbase32.EncodeToString(sig), streamSignatureTimestampKey,
+		strconv.FormatInt(at.Unix(), 10),
+	)
+}
+
+// TestHashMailStreamSignatures tests that a stream created with a signed
+// request can only be torn down or reclaimed by requests signed by the same
+// key, also after it was restored.
+func TestHashMailStreamSignatures(t *testing.T) {
+	key1, err := btcec.NewPrivateKey()
+	require.NoError(t, err)
+	key2, err := btcec.NewPrivateKey()
+	require.NoError(t, err)
+
+	sign := func(key *btcec.PrivateKey, op string) context.Context {
+		return signStreamOp(key, op, testSID, time.Now())
 	}
+	unsigned := context.Background()
+	auth := &hashmailrpc.CipherBoxAuth{
+		Auth: &hashmailrpc.CipherBoxAuth_LndAuth{},
+		Desc: testStreamDesc,
+	}
+
+	store := newMockHashMailStreamStore()
+	cfg := hashMailServerConfig{
+		staleTimeout:   -1,
+		reclaimStreams: true,
+		streamStore:    store,
+	}
+	hm := newHashMailHarness(t, cfg)
+	client := hashmailrpc.NewHashMailClient(hm.newClientConn())
+
+	// Signatures that can't be decoded are rejected.
+	badCtx := metadata.AppendToOutgoingContext(
+		unsigned, streamSignatureKey, "not zbase32!",
+	)
+	_, err = client.NewCipherBox(badCtx, auth)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = client.NewCipherBox(sign(key1, streamOpCreate), auth)
+	require.NoError(t, err)
+	require.Equal(
+		t, key1.PubKey().SerializeCompressed(),
+		store.streams[testSID].Creator,
+	)
+
+	// Neither an unsigned request nor one signed by another key can tear
+	// down or reclaim the stream.
+	_, err = client.DelCipherBox(unsigned, auth)
+	require.ErrorContains(t, err, "signer not equivalent")
+	_, err = client.DelCipherBox(sign(key2, streamOpDelete), auth)
+	require.ErrorContains(t, err, "signer not equivalent")
+	_, err = client.NewCipherBox(sign(key2, streamOpCreate), auth)
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	hm.assertStreamExists(true)
+
+	// A signature only authorizes the operation it was made for, so the
+	// signature of the creation can't be used to tear down the stream.
+	createMD, _ := metadata.FromOutgoingContext(
+		sign(key1, streamOpCreate),
+	)
+	createSig := createMD.Get(streamSignatureKey)[0]
+	deleteCtx := metadata.AppendToOutgoingContext(
+		unsigned, streamSignatureKey, createSig,
+		streamSignatureTimestampKey,
+		createMD.Get(streamSignatureTimestampKey)[0],
+	)
+	_, err = client.DelCipherBox(deleteCtx, auth)
+	require.ErrorContains(t, err, "signer not equivalent")
+
+	// Signatures without a timestamp or that were made too long ago are
+	// rejected.
+	noTimestamp := metadata.AppendToOutgoingContext(
+		unsigned, streamSignatureKey, createSig,
+	)
+	_, err = client.NewCipherBox(noTimestamp, auth)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	expired := signStreamOp(
+		key1, streamOpDelete, testSID,
+		time.Now().Add(-2*streamSignatureMaxAge),
+	)
+	_, err = client.DelCipherBox(expired, auth)
+	require.ErrorContains(t, err, "stream signature expired")
+	hm.assertStreamExists(true)
+
+	// The creator can reclaim the stream.
+	_, err = client.NewCipherBox(sign(key1, streamOpCreate), auth)
+	require.NoError(t, err)
+
+	// The creator of a restored stream is still known.
+	hm.server.Stop()
+	hm = newHashMailHarness(t, cfg)
+	require.NoError(t, hm.server.restoreStreams(unsigned))
+	client = hashmailrpc.NewHashMailClient(hm.newClientConn())
+
+	_, err = client.DelCipherBox(sign(key2, streamOpDelete), auth)
+	require.ErrorContains(t, err, "signer not equivalent")
+	_, err = client.DelCipherBox(sign(key1, streamOpDelete), auth)
+	require.NoError(t, err)
+	hm.assertStreamExists(false)
+
+	// Streams created without a signature can be torn down without one.
+	_, err = client.NewCipherBox(unsigned, auth)
+	require.NoError(t, err)
+	_, err = client.DelCipherBox(unsigned, auth)
+	require.NoError(t, err)
+
+	// If signatures are required, unsigned requests are rejected.
+	hm = newHashMailHarness(t, hashMailServerConfig{
+		staleTimeout:      -1,
+		requireSignatures: true,
+	})
+	client = hashmailrpc.NewHashMailClient(hm.newClientConn())
+	_, err = client.NewCipherBox(unsigned, auth)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.NewCipherBox(sign(key1, streamOpCreate), auth)
+	require.NoError(t, err)
+	_, err = client.DelCipherBox(unsigned, auth)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+// TestHashMailMaxStreamsPerClient tests that a client can't create more than
+// the configured number of streams and that deleted streams are released.
+func TestHashMailMaxStreamsPerClient(t *testing.T) {
+	ctx := context.Background()
+	hm := newHashMailHarness(t, hashMailServerConfig{
+		staleTimeout:        -1,
+		reclaimStreams:      true,
+		maxStreamsPerClient: 2,
+	})
+	client := hashmailrpc.NewHashMailClient(hm.newClientConn())
+
+	newAuth := func(sid streamID) *hashmailrpc.CipherBoxAuth {
+		return &hashmailrpc.CipherBoxAuth{
+			Auth: &hashmailrpc.CipherBoxAuth_LndAuth{},
+			Desc: &hashmailrpc.CipherBoxDesc{
+				StreamId: sid[:],
+			},
+		}
+	}
+	auth1 := newAuth(testSID)
+	auth2 := newAuth(testSID.sibling())
+	auth3 := newAuth(streamID{4, 5, 6})
+
+	_, err := client.NewCipherBox(ctx, auth1)
+	require.NoError(t, err)
+	_, err = client.NewCipherBox(ctx, auth2)
+	require.NoError(t, err)
+
+	_, err = client.NewCipherBox(ctx, auth3)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// Reclaiming one of its own streams doesn't count as a new stream.
+	_, err = client.NewCipherBox(ctx, auth1)
+	require.NoError(t, err)
+
+	// Once a stream is deleted, the client can create another one.
+	_, err = client.DelCipherBox(ctx, auth2)
+	require.NoError(t, err)
+	_, err = client.NewCipherBox(ctx, auth3)
+	require.NoError(t, err)
+
+	hm.server.Lock()
+	require.Len(t, hm.server.clientStreams, 1)
+	for _, count := range hm.server.clientStreams {
+		require.Equal(t, 2, count)
+	}
+	hm.server.Unlock()
+}
+
+// TestHashMailStreamClient tests that streams are attributed to the address of
+// the gRPC peer, or to the forwarded address if the peer is a trusted proxy,
+// such as the REST proxy on the loopback interface.
+func TestHashMailStreamClient(t *testing.T) {
+	realIP, err := proxy.NewRealIPResolver([]string{"127.0.0.1"}, "")
+	require.NoError(t, err)
+
+	require.Empty(t, streamClient(context.Background(), realIP))
+
+	newCtx := func(addr string, forwarded ...string) context.Context {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{
+			Addr: &net.TCPAddr{
+				IP: net.ParseIP(addr), Port: 1234,
+			},
+		})
+		if len(forwarded) > 0 {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(
+				"x-forwarded-for", forwarded[0],
+			))
+		}
+
+		return ctx
+	}
+
+	require.Equal(t, "192.0.2.1", streamClient(newCtx("192.0.2.1"), realIP))
+	require.Equal(t, "127.0.0.1", streamClient(newCtx("127.0.0.1"), realIP))
+
+	// Only trusted proxies may forward requests, and the address they
+	// appended is used.
+	require.Equal(t, "192.0.2.1", streamClient(
+		newCtx("192.0.2.1", "198.51.100.1"), realIP,
+	))
+	require.Equal(t, "198.51.100.2", streamClient(
+		newCtx("127.0.0.1", "198.51.100.1, 198.51.100.2"), realIP,
+	))
+
+	// Without any trusted proxies, not even loopback peers can forward
+	// requests.
+	untrusted, err := proxy.NewRealIPResolver(nil, "")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", streamClient(
+		newCtx("127.0.0.1", "198.51.100.1"), untrusted,
+	))
+	require.Equal(t, "127.0.0.1", streamClient(
+		newCtx("127.0.0.1", "198.51.100.1"), nil,
+	))
+}
+
+// mockHashMailStreamStore is an in-memory implementation of the
+// hashMailStreamStore interface.
+type mockHashMailStreamStore struct {
+	sync.Mutex
+	streams map[streamID]aperturedb.HashMailStream
+}
+
+func newMockHashMailStreamStore() *mockHashMailStreamStore {
+	return &mockHashMailStreamStore{
+		streams: make(map[streamID]aperturedb.HashMailStream),
+	}
+}
+
+func (m *mockHashMailStreamStore) AddStream(_ context.Context, id, auth,
+	creator []byte) error {
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.streams[newStreamID(id)] = aperturedb.HashMailStream{
+		StreamID: id,
+		Auth:     auth,
+		Creator:  creator,
+	}
+	return nil
+}
+
+func (m *mockHashMailStreamStore) ListStreams(
+	_ context.Context) ([]aperturedb.HashMailStream, error) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	streams := make([]aperturedb.HashMailStream, 0, len(m.streams))
+	for _, stream := range m.streams {
+		streams = append(streams, stream)
+	}
+	return streams, nil
+}
+
+func (m *mockHashMailStreamStore) DeleteStream(_ context.Context,
+	id []byte) error {
+
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.streams, newStreamID(id))
+	return nil
 }
 
 // hashMailHarness is a test harness that spins up a hashmail server for
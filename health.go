@@ -0,0 +1,219 @@
+package aperture
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/challenger"
+	"github.com/lightninglabs/aperture/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// healthzPath is the path of the liveness endpoint that reports that
+	// aperture is running.
+	healthzPath = "/healthz"
+
+	// readyzPath is the path of the readiness endpoint that reports
+	// whether aperture is ready to serve paid requests.
+	readyzPath = "/readyz"
+
+	// grpcHealthPrefix is the path prefix of the standard gRPC health
+	// service.
+	grpcHealthPrefix = "/grpc.health.v1.Health/"
+
+	// grpcHealthWatchInterval is the interval in which the serving status
+	// is checked for changes while a client watches it.
+	grpcHealthWatchInterval = time.Second
+)
+
+// newHealthService creates a local service that serves the liveness and
+// readiness endpoints. Neither requires authentication nor contacts any
+// backend service. The liveness endpoint always responds with 200 OK, while
+// the readiness endpoint responds with 503 Service Unavailable until the given
+// challenger, if any, is ready to create challenges and verify invoices. This
+// allows load balancers to hold back traffic during rolling deploys. The
+// endpoints take precedence over all backend services, so a service with a
+// catch-all host or path regexp can't shadow them.
+func newHealthService(c challenger.Challenger) proxy.LocalService {
+	handler := http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(
+				w, http.StatusText(http.StatusMethodNotAllowed),
+				http.StatusMethodNotAllowed,
+			)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+
+		if r.URL.Path == readyzPath && c != nil {
+			if err := challenger.CheckReady(c); err != nil {
+				log.Debugf("Readiness check failed: %v", err)
+				http.Error(
+					w, "not ready: "+err.Error(),
+					http.StatusServiceUnavailable,
+				)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("ok\n"))
+	})
+
+	isHandling := func(r *http.Request) bool {
+		return r.URL.Path == healthzPath || r.URL.Path == readyzPath
+	}
+
+	return proxy.NewPriorityLocalService(handler, isHandling)
+}
+
+// servingStatus is the serving status reported by the gRPC health service.
+type servingStatus = grpc_health_v1.HealthCheckResponse_ServingStatus
+
+const (
+	statusServing    = grpc_health_v1.HealthCheckResponse_SERVING
+	statusNotServing = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	statusUnknown    = grpc_health_v1.HealthCheckResponse_SERVICE_UNKNOWN
+)
+
+// grpcHealthServer implements the standard gRPC health service for aperture as
+// a whole, which is identified by the empty service name. It reports SERVING
+// once the given challenger, if any, is ready and NOT_SERVING as soon as
+// aperture shuts down.
+type grpcHealthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+
+	challenger challenger.Challenger
+
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+// A compile time check to ensure grpcHealthServer implements the health
+// server interface.
+var _ grpc_health_v1.HealthServer = (*grpcHealthServer)(nil)
+
+// newGRPCHealthServer creates a new gRPC health server that reports the
+// readiness of the given challenger.
+func newGRPCHealthServer(c challenger.Challenger) *grpcHealthServer {
+	return &grpcHealthServer{
+		challenger: c,
+		quit:       make(chan struct{}),
+	}
+}
+
+// Shutdown makes the server report NOT_SERVING from now on and ends all
+// running watch streams.
+func (s *grpcHealthServer) Shutdown() {
+	s.quitOnce.Do(func() {
+		close(s.quit)
+	})
+}
+
+// servingStatus returns the current serving status of aperture.
+func (s *grpcHealthServer) servingStatus() servingStatus {
+	select {
+	case <-s.quit:
+		return statusNotServing
+	default:
+	}
+
+	if s.challenger != nil {
+		if err := challenger.CheckReady(s.challenger); err != nil {
+			return statusNotServing
+		}
+	}
+
+	return statusServing
+}
+
+// Check returns the current serving status of aperture.
+//
+// NOTE: This is part of the grpc_health_v1.HealthServer interface.
+func (s *grpcHealthServer) Check(_ context.Context,
+	req *grpc_health_v1.HealthCheckRequest) (
+	*grpc_health_v1.HealthCheckResponse, error) {
+
+	if req.Service != "" {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q",
+			req.Service)
+	}
+
+	return &grpc_health_v1.HealthCheckResponse{
+		Status: s.servingStatus(),
+	}, nil
+}
+
+// Watch sends the current serving status of aperture and every change of it
+// until the client goes away or aperture shuts down.
+//
+// NOTE: This is part of the grpc_health_v1.HealthServer interface.
+func (s *grpcHealthServer) Watch(req *grpc_health_v1.HealthCheckRequest,
+	stream grpc_health_v1.Health_WatchServer) error {
+
+	// Unknown services are reported as such instead of failing the call,
+	// as the service might be registered later on.
+	if req.Service != "" {
+		return stream.Send(&grpc_health_v1.HealthCheckResponse{
+			Status: statusUnknown,
+		})
+	}
+
+	ticker := time.NewTicker(grpcHealthWatchInterval)
+	defer ticker.Stop()
+
+	var lastStatus servingStatus
+	for {
+		current := s.servingStatus()
+		if current != lastStatus {
+			err := stream.Send(&grpc_health_v1.HealthCheckResponse{
+				Status: current,
+			})
+			if err != nil {
+				return err
+			}
+			lastStatus = current
+		}
+
+		select {
+		case <-ticker.C:
+
+		case <-s.quit:
+			// Let the client know we're shutting down before we end
+			// the stream.
+			if lastStatus == statusNotServing {
+				return nil
+			}
+
+			return stream.Send(&grpc_health_v1.HealthCheckResponse{
+				Status: statusNotServing,
+			})
+
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// newGRPCHealthService creates a local service that serves the given gRPC
+// health server. Like the other health endpoints, it doesn't require
+// authentication.
+func newGRPCHealthService(healthServer *grpcHealthServer) proxy.LocalService {
+	grpcServer := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(grpcServer, healthServer)
+
+	return proxy.NewLocalService(grpcServer, func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, grpcHealthPrefix)
+	})
+}
@@ -0,0 +1,170 @@
+package aperture
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/challenger"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// readyChallenger is a challenger that only implements the readiness check.
+type readyChallenger struct {
+	challenger.Challenger
+
+	err error
+}
+
+// Ready returns the configured readiness error.
+func (c *readyChallenger) Ready() error {
+	return c.err
+}
+
+// TestHealthService makes sure the liveness endpoint always succeeds while the
+// readiness endpoint reflects the state of the challenger.
+func TestHealthService(t *testing.T) {
+	c := &readyChallenger{err: errors.New("initial load pending")}
+	svc := newHealthService(c)
+
+	serve := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		require.True(t, svc.IsHandling(req))
+
+		rec := httptest.NewRecorder()
+		svc.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	require.False(t, svc.IsHandling(
+		httptest.NewRequest(http.MethodGet, "/other", nil),
+	))
+
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, healthzPath))
+	require.Equal(
+		t, http.StatusServiceUnavailable,
+		serve(http.MethodGet, readyzPath),
+	)
+	require.Equal(
+		t, http.StatusMethodNotAllowed,
+		serve(http.MethodPost, healthzPath),
+	)
+
+	// Once the challenger is ready, so is aperture.
+	c.err = nil
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, readyzPath))
+	require.Equal(t, http.StatusOK, serve(http.MethodHead, readyzPath))
+
+	// Without a challenger, there's nothing to wait for.
+	svc = newHealthService(nil)
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, readyzPath))
+}
+
+// TestHealthServiceCatchAll makes sure the health endpoints can't be shadowed
+// by a backend service that matches every request.
+func TestHealthServiceCatchAll(t *testing.T) {
+	services := []*proxy.Service{{
+		Name:       "catchall",
+		Address:    "127.0.0.1:10000",
+		HostRegexp: ".*",
+		PathRegexp: ".*",
+		Protocol:   "http",
+		Auth:       "on",
+		Price:      1,
+	}}
+
+	p, err := proxy.NewWithConfig(
+		&proxy.Config{}, auth.NewMockAuthenticator(), services,
+		newHealthService(nil),
+	)
+	require.NoError(t, err)
+
+	serve := func(path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusOK, serve(healthzPath))
+	require.Equal(t, http.StatusOK, serve(readyzPath))
+
+	// Every other request still goes to the catch-all service.
+	require.Equal(t, http.StatusPaymentRequired, serve("/other"))
+}
+
+// TestGRPCHealthService makes sure the gRPC health service can be reached
+// through h2c and reports the readiness of the challenger until aperture shuts
+// down.
+func TestGRPCHealthService(t *testing.T) {
+	c := &readyChallenger{err: errors.New("initial load pending")}
+	healthServer := newGRPCHealthServer(c)
+	svc := newGRPCHealthService(healthServer)
+
+	require.True(t, svc.IsHandling(httptest.NewRequest(
+		http.MethodPost, grpcHealthPrefix+"Check", nil,
+	)))
+	require.False(t, svc.IsHandling(
+		httptest.NewRequest(http.MethodGet, healthzPath, nil),
+	))
+
+	server := httptest.NewServer(newH2CHandler(svc, false))
+	defer server.Close()
+
+	conn, err := grpc.Dial(
+		strings.TrimPrefix(server.URL, "http://"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx := context.Background()
+	client := grpc_health_v1.NewHealthClient(conn)
+	check := func() servingStatus {
+		resp, err := client.Check(
+			ctx, &grpc_health_v1.HealthCheckRequest{},
+		)
+		require.NoError(t, err)
+
+		return resp.Status
+	}
+
+	// Aperture isn't serving until the challenger is ready.
+	require.Equal(t, statusNotServing, check())
+	c.err = nil
+	require.Equal(t, statusServing, check())
+
+	// Other services are unknown.
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{
+		Service: "other",
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// A watching client is told about the shutdown before the stream
+	// ends.
+	stream, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, statusServing, resp.Status)
+
+	healthServer.Shutdown()
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, statusNotServing, resp.Status)
+
+	require.Equal(t, statusNotServing, check())
+}
@@ -18,6 +18,12 @@ var (
 	// caveat with an invalid format.
 	ErrInvalidCaveat = errors.New("caveat must be of the form " +
 		"\"condition=value\"")
+
+	// ErrCaveatWidening is an error returned when a caveat attempts to
+	// widen the access granted by a previous caveat of the same condition.
+	// Caveats of the same condition can only ever narrow access.
+	ErrCaveatWidening = errors.New("caveat widens access granted by " +
+		"previous caveat")
 )
 
 // Caveat is a predicate that can be applied to an L402 in order to restrict its
@@ -120,13 +126,20 @@ func VerifyCaveats(caveats []Caveat, satisfiers ...Satisfier) error {
 
 		// Since it's possible for a chain of caveat to exist for the
 		// same condition as a way to demote privileges, we'll ensure
-		// each one satisfies its previous.
+		// each one satisfies its previous. A satisfier without
+		// SatisfyPrevious places no constraint on the order, see
+		// NewStrictSatisfier to reject such chains instead.
 		for i, j := 0, 1; j < len(caveats); i, j = i+1, j+1 {
+			if satisfier.SatisfyPrevious == nil {
+				break
+			}
+
 			prevCaveat := caveats[i]
 			curCaveat := caveats[j]
 			err := satisfier.SatisfyPrevious(prevCaveat, curCaveat)
 			if err != nil {
-				return err
+				return fmt.Errorf("%w: %v", ErrCaveatWidening,
+					err)
 			}
 		}
 
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/stretchr/testify/require"
 	"gopkg.in/macaroon.v2"
 )
 
@@ -182,6 +183,39 @@ func TestVerifyCaveats(t *testing.T) {
 			},
 			shouldFail: true,
 		},
+		{
+			name:    "chain without prev check",
+			caveats: []Caveat{caveat1, caveat1},
+			satisfiers: []Satisfier{
+				{
+					Condition:    caveat1.Condition,
+					SatisfyFinal: satisfier.SatisfyFinal,
+				},
+			},
+			shouldFail: false,
+		},
+		{
+			name:    "strict chain without prev check",
+			caveats: []Caveat{caveat1, caveat1},
+			satisfiers: []Satisfier{
+				NewStrictSatisfier(Satisfier{
+					Condition:    caveat1.Condition,
+					SatisfyFinal: satisfier.SatisfyFinal,
+				}),
+			},
+			shouldFail: true,
+		},
+		{
+			name:    "strict single caveat without prev check",
+			caveats: []Caveat{caveat1},
+			satisfiers: []Satisfier{
+				NewStrictSatisfier(Satisfier{
+					Condition:    caveat1.Condition,
+					SatisfyFinal: satisfier.SatisfyFinal,
+				}),
+			},
+			shouldFail: false,
+		},
 	}
 
 	for _, test := range tests {
@@ -200,3 +234,97 @@ func TestVerifyCaveats(t *testing.T) {
 		}
 	}
 }
+
+// TestVerifyCaveatsWidening ensures that a later services caveat can only
+// narrow the access granted by a previous one, never widen it.
+func TestVerifyCaveatsWidening(t *testing.T) {
+	t.Parallel()
+
+	servicesCaveat := func(services ...Service) Caveat {
+		caveat, err := NewServicesCaveat(services...)
+		require.NoError(t, err)
+		return caveat
+	}
+
+	var (
+		a        = Service{Name: "a", Tier: BaseTier}
+		b        = Service{Name: "b", Tier: BaseTier}
+		aPremium = Service{Name: "a", Tier: BaseTier + 1}
+	)
+
+	tests := []struct {
+		name    string
+		caveats []Caveat
+		target  string
+		err     error
+	}{
+		{
+			name: "narrowing",
+			caveats: []Caveat{
+				servicesCaveat(a, b), servicesCaveat(a),
+			},
+			target: "a",
+		},
+		{
+			name: "narrowing denies removed service",
+			caveats: []Caveat{
+				servicesCaveat(a, b), servicesCaveat(a),
+			},
+			target: "b",
+			err:    errors.New("target service b not authorized"),
+		},
+		{
+			name: "widening with new service",
+			caveats: []Caveat{
+				servicesCaveat(a), servicesCaveat(a, b),
+			},
+			target: "b",
+			err:    ErrCaveatWidening,
+		},
+		{
+			name: "widening after narrowing",
+			caveats: []Caveat{
+				servicesCaveat(a, b), servicesCaveat(a),
+				servicesCaveat(a, b),
+			},
+			target: "a",
+			err:    ErrCaveatWidening,
+		},
+		{
+			name: "widening tier",
+			caveats: []Caveat{
+				servicesCaveat(a), servicesCaveat(aPremium),
+			},
+			target: "a",
+			err:    ErrCaveatWidening,
+		},
+		{
+			name: "narrowing tier",
+			caveats: []Caveat{
+				servicesCaveat(aPremium), servicesCaveat(a),
+			},
+			target: "a",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := VerifyCaveats(
+				test.caveats, NewServicesSatisfier(test.target),
+			)
+			switch {
+			case test.err == nil:
+				require.NoError(t, err)
+
+			case errors.Is(test.err, ErrCaveatWidening):
+				require.ErrorIs(t, err, ErrCaveatWidening)
+
+			default:
+				require.EqualError(t, err, test.err.Error())
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"strings"
 
 	"github.com/lightningnetwork/lnd/lntypes"
 	"gopkg.in/macaroon.v2"
@@ -24,14 +25,77 @@ const (
 	// HeaderMacaroon is the HTTP header field name that is used to send the
 	// L402 by our own gRPC clients.
 	HeaderMacaroon = "Macaroon"
+
+	// HeaderDischarge is the HTTP header field name that is used to send
+	// the base64 encoded discharge macaroons of the third-party caveats of
+	// an L402. Several discharges can be sent in separate fields or
+	// separated by commas.
+	HeaderDischarge = "L402-Discharge"
 )
 
 var (
-	authRegex        = regexp.MustCompile("(LSAT|L402) (.*?):([a-f0-9]{64})")
+	// ErrInvalidPreimage is an error returned when the preimage of an L402
+	// is not a hex encoded 32 byte value.
+	ErrInvalidPreimage = errors.New("invalid preimage")
+
+	// ErrConflictingAuthHeaders is an error returned when a client sends
+	// both an LSAT and an L402 authorization header with different
+	// credentials and the DualHeaderRequireMatch policy is used.
+	ErrConflictingAuthHeaders = errors.New("conflicting LSAT and L402 " +
+		"auth headers")
+
+	authRegex        = regexp.MustCompile("(LSAT|L402) (.*?):([^:]*)$")
 	authFormatLegacy = "LSAT %s:%s"
 	authFormat       = "L402 %s:%s"
 )
 
+// DualHeaderPolicy defines how the credentials are chosen if a client sends
+// both an LSAT and an L402 authorization header, as clients do during the
+// migration from the LSAT to the L402 scheme.
+type DualHeaderPolicy string
+
+const (
+	// DualHeaderPreferL402 uses the credentials of the L402 header and
+	// ignores the LSAT header. This is the default.
+	DualHeaderPreferL402 DualHeaderPolicy = "preferl402"
+
+	// DualHeaderRequireMatch requires the credentials of both headers to
+	// be identical and rejects the request otherwise.
+	DualHeaderRequireMatch DualHeaderPolicy = "requirematch"
+)
+
+// resolveAuthMatches picks the regular expression matches of the authorization
+// header value to use according to the given policy. Either of the matches may
+// be nil if the client didn't send a valid header of that scheme.
+func resolveAuthMatches(lsatMatches, l402Matches []string,
+	policy DualHeaderPolicy) ([]string, error) {
+
+	switch {
+	case l402Matches == nil:
+		return lsatMatches, nil
+
+	case lsatMatches == nil:
+		return l402Matches, nil
+	}
+
+	switch policy {
+	case "", DualHeaderPreferL402:
+		return l402Matches, nil
+
+	case DualHeaderRequireMatch:
+		if lsatMatches[2] != l402Matches[2] ||
+			lsatMatches[3] != l402Matches[3] {
+
+			return nil, ErrConflictingAuthHeaders
+		}
+
+		return l402Matches, nil
+
+	default:
+		return nil, fmt.Errorf("unknown dual header policy %s", policy)
+	}
+}
+
 // FromHeader tries to extract authentication information from HTTP headers.
 // There are two supported formats that can be sent in four different header
 // fields:
@@ -41,27 +105,52 @@ var (
 //  3. Macaroon: <macHex>
 //
 // If only the macaroon is sent in header 2 or three then it is expected to have
-// a caveat with the preimage attached to it.
+// a caveat with the preimage attached to it. If both header 0 and 1 are sent,
+// the L402 header is used.
 func FromHeader(header *http.Header) (*macaroon.Macaroon, lntypes.Preimage, error) {
+	return FromHeaderWithPolicy(header, DualHeaderPreferL402)
+}
+
+// FromHeaderWithPolicy tries to extract authentication information from HTTP
+// headers like FromHeader, using the given policy to resolve the credentials if
+// both an LSAT and an L402 Authorization header are sent.
+func FromHeaderWithPolicy(header *http.Header,
+	policy DualHeaderPolicy) (*macaroon.Macaroon, lntypes.Preimage, error) {
+
 	var authHeader string
 
 	switch {
 	// Header field 1 contains the macaroon and the preimage as distinct
 	// values separated by a colon.
 	case header.Get(HeaderAuthorization) != "":
-		// Parse the content of the header field and check that it is in
-		// the correct format.
-		var matches []string
+		// Parse the content of the header fields and check that they
+		// are in the correct format. We remember the first valid value
+		// of each scheme.
+		var lsatMatches, l402Matches []string
 		authHeaders := header.Values(HeaderAuthorization)
 		for _, authHeader := range authHeaders {
 			log.Debugf("Trying to authorize with header value "+
 				"[%s].", authHeader)
-			matches = authRegex.FindStringSubmatch(authHeader)
+			matches := authRegex.FindStringSubmatch(authHeader)
 			if len(matches) != 4 {
 				continue
 			}
+
+			switch {
+			case matches[1] == "LSAT" && lsatMatches == nil:
+				lsatMatches = matches
+
+			case matches[1] == "L402" && l402Matches == nil:
+				l402Matches = matches
+			}
 		}
 
+		matches, err := resolveAuthMatches(
+			lsatMatches, l402Matches, policy,
+		)
+		if err != nil {
+			return nil, lntypes.Preimage{}, err
+		}
 		if len(matches) != 4 {
 			return nil, lntypes.Preimage{}, fmt.Errorf("invalid "+
 				"auth header format: %s", authHeader)
@@ -82,8 +171,9 @@ func FromHeader(header *http.Header) (*macaroon.Macaroon, lntypes.Preimage, erro
 		}
 		preimage, err := lntypes.MakePreimageFromStr(preimageHex)
 		if err != nil {
-			return nil, lntypes.Preimage{}, fmt.Errorf("hex "+
-				"decode of preimage failed: %v", err)
+			return nil, lntypes.Preimage{}, fmt.Errorf("%w: hex "+
+				"decode of preimage failed: %v",
+				ErrInvalidPreimage, err)
 		}
 
 		// All done, we don't need to extract anything from the
@@ -123,8 +213,8 @@ func FromHeader(header *http.Header) (*macaroon.Macaroon, lntypes.Preimage, erro
 	}
 	preimage, err := lntypes.MakePreimageFromStr(preimageHex)
 	if err != nil {
-		return nil, lntypes.Preimage{}, fmt.Errorf("hex decode of "+
-			"preimage failed: %v", err)
+		return nil, lntypes.Preimage{}, fmt.Errorf("%w: hex decode "+
+			"of preimage failed: %v", ErrInvalidPreimage, err)
 	}
 
 	return mac, preimage, nil
@@ -153,3 +243,52 @@ func SetHeader(header *http.Header, mac *macaroon.Macaroon,
 
 	return nil
 }
+
+// DischargesFromHeader extracts the discharge macaroons of third-party caveats
+// from the given HTTP header. The discharges must already be bound to the
+// L402 they discharge the caveats of.
+func DischargesFromHeader(header *http.Header) ([]*macaroon.Macaroon, error) {
+	var discharges []*macaroon.Macaroon
+	for _, value := range header.Values(HeaderDischarge) {
+		for _, encoded := range strings.Split(value, ",") {
+			encoded = strings.TrimSpace(encoded)
+			if encoded == "" {
+				continue
+			}
+
+			dmBytes, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, fmt.Errorf("base64 decode of "+
+					"discharge macaroon failed: %v", err)
+			}
+			dm := &macaroon.Macaroon{}
+			if err := dm.UnmarshalBinary(dmBytes); err != nil {
+				return nil, fmt.Errorf("unable to unmarshal "+
+					"discharge macaroon: %v", err)
+			}
+			discharges = append(discharges, dm)
+		}
+	}
+
+	return discharges, nil
+}
+
+// SetDischargeHeader binds the given discharge macaroons to the L402 macaroon
+// and adds them to the HTTP header.
+func SetDischargeHeader(header *http.Header, mac *macaroon.Macaroon,
+	discharges ...*macaroon.Macaroon) error {
+
+	for _, dm := range discharges {
+		bound := dm.Clone()
+		bound.Bind(mac.Signature())
+
+		dmBytes, err := bound.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		encoded := base64.StdEncoding.EncodeToString(dmBytes)
+		header.Add(HeaderDischarge, encoded)
+	}
+
+	return nil
+}
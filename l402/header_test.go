@@ -0,0 +1,237 @@
+package l402
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+// TestFromHeaderInvalidPreimage makes sure a preimage that isn't exactly 32
+// bytes is rejected with ErrInvalidPreimage.
+func TestFromHeaderInvalidPreimage(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		preimage string
+		err      error
+	}{{
+		name:     "valid preimage",
+		preimage: hex.EncodeToString(make([]byte, 32)),
+	}, {
+		name:     "too short",
+		preimage: hex.EncodeToString(make([]byte, 31)),
+		err:      ErrInvalidPreimage,
+	}, {
+		name:     "too long",
+		preimage: hex.EncodeToString(make([]byte, 33)),
+		err:      ErrInvalidPreimage,
+	}, {
+		name:     "not hex",
+		preimage: "zz",
+		err:      ErrInvalidPreimage,
+	}, {
+		name:     "not hex with valid prefix",
+		preimage: hex.EncodeToString(make([]byte, 32)) + "zz",
+		err:      ErrInvalidPreimage,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mac, err := macaroon.New(
+				make([]byte, SecretSize), []byte("id"), "lsat",
+				macaroon.LatestVersion,
+			)
+			require.NoError(t, err)
+			require.NoError(t, AddFirstPartyCaveats(
+				mac, NewCaveat(PreimageKey, tc.preimage),
+			))
+
+			macBytes, err := mac.MarshalBinary()
+			require.NoError(t, err)
+
+			header := http.Header{}
+			header.Set(HeaderMacaroon, hex.EncodeToString(macBytes))
+
+			// The preimage is checked the same way if it's sent
+			// in the Authorization header.
+			authHeader := http.Header{}
+			authHeader.Set(HeaderAuthorization, fmt.Sprintf(
+				"L402 %s:%s",
+				base64.StdEncoding.EncodeToString(macBytes),
+				tc.preimage,
+			))
+
+			for _, h := range []http.Header{header, authHeader} {
+				_, _, err = FromHeader(&h)
+				if tc.err == nil {
+					require.NoError(t, err)
+					continue
+				}
+				require.ErrorIs(t, err, tc.err)
+			}
+		})
+	}
+}
+
+// TestFromHeaderDualHeaders makes sure the configured policy is applied when a
+// client sends both an LSAT and an L402 Authorization header.
+func TestFromHeaderDualHeaders(t *testing.T) {
+	t.Parallel()
+
+	newAuthValue := func(scheme, id string, preimage byte) (string,
+		lntypes.Preimage) {
+
+		mac, err := macaroon.New(
+			make([]byte, SecretSize), []byte(id), "lsat",
+			macaroon.LatestVersion,
+		)
+		require.NoError(t, err)
+
+		macBytes, err := mac.MarshalBinary()
+		require.NoError(t, err)
+
+		var p lntypes.Preimage
+		p[0] = preimage
+
+		return fmt.Sprintf(
+			"%s %s:%s", scheme,
+			base64.StdEncoding.EncodeToString(macBytes), p,
+		), p
+	}
+
+	lsatValue, preimage := newAuthValue("LSAT", "id", 1)
+	l402Value, _ := newAuthValue("L402", "id", 1)
+	otherL402Value, otherPreimage := newAuthValue("L402", "other", 2)
+
+	testCases := []struct {
+		name     string
+		values   []string
+		policy   DualHeaderPolicy
+		preimage lntypes.Preimage
+		macID    string
+		err      error
+	}{{
+		name:     "matching, prefer l402",
+		values:   []string{lsatValue, l402Value},
+		policy:   DualHeaderPreferL402,
+		preimage: preimage,
+		macID:    "id",
+	}, {
+		name:     "matching, require match",
+		values:   []string{lsatValue, l402Value},
+		policy:   DualHeaderRequireMatch,
+		preimage: preimage,
+		macID:    "id",
+	}, {
+		name:     "conflicting, prefer l402",
+		values:   []string{lsatValue, otherL402Value},
+		policy:   DualHeaderPreferL402,
+		preimage: otherPreimage,
+		macID:    "other",
+	}, {
+		name:     "conflicting, l402 first, prefer l402",
+		values:   []string{otherL402Value, lsatValue},
+		policy:   DualHeaderPreferL402,
+		preimage: otherPreimage,
+		macID:    "other",
+	}, {
+		name:   "conflicting, require match",
+		values: []string{lsatValue, otherL402Value},
+		policy: DualHeaderRequireMatch,
+		err:    ErrConflictingAuthHeaders,
+	}, {
+		name:     "lsat only, require match",
+		values:   []string{lsatValue},
+		policy:   DualHeaderRequireMatch,
+		preimage: preimage,
+		macID:    "id",
+	}, {
+		name:     "invalid l402, prefer l402",
+		values:   []string{lsatValue, "L402 foo"},
+		policy:   DualHeaderPreferL402,
+		preimage: preimage,
+		macID:    "id",
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			header := http.Header{
+				HeaderAuthorization: tc.values,
+			}
+			mac, p, err := FromHeaderWithPolicy(&header, tc.policy)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.preimage, p)
+			require.Equal(t, tc.macID, string(mac.Id()))
+		})
+	}
+}
+
+// TestDischargeHeader makes sure discharge macaroons are bound to the L402 and
+// can be read back from separate or comma separated header fields.
+func TestDischargeHeader(t *testing.T) {
+	t.Parallel()
+
+	newMac := func(id string) *macaroon.Macaroon {
+		mac, err := macaroon.New(
+			[]byte("key"), []byte(id), "loc",
+			macaroon.LatestVersion,
+		)
+		require.NoError(t, err)
+
+		return mac
+	}
+	mac := newMac("l402")
+	dm1, dm2 := newMac("discharge1"), newMac("discharge2")
+
+	header := http.Header{}
+	require.NoError(t, SetDischargeHeader(&header, mac, dm1, dm2))
+	require.Len(t, header.Values(HeaderDischarge), 2)
+
+	discharges, err := DischargesFromHeader(&header)
+	require.NoError(t, err)
+	require.Len(t, discharges, 2)
+	require.Equal(t, dm1.Id(), discharges[0].Id())
+	require.Equal(t, dm2.Id(), discharges[1].Id())
+
+	// The discharges were bound to the L402, not sent as they are.
+	require.NotEqual(t, dm1.Signature(), discharges[0].Signature())
+
+	// Both discharges can be sent in a single field as well.
+	header.Set(HeaderDischarge, fmt.Sprintf(
+		"%s, %s", header.Values(HeaderDischarge)[0],
+		header.Values(HeaderDischarge)[1],
+	))
+	discharges, err = DischargesFromHeader(&header)
+	require.NoError(t, err)
+	require.Len(t, discharges, 2)
+
+	// Without the header field, there are no discharges.
+	discharges, err = DischargesFromHeader(&http.Header{})
+	require.NoError(t, err)
+	require.Empty(t, discharges)
+
+	// Invalid discharges are rejected.
+	header.Set(HeaderDischarge, base64.StdEncoding.EncodeToString(
+		[]byte("invalid"),
+	))
+	_, err = DischargesFromHeader(&header)
+	require.Error(t, err)
+}
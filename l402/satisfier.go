@@ -29,6 +29,24 @@ type Satisfier struct {
 	SatisfyFinal func(Caveat) error
 }
 
+// NewStrictSatisfier returns a copy of the given satisfier that rejects chains
+// of multiple caveats of its condition if it doesn't know how to compare them
+// through SatisfyPrevious. Without such a comparison, a later caveat could
+// widen the access granted by a previous one.
+func NewStrictSatisfier(satisfier Satisfier) Satisfier {
+	if satisfier.SatisfyPrevious != nil {
+		return satisfier
+	}
+
+	condition := satisfier.Condition
+	satisfier.SatisfyPrevious = func(_, _ Caveat) error {
+		return fmt.Errorf("unable to verify chain of %v caveats",
+			condition)
+	}
+
+	return satisfier
+}
+
 // NewServicesSatisfier implements a satisfier to determine whether the target
 // service is authorized for a given L402.
 //
@@ -43,22 +61,32 @@ func NewServicesSatisfier(targetService string) Satisfier {
 			if err != nil {
 				return err
 			}
-			prevAllowed := make(map[string]struct{}, len(prevServices))
+			prevAllowed := make(
+				map[string]ServiceTier, len(prevServices),
+			)
 			for _, service := range prevServices {
-				prevAllowed[service.Name] = struct{}{}
+				prevAllowed[service.Name] = service.Tier
 			}
 
 			// The caveat should not include any new services that
-			// weren't previously allowed.
+			// weren't previously allowed, nor a higher tier of a
+			// service than previously allowed.
 			currentServices, err := decodeServicesCaveatValue(cur.Value)
 			if err != nil {
 				return err
 			}
 			for _, service := range currentServices {
-				if _, ok := prevAllowed[service.Name]; !ok {
+				prevTier, ok := prevAllowed[service.Name]
+				if !ok {
 					return fmt.Errorf("service %v not "+
 						"previously allowed", service)
 				}
+				if service.Tier > prevTier {
+					return fmt.Errorf("tier %d of service "+
+						"%v exceeds previously allowed "+
+						"tier %d", service.Tier,
+						service.Name, prevTier)
+				}
 			}
 
 			return nil
@@ -120,6 +148,125 @@ func NewCapabilitiesSatisfier(service string,
 	}
 }
 
+// NewMethodSatisfier implements a satisfier to determine whether the HTTP
+// method of a request to a service is authorized for a given L402. Each
+// subsequent caveat of the same condition may only allow a subset of the
+// methods. Methods are compared case-insensitively.
+func NewMethodSatisfier(service string, targetMethod string) Satisfier {
+	return Satisfier{
+		Condition: service + CondMethodsSuffix,
+		SatisfyPrevious: func(prev, cur Caveat) error {
+			allowed := make(map[string]struct{})
+			for _, method := range splitMethods(prev.Value) {
+				allowed[method] = struct{}{}
+			}
+
+			// The caveat should not include any new methods that
+			// weren't previously allowed.
+			for _, method := range splitMethods(cur.Value) {
+				if _, ok := allowed[method]; !ok {
+					return fmt.Errorf("method %v not "+
+						"previously allowed", method)
+				}
+			}
+
+			return nil
+		},
+		SatisfyFinal: func(c Caveat) error {
+			for _, method := range splitMethods(c.Value) {
+				if strings.EqualFold(method, targetMethod) {
+					return nil
+				}
+			}
+
+			return fmt.Errorf("method %v not authorized",
+				targetMethod)
+		},
+	}
+}
+
+// splitMethods splits the value of a methods caveat into its upper case
+// methods.
+func splitMethods(value string) []string {
+	methods := strings.Split(value, ",")
+	for i, method := range methods {
+		methods[i] = strings.ToUpper(strings.TrimSpace(method))
+	}
+
+	return methods
+}
+
+// NewDowngradeSatisfier implements a satisfier to determine whether the target
+// capability for a service is still authorized for a given L402 once its
+// capabilities have been downgraded. Before the downgrade time is reached, the
+// caveat does not restrict access. Afterwards, only the base capabilities
+// listed in the caveat are authorized. Each subsequent caveat of the same
+// condition may only downgrade earlier and to a subset of the capabilities.
+func NewDowngradeSatisfier(service string, targetCapability string,
+	now func() time.Time) Satisfier {
+
+	return Satisfier{
+		Condition: service + CondDowngradeSuffix,
+		SatisfyPrevious: func(prev, cur Caveat) error {
+			prevTime, prevCapabilities, err :=
+				decodeDowngradeCaveatValue(prev.Value)
+			if err != nil {
+				return err
+			}
+			curTime, curCapabilities, err :=
+				decodeDowngradeCaveatValue(cur.Value)
+			if err != nil {
+				return err
+			}
+
+			// A later downgrade would make the L402 more
+			// permissive.
+			if curTime.After(prevTime) {
+				return fmt.Errorf("%s caveat violates "+
+					"increasing restrictiveness",
+					service+CondDowngradeSuffix)
+			}
+
+			// The caveat should not include any base capabilities
+			// that weren't previously allowed.
+			allowed := make(map[string]struct{}, len(prevCapabilities))
+			for _, capability := range prevCapabilities {
+				allowed[capability] = struct{}{}
+			}
+			for _, capability := range curCapabilities {
+				if _, ok := allowed[capability]; !ok {
+					return fmt.Errorf("capability %v not "+
+						"previously allowed", capability)
+				}
+			}
+
+			return nil
+		},
+		SatisfyFinal: func(c Caveat) error {
+			downgradeTime, capabilities, err :=
+				decodeDowngradeCaveatValue(c.Value)
+			if err != nil {
+				return err
+			}
+
+			// Until the downgrade happens, all capabilities remain
+			// available.
+			if now().Before(downgradeTime) {
+				return nil
+			}
+
+			for _, capability := range capabilities {
+				if capability == targetCapability {
+					return nil
+				}
+			}
+
+			return fmt.Errorf("target capability %v not "+
+				"authorized after downgrade", targetCapability)
+		},
+	}
+}
+
 // NewTimeoutSatisfier checks if an L402 is expired or not. The Satisfier takes
 // a service name to set as the condition prefix and currentTimestamp to
 // compare against the expiration(s) in the caveats. The expiration time is
@@ -178,3 +325,29 @@ func NewTimeoutSatisfier(service string, now func() time.Time) Satisfier {
 		},
 	}
 }
+
+// NewLabelSatisfier implements a satisfier for the label caveat of the given
+// service. The label doesn't restrict access, so the satisfier only makes sure
+// it is set and that it isn't changed by a subsequent caveat.
+func NewLabelSatisfier(service string) Satisfier {
+	return Satisfier{
+		Condition: service + CondLabelSuffix,
+		SatisfyPrevious: func(prev, cur Caveat) error {
+			if prev.Value != cur.Value {
+				return fmt.Errorf("%s caveat changes label %q "+
+					"to %q", service+CondLabelSuffix,
+					prev.Value, cur.Value)
+			}
+
+			return nil
+		},
+		SatisfyFinal: func(c Caveat) error {
+			if c.Value == "" {
+				return fmt.Errorf("%s caveat has empty label",
+					service+CondLabelSuffix)
+			}
+
+			return nil
+		},
+	}
+}
@@ -85,3 +85,92 @@ func TestTimeoutSatisfier(t *testing.T) {
 		})
 	}
 }
+
+// TestDowngradeSatisfier tests that the downgrade satisfier authorizes premium
+// capabilities before the downgrade and only the base ones afterwards.
+func TestDowngradeSatisfier(t *testing.T) {
+	t.Parallel()
+
+	var (
+		service     = "promo"
+		currentTime = time.Unix(1000, 0)
+		now         = func() time.Time {
+			return currentTime
+		}
+		caveat = NewDowngradeCaveat(service, 100, "base", now)
+	)
+
+	premium := NewDowngradeSatisfier(service, "premium", now)
+	base := NewDowngradeSatisfier(service, "base", now)
+
+	// Before the downgrade, both capabilities are authorized.
+	require.NoError(t, premium.SatisfyFinal(caveat))
+	require.NoError(t, base.SatisfyFinal(caveat))
+
+	// After the downgrade, only the base capability is.
+	currentTime = currentTime.Add(101 * time.Second)
+	require.Error(t, premium.SatisfyFinal(caveat))
+	require.NoError(t, base.SatisfyFinal(caveat))
+
+	// A subsequent caveat may only downgrade earlier and to fewer
+	// capabilities.
+	earlier := NewCaveat(caveat.Condition, "1050:base")
+	later := NewCaveat(caveat.Condition, "2000:base")
+	wider := NewCaveat(caveat.Condition, "1050:base,premium")
+	require.NoError(t, premium.SatisfyPrevious(caveat, earlier))
+	require.Error(t, premium.SatisfyPrevious(caveat, later))
+	require.Error(t, premium.SatisfyPrevious(caveat, wider))
+
+	// Malformed values are rejected.
+	invalid := NewCaveat(caveat.Condition, "base")
+	require.ErrorIs(t, premium.SatisfyFinal(invalid), ErrInvalidDowngrade)
+}
+
+// TestLabelSatisfier tests that the label satisfier only requires the label to
+// be set and not to change.
+func TestLabelSatisfier(t *testing.T) {
+	t.Parallel()
+
+	caveat := NewLabelCaveat("loop", "campaign-1")
+	satisfier := NewLabelSatisfier("loop")
+	require.Equal(t, "loop_label", satisfier.Condition)
+
+	require.NoError(t, satisfier.SatisfyFinal(caveat))
+	require.Error(t, satisfier.SatisfyFinal(NewLabelCaveat("loop", "")))
+
+	// The label can be repeated but not changed.
+	require.NoError(t, satisfier.SatisfyPrevious(caveat, caveat))
+	require.Error(t, satisfier.SatisfyPrevious(
+		caveat, NewLabelCaveat("loop", "campaign-2"),
+	))
+}
+
+// TestMethodSatisfier tests that the method satisfier only authorizes the
+// methods of the caveat and that subsequent caveats can only narrow them down.
+func TestMethodSatisfier(t *testing.T) {
+	t.Parallel()
+
+	caveat := NewMethodCaveat("loop", "get", "HEAD")
+	require.Equal(t, "loop_methods", caveat.Condition)
+	require.Equal(t, "GET,HEAD", caveat.Value)
+
+	get := NewMethodSatisfier("loop", "GET")
+	require.Equal(t, "loop_methods", get.Condition)
+	require.NoError(t, get.SatisfyFinal(caveat))
+	require.NoError(t, NewMethodSatisfier("loop", "head").SatisfyFinal(
+		caveat,
+	))
+	require.Error(t, NewMethodSatisfier("loop", "POST").SatisfyFinal(
+		caveat,
+	))
+
+	// Without a known method, no methods caveat is satisfied.
+	require.Error(t, NewMethodSatisfier("loop", "").SatisfyFinal(caveat))
+
+	// The methods can be narrowed down but not widened.
+	readOnly := NewMethodCaveat("loop", "GET")
+	require.NoError(t, get.SatisfyPrevious(caveat, readOnly))
+	require.Error(t, get.SatisfyPrevious(
+		readOnly, NewMethodCaveat("loop", "GET", "POST"),
+	))
+}
@@ -20,6 +20,23 @@ const (
 	// CondTimeoutSuffix is the condition suffix used for a service's
 	// timeout caveat.
 	CondTimeoutSuffix = "_valid_until"
+
+	// CondDowngradeSuffix is the condition suffix used for a service's
+	// capability downgrade caveat. Its value is of the form
+	// "<unix timestamp>:<capabilities>" and restricts the capabilities of
+	// the service to the given ones once the timestamp has passed.
+	CondDowngradeSuffix = "_downgrade_at"
+
+	// CondLabelSuffix is the condition suffix used for a service's label
+	// caveat. Its value is an operator-defined label, such as a product or
+	// campaign ID, that allows grouping the issued L402s. It doesn't
+	// restrict access by itself.
+	CondLabelSuffix = "_label"
+
+	// CondMethodsSuffix is the condition suffix used for a service's
+	// methods caveat. Its value is a comma separated list of the HTTP
+	// methods, such as "GET,HEAD", the L402 may be used with.
+	CondMethodsSuffix = "_methods"
 )
 
 var (
@@ -31,6 +48,11 @@ var (
 	// service with an invalid format.
 	ErrInvalidService = errors.New("service must be of the form " +
 		"\"name:tier\"")
+
+	// ErrInvalidDowngrade is an error returned when we attempt to decode a
+	// downgrade caveat value with an invalid format.
+	ErrInvalidDowngrade = errors.New("downgrade must be of the form " +
+		"\"timestamp:capabilities\"")
 )
 
 // ServiceTier represents the different possible tiers of an L402-enabled
@@ -92,6 +114,17 @@ func encodeServicesCaveatValue(services ...Service) (string, error) {
 	return s.String(), nil
 }
 
+// DecodeServicesCaveat decodes the list of services of the given services
+// caveat.
+func DecodeServicesCaveat(c Caveat) ([]Service, error) {
+	if c.Condition != CondServices {
+		return nil, fmt.Errorf("caveat with condition %s is not a "+
+			"services caveat", c.Condition)
+	}
+
+	return decodeServicesCaveatValue(c.Value)
+}
+
 // decodeServicesCaveatValue decodes a list of services from the expected format
 // of a services caveat's value.
 func decodeServicesCaveatValue(s string) ([]Service, error) {
@@ -135,6 +168,29 @@ func NewCapabilitiesCaveat(serviceName string, capabilities string) Caveat {
 	}
 }
 
+// NewLabelCaveat creates a new caveat that tags an L402 for the given service
+// with the given label.
+func NewLabelCaveat(serviceName string, label string) Caveat {
+	return Caveat{
+		Condition: serviceName + CondLabelSuffix,
+		Value:     label,
+	}
+}
+
+// NewMethodCaveat creates a new caveat that restricts an L402 for the given
+// service to requests with one of the given HTTP methods.
+func NewMethodCaveat(serviceName string, methods ...string) Caveat {
+	normalized := make([]string, 0, len(methods))
+	for _, method := range methods {
+		normalized = append(normalized, strings.ToUpper(method))
+	}
+
+	return Caveat{
+		Condition: serviceName + CondMethodsSuffix,
+		Value:     strings.Join(normalized, ","),
+	}
+}
+
 // NewTimeoutCaveat creates a new caveat that will result in a macaroon being
 // valid for numSeconds after the current time.
 func NewTimeoutCaveat(serviceName string, numSeconds int64,
@@ -150,3 +206,45 @@ func NewTimeoutCaveat(serviceName string, numSeconds int64,
 		Value:     strconv.FormatInt(requestTimeout.Unix(), 10),
 	}
 }
+
+// NewDowngradeCaveat creates a new caveat that restricts the capabilities of
+// the given service to the base capabilities numSeconds after the current
+// time. Until then, the capabilities are only limited by the regular
+// capabilities caveat.
+func NewDowngradeCaveat(serviceName string, numSeconds int64,
+	baseCapabilities string, now func() time.Time) Caveat {
+
+	var (
+		downgradeDelay = time.Duration(numSeconds) * time.Second
+		downgradeTime  = now().Add(downgradeDelay)
+	)
+
+	return Caveat{
+		Condition: serviceName + CondDowngradeSuffix,
+		Value: fmt.Sprintf(
+			"%d:%s", downgradeTime.Unix(), baseCapabilities,
+		),
+	}
+}
+
+// decodeDowngradeCaveatValue decodes the downgrade time and base capabilities
+// from the expected format of a downgrade caveat's value.
+func decodeDowngradeCaveatValue(s string) (time.Time, []string, error) {
+	timestampStr, capabilitiesStr, ok := strings.Cut(s, ":")
+	if !ok {
+		return time.Time{}, nil, ErrInvalidDowngrade
+	}
+
+	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+	if err != nil {
+		return time.Time{}, nil, fmt.Errorf("%w: %v",
+			ErrInvalidDowngrade, err)
+	}
+
+	var capabilities []string
+	if capabilitiesStr != "" {
+		capabilities = strings.Split(capabilitiesStr, ",")
+	}
+
+	return time.Unix(timestamp, 0), capabilities, nil
+}
@@ -0,0 +1,101 @@
+package l402
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
+)
+
+// VerifyPreimage checks that the given preimage belongs to the payment hash of
+// the identifier of the given L402 macaroon. This is a quick check that
+// doesn't require the secret the macaroon was minted with.
+func VerifyPreimage(mac *macaroon.Macaroon, preimage lntypes.Preimage) error {
+	id, err := DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return err
+	}
+	if preimage.Hash() != id.PaymentHash {
+		return fmt.Errorf("invalid preimage %v for %v", preimage,
+			id.PaymentHash)
+	}
+
+	return nil
+}
+
+// VerifyMacaroon verifies that the given L402 macaroon without third-party
+// caveats, together with its preimage, authorizes access to the target
+// service. See VerifyMacaroonWithDischarges for the checks that are done.
+func VerifyMacaroon(mac *macaroon.Macaroon, preimage lntypes.Preimage,
+	secret [32]byte, targetService string, now func() time.Time,
+	satisfiers ...Satisfier) error {
+
+	return VerifyMacaroonWithDischarges(
+		mac, nil, preimage, secret, targetService, now, satisfiers...,
+	)
+}
+
+// VerifyMacaroonWithDischarges verifies that the given L402 macaroon, together
+// with its preimage and the discharge macaroons of its third-party caveats,
+// authorizes access to the target service. The preimage must belong to the
+// payment hash of the macaroon's identifier and the macaroon must have been
+// signed with the given secret. Its first-party caveats are then verified with
+// the satisfiers for the services, timeout and label caveats of the target
+// service, as well as the given satisfiers. The built-in satisfiers take
+// precedence over given ones of the same condition, and of the given ones, the
+// last one of a condition is used. This allows L402s to be verified without a
+// full mint, given the secret was looked up in advance.
+func VerifyMacaroonWithDischarges(mac *macaroon.Macaroon,
+	discharges []*macaroon.Macaroon, preimage lntypes.Preimage,
+	secret [32]byte, targetService string, now func() time.Time,
+	satisfiers ...Satisfier) error {
+
+	if err := VerifyPreimage(mac, preimage); err != nil {
+		return err
+	}
+
+	return VerifyMacaroonWithoutPreimage(
+		mac, discharges, secret, targetService, now, satisfiers...,
+	)
+}
+
+// VerifyMacaroonWithoutPreimage verifies the given L402 macaroon like
+// VerifyMacaroonWithDischarges, but without its preimage. This is only safe if
+// the payment of the L402 is proven otherwise, e.g. by looking up the state of
+// the invoice of its payment hash, as is done for hold invoices whose preimage
+// the payer only learns once the invoice is settled.
+func VerifyMacaroonWithoutPreimage(mac *macaroon.Macaroon,
+	discharges []*macaroon.Macaroon, secret [32]byte, targetService string,
+	now func() time.Time, satisfiers ...Satisfier) error {
+
+	rawCaveats, err := mac.VerifySignature(secret[:], discharges)
+	if err != nil {
+		return err
+	}
+
+	// With the L402 verified, we'll now inspect its caveats to ensure the
+	// target service is authorized.
+	caveats := make([]Caveat, 0, len(rawCaveats))
+	for _, rawCaveat := range rawCaveats {
+		// The third-party caveats were checked along with the
+		// signature, but their discharges can contain first-party
+		// caveats in a format we're not aware of, so just skip those.
+		caveat, err := DecodeCaveat(rawCaveat)
+		if err != nil {
+			continue
+		}
+		caveats = append(caveats, caveat)
+	}
+
+	allSatisfiers := make([]Satisfier, 0, len(satisfiers)+3)
+	allSatisfiers = append(allSatisfiers, satisfiers...)
+	allSatisfiers = append(allSatisfiers,
+		NewServicesSatisfier(targetService),
+		NewTimeoutSatisfier(targetService, now),
+		NewLabelSatisfier(targetService),
+	)
+
+	return VerifyCaveats(caveats, allSatisfiers...)
+}
@@ -0,0 +1,74 @@
+package l402
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+// TestVerifyMacaroon makes sure an L402 is only verified with the right
+// preimage and secret and if its caveats authorize the target service.
+func TestVerifyMacaroon(t *testing.T) {
+	var (
+		preimage = lntypes.Preimage{1}
+		secret   = [32]byte{2}
+		now      = func() time.Time {
+			return time.Unix(1000, 0)
+		}
+	)
+
+	var id bytes.Buffer
+	require.NoError(t, EncodeIdentifier(&id, &Identifier{
+		PaymentHash: preimage.Hash(),
+		TokenID:     TokenID{3},
+	}))
+
+	mac, err := macaroon.New(
+		secret[:], id.Bytes(), "aperture", macaroon.LatestVersion,
+	)
+	require.NoError(t, err)
+
+	servicesCaveat, err := NewServicesCaveat(Service{Name: "svc"})
+	require.NoError(t, err)
+	require.NoError(t, AddFirstPartyCaveats(
+		mac, servicesCaveat, NewTimeoutCaveat("svc", 60, now),
+		NewCaveat("custom", "value"),
+	))
+
+	require.NoError(t, VerifyMacaroon(mac, preimage, secret, "svc", now))
+
+	// The preimage must match the payment hash.
+	err = VerifyMacaroon(mac, lntypes.Preimage{}, secret, "svc", now)
+	require.ErrorContains(t, err, "invalid preimage")
+	require.Error(t, VerifyPreimage(mac, lntypes.Preimage{}))
+	require.NoError(t, VerifyPreimage(mac, preimage))
+
+	// The macaroon must be signed with the secret.
+	err = VerifyMacaroon(mac, preimage, [32]byte{}, "svc", now)
+	require.Error(t, err)
+
+	// The built-in satisfiers check the caveats of the target service.
+	err = VerifyMacaroon(mac, preimage, secret, "other", now)
+	require.Error(t, err)
+
+	later := func() time.Time {
+		return time.Unix(1060, 0)
+	}
+	err = VerifyMacaroon(mac, preimage, secret, "svc", later)
+	require.ErrorContains(t, err, "expired")
+
+	// Additional satisfiers are checked as well.
+	errCustom := errors.New("custom caveat not satisfied")
+	err = VerifyMacaroon(mac, preimage, secret, "svc", now, Satisfier{
+		Condition: "custom",
+		SatisfyFinal: func(Caveat) error {
+			return errCustom
+		},
+	})
+	require.ErrorIs(t, err, errCustom)
+}
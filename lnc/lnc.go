@@ -16,8 +16,11 @@ import (
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/mwitkow/grpc-proxy/proxy"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
 	"gopkg.in/macaroon.v2"
 )
@@ -29,6 +32,12 @@ var (
 
 	// DefaultStoreTimetout is the default timeout for a db transaction.
 	DefaultStoreTimetout = time.Second * 10
+
+	// minReconnectBackoff and maxReconnectBackoff are the bounds of the
+	// exponential backoff between attempts to re-establish a broken
+	// connection.
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = time.Minute
 )
 
 // HeaderMacaroon is the HTTP header field name that is used to send
@@ -40,6 +49,7 @@ type conn struct {
 	client     lnrpc.LightningClient
 	grpcClient *grpc.ClientConn
 	creds      credentials.PerRPCCredentials
+	ctx        context.Context
 	cancel     func()
 
 	stop sync.Once
@@ -49,8 +59,8 @@ type conn struct {
 func (c *conn) Close() error {
 	var err error
 	c.stop.Do(func() {
-		err = c.grpcClient.Close()
 		c.cancel()
+		err = c.grpcClient.Close()
 	})
 
 	return err
@@ -64,12 +74,33 @@ type NodeConn struct {
 	// session is the session that is currently open.
 	session *Session
 
+	// client is the gRPC client to the remote node. Its calls are always
+	// made through the current connection, so it stays valid when the
+	// connection is re-established.
+	client lnrpc.LightningClient
+
+	// connMtx guards conn and macStr, which are replaced when the
+	// connection is re-established, as well as the remote static key of
+	// the session, which is set by the mailbox while connecting.
+	connMtx sync.RWMutex
+
 	// conn is the underlying connection to the remote node.
 	conn *conn
 
 	// macStr is the macaroon is used to authenticate the connection encoded
 	// as a hex string.
 	macStr string
+
+	// reconnect is signaled whenever the connection is found to be broken.
+	reconnect chan struct{}
+
+	// dial establishes a new connection with the remote node for the given
+	// session. This is newConn, unless replaced in tests.
+	dial func(ctx context.Context, session *Session) (*conn, error)
+
+	stopOnce sync.Once
+	quit     chan struct{}
+	wg       sync.WaitGroup
 }
 
 // NewNodeConn creates a new NodeConn instance.
@@ -104,28 +135,70 @@ func NewNodeConn(session *Session, store Store) (*NodeConn, error) {
 		session = dbSession
 	}
 
+	nodeConn := newNodeConn(session, store)
+	if err := nodeConn.start(); err != nil {
+		return nil, err
+	}
+
+	return nodeConn, nil
+}
+
+// newNodeConn creates a new NodeConn for the given session that isn't
+// connected yet.
+func newNodeConn(session *Session, store Store) *NodeConn {
 	nodeConn := &NodeConn{
-		store:   store,
-		session: session,
+		store:     store,
+		session:   session,
+		reconnect: make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+	}
+	nodeConn.client = lnrpc.NewLightningClient(
+		&reconnectingConn{nodeConn: nodeConn},
+	)
+	nodeConn.dial = func(ctx context.Context,
+		session *Session) (*conn, error) {
+
+		return nodeConn.newConn(ctx, session)
 	}
 
-	conn, err := nodeConn.newConn(session)
+	return nodeConn
+}
+
+// start establishes the connection with the remote node and starts the
+// goroutines that re-establish it once it breaks.
+func (n *NodeConn) start() error {
+	conn, err := n.dial(context.Background(), n.session)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	nodeConn.conn = conn
+	n.connMtx.Lock()
+	n.conn = conn
+	n.connMtx.Unlock()
 
-	return nodeConn, nil
+	n.wg.Add(2)
+	go n.monitorConn(conn)
+	go n.reconnectHandler()
+
+	return nil
 }
 
-// CloseConn closes the connection with the remote node.
+// CloseConn closes the connection with the remote node. The connection won't
+// be re-established afterwards.
 func (n *NodeConn) CloseConn() error {
-	if n.conn == nil {
+	// Once quit is closed, the connection isn't replaced anymore. Closing
+	// it also stops its monitor, so we can wait for the goroutines after.
+	n.stopOnce.Do(func() {
+		close(n.quit)
+	})
+
+	conn := n.currentConn()
+	if conn == nil {
 		return fmt.Errorf("connection not open")
 	}
 
-	err := n.conn.Close()
+	err := conn.Close()
+	n.wg.Wait()
 	if err != nil {
 		return fmt.Errorf("unable to close connection: %w", err)
 	}
@@ -135,27 +208,240 @@ func (n *NodeConn) CloseConn() error {
 
 // Stop closes the connection with the remote node if it is open.
 func (n *NodeConn) Stop() error {
-	if n.conn != nil {
+	if n.currentConn() != nil {
 		return n.CloseConn()
 	}
 
 	return nil
 }
 
-// Client returns the gRPC client to the remote node.
+// Client returns the gRPC client to the remote node. The client stays valid if
+// the connection is re-established after a failure.
 func (n *NodeConn) Client() (lnrpc.LightningClient, error) {
-	if n.conn == nil {
+	if n.currentConn() == nil {
 		return nil, fmt.Errorf("connection not open")
 	}
 
-	return n.conn.client, nil
+	return n.client, nil
 }
 
 // CtxFunc returns the context that needs to be used whenever the internal
 // Client is used.
 func (n *NodeConn) CtxFunc() context.Context {
+	n.connMtx.RLock()
+	macStr := n.macStr
+	n.connMtx.RUnlock()
+
 	ctx := context.Background()
-	return metadata.AppendToOutgoingContext(ctx, HeaderMacaroon, n.macStr)
+	return metadata.AppendToOutgoingContext(ctx, HeaderMacaroon, macStr)
+}
+
+// Health returns an error if the connection with the remote node is currently
+// broken. While it is, the connection is re-established in the background.
+func (n *NodeConn) Health() error {
+	conn := n.currentConn()
+	if conn == nil {
+		return fmt.Errorf("connection not open")
+	}
+
+	state := conn.grpcClient.GetState()
+	if isBrokenState(state) {
+		return fmt.Errorf("connection is %v", state)
+	}
+
+	return nil
+}
+
+// currentConn returns the current connection with the remote node.
+func (n *NodeConn) currentConn() *conn {
+	n.connMtx.RLock()
+	defer n.connMtx.RUnlock()
+
+	return n.conn
+}
+
+// requestReconnect signals that the connection is broken and needs to be
+// re-established.
+func (n *NodeConn) requestReconnect() {
+	select {
+	case n.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// isBrokenState returns true if a connection in the given state can't be used
+// without being re-established.
+func isBrokenState(state connectivity.State) bool {
+	return state == connectivity.TransientFailure ||
+		state == connectivity.Shutdown
+}
+
+// monitorConn watches the state of the given connection and requests it to be
+// re-established once it's broken.
+//
+// NOTE: This must be run as a goroutine.
+func (n *NodeConn) monitorConn(c *conn) {
+	defer n.wg.Done()
+
+	for {
+		state := c.grpcClient.GetState()
+		if isBrokenState(state) {
+			// The connection might have been replaced or closed
+			// on purpose in the meantime.
+			select {
+			case <-n.quit:
+				return
+			default:
+			}
+			if n.currentConn() != c {
+				return
+			}
+
+			log.Warnf("LNC connection for session(%x) is %v",
+				n.session.PassphraseEntropy, state)
+			n.requestReconnect()
+
+			return
+		}
+
+		if !c.grpcClient.WaitForStateChange(c.ctx, state) {
+			return
+		}
+	}
+}
+
+// reconnectHandler re-establishes the connection with the remote node
+// whenever it's found to be broken, retrying with an exponential backoff.
+//
+// NOTE: This must be run as a goroutine.
+func (n *NodeConn) reconnectHandler() {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-n.reconnect:
+		case <-n.quit:
+			return
+		}
+
+		backoff := minReconnectBackoff
+		for {
+			err := n.redial()
+			if err == nil {
+				break
+			}
+
+			log.Errorf("Unable to re-establish LNC connection for "+
+				"session(%x), retrying in %v: %v",
+				n.session.PassphraseEntropy, backoff, err)
+
+			select {
+			case <-time.After(backoff):
+			case <-n.quit:
+				return
+			}
+
+			backoff *= 2
+			if backoff > maxReconnectBackoff {
+				backoff = maxReconnectBackoff
+			}
+		}
+	}
+}
+
+// redial establishes a new connection with the remote node using the stored
+// session, which holds the local static key and, after the first connection,
+// the remote static key, and replaces the current connection with it.
+func (n *NodeConn) redial() error {
+	log.Infof("Re-establishing LNC connection for session(%x)",
+		n.session.PassphraseEntropy)
+
+	ctxt, cancel := context.WithTimeout(
+		context.Background(), DefaultConnectionTimetout,
+	)
+	defer cancel()
+
+	newConn, err := n.dial(ctxt, n.session)
+	if err != nil {
+		return err
+	}
+
+	n.connMtx.Lock()
+	select {
+	case <-n.quit:
+		n.connMtx.Unlock()
+		return newConn.Close()
+	default:
+	}
+	oldConn := n.conn
+	n.conn = newConn
+	n.connMtx.Unlock()
+
+	if err := oldConn.Close(); err != nil {
+		log.Debugf("Unable to close broken LNC connection: %v", err)
+	}
+
+	n.wg.Add(1)
+	go n.monitorConn(newConn)
+
+	log.Infof("LNC connection for session(%x) re-established",
+		n.session.PassphraseEntropy)
+
+	return nil
+}
+
+// reconnectingConn is a gRPC client connection that makes all calls through
+// the current connection of a NodeConn. Calls that fail because the
+// connection is unavailable trigger a reconnection.
+type reconnectingConn struct {
+	nodeConn *NodeConn
+}
+
+// A compile-time check to ensure reconnectingConn implements
+// grpc.ClientConnInterface.
+var _ grpc.ClientConnInterface = (*reconnectingConn)(nil)
+
+// Invoke performs a unary RPC through the current connection.
+//
+// NOTE: This is part of the grpc.ClientConnInterface interface.
+func (r *reconnectingConn) Invoke(ctx context.Context, method string,
+	args interface{}, reply interface{}, opts ...grpc.CallOption) error {
+
+	conn := r.nodeConn.currentConn()
+	if conn == nil {
+		return fmt.Errorf("connection not open")
+	}
+
+	err := conn.grpcClient.Invoke(ctx, method, args, reply, opts...)
+	r.checkErr(err)
+
+	return err
+}
+
+// NewStream begins a streaming RPC through the current connection.
+//
+// NOTE: This is part of the grpc.ClientConnInterface interface.
+func (r *reconnectingConn) NewStream(ctx context.Context,
+	desc *grpc.StreamDesc, method string,
+	opts ...grpc.CallOption) (grpc.ClientStream, error) {
+
+	conn := r.nodeConn.currentConn()
+	if conn == nil {
+		return nil, fmt.Errorf("connection not open")
+	}
+
+	stream, err := conn.grpcClient.NewStream(ctx, desc, method, opts...)
+	r.checkErr(err)
+
+	return stream, err
+}
+
+// checkErr requests a reconnection if the given error shows that the
+// connection is unavailable.
+func (r *reconnectingConn) checkErr(err error) {
+	if status.Code(err) == codes.Unavailable {
+		r.nodeConn.requestReconnect()
+	}
 }
 
 // onRemoteStatic is called when the remote static key is received.
@@ -176,9 +462,17 @@ func (n *NodeConn) onRemoteStatic(key *btcec.PublicKey) error {
 	if err != nil {
 		log.Errorf("unable to set remote pub key for session(%x): %w",
 			n.session.PassphraseEntropy, err)
+
+		return err
 	}
 
-	return err
+	// Connections that are re-established later on need to use the same
+	// remote key.
+	n.connMtx.Lock()
+	n.session.RemoteStaticPubKey = key
+	n.connMtx.Unlock()
+
+	return nil
 }
 
 // onAuthData is called when the auth data is received.
@@ -204,7 +498,9 @@ func (n *NodeConn) onAuthData(data []byte) error {
 
 	// TODO(positiveblue): check that the macaroon has all the needed
 	// permissions.
+	n.connMtx.Lock()
 	n.macStr = hex.EncodeToString(macBytes)
+	n.connMtx.Unlock()
 
 	// If we already know the expiry time for this session there is no need
 	// to parse the macaroon to obtain it.
@@ -236,14 +532,19 @@ func (n *NodeConn) onAuthData(data []byte) error {
 	return nil
 }
 
-// newConn creates an LNC connection.
-func (n *NodeConn) newConn(session *Session, opts ...grpc.DialOption) (*conn,
-	error) {
+// newConn creates an LNC connection. The given context bounds the time it
+// takes to establish the connection.
+func (n *NodeConn) newConn(ctx context.Context, session *Session,
+	opts ...grpc.DialOption) (*conn, error) {
 
 	localKey := &keychain.PrivKeyECDH{PrivKey: session.LocalStaticPrivKey}
 
 	// remoteKey can be nil if this is the first time the session is used.
+	// It is set by the mailbox of a previous connection, so we need to
+	// hold the lock to read it.
+	n.connMtx.RLock()
 	remoteKey := session.RemoteStaticPubKey
+	n.connMtx.RUnlock()
 	entropy := session.PassphraseEntropy
 
 	connData := mailbox.NewConnData(
@@ -281,8 +582,15 @@ func (n *NodeConn) newConn(session *Session, opts ...grpc.DialOption) (*conn,
 	}
 	dialOpts = append(dialOpts, opts...)
 
+	// The connection itself lives until ctxc is canceled, the given
+	// context only applies to the dial.
+	dialCtx, dialCancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(ctxc, dialCancel)
+	defer stop()
+	defer dialCancel()
+
 	grpcClient, err := grpc.DialContext(
-		ctxc, session.MailboxAddr, dialOpts...,
+		dialCtx, session.MailboxAddr, dialOpts...,
 	)
 	if err != nil {
 		cancel()
@@ -293,6 +601,7 @@ func (n *NodeConn) newConn(session *Session, opts ...grpc.DialOption) (*conn,
 		client:     lnrpc.NewLightningClient(grpcClient),
 		grpcClient: grpcClient,
 		creds:      noiseConn,
+		ctx:        ctxc,
 		cancel:     cancel,
 	}, nil
 }
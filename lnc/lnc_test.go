@@ -0,0 +1,279 @@
+package lnc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// fakeDialer hands out fake connections to a NodeConn. Instead of going
+// through a mailbox, the connections connect to a local gRPC server, so they
+// stay healthy until they are closed, which puts them into the broken shutdown
+// state.
+type fakeDialer struct {
+	t    *testing.T
+	addr string
+
+	mu       sync.Mutex
+	conns    []*conn
+	fails    int
+	dials    []time.Time
+	attempts int
+
+	// block, if set, is waited on before a connection is handed out.
+	block chan struct{}
+}
+
+// newFakeDialer creates a new fake dialer along with the gRPC server its
+// connections connect to.
+func newFakeDialer(t *testing.T) *fakeDialer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	return &fakeDialer{t: t, addr: listener.Addr().String()}
+}
+
+// dial records the attempt and returns a new fake connection, unless the
+// dialer is configured to fail.
+func (d *fakeDialer) dial(_ context.Context, _ *Session) (*conn, error) {
+	d.mu.Lock()
+	d.attempts++
+	block := d.block
+	d.mu.Unlock()
+
+	if block != nil {
+		<-block
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.dials = append(d.dials, time.Now())
+	if d.fails > 0 {
+		d.fails--
+		return nil, errors.New("mailbox unavailable")
+	}
+
+	grpcClient, err := grpc.Dial(
+		d.addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(d.t, err)
+
+	ctxc, cancel := context.WithCancel(context.Background())
+	c := &conn{
+		client:     lnrpc.NewLightningClient(grpcClient),
+		grpcClient: grpcClient,
+		ctx:        ctxc,
+		cancel:     cancel,
+	}
+	d.conns = append(d.conns, c)
+
+	return c, nil
+}
+
+// numAttempts returns the number of dial attempts that were started so far.
+func (d *fakeDialer) numAttempts() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.attempts
+}
+
+// numDials returns the number of dial attempts that completed so far.
+func (d *fakeDialer) numDials() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.dials)
+}
+
+// lastConn returns the connection that was handed out last.
+func (d *fakeDialer) lastConn() *conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.conns[len(d.conns)-1]
+}
+
+// newTestNodeConn creates a started NodeConn that uses the given fake dialer.
+func newTestNodeConn(t *testing.T, d *fakeDialer) *NodeConn {
+	n := newNodeConn(&Session{PassphraseEntropy: []byte("test")}, nil)
+	n.dial = d.dial
+	require.NoError(t, n.start())
+
+	return n
+}
+
+// setBackoff sets the reconnect backoff bounds for the duration of the test.
+func setBackoff(t *testing.T, min, max time.Duration) {
+	oldMin, oldMax := minReconnectBackoff, maxReconnectBackoff
+	minReconnectBackoff, maxReconnectBackoff = min, max
+
+	t.Cleanup(func() {
+		minReconnectBackoff, maxReconnectBackoff = oldMin, oldMax
+	})
+}
+
+// TestNodeConnReconnect makes sure a broken connection is reported by Health
+// and replaced with a new one.
+func TestNodeConnReconnect(t *testing.T) {
+	setBackoff(t, time.Millisecond, time.Millisecond)
+
+	d := newFakeDialer(t)
+	n := newTestNodeConn(t, d)
+	defer func() {
+		require.NoError(t, n.CloseConn())
+	}()
+
+	first := n.currentConn()
+	require.NoError(t, n.Health())
+
+	// Breaking the connection makes it unhealthy, until it's replaced.
+	require.NoError(t, first.grpcClient.Close())
+	require.Equal(t, connectivity.Shutdown, first.grpcClient.GetState())
+
+	require.Eventually(t, func() bool {
+		return n.currentConn() != first
+	}, time.Second, time.Millisecond)
+	require.NoError(t, n.Health())
+	require.Equal(t, 2, d.numDials())
+
+	// The new connection is monitored as well.
+	second := n.currentConn()
+	require.NoError(t, second.grpcClient.Close())
+	require.Eventually(t, func() bool {
+		return n.currentConn() != second
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 3, d.numDials())
+}
+
+// TestNodeConnBackoff makes sure failed attempts to re-establish the
+// connection are retried with an exponential backoff up to the maximum.
+func TestNodeConnBackoff(t *testing.T) {
+	const (
+		minBackoff = 20 * time.Millisecond
+		maxBackoff = 80 * time.Millisecond
+	)
+	setBackoff(t, minBackoff, maxBackoff)
+
+	d := newFakeDialer(t)
+	n := newTestNodeConn(t, d)
+	defer func() {
+		require.NoError(t, n.CloseConn())
+	}()
+
+	// The next four attempts fail, the fifth one succeeds.
+	d.mu.Lock()
+	d.fails = 4
+	d.mu.Unlock()
+
+	first := n.currentConn()
+	require.NoError(t, first.grpcClient.Close())
+	require.Error(t, n.Health())
+
+	require.Eventually(t, func() bool {
+		return n.currentConn() != first
+	}, 5*time.Second, time.Millisecond)
+	require.NoError(t, n.Health())
+
+	d.mu.Lock()
+	dials := d.dials[1:]
+	d.mu.Unlock()
+	require.Len(t, dials, 5)
+
+	expected := []time.Duration{
+		minBackoff, 2 * minBackoff, maxBackoff, maxBackoff,
+	}
+	for i, backoff := range expected {
+		require.GreaterOrEqual(t, dials[i+1].Sub(dials[i]), backoff)
+	}
+}
+
+// TestNodeConnHealth makes sure Health reports a connection that isn't open or
+// is broken.
+func TestNodeConnHealth(t *testing.T) {
+	d := newFakeDialer(t)
+	n := newNodeConn(&Session{PassphraseEntropy: []byte("test")}, nil)
+	n.dial = d.dial
+
+	// Before the connection is established, there's nothing to check.
+	require.ErrorContains(t, n.Health(), "connection not open")
+	require.ErrorContains(t, n.CloseConn(), "connection not open")
+
+	n = newTestNodeConn(t, d)
+	require.NoError(t, n.Health())
+
+	// Once closed, the connection stays broken.
+	require.NoError(t, n.CloseConn())
+	require.ErrorContains(t, n.Health(), "SHUTDOWN")
+	require.Equal(t, 1, d.numDials())
+}
+
+// TestNodeConnCloseConcurrent makes sure CloseConn can be called concurrently,
+// also while the connection is being re-established, and that no connection
+// is left open afterwards.
+func TestNodeConnCloseConcurrent(t *testing.T) {
+	setBackoff(t, time.Millisecond, time.Millisecond)
+
+	d := newFakeDialer(t)
+	n := newTestNodeConn(t, d)
+
+	// Break the connection, but hold back the new one until the
+	// connection is closed.
+	d.mu.Lock()
+	d.block = make(chan struct{})
+	d.mu.Unlock()
+	first := n.currentConn()
+	require.NoError(t, first.grpcClient.Close())
+	require.Eventually(t, func() bool {
+		return d.numAttempts() == 2
+	}, time.Second, time.Millisecond)
+
+	const numClosers = 8
+	var wg sync.WaitGroup
+	wg.Add(numClosers)
+	for i := 0; i < numClosers; i++ {
+		go func() {
+			defer wg.Done()
+
+			_ = n.CloseConn()
+		}()
+	}
+
+	// The closers wait for the reconnect handler, which is stuck in the
+	// dial until we let it continue.
+	require.Eventually(t, func() bool {
+		select {
+		case <-n.quit:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, time.Millisecond)
+	close(d.block)
+	wg.Wait()
+
+	// The connection that was dialed concurrently must not replace the
+	// closed one and must be closed itself.
+	require.Equal(t, first, n.currentConn())
+	require.Equal(t, 2, d.numDials())
+	require.Equal(
+		t, connectivity.Shutdown, d.lastConn().grpcClient.GetState(),
+	)
+}
@@ -22,6 +22,9 @@ type Store interface {
 	GetSession(ctx context.Context,
 		passphraseEntropy []byte) (*Session, error)
 
+	// ListSessions returns all stored sessions.
+	ListSessions(ctx context.Context) ([]*Session, error)
+
 	// SetRemotePubKey sets the remote public key for a session.
 	SetRemotePubKey(ctx context.Context, passphraseEntropy,
 		remotePubKey []byte) error
@@ -29,4 +32,9 @@ type Store interface {
 	// SetExpiry sets the expiry time for a session.
 	SetExpiry(ctx context.Context, passphraseEntroy []byte,
 		expiry time.Time) error
+
+	// DeleteExpiredSessions deletes all sessions that expired before the
+	// given time and returns the number of deleted sessions.
+	DeleteExpiredSessions(ctx context.Context, before time.Time) (int64,
+		error)
 }
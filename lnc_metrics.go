@@ -0,0 +1,85 @@
+package aperture
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/lightninglabs/aperture/aperturedb"
+	"github.com/lightninglabs/aperture/lnc"
+)
+
+// lncSessionMetricsInterval is the interval at which the LNC session metrics
+// are updated from the session store.
+const lncSessionMetricsInterval = time.Minute
+
+// updateLNCSessionMetrics updates the LNC session metrics from the sessions in
+// the given store.
+func updateLNCSessionMetrics(ctx context.Context, store lnc.Store,
+	now time.Time) error {
+
+	sessions, err := store.ListSessions(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Sessions without an expiry never expire, so if there's no session
+	// left that does, the time until the next expiry is infinite.
+	var (
+		numExpired int
+		nextExpiry = math.Inf(1)
+	)
+	for _, session := range sessions {
+		if session.Expiry == nil {
+			continue
+		}
+
+		timeLeft := session.Expiry.Sub(now)
+		if timeLeft <= 0 {
+			numExpired++
+			continue
+		}
+		nextExpiry = math.Min(nextExpiry, timeLeft.Seconds())
+	}
+
+	lncSessions.Set(float64(len(sessions)))
+	lncSessionsExpired.Set(float64(numExpired))
+	lncSessionNextExpiry.Set(nextExpiry)
+
+	return nil
+}
+
+// trackLNCSessions periodically updates the LNC session metrics from the given
+// store until aperture shuts down.
+//
+// NOTE: This must be run as a goroutine.
+func (a *Aperture) trackLNCSessions(store lnc.Store) {
+	defer a.wg.Done()
+
+	update := func() {
+		ctxt, cancel := context.WithTimeout(
+			context.Background(), aperturedb.DefaultStoreTimeout,
+		)
+		defer cancel()
+
+		err := updateLNCSessionMetrics(ctxt, store, time.Now())
+		if err != nil {
+			log.Errorf("Unable to update LNC session metrics: %v",
+				err)
+		}
+	}
+
+	ticker := time.NewTicker(lncSessionMetricsInterval)
+	defer ticker.Stop()
+
+	update()
+	for {
+		select {
+		case <-ticker.C:
+			update()
+
+		case <-a.quit:
+			return
+		}
+	}
+}
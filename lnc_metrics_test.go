@@ -0,0 +1,82 @@
+package aperture
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/lnc"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// mockLNCStore is an LNC session store that only supports listing and
+// deleting its sessions.
+type mockLNCStore struct {
+	lnc.Store
+
+	mu       sync.Mutex
+	sessions []*lnc.Session
+}
+
+// ListSessions returns the sessions of the mock store.
+func (m *mockLNCStore) ListSessions(context.Context) ([]*lnc.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.sessions, nil
+}
+
+// DeleteExpiredSessions deletes the sessions of the mock store that expired
+// before the given time.
+func (m *mockLNCStore) DeleteExpiredSessions(_ context.Context,
+	before time.Time) (int64, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var (
+		kept       []*lnc.Session
+		numDeleted int64
+	)
+	for _, session := range m.sessions {
+		if session.Expiry != nil && session.Expiry.Before(before) {
+			numDeleted++
+			continue
+		}
+		kept = append(kept, session)
+	}
+	m.sessions = kept
+
+	return numDeleted, nil
+}
+
+// TestUpdateLNCSessionMetrics makes sure the LNC session metrics reflect the
+// number of sessions and their expiry.
+func TestUpdateLNCSessionMetrics(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(10000, 0)
+	expiry := func(d time.Duration) *time.Time {
+		e := now.Add(d)
+		return &e
+	}
+
+	store := &mockLNCStore{}
+	require.NoError(t, updateLNCSessionMetrics(ctx, store, now))
+	require.Zero(t, testutil.ToFloat64(lncSessions))
+	require.Zero(t, testutil.ToFloat64(lncSessionsExpired))
+	require.True(t, math.IsInf(testutil.ToFloat64(lncSessionNextExpiry), 1))
+
+	store.sessions = []*lnc.Session{
+		{},
+		{Expiry: expiry(-time.Minute)},
+		{Expiry: expiry(2 * time.Hour)},
+		{Expiry: expiry(time.Hour)},
+	}
+	require.NoError(t, updateLNCSessionMetrics(ctx, store, now))
+	require.EqualValues(t, 4, testutil.ToFloat64(lncSessions))
+	require.EqualValues(t, 1, testutil.ToFloat64(lncSessionsExpired))
+	require.EqualValues(t, 3600, testutil.ToFloat64(lncSessionNextExpiry))
+}
@@ -0,0 +1,47 @@
+package aperture
+
+import (
+	"context"
+	"time"
+
+	"github.com/lightninglabs/aperture/aperturedb"
+	"github.com/lightninglabs/aperture/lnc"
+)
+
+// pruneLNCSessions periodically removes expired sessions from the given LNC
+// session store until aperture shuts down.
+//
+// NOTE: This must be run as a goroutine.
+func (a *Aperture) pruneLNCSessions(store lnc.Store, interval time.Duration) {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctxt, cancel := context.WithTimeout(
+				context.Background(),
+				aperturedb.DefaultStoreTimeout,
+			)
+			numPruned, err := store.DeleteExpiredSessions(
+				ctxt, time.Now(),
+			)
+			cancel()
+			if err != nil {
+				log.Errorf("Unable to prune expired LNC "+
+					"sessions: %v", err)
+				continue
+			}
+
+			if numPruned > 0 {
+				log.Infof("Pruned %d expired LNC sessions",
+					numPruned)
+			}
+
+		case <-a.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/lnc"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPruneLNCSessions makes sure expired LNC sessions are pruned in the
+// background until aperture shuts down.
+func TestPruneLNCSessions(t *testing.T) {
+	expired := time.Now().Add(-time.Minute)
+	live := time.Now().Add(time.Hour)
+	liveSession := &lnc.Session{Expiry: &live}
+	noExpirySession := &lnc.Session{}
+	store := &mockLNCStore{
+		sessions: []*lnc.Session{
+			{Expiry: &expired}, liveSession, noExpirySession,
+		},
+	}
+
+	a := &Aperture{quit: make(chan struct{})}
+	a.wg.Add(1)
+	go a.pruneLNCSessions(store, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		sessions, err := store.ListSessions(context.Background())
+		require.NoError(t, err)
+
+		return len(sessions) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	sessions, err := store.ListSessions(context.Background())
+	require.NoError(t, err)
+	require.Equal(
+		t, []*lnc.Session{liveSession, noExpirySession}, sessions,
+	)
+
+	close(a.quit)
+	a.wg.Wait()
+}
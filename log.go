@@ -5,6 +5,7 @@ import (
 	"github.com/lightninglabs/aperture/auth"
 	"github.com/lightninglabs/aperture/challenger"
 	"github.com/lightninglabs/aperture/l402"
+	"github.com/lightninglabs/aperture/pricer"
 	"github.com/lightninglabs/aperture/proxy"
 	"github.com/lightninglabs/lndclient"
 	"github.com/lightningnetwork/lnd"
@@ -30,6 +31,7 @@ func SetupLoggers(root *build.RotatingLogWriter, intercept signal.Interceptor) {
 	lnd.AddSubLogger(root, auth.Subsystem, intercept, auth.UseLogger)
 	lnd.AddSubLogger(root, l402.Subsystem, intercept, l402.UseLogger)
 	lnd.AddSubLogger(root, proxy.Subsystem, intercept, proxy.UseLogger)
+	lnd.AddSubLogger(root, pricer.Subsystem, intercept, pricer.UseLogger)
 	lnd.AddSubLogger(root, "LNDC", intercept, lndclient.UseLogger)
 	lnd.AddSubLogger(
 		root, challenger.Subsystem, intercept, challenger.UseLogger,
@@ -0,0 +1,131 @@
+package mint
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/l402"
+)
+
+// memorySecret is a secret kept by the InMemorySecretStore together with its
+// expiry.
+type memorySecret struct {
+	secret [l402.SecretSize]byte
+	expiry time.Time
+}
+
+// InMemorySecretStore is a store of L402 secrets that only keeps them in
+// memory. All secrets are lost when the process exits, which invalidates every
+// L402 minted before. It is meant for testing, local development and
+// ephemeral single-instance deployments.
+type InMemorySecretStore struct {
+	mu      sync.Mutex
+	secrets map[[sha256.Size]byte]memorySecret
+}
+
+// A compile-time constraint to ensure InMemorySecretStore implements
+// SecretStore, ExpiringSecretStore and SecretPruner.
+var _ SecretStore = (*InMemorySecretStore)(nil)
+var _ ExpiringSecretStore = (*InMemorySecretStore)(nil)
+var _ SecretPruner = (*InMemorySecretStore)(nil)
+
+// NewInMemorySecretStore creates a new, empty in-memory secret store.
+func NewInMemorySecretStore() *InMemorySecretStore {
+	return &InMemorySecretStore{
+		secrets: make(map[[sha256.Size]byte]memorySecret),
+	}
+}
+
+// NewSecret creates a new cryptographically random secret which is keyed by the
+// given hash. If there already is a secret for the hash, ErrSecretExists is
+// returned and the existing secret is kept.
+//
+// NOTE: This is part of the SecretStore interface.
+func (s *InMemorySecretStore) NewSecret(ctx context.Context,
+	id [sha256.Size]byte) ([l402.SecretSize]byte, error) {
+
+	return s.NewExpiringSecret(ctx, id, time.Time{})
+}
+
+// NewExpiringSecret creates a new secret like NewSecret that is pruned once
+// the given expiry passed, unless it is zero.
+//
+// NOTE: This is part of the ExpiringSecretStore interface.
+func (s *InMemorySecretStore) NewExpiringSecret(_ context.Context,
+	id [sha256.Size]byte, expiry time.Time) ([l402.SecretSize]byte,
+	error) {
+
+	var secret [l402.SecretSize]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return secret, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.secrets[id]; ok {
+		return [l402.SecretSize]byte{}, ErrSecretExists
+	}
+	s.secrets[id] = memorySecret{
+		secret: secret,
+		expiry: expiry,
+	}
+
+	return secret, nil
+}
+
+// GetSecret returns the cryptographically random secret that corresponds to
+// the given hash. If there is no secret, then ErrSecretNotFound is returned.
+//
+// NOTE: This is part of the SecretStore interface.
+func (s *InMemorySecretStore) GetSecret(_ context.Context,
+	id [sha256.Size]byte) ([l402.SecretSize]byte, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secret, ok := s.secrets[id]
+	if !ok {
+		return [l402.SecretSize]byte{}, ErrSecretNotFound
+	}
+
+	return secret.secret, nil
+}
+
+// RevokeSecret removes the cryptographically random secret that corresponds to
+// the given hash. This acts as a NOP if the secret does not exist.
+//
+// NOTE: This is part of the SecretStore interface.
+func (s *InMemorySecretStore) RevokeSecret(_ context.Context,
+	id [sha256.Size]byte) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.secrets, id)
+
+	return nil
+}
+
+// PruneSecrets removes all secrets whose expiry is before the given time.
+//
+// NOTE: This is part of the SecretPruner interface.
+func (s *InMemorySecretStore) PruneSecrets(_ context.Context,
+	before time.Time) (int64, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var numPruned int64
+	for id, secret := range s.secrets {
+		if !secret.expiry.IsZero() && secret.expiry.Before(before) {
+			delete(s.secrets, id)
+			numPruned++
+		}
+	}
+
+	return numPruned, nil
+}
@@ -0,0 +1,74 @@
+package mint
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestInMemorySecretStore makes sure the in-memory secret store creates,
+// returns and revokes secrets like the persistent stores.
+func TestInMemorySecretStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemorySecretStore()
+	hash := sha256.Sum256([]byte("id"))
+
+	// Trying to get a secret that doesn't exist should fail.
+	_, err := store.GetSecret(ctx, hash)
+	require.ErrorIs(t, err, ErrSecretNotFound)
+
+	secret, err := store.NewSecret(ctx, hash)
+	require.NoError(t, err)
+
+	storedSecret, err := store.GetSecret(ctx, hash)
+	require.NoError(t, err)
+	require.Equal(t, secret, storedSecret)
+
+	// Creating another secret for the same hash should fail and leave the
+	// existing secret in place.
+	_, err = store.NewSecret(ctx, hash)
+	require.ErrorIs(t, err, ErrSecretExists)
+
+	storedSecret, err = store.GetSecret(ctx, hash)
+	require.NoError(t, err)
+	require.Equal(t, secret, storedSecret)
+
+	// Once revoked, the secret is gone. Revoking it again is a NOP.
+	require.NoError(t, store.RevokeSecret(ctx, hash))
+	_, err = store.GetSecret(ctx, hash)
+	require.ErrorIs(t, err, ErrSecretNotFound)
+	require.NoError(t, store.RevokeSecret(ctx, hash))
+}
+
+// TestInMemorySecretStorePrune makes sure only the secrets that expired are
+// pruned.
+func TestInMemorySecretStorePrune(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemorySecretStore()
+	now := time.Unix(1000, 0)
+
+	expired := sha256.Sum256([]byte("expired"))
+	valid := sha256.Sum256([]byte("valid"))
+	forever := sha256.Sum256([]byte("forever"))
+
+	_, err := store.NewExpiringSecret(ctx, expired, now.Add(-time.Second))
+	require.NoError(t, err)
+	_, err = store.NewExpiringSecret(ctx, valid, now.Add(time.Second))
+	require.NoError(t, err)
+	_, err = store.NewSecret(ctx, forever)
+	require.NoError(t, err)
+
+	numPruned, err := store.PruneSecrets(ctx, now)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, numPruned)
+
+	_, err = store.GetSecret(ctx, expired)
+	require.ErrorIs(t, err, ErrSecretNotFound)
+	_, err = store.GetSecret(ctx, valid)
+	require.NoError(t, err)
+	_, err = store.GetSecret(ctx, forever)
+	require.NoError(t, err)
+}
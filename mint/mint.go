@@ -7,6 +7,9 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/lightninglabs/aperture/l402"
@@ -14,10 +17,34 @@ import (
 	"gopkg.in/macaroon.v2"
 )
 
+const (
+	// DefaultLocation is the location hint set on every minted L402
+	// macaroon if the mint isn't configured with a location.
+	DefaultLocation = "lsat"
+
+	// maxTokenIDAttempts is the number of random token IDs that are tried
+	// when minting an L402 before giving up, should their secrets already
+	// exist.
+	maxTokenIDAttempts = 3
+)
+
 var (
 	// ErrSecretNotFound is an error returned when we attempt to retrieve a
 	// secret by its key but it is not found.
 	ErrSecretNotFound = errors.New("secret not found")
+
+	// ErrSecretExists is an error returned when we attempt to create a new
+	// secret for a key that already has one.
+	ErrSecretExists = errors.New("secret already exists")
+
+	// ErrMissingServicesCaveat is an error returned when verifying an L402
+	// without a services caveat while such admin L402s are not allowed.
+	ErrMissingServicesCaveat = errors.New("L402 has no services caveat")
+
+	// ErrPendingPreimage is an error returned when verifying an L402 with
+	// an all-zero preimage, which clients use as a placeholder while the
+	// payment is still pending.
+	ErrPendingPreimage = errors.New("preimage is zero, payment pending")
 )
 
 // Challenger is an interface used to present requesters of L402s with a
@@ -34,11 +61,43 @@ type Challenger interface {
 	Stop()
 }
 
+// ServiceChallenger is an optional interface of a Challenger that creates
+// challenges for a specific service, for example to describe the service in
+// the invoice memo.
+type ServiceChallenger interface {
+	// NewServiceChallenge returns a new challenge for the given service in
+	// the form of a Lightning payment request and its payment hash.
+	NewServiceChallenge(service string, price int64) (string,
+		lntypes.Hash, error)
+}
+
+// NewServiceChallenge creates a new challenge for the given service if the
+// challenger implements the ServiceChallenger interface. Other challengers
+// create a challenge that isn't specific to the service.
+func NewServiceChallenge(c Challenger, service string,
+	price int64) (string, lntypes.Hash, error) {
+
+	if serviceChallenger, ok := c.(ServiceChallenger); ok {
+		return serviceChallenger.NewServiceChallenge(service, price)
+	}
+
+	return c.NewChallenge(price)
+}
+
+// PaymentHashVerifier is used to make sure a payment hash handed out by a
+// Challenger actually belongs to an invoice the backing node knows about.
+type PaymentHashVerifier interface {
+	// VerifyPaymentHash returns an error if the given payment hash does not
+	// correspond to an invoice known to the backing node.
+	VerifyPaymentHash(context.Context, lntypes.Hash) error
+}
+
 // SecretStore is the store responsible for storing L402 secrets. These secrets
 // are required for proper verification of each minted L402.
 type SecretStore interface {
 	// NewSecret creates a new cryptographically random secret which is
-	// keyed by the given hash.
+	// keyed by the given hash. If there already is a secret for the hash,
+	// ErrSecretExists is returned and the existing secret is kept.
 	NewSecret(context.Context, [sha256.Size]byte) ([l402.SecretSize]byte,
 		error)
 
@@ -54,6 +113,71 @@ type SecretStore interface {
 	RevokeSecret(context.Context, [sha256.Size]byte) error
 }
 
+// ExpiringSecretStore is an optional interface of a SecretStore that records
+// when a secret is no longer needed, so it can be pruned afterwards.
+type ExpiringSecretStore interface {
+	// NewExpiringSecret creates a new secret like NewSecret that is no
+	// longer needed after the given expiry, at which point the store may
+	// prune it. A zero expiry means it never expires.
+	NewExpiringSecret(context.Context, [sha256.Size]byte,
+		time.Time) ([l402.SecretSize]byte, error)
+}
+
+// newSecret creates a new secret in the given store that expires at the given
+// time. Stores that don't implement the ExpiringSecretStore interface keep the
+// secret forever.
+func newSecret(ctx context.Context, store SecretStore, id [sha256.Size]byte,
+	expiry time.Time) ([l402.SecretSize]byte, error) {
+
+	if expiring, ok := store.(ExpiringSecretStore); ok {
+		return expiring.NewExpiringSecret(ctx, id, expiry)
+	}
+
+	return store.NewSecret(ctx, id)
+}
+
+// RevocationEvent is an audit event describing the revocation of the secret of
+// an L402.
+type RevocationEvent struct {
+	// TokenID is the ID of the L402 whose secret was revoked.
+	TokenID l402.TokenID
+
+	// PaymentHash is the payment hash the L402 is bound to.
+	PaymentHash lntypes.Hash
+
+	// Timestamp is the time the secret was revoked at.
+	Timestamp time.Time
+
+	// Reason is the reason the caller supplied for the revocation.
+	Reason string
+}
+
+// BatchSecretRevoker is an optional interface of a SecretStore that can revoke
+// the secrets of many L402s at once, for example within a single database
+// transaction.
+type BatchSecretRevoker interface {
+	// RevokeSecrets removes the secrets that correspond to the given
+	// hashes. Either all of them are removed or, if an error is returned,
+	// none. Hashes without a secret are ignored.
+	RevokeSecrets(context.Context, [][sha256.Size]byte) error
+}
+
+// SecretPruner is an optional interface of a SecretStore that can remove the
+// secrets of expired L402s in bulk.
+type SecretPruner interface {
+	// PruneSecrets removes all secrets whose expiry is before the given
+	// time and returns the number of removed secrets. Secrets without an
+	// expiry are kept.
+	PruneSecrets(context.Context, time.Time) (int64, error)
+}
+
+// RevocationAuditor is notified of every L402 secret revoked through the mint
+// so an audit trail can be kept.
+type RevocationAuditor interface {
+	// AuditRevocation records the given revocation event.
+	AuditRevocation(context.Context, *RevocationEvent) error
+}
+
 // ServiceLimiter abstracts the source of caveats that should be applied to an
 // L402 for a particular service.
 type ServiceLimiter interface {
@@ -75,6 +199,28 @@ type ServiceLimiter interface {
 		error)
 }
 
+// ThirdPartyAuthority is an external authority, such as an identity provider,
+// that must discharge a third-party caveat of each minted L402 before it
+// grants access. This allows delegating authorization decisions on top of the
+// payment proof.
+type ThirdPartyAuthority interface {
+	// Location returns the location of the authority that clients obtain
+	// the discharge macaroon from.
+	Location() string
+
+	// NewCaveat returns the root key of the discharge macaroon and the ID
+	// of the third-party caveat for an L402 of the given services. The
+	// caveat ID must allow the authority to recover the root key, for
+	// example by encrypting it to the authority.
+	NewCaveat(context.Context, ...l402.Service) ([]byte, []byte, error)
+}
+
+// SatisfierFactory creates the satisfier of a custom caveat condition for the
+// given verification. The satisfier can base its decision on any of the
+// verification parameters, for example the target service or the header of
+// the request the L402 was presented with.
+type SatisfierFactory func(*VerificationParams) l402.Satisfier
+
 // Config packages all of the required dependencies to instantiate a new L402
 // mint.
 type Config struct {
@@ -90,6 +236,49 @@ type Config struct {
 	// on its target services.
 	ServiceLimiter ServiceLimiter
 
+	// PaymentHashVerifier is an optional verifier that is used to check
+	// every payment hash returned by the Challenger against the backing
+	// node before an L402 is minted for it. This catches misconfigurations
+	// where invoices are created by a different node than the one used to
+	// verify payments. If nil, no such check is performed.
+	PaymentHashVerifier PaymentHashVerifier
+
+	// RequireServicesCaveat can be set to reject L402s without a services
+	// caveat. By default such L402s are treated as admin L402s that are
+	// authorized to access any service.
+	RequireServicesCaveat bool
+
+	// StrictPreimage can be set to reject all-zero preimages with
+	// ErrPendingPreimage before attempting any further verification.
+	StrictPreimage bool
+
+	// RevocationAuditor is an optional auditor that is notified of every
+	// secret revoked through the mint.
+	RevocationAuditor RevocationAuditor
+
+	// CustomSatisfiers is an optional registry of satisfiers for custom
+	// caveat conditions, keyed by the condition they claim. Such caveats
+	// are added to new L402s through the constraints of the
+	// ServiceLimiter. The built-in conditions can't be claimed, and
+	// caveats that no satisfier claims are ignored.
+	CustomSatisfiers map[string]SatisfierFactory
+
+	// StrictCaveatChains can be set to reject L402s with multiple caveats
+	// of a custom condition whose satisfier can't make sure that each of
+	// them only narrows the access granted by the previous one. By default
+	// such chains are allowed and only the last caveat is enforced.
+	StrictCaveatChains bool
+
+	// ThirdPartyAuthorities are the optional external authorities whose
+	// third-party caveats are added to every minted L402. Such L402s are
+	// only valid together with a discharge macaroon of each authority.
+	ThirdPartyAuthorities []ThirdPartyAuthority
+
+	// Location is the location hint set on every minted L402 macaroon,
+	// for example the domain of the operator. If empty, DefaultLocation
+	// is used.
+	Location string
+
 	// Now returns the current time.
 	Now func() time.Time
 }
@@ -98,11 +287,22 @@ type Config struct {
 // services.
 type Mint struct {
 	cfg Config
+
+	// newTokenID generates the random token ID of each new L402.
+	newTokenID func() ([l402.TokenIDSize]byte, error)
 }
 
 // New creates a new L402 mint backed by its given dependencies.
 func New(cfg *Config) *Mint {
-	return &Mint{cfg: *cfg}
+	m := &Mint{
+		cfg:        *cfg,
+		newTokenID: generateTokenID,
+	}
+	if m.cfg.Location == "" {
+		m.cfg.Location = DefaultLocation
+	}
+
+	return m
 }
 
 // MintL402 mints a new L402 for the target services.
@@ -114,55 +314,245 @@ func (m *Mint) MintL402(ctx context.Context,
 	price := maximumPrice(services)
 
 	// We'll start by retrieving a new challenge in the form of a Lightning
-	// payment request to present the requester of the L402 with.
-	paymentRequest, paymentHash, err := m.cfg.Challenger.NewChallenge(price)
+	// payment request to present the requester of the L402 with. The
+	// challenge can only describe the service if there's exactly one.
+	var serviceName string
+	if len(services) == 1 {
+		serviceName = services[0].Name
+	}
+	paymentRequest, paymentHash, err := NewServiceChallenge(
+		m.cfg.Challenger, serviceName, price,
+	)
 	if err != nil {
 		return nil, "", err
 	}
 
+	// If configured, make sure the node we use to verify payments knows
+	// about the invoice. Otherwise the L402 could never be redeemed.
+	if m.cfg.PaymentHashVerifier != nil {
+		err := m.cfg.PaymentHashVerifier.VerifyPaymentHash(
+			ctx, paymentHash,
+		)
+		if err != nil {
+			return nil, "", fmt.Errorf("payment hash %v not known "+
+				"to node: %w", paymentHash, err)
+		}
+	}
+
 	// TODO(wilmer): remove invoice if any of the operations below fail?
 
+	// Determine any restrictions that should be immediately applied to the
+	// L402. The secret is only needed as long as they allow access.
+	var caveats []l402.Caveat
+	if len(services) > 0 {
+		var err error
+		caveats, err = m.caveatsForServices(ctx, services...)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	expiry := secretExpiry(caveats, services)
+
 	// We can then proceed to mint the L402 with a unique identifier that is
 	// mapped to a unique secret.
-	id, err := createUniqueIdentifier(paymentHash)
-	if err != nil {
-		return nil, "", err
-	}
-	idHash := sha256.Sum256(id)
-	secret, err := m.cfg.Secrets.NewSecret(ctx, idHash)
+	_, rawID, secret, err := m.newIdentifierSecret(
+		ctx, paymentHash, expiry,
+	)
 	if err != nil {
 		return nil, "", err
 	}
 	mac, err := macaroon.New(
-		secret[:], id, "lsat", macaroon.LatestVersion,
+		secret[:], rawID, m.cfg.Location, macaroon.LatestVersion,
 	)
 	if err != nil {
-		// Attempt to revoke the secret to save space.
-		_ = m.cfg.Secrets.RevokeSecret(ctx, idHash)
+		m.discardSecret(ctx, rawID)
 		return nil, "", err
 	}
 
-	// Include any restrictions that should be immediately applied to the
-	// L402.
-	var caveats []l402.Caveat
-	if len(services) > 0 {
-		var err error
-		caveats, err = m.caveatsForServices(ctx, services...)
-		if err != nil {
-			// Attempt to revoke the secret to save space.
-			_ = m.cfg.Secrets.RevokeSecret(ctx, idHash)
-			return nil, "", err
-		}
-	}
 	if err := l402.AddFirstPartyCaveats(mac, caveats...); err != nil {
-		// Attempt to revoke the secret to save space.
-		_ = m.cfg.Secrets.RevokeSecret(ctx, idHash)
+		m.discardSecret(ctx, rawID)
+		return nil, "", err
+	}
+	if err := m.addThirdPartyCaveats(ctx, mac, services...); err != nil {
+		m.discardSecret(ctx, rawID)
 		return nil, "", err
 	}
 
 	return mac, paymentRequest, nil
 }
 
+// discardSecret removes the secret of an L402 that couldn't be minted to save
+// space. The L402 was never handed out, so unlike RevokeL402, this isn't a
+// revocation that is audited.
+func (m *Mint) discardSecret(ctx context.Context, rawID []byte) {
+	_ = m.cfg.Secrets.RevokeSecret(ctx, sha256.Sum256(rawID))
+}
+
+// addThirdPartyCaveats adds a third-party caveat of each configured authority
+// to the given macaroon of an L402 for the given services.
+func (m *Mint) addThirdPartyCaveats(ctx context.Context,
+	mac *macaroon.Macaroon, services ...l402.Service) error {
+
+	for _, authority := range m.cfg.ThirdPartyAuthorities {
+		rootKey, caveatID, err := authority.NewCaveat(ctx, services...)
+		if err != nil {
+			return fmt.Errorf("unable to create third-party "+
+				"caveat for %s: %w", authority.Location(), err)
+		}
+
+		err = mac.AddThirdPartyCaveat(
+			rootKey, caveatID, authority.Location(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RevokeL402 revokes the secret of the L402 with the given identifier, which
+// renders it invalid. If configured, the revocation auditor is notified of the
+// revocation along with the given reason.
+func (m *Mint) RevokeL402(ctx context.Context, id *l402.Identifier,
+	reason string) error {
+
+	var buf bytes.Buffer
+	if err := l402.EncodeIdentifier(&buf, id); err != nil {
+		return err
+	}
+
+	idHash := sha256.Sum256(buf.Bytes())
+	if err := m.cfg.Secrets.RevokeSecret(ctx, idHash); err != nil {
+		return err
+	}
+
+	return m.auditRevocation(ctx, id, reason)
+}
+
+// BatchRevocationError is returned by RevokeL402s if some of the L402s
+// couldn't be revoked.
+type BatchRevocationError struct {
+	// Errors holds the error of each L402 in the order they were passed
+	// in. It is nil for the L402s that were revoked.
+	Errors []error
+}
+
+// Error returns a summary of the failed revocations.
+//
+// NOTE: This is part of the error interface.
+func (e *BatchRevocationError) Error() string {
+	var (
+		numFailed int
+		firstErr  error
+	)
+	for _, err := range e.Errors {
+		if err == nil {
+			continue
+		}
+
+		numFailed++
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return fmt.Sprintf("unable to revoke %d of %d L402s, first error: %v",
+		numFailed, len(e.Errors), firstErr)
+}
+
+// Unwrap returns the errors of the L402s that couldn't be revoked.
+func (e *BatchRevocationError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errors {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// RevokeL402s revokes the secrets of all L402s with the given macaroons. If
+// the secret store supports it, they are revoked at once, otherwise one after
+// the other. A failure to revoke one L402 doesn't stop the others from being
+// revoked. If any of them fails, a *BatchRevocationError reports the error of
+// each L402. If configured, the revocation auditor is notified of every
+// revocation along with the given reason.
+func (m *Mint) RevokeL402s(ctx context.Context,
+	macaroons []*macaroon.Macaroon, reason string) error {
+
+	var (
+		errs     = make([]error, len(macaroons))
+		ids      = make([]*l402.Identifier, len(macaroons))
+		idHashes = make([][sha256.Size]byte, 0, len(macaroons))
+		pending  = make([]int, 0, len(macaroons))
+	)
+	for i, mac := range macaroons {
+		id, err := l402.DecodeIdentifier(bytes.NewReader(mac.Id()))
+		if err != nil {
+			errs[i] = fmt.Errorf("unable to decode identifier: %w",
+				err)
+			continue
+		}
+
+		ids[i] = id
+		idHashes = append(idHashes, sha256.Sum256(mac.Id()))
+		pending = append(pending, i)
+	}
+
+	// If the batch can't be revoked as a whole, we fall back to revoking
+	// the secrets one by one to find out which of them failed.
+	batchRevoked := false
+	if revoker, ok := m.cfg.Secrets.(BatchSecretRevoker); ok &&
+		len(idHashes) > 0 {
+
+		batchRevoked = revoker.RevokeSecrets(ctx, idHashes) == nil
+	}
+
+	for j, i := range pending {
+		if !batchRevoked {
+			err := m.cfg.Secrets.RevokeSecret(ctx, idHashes[j])
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+
+		errs[i] = m.auditRevocation(ctx, ids[i], reason)
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return &BatchRevocationError{Errors: errs}
+		}
+	}
+
+	return nil
+}
+
+// auditRevocation notifies the revocation auditor, if there is one, of the
+// revocation of the L402 with the given identifier.
+func (m *Mint) auditRevocation(ctx context.Context, id *l402.Identifier,
+	reason string) error {
+
+	if m.cfg.RevocationAuditor == nil {
+		return nil
+	}
+
+	now := time.Now
+	if m.cfg.Now != nil {
+		now = m.cfg.Now
+	}
+
+	return m.cfg.RevocationAuditor.AuditRevocation(ctx, &RevocationEvent{
+		TokenID:     id.TokenID,
+		PaymentHash: id.PaymentHash,
+		Timestamp:   now(),
+		Reason:      reason,
+	})
+}
+
 // maximumPrice determines the necessary price to use for a collection
 // of services.
 func maximumPrice(services []l402.Service) int64 {
@@ -177,25 +567,104 @@ func maximumPrice(services []l402.Service) int64 {
 	return max
 }
 
+// secretExpiry returns the time after which the timeout caveats among the
+// given caveats deny access to all of the given services, so the secret of an
+// L402 with these caveats is no longer needed. Further caveats can only
+// restrict access, so an L402 can't outlive this time. If any of the services
+// has no timeout, a zero time is returned, as the L402 never expires.
+func secretExpiry(caveats []l402.Caveat, services []l402.Service) time.Time {
+	if len(services) == 0 {
+		return time.Time{}
+	}
+
+	var expiry time.Time
+	for _, service := range services {
+		condition := service.Name + l402.CondTimeoutSuffix
+
+		var (
+			serviceExpiry time.Time
+			found         bool
+		)
+		for _, caveat := range caveats {
+			if caveat.Condition != condition {
+				continue
+			}
+
+			timestamp, err := strconv.ParseInt(caveat.Value, 10, 64)
+			if err != nil {
+				return time.Time{}
+			}
+
+			// Only the earliest timeout of a service applies.
+			timeout := time.Unix(timestamp, 0)
+			if !found || timeout.Before(serviceExpiry) {
+				serviceExpiry = timeout
+			}
+			found = true
+		}
+
+		if !found {
+			return time.Time{}
+		}
+		if serviceExpiry.After(expiry) {
+			expiry = serviceExpiry
+		}
+	}
+
+	return expiry
+}
+
+// newIdentifierSecret creates a new L402 identifier bound to the payment hash
+// together with the secret it is mapped to. The encoded identifier is returned
+// as well. Should the randomly generated token ID collide with one that
+// already has a secret, a new token ID is generated, so an existing secret is
+// never overwritten.
+func (m *Mint) newIdentifierSecret(ctx context.Context,
+	paymentHash lntypes.Hash, expiry time.Time) (*l402.Identifier, []byte,
+	[l402.SecretSize]byte, error) {
+
+	var noSecret [l402.SecretSize]byte
+	for attempt := 1; ; attempt++ {
+		id, err := m.createUniqueIdentifier(paymentHash)
+		if err != nil {
+			return nil, nil, noSecret, err
+		}
+		var idBuf bytes.Buffer
+		if err := l402.EncodeIdentifier(&idBuf, id); err != nil {
+			return nil, nil, noSecret, err
+		}
+
+		idHash := sha256.Sum256(idBuf.Bytes())
+		secret, err := newSecret(ctx, m.cfg.Secrets, idHash, expiry)
+		switch {
+		case errors.Is(err, ErrSecretExists) &&
+			attempt < maxTokenIDAttempts:
+
+			continue
+
+		case err != nil:
+			return nil, nil, noSecret, err
+		}
+
+		return id, idBuf.Bytes(), secret, nil
+	}
+}
+
 // createUniqueIdentifier creates a new L402 identifier bound to a payment hash
 // and a randomly generated ID.
-func createUniqueIdentifier(paymentHash lntypes.Hash) ([]byte, error) {
-	tokenID, err := generateTokenID()
+func (m *Mint) createUniqueIdentifier(
+	paymentHash lntypes.Hash) (*l402.Identifier, error) {
+
+	tokenID, err := m.newTokenID()
 	if err != nil {
 		return nil, err
 	}
 
-	id := &l402.Identifier{
+	return &l402.Identifier{
 		Version:     l402.LatestVersion,
 		PaymentHash: paymentHash,
 		TokenID:     tokenID,
-	}
-
-	var buf bytes.Buffer
-	if err := l402.EncodeIdentifier(&buf, id); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	}, nil
 }
 
 // generateTokenID generates a new random L402 ID.
@@ -238,6 +707,56 @@ func (m *Mint) caveatsForServices(ctx context.Context,
 	return caveats, nil
 }
 
+// VerificationInfo holds the public metadata describing the L402s minted by
+// a mint. It allows clients to inspect and pre-validate the identifier and
+// caveats of a token offline. Verifying the token's signature still requires
+// access to the mint's secret store.
+type VerificationInfo struct {
+	// IdentifierVersion is the version of the identifier encoding used
+	// for newly minted L402s.
+	IdentifierVersion uint16 `json:"identifier_version"`
+
+	// TokenIDSize is the size in bytes of the random token ID contained
+	// in each identifier.
+	TokenIDSize int `json:"token_id_size"`
+
+	// Location is the location hint of each minted macaroon.
+	Location string `json:"location"`
+
+	// CaveatConditions lists the caveat conditions enforced by the mint.
+	// Service specific conditions are listed by their suffix only.
+	CaveatConditions []string `json:"caveat_conditions"`
+}
+
+// VerificationInfo returns the public metadata describing the L402s minted by
+// the mint.
+func (m *Mint) VerificationInfo() *VerificationInfo {
+	return &VerificationInfo{
+		IdentifierVersion: l402.LatestVersion,
+		TokenIDSize:       l402.TokenIDSize,
+		Location:          m.cfg.Location,
+		CaveatConditions: append([]string{
+			l402.CondServices,
+			l402.CondCapabilitiesSuffix,
+			l402.CondTimeoutSuffix,
+			l402.CondLabelSuffix,
+			l402.CondMethodsSuffix,
+			l402.CondDowngradeSuffix,
+		}, m.customConditions()...),
+	}
+}
+
+// customConditions returns the sorted conditions of all custom satisfiers.
+func (m *Mint) customConditions() []string {
+	conditions := make([]string, 0, len(m.cfg.CustomSatisfiers))
+	for condition := range m.cfg.CustomSatisfiers {
+		conditions = append(conditions, condition)
+	}
+	sort.Strings(conditions)
+
+	return conditions
+}
+
 // VerificationParams holds all of the requirements to properly verify an L402.
 type VerificationParams struct {
 	// Macaroon is the macaroon as part of the L402 we'll attempt to verify.
@@ -247,53 +766,131 @@ type VerificationParams struct {
 	// hash.
 	Preimage lntypes.Preimage
 
+	// AllowPendingPreimage allows an all-zero preimage, which clients send
+	// while their payment is still pending. The L402 is then verified
+	// without its preimage, so the caller must prove the payment otherwise
+	// by checking that the invoice of the L402's payment hash was paid.
+	// This is needed for hold invoices, as the payer only learns their
+	// preimage once they are settled.
+	AllowPendingPreimage bool
+
 	// TargetService is the target service a user of an L402 is attempting
 	// to access.
 	TargetService string
+
+	// TargetCapability is the optional capability of the target service a
+	// user of an L402 is attempting to access. If set, any capability
+	// downgrade caveats of the L402 are enforced as well.
+	TargetCapability string
+
+	// TargetMethod is the HTTP method of the request the L402 was
+	// presented with. Any methods caveat of the target service must allow
+	// it, so an L402 with such a caveat is rejected if the method is
+	// unknown.
+	TargetMethod string
+
+	// Discharges are the discharge macaroons of the third-party caveats of
+	// the L402, bound to its macaroon. Each third-party caveat must be
+	// discharged for the L402 to be valid, and the first-party caveats of
+	// the discharges are enforced like those of the L402 itself.
+	Discharges []*macaroon.Macaroon
+
+	// Header is the optional header of the request the L402 was presented
+	// with. It allows custom satisfiers to check caveats against request
+	// attributes.
+	Header http.Header
 }
 
 // VerifyL402 attempts to verify an L402 with the given parameters.
 func (m *Mint) VerifyL402(ctx context.Context,
 	params *VerificationParams) error {
 
+	// A zero preimage is what clients use while their payment is still
+	// pending, so it can never be valid on its own.
+	pending := params.Preimage == (lntypes.Preimage{})
+	switch {
+	// The caller verifies the payment of the L402 itself.
+	case pending && params.AllowPendingPreimage:
+
+	case pending && m.cfg.StrictPreimage:
+		return ErrPendingPreimage
+
 	// We'll first perform a quick check to determine if a valid preimage
-	// was provided.
-	id, err := l402.DecodeIdentifier(bytes.NewReader(params.Macaroon.Id()))
-	if err != nil {
-		return err
-	}
-	if params.Preimage.Hash() != id.PaymentHash {
-		return fmt.Errorf("invalid preimage %v for %v", params.Preimage,
-			id.PaymentHash)
+	// was provided, so we don't look up the secret of invalid L402s.
+	default:
+		err := l402.VerifyPreimage(params.Macaroon, params.Preimage)
+		if err != nil {
+			return err
+		}
 	}
 
-	// If there was, then we'll ensure the L402 was minted by us.
+	// If there was, then we'll ensure the L402 was minted by us and that
+	// its caveats authorize access to the target service.
 	secret, err := m.cfg.Secrets.GetSecret(
 		ctx, sha256.Sum256(params.Macaroon.Id()),
 	)
 	if err != nil {
 		return err
 	}
-	rawCaveats, err := params.Macaroon.VerifySignature(secret[:], nil)
+
+	// The custom satisfiers come first, so a built-in satisfier of the
+	// same condition takes precedence.
+	satisfiers := make(
+		[]l402.Satisfier, 0, len(m.cfg.CustomSatisfiers)+2,
+	)
+	for condition, newSatisfier := range m.cfg.CustomSatisfiers {
+		satisfier := newSatisfier(params)
+		satisfier.Condition = condition
+		if m.cfg.StrictCaveatChains {
+			satisfier = l402.NewStrictSatisfier(satisfier)
+		}
+		satisfiers = append(satisfiers, satisfier)
+	}
+
+	satisfiers = append(satisfiers, l402.NewMethodSatisfier(
+		params.TargetService, params.TargetMethod,
+	))
+	if params.TargetCapability != "" {
+		satisfiers = append(satisfiers, l402.NewDowngradeSatisfier(
+			params.TargetService, params.TargetCapability,
+			m.cfg.Now,
+		))
+	}
+
+	// The preimage was already verified above.
+	err = l402.VerifyMacaroonWithoutPreimage(
+		params.Macaroon, params.Discharges, secret,
+		params.TargetService, m.cfg.Now, satisfiers...,
+	)
 	if err != nil {
 		return err
 	}
 
-	// With the L402 verified, we'll now inspect its caveats to ensure the
-	// target service is authorized.
-	caveats := make([]l402.Caveat, 0, len(rawCaveats))
-	for _, rawCaveat := range rawCaveats {
-		// L402s can contain third-party caveats that we're not aware
-		// of, so just skip those.
-		caveat, err := l402.DecodeCaveat(rawCaveat)
-		if err != nil {
-			continue
+	// Unless explicitly disallowed, an L402 without a services caveat is
+	// authorized to access any service. The first-party caveats of the
+	// discharges restrict access as well, so they are taken into account.
+	if !m.cfg.RequireServicesCaveat {
+		return nil
+	}
+	for _, mac := range append(
+		[]*macaroon.Macaroon{params.Macaroon}, params.Discharges...,
+	) {
+
+		if _, ok := l402.HasCaveat(mac, l402.CondServices); ok {
+			return nil
 		}
-		caveats = append(caveats, caveat)
 	}
-	return l402.VerifyCaveats(
-		caveats,
-		l402.NewServicesSatisfier(params.TargetService),
-		l402.NewTimeoutSatisfier(params.TargetService, m.cfg.Now),
-	)
+
+	return ErrMissingServicesCaveat
+}
+
+// hasCondition returns true if any of the given caveats has the condition.
+func hasCondition(caveats []l402.Caveat, condition string) bool {
+	for _, caveat := range caveats {
+		if caveat.Condition == condition {
+			return true
+		}
+	}
+
+	return false
 }
@@ -1,13 +1,18 @@
 package mint
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/lightninglabs/aperture/l402"
+	"github.com/lightningnetwork/lnd/lntypes"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/macaroon.v2"
 )
@@ -56,6 +61,46 @@ func TestBasicL402(t *testing.T) {
 	}
 }
 
+// serviceChallenger is a challenger that records the services it creates
+// challenges for.
+type serviceChallenger struct {
+	*mockChallenger
+
+	services []string
+}
+
+func (c *serviceChallenger) NewServiceChallenge(service string,
+	price int64) (string, lntypes.Hash, error) {
+
+	c.services = append(c.services, service)
+	return c.NewChallenge(price)
+}
+
+// TestServiceChallenge ensures that challengers that support it create
+// challenges for the service an L402 is minted for.
+func TestServiceChallenge(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	challenger := &serviceChallenger{mockChallenger: newMockChallenger()}
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     challenger,
+		ServiceLimiter: newMockServiceLimiter(),
+		Now:            time.Now,
+	})
+
+	_, _, err := mint.MintL402(ctx, testService)
+	require.NoError(t, err)
+
+	// With several services, the challenge can't describe a single one.
+	otherService := l402.Service{Name: "other", Tier: l402.BaseTier}
+	_, _, err = mint.MintL402(ctx, testService, otherService)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{testService.Name, ""}, challenger.services)
+}
+
 // TestAdminL402 ensures that an admin L402 (one without a services caveat) is
 // authorized to access any service.
 func TestAdminL402(t *testing.T) {
@@ -87,6 +132,106 @@ func TestAdminL402(t *testing.T) {
 	}
 }
 
+// TestAdminL402Disallowed ensures that an L402 without a services caveat is
+// rejected if admin L402s are disallowed.
+func TestAdminL402Disallowed(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mint := New(&Config{
+		Secrets:               newMockSecretStore(),
+		Challenger:            newMockChallenger(),
+		ServiceLimiter:        newMockServiceLimiter(),
+		RequireServicesCaveat: true,
+		Now:                   time.Now,
+	})
+
+	// An L402 without a services caveat must be denied.
+	macaroon, _, err := mint.MintL402(ctx)
+	require.NoError(t, err)
+
+	params := &VerificationParams{
+		Macaroon:      macaroon,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	}
+	err = mint.VerifyL402(ctx, params)
+	require.ErrorIs(t, err, ErrMissingServicesCaveat)
+
+	// An L402 restricted to the target service is still authorized.
+	macaroon, _, err = mint.MintL402(ctx, testService)
+	require.NoError(t, err)
+
+	params.Macaroon = macaroon
+	require.NoError(t, mint.VerifyL402(ctx, params))
+}
+
+// TestStrictPreimage ensures that a zero preimage is rejected with a specific
+// error if strict preimage validation is enabled.
+func TestStrictPreimage(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+		StrictPreimage: true,
+		Now:            time.Now,
+	})
+
+	macaroon, _, err := mint.MintL402(ctx, testService)
+	require.NoError(t, err)
+
+	params := &VerificationParams{
+		Macaroon:      macaroon,
+		TargetService: testService.Name,
+	}
+	err = mint.VerifyL402(ctx, params)
+	require.ErrorIs(t, err, ErrPendingPreimage)
+
+	params.Preimage = testPreimage
+	require.NoError(t, mint.VerifyL402(ctx, params))
+}
+
+// TestPendingPreimage ensures that a zero preimage is only accepted if the
+// caller proves the payment itself, and that the rest of the L402 is still
+// verified in that case.
+func TestPendingPreimage(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+		StrictPreimage: true,
+		Now:            time.Now,
+	})
+
+	macaroon, _, err := mint.MintL402(ctx, testService)
+	require.NoError(t, err)
+
+	params := &VerificationParams{
+		Macaroon:      macaroon,
+		TargetService: testService.Name,
+	}
+	err = mint.VerifyL402(ctx, params)
+	require.ErrorIs(t, err, ErrPendingPreimage)
+
+	params.AllowPendingPreimage = true
+	require.NoError(t, mint.VerifyL402(ctx, params))
+
+	// A wrong preimage is still rejected.
+	params.Preimage = lntypes.Preimage{1}
+	require.Error(t, mint.VerifyL402(ctx, params))
+
+	// So are the caveats of the L402.
+	params.Preimage = lntypes.Preimage{}
+	params.TargetService = "other"
+	require.Error(t, mint.VerifyL402(ctx, params))
+}
+
 // TestRevokedL402 ensures that we can no longer verify a revoked L402.
 func TestRevokedL402(t *testing.T) {
 	t.Parallel()
@@ -123,6 +268,48 @@ func TestRevokedL402(t *testing.T) {
 	}
 }
 
+// TestRevocationAudit ensures that revoking an L402 through the mint emits
+// exactly one audit event with the expected fields.
+func TestRevocationAudit(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	auditor := &mockRevocationAuditor{}
+	now := time.Unix(1700000000, 0)
+	mint := New(&Config{
+		Secrets:           newMockSecretStore(),
+		Challenger:        newMockChallenger(),
+		ServiceLimiter:    newMockServiceLimiter(),
+		RevocationAuditor: auditor,
+		Now: func() time.Time {
+			return now
+		},
+	})
+
+	mac, _, err := mint.MintL402(ctx)
+	require.NoError(t, err)
+	require.Empty(t, auditor.events)
+
+	id, err := l402.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	require.NoError(t, err)
+
+	require.NoError(t, mint.RevokeL402(ctx, id, "compromised"))
+	require.Equal(t, []*RevocationEvent{{
+		TokenID:     id.TokenID,
+		PaymentHash: testHash,
+		Timestamp:   now,
+		Reason:      "compromised",
+	}}, auditor.events)
+
+	// The L402 can no longer be verified.
+	err = mint.VerifyL402(ctx, &VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	})
+	require.ErrorIs(t, err, ErrSecretNotFound)
+}
+
 // TestTamperedL402 ensures that an L402 that has been tampered with by
 // modifying its signature results in its verification failing.
 func TestTamperedL402(t *testing.T) {
@@ -233,6 +420,44 @@ func TestDemotedServicesL402(t *testing.T) {
 	}
 }
 
+// TestWidenedServicesL402 ensures that an L402 can't gain access to a service
+// it wasn't authorized for by adding a services caveat that includes it.
+func TestWidenedServicesL402(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+		Now:            time.Now,
+	})
+
+	otherService := testService
+	otherService.Name = "other"
+
+	// Mint an L402 that is only able to access a single service.
+	mac, _, err := mint.MintL402(ctx, testService)
+	require.NoError(t, err)
+
+	// Attempt to widen its access by adding a services caveat that also
+	// includes another service.
+	services, err := l402.NewServicesCaveat(testService, otherService)
+	require.NoError(t, err)
+	require.NoError(t, l402.AddFirstPartyCaveats(mac, services))
+
+	// Neither service should be accessible anymore, as the chain of
+	// services caveats is invalid.
+	for _, service := range []l402.Service{testService, otherService} {
+		err := mint.VerifyL402(ctx, &VerificationParams{
+			Macaroon:      mac,
+			Preimage:      testPreimage,
+			TargetService: service.Name,
+		})
+		require.ErrorIs(t, err, l402.ErrCaveatWidening)
+	}
+}
+
 // TestExpiredServicesL402 asserts the behavior of the Timeout caveat.
 func TestExpiredServicesL402(t *testing.T) {
 	t.Parallel()
@@ -278,6 +503,599 @@ func TestExpiredServicesL402(t *testing.T) {
 	require.Contains(t, err.Error(), "not authorized")
 }
 
+// TestSecretExpiry makes sure the secret of an L402 expires once its timeout
+// caveats deny access to all of its services.
+func TestSecretExpiry(t *testing.T) {
+	t.Parallel()
+
+	var (
+		svcA = l402.Service{Name: "a"}
+		svcB = l402.Service{Name: "b"}
+	)
+	timeout := func(service l402.Service, timestamp string) l402.Caveat {
+		return l402.NewCaveat(
+			service.Name+l402.CondTimeoutSuffix, timestamp,
+		)
+	}
+
+	testCases := []struct {
+		name     string
+		caveats  []l402.Caveat
+		services []l402.Service
+		expiry   int64
+	}{{
+		name:     "no services",
+		caveats:  []l402.Caveat{timeout(svcA, "100")},
+		services: nil,
+	}, {
+		name:     "no timeout",
+		services: []l402.Service{svcA},
+	}, {
+		name:     "single service",
+		caveats:  []l402.Caveat{timeout(svcA, "100")},
+		services: []l402.Service{svcA},
+		expiry:   100,
+	}, {
+		name: "earliest timeout of a service",
+		caveats: []l402.Caveat{
+			timeout(svcA, "100"), timeout(svcA, "50"),
+		},
+		services: []l402.Service{svcA},
+		expiry:   50,
+	}, {
+		name: "latest timeout of all services",
+		caveats: []l402.Caveat{
+			timeout(svcA, "100"), timeout(svcB, "200"),
+		},
+		services: []l402.Service{svcA, svcB},
+		expiry:   200,
+	}, {
+		name:     "service without timeout",
+		caveats:  []l402.Caveat{timeout(svcA, "100")},
+		services: []l402.Service{svcA, svcB},
+	}, {
+		name:     "invalid timeout",
+		caveats:  []l402.Caveat{timeout(svcA, "invalid")},
+		services: []l402.Service{svcA},
+	}}
+
+	for _, tc := range testCases {
+		expiry := secretExpiry(tc.caveats, tc.services)
+		if tc.expiry == 0 {
+			require.True(t, expiry.IsZero(), tc.name)
+			continue
+		}
+
+		require.Equal(t, tc.expiry, expiry.Unix(), tc.name)
+	}
+
+	// The mint stores the expiry along with the secret.
+	secrets := newMockSecretStore()
+	limiter := newMockServiceLimiter()
+	limiter.timeouts[testService] = timeout(testService, "1234")
+	mint := New(&Config{
+		Secrets:        secrets,
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: limiter,
+	})
+
+	mac, _, err := mint.MintL402(context.Background(), testService)
+	require.NoError(t, err)
+
+	expiry := secrets.expiries[sha256.Sum256(mac.Id())]
+	require.EqualValues(t, 1234, expiry.Unix())
+
+	// Stores that can't record an expiry still get the secret, which then
+	// never expires.
+	secrets = newMockSecretStore()
+	mint = New(&Config{
+		Secrets:        struct{ SecretStore }{secrets},
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: limiter,
+	})
+
+	mac, _, err = mint.MintL402(context.Background(), testService)
+	require.NoError(t, err)
+
+	expiry, ok := secrets.expiries[sha256.Sum256(mac.Id())]
+	require.True(t, ok)
+	require.True(t, expiry.IsZero())
+}
+
+// TestPaymentHashVerification ensures that an L402 is only minted if the
+// configured verifier knows about the challenge's payment hash.
+func TestPaymentHashVerification(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	secrets := newMockSecretStore()
+	mint := New(&Config{
+		Secrets:             secrets,
+		Challenger:          newMockChallenger(),
+		ServiceLimiter:      newMockServiceLimiter(),
+		PaymentHashVerifier: newMockPaymentHashVerifier(),
+		Now:                 time.Now,
+	})
+
+	// The challenger returns a payment hash the node doesn't know about,
+	// so minting must fail without storing a secret.
+	_, _, err := mint.MintL402(ctx, testService)
+	require.ErrorContains(t, err, "not known to node")
+	require.Empty(t, secrets.secrets)
+
+	// Once the node knows about the payment hash, minting succeeds.
+	mint = New(&Config{
+		Secrets:             secrets,
+		Challenger:          newMockChallenger(),
+		ServiceLimiter:      newMockServiceLimiter(),
+		PaymentHashVerifier: newMockPaymentHashVerifier(testHash),
+		Now:                 time.Now,
+	})
+	mac, _, err := mint.MintL402(ctx, testService)
+	require.NoError(t, err)
+	require.NoError(t, mint.VerifyL402(ctx, &VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	}))
+}
+
+// TestVerificationInfo ensures the published verification metadata matches the
+// L402s actually minted.
+func TestVerificationInfo(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+		Now:            time.Now,
+	})
+
+	mac, _, err := mint.MintL402(ctx, testService)
+	require.NoError(t, err)
+
+	info := mint.VerificationInfo()
+	require.Equal(t, mac.Location(), info.Location)
+
+	id, err := l402.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	require.NoError(t, err)
+	require.Equal(t, id.Version, info.IdentifierVersion)
+	require.Len(t, id.TokenID, info.TokenIDSize)
+	require.Equal(t, []string{
+		l402.CondServices, l402.CondCapabilitiesSuffix,
+		l402.CondTimeoutSuffix, l402.CondLabelSuffix,
+		l402.CondMethodsSuffix, l402.CondDowngradeSuffix,
+	}, info.CaveatConditions)
+}
+
+// TestMacaroonLocation asserts that minted L402s carry the configured location
+// and can still be verified.
+func TestMacaroonLocation(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	newMint := func(location string) *Mint {
+		return New(&Config{
+			Secrets:        newMockSecretStore(),
+			Challenger:     newMockChallenger(),
+			ServiceLimiter: newMockServiceLimiter(),
+			Location:       location,
+			Now:            time.Now,
+		})
+	}
+
+	// Without a location, the default one is used.
+	mac, _, err := newMint("").MintL402(ctx, testService)
+	require.NoError(t, err)
+	require.Equal(t, DefaultLocation, mac.Location())
+
+	mint := newMint("example.com")
+	mac, _, err = mint.MintL402(ctx, testService)
+	require.NoError(t, err)
+	require.Equal(t, "example.com", mac.Location())
+	require.Equal(t, "example.com", mint.VerificationInfo().Location)
+
+	// The location survives a round trip through the serialized macaroon.
+	macBytes, err := mac.MarshalBinary()
+	require.NoError(t, err)
+	decodedMac := &macaroon.Macaroon{}
+	require.NoError(t, decodedMac.UnmarshalBinary(macBytes))
+	require.Equal(t, "example.com", decodedMac.Location())
+
+	params := VerificationParams{
+		Macaroon:      decodedMac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	}
+	require.NoError(t, mint.VerifyL402(ctx, &params))
+}
+
+// TestDowngradedCapabilitiesL402 asserts that premium capabilities are only
+// authorized until an L402's capabilities are downgraded.
+func TestDowngradedCapabilitiesL402(t *testing.T) {
+	t.Parallel()
+
+	initialTime := int64(1000)
+	mockTime := newMockTime(initialTime)
+
+	ctx := context.Background()
+	serviceLimiter := newMockServiceLimiter()
+	serviceLimiter.constraints[testService] = []l402.Caveat{
+		l402.NewDowngradeCaveat(
+			testService.Name, 1000, "base", mockTime.now,
+		),
+	}
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: serviceLimiter,
+		Now:            mockTime.now,
+	})
+
+	mac, _, err := mint.MintL402(ctx, testService)
+	require.NoError(t, err)
+
+	premiumParams := VerificationParams{
+		Macaroon:         mac,
+		Preimage:         testPreimage,
+		TargetService:    testService.Name,
+		TargetCapability: "premium",
+	}
+	baseParams := premiumParams
+	baseParams.TargetCapability = "base"
+
+	// Before the downgrade, the premium capability is authorized.
+	require.NoError(t, mint.VerifyL402(ctx, &premiumParams))
+	require.NoError(t, mint.VerifyL402(ctx, &baseParams))
+
+	// Once the downgrade time has passed, only the base tier is.
+	mockTime.setTime(initialTime + 1001)
+	err = mint.VerifyL402(ctx, &premiumParams)
+	require.ErrorContains(t, err, "not authorized after downgrade")
+	require.NoError(t, mint.VerifyL402(ctx, &baseParams))
+}
+
+// TestLabeledL402 asserts that a minted L402 carries the configured label and
+// that the label is verified without restricting access.
+func TestLabeledL402(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	serviceLimiter := newMockServiceLimiter()
+	serviceLimiter.constraints[testService] = []l402.Caveat{
+		l402.NewLabelCaveat(testService.Name, "campaign-1"),
+	}
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: serviceLimiter,
+		Now:            time.Now,
+	})
+
+	mac, _, err := mint.MintL402(ctx, testService)
+	require.NoError(t, err)
+
+	label, ok := l402.HasCaveat(
+		mac, testService.Name+l402.CondLabelSuffix,
+	)
+	require.True(t, ok)
+	require.Equal(t, "campaign-1", label)
+
+	params := VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	}
+	require.NoError(t, mint.VerifyL402(ctx, &params))
+
+	// The label survives a round trip through the serialized macaroon.
+	macBytes, err := mac.MarshalBinary()
+	require.NoError(t, err)
+	decodedMac := &macaroon.Macaroon{}
+	require.NoError(t, decodedMac.UnmarshalBinary(macBytes))
+
+	label, ok = l402.HasCaveat(
+		decodedMac, testService.Name+l402.CondLabelSuffix,
+	)
+	require.True(t, ok)
+	require.Equal(t, "campaign-1", label)
+
+	params.Macaroon = decodedMac
+	require.NoError(t, mint.VerifyL402(ctx, &params))
+
+	// The holder of the L402 can't relabel it.
+	relabeledMac := mac.Clone()
+	err = l402.AddFirstPartyCaveats(
+		relabeledMac, l402.NewLabelCaveat(testService.Name, "other"),
+	)
+	require.NoError(t, err)
+	params.Macaroon = relabeledMac
+	err = mint.VerifyL402(ctx, &params)
+	require.ErrorIs(t, err, l402.ErrCaveatWidening)
+}
+
+// TestMethodRestrictedL402 asserts that an L402 with a methods caveat is only
+// authorized for requests with one of its methods.
+func TestMethodRestrictedL402(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	serviceLimiter := newMockServiceLimiter()
+	serviceLimiter.constraints[testService] = []l402.Caveat{
+		l402.NewMethodCaveat(testService.Name, "GET", "HEAD"),
+	}
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: serviceLimiter,
+		Now:            time.Now,
+	})
+
+	mac, _, err := mint.MintL402(ctx, testService)
+	require.NoError(t, err)
+
+	params := VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+		TargetMethod:  "GET",
+	}
+	require.NoError(t, mint.VerifyL402(ctx, &params))
+
+	params.TargetMethod = "POST"
+	require.ErrorContains(
+		t, mint.VerifyL402(ctx, &params), "method POST not authorized",
+	)
+
+	// Without a method, the restriction can't be checked.
+	params.TargetMethod = ""
+	require.Error(t, mint.VerifyL402(ctx, &params))
+
+	// The holder of the L402 can't add methods.
+	widenedMac := mac.Clone()
+	err = l402.AddFirstPartyCaveats(
+		widenedMac, l402.NewMethodCaveat(testService.Name, "POST"),
+	)
+	require.NoError(t, err)
+	params.Macaroon = widenedMac
+	params.TargetMethod = "POST"
+	err = mint.VerifyL402(ctx, &params)
+	require.ErrorIs(t, err, l402.ErrCaveatWidening)
+}
+
+// mockAuthority is a third-party authority that uses a fixed root key for all
+// of its discharge macaroons.
+type mockAuthority struct {
+	rootKey []byte
+	err     error
+}
+
+func (a *mockAuthority) Location() string {
+	return "https://identity.example.com"
+}
+
+func (a *mockAuthority) NewCaveat(context.Context,
+	...l402.Service) ([]byte, []byte, error) {
+
+	return a.rootKey, []byte("user-is-verified"), a.err
+}
+
+// TestFailedMintNotAudited asserts that the secret of an L402 that couldn't be
+// minted is removed without reporting a revocation to the auditor.
+func TestFailedMintNotAudited(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	secrets := newMockSecretStore()
+	auditor := &mockRevocationAuditor{}
+	mint := New(&Config{
+		Secrets:           secrets,
+		Challenger:        newMockChallenger(),
+		ServiceLimiter:    newMockServiceLimiter(),
+		RevocationAuditor: auditor,
+		ThirdPartyAuthorities: []ThirdPartyAuthority{&mockAuthority{
+			err: errors.New("authority unavailable"),
+		}},
+		Now: time.Now,
+	})
+
+	_, _, err := mint.MintL402(ctx, testService)
+	require.ErrorContains(t, err, "authority unavailable")
+	require.Empty(t, secrets.secrets)
+	require.Empty(t, auditor.events)
+}
+
+// TestThirdPartyCaveat asserts that an L402 with a third-party caveat is only
+// valid together with a discharge macaroon bound to it.
+func TestThirdPartyCaveat(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	authority := &mockAuthority{rootKey: []byte("discharge-root-key")}
+	mint := New(&Config{
+		Secrets:               newMockSecretStore(),
+		Challenger:            newMockChallenger(),
+		ServiceLimiter:        newMockServiceLimiter(),
+		ThirdPartyAuthorities: []ThirdPartyAuthority{authority},
+		Now:                   time.Now,
+	})
+
+	mac, _, err := mint.MintL402(ctx, testService)
+	require.NoError(t, err)
+
+	var thirdPartyCaveats []macaroon.Caveat
+	for _, caveat := range mac.Caveats() {
+		if len(caveat.VerificationId) > 0 {
+			thirdPartyCaveats = append(thirdPartyCaveats, caveat)
+		}
+	}
+	require.Len(t, thirdPartyCaveats, 1)
+	require.Equal(t, authority.Location(), thirdPartyCaveats[0].Location)
+
+	// Without a discharge, the L402 isn't valid.
+	params := VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	}
+	require.Error(t, mint.VerifyL402(ctx, &params))
+
+	// The authority issues the discharge, which the client binds to the
+	// L402.
+	discharge, err := macaroon.New(
+		authority.rootKey, thirdPartyCaveats[0].Id,
+		authority.Location(), macaroon.LatestVersion,
+	)
+	require.NoError(t, err)
+
+	// An unbound discharge isn't accepted.
+	params.Discharges = []*macaroon.Macaroon{discharge}
+	require.Error(t, mint.VerifyL402(ctx, &params))
+
+	bound := discharge.Clone()
+	bound.Bind(mac.Signature())
+	params.Discharges = []*macaroon.Macaroon{bound}
+	require.NoError(t, mint.VerifyL402(ctx, &params))
+
+	// The first-party caveats of the discharge are enforced as well.
+	restricted := discharge.Clone()
+	err = l402.AddFirstPartyCaveats(
+		restricted, l402.NewMethodCaveat(testService.Name, "GET"),
+	)
+	require.NoError(t, err)
+	restricted.Bind(mac.Signature())
+	params.Discharges = []*macaroon.Macaroon{restricted}
+	params.TargetMethod = "POST"
+	require.Error(t, mint.VerifyL402(ctx, &params))
+
+	params.TargetMethod = "GET"
+	require.NoError(t, mint.VerifyL402(ctx, &params))
+}
+
+// TestCustomSatisfier asserts that a caveat claimed by a custom satisfier is
+// enforced, while other unknown caveats are still ignored.
+func TestCustomSatisfier(t *testing.T) {
+	t.Parallel()
+
+	const deviceCondition = "device"
+
+	ctx := context.Background()
+	serviceLimiter := newMockServiceLimiter()
+	serviceLimiter.constraints[testService] = []l402.Caveat{{
+		Condition: deviceCondition,
+		Value:     "phone",
+	}, {
+		Condition: "unclaimed",
+		Value:     "anything",
+	}}
+
+	// The device satisfier authorizes requests that carry the device
+	// header value of the caveat.
+	newDeviceSatisfier := func(params *VerificationParams) l402.Satisfier {
+		return l402.Satisfier{
+			SatisfyPrevious: func(prev, cur l402.Caveat) error {
+				if prev.Value != cur.Value {
+					return fmt.Errorf("device changed")
+				}
+				return nil
+			},
+			SatisfyFinal: func(c l402.Caveat) error {
+				device := params.Header.Get("Device")
+				if device != c.Value {
+					return fmt.Errorf("device %q not "+
+						"authorized", device)
+				}
+				return nil
+			},
+		}
+	}
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: serviceLimiter,
+		Now:            time.Now,
+		CustomSatisfiers: map[string]SatisfierFactory{
+			deviceCondition: newDeviceSatisfier,
+		},
+	})
+
+	mac, _, err := mint.MintL402(ctx, testService)
+	require.NoError(t, err)
+
+	params := VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+		Header:        http.Header{"Device": []string{"phone"}},
+	}
+	require.NoError(t, mint.VerifyL402(ctx, &params))
+
+	// A request from a different device is denied.
+	params.Header = http.Header{"Device": []string{"laptop"}}
+	err = mint.VerifyL402(ctx, &params)
+	require.ErrorContains(t, err, "device \"laptop\" not authorized")
+
+	// So is a request without any device.
+	params.Header = nil
+	require.Error(t, mint.VerifyL402(ctx, &params))
+
+	// The custom condition is advertised along with the built-in ones.
+	info := mint.VerificationInfo()
+	require.Contains(t, info.CaveatConditions, deviceCondition)
+	require.NotContains(t, info.CaveatConditions, "unclaimed")
+}
+
+// TestStrictCaveatChains makes sure a chain of custom caveats whose satisfier
+// can't compare them is only rejected if strict caveat chains are enabled.
+func TestStrictCaveatChains(t *testing.T) {
+	t.Parallel()
+
+	const deviceCondition = "device"
+
+	ctx := context.Background()
+	newDeviceSatisfier := func(*VerificationParams) l402.Satisfier {
+		return l402.Satisfier{
+			SatisfyFinal: func(l402.Caveat) error {
+				return nil
+			},
+		}
+	}
+
+	for _, strict := range []bool{false, true} {
+		mint := New(&Config{
+			Secrets:        newMockSecretStore(),
+			Challenger:     newMockChallenger(),
+			ServiceLimiter: newMockServiceLimiter(),
+			Now:            time.Now,
+			CustomSatisfiers: map[string]SatisfierFactory{
+				deviceCondition: newDeviceSatisfier,
+			},
+			StrictCaveatChains: strict,
+		})
+
+		mac, _, err := mint.MintL402(ctx, testService)
+		require.NoError(t, err)
+		require.NoError(t, l402.AddFirstPartyCaveats(
+			mac,
+			l402.Caveat{Condition: deviceCondition, Value: "a"},
+			l402.Caveat{Condition: deviceCondition, Value: "b"},
+		))
+
+		err = mint.VerifyL402(ctx, &VerificationParams{
+			Macaroon:      mac,
+			Preimage:      testPreimage,
+			TargetService: testService.Name,
+		})
+		if strict {
+			require.ErrorIs(t, err, l402.ErrCaveatWidening)
+		} else {
+			require.NoError(t, err)
+		}
+	}
+}
+
 type mockTime struct {
 	time time.Time
 }
@@ -295,3 +1113,191 @@ func (mt *mockTime) now() time.Time {
 func (mt *mockTime) setTime(timestamp int64) {
 	mt.time = time.Unix(timestamp, 0)
 }
+
+// TestTokenIDCollision asserts that minting retries with a fresh token ID if
+// the secret of a generated ID already exists, and that an existing secret is
+// never overwritten.
+func TestTokenIDCollision(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	secrets := newMockSecretStore()
+	mint := New(&Config{
+		Secrets:        secrets,
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+		Now:            time.Now,
+	})
+
+	// Token IDs are taken from the list, repeating the last one once the
+	// list is exhausted.
+	var (
+		tokenIDs [][l402.TokenIDSize]byte
+		numCalls int
+	)
+	mint.newTokenID = func() ([l402.TokenIDSize]byte, error) {
+		numCalls++
+		if len(tokenIDs) > 1 {
+			id := tokenIDs[0]
+			tokenIDs = tokenIDs[1:]
+			return id, nil
+		}
+
+		return tokenIDs[0], nil
+	}
+	tokenID := func(mac *macaroon.Macaroon) [l402.TokenIDSize]byte {
+		id, err := l402.DecodeIdentifier(bytes.NewReader(mac.Id()))
+		require.NoError(t, err)
+
+		return id.TokenID
+	}
+
+	firstID := [l402.TokenIDSize]byte{1}
+	tokenIDs = [][l402.TokenIDSize]byte{firstID}
+	firstMac, _, err := mint.MintL402(ctx, testService)
+	require.NoError(t, err)
+	require.Equal(t, firstID, tokenID(firstMac))
+	require.Len(t, secrets.secrets, 1)
+
+	existing := make(map[[sha256.Size]byte][l402.SecretSize]byte)
+	for idHash, secret := range secrets.secrets {
+		existing[idHash] = secret
+	}
+
+	// A colliding token ID is replaced by a fresh one.
+	secondID := [l402.TokenIDSize]byte{2}
+	tokenIDs = [][l402.TokenIDSize]byte{firstID, firstID, secondID}
+	numCalls = 0
+	secondMac, _, err := mint.MintL402(ctx, testService)
+	require.NoError(t, err)
+	require.Equal(t, 3, numCalls)
+	require.Equal(t, secondID, tokenID(secondMac))
+	require.Len(t, secrets.secrets, 2)
+
+	// If every attempt collides, minting fails.
+	tokenIDs = [][l402.TokenIDSize]byte{firstID}
+	numCalls = 0
+	_, _, err = mint.MintL402(ctx, testService)
+	require.ErrorIs(t, err, ErrSecretExists)
+	require.Equal(t, maxTokenIDAttempts, numCalls)
+
+	// The first secret was never overwritten, so its L402 still verifies.
+	for idHash, secret := range existing {
+		require.Equal(t, secret, secrets.secrets[idHash])
+	}
+	params := VerificationParams{
+		Macaroon:      firstMac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	}
+	require.NoError(t, mint.VerifyL402(ctx, &params))
+}
+
+// batchSecretStore is a secret store that supports batch revocations and
+// fails to revoke a single secret.
+type batchSecretStore struct {
+	*mockSecretStore
+
+	failHash    [sha256.Size]byte
+	batchCalled bool
+}
+
+func (s *batchSecretStore) RevokeSecret(ctx context.Context,
+	id [sha256.Size]byte) error {
+
+	if id == s.failHash {
+		return errors.New("revocation failed")
+	}
+
+	return s.mockSecretStore.RevokeSecret(ctx, id)
+}
+
+func (s *batchSecretStore) RevokeSecrets(ctx context.Context,
+	ids [][sha256.Size]byte) error {
+
+	s.batchCalled = true
+	for _, id := range ids {
+		if id == s.failHash {
+			return errors.New("batch revocation failed")
+		}
+	}
+	for _, id := range ids {
+		delete(s.secrets, id)
+	}
+
+	return nil
+}
+
+// TestRevokeL402s ensures that many L402s can be revoked at once and that the
+// failure to revoke one of them is reported without affecting the others.
+func TestRevokeL402s(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	store := &batchSecretStore{mockSecretStore: newMockSecretStore()}
+	auditor := &mockRevocationAuditor{}
+	mint := New(&Config{
+		Secrets:           store,
+		Challenger:        newMockChallenger(),
+		ServiceLimiter:    newMockServiceLimiter(),
+		RevocationAuditor: auditor,
+	})
+
+	mintL402s := func(n int) []*macaroon.Macaroon {
+		macs := make([]*macaroon.Macaroon, n)
+		for i := range macs {
+			mac, _, err := mint.MintL402(ctx)
+			require.NoError(t, err)
+			macs[i] = mac
+		}
+
+		return macs
+	}
+	requireRevoked := func(mac *macaroon.Macaroon, revoked bool) {
+		err := mint.VerifyL402(ctx, &VerificationParams{
+			Macaroon:      mac,
+			Preimage:      testPreimage,
+			TargetService: testService.Name,
+		})
+		if revoked {
+			require.ErrorIs(t, err, ErrSecretNotFound)
+		} else {
+			require.NoError(t, err)
+		}
+	}
+
+	// A batch that the store accepts is revoked at once.
+	macs := mintL402s(2)
+	require.NoError(t, mint.RevokeL402s(ctx, macs, "compromised"))
+	require.True(t, store.batchCalled)
+	require.Len(t, auditor.events, 2)
+	for _, mac := range macs {
+		requireRevoked(mac, true)
+	}
+
+	// If one of the secrets can't be revoked, the others still are and
+	// the failure is reported for that L402 only. An L402 with an invalid
+	// identifier fails as well.
+	macs = mintL402s(3)
+	store.failHash = sha256.Sum256(macs[1].Id())
+
+	invalidMac, err := macaroon.New(
+		nil, []byte("invalid"), "", macaroon.LatestVersion,
+	)
+	require.NoError(t, err)
+	macs = append(macs, invalidMac)
+
+	err = mint.RevokeL402s(ctx, macs, "compromised")
+	var batchErr *BatchRevocationError
+	require.ErrorAs(t, err, &batchErr)
+	require.Len(t, batchErr.Errors, 4)
+	require.NoError(t, batchErr.Errors[0])
+	require.ErrorContains(t, batchErr.Errors[1], "revocation failed")
+	require.NoError(t, batchErr.Errors[2])
+	require.ErrorContains(t, batchErr.Errors[3], "unable to decode")
+	require.Len(t, auditor.events, 4)
+
+	requireRevoked(macs[0], true)
+	requireRevoked(macs[1], false)
+	requireRevoked(macs[2], true)
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"fmt"
+	"time"
 
 	"github.com/lightninglabs/aperture/l402"
 	"github.com/lightningnetwork/lnd/lntypes"
@@ -40,20 +42,60 @@ func (d *mockChallenger) NewChallenge(price int64) (string, lntypes.Hash,
 	return testPayReq, testHash, nil
 }
 
+type mockPaymentHashVerifier struct {
+	known map[lntypes.Hash]struct{}
+}
+
+var _ PaymentHashVerifier = (*mockPaymentHashVerifier)(nil)
+
+func newMockPaymentHashVerifier(
+	hashes ...lntypes.Hash) *mockPaymentHashVerifier {
+
+	known := make(map[lntypes.Hash]struct{}, len(hashes))
+	for _, hash := range hashes {
+		known[hash] = struct{}{}
+	}
+
+	return &mockPaymentHashVerifier{known: known}
+}
+
+func (v *mockPaymentHashVerifier) VerifyPaymentHash(_ context.Context,
+	hash lntypes.Hash) error {
+
+	if _, ok := v.known[hash]; !ok {
+		return fmt.Errorf("unknown payment hash %v", hash)
+	}
+	return nil
+}
+
 type mockSecretStore struct {
-	secrets map[[sha256.Size]byte][l402.SecretSize]byte
+	secrets  map[[sha256.Size]byte][l402.SecretSize]byte
+	expiries map[[sha256.Size]byte]time.Time
 }
 
 var _ SecretStore = (*mockSecretStore)(nil)
+var _ ExpiringSecretStore = (*mockSecretStore)(nil)
 
 func (s *mockSecretStore) NewSecret(ctx context.Context,
 	id [sha256.Size]byte) ([l402.SecretSize]byte, error) {
 
+	return s.NewExpiringSecret(ctx, id, time.Time{})
+}
+
+func (s *mockSecretStore) NewExpiringSecret(ctx context.Context,
+	id [sha256.Size]byte, expiry time.Time) ([l402.SecretSize]byte,
+	error) {
+
+	if _, ok := s.secrets[id]; ok {
+		return [l402.SecretSize]byte{}, ErrSecretExists
+	}
+
 	var secret [l402.SecretSize]byte
 	if _, err := rand.Read(secret[:]); err != nil {
 		return secret, err
 	}
 	s.secrets[id] = secret
+	s.expiries[id] = expiry
 	return secret, nil
 }
 
@@ -76,7 +118,8 @@ func (s *mockSecretStore) RevokeSecret(ctx context.Context,
 
 func newMockSecretStore() *mockSecretStore {
 	return &mockSecretStore{
-		secrets: make(map[[sha256.Size]byte][l402.SecretSize]byte),
+		secrets:  make(map[[sha256.Size]byte][l402.SecretSize]byte),
+		expiries: make(map[[sha256.Size]byte]time.Time),
 	}
 }
 
@@ -137,3 +180,16 @@ func (l *mockServiceLimiter) ServiceTimeouts(ctx context.Context,
 	}
 	return res, nil
 }
+
+type mockRevocationAuditor struct {
+	events []*RevocationEvent
+}
+
+var _ RevocationAuditor = (*mockRevocationAuditor)(nil)
+
+func (a *mockRevocationAuditor) AuditRevocation(_ context.Context,
+	event *RevocationEvent) error {
+
+	a.events = append(a.events, event)
+	return nil
+}
@@ -0,0 +1,199 @@
+package mint
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/lightninglabs/aperture/l402"
+)
+
+const (
+	// DefaultSecretCacheTTL is the default time a secret is kept in the
+	// cache of a CachingSecretStore.
+	DefaultSecretCacheTTL = time.Minute
+)
+
+var (
+	// errBatchRevocationUnsupported is returned when revoking secrets in a
+	// batch through a cache in front of a store that doesn't support it.
+	errBatchRevocationUnsupported = errors.New("secret store doesn't " +
+		"support batch revocation")
+
+	// errPruningUnsupported is returned when pruning secrets through a
+	// cache in front of a store that doesn't support it.
+	errPruningUnsupported = errors.New("secret store doesn't support " +
+		"pruning")
+)
+
+// CachingSecretStore is a SecretStore that keeps the most recently used
+// secrets of another store in memory, so verifying an L402 doesn't need a
+// round trip to the store every time. As the secret of an L402 never changes,
+// the only risk is revocation: a secret revoked through another instance that
+// shares the store stays in the cache until its TTL expires, which bounds the
+// time a revoked L402 is still accepted.
+type CachingSecretStore struct {
+	SecretStore
+
+	cache *expirable.LRU[[sha256.Size]byte, [l402.SecretSize]byte]
+
+	// revocations is increased after every revocation. A lookup only
+	// caches the secret it fetched if no revocation completed in the
+	// meantime, as the secret might have been revoked after it was read
+	// from the store.
+	revocations uint64
+	revokeMtx   sync.Mutex
+}
+
+// A compile-time constraint to ensure CachingSecretStore implements
+// SecretStore, ExpiringSecretStore, BatchSecretRevoker and SecretPruner.
+var _ SecretStore = (*CachingSecretStore)(nil)
+var _ ExpiringSecretStore = (*CachingSecretStore)(nil)
+var _ BatchSecretRevoker = (*CachingSecretStore)(nil)
+var _ SecretPruner = (*CachingSecretStore)(nil)
+
+// NewCachingSecretStore creates a new store that caches up to size secrets of
+// the given store for the given TTL. If the TTL is zero,
+// DefaultSecretCacheTTL is used.
+func NewCachingSecretStore(store SecretStore, size int,
+	ttl time.Duration) *CachingSecretStore {
+
+	if ttl == 0 {
+		ttl = DefaultSecretCacheTTL
+	}
+
+	return &CachingSecretStore{
+		SecretStore: store,
+		cache: expirable.NewLRU[[sha256.Size]byte,
+			[l402.SecretSize]byte](size, nil, ttl),
+	}
+}
+
+// NewSecret creates a new secret in the underlying store and caches it.
+//
+// NOTE: This is part of the SecretStore interface.
+func (s *CachingSecretStore) NewSecret(ctx context.Context,
+	id [sha256.Size]byte) ([l402.SecretSize]byte, error) {
+
+	return s.NewExpiringSecret(ctx, id, time.Time{})
+}
+
+// NewExpiringSecret creates a new secret that expires at the given time in the
+// underlying store and caches it. If the underlying store can't record the
+// expiry, the secret never expires.
+//
+// NOTE: This is part of the ExpiringSecretStore interface.
+func (s *CachingSecretStore) NewExpiringSecret(ctx context.Context,
+	id [sha256.Size]byte, expiry time.Time) ([l402.SecretSize]byte,
+	error) {
+
+	secret, err := newSecret(ctx, s.SecretStore, id, expiry)
+	if err != nil {
+		return secret, err
+	}
+
+	s.cache.Add(id, secret)
+
+	return secret, nil
+}
+
+// GetSecret returns the cached secret that corresponds to the given hash or
+// fetches it from the underlying store. Missing secrets aren't cached.
+//
+// NOTE: This is part of the SecretStore interface.
+func (s *CachingSecretStore) GetSecret(ctx context.Context,
+	id [sha256.Size]byte) ([l402.SecretSize]byte, error) {
+
+	if secret, ok := s.cache.Get(id); ok {
+		return secret, nil
+	}
+
+	s.revokeMtx.Lock()
+	revocations := s.revocations
+	s.revokeMtx.Unlock()
+
+	secret, err := s.SecretStore.GetSecret(ctx, id)
+	if err != nil {
+		return secret, err
+	}
+
+	s.revokeMtx.Lock()
+	if s.revocations == revocations {
+		s.cache.Add(id, secret)
+	}
+	s.revokeMtx.Unlock()
+
+	return secret, nil
+}
+
+// forget removes the secrets that correspond to the given hashes from the
+// cache once they were revoked in the underlying store and prevents lookups
+// that are still in flight from caching them again.
+func (s *CachingSecretStore) forget(ids ...[sha256.Size]byte) {
+	s.revokeMtx.Lock()
+	defer s.revokeMtx.Unlock()
+
+	s.revocations++
+	for _, id := range ids {
+		s.cache.Remove(id)
+	}
+}
+
+// RevokeSecret removes the secret that corresponds to the given hash from the
+// cache and the underlying store.
+//
+// NOTE: This is part of the SecretStore interface.
+func (s *CachingSecretStore) RevokeSecret(ctx context.Context,
+	id [sha256.Size]byte) error {
+
+	// A concurrent lookup might add the secret back to the cache while it
+	// is being revoked, so we remove it again once it's gone from the
+	// store, which also keeps lookups still in flight from caching it.
+	s.cache.Remove(id)
+	err := s.SecretStore.RevokeSecret(ctx, id)
+	s.forget(id)
+
+	return err
+}
+
+// RevokeSecrets removes the secrets that correspond to the given hashes from
+// the cache and the underlying store at once. If the underlying store can't
+// revoke secrets in batches, an error is returned and nothing is revoked.
+//
+// NOTE: This is part of the BatchSecretRevoker interface.
+func (s *CachingSecretStore) RevokeSecrets(ctx context.Context,
+	ids [][sha256.Size]byte) error {
+
+	revoker, ok := s.SecretStore.(BatchSecretRevoker)
+	if !ok {
+		return errBatchRevocationUnsupported
+	}
+
+	for _, id := range ids {
+		s.cache.Remove(id)
+	}
+	err := revoker.RevokeSecrets(ctx, ids)
+	s.forget(ids...)
+
+	return err
+}
+
+// PruneSecrets removes the expired secrets from the underlying store. Pruned
+// secrets may stay in the cache until their TTL expires, but they belong to
+// expired L402s that are rejected anyway. If the underlying store can't prune
+// secrets, an error is returned.
+//
+// NOTE: This is part of the SecretPruner interface.
+func (s *CachingSecretStore) PruneSecrets(ctx context.Context,
+	before time.Time) (int64, error) {
+
+	pruner, ok := s.SecretStore.(SecretPruner)
+	if !ok {
+		return 0, errPruningUnsupported
+	}
+
+	return pruner.PruneSecrets(ctx, before)
+}
@@ -0,0 +1,137 @@
+package mint
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/l402"
+	"github.com/stretchr/testify/require"
+)
+
+// countingSecretStore is a secret store that counts the lookups of secrets.
+type countingSecretStore struct {
+	*mockSecretStore
+
+	lookups int
+}
+
+func (s *countingSecretStore) GetSecret(ctx context.Context,
+	id [sha256.Size]byte) ([l402.SecretSize]byte, error) {
+
+	s.lookups++
+	return s.mockSecretStore.GetSecret(ctx, id)
+}
+
+// TestCachingSecretStore ensures that secrets are served from the cache until
+// they expire or are revoked.
+func TestCachingSecretStore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	store := &countingSecretStore{mockSecretStore: newMockSecretStore()}
+	cache := NewCachingSecretStore(store, 10, 100*time.Millisecond)
+	hash := sha256.Sum256([]byte("id"))
+
+	// Missing secrets aren't cached.
+	_, err := cache.GetSecret(ctx, hash)
+	require.ErrorIs(t, err, ErrSecretNotFound)
+	_, err = cache.GetSecret(ctx, hash)
+	require.ErrorIs(t, err, ErrSecretNotFound)
+	require.Equal(t, 2, store.lookups)
+
+	// A new secret is cached right away.
+	secret, err := cache.NewSecret(ctx, hash)
+	require.NoError(t, err)
+
+	cachedSecret, err := cache.GetSecret(ctx, hash)
+	require.NoError(t, err)
+	require.Equal(t, secret, cachedSecret)
+	require.Equal(t, 2, store.lookups)
+
+	// Once the secret expired, it is looked up in the store again.
+	require.Eventually(t, func() bool {
+		_, err := cache.GetSecret(ctx, hash)
+		require.NoError(t, err)
+
+		return store.lookups == 3
+	}, time.Second, 10*time.Millisecond)
+
+	// A revoked secret is removed from the cache as well.
+	require.NoError(t, cache.RevokeSecret(ctx, hash))
+	_, err = cache.GetSecret(ctx, hash)
+	require.ErrorIs(t, err, ErrSecretNotFound)
+
+	// The mock store can't revoke secrets in batches, so neither can the
+	// cache in front of it.
+	err = cache.RevokeSecrets(ctx, [][sha256.Size]byte{hash})
+	require.ErrorIs(t, err, errBatchRevocationUnsupported)
+}
+
+// blockingSecretStore is a secret store that holds back the result of a
+// lookup until it's released.
+type blockingSecretStore struct {
+	*mockSecretStore
+
+	fetched chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSecretStore) GetSecret(ctx context.Context,
+	id [sha256.Size]byte) ([l402.SecretSize]byte, error) {
+
+	secret, err := s.mockSecretStore.GetSecret(ctx, id)
+	s.fetched <- struct{}{}
+	<-s.release
+
+	return secret, err
+}
+
+// TestCachingSecretStoreRevokeInFlight ensures that a lookup that fetched a
+// secret before it was revoked doesn't add it back to the cache.
+func TestCachingSecretStoreRevokeInFlight(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	store := &blockingSecretStore{
+		mockSecretStore: newMockSecretStore(),
+		fetched:         make(chan struct{}),
+		release:         make(chan struct{}),
+	}
+	cache := NewCachingSecretStore(store, 10, time.Minute)
+	hash := sha256.Sum256([]byte("id"))
+
+	secret, err := store.mockSecretStore.NewSecret(ctx, hash)
+	require.NoError(t, err)
+
+	// Start a lookup and revoke the secret while it's in flight.
+	type result struct {
+		secret [l402.SecretSize]byte
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		secret, err := cache.GetSecret(ctx, hash)
+		results <- result{secret, err}
+	}()
+
+	<-store.fetched
+	require.NoError(t, cache.RevokeSecret(ctx, hash))
+	close(store.release)
+
+	res := <-results
+	require.NoError(t, res.err)
+	require.Equal(t, secret, res.secret)
+
+	// The lookup read the secret before it was revoked, but must not have
+	// cached it.
+	_, ok := cache.cache.Get(hash)
+	require.False(t, ok)
+
+	go func() {
+		<-store.fetched
+	}()
+	_, err = cache.GetSecret(ctx, hash)
+	require.ErrorIs(t, err, ErrSecretNotFound)
+}
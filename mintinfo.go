@@ -0,0 +1,97 @@
+package aperture
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightninglabs/aperture/proxy"
+)
+
+const (
+	// mintInfoPath is the well-known path under which the mint's
+	// verification metadata is served.
+	mintInfoPath = "/.well-known/l402"
+)
+
+// serviceInfo describes a single L402-enabled service in the published
+// service catalog.
+type serviceInfo struct {
+	Name         string   `json:"name"`
+	Auth         string   `json:"auth"`
+	Price        int64    `json:"price"`
+	DynamicPrice bool     `json:"dynamic_price"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Timeout      int64    `json:"timeout,omitempty"`
+}
+
+// mintInfo is the response returned by the mint info endpoint.
+type mintInfo struct {
+	*mint.VerificationInfo
+
+	Services []serviceInfo `json:"services"`
+}
+
+// newMintInfoService creates a local service that serves the mint's
+// verification metadata together with the catalog of configured services.
+func newMintInfoService(info *mint.VerificationInfo,
+	services *serviceRegistry) proxy.LocalService {
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(
+				w, http.StatusText(http.StatusMethodNotAllowed),
+				http.StatusMethodNotAllowed,
+			)
+			return
+		}
+
+		// The services are only fully prepared (e.g. default prices
+		// applied) once the proxy is created and are replaced when
+		// the configuration is reloaded, so we assemble the response
+		// on each request.
+		proxyServices := services.get()
+		resp := &mintInfo{
+			VerificationInfo: info,
+			Services: make(
+				[]serviceInfo, 0, len(proxyServices),
+			),
+		}
+		for _, s := range proxyServices {
+			resp.Services = append(resp.Services, newServiceInfo(s))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Errorf("Unable to encode mint info: %v", err)
+		}
+	})
+
+	return proxy.NewLocalService(handler, func(r *http.Request) bool {
+		return r.URL.Path == mintInfoPath
+	})
+}
+
+// newServiceInfo returns the public catalog entry of the given service.
+func newServiceInfo(s *proxy.Service) serviceInfo {
+	var capabilities []string
+	for _, c := range strings.Split(s.Capabilities, ",") {
+		c = strings.TrimSpace(c)
+		if c != "" {
+			capabilities = append(capabilities, c)
+		}
+	}
+
+	return serviceInfo{
+		Name:         s.Name,
+		Auth:         string(s.Auth),
+		Price:        s.Price,
+		DynamicPrice: s.DynamicPrice.Enabled,
+		Capabilities: capabilities,
+		Timeout:      s.TimeoutSeconds(),
+	}
+}
@@ -0,0 +1,90 @@
+package aperture
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/l402"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMintInfoService makes sure the mint info endpoint returns the expected
+// verification metadata and service catalog.
+func TestMintInfoService(t *testing.T) {
+	info := mint.New(&mint.Config{}).VerificationInfo()
+	services := []*proxy.Service{{
+		Name:         "service1",
+		Auth:         "on",
+		Price:        100,
+		Capabilities: "add, subtract",
+		Timeout:      3600,
+	}, {
+		Name: "service2",
+		Auth: "freebie 1",
+	}, {
+		Name:            "service3",
+		Auth:            "on",
+		Price:           10,
+		Timeout:         60,
+		TimeoutDuration: 90 * time.Minute,
+	}}
+	svc := newMintInfoService(info, newServiceRegistry(services))
+
+	// Only the well-known path should be handled.
+	req := httptest.NewRequest(http.MethodGet, mintInfoPath, nil)
+	require.True(t, svc.IsHandling(req))
+	require.False(t, svc.IsHandling(
+		httptest.NewRequest(http.MethodGet, "/other", nil),
+	))
+
+	rec := httptest.NewRecorder()
+	svc.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var resp struct {
+		IdentifierVersion uint16        `json:"identifier_version"`
+		TokenIDSize       int           `json:"token_id_size"`
+		Location          string        `json:"location"`
+		CaveatConditions  []string      `json:"caveat_conditions"`
+		Services          []serviceInfo `json:"services"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+
+	require.EqualValues(t, l402.LatestVersion, resp.IdentifierVersion)
+	require.Equal(t, l402.TokenIDSize, resp.TokenIDSize)
+	require.Equal(t, info.Location, resp.Location)
+	require.Equal(t, []string{
+		l402.CondServices, l402.CondCapabilitiesSuffix,
+		l402.CondTimeoutSuffix, l402.CondLabelSuffix,
+		l402.CondMethodsSuffix, l402.CondDowngradeSuffix,
+	}, resp.CaveatConditions)
+	require.Equal(t, []serviceInfo{{
+		Name:         "service1",
+		Auth:         "on",
+		Price:        100,
+		Capabilities: []string{"add", "subtract"},
+		Timeout:      3600,
+	}, {
+		Name: "service2",
+		Auth: "freebie 1",
+	}, {
+		// The timeout duration takes precedence over the timeout in
+		// seconds, like it does for the timeout caveat.
+		Name:    "service3",
+		Auth:    "on",
+		Price:   10,
+		Timeout: 5400,
+	}}, resp.Services)
+
+	// Other methods aren't allowed.
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, mintInfoPath, nil)
+	svc.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -0,0 +1,132 @@
+package aperture
+
+import (
+	"encoding/base32"
+	"fmt"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/tor"
+)
+
+const (
+	// clientAuthPrefix is the prefix of the client authorization lines
+	// Tor expects in the .auth files of an onion service's
+	// authorized_clients directory. Operators can pass such lines as they
+	// are.
+	clientAuthPrefix = "descriptor:x25519:"
+
+	// x25519KeyLen is the length of an x25519 public key in bytes.
+	x25519KeyLen = 32
+)
+
+// clientAuthEncoding is the unpadded base32 encoding Tor uses for the x25519
+// keys of authorized clients.
+var clientAuthEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// parseAuthorizedClient parses the base32 encoded x25519 public key of a
+// client that is authorized to connect to the onion service. The key may be
+// prefixed the same way as in Tor's .auth files.
+func parseAuthorizedClient(client string) (string, error) {
+	key := strings.ToUpper(strings.TrimSpace(client))
+	key = strings.TrimPrefix(key, strings.ToUpper(clientAuthPrefix))
+
+	pubKey, err := clientAuthEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorized client %s: %w",
+			client, err)
+	}
+	if len(pubKey) != x25519KeyLen {
+		return "", fmt.Errorf("invalid authorized client %s: expected "+
+			"%d byte key, got %d", client, x25519KeyLen,
+			len(pubKey))
+	}
+
+	return key, nil
+}
+
+// clientAuthOnionStore is a tor.OnionStore that restricts the onion service
+// to a set of authorized clients. The Tor controller we use doesn't support
+// client authorization, but it passes the key returned by the store verbatim
+// into the ADD_ONION command. This store appends the client authorization
+// arguments to that key and strips them again before the key is persisted.
+type clientAuthOnionStore struct {
+	// store is the store the onion service's private key is persisted
+	// in. If nil, the key is not persisted and a new onion service is
+	// created on every start.
+	store tor.OnionStore
+
+	// authParams are the ADD_ONION arguments that require client
+	// authorization.
+	authParams string
+}
+
+// A compile-time constraint to ensure clientAuthOnionStore implements
+// tor.OnionStore.
+var _ tor.OnionStore = (*clientAuthOnionStore)(nil)
+
+// newClientAuthOnionStore creates a store that wraps the given store and only
+// authorizes the given clients to connect to the onion service.
+func newClientAuthOnionStore(store tor.OnionStore,
+	clients []string) (*clientAuthOnionStore, error) {
+
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("at least one authorized client " +
+			"required")
+	}
+
+	params := []string{"Flags=V3Auth"}
+	for _, client := range clients {
+		key, err := parseAuthorizedClient(client)
+		if err != nil {
+			return nil, err
+		}
+
+		params = append(params, "ClientAuthV3="+key)
+	}
+
+	return &clientAuthOnionStore{
+		store:      store,
+		authParams: strings.Join(params, " "),
+	}, nil
+}
+
+// StorePrivateKey stores the given private key without the client
+// authorization arguments.
+func (s *clientAuthOnionStore) StorePrivateKey(privateKey []byte) error {
+	if s.store == nil {
+		return nil
+	}
+
+	key, _, _ := strings.Cut(string(privateKey), " ")
+	return s.store.StorePrivateKey([]byte(key))
+}
+
+// PrivateKey returns the stored private key followed by the client
+// authorization arguments. If no key is stored yet, Tor is asked to create a
+// new v3 onion service, whose key is then stored.
+func (s *clientAuthOnionStore) PrivateKey() ([]byte, error) {
+	key := "NEW:" + tor.V3KeyParam
+	if s.store != nil {
+		privateKey, err := s.store.PrivateKey()
+		switch err {
+		case tor.ErrNoPrivateKey:
+
+		case nil:
+			key = string(privateKey)
+
+		default:
+			return nil, err
+		}
+	}
+
+	return []byte(key + " " + s.authParams), nil
+}
+
+// DeletePrivateKey removes the private key from the wrapped store.
+func (s *clientAuthOnionStore) DeletePrivateKey() error {
+	if s.store == nil {
+		return nil
+	}
+
+	return s.store.DeletePrivateKey()
+}
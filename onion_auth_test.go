@@ -0,0 +1,106 @@
+package aperture
+
+import (
+	"testing"
+
+	"github.com/lightningnetwork/lnd/tor"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testClientKey  = "N2NU7BSRL6YODZCYPN4CREB54TYLKGIE2KYOQWLFYC23ZJVCE5DQ"
+	testClientKey2 = "AAAQEAYEAUDAOCAJBIFQYDIOB4IBCEQTCQKRMFYYDENBWHA5DYPQ"
+)
+
+// memOnionStore is a simple in-memory tor.OnionStore.
+type memOnionStore struct {
+	key []byte
+}
+
+func (m *memOnionStore) StorePrivateKey(key []byte) error {
+	m.key = key
+	return nil
+}
+
+func (m *memOnionStore) PrivateKey() ([]byte, error) {
+	if m.key == nil {
+		return nil, tor.ErrNoPrivateKey
+	}
+
+	return m.key, nil
+}
+
+func (m *memOnionStore) DeletePrivateKey() error {
+	m.key = nil
+	return nil
+}
+
+// TestParseAuthorizedClient makes sure authorized client keys are accepted
+// bare and in Tor's .auth file format, while invalid keys are rejected.
+func TestParseAuthorizedClient(t *testing.T) {
+	key, err := parseAuthorizedClient(testClientKey)
+	require.NoError(t, err)
+	require.Equal(t, testClientKey, key)
+
+	key, err = parseAuthorizedClient(
+		"descriptor:x25519:" + testClientKey + "\n",
+	)
+	require.NoError(t, err)
+	require.Equal(t, testClientKey, key)
+
+	_, err = parseAuthorizedClient("not-base32!")
+	require.ErrorContains(t, err, "invalid authorized client")
+
+	_, err = parseAuthorizedClient(testClientKey[:40])
+	require.ErrorContains(t, err, "expected 32 byte key")
+}
+
+// TestClientAuthOnionStore makes sure the client authorization arguments are
+// added to the key param of the onion service, but never persisted.
+func TestClientAuthOnionStore(t *testing.T) {
+	_, err := newClientAuthOnionStore(nil, nil)
+	require.Error(t, err)
+
+	_, err = newClientAuthOnionStore(nil, []string{"invalid"})
+	require.Error(t, err)
+
+	inner := &memOnionStore{}
+	store, err := newClientAuthOnionStore(
+		inner, []string{testClientKey, testClientKey2},
+	)
+	require.NoError(t, err)
+
+	authParams := " Flags=V3Auth ClientAuthV3=" + testClientKey +
+		" ClientAuthV3=" + testClientKey2
+
+	// Without a stored key, a new onion service is requested.
+	key, err := store.PrivateKey()
+	require.NoError(t, err)
+	require.Equal(t, "NEW:ED25519-V3"+authParams, string(key))
+
+	// The controller stores the key param it used, which must not include
+	// the client authorization arguments.
+	require.NoError(t, store.StorePrivateKey(
+		[]byte("ED25519-V3:secret"+authParams),
+	))
+	require.Equal(t, "ED25519-V3:secret", string(inner.key))
+
+	key, err = store.PrivateKey()
+	require.NoError(t, err)
+	require.Equal(t, "ED25519-V3:secret"+authParams, string(key))
+
+	require.NoError(t, store.DeletePrivateKey())
+	require.Nil(t, inner.key)
+
+	// Without a wrapped store, nothing is persisted.
+	store, err = newClientAuthOnionStore(nil, []string{testClientKey})
+	require.NoError(t, err)
+	require.NoError(t, store.StorePrivateKey([]byte("ED25519-V3:secret")))
+
+	key, err = store.PrivateKey()
+	require.NoError(t, err)
+	require.Equal(
+		t, "NEW:ED25519-V3 Flags=V3Auth ClientAuthV3="+testClientKey,
+		string(key),
+	)
+}
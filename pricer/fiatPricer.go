@@ -0,0 +1,294 @@
+package pricer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// StaleRatePolicy determines how a FiatPricer quotes prices once the exchange
+// rate of its rate source is older than the configured maximum age.
+type StaleRatePolicy string
+
+const (
+	// StaleRateFail fails to quote a price, so no invoices are created
+	// until the rate source recovers. This is the default policy.
+	StaleRateFail StaleRatePolicy = "fail"
+
+	// StaleRateFallback quotes prices using the configured fallback rate.
+	StaleRateFallback StaleRatePolicy = "fallback"
+
+	// StaleRateLast keeps quoting prices using the last known rate and logs
+	// a warning.
+	StaleRateLast StaleRatePolicy = "last"
+)
+
+const (
+	// DefaultRateRefreshInterval is the default time a rate fetched from
+	// the rate source is used before it is fetched again.
+	DefaultRateRefreshInterval = time.Minute
+)
+
+var (
+	// ErrStaleRate is returned if the exchange rate is older than the
+	// maximum age and the stale rate policy doesn't allow quoting a price.
+	ErrStaleRate = errors.New("exchange rate is stale")
+)
+
+// RateSource provides the exchange rate between a fiat currency and bitcoin.
+type RateSource interface {
+	// Rate returns the number of satoshis a single unit of the fiat
+	// currency is worth, together with the time the rate was last updated
+	// at the source.
+	Rate(ctx context.Context) (float64, time.Time, error)
+}
+
+// FiatPriceConfig holds the config options of a service that is priced in a
+// fiat currency.
+type FiatPriceConfig struct {
+	// Enabled indicates if the FiatPricer is to be used.
+	Enabled bool `long:"enabled" description:"Set to true to price the service in a fiat currency"`
+
+	// Amount is the price in units of the fiat currency.
+	Amount float64 `long:"amount" description:"The price in units of the fiat currency"`
+
+	// RateURL is the URL of the exchange rate source, see HTTPRateSource
+	// for the expected format.
+	RateURL string `long:"rateurl" description:"The URL to fetch the bitcoin price in the fiat currency from"`
+
+	// MaxRateAge is the age after which an exchange rate is considered
+	// stale. If zero, rates never become stale.
+	MaxRateAge time.Duration `long:"maxrateage" description:"The age after which an exchange rate is considered stale, 0 to never consider it stale"`
+
+	// StalePolicy determines how prices are quoted once the rate is stale.
+	StalePolicy string `long:"stalepolicy" description:"How prices are quoted once the exchange rate is stale" choice:"fail" choice:"fallback" choice:"last"`
+
+	// FallbackRate is the number of satoshis a single unit of the fiat
+	// currency is assumed to be worth by the fallback policy.
+	FallbackRate float64 `long:"fallbackrate" description:"The number of satoshis a unit of the fiat currency is worth when using the fallback policy"`
+
+	// RefreshInterval is the time a fetched rate is used before it is
+	// fetched again. If zero, DefaultRateRefreshInterval is used.
+	RefreshInterval time.Duration `long:"refreshinterval" description:"The time a fetched exchange rate is used before it is fetched again, 0 to use the default of 1m"`
+}
+
+// FiatConfig holds the config of a FiatPricer.
+type FiatConfig struct {
+	// Source is the source of the exchange rate.
+	Source RateSource
+
+	// MaxRateAge is the age after which an exchange rate is considered
+	// stale. If zero, rates never become stale.
+	MaxRateAge time.Duration
+
+	// StalePolicy determines how prices are quoted once the rate is stale.
+	StalePolicy StaleRatePolicy
+
+	// FallbackRate is the number of satoshis a single unit of the fiat
+	// currency is assumed to be worth by the StaleRateFallback policy.
+	FallbackRate float64
+
+	// RefreshInterval is the time a rate fetched from the source is used
+	// before it is fetched again, so not every price quote waits for the
+	// source. If zero, DefaultRateRefreshInterval is used.
+	RefreshInterval time.Duration
+
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// validate makes sure the config is consistent.
+func (c *FiatConfig) validate() error {
+	switch {
+	case c.Source == nil:
+		return errors.New("fiat pricer requires a rate source")
+
+	case c.MaxRateAge < 0:
+		return errors.New("negative maximum rate age")
+
+	case c.RefreshInterval < 0:
+		return errors.New("negative rate refresh interval")
+	}
+
+	switch c.StalePolicy {
+	case "", StaleRateFail, StaleRateLast:
+		return nil
+
+	case StaleRateFallback:
+		if c.FallbackRate <= 0 {
+			return errors.New("fallback policy requires a " +
+				"positive fallback rate")
+		}
+
+		return nil
+
+	default:
+		return fmt.Errorf("unknown stale rate policy %q", c.StalePolicy)
+	}
+}
+
+// FiatPricer quotes a fixed price in a fiat currency in satoshis, using the
+// exchange rate of a rate source. It implements the Pricer interface.
+type FiatPricer struct {
+	cfg *FiatConfig
+
+	// amount is the price in units of the fiat currency.
+	amount float64
+
+	// rateMtx guards the fields below. It is held while the rate is
+	// fetched, so concurrent quotes wait for a single fetch.
+	rateMtx sync.Mutex
+
+	// lastRate is the last valid rate returned by the source and
+	// lastUpdated the time it was updated at the source. They are used
+	// until the rate is refreshed and while the source is unavailable.
+	lastRate    float64
+	lastUpdated time.Time
+
+	// lastFetch is the time the rate was last fetched from the source and
+	// lastErr the error of that fetch, if any.
+	lastFetch time.Time
+	lastErr   error
+
+	// warnMtx guards warnedRate.
+	warnMtx sync.Mutex
+
+	// warnedRate is the update time of the stale rate a warning was last
+	// logged for, so each stale rate is only warned about once.
+	warnedRate time.Time
+}
+
+// NewFiatPricer creates a new pricer that quotes the given amount of units of
+// a fiat currency in satoshis.
+func NewFiatPricer(amount float64, cfg *FiatConfig) (*FiatPricer, error) {
+	if amount < 0 {
+		return nil, errors.New("negative fiat price")
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = DefaultRateRefreshInterval
+	}
+
+	return &FiatPricer{
+		cfg:    cfg,
+		amount: amount,
+	}, nil
+}
+
+// GetPrice returns the fiat price converted to satoshis, rounded up to the
+// next full satoshi. It is part of the Pricer interface.
+func (f *FiatPricer) GetPrice(ctx context.Context,
+	_ *http.Request) (int64, error) {
+
+	rate, err := f.rate(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	price := math.Ceil(f.amount * rate)
+	if price > math.MaxInt64 {
+		return 0, fmt.Errorf("price of %v satoshis out of range", price)
+	}
+
+	return int64(price), nil
+}
+
+// fetchRate returns the last good rate and the time it was updated at the
+// source, together with the error of the last fetch. The rate is only fetched
+// from the source again once the refresh interval passed since the last fetch,
+// whether that fetch succeeded or not.
+func (f *FiatPricer) fetchRate(ctx context.Context) (float64, time.Time,
+	error) {
+
+	f.rateMtx.Lock()
+	defer f.rateMtx.Unlock()
+
+	now := f.cfg.Now()
+	if !f.lastFetch.IsZero() &&
+		now.Sub(f.lastFetch) < f.cfg.RefreshInterval {
+
+		return f.lastRate, f.lastUpdated, f.lastErr
+	}
+
+	rate, updated, err := f.cfg.Source.Rate(ctx)
+	if err == nil && rate <= 0 {
+		err = fmt.Errorf("invalid exchange rate %v", rate)
+	}
+
+	f.lastFetch, f.lastErr = now, err
+	if err != nil {
+		log.Warnf("Unable to fetch exchange rate: %v", err)
+	} else {
+		f.lastRate, f.lastUpdated = rate, updated
+	}
+
+	return f.lastRate, f.lastUpdated, err
+}
+
+// rate returns the exchange rate to convert the price with, applying the stale
+// rate policy if the rate is too old. If the source fails, the last good rate
+// is used instead, which the stale rate policy applies to once it is too old.
+func (f *FiatPricer) rate(ctx context.Context) (float64, error) {
+	rate, updated, err := f.fetchRate(ctx)
+	if err != nil {
+		// Without any good rate yet, only the fallback rate can be
+		// used.
+		if rate == 0 {
+			if f.cfg.StalePolicy == StaleRateFallback {
+				return f.cfg.FallbackRate, nil
+			}
+
+			return 0, fmt.Errorf("unable to fetch exchange rate: "+
+				"%w", err)
+		}
+	}
+
+	age := f.cfg.Now().Sub(updated)
+	if f.cfg.MaxRateAge == 0 || age <= f.cfg.MaxRateAge {
+		return rate, nil
+	}
+
+	switch f.cfg.StalePolicy {
+	case StaleRateFallback:
+		return f.cfg.FallbackRate, nil
+
+	case StaleRateLast:
+		f.warnStale(updated, age)
+		return rate, nil
+
+	default:
+		return 0, fmt.Errorf("%w: last updated %v ago", ErrStaleRate,
+			age)
+	}
+}
+
+// warnStale logs a warning that the rate last updated at the given time is
+// used although it is stale, once per rate update.
+func (f *FiatPricer) warnStale(updated time.Time, age time.Duration) {
+	f.warnMtx.Lock()
+	defer f.warnMtx.Unlock()
+
+	if f.warnedRate.Equal(updated) {
+		return
+	}
+	f.warnedRate = updated
+
+	log.Warnf("Quoting prices with stale exchange rate last updated %v "+
+		"ago", age)
+}
+
+// Close is part of the Pricer interface. For the FiatPricer, the method does
+// nothing.
+func (f *FiatPricer) Close() error {
+	return nil
+}
@@ -0,0 +1,245 @@
+package pricer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// staticRateSource is a rate source that returns a fixed rate and update time.
+type staticRateSource struct {
+	rate    float64
+	updated time.Time
+	err     error
+
+	fetches int
+}
+
+// Rate returns the fixed rate and update time.
+func (s *staticRateSource) Rate(context.Context) (float64, time.Time, error) {
+	s.fetches++
+	return s.rate, s.updated, s.err
+}
+
+// TestFiatPricer tests that fiat prices are converted with the source's rate
+// and that each stale rate policy is applied once the rate is too old.
+func TestFiatPricer(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	freshSource := &staticRateSource{
+		rate:    1500.5,
+		updated: now.Add(-time.Minute),
+	}
+	staleSource := &staticRateSource{
+		rate:    1500.5,
+		updated: now.Add(-time.Hour),
+	}
+
+	testCases := []struct {
+		name          string
+		source        RateSource
+		policy        StaleRatePolicy
+		expectedPrice int64
+		expectedErr   error
+	}{{
+		name:          "fresh rate",
+		source:        freshSource,
+		expectedPrice: 3001,
+	}, {
+		name:        "stale rate, default policy",
+		source:      staleSource,
+		expectedErr: ErrStaleRate,
+	}, {
+		name:        "stale rate, fail",
+		source:      staleSource,
+		policy:      StaleRateFail,
+		expectedErr: ErrStaleRate,
+	}, {
+		name:          "stale rate, fallback",
+		source:        staleSource,
+		policy:        StaleRateFallback,
+		expectedPrice: 2000,
+	}, {
+		name:          "stale rate, last",
+		source:        staleSource,
+		policy:        StaleRateLast,
+		expectedPrice: 3001,
+	}, {
+		name:          "fresh rate, fallback",
+		source:        freshSource,
+		policy:        StaleRateFallback,
+		expectedPrice: 3001,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := NewFiatPricer(2, &FiatConfig{
+				Source:       tc.source,
+				MaxRateAge:   10 * time.Minute,
+				StalePolicy:  tc.policy,
+				FallbackRate: 1000,
+				Now: func() time.Time {
+					return now
+				},
+			})
+			require.NoError(t, err)
+
+			price, err := p.GetPrice(context.Background(), nil)
+			if tc.expectedErr != nil {
+				require.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedPrice, price)
+		})
+	}
+
+	// Without a maximum age, rates never become stale.
+	p, err := NewFiatPricer(2, &FiatConfig{Source: staleSource})
+	require.NoError(t, err)
+	price, err := p.GetPrice(context.Background(), nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 3001, price)
+
+	// Errors of the rate source are passed on.
+	sourceErr := errors.New("source down")
+	p, err = NewFiatPricer(2, &FiatConfig{
+		Source: &staticRateSource{err: sourceErr},
+	})
+	require.NoError(t, err)
+	_, err = p.GetPrice(context.Background(), nil)
+	require.ErrorIs(t, err, sourceErr)
+}
+
+// TestFiatPricerSourceFailure tests that the last good rate is used while the
+// rate source is unavailable, subject to the stale rate policy.
+func TestFiatPricerSourceFailure(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	sourceErr := errors.New("source down")
+	source := &staticRateSource{
+		rate:    1500.5,
+		updated: now.Add(-time.Minute),
+	}
+	p, err := NewFiatPricer(2, &FiatConfig{
+		Source:       source,
+		MaxRateAge:   10 * time.Minute,
+		StalePolicy:  StaleRateFallback,
+		FallbackRate: 1000,
+		Now: func() time.Time {
+			return now
+		},
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	price, err := p.GetPrice(ctx, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 3001, price)
+
+	// While the source is down, the last good rate is still fresh.
+	source.err = sourceErr
+	now = now.Add(2 * DefaultRateRefreshInterval)
+	price, err = p.GetPrice(ctx, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 3001, price)
+
+	// Once it is stale, the policy applies.
+	now = now.Add(time.Hour)
+	price, err = p.GetPrice(ctx, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 2000, price)
+
+	// Without any good rate, the fallback policy uses the fallback rate.
+	p, err = NewFiatPricer(2, &FiatConfig{
+		Source:       &staticRateSource{err: sourceErr},
+		StalePolicy:  StaleRateFallback,
+		FallbackRate: 1000,
+	})
+	require.NoError(t, err)
+	price, err = p.GetPrice(ctx, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 2000, price)
+}
+
+// TestFiatPricerRefresh tests that the rate is only fetched from the source
+// once per refresh interval, and that the cached rate is still checked against
+// the maximum age.
+func TestFiatPricerRefresh(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	source := &staticRateSource{
+		rate:    1500.5,
+		updated: now.Add(-time.Minute),
+	}
+	p, err := NewFiatPricer(2, &FiatConfig{
+		Source:          source,
+		MaxRateAge:      10 * time.Minute,
+		RefreshInterval: 20 * time.Minute,
+		Now: func() time.Time {
+			return now
+		},
+	})
+	require.NoError(t, err)
+
+	// Repeated quotes are served from the cached rate.
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		price, err := p.GetPrice(ctx, nil)
+		require.NoError(t, err)
+		require.EqualValues(t, 3001, price)
+	}
+	require.Equal(t, 1, source.fetches)
+
+	// The cached rate becomes stale before it is refreshed.
+	now = now.Add(15 * time.Minute)
+	_, err = p.GetPrice(ctx, nil)
+	require.ErrorIs(t, err, ErrStaleRate)
+	require.Equal(t, 1, source.fetches)
+
+	// Once the refresh interval passed, the rate is fetched again.
+	now = now.Add(5 * time.Minute)
+	source.updated = now
+	price, err := p.GetPrice(ctx, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 3001, price)
+	require.Equal(t, 2, source.fetches)
+
+	// Failed fetches aren't retried before the refresh interval either.
+	source.err = errors.New("source down")
+	now = now.Add(20 * time.Minute)
+	_, err = p.GetPrice(ctx, nil)
+	require.ErrorIs(t, err, ErrStaleRate)
+	_, err = p.GetPrice(ctx, nil)
+	require.ErrorIs(t, err, ErrStaleRate)
+	require.Equal(t, 3, source.fetches)
+}
+
+// TestFiatConfigValidation tests that inconsistent configs are rejected.
+func TestFiatConfigValidation(t *testing.T) {
+	source := &staticRateSource{rate: 1}
+
+	_, err := NewFiatPricer(1, &FiatConfig{})
+	require.Error(t, err)
+
+	_, err = NewFiatPricer(-1, &FiatConfig{Source: source})
+	require.Error(t, err)
+
+	_, err = NewFiatPricer(1, &FiatConfig{
+		Source:      source,
+		StalePolicy: StaleRateFallback,
+	})
+	require.Error(t, err)
+
+	_, err = NewFiatPricer(1, &FiatConfig{
+		Source:      source,
+		StalePolicy: "unknown",
+	})
+	require.Error(t, err)
+
+	_, err = NewFiatPricer(1, &FiatConfig{
+		Source:          source,
+		RefreshInterval: -time.Second,
+	})
+	require.Error(t, err)
+}
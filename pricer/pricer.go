@@ -8,7 +8,10 @@ import (
 // Pricer is an interface used to query price data from a price provider.
 type Pricer interface {
 	// GetPrice should return the price in satoshis for the given
-	// resource path.
+	// resource path. A price of zero makes the resource free, so requests
+	// for it are passed to the backend without a payment challenge. This
+	// allows dynamic pricers to turn the paywall of a resource on and off
+	// at runtime.
 	GetPrice(ctx context.Context, req *http.Request) (int64, error)
 
 	// Close should clean up the Pricer implementation if needed.
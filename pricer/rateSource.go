@@ -0,0 +1,92 @@
+package pricer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// defaultRateSourceTimeout is the default timeout of a request to an
+	// HTTP rate source.
+	defaultRateSourceTimeout = 10 * time.Second
+
+	// maxRateResponseSize is the maximum size in bytes of the response of
+	// an HTTP rate source that is read.
+	maxRateResponseSize = 1 << 16
+
+	// satsPerBTC is the number of satoshis in a bitcoin.
+	satsPerBTC = 100_000_000
+)
+
+// rateResponse is the JSON response of an HTTP rate source.
+type rateResponse struct {
+	// BTCPrice is the price of a bitcoin in units of the fiat currency.
+	BTCPrice float64 `json:"btc_price"`
+
+	// Updated is the unix timestamp in seconds of the time the price was
+	// last updated.
+	Updated int64 `json:"updated"`
+}
+
+// HTTPRateSource is a RateSource that fetches the bitcoin price in a fiat
+// currency from a URL. The URL must respond with a JSON object that contains
+// the price of a bitcoin in units of the currency as "btc_price" and the unix
+// timestamp of its last update as "updated".
+type HTTPRateSource struct {
+	url    string
+	client *http.Client
+}
+
+// A compile time check to ensure HTTPRateSource implements the RateSource
+// interface.
+var _ RateSource = (*HTTPRateSource)(nil)
+
+// NewHTTPRateSource creates a new rate source that fetches the bitcoin price
+// from the given URL.
+func NewHTTPRateSource(url string) *HTTPRateSource {
+	return &HTTPRateSource{
+		url: url,
+		client: &http.Client{
+			Timeout: defaultRateSourceTimeout,
+		},
+	}
+}
+
+// Rate returns the number of satoshis a single unit of the fiat currency is
+// worth, together with the time the rate was last updated at the source.
+//
+// NOTE: This is part of the RateSource interface.
+func (s *HTTPRateSource) Rate(ctx context.Context) (float64, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, time.Time{}, fmt.Errorf("unexpected status %d from "+
+			"rate source", resp.StatusCode)
+	}
+
+	var rate rateResponse
+	body := io.LimitReader(resp.Body, maxRateResponseSize)
+	if err := json.NewDecoder(body).Decode(&rate); err != nil {
+		return 0, time.Time{}, fmt.Errorf("unable to decode rate: %w",
+			err)
+	}
+	if rate.BTCPrice <= 0 {
+		return 0, time.Time{}, fmt.Errorf("invalid bitcoin price %v",
+			rate.BTCPrice)
+	}
+
+	return satsPerBTC / rate.BTCPrice, time.Unix(rate.Updated, 0), nil
+}
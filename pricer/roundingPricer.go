@@ -0,0 +1,107 @@
+package pricer
+
+import (
+	"context"
+	"net/http"
+)
+
+// RoundingMode determines the direction in which prices are rounded to the
+// configured increment.
+type RoundingMode string
+
+const (
+	// RoundUp rounds prices up to the next increment.
+	RoundUp RoundingMode = "up"
+
+	// RoundDown rounds prices down to the previous increment.
+	RoundDown RoundingMode = "down"
+
+	// RoundNearest rounds prices to the nearest increment, rounding half
+	// way values up. This is the default mode.
+	RoundNearest RoundingMode = "nearest"
+)
+
+// RoundingPricer rounds the prices returned by another Pricer to a multiple of
+// a configured increment so invoice amounts look cleaner. It implements the
+// Pricer interface.
+type RoundingPricer struct {
+	next      Pricer
+	increment int64
+	mode      RoundingMode
+	maxPrice  int64
+}
+
+// NewRoundingPricer initialises a new RoundingPricer that rounds the prices of
+// the given pricer to the given increment. Rounded prices never exceed the
+// given maximum price. If no mode is given, prices are rounded to the nearest
+// increment.
+func NewRoundingPricer(next Pricer, increment int64, mode RoundingMode,
+	maxPrice int64) *RoundingPricer {
+
+	if mode == "" {
+		mode = RoundNearest
+	}
+
+	return &RoundingPricer{
+		next:      next,
+		increment: increment,
+		mode:      mode,
+		maxPrice:  maxPrice,
+	}
+}
+
+// GetPrice returns the price of the underlying pricer, rounded to the
+// configured increment. It is part of the Pricer interface.
+func (r *RoundingPricer) GetPrice(ctx context.Context,
+	req *http.Request) (int64, error) {
+
+	price, err := r.next.GetPrice(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	return r.round(price), nil
+}
+
+// round rounds the given price to the configured increment.
+func (r *RoundingPricer) round(price int64) int64 {
+	// A zero price means free access, so we don't touch it, nor any
+	// invalid price.
+	if price <= 0 || r.increment <= 1 {
+		return price
+	}
+
+	var rounded int64
+	switch r.mode {
+	case RoundUp:
+		rounded = (price + r.increment - 1) / r.increment * r.increment
+
+	case RoundDown:
+		rounded = price / r.increment * r.increment
+
+	default:
+		rounded = (price + r.increment/2) / r.increment * r.increment
+	}
+
+	// We never want to turn a paid resource into a free one by rounding,
+	// so the smallest price is a single increment.
+	if rounded == 0 {
+		rounded = r.increment
+	}
+
+	// The rounded price must still respect the maximum price, so we fall
+	// back to the largest increment below it.
+	if r.maxPrice > 0 && rounded > r.maxPrice {
+		rounded = r.maxPrice / r.increment * r.increment
+		if rounded == 0 {
+			return price
+		}
+	}
+
+	return rounded
+}
+
+// Close is part of the Pricer interface. It closes the underlying pricer.
+func (r *RoundingPricer) Close() error {
+	return r.next.Close()
+}
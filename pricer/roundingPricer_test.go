@@ -0,0 +1,95 @@
+package pricer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRoundingPricer tests that prices are rounded to the configured increment
+// in each rounding mode while respecting the maximum price.
+func TestRoundingPricer(t *testing.T) {
+	const (
+		increment = 10
+		maxPrice  = 1000
+	)
+
+	testCases := []struct {
+		name     string
+		mode     RoundingMode
+		price    int64
+		expected int64
+	}{{
+		name:     "up",
+		mode:     RoundUp,
+		price:    21,
+		expected: 30,
+	}, {
+		name:     "up exact",
+		mode:     RoundUp,
+		price:    20,
+		expected: 20,
+	}, {
+		name:     "down",
+		mode:     RoundDown,
+		price:    29,
+		expected: 20,
+	}, {
+		name:     "down never free",
+		mode:     RoundDown,
+		price:    7,
+		expected: 10,
+	}, {
+		name:     "nearest down",
+		mode:     RoundNearest,
+		price:    24,
+		expected: 20,
+	}, {
+		name:     "nearest half up",
+		mode:     RoundNearest,
+		price:    25,
+		expected: 30,
+	}, {
+		name:     "default mode is nearest",
+		price:    26,
+		expected: 30,
+	}, {
+		name:     "free stays free",
+		mode:     RoundUp,
+		price:    0,
+		expected: 0,
+	}, {
+		name:     "up respects max price",
+		mode:     RoundUp,
+		price:    maxPrice - 1,
+		expected: maxPrice,
+	}, {
+		name:     "nearest respects max price",
+		mode:     RoundNearest,
+		price:    maxPrice,
+		expected: maxPrice,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			p := NewRoundingPricer(
+				NewDefaultPricer(tc.price), increment, tc.mode,
+				maxPrice,
+			)
+
+			price, err := p.GetPrice(context.Background(), nil)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, price)
+		})
+	}
+
+	// If the increment doesn't divide the maximum price, rounding up must
+	// fall back to the largest increment below the maximum.
+	p := NewRoundingPricer(NewDefaultPricer(995), 10, RoundUp, 999)
+	price, err := p.GetPrice(context.Background(), nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 990, price)
+}
@@ -0,0 +1,149 @@
+package pricer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+)
+
+var (
+	// ErrUnknownBodySize is returned if a request matches a rule that
+	// charges by the size of the request body, but the request doesn't
+	// declare the size of its body in the Content-Length header field.
+	ErrUnknownBodySize = errors.New("request body size unknown")
+)
+
+// RuleConfig holds the config of a RuleBasedPricer.
+type RuleConfig struct {
+	// Enabled indicates if the RuleBasedPricer is to be used.
+	Enabled bool `long:"enabled" description:"Set to true to price requests by the configured rules"`
+
+	// Rules is the list of rules to price requests by. The first rule
+	// matching the path of a request determines its price.
+	Rules []*Rule `long:"rules" description:"The rules to price requests by, the first matching rule determines the price"`
+}
+
+// Rule prices the requests whose URL path matches a regular expression.
+type Rule struct {
+	// PathRegexp is the regular expression the URL path of a request must
+	// match for the rule to apply. If empty, the rule matches all paths.
+	PathRegexp string `long:"pathregexp" description:"Regular expression to match the path of the URL against, matches all paths if empty"`
+
+	// Price is the base price in satoshis of a matching request.
+	Price int64 `long:"price" description:"The base price in satoshis of a matching request"`
+
+	// PricePerKB is the price in satoshis that is charged on top of the
+	// base price for each started kilobyte of the request body. As prices
+	// are only determined for requests without a valid L402, this only
+	// charges by the body of the request that triggers the payment
+	// challenge. The L402 can then be used for requests with bodies of any
+	// size. Requests that don't declare the size of their body, like
+	// chunked or gRPC requests, can't be priced.
+	PricePerKB int64 `long:"priceperkb" description:"The price in satoshis charged on top of the base price for each started kilobyte of the body of the request that triggers the payment challenge"`
+}
+
+// compiledRule is a rule with its compiled path regular expression.
+type compiledRule struct {
+	*Rule
+
+	pathRegexp *regexp.Regexp
+}
+
+// RuleBasedPricer prices requests by a list of rules that match the path of
+// a request and can charge by the size of its body. It implements the Pricer
+// interface.
+type RuleBasedPricer struct {
+	rules []*compiledRule
+
+	// defaultPrice is the price of requests that match none of the rules.
+	defaultPrice int64
+}
+
+// NewRuleBasedPricer initialises a new RuleBasedPricer that prices requests by
+// the given rules. Requests that match none of the rules are charged the given
+// default price.
+func NewRuleBasedPricer(cfg *RuleConfig,
+	defaultPrice int64) (*RuleBasedPricer, error) {
+
+	if len(cfg.Rules) == 0 {
+		return nil, errors.New("rule based pricer requires at least " +
+			"one rule")
+	}
+
+	rules := make([]*compiledRule, 0, len(cfg.Rules))
+	for idx, rule := range cfg.Rules {
+		if rule.Price < 0 || rule.PricePerKB < 0 {
+			return nil, fmt.Errorf("negative price in pricing "+
+				"rule %d", idx)
+		}
+
+		var pathRegexp *regexp.Regexp
+		if rule.PathRegexp != "" {
+			var err error
+			pathRegexp, err = regexp.Compile(rule.PathRegexp)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path regexp "+
+					"in pricing rule %d: %w", idx, err)
+			}
+		}
+
+		rules = append(rules, &compiledRule{
+			Rule:       rule,
+			pathRegexp: pathRegexp,
+		})
+	}
+
+	return &RuleBasedPricer{
+		rules:        rules,
+		defaultPrice: defaultPrice,
+	}, nil
+}
+
+// GetPrice returns the price of the first rule that matches the path of the
+// request. If the rule charges by the size of the request body, the size is
+// taken from the Content-Length header field, so the body isn't consumed. It
+// is part of the Pricer interface.
+func (p *RuleBasedPricer) GetPrice(_ context.Context,
+	r *http.Request) (int64, error) {
+
+	for _, rule := range p.rules {
+		if rule.pathRegexp != nil &&
+			!rule.pathRegexp.MatchString(r.URL.Path) {
+
+			continue
+		}
+
+		return rule.price(r)
+	}
+
+	return p.defaultPrice, nil
+}
+
+// price returns the price the rule charges for the given request.
+func (r *compiledRule) price(req *http.Request) (int64, error) {
+	if r.PricePerKB == 0 {
+		return r.Price, nil
+	}
+
+	if req.ContentLength < 0 {
+		return 0, ErrUnknownBodySize
+	}
+
+	// Every started kilobyte is charged in full.
+	kiloBytes := (req.ContentLength + 1023) / 1024
+	if kiloBytes > (math.MaxInt64-r.Price)/r.PricePerKB {
+		return 0, fmt.Errorf("price for request body of %d bytes out "+
+			"of range", req.ContentLength)
+	}
+
+	return r.Price + kiloBytes*r.PricePerKB, nil
+}
+
+// Close is part of the Pricer interface. For the RuleBasedPricer, the method
+// does nothing.
+func (p *RuleBasedPricer) Close() error {
+	return nil
+}
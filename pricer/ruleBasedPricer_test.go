@@ -0,0 +1,118 @@
+package pricer
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRuleBasedPricer tests that requests are priced by the first rule that
+// matches their path and the size of their body.
+func TestRuleBasedPricer(t *testing.T) {
+	const defaultPrice = 5
+
+	p, err := NewRuleBasedPricer(&RuleConfig{
+		Rules: []*Rule{{
+			PathRegexp: "^/upload/.*$",
+			Price:      10,
+			PricePerKB: 2,
+		}, {
+			PathRegexp: "^/premium/.*$",
+			Price:      100,
+		}, {
+			PathRegexp: "^/premium/expensive$",
+			Price:      1000,
+		}, {
+			PathRegexp: "^/huge$",
+			PricePerKB: math.MaxInt64 / 2,
+		}},
+	}, defaultPrice)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name          string
+		path          string
+		contentLength int64
+		expected      int64
+		expectedErr   error
+	}{{
+		name:     "no match",
+		path:     "/other",
+		expected: defaultPrice,
+	}, {
+		name:     "path",
+		path:     "/premium/item",
+		expected: 100,
+	}, {
+		name:     "first match wins",
+		path:     "/premium/expensive",
+		expected: 100,
+	}, {
+		name:     "empty body",
+		path:     "/upload/file",
+		expected: 10,
+	}, {
+		name:          "started kilobyte",
+		path:          "/upload/file",
+		contentLength: 1025,
+		expected:      14,
+	}, {
+		name:          "full kilobyte",
+		path:          "/upload/file",
+		contentLength: 1024,
+		expected:      12,
+	}, {
+		name:          "unknown size",
+		path:          "/upload/file",
+		contentLength: -1,
+		expectedErr:   ErrUnknownBodySize,
+	}, {
+		name:          "overflow",
+		path:          "/huge",
+		contentLength: 4096,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(
+				http.MethodPost, tc.path, nil,
+			)
+			req.ContentLength = tc.contentLength
+
+			price, err := p.GetPrice(context.Background(), req)
+			switch {
+			case tc.expectedErr != nil:
+				require.ErrorIs(t, err, tc.expectedErr)
+
+			case tc.expected == 0:
+				require.ErrorContains(t, err, "out of range")
+
+			default:
+				require.NoError(t, err)
+				require.Equal(t, tc.expected, price)
+			}
+		})
+	}
+
+	require.NoError(t, p.Close())
+}
+
+// TestRuleBasedPricerConfig tests that invalid rules are rejected.
+func TestRuleBasedPricerConfig(t *testing.T) {
+	_, err := NewRuleBasedPricer(&RuleConfig{}, 1)
+	require.ErrorContains(t, err, "at least one rule")
+
+	_, err = NewRuleBasedPricer(&RuleConfig{
+		Rules: []*Rule{{PathRegexp: "("}},
+	}, 1)
+	require.ErrorContains(t, err, "invalid path regexp")
+
+	_, err = NewRuleBasedPricer(&RuleConfig{
+		Rules: []*Rule{{PricePerKB: -1}},
+	}, 1)
+	require.ErrorContains(t, err, "negative price")
+}
@@ -1,9 +1,13 @@
 package aperture
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"net/http"
+	"strings"
 
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/proxy"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -17,6 +21,26 @@ var (
 		Name:      "mailbox_count",
 	})
 
+	// streamsCreatedTotal counts the mailbox streams that were created.
+	streamsCreatedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "hashmail",
+		Name:      "streams_created_total",
+	})
+
+	// streamsDeletedTotal counts the mailbox streams that were explicitly
+	// torn down by their creator.
+	streamsDeletedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "hashmail",
+		Name:      "streams_deleted_total",
+	})
+
+	// staleTeardownsTotal counts the mailbox streams that were torn down
+	// because they weren't used within the stale timeout.
+	staleTeardownsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "hashmail",
+		Name:      "stale_teardowns_total",
+	})
+
 	// mailboxReadCount counts each time a mailbox pair is being used.
 	// A session consists of a bidirectional stream each using a mailbox
 	// with an ID that overlaps for the first 63 bytes and differ for the
@@ -30,6 +54,69 @@ var (
 			Name:      "mailbox_read_count",
 		}, []string{streamIDLabel},
 	)
+
+	// mailboxBytesRead tracks the total number of message bytes read from
+	// both mailboxes of a session, labeled by the session's base stream
+	// ID.
+	mailboxBytesRead = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "hashmail",
+			Name:      "mailbox_bytes_read",
+		}, []string{streamIDLabel},
+	)
+
+	// mailboxBytesWritten tracks the total number of message bytes written
+	// to both mailboxes of a session, labeled by the session's base stream
+	// ID.
+	mailboxBytesWritten = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "hashmail",
+			Name:      "mailbox_bytes_written",
+		}, []string{streamIDLabel},
+	)
+
+	// lncSessions tracks the number of stored LNC sessions.
+	lncSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "lnc",
+		Name:      "sessions",
+	})
+
+	// lncSessionsExpired tracks the number of stored LNC sessions whose
+	// expiry has passed.
+	lncSessionsExpired = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "lnc",
+		Name:      "sessions_expired",
+	})
+
+	// lncSessionNextExpiry tracks the time in seconds until the next
+	// stored LNC session expires. It is +Inf if no session expires.
+	lncSessionNextExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "lnc",
+		Name:      "session_next_expiry_seconds",
+	})
+
+	// sessionsActive tracks the number of mailbox sessions that were read
+	// from at least at the configured active read rate during the last
+	// classification interval.
+	sessionsActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "hashmail",
+		Name:      "sessions_active",
+	})
+
+	// sessionsStandby tracks the number of mailbox sessions that were
+	// read from, but less often than the active read rate, during the last
+	// classification interval.
+	sessionsStandby = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "hashmail",
+		Name:      "sessions_standby",
+	})
+
+	// sessionsInUse tracks the number of mailbox sessions that were read
+	// from at all during the last classification interval.
+	sessionsInUse = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "hashmail",
+		Name:      "sessions_in_use",
+	})
 )
 
 // PrometheusConfig is the set of configuration data that specifies if
@@ -42,6 +129,79 @@ type PrometheusConfig struct {
 	// ListenAddr is the listening address that we should use to allow the
 	// main Prometheus server to scrape our metrics.
 	ListenAddr string `long:"listenaddr" description:"the interface we should listen on for prometheus"`
+
+	// BearerToken is an optional token that scrape requests must present
+	// in the Authorization header as "Bearer <token>".
+	BearerToken string `long:"bearertoken" description:"if set, scrape requests must authenticate with this bearer token"`
+
+	// BasicAuthUser and BasicAuthPassword are optional credentials that
+	// scrape requests must present using HTTP basic auth.
+	BasicAuthUser     string `long:"basicauthuser" description:"if set, scrape requests must authenticate with this basic auth user name"`
+	BasicAuthPassword string `long:"basicauthpassword" description:"the basic auth password for the basicauthuser"`
+
+	// BackendMetrics, if true, records the duration and the status code
+	// of each request proxied to a service backend, labeled by service.
+	BackendMetrics bool `long:"backendmetrics" description:"if true the duration and status code of each request proxied to a backend service are exported, labeled by service"`
+
+	// MacaroonSizeMetrics, if true, records the serialized size of each
+	// verified macaroon, labeled by service.
+	MacaroonSizeMetrics bool `long:"macaroonsizemetrics" description:"if true the serialized size of each verified macaroon is exported, labeled by service"`
+}
+
+// validate makes sure the config is consistent.
+func (c *PrometheusConfig) validate() error {
+	if (c.BasicAuthUser == "") != (c.BasicAuthPassword == "") {
+		return fmt.Errorf("prometheus basic auth requires both a " +
+			"user name and a password")
+	}
+
+	return nil
+}
+
+// metricsAuthHandler wraps the given metrics handler so that it requires the
+// bearer token or basic auth credentials of the config, if any are set. If
+// both are set, either of them is accepted.
+func metricsAuthHandler(cfg *PrometheusConfig,
+	next http.Handler) http.Handler {
+
+	if cfg.BearerToken == "" && cfg.BasicAuthUser == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.BearerToken != "" {
+			token, ok := strings.CutPrefix(
+				r.Header.Get("Authorization"), "Bearer ",
+			)
+			if ok && secureCompare(token, cfg.BearerToken) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add(
+				"WWW-Authenticate", `Bearer realm="metrics"`,
+			)
+		}
+
+		if cfg.BasicAuthUser != "" {
+			user, password, ok := r.BasicAuth()
+			if ok && secureCompare(user, cfg.BasicAuthUser) &&
+				secureCompare(password, cfg.BasicAuthPassword) {
+
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add(
+				"WWW-Authenticate", `Basic realm="metrics"`,
+			)
+		}
+
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// secureCompare compares the two strings in constant time.
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
 }
 
 // StartPrometheusExporter registers all relevant metrics with the Prometheus
@@ -53,9 +213,26 @@ func StartPrometheusExporter(cfg *PrometheusConfig) error {
 		return nil
 	}
 
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
 	// Next, we'll register all our metrics.
 	prometheus.MustRegister(mailboxCount)
+	prometheus.MustRegister(streamsCreatedTotal)
+	prometheus.MustRegister(streamsDeletedTotal)
+	prometheus.MustRegister(staleTeardownsTotal)
 	prometheus.MustRegister(mailboxReadCount)
+	prometheus.MustRegister(mailboxBytesRead)
+	prometheus.MustRegister(mailboxBytesWritten)
+	prometheus.MustRegister(sessionsActive)
+	prometheus.MustRegister(sessionsStandby)
+	prometheus.MustRegister(sessionsInUse)
+	prometheus.MustRegister(lncSessions)
+	prometheus.MustRegister(lncSessionsExpired)
+	prometheus.MustRegister(lncSessionNextExpiry)
+	proxy.RegisterMetrics()
+	auth.RegisterMetrics()
 
 	// Finally, we'll launch the HTTP server that Prometheus will use to
 	// scape our metrics.
@@ -63,7 +240,9 @@ func StartPrometheusExporter(cfg *PrometheusConfig) error {
 		log.Infof("Prometheus metrics http endpoint being served on "+
 			"%s", cfg.ListenAddr)
 
-		http.Handle("/metrics", promhttp.Handler())
+		http.Handle(
+			"/metrics", metricsAuthHandler(cfg, promhttp.Handler()),
+		)
 		fmt.Println(http.ListenAndServe(cfg.ListenAddr, nil))
 	}()
 
@@ -0,0 +1,101 @@
+package aperture
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMetricsAuthHandler makes sure the metrics endpoint can only be scraped
+// with the configured credentials.
+func TestMetricsAuthHandler(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "test",
+		Name:      "scrape_counter",
+	})
+	registry.MustRegister(counter)
+	counter.Inc()
+	metricsHandler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+
+	scrape := func(cfg *PrometheusConfig,
+		setAuth func(r *http.Request)) *httptest.ResponseRecorder {
+
+		req := httptest.NewRequest(
+			"GET", "http://localhost/metrics", nil,
+		)
+		if setAuth != nil {
+			setAuth(req)
+		}
+		rec := httptest.NewRecorder()
+		metricsAuthHandler(cfg, metricsHandler).ServeHTTP(rec, req)
+
+		return rec
+	}
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	basic := func(user, password string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.SetBasicAuth(user, password)
+		}
+	}
+	requireMetrics := func(rec *httptest.ResponseRecorder) {
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Contains(t, rec.Body.String(), "test_scrape_counter 1")
+	}
+
+	// Without any credentials configured, the endpoint is open.
+	requireMetrics(scrape(&PrometheusConfig{}, nil))
+
+	// With a bearer token, only requests with that token are served.
+	tokenCfg := &PrometheusConfig{BearerToken: "secret"}
+	rec := scrape(tokenCfg, nil)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.NotContains(t, rec.Body.String(), "test_scrape_counter")
+	require.Equal(
+		t, `Bearer realm="metrics"`,
+		rec.Header().Get("WWW-Authenticate"),
+	)
+	require.Equal(
+		t, http.StatusUnauthorized,
+		scrape(tokenCfg, bearer("wrong")).Code,
+	)
+	requireMetrics(scrape(tokenCfg, bearer("secret")))
+
+	// With basic auth, both user name and password must match.
+	basicCfg := &PrometheusConfig{
+		BasicAuthUser:     "prometheus",
+		BasicAuthPassword: "secret",
+	}
+	require.Equal(t, http.StatusUnauthorized, scrape(basicCfg, nil).Code)
+	require.Equal(
+		t, http.StatusUnauthorized,
+		scrape(basicCfg, basic("prometheus", "wrong")).Code,
+	)
+	require.Equal(
+		t, http.StatusUnauthorized,
+		scrape(basicCfg, basic("other", "secret")).Code,
+	)
+	requireMetrics(scrape(basicCfg, basic("prometheus", "secret")))
+
+	// If both are configured, either of them is accepted.
+	bothCfg := &PrometheusConfig{
+		BearerToken:       "token",
+		BasicAuthUser:     "prometheus",
+		BasicAuthPassword: "secret",
+	}
+	require.Equal(t, http.StatusUnauthorized, scrape(bothCfg, nil).Code)
+	requireMetrics(scrape(bothCfg, bearer("token")))
+	requireMetrics(scrape(bothCfg, basic("prometheus", "secret")))
+
+	// Basic auth needs both a user name and a password.
+	require.Error(t, (&PrometheusConfig{BasicAuthUser: "foo"}).validate())
+	require.NoError(t, basicCfg.validate())
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// AccessLogFormatText logs each request in an apache-like text
+	// format. This is the default.
+	AccessLogFormatText = "text"
+
+	// AccessLogFormatJSON logs each request as a single JSON object.
+	AccessLogFormatJSON = "json"
+)
+
+const (
+	// authOutcomeNone means no authentication was required or performed
+	// for the request.
+	authOutcomeNone = "none"
+
+	// authOutcomeAccepted means the request carried a valid L402.
+	authOutcomeAccepted = "accepted"
+
+	// authOutcomePaymentRequired means the request didn't carry a valid
+	// L402 and a payment challenge was sent.
+	authOutcomePaymentRequired = "payment_required"
+
+	// authOutcomeFreebie means the request didn't carry a valid L402 but
+	// was let through as a freebie.
+	authOutcomeFreebie = "freebie"
+
+	// authOutcomeZeroPrice means the request didn't carry a valid L402 but
+	// was let through because the resource has a price of zero.
+	authOutcomeZeroPrice = "zero_price"
+
+	// authOutcomeShed means the request was shed before it could be
+	// authenticated.
+	authOutcomeShed = "shed"
+
+	// authOutcomeBlocked means the request was denied because its remote
+	// address is on the blocklist.
+	authOutcomeBlocked = "blocked"
+
+	// authOutcomeAuditAllow means the request to a service in audit mode
+	// would have been allowed.
+	authOutcomeAuditAllow = "audit_allow"
+
+	// authOutcomeAuditCharge means the request to a service in audit mode
+	// would have been sent a payment challenge but was let through.
+	authOutcomeAuditCharge = "audit_charge"
+
+	// authOutcomeError means authenticating the request failed because of
+	// an internal error.
+	authOutcomeError = "error"
+)
+
+// accessLogEntry is a single request entry of the structured access log.
+type accessLogEntry struct {
+	RemoteIP    string  `json:"remote_ip"`
+	Method      string  `json:"method"`
+	URI         string  `json:"uri"`
+	Proto       string  `json:"proto"`
+	Status      int     `json:"status"`
+	Bytes       int64   `json:"bytes"`
+	DurationMs  float64 `json:"duration_ms"`
+	Service     string  `json:"service,omitempty"`
+	AuthOutcome string  `json:"auth_outcome"`
+	Referer     string  `json:"referer,omitempty"`
+	UserAgent   string  `json:"user_agent,omitempty"`
+}
+
+// write writes the entry to the proxy log as a single JSON line.
+func (e *accessLogEntry) write() {
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("Unable to encode access log entry: %v", err)
+		return
+	}
+
+	log.Infof("%s", line)
+}
+
+// responseRecorder is an http.ResponseWriter that records the status code and
+// the number of body bytes written to the wrapped writer.
+type responseRecorder struct {
+	http.ResponseWriter
+
+	status int
+	bytes  int64
+}
+
+// newResponseRecorder wraps the given response writer.
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w}
+}
+
+// WriteHeader records the status code and passes it on to the wrapped writer.
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	// Only the first call counts, informational responses aside.
+	if r.status == 0 && statusCode >= http.StatusOK {
+		r.status = statusCode
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write records the number of bytes written and passes them on to the wrapped
+// writer.
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+
+	return n, err
+}
+
+// Flush flushes the wrapped writer if it supports flushing. The reverse proxy
+// relies on this to stream responses such as gRPC server streams.
+func (r *responseRecorder) Flush() {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack takes over the connection of the wrapped writer, which is done to
+// proxy WebSocket connections. Such requests are logged with the status code
+// of the protocol switch.
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil {
+		r.status = http.StatusSwitchingProtocols
+	}
+
+	return conn, buf, err
+}
+
+// Unwrap returns the wrapped writer so http.ResponseController can reach any
+// optional interfaces it implements.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// statusCode returns the recorded status code. If nothing was written at all,
+// the server will reply with 200 OK.
+func (r *responseRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+
+	return r.status
+}
+
+// A compile-time constraint to ensure responseRecorder implements
+// http.Flusher and http.Hijacker.
+var (
+	_ http.Flusher  = (*responseRecorder)(nil)
+	_ http.Hijacker = (*responseRecorder)(nil)
+)
+
+// newAccessLogEntry creates the access log entry for the given request that
+// was started at the given time and answered through the given recorder.
+func newAccessLogEntry(r *http.Request, remoteIP, serviceName,
+	authOutcome string, start time.Time,
+	rec *responseRecorder) *accessLogEntry {
+
+	return &accessLogEntry{
+		RemoteIP:    remoteIP,
+		Method:      r.Method,
+		URI:         r.RequestURI,
+		Proto:       r.Proto,
+		Status:      rec.statusCode(),
+		Bytes:       rec.bytes,
+		DurationMs:  float64(time.Since(start)) / float64(time.Millisecond),
+		Service:     serviceName,
+		AuthOutcome: authOutcome,
+		Referer:     r.Referer(),
+		UserAgent:   r.UserAgent(),
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btclog"
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestJSONAccessLog makes sure that each request is logged as a structured
+// JSON line when the JSON access log format is configured.
+func TestJSONAccessLog(t *testing.T) {
+	var logBuf bytes.Buffer
+	logger := btclog.NewBackend(&logBuf).Logger(Subsystem)
+	logger.SetLevel(btclog.LevelInfo)
+
+	oldLogger := log
+	UseLogger(logger)
+	t.Cleanup(func() {
+		UseLogger(oldLogger)
+	})
+
+	services := []*Service{{
+		Name:       "service1",
+		Address:    "127.0.0.1:1",
+		HostRegexp: "^service1.com$",
+		Protocol:   "http",
+		Auth:       "on",
+	}}
+	localService := NewLocalService(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+			_, _ = w.Write([]byte("hello"))
+		}), func(r *http.Request) bool {
+			return true
+		},
+	)
+
+	p, err := NewWithConfig(&Config{
+		AccessLogFormat: AccessLogFormatJSON,
+	}, auth.NewMockAuthenticator(), services, localService)
+	require.NoError(t, err)
+
+	// serve sends a request to the given host and returns the access log
+	// entry that was written for it.
+	serve := func(host string, header http.Header) *accessLogEntry {
+		logBuf.Reset()
+
+		req := httptest.NewRequest("GET", "http://"+host+"/foo", nil)
+		req.RemoteAddr = "1.2.3.4:5678"
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		p.ServeHTTP(httptest.NewRecorder(), req)
+
+		// Find the JSON access log line among the log output.
+		var entry *accessLogEntry
+		scanner := bufio.NewScanner(&logBuf)
+		for scanner.Scan() {
+			line := scanner.Text()
+			idx := strings.Index(line, "{")
+			if idx < 0 {
+				continue
+			}
+
+			entry = &accessLogEntry{}
+			err := json.Unmarshal([]byte(line[idx:]), entry)
+			require.NoError(t, err)
+		}
+		require.NotNil(t, entry)
+
+		return entry
+	}
+
+	// A request for the local service doesn't need any authentication.
+	entry := serve("other.com", nil)
+	require.Equal(t, "1.2.3.4", entry.RemoteIP)
+	require.Equal(t, "GET", entry.Method)
+	require.Equal(t, "http://other.com/foo", entry.URI)
+	require.Equal(t, "HTTP/1.1", entry.Proto)
+	require.Equal(t, http.StatusTeapot, entry.Status)
+	require.EqualValues(t, len("hello"), entry.Bytes)
+	require.Empty(t, entry.Service)
+	require.Equal(t, authOutcomeNone, entry.AuthOutcome)
+	require.GreaterOrEqual(t, entry.DurationMs, float64(0))
+
+	// An unauthenticated request for the proxied service is answered with
+	// a payment challenge.
+	entry = serve("service1.com", nil)
+	require.Equal(t, http.StatusPaymentRequired, entry.Status)
+	require.Positive(t, entry.Bytes)
+	require.Equal(t, "service1", entry.Service)
+	require.Equal(t, authOutcomePaymentRequired, entry.AuthOutcome)
+
+	// An authenticated request is passed on to the backend, which isn't
+	// reachable.
+	entry = serve("service1.com", http.Header{
+		"Authorization": []string{"L402 foo:bar"},
+	})
+	require.Equal(t, http.StatusBadGateway, entry.Status)
+	require.Equal(t, "service1", entry.Service)
+	require.Equal(t, authOutcomeAccepted, entry.AuthOutcome)
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// admissionController limits the total number of requests the proxy admits,
+// independent of the service they are targeted at. This protects the process
+// as a whole from being overwhelmed by a thundering herd of requests.
+type admissionController struct {
+	// limiter limits the rate at which requests are admitted. If nil,
+	// the rate is not limited.
+	limiter *rate.Limiter
+
+	// slots is a semaphore that limits the number of concurrently handled
+	// requests. If nil, the number of concurrent requests is not limited.
+	slots chan struct{}
+}
+
+// newAdmissionController creates a new admission controller for the given
+// limits. A value of zero for any of the limits means unlimited.
+func newAdmissionController(maxRate float64, burst,
+	maxConcurrent int) *admissionController {
+
+	a := &admissionController{}
+
+	if maxRate > 0 {
+		// If no burst is configured, we allow at least the number of
+		// requests that can happen within a second.
+		if burst <= 0 {
+			burst = int(math.Max(1, math.Ceil(maxRate)))
+		}
+		a.limiter = rate.NewLimiter(rate.Limit(maxRate), burst)
+	}
+
+	if maxConcurrent > 0 {
+		a.slots = make(chan struct{}, maxConcurrent)
+	}
+
+	return a
+}
+
+// admit returns true if a new request can be admitted. If the request is
+// admitted, the returned release function must be called once the request has
+// been handled. The concurrency limit is checked first, so requests rejected
+// by it don't use up the rate limit.
+func (a *admissionController) admit() (func(), bool) {
+	release := func() {}
+	if a.slots != nil {
+		select {
+		case a.slots <- struct{}{}:
+			release = func() { <-a.slots }
+
+		default:
+			return nil, false
+		}
+	}
+
+	if a.limiter != nil && !a.limiter.Allow() {
+		release()
+		return nil, false
+	}
+
+	return release, true
+}
+
+// verificationLimiter limits the number of authentication verifications that
+// run concurrently. This is separate from the admission controller as
+// verifying an L402 involves crypto operations and a store lookup, which is
+// considerably more expensive than handling other requests.
+type verificationLimiter struct {
+	// slots is a semaphore that limits the number of concurrent
+	// verifications. If nil, the number of verifications is not limited.
+	slots chan struct{}
+
+	// queueTimeout is the maximum time a verification waits for a free
+	// slot before it is shed. If zero, verifications are shed right away.
+	queueTimeout time.Duration
+}
+
+// newVerificationLimiter creates a new verification limiter. A value of zero
+// for maxConcurrent means unlimited.
+func newVerificationLimiter(maxConcurrent int,
+	queueTimeout time.Duration) *verificationLimiter {
+
+	v := &verificationLimiter{
+		queueTimeout: queueTimeout,
+	}
+
+	if maxConcurrent > 0 {
+		v.slots = make(chan struct{}, maxConcurrent)
+	}
+
+	return v
+}
+
+// acquire waits for a free verification slot, returning true if one was
+// obtained. If so, the returned release function must be called once the
+// verification is done.
+func (v *verificationLimiter) acquire(ctx context.Context) (func(), bool) {
+	if v.slots == nil {
+		return func() {}, true
+	}
+
+	release := func() { <-v.slots }
+
+	select {
+	case v.slots <- struct{}{}:
+		return release, true
+
+	default:
+	}
+
+	if v.queueTimeout <= 0 {
+		return nil, false
+	}
+
+	timer := time.NewTimer(v.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case v.slots <- struct{}{}:
+		return release, true
+
+	case <-timer.C:
+		return nil, false
+
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// requestQueue limits the number of requests that are concurrently proxied to
+// the backend of a single service. Excess requests can wait in a queue of
+// bounded length for a bounded time, which smooths out bursts to slow
+// backends, before they are shed.
+type requestQueue struct {
+	// slots is a semaphore that limits the number of concurrent requests.
+	slots chan struct{}
+
+	// waiting is a semaphore that limits the number of requests waiting
+	// for a free slot. If nil, requests are shed right away.
+	waiting chan struct{}
+
+	// maxWait is the maximum time a request waits for a free slot.
+	maxWait time.Duration
+}
+
+// newRequestQueue creates a new request queue that admits the given number of
+// concurrent requests. If both maxQueueLength and maxWait are positive, up to
+// maxQueueLength excess requests wait for up to maxWait for a free slot.
+func newRequestQueue(maxConcurrent, maxQueueLength int,
+	maxWait time.Duration) *requestQueue {
+
+	q := &requestQueue{
+		slots:   make(chan struct{}, maxConcurrent),
+		maxWait: maxWait,
+	}
+
+	if maxQueueLength > 0 && maxWait > 0 {
+		q.waiting = make(chan struct{}, maxQueueLength)
+	}
+
+	return q
+}
+
+// acquire waits for a free slot, returning true if one was obtained. If so,
+// the returned release function must be called once the request has been
+// handled. Requests are shed if the queue is full, the maximum wait time is
+// exceeded or the given context is canceled.
+func (q *requestQueue) acquire(ctx context.Context) (func(), bool) {
+	release := func() { <-q.slots }
+
+	select {
+	case q.slots <- struct{}{}:
+		return release, true
+
+	default:
+	}
+
+	if q.waiting == nil {
+		return nil, false
+	}
+
+	// Take a place in the queue, if there's one left.
+	select {
+	case q.waiting <- struct{}{}:
+		defer func() { <-q.waiting }()
+
+	default:
+		return nil, false
+	}
+
+	timer := time.NewTimer(q.maxWait)
+	defer timer.Stop()
+
+	select {
+	case q.slots <- struct{}{}:
+		return release, true
+
+	case <-timer.C:
+		return nil, false
+
+	case <-ctx.Done():
+		return nil, false
+	}
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAdmissionControllerTokens makes sure requests rejected by the
+// concurrency limit don't use up the rate limit.
+func TestAdmissionControllerTokens(t *testing.T) {
+	a := newAdmissionController(0.001, 2, 1)
+
+	release, ok := a.admit()
+	require.True(t, ok)
+
+	// The request is rejected because of the concurrency limit, which must
+	// leave the remaining token of the burst untouched.
+	_, ok = a.admit()
+	require.False(t, ok)
+
+	release()
+	release, ok = a.admit()
+	require.True(t, ok)
+	release()
+
+	// Now the burst is used up, so the rate limit rejects the request and
+	// frees its concurrency slot again.
+	_, ok = a.admit()
+	require.False(t, ok)
+	require.Empty(t, a.slots)
+}
+
+// TestRequestQueue makes sure requests beyond the concurrency limit wait in
+// the queue and proceed once a slot frees up, and are shed if the queue is
+// full or they waited too long.
+func TestRequestQueue(t *testing.T) {
+	ctx := context.Background()
+
+	// Without a queue, excess requests are shed right away.
+	q := newRequestQueue(1, 0, 0)
+	release, ok := q.acquire(ctx)
+	require.True(t, ok)
+
+	_, ok = q.acquire(ctx)
+	require.False(t, ok)
+
+	release()
+	release, ok = q.acquire(ctx)
+	require.True(t, ok)
+	release()
+
+	// With a queue, an excess request waits for a free slot.
+	q = newRequestQueue(1, 1, time.Minute)
+	release, ok = q.acquire(ctx)
+	require.True(t, ok)
+
+	acquired := make(chan func())
+	go func() {
+		queuedRelease, ok := q.acquire(ctx)
+		if ok {
+			acquired <- queuedRelease
+		}
+		close(acquired)
+	}()
+
+	// Once the queued request holds its place, the queue is full.
+	require.Eventually(t, func() bool {
+		return len(q.waiting) == 1
+	}, time.Second, time.Millisecond)
+	_, ok = q.acquire(ctx)
+	require.False(t, ok)
+
+	// Releasing the slot lets the queued request proceed.
+	release()
+	queuedRelease, ok := <-acquired
+	require.True(t, ok)
+	require.Empty(t, q.waiting)
+
+	// A request that waits longer than the maximum wait time is shed.
+	q.maxWait = 10 * time.Millisecond
+	start := time.Now()
+	_, ok = q.acquire(ctx)
+	require.False(t, ok)
+	require.GreaterOrEqual(t, time.Since(start), q.maxWait)
+
+	// So is a request whose client gives up.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	q.maxWait = time.Minute
+	_, ok = q.acquire(cancelCtx)
+	require.False(t, ok)
+
+	queuedRelease()
+}
+
+// TestServiceConcurrencyLimit makes sure requests to a service at its
+// concurrency limit are queued and shed by the proxy.
+func TestServiceConcurrencyLimit(t *testing.T) {
+	enter, block := make(chan struct{}, 2), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			enter <- struct{}{}
+			<-block
+		},
+	))
+	defer backend.Close()
+
+	address := strings.TrimPrefix(backend.URL, "http://")
+	services := []*Service{{
+		Name:                  "limited",
+		Address:               address,
+		HostRegexp:            "^limited.com$",
+		Protocol:              "http",
+		Auth:                  "off",
+		MaxConcurrentRequests: 1,
+		MaxQueueLength:        1,
+		MaxQueueWait:          time.Minute,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	serve := func() int {
+		req := httptest.NewRequest("GET", "http://limited.com/", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	// The first request takes the only slot, the second one is queued.
+	codes := make(chan int, 2)
+	go func() { codes <- serve() }()
+	<-enter
+	go func() { codes <- serve() }()
+
+	queue := services[0].queue
+	require.Eventually(t, func() bool {
+		return len(queue.waiting) == 1
+	}, time.Second, time.Millisecond)
+
+	// With the queue full, a third request is shed.
+	require.Equal(t, http.StatusServiceUnavailable, serve())
+
+	// Once the backend responds, the queued request proceeds.
+	close(block)
+	require.Equal(t, http.StatusOK, <-codes)
+	require.Equal(t, http.StatusOK, <-codes)
+	<-enter
+
+	// Negative limits are rejected.
+	services[0].MaxQueueLength = -1
+	_, err = New(auth.NewMockAuthenticator(), services)
+	require.Error(t, err)
+}
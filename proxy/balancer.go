@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// backendCooldown is the time a backend address isn't used after a
+	// connection to it failed.
+	backendCooldown = 10 * time.Second
+)
+
+// BackendAddress is one of several addresses of a service's backend instances
+// that requests are distributed across.
+type BackendAddress struct {
+	// Address is the IP address and port of the backend instance.
+	Address string `long:"address" description:"IP address and port of the backend instance"`
+
+	// Weight is the share of requests the backend instance receives in
+	// relation to the weights of the other instances. If zero, a weight of
+	// one is used.
+	Weight int `long:"weight" description:"The relative share of requests the backend instance receives"`
+}
+
+// backend is a single backend instance of a service.
+type backend struct {
+	address string
+	weight  int
+
+	// currentWeight is the running weight of the smooth weighted
+	// round-robin algorithm.
+	currentWeight int
+
+	// downUntil is the time until which the backend isn't used because a
+	// connection to it failed.
+	downUntil time.Time
+}
+
+// backendPool distributes the requests to a service across its backend
+// instances using smooth weighted round-robin. Instances that can't be
+// connected to are skipped for a cooldown period, unless all of them are down.
+type backendPool struct {
+	mu       sync.Mutex
+	backends []*backend
+
+	now func() time.Time
+}
+
+// newBackendPool creates a pool of the given backend addresses.
+func newBackendPool(addresses []BackendAddress) (*backendPool, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("no backend address")
+	}
+
+	pool := &backendPool{
+		backends: make([]*backend, 0, len(addresses)),
+		now:      time.Now,
+	}
+	for _, a := range addresses {
+		switch {
+		case a.Address == "":
+			return nil, errors.New("empty backend address")
+
+		case a.Weight < 0:
+			return nil, fmt.Errorf("negative weight for backend "+
+				"address %s", a.Address)
+		}
+
+		weight := a.Weight
+		if weight == 0 {
+			weight = 1
+		}
+
+		pool.backends = append(pool.backends, &backend{
+			address: a.Address,
+			weight:  weight,
+		})
+	}
+
+	return pool, nil
+}
+
+// next returns the address of the backend instance the next request should be
+// sent to.
+func (p *backendPool) next() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Only the backends that are up take part in the selection. If none
+	// is, we try all of them rather than failing right away.
+	now := p.now()
+	candidates := make([]*backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if !now.Before(b.downUntil) {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.backends
+	}
+
+	var (
+		selected    *backend
+		totalWeight int
+	)
+	for _, b := range candidates {
+		b.currentWeight += b.weight
+		totalWeight += b.weight
+
+		if selected == nil || b.currentWeight > selected.currentWeight {
+			selected = b
+		}
+	}
+	selected.currentWeight -= totalWeight
+
+	return selected.address
+}
+
+// markDown excludes the backend instance with the given address from the
+// selection for the cooldown period.
+func (p *backendPool) markDown(address string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, b := range p.backends {
+		if b.address != address {
+			continue
+		}
+
+		log.Warnf("Unable to connect to backend %s, not using it for "+
+			"%v", address, backendCooldown)
+		b.downUntil = p.now().Add(backendCooldown)
+	}
+}
+
+// isDialError returns true if the error occurred while connecting to a
+// backend, which means the request never reached it.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
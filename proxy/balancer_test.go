@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBackendPool makes sure requests are distributed by weight and that
+// backends that are down are skipped until their cooldown is over.
+func TestBackendPool(t *testing.T) {
+	_, err := newBackendPool([]BackendAddress{{Address: "a", Weight: -1}})
+	require.Error(t, err)
+	_, err = newBackendPool([]BackendAddress{{}})
+	require.Error(t, err)
+
+	pool, err := newBackendPool([]BackendAddress{{
+		Address: "a",
+		Weight:  3,
+	}, {
+		Address: "b",
+	}})
+	require.NoError(t, err)
+
+	now := time.Unix(1000, 0)
+	pool.now = func() time.Time {
+		return now
+	}
+
+	pick := func(n int) []string {
+		addresses := make([]string, n)
+		for i := range addresses {
+			addresses[i] = pool.next()
+		}
+
+		return addresses
+	}
+
+	// The smooth weighted round-robin interleaves the backends.
+	require.Equal(t, []string{"a", "a", "b", "a"}, pick(4))
+	require.Equal(t, []string{"a", "a", "b", "a"}, pick(4))
+
+	// A backend that is down isn't used until the cooldown is over.
+	pool.markDown("a")
+	require.Equal(t, []string{"b", "b"}, pick(2))
+
+	// If all backends are down, they are used anyway.
+	pool.markDown("b")
+	require.Contains(t, []string{"a", "b"}, pool.next())
+
+	now = now.Add(backendCooldown)
+	require.ElementsMatch(t, []string{"a", "a", "a", "b"}, pick(4))
+}
+
+// TestProxyBackendAddresses makes sure requests to a service with several
+// backend addresses are distributed across them and that an unreachable
+// backend is skipped.
+func TestProxyBackendAddresses(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer backend.Close()
+
+	// We reserve an address nothing listens on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachable := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	reachable := strings.TrimPrefix(backend.URL, "http://")
+
+	newService := func() *Service {
+		return &Service{
+			Name: "service",
+			Addresses: []BackendAddress{{
+				Address: reachable,
+			}, {
+				Address: unreachable,
+			}},
+			HostRegexp: "^service.com$",
+			Protocol:   "http",
+			Auth:       "off",
+		}
+	}
+
+	// A service can't have both an address and addresses.
+	invalid := newService()
+	invalid.Address = unreachable
+	_, err = New(auth.NewMockAuthenticator(), []*Service{invalid})
+	require.Error(t, err)
+
+	p, err := New(
+		auth.NewMockAuthenticator(), []*Service{newService()},
+	)
+	require.NoError(t, err)
+
+	// The second request goes to the unreachable backend and fails. From
+	// then on, only the reachable backend is used.
+	codes := make([]int, 5)
+	for i := range codes {
+		req := httptest.NewRequest("GET", "http://service.com/", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		codes[i] = rec.Code
+	}
+	require.Equal(t, []int{
+		http.StatusOK, http.StatusBadGateway, http.StatusOK,
+		http.StatusOK, http.StatusOK,
+	}, codes)
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+)
+
+// blocklist is a list of remote IP addresses and subnets that are denied
+// access to the proxy.
+type blocklist struct {
+	// ips holds the single blocked IP addresses for an exact match.
+	ips map[string]struct{}
+
+	// nets holds the blocked subnets.
+	nets []*net.IPNet
+}
+
+// newBlocklist parses the given entries, which can either be single IP
+// addresses or subnets in CIDR notation. Entries that are neither are skipped
+// with a warning.
+func newBlocklist(entries []string) *blocklist {
+	bl := &blocklist{
+		ips: make(map[string]struct{}),
+	}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+
+		if ip := net.ParseIP(entry); ip != nil {
+			bl.ips[ip.String()] = struct{}{}
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Warnf("Ignoring invalid blocklist entry %q, must "+
+				"be an IP address or CIDR subnet", entry)
+			continue
+		}
+		bl.nets = append(bl.nets, ipNet)
+	}
+
+	return bl
+}
+
+// isBlocked returns true if the given IP address is on the blocklist, either
+// directly or as part of a blocked subnet.
+func (b *blocklist) isBlocked(ip net.IP) bool {
+	if _, ok := b.ips[ip.String()]; ok {
+		return true
+	}
+
+	for _, ipNet := range b.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxCacheBodySize is the maximum size of a response body that is
+	// cached. Larger responses are passed through without being cached.
+	maxCacheBodySize = 1 << 20
+
+	// maxCacheSize is the maximum total size of the bodies of all cached
+	// responses across all services.
+	maxCacheSize = 64 << 20
+)
+
+// cachedResponse is a successful backend response that is served to further
+// requests for the same resource until it expires.
+type cachedResponse struct {
+	header http.Header
+	body   []byte
+	stored time.Time
+	expiry time.Time
+}
+
+// response creates a new response to the given request from the cached one.
+func (c *cachedResponse) response(req *http.Request,
+	now time.Time) *http.Response {
+
+	header := c.header.Clone()
+	header.Set("Age", strconv.Itoa(int(now.Sub(c.stored).Seconds())))
+
+	return &http.Response{
+		Status: fmt.Sprintf(
+			"%d %s", http.StatusOK, http.StatusText(http.StatusOK),
+		),
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(c.body)),
+		ContentLength: int64(len(c.body)),
+		Request:       req,
+	}
+}
+
+// cacheTransport is a round tripper that caches the successful responses to
+// GET requests of services that have CacheTTL set. Requests for a cached
+// resource are answered from the cache without reaching the backend. As the
+// transport is only used for authorized requests, the cache doesn't affect
+// authentication.
+type cacheTransport struct {
+	next http.RoundTripper
+
+	mu        sync.Mutex
+	responses map[string]*cachedResponse
+
+	// size is the total size of the bodies of all cached responses.
+	size int
+
+	now func() time.Time
+}
+
+// A compile-time constraint to ensure cacheTransport implements
+// http.RoundTripper.
+var _ http.RoundTripper = (*cacheTransport)(nil)
+
+// newCacheTransport creates a new response caching round tripper that sends
+// requests through the given round tripper.
+func newCacheTransport(next http.RoundTripper) *cacheTransport {
+	return &cacheTransport{
+		next:      next,
+		responses: make(map[string]*cachedResponse),
+		now:       time.Now,
+	}
+}
+
+// RoundTrip answers the request from the cache if possible. Otherwise it is
+// sent to the backend and a successful response is cached.
+//
+// NOTE: This is part of the http.RoundTripper interface.
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+
+	service, ok := serviceFromContext(req.Context())
+	if !ok || service.CacheTTL == 0 || req.Method != http.MethodGet {
+		return t.next.RoundTrip(req)
+	}
+
+	// Like the backend instance, the host name isn't part of the key, as
+	// all hosts of a service serve the same resources.
+	key := service.Name + " " + req.URL.RequestURI()
+	if cached, ok := t.lookup(key); ok {
+		log.Tracef("Serving cached response of service %s for %s",
+			service.Name, req.URL.Path)
+
+		return cached.response(req, t.now()), nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusOK && cacheable(resp) {
+		t.store(key, resp, service.CacheTTL)
+	}
+
+	return resp, nil
+}
+
+// cacheable returns true if the given response may be cached and served to
+// other clients.
+func cacheable(resp *http.Response) bool {
+	// Cookies are specific to a single client.
+	if len(resp.Header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+
+	// Private responses are meant for a single client only.
+	for _, value := range resp.Header.Values("Cache-Control") {
+		if strings.Contains(strings.ToLower(value), "private") {
+			return false
+		}
+	}
+
+	// The cache key only consists of the service and the requested
+	// resource, so responses that vary by any request header field would
+	// be served to clients they weren't meant for.
+	if len(resp.Header.Values("Vary")) > 0 {
+		return false
+	}
+
+	return storable(resp)
+}
+
+// store reads the body of the given response and caches the response for the
+// given period. The body of the response is replaced, so it can still be read
+// by the caller. Responses that are too large aren't cached.
+func (t *cacheTransport) store(key string, resp *http.Response,
+	period time.Duration) {
+
+	body, ok := readBody(resp, maxCacheBodySize)
+	if !ok {
+		return
+	}
+
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if old, ok := t.responses[key]; ok {
+		t.size -= len(old.body)
+		delete(t.responses, key)
+	}
+
+	// If there's no more room, we make some by removing the expired
+	// responses. If that's not enough, the response isn't cached.
+	if t.size+len(body) > maxCacheSize {
+		for k, r := range t.responses {
+			if now.After(r.expiry) {
+				t.size -= len(r.body)
+				delete(t.responses, k)
+			}
+		}
+
+		if t.size+len(body) > maxCacheSize {
+			return
+		}
+	}
+
+	t.responses[key] = &cachedResponse{
+		header: resp.Header.Clone(),
+		body:   body,
+		stored: now,
+		expiry: now.Add(period),
+	}
+	t.size += len(body)
+}
+
+// lookup returns the cached response for the given key if it hasn't expired.
+func (t *cacheTransport) lookup(key string) (*cachedResponse, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cached, ok := t.responses[key]
+	if !ok {
+		return nil, false
+	}
+
+	if t.now().After(cached.expiry) {
+		t.size -= len(cached.body)
+		delete(t.responses, key)
+		return nil, false
+	}
+
+	return cached, true
+}
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestResponseCache makes sure cached responses are served without reaching
+// the backend, but only to authorized requests.
+func TestResponseCache(t *testing.T) {
+	var numRequests atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			numRequests.Add(1)
+
+			switch r.URL.Path {
+			case "/nostore":
+				w.Header().Set("Cache-Control", "no-store")
+			case "/private":
+				w.Header().Set(
+					"Cache-Control", "private, max-age=60",
+				)
+			case "/vary":
+				w.Header().Set("Vary", "Authorization")
+			}
+			if r.URL.Path == "/missing" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+			_, _ = w.Write([]byte("hello " + r.URL.Path))
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:       "cached",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: "^cached.com$",
+		Protocol:   "http",
+		Auth:       "on",
+		CacheTTL:   time.Minute,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	serve := func(method, path string, authorized bool) (
+		*httptest.ResponseRecorder, int32) {
+
+		req := httptest.NewRequest(
+			method, "http://cached.com"+path, nil,
+		)
+		if authorized {
+			req.Header.Set("Authorization", "L402 token")
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec, numRequests.Load()
+	}
+
+	rec, num := serve("GET", "/resource", true)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "hello /resource", rec.Body.String())
+	require.EqualValues(t, 1, num)
+
+	// The second request is answered from the cache.
+	rec, num = serve("GET", "/resource", true)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "hello /resource", rec.Body.String())
+	require.Equal(t, "0", rec.Header().Get("Age"))
+	require.EqualValues(t, 1, num)
+
+	// Unauthorized requests are still challenged.
+	rec, _ = serve("GET", "/resource", false)
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+
+	// Other methods, responses that must not be stored or served to other
+	// clients and non-200 responses aren't cached.
+	for _, req := range []struct {
+		method string
+		path   string
+	}{
+		{"POST", "/resource"},
+		{"GET", "/nostore"},
+		{"GET", "/private"},
+		{"GET", "/vary"},
+		{"GET", "/missing"},
+	} {
+		_, before := serve(req.method, req.path, true)
+		_, after := serve(req.method, req.path, true)
+		require.Equal(t, before+1, after, req.path)
+	}
+}
+
+// TestCacheIdentityConflict makes sure services can't both cache responses and
+// forward the token identity, as cached responses are served to all clients.
+func TestCacheIdentityConflict(t *testing.T) {
+	err := prepareServices([]*Service{{
+		Name:                 "cached",
+		Address:              "127.0.0.1:1",
+		CacheTTL:             time.Minute,
+		ForwardTokenIdentity: true,
+	}}, 0, nil)
+	require.ErrorContains(t, err, "forwarding the token identity")
+}
+
+// TestCacheTransportExpiry makes sure cached responses are only served within
+// their TTL and that the total cache size is capped.
+func TestCacheTransportExpiry(t *testing.T) {
+	next := &staticRoundTripper{}
+	transport := newCacheTransport(next)
+
+	now := time.Unix(1000, 0)
+	transport.now = func() time.Time {
+		return now
+	}
+
+	service := &Service{Name: "service", CacheTTL: 10 * time.Second}
+	roundTrip := func(path string) (*http.Response, error) {
+		req := httptest.NewRequest(
+			"GET", "http://service.com"+path, nil,
+		)
+		ctx := context.WithValue(
+			context.Background(), serviceContextKey{}, service,
+		)
+
+		return transport.RoundTrip(req.WithContext(ctx))
+	}
+	newResponse := func(body string) *http.Response {
+		rec := httptest.NewRecorder()
+		_, _ = rec.WriteString(body)
+
+		return rec.Result()
+	}
+
+	next.resp = newResponse("first")
+	_, err := roundTrip("/")
+	require.NoError(t, err)
+
+	// Within the TTL, the cached response is served.
+	now = now.Add(10 * time.Second)
+	next.resp = newResponse("second")
+	resp, err := roundTrip("/")
+	require.NoError(t, err)
+	require.Equal(t, "10", resp.Header.Get("Age"))
+	require.Equal(t, int64(len("first")), resp.ContentLength)
+
+	// Once the TTL is over, the backend is asked again.
+	now = now.Add(time.Second)
+	resp, err = roundTrip("/")
+	require.NoError(t, err)
+	require.Empty(t, resp.Header.Get("Age"))
+	require.Equal(t, len("second"), transport.size)
+
+	// Responses that don't fit into the cache aren't cached.
+	transport.size = maxCacheSize
+	next.resp = newResponse("other")
+	_, err = roundTrip("/other")
+	require.NoError(t, err)
+
+	_, ok := transport.lookup(service.Name + " /other")
+	require.False(t, ok)
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultMaxJSONChallengeSize is the default maximum size in bytes of
+	// the JSON body of a 402 response.
+	DefaultMaxJSONChallengeSize = 8192
+)
+
+var (
+	// challengeRegex is the regular expression used to extract the
+	// macaroon and invoice from an L402 WWW-Authenticate header value.
+	challengeRegex = regexp.MustCompile(
+		"L402 macaroon=\"(.*?)\", invoice=\"(.*?)\"",
+	)
+)
+
+// paymentRequiredBody is the JSON body of a 402 response. It contains the same
+// challenge as the WWW-Authenticate header fields, together with the price of
+// the resource so clients don't need to decode the invoice to show it.
+type paymentRequiredBody struct {
+	// Error is the human readable reason of the response. It is left out
+	// if the body would otherwise be too large.
+	Error string `json:"error,omitempty"`
+
+	// PriceSat is the price of the resource in satoshis.
+	PriceSat int64 `json:"price_sat"`
+
+	// Invoice is the payment request that needs to be paid.
+	Invoice string `json:"invoice"`
+
+	// Macaroon is the base64 encoded macaroon of the L402.
+	Macaroon string `json:"macaroon"`
+
+	// Tiers maps the name of each tier of the service to its price in
+	// satoshis. It is only set if the service has higher tiers and is left
+	// out if the body would otherwise be too large.
+	Tiers map[string]int64 `json:"tiers,omitempty"`
+}
+
+// newPaymentRequiredBody creates the JSON body of a 402 response from the given
+// challenge header fields.
+func newPaymentRequiredBody(header http.Header,
+	price int64) (*paymentRequiredBody, error) {
+
+	for _, value := range header.Values("WWW-Authenticate") {
+		matches := challengeRegex.FindStringSubmatch(value)
+		if len(matches) != 3 {
+			continue
+		}
+
+		return &paymentRequiredBody{
+			Error:    "payment required",
+			PriceSat: price,
+			Invoice:  matches[2],
+			Macaroon: matches[1],
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no L402 challenge found in header")
+}
+
+// encode returns the JSON encoding of the body if it fits into the given
+// maximum size. The optional fields are left out one after the other until
+// the body fits. If even the required fields don't fit, false is returned.
+func (b *paymentRequiredBody) encode(maxSize int) ([]byte, bool) {
+	// Each step drops the next optional field, starting with the one that
+	// is least useful to the client.
+	dropFields := []func(){
+		func() {},
+		func() { b.Tiers = nil },
+		func() { b.Error = "" },
+	}
+	for _, drop := range dropFields {
+		drop()
+
+		encoded, err := json.Marshal(b)
+		if err != nil {
+			log.Errorf("Error encoding challenge body: %v", err)
+			return nil, false
+		}
+		if len(encoded) <= maxSize {
+			return encoded, true
+		}
+	}
+
+	return nil, false
+}
+
+// acceptsJSON returns true if the client explicitly asked for a JSON response
+// through the Accept header field.
+func acceptsJSON(r *http.Request) bool {
+	return acceptsMediaType(r, hdrTypeJSON)
+}
+
+// acceptsHTML returns true if the client explicitly accepts an HTML response
+// through the Accept header field, as browsers do when navigating to a page.
+func acceptsHTML(r *http.Request) bool {
+	return acceptsMediaType(r, hdrTypeHTML)
+}
+
+// acceptsMediaType returns true if the given media type is explicitly listed in
+// the Accept header field of the request. Wildcards don't count.
+func acceptsMediaType(r *http.Request, expected string) bool {
+	for _, value := range r.Header.Values(hdrAccept) {
+		for _, mediaRange := range strings.Split(value, ",") {
+			mediaType, _, err := mime.ParseMediaType(mediaRange)
+			if err != nil {
+				continue
+			}
+
+			if mediaType == expected {
+				return true
+			}
+		}
+	}
+
+	return false
+}
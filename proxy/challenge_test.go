@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPaymentRequiredBodySize makes sure a JSON challenge includes all fields
+// if it fits into the maximum size and that the optional fields are left out
+// of an oversized one.
+func TestPaymentRequiredBodySize(t *testing.T) {
+	newBody := func(invoiceSize int) *paymentRequiredBody {
+		return &paymentRequiredBody{
+			Error:    "payment required",
+			PriceSat: 10,
+			Invoice:  strings.Repeat("a", invoiceSize),
+			Macaroon: "mac",
+			Tiers: map[string]int64{
+				"base": 10, "premium": 100,
+			},
+		}
+	}
+	decode := func(encoded []byte) *paymentRequiredBody {
+		var body paymentRequiredBody
+		require.NoError(t, json.Unmarshal(encoded, &body))
+		return &body
+	}
+
+	// A normal body includes all fields.
+	encoded, ok := newBody(100).encode(DefaultMaxJSONChallengeSize)
+	require.True(t, ok)
+	require.Equal(t, newBody(100), decode(encoded))
+
+	// The tiers are left out first, then the error.
+	full, err := json.Marshal(newBody(100))
+	require.NoError(t, err)
+
+	encoded, ok = newBody(100).encode(len(full) - 1)
+	require.True(t, ok)
+	require.LessOrEqual(t, len(encoded), len(full)-1)
+	body := decode(encoded)
+	require.Nil(t, body.Tiers)
+	require.Equal(t, "payment required", body.Error)
+
+	required := newBody(100)
+	required.Tiers, required.Error = nil, ""
+	minimal, err := json.Marshal(required)
+	require.NoError(t, err)
+
+	encoded, ok = newBody(100).encode(len(minimal))
+	require.True(t, ok)
+	body = decode(encoded)
+	require.Nil(t, body.Tiers)
+	require.Empty(t, body.Error)
+	require.Equal(t, newBody(100).Invoice, body.Invoice)
+
+	// If even the required fields don't fit, there's no body.
+	_, ok = newBody(100).encode(len(minimal) - 1)
+	require.False(t, ok)
+}
+
+// TestProxyJSONChallengeSize makes sure an oversized JSON challenge is only
+// sent in the header fields.
+func TestProxyJSONChallengeSize(t *testing.T) {
+	services := []*Service{{
+		Name:          "json",
+		Address:       "127.0.0.1:1",
+		HostRegexp:    "^json.com$",
+		Protocol:      "http",
+		Auth:          "on",
+		JSONChallenge: true,
+	}}
+
+	serve := func(cfg *Config) *httptest.ResponseRecorder {
+		p, err := NewWithConfig(
+			cfg, auth.NewMockAuthenticator(), services,
+		)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest("GET", "http://json.com/", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	rec := serve(nil)
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	require.Equal(t, hdrTypeJSON, rec.Header().Get(hdrContentType))
+
+	rec = serve(&Config{MaxJSONChallengeSize: 100})
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	require.NotEqual(t, hdrTypeJSON, rec.Header().Get(hdrContentType))
+	require.NotEmpty(t, rec.Header().Values("WWW-Authenticate"))
+}
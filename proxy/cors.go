@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// corsAnyOrigin is the allowed origin that matches any origin.
+	corsAnyOrigin = "*"
+
+	// defaultCORSMethods, defaultCORSHeaders and defaultCORSExposedHeaders
+	// are the values of the CORS header fields that are used if the
+	// policy doesn't configure them.
+	defaultCORSMethods        = "GET, POST, OPTIONS"
+	defaultCORSExposedHeaders = "WWW-Authenticate, Grpc-Status, " +
+		"Grpc-Message, L402-Tiers"
+	defaultCORSHeaders = "Authorization, Grpc-Metadata-macaroon, " +
+		"WWW-Authenticate, Content-Type, X-Grpc-Web, X-User-Agent, " +
+		"L402-Tier, L402-Discharge"
+)
+
+// CORSConfig is the Cross Origin Resource Sharing (CORS) policy the proxy
+// applies to its responses. Options that aren't set keep the permissive
+// default policy, which allows requests from any origin.
+type CORSConfig struct {
+	// AllowedOrigins is the list of origins that are allowed to access
+	// the proxy from a browser. If the origin of a request is on the list,
+	// it is echoed back in the Access-Control-Allow-Origin header field.
+	// The origin "*" allows any origin. If empty, any origin is allowed.
+	AllowedOrigins []string `long:"allowedorigins" description:"An origin that is allowed to access the proxy from a browser, e.g. https://example.com. Can be specified multiple times. Use * to allow any origin. If none is set, any origin is allowed."`
+
+	// AllowedMethods is the list of HTTP methods that browsers may use
+	// for cross origin requests.
+	AllowedMethods []string `long:"allowedmethods" description:"An HTTP method browsers may use for cross origin requests. Can be specified multiple times. Defaults to GET, POST and OPTIONS."`
+
+	// AllowedHeaders is the list of header fields that browsers may send
+	// with cross origin requests.
+	AllowedHeaders []string `long:"allowedheaders" description:"A header field browsers may send with cross origin requests. Can be specified multiple times. Defaults to the header fields used by L402 and gRPC-Web clients."`
+
+	// ExposedHeaders is the list of response header fields that scripts
+	// making cross origin requests may read.
+	ExposedHeaders []string `long:"exposedheaders" description:"A response header field scripts making cross origin requests may read. Can be specified multiple times. Defaults to the L402 challenge and gRPC status header fields."`
+
+	// AllowCredentials can be set to allow browsers to send credentials,
+	// such as cookies, with cross origin requests. It can't be combined
+	// with allowing any origin.
+	AllowCredentials bool `long:"allowcredentials" description:"Allow browsers to send credentials, such as cookies, with cross origin requests. Requires the allowed origins to be listed explicitly."`
+
+	// MaxAge is the time browsers may cache the result of a preflight
+	// request for. If zero, the header field isn't sent and browsers use
+	// their default.
+	MaxAge time.Duration `long:"maxage" description:"The time browsers may cache the result of a preflight request for. If not set, browsers use their default."`
+}
+
+// corsPolicy holds the CORS header fields derived from a CORSConfig.
+type corsPolicy struct {
+	// anyOrigin is true if requests from any origin are allowed.
+	anyOrigin bool
+
+	// origins is the set of origins requests are allowed from if not any
+	// origin is allowed.
+	origins map[string]struct{}
+
+	// methodSet and headerSet are the allowed methods and the lower case
+	// names of the allowed header fields that preflight requests are
+	// checked against.
+	methodSet map[string]struct{}
+	headerSet map[string]struct{}
+
+	methods          string
+	headers          string
+	exposedHeaders   string
+	allowCredentials bool
+
+	// maxAge is the value of the Access-Control-Max-Age header field of
+	// preflight responses. If empty, the header field isn't sent.
+	maxAge string
+}
+
+// newCORSPolicy creates the CORS policy for the given configuration. A nil
+// configuration results in the permissive default policy.
+func newCORSPolicy(cfg *CORSConfig) (*corsPolicy, error) {
+	if cfg == nil {
+		cfg = &CORSConfig{}
+	}
+
+	policy := &corsPolicy{
+		anyOrigin:        len(cfg.AllowedOrigins) == 0,
+		origins:          make(map[string]struct{}),
+		methods:          joinCORSValues(cfg.AllowedMethods),
+		headers:          joinCORSValues(cfg.AllowedHeaders),
+		exposedHeaders:   joinCORSValues(cfg.ExposedHeaders),
+		allowCredentials: cfg.AllowCredentials,
+	}
+	for _, origin := range cfg.AllowedOrigins {
+		origin = strings.TrimSpace(origin)
+		if origin == corsAnyOrigin {
+			policy.anyOrigin = true
+			continue
+		}
+		policy.origins[origin] = struct{}{}
+	}
+
+	// Browsers refuse credentialed responses that allow any origin, and
+	// echoing back any origin instead would let every website act on
+	// behalf of the user.
+	if policy.anyOrigin && policy.allowCredentials {
+		return nil, fmt.Errorf("CORS credentials can only be allowed " +
+			"for explicitly listed origins")
+	}
+
+	if cfg.MaxAge < 0 {
+		return nil, fmt.Errorf("CORS max age must not be negative")
+	}
+	if cfg.MaxAge > 0 {
+		policy.maxAge = strconv.FormatInt(
+			int64(cfg.MaxAge/time.Second), 10,
+		)
+	}
+
+	if policy.methods == "" {
+		policy.methods = defaultCORSMethods
+	}
+	if policy.headers == "" {
+		policy.headers = defaultCORSHeaders
+	}
+	if policy.exposedHeaders == "" {
+		policy.exposedHeaders = defaultCORSExposedHeaders
+	}
+
+	policy.methodSet = splitCORSValues(policy.methods, strings.ToUpper)
+	policy.headerSet = splitCORSValues(policy.headers, strings.ToLower)
+
+	return policy, nil
+}
+
+// joinCORSValues joins the given values into a single header field value.
+func joinCORSValues(values []string) string {
+	trimmed := make([]string, 0, len(values))
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			trimmed = append(trimmed, value)
+		}
+	}
+
+	return strings.Join(trimmed, ", ")
+}
+
+// splitCORSValues splits the given header field value into the set of its
+// values, normalized with the given function.
+func splitCORSValues(value string,
+	normalize func(string) string) map[string]struct{} {
+
+	values := make(map[string]struct{})
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values[normalize(v)] = struct{}{}
+		}
+	}
+
+	return values
+}
+
+// allowsOrigin returns true if requests from the given origin are allowed.
+func (c *corsPolicy) allowsOrigin(origin string) bool {
+	if c.anyOrigin {
+		return true
+	}
+
+	_, ok := c.origins[origin]
+	return ok
+}
+
+// allowsPreflight returns true if the cross origin request announced by the
+// given preflight request is allowed, which means its origin, method and all
+// of its header fields are allowed.
+func (c *corsPolicy) allowsPreflight(r *http.Request) bool {
+	if !c.allowsOrigin(r.Header.Get("Origin")) {
+		return false
+	}
+
+	method := r.Header.Get("Access-Control-Request-Method")
+	if _, ok := c.methodSet[strings.ToUpper(method)]; !ok {
+		return false
+	}
+
+	headers := splitCORSValues(strings.Join(
+		r.Header.Values("Access-Control-Request-Headers"), ",",
+	), strings.ToLower)
+	for name := range headers {
+		if _, ok := c.headerSet[name]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// addHeaders adds the HTTP header fields that are required for Cross Origin
+// Resource Sharing to the given response header of the given request. If the
+// request's origin isn't allowed, no header fields are added, so browsers
+// block the response.
+func (c *corsPolicy) addHeaders(header http.Header, r *http.Request) {
+	origin := corsAnyOrigin
+	if !c.anyOrigin {
+		origin = r.Header.Get("Origin")
+		if !c.allowsOrigin(origin) {
+			return
+		}
+
+		// The response depends on the origin of the request, so caches
+		// must not serve it to other origins.
+		header.Add("Vary", "Origin")
+	}
+
+	log.Debugf("Adding CORS headers to response.")
+
+	header.Add("Access-Control-Allow-Origin", origin)
+	header.Add("Access-Control-Allow-Methods", c.methods)
+	header.Add("Access-Control-Expose-Headers", c.exposedHeaders)
+	header.Add("Access-Control-Allow-Headers", c.headers)
+	if c.allowCredentials {
+		header.Add("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// isPreflightRequest returns true if the given request is a CORS preflight
+// request a browser sends before a cross origin request.
+func isPreflightRequest(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// handlePreflight answers the given CORS preflight request. If the announced
+// request is allowed by the CORS policy, the CORS header fields are sent with
+// a 204 status code. Otherwise, the request is denied without any CORS header
+// fields, so the browser blocks the cross origin request.
+func (p *Proxy) handlePreflight(w http.ResponseWriter, r *http.Request,
+	prefixLog *PrefixLog) {
+
+	if !p.cors.allowsPreflight(r) {
+		prefixLog.Debugf("CORS preflight request for %s %v from "+
+			"origin %s denied",
+			r.Header.Get("Access-Control-Request-Method"),
+			r.Header.Values("Access-Control-Request-Headers"),
+			r.Header.Get("Origin"))
+		sendDirectResponse(
+			w, r, http.StatusForbidden, "cross origin request "+
+				"not allowed",
+		)
+		return
+	}
+
+	p.cors.addHeaders(w.Header(), r)
+	if p.cors.maxAge != "" {
+		w.Header().Set("Access-Control-Max-Age", p.cors.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
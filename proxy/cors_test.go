@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCORSPolicy makes sure the CORS header fields of responses follow the
+// configured policy and that the default policy allows any origin.
+func TestCORSPolicy(t *testing.T) {
+	preflight := func(p *Proxy, origin string) http.Header {
+		req := httptest.NewRequest(
+			"OPTIONS", "http://service.com/", nil,
+		)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		return rec.Header()
+	}
+
+	// Without a policy, any origin is allowed.
+	p, err := New(auth.NewMockAuthenticator(), nil)
+	require.NoError(t, err)
+	header := preflight(p, "https://example.com")
+	require.Equal(t, "*", header.Get("Access-Control-Allow-Origin"))
+	require.Equal(
+		t, defaultCORSMethods,
+		header.Get("Access-Control-Allow-Methods"),
+	)
+	require.Equal(
+		t, defaultCORSHeaders,
+		header.Get("Access-Control-Allow-Headers"),
+	)
+	require.Equal(
+		t, defaultCORSExposedHeaders,
+		header.Get("Access-Control-Expose-Headers"),
+	)
+	require.Empty(t, header.Get("Access-Control-Allow-Credentials"))
+	require.Empty(t, header.Get("Vary"))
+
+	// Credentials can't be allowed for any origin.
+	_, err = NewWithConfig(&Config{
+		CORS: &CORSConfig{
+			AllowedOrigins:   []string{"https://example.com", "*"},
+			AllowCredentials: true,
+		},
+	}, auth.NewMockAuthenticator(), nil)
+	require.ErrorContains(t, err, "explicitly listed origins")
+
+	// With a restricted policy, only listed origins are echoed back.
+	p, err = NewWithConfig(&Config{
+		CORS: &CORSConfig{
+			AllowedOrigins:   []string{"https://example.com"},
+			AllowedMethods:   []string{"GET", "PUT"},
+			AllowedHeaders:   []string{"Authorization"},
+			ExposedHeaders:   []string{"WWW-Authenticate"},
+			AllowCredentials: true,
+		},
+	}, auth.NewMockAuthenticator(), nil)
+	require.NoError(t, err)
+
+	header = preflight(p, "https://example.com")
+	require.Equal(
+		t, "https://example.com",
+		header.Get("Access-Control-Allow-Origin"),
+	)
+	require.Equal(t, "GET, PUT", header.Get("Access-Control-Allow-Methods"))
+	require.Equal(
+		t, "Authorization", header.Get("Access-Control-Allow-Headers"),
+	)
+	require.Equal(
+		t, "WWW-Authenticate",
+		header.Get("Access-Control-Expose-Headers"),
+	)
+	require.Equal(
+		t, "true", header.Get("Access-Control-Allow-Credentials"),
+	)
+	require.Equal(t, "Origin", header.Get("Vary"))
+
+	for _, origin := range []string{"https://other.com", ""} {
+		header = preflight(p, origin)
+		require.Empty(t, header.Get("Access-Control-Allow-Origin"))
+		require.Empty(t, header.Get("Access-Control-Allow-Credentials"))
+	}
+}
+
+// TestCORSPreflight makes sure preflight requests are checked against the CORS
+// policy and only allowed cross origin requests get the CORS header fields.
+func TestCORSPreflight(t *testing.T) {
+	p, err := NewWithConfig(&Config{
+		CORS: &CORSConfig{
+			AllowedOrigins: []string{"https://example.com"},
+			AllowedMethods: []string{"GET", "POST"},
+			AllowedHeaders: []string{
+				"Authorization", "Content-Type",
+			},
+			MaxAge: 10 * time.Minute,
+		},
+	}, auth.NewMockAuthenticator(), nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		origin  string
+		method  string
+		headers []string
+		allowed bool
+	}{{
+		name:    "allowed",
+		origin:  "https://example.com",
+		method:  "POST",
+		headers: []string{"content-type, AUTHORIZATION"},
+		allowed: true,
+	}, {
+		name:    "no header fields",
+		origin:  "https://example.com",
+		method:  "GET",
+		allowed: true,
+	}, {
+		name:   "disallowed origin",
+		origin: "https://other.com",
+		method: "GET",
+	}, {
+		name:   "disallowed method",
+		origin: "https://example.com",
+		method: "DELETE",
+	}, {
+		name:    "disallowed header field",
+		origin:  "https://example.com",
+		method:  "POST",
+		headers: []string{"Content-Type", "X-Custom"},
+	}}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(
+			"OPTIONS", "http://service.com/", nil,
+		)
+		req.Header.Set("Origin", tc.origin)
+		req.Header.Set("Access-Control-Request-Method", tc.method)
+		for _, value := range tc.headers {
+			req.Header.Add("Access-Control-Request-Headers", value)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		header := rec.Header()
+		if !tc.allowed {
+			require.Equal(
+				t, http.StatusForbidden, rec.Code, tc.name,
+			)
+			require.Empty(
+				t, header.Get("Access-Control-Allow-Origin"),
+				tc.name,
+			)
+			require.Empty(
+				t, header.Get("Access-Control-Max-Age"),
+				tc.name,
+			)
+			continue
+		}
+
+		require.Equal(t, http.StatusNoContent, rec.Code, tc.name)
+		require.Empty(t, rec.Body.String(), tc.name)
+		require.Equal(
+			t, tc.origin, header.Get("Access-Control-Allow-Origin"),
+			tc.name,
+		)
+		require.Equal(
+			t, "GET, POST",
+			header.Get("Access-Control-Allow-Methods"), tc.name,
+		)
+		require.Equal(
+			t, "Authorization, Content-Type",
+			header.Get("Access-Control-Allow-Headers"), tc.name,
+		)
+		require.Equal(
+			t, "600", header.Get("Access-Control-Max-Age"), tc.name,
+		)
+	}
+
+	// A negative max age is rejected.
+	_, err = NewWithConfig(&Config{
+		CORS: &CORSConfig{MaxAge: -time.Second},
+	}, auth.NewMockAuthenticator(), nil)
+	require.ErrorContains(t, err, "max age")
+}
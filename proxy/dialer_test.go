@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBackendDialer makes sure the backend dialer binds to the configured
+// local source address.
+func TestBackendDialer(t *testing.T) {
+	// Invalid addresses are rejected.
+	_, err := newBackendDialer("not-an-address")
+	require.Error(t, err)
+	_, err = newBackendDialer(":1234")
+	require.Error(t, err)
+
+	// An IP address without a port lets the operating system choose the
+	// port.
+	dialer, err := newBackendDialer("127.0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:0", dialer.LocalAddr.String())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	localAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	require.True(t, ok)
+	require.True(t, localAddr.IP.Equal(net.ParseIP("127.0.0.1")))
+	require.NotZero(t, localAddr.Port)
+}
+
+// TestProxyBackendSourceAddr makes sure the proxy connects to the backend from
+// the configured local source address.
+func TestProxyBackendSourceAddr(t *testing.T) {
+	remoteAddrs := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			remoteAddrs <- r.RemoteAddr
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:       "backend",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: "^service.com$",
+		Protocol:   "http",
+		Auth:       "off",
+	}}
+
+	// An invalid source address is rejected right away.
+	_, err := NewWithConfig(&Config{
+		BackendSourceAddr: "not-an-address",
+	}, auth.NewMockAuthenticator(), services)
+	require.Error(t, err)
+
+	p, err := NewWithConfig(&Config{
+		BackendSourceAddr: "127.0.0.1",
+	}, auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "http://service.com/", nil)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	host, _, err := net.SplitHostPort(<-remoteAddrs)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", host)
+}
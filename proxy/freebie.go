@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/lightninglabs/aperture/freebie"
+)
+
+var (
+	// ErrUnknownService is returned if no service with the given name is
+	// configured.
+	ErrUnknownService = errors.New("unknown service")
+
+	// ErrNoFreebies is returned if a service doesn't grant any free
+	// requests.
+	ErrNoFreebies = errors.New("service doesn't grant free requests")
+)
+
+// freebieDB returns the freebie store of the service with the given name.
+func (p *Proxy) freebieDB(serviceName string) (freebie.DB, error) {
+	p.mu.RLock()
+	services := p.services
+	p.mu.RUnlock()
+
+	for _, s := range services {
+		if s.Name != serviceName {
+			continue
+		}
+
+		if s.freebieDB == nil {
+			return nil, fmt.Errorf("%w: %s", ErrNoFreebies,
+				serviceName)
+		}
+
+		return s.freebieDB, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownService, serviceName)
+}
+
+// FreebieCount returns the number of free requests the given IP address made
+// to the service with the given name.
+func (p *Proxy) FreebieCount(serviceName string,
+	ip net.IP) (freebie.Count, error) {
+
+	db, err := p.freebieDB(serviceName)
+	if err != nil {
+		return 0, err
+	}
+
+	return db.Count(ip)
+}
+
+// ResetFreebies grants the given IP address the full number of free requests
+// to the service with the given name again. If the service counts free
+// requests by token ID as well, the token ID counters aren't reset.
+func (p *Proxy) ResetFreebies(serviceName string, ip net.IP) error {
+	db, err := p.freebieDB(serviceName)
+	if err != nil {
+		return err
+	}
+
+	return db.Reset(ip)
+}
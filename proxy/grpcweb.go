@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// hdrTypeGrpcWeb is the content type prefix of gRPC-Web requests. It
+	// covers both the binary and the base64 encoded text format.
+	hdrTypeGrpcWeb = "application/grpc-web"
+
+	// hdrTypeGrpcWebText is the content type prefix of gRPC-Web requests
+	// that use the base64 encoded text format.
+	hdrTypeGrpcWebText = "application/grpc-web-text"
+
+	// grpcWebTrailerFlag is the flag of a gRPC-Web frame that marks it as
+	// the trailer frame.
+	grpcWebTrailerFlag = 0x80
+)
+
+// isGRPCWebRequest returns true if the given request was sent by a gRPC-Web
+// client, for example from a browser.
+func isGRPCWebRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get(hdrContentType), hdrTypeGrpcWeb)
+}
+
+// newGRPCWebTrailerFrame encodes the given status as a gRPC-Web trailer frame.
+// The frame consists of the trailer flag, the big endian length of the
+// trailer block and the trailer block itself, which is formatted like HTTP/1
+// header fields.
+func newGRPCWebTrailerFrame(code codes.Code, message string) []byte {
+	trailer := fmt.Sprintf(
+		"grpc-status: %d\r\ngrpc-message: %s\r\n", code,
+		encodeGRPCMessage(message),
+	)
+
+	frame := make([]byte, 5+len(trailer))
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(trailer)))
+	copy(frame[5:], trailer)
+
+	return frame
+}
+
+// encodeGRPCMessage percent-encodes the given status message as required by
+// the gRPC protocol. All bytes outside of the printable ASCII range and the
+// percent sign itself are encoded.
+func encodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+
+	return b.String()
+}
+
+// sendGRPCWebError sends the given error to a gRPC-Web client. Browsers can't
+// read HTTP trailers, so the status is sent in a trailer frame in the response
+// body, which is base64 encoded if the client uses the text format.
+func sendGRPCWebError(w http.ResponseWriter, r *http.Request, code codes.Code,
+	message string) {
+
+	contentType := r.Header.Get(hdrContentType)
+	frame := newGRPCWebTrailerFrame(code, message)
+	if strings.HasPrefix(contentType, hdrTypeGrpcWebText) {
+		frame = []byte(base64.StdEncoding.EncodeToString(frame))
+	}
+
+	// As with gRPC, the status code is always 200 OK and the actual
+	// status is transported in the trailer.
+	w.Header().Set(hdrContentType, contentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(frame)
+}
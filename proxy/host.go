@@ -0,0 +1,21 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hasConflictingHost returns true if the request carries a Host header field
+// that doesn't match the host it is routed by. For HTTP/1 requests, the Host
+// header field is the routing host itself, so there can't be a conflict. For
+// HTTP/2 requests, the routing host is taken from the :authority pseudo-header
+// and any Host header field sent in addition is kept in the header map.
+func hasConflictingHost(r *http.Request) bool {
+	for _, host := range r.Header.Values("Host") {
+		if !strings.EqualFold(host, r.Host) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRejectHostMismatch makes sure requests with a Host header field that
+// conflicts with their authority are rejected if configured, while consistent
+// ones are proxied normally.
+func TestRejectHostMismatch(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer backend.Close()
+
+	newProxy := func(reject bool) *Proxy {
+		services := []*Service{{
+			Name:       "service",
+			Address:    strings.TrimPrefix(backend.URL, "http://"),
+			HostRegexp: "^service.com$",
+			Protocol:   "http",
+			Auth:       "off",
+		}}
+		p, err := NewWithConfig(
+			&Config{RejectHostMismatch: reject},
+			auth.NewMockAuthenticator(), services,
+		)
+		require.NoError(t, err)
+
+		return p
+	}
+
+	// serve sends a request for the service. A non-empty host header is
+	// added to the header map, as the HTTP/2 server does for a Host header
+	// field sent in addition to the :authority pseudo-header.
+	serve := func(p *Proxy, hostHeader string) int {
+		req := httptest.NewRequest("GET", "http://service.com/", nil)
+		req.ProtoMajor, req.ProtoMinor, req.Proto = 2, 0, "HTTP/2.0"
+		if hostHeader != "" {
+			req.Header.Set("Host", hostHeader)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	p := newProxy(true)
+	require.Equal(t, http.StatusOK, serve(p, ""))
+	require.Equal(t, http.StatusOK, serve(p, "Service.com"))
+	require.Equal(t, http.StatusBadRequest, serve(p, "other.com"))
+
+	// Without the option, the authority is used and the Host header field
+	// is ignored.
+	p = newProxy(false)
+	require.Equal(t, http.StatusOK, serve(p, "other.com"))
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// serviceLabel is the metric label that holds the service name.
+	serviceLabel = "service"
+
+	// capabilityLabel is the metric label that holds the capability name.
+	capabilityLabel = "capability"
+
+	// codeLabel is the metric label that holds the HTTP status code of a
+	// response.
+	codeLabel = "code"
+
+	// decisionLabel is the metric label that holds the decision that was
+	// made for a request to a service in audit mode.
+	decisionLabel = "decision"
+
+	// auditDecisionAllow is the decision for a request that would have
+	// been allowed.
+	auditDecisionAllow = "allow"
+
+	// auditDecisionCharge is the decision for a request that would have
+	// been sent a payment challenge.
+	auditDecisionCharge = "charge"
+
+	// unknownCapability is the capability label value that is used if a
+	// request couldn't be mapped to any of a service's configured
+	// capabilities.
+	unknownCapability = "unknown"
+)
+
+var (
+	// capabilityUsageCount counts each authorized request to a service,
+	// labeled by the capability that was accessed.
+	capabilityUsageCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "aperture",
+			Name:      "capability_usage_count",
+		}, []string{serviceLabel, capabilityLabel},
+	)
+
+	// freeRequestsTotal counts each request that was passed to a service
+	// without payment because its pricer returned a price of zero, labeled
+	// by the service.
+	freeRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "aperture",
+			Name:      "free_requests_total",
+		}, []string{serviceLabel},
+	)
+
+	// freebiesGrantedTotal counts each request that was passed to a
+	// service as one of the free requests of its client, labeled by the
+	// service.
+	freebiesGrantedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "aperture",
+			Name:      "freebies_granted_total",
+		}, []string{serviceLabel},
+	)
+
+	// auditDecisionsTotal counts the decisions made for requests to
+	// services in audit mode, labeled by the service and the decision.
+	auditDecisionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "aperture",
+			Name:      "audit_decisions_total",
+		}, []string{serviceLabel, decisionLabel},
+	)
+
+	// auditChargedSatsTotal sums up the prices of the requests to services
+	// in audit mode that would have been charged, labeled by the service.
+	auditChargedSatsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "aperture",
+			Name:      "audit_charged_sats_total",
+		}, []string{serviceLabel},
+	)
+
+	// backendRequestDuration measures how long requests that are proxied
+	// to a service backend take, labeled by the service.
+	backendRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "aperture",
+			Name:      "backend_request_duration_seconds",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{serviceLabel},
+	)
+
+	// backendResponsesTotal counts the responses of the service backends,
+	// labeled by the service and the HTTP status code.
+	backendResponsesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "aperture",
+			Name:      "backend_responses_total",
+		}, []string{serviceLabel, codeLabel},
+	)
+)
+
+// RegisterMetrics registers all metrics of the proxy with the default
+// Prometheus registry.
+func RegisterMetrics() {
+	prometheus.MustRegister(capabilityUsageCount)
+	prometheus.MustRegister(freeRequestsTotal)
+	prometheus.MustRegister(freebiesGrantedTotal)
+	prometheus.MustRegister(auditDecisionsTotal)
+	prometheus.MustRegister(auditChargedSatsTotal)
+	prometheus.MustRegister(backendRequestDuration)
+	prometheus.MustRegister(backendResponsesTotal)
+}
+
+// recordBackendResponse records the duration and the status code of a request
+// that was proxied to the backend of the given service.
+func recordBackendResponse(s *Service, statusCode int,
+	duration time.Duration) {
+
+	backendRequestDuration.With(prometheus.Labels{
+		serviceLabel: s.Name,
+	}).Observe(duration.Seconds())
+
+	backendResponsesTotal.With(prometheus.Labels{
+		serviceLabel: s.Name,
+		codeLabel:    strconv.Itoa(statusCode),
+	}).Inc()
+}
+
+// recordFreeRequest records a request to the given service that was allowed
+// without payment because the requested resource is currently free.
+func recordFreeRequest(s *Service) {
+	freeRequestsTotal.With(prometheus.Labels{
+		serviceLabel: s.Name,
+	}).Inc()
+}
+
+// recordFreebie records a request to the given service that was allowed as
+// one of the free requests of its client.
+func recordFreebie(s *Service) {
+	freebiesGrantedTotal.With(prometheus.Labels{
+		serviceLabel: s.Name,
+	}).Inc()
+}
+
+// recordAuditDecision records the decision made for a request to the given
+// service in audit mode and the price it would have been charged.
+func recordAuditDecision(s *Service, decision string, price int64) {
+	auditDecisionsTotal.With(prometheus.Labels{
+		serviceLabel:  s.Name,
+		decisionLabel: decision,
+	}).Inc()
+
+	if price > 0 {
+		auditChargedSatsTotal.With(prometheus.Labels{
+			serviceLabel: s.Name,
+		}).Add(float64(price))
+	}
+}
+
+// recordCapabilityUsage records the capability of the given service that is
+// accessed by the request, if capability metering is enabled for the service.
+func recordCapabilityUsage(s *Service, r *http.Request, prefixLog *PrefixLog) {
+	if !s.MeterCapabilities && !s.LogCapabilities {
+		return
+	}
+
+	capability := capabilityForRequest(s, r)
+
+	if s.MeterCapabilities {
+		capabilityUsageCount.With(prometheus.Labels{
+			serviceLabel:    s.Name,
+			capabilityLabel: capability,
+		}).Inc()
+	}
+
+	if s.LogCapabilities {
+		prefixLog.Infof("Capability %s of service %s accessed",
+			capability, s.Name)
+	}
+}
+
+// capabilityForRequest derives the capability of a service that is accessed by
+// the given request. Only the capabilities configured for the service are
+// reported, requests for anything else are put into a single bucket, so the
+// number of distinct capability values is bounded by the configuration.
+func capabilityForRequest(s *Service, r *http.Request) string {
+	if capability := s.RequestCapability(r); capability != "" {
+		return capability
+	}
+
+	return unknownCapability
+}
@@ -0,0 +1,375 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/freebie"
+	"github.com/lightninglabs/aperture/l402"
+	"github.com/lightninglabs/aperture/pricer"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+var (
+	testPreimage = lntypes.Preimage{1, 2, 3}
+)
+
+// newTestMacaroon creates a dummy macaroon with the given caveats.
+func newTestMacaroon(caveats ...l402.Caveat) (*macaroon.Macaroon, error) {
+	mac, err := macaroon.New(
+		[]byte("key"), []byte("id"), "loc", macaroon.LatestVersion,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l402.AddFirstPartyCaveats(mac, caveats...); err != nil {
+		return nil, err
+	}
+
+	return mac, nil
+}
+
+// TestRecordCapabilityUsage makes sure that requests to different capability
+// paths increment the correctly labeled counters.
+func TestRecordCapabilityUsage(t *testing.T) {
+	capabilityUsageCount.Reset()
+
+	service := &Service{
+		Name:              "calc",
+		Capabilities:      "add,subtract",
+		MeterCapabilities: true,
+	}
+	_, prefixLog := NewRemoteIPPrefixLog(log, "127.0.0.1:1234")
+
+	paths := []string{
+		"/calc/add", "/calc/add/", "/calc/subtract", "/calc/divide",
+	}
+	for _, path := range paths {
+		req, err := http.NewRequest("GET", "http://localhost"+path, nil)
+		require.NoError(t, err)
+
+		recordCapabilityUsage(service, req, prefixLog)
+	}
+
+	count := func(capability string) float64 {
+		return testutil.ToFloat64(capabilityUsageCount.With(
+			prometheus.Labels{
+				serviceLabel:    service.Name,
+				capabilityLabel: capability,
+			},
+		))
+	}
+	require.EqualValues(t, 2, count("add"))
+	require.EqualValues(t, 1, count("subtract"))
+	require.EqualValues(t, 1, count(unknownCapability))
+
+	// Without any capabilities configured, all requests are recorded in
+	// the same bucket, so the path can't create new label values.
+	service.Capabilities = ""
+	req, err := http.NewRequest(
+		"POST", "http://localhost/calc.Calculator/Multiply", nil,
+	)
+	require.NoError(t, err)
+	req.Header.Set(hdrContentType, hdrTypeGrpc)
+
+	recordCapabilityUsage(service, req, prefixLog)
+	require.EqualValues(t, 0, count("Multiply"))
+	require.EqualValues(t, 2, count(unknownCapability))
+
+	// Nothing is recorded if metering is disabled.
+	service.MeterCapabilities = false
+	recordCapabilityUsage(service, req, prefixLog)
+	require.EqualValues(t, 2, count(unknownCapability))
+}
+
+// TestCapabilityForRequestCaveat makes sure the capabilities caveat of a
+// token can't introduce capabilities that aren't configured.
+func TestCapabilityForRequestCaveat(t *testing.T) {
+	service := &Service{
+		Name:         "calc",
+		Capabilities: "add,subtract",
+	}
+
+	req, err := http.NewRequest("GET", "http://localhost/calc/sqrt", nil)
+	require.NoError(t, err)
+	require.Equal(t, unknownCapability, capabilityForRequest(service, req))
+
+	mac, err := newTestMacaroon(
+		l402.NewCapabilitiesCaveat(service.Name, "sqrt"),
+	)
+	require.NoError(t, err)
+	require.NoError(t, l402.SetHeader(&req.Header, mac, testPreimage))
+
+	require.Equal(t, unknownCapability, capabilityForRequest(service, req))
+}
+
+// TestFreeRequests makes sure requests for resources with a price of zero are
+// passed to the backend without a challenge and are counted as free.
+func TestFreeRequests(t *testing.T) {
+	freeRequestsTotal.Reset()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer backend.Close()
+
+	address := strings.TrimPrefix(backend.URL, "http://")
+	services := []*Service{{
+		Name:       "free",
+		Address:    address,
+		HostRegexp: "^free.com$",
+		Protocol:   "http",
+		Auth:       "on",
+	}, {
+		Name:       "paid",
+		Address:    address,
+		HostRegexp: "^paid.com$",
+		Protocol:   "http",
+		Auth:       "on",
+		Price:      1,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	// A static price of zero falls back to the default price, so we
+	// replace the pricer as if a dynamic pricer made the resource free.
+	services[0].pricer = pricer.NewDefaultPricer(0)
+
+	serve := func(host string, authenticated bool) int {
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		if authenticated {
+			req.Header.Set("Authorization", "L402 foo:bar")
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+	count := func(service string) float64 {
+		return testutil.ToFloat64(freeRequestsTotal.With(
+			prometheus.Labels{serviceLabel: service},
+		))
+	}
+
+	// Unauthenticated requests for a free resource reach the backend.
+	require.Equal(t, http.StatusOK, serve("free.com", false))
+	require.EqualValues(t, 1, count("free"))
+
+	// Authenticated requests aren't counted as free.
+	require.Equal(t, http.StatusOK, serve("free.com", true))
+	require.EqualValues(t, 1, count("free"))
+
+	// Paid resources still require a payment.
+	require.Equal(t, http.StatusPaymentRequired, serve("paid.com", false))
+	require.EqualValues(t, 0, count("paid"))
+}
+
+// TestFreebies makes sure free requests are counted per service and that the
+// free requests of a client can be inspected and reset.
+func TestFreebies(t *testing.T) {
+	freebiesGrantedTotal.Reset()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer backend.Close()
+
+	address := strings.TrimPrefix(backend.URL, "http://")
+	services := []*Service{{
+		Name:       "freebie",
+		Address:    address,
+		HostRegexp: "^freebie.com$",
+		Protocol:   "http",
+		Auth:       "freebie 2",
+		Price:      1,
+	}, {
+		Name:       "paid",
+		Address:    address,
+		HostRegexp: "^paid.com$",
+		Protocol:   "http",
+		Auth:       "on",
+		Price:      1,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	// Requests created by httptest come from this address.
+	clientIP := net.ParseIP("192.0.2.1")
+
+	serve := func() int {
+		req := httptest.NewRequest("GET", "http://freebie.com/", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+	granted := func() float64 {
+		return testutil.ToFloat64(freebiesGrantedTotal.With(
+			prometheus.Labels{serviceLabel: "freebie"},
+		))
+	}
+	freebies := func() freebie.Count {
+		count, err := p.FreebieCount("freebie", clientIP)
+		require.NoError(t, err)
+
+		return count
+	}
+
+	require.Equal(t, http.StatusOK, serve())
+	require.Equal(t, http.StatusOK, serve())
+	require.Equal(t, http.StatusPaymentRequired, serve())
+	require.EqualValues(t, 2, granted())
+	require.EqualValues(t, 2, freebies())
+
+	// After a reset, the client gets its free requests again.
+	require.NoError(t, p.ResetFreebies("freebie", clientIP))
+	require.Zero(t, freebies())
+	require.Equal(t, http.StatusOK, serve())
+	require.EqualValues(t, 3, granted())
+	require.EqualValues(t, 1, freebies())
+
+	_, err = p.FreebieCount("paid", clientIP)
+	require.ErrorIs(t, err, ErrNoFreebies)
+	require.ErrorIs(t, p.ResetFreebies("unknown", clientIP),
+		ErrUnknownService)
+}
+
+// TestAuditMode makes sure requests to services in audit mode are always
+// passed to the backend while the decisions that would have been made are
+// recorded.
+func TestAuditMode(t *testing.T) {
+	auditDecisionsTotal.Reset()
+	auditChargedSatsTotal.Reset()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			_, _ = w.Write(body)
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:       "audited",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: "^audited.com$",
+		Protocol:   "http",
+		Auth:       "audit",
+		Price:      5,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	serve := func(authenticated bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			"POST", "http://audited.com/",
+			strings.NewReader("body"),
+		)
+		if authenticated {
+			req.Header.Set("Authorization", "L402 foo:bar")
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec
+	}
+	count := func(decision string) float64 {
+		return testutil.ToFloat64(auditDecisionsTotal.With(
+			prometheus.Labels{
+				serviceLabel:  "audited",
+				decisionLabel: decision,
+			},
+		))
+	}
+
+	// Unauthenticated requests reach the backend with their body, but
+	// are recorded as charged.
+	rec := serve(false)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "body", rec.Body.String())
+	require.EqualValues(t, 1, count(auditDecisionCharge))
+	require.EqualValues(t, 5, testutil.ToFloat64(auditChargedSatsTotal.With(
+		prometheus.Labels{serviceLabel: "audited"},
+	)))
+
+	// Authenticated requests are recorded as allowed.
+	require.Equal(t, http.StatusOK, serve(true).Code)
+	require.EqualValues(t, 1, count(auditDecisionAllow))
+	require.EqualValues(t, 1, count(auditDecisionCharge))
+}
+
+// TestBackendMetrics makes sure the duration and status code of proxied
+// requests are only recorded if backend metrics are enabled.
+func TestBackendMetrics(t *testing.T) {
+	backendRequestDuration.Reset()
+	backendResponsesTotal.Reset()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/missing" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer backend.Close()
+
+	newProxy := func(backendMetrics bool) *Proxy {
+		services := []*Service{{
+			Name:       "service",
+			Address:    strings.TrimPrefix(backend.URL, "http://"),
+			HostRegexp: "^service.com$",
+			Protocol:   "http",
+			Auth:       "off",
+		}}
+		p, err := NewWithConfig(
+			&Config{BackendMetrics: backendMetrics},
+			auth.NewMockAuthenticator(), services,
+		)
+		require.NoError(t, err)
+
+		return p
+	}
+	serve := func(p *Proxy, path string) {
+		url := "http://service.com" + path
+		req := httptest.NewRequest("GET", url, nil)
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	count := func(code string) float64 {
+		return testutil.ToFloat64(backendResponsesTotal.With(
+			prometheus.Labels{
+				serviceLabel: "service",
+				codeLabel:    code,
+			},
+		))
+	}
+
+	// Nothing is recorded by default.
+	p := newProxy(false)
+	serve(p, "/")
+	require.Zero(t, testutil.CollectAndCount(backendRequestDuration))
+	require.Zero(t, testutil.CollectAndCount(backendResponsesTotal))
+
+	p = newProxy(true)
+	serve(p, "/")
+	serve(p, "/")
+	serve(p, "/missing")
+	require.EqualValues(t, 2, count("200"))
+	require.EqualValues(t, 1, count("404"))
+	require.Equal(t, 1, testutil.CollectAndCount(backendRequestDuration))
+}
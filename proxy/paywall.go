@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// defaultPaywallTemplate is the built-in paywall page. It shows the price and
+// the invoice of the challenge together with a link that opens the invoice in
+// a Lightning wallet.
+const defaultPaywallTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Payment required</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 4em auto;
+       padding: 0 1em; color: #222; }
+code { display: block; word-break: break-all; padding: 1em;
+       background: #f4f4f4; }
+</style>
+</head>
+<body>
+<h1>Payment required</h1>
+<p>Access to {{.Service}} costs <strong>{{.PriceSat}} sats</strong>.</p>
+{{- if .Tiers}}
+<ul>
+{{- range $name, $price := .Tiers}}
+<li>{{$name}}: {{$price}} sats</li>
+{{- end}}
+</ul>
+{{- end}}
+<p><a href="{{.PaymentURI}}">Pay with a Lightning wallet</a></p>
+<p>Invoice:</p>
+<code>{{.Invoice}}</code>
+<p>Once the invoice is paid, send the macaroon together with the preimage of
+the payment in the Authorization header of your request:</p>
+<code>{{.Macaroon}}</code>
+</body>
+</html>
+`
+
+// paywallPageData is the data a paywall page template is rendered with.
+type paywallPageData struct {
+	// Service is the name of the service the client tried to access.
+	Service string
+
+	// PriceSat is the price of the resource in satoshis.
+	PriceSat int64
+
+	// Invoice is the payment request that needs to be paid.
+	Invoice string
+
+	// Macaroon is the base64 encoded macaroon of the L402.
+	Macaroon string
+
+	// Tiers maps the name of each tier of the service to its price in
+	// satoshis. It is only set if the service has higher tiers.
+	Tiers map[string]int64
+}
+
+// PaymentURI returns the lightning: URI of the invoice, which can be used as a
+// link or encoded as a QR code by custom templates.
+func (d *paywallPageData) PaymentURI() template.URL {
+	// The invoice is a bech32 string, so it can't break out of the URI.
+	return template.URL("lightning:" + strings.ToLower(d.Invoice))
+}
+
+// newPaywallPageData creates the data of a paywall page from the given
+// challenge header fields.
+func newPaywallPageData(header http.Header, target *Service,
+	price int64) (*paywallPageData, error) {
+
+	body, err := newPaymentRequiredBody(header, price)
+	if err != nil {
+		return nil, err
+	}
+
+	return &paywallPageData{
+		Service:  target.Name,
+		PriceSat: body.PriceSat,
+		Invoice:  body.Invoice,
+		Macaroon: body.Macaroon,
+	}, nil
+}
+
+// loadPaywallTemplate parses the paywall page template at the given path. If
+// the path is empty, the built-in template is used.
+func loadPaywallTemplate(path string) (*template.Template, error) {
+	if path == "" {
+		return template.Must(
+			template.New("paywall").Parse(defaultPaywallTemplate),
+		), nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read paywall template: %w",
+			err)
+	}
+
+	tmpl, err := template.New("paywall").Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse paywall template: %w",
+			err)
+	}
+
+	return tmpl, nil
+}
+
+// sendPaywallPage renders the paywall page with the given data and sends it as
+// the body of a 402 response. The challenge header fields must already be set.
+// If the page can't be rendered, nothing is sent and false is returned.
+func (p *Proxy) sendPaywallPage(w http.ResponseWriter,
+	data *paywallPageData) bool {
+
+	var page bytes.Buffer
+	if err := p.paywall.Execute(&page, data); err != nil {
+		log.Errorf("Error rendering paywall page: %v", err)
+		return false
+	}
+
+	w.Header().Set(hdrContentType, hdrTypeHTML+"; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusPaymentRequired)
+	_, _ = w.Write(page.Bytes())
+
+	return true
+}
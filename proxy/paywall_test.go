@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestProxyPaywallPage makes sure browsers get the paywall page of a service
+// that has one, while API clients get the plain text or JSON challenge.
+func TestProxyPaywallPage(t *testing.T) {
+	services := []*Service{{
+		Name:        "paywall",
+		Address:     "127.0.0.1:1",
+		HostRegexp:  "^paywall.com$",
+		Protocol:    "http",
+		Auth:        "on",
+		PaywallPage: true,
+	}, {
+		Name:       "api",
+		Address:    "127.0.0.1:1",
+		HostRegexp: "^api.com$",
+		Protocol:   "http",
+		Auth:       "on",
+	}}
+
+	serve := func(cfg *Config, host,
+		accept string) *httptest.ResponseRecorder {
+
+		p, err := NewWithConfig(
+			cfg, auth.NewMockAuthenticator(), services,
+		)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		if accept != "" {
+			req.Header.Set(hdrAccept, accept)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		require.Equal(t, http.StatusPaymentRequired, rec.Code)
+		require.NotEmpty(t, rec.Header().Values("WWW-Authenticate"))
+
+		return rec
+	}
+
+	const browserAccept = "text/html,application/xhtml+xml," +
+		"application/xml;q=0.9,*/*;q=0.8"
+
+	// A browser gets the built-in page with the price and invoice.
+	rec := serve(nil, "paywall.com", browserAccept)
+	require.Equal(
+		t, "text/html; charset=utf-8", rec.Header().Get(hdrContentType),
+	)
+	require.Contains(t, rec.Body.String(), "Payment required")
+	require.Contains(t, rec.Body.String(), "lightning:")
+
+	// API clients get the plain text or JSON challenge.
+	rec = serve(nil, "paywall.com", "")
+	require.Contains(t, rec.Header().Get(hdrContentType), "text/plain")
+	rec = serve(nil, "paywall.com", "*/*")
+	require.Contains(t, rec.Header().Get(hdrContentType), "text/plain")
+	rec = serve(nil, "paywall.com", hdrTypeJSON+", text/html")
+	require.Equal(t, hdrTypeJSON, rec.Header().Get(hdrContentType))
+
+	// Services without a paywall page never send one.
+	rec = serve(nil, "api.com", browserAccept)
+	require.Contains(t, rec.Header().Get(hdrContentType), "text/plain")
+
+	// A custom template is rendered with the challenge.
+	path := filepath.Join(t.TempDir(), "paywall.html")
+	err := os.WriteFile(
+		path, []byte("<p>{{.Service}} {{.PriceSat}} {{.Invoice}}</p>"),
+		0600,
+	)
+	require.NoError(t, err)
+
+	rec = serve(&Config{PaywallTemplate: path}, "paywall.com", "text/html")
+	require.Regexp(t, `^<p>paywall \d+ \S+</p>$`, rec.Body.String())
+}
+
+// TestLoadPaywallTemplate makes sure invalid paywall templates are rejected.
+func TestLoadPaywallTemplate(t *testing.T) {
+	_, err := loadPaywallTemplate("")
+	require.NoError(t, err)
+
+	_, err = loadPaywallTemplate(filepath.Join(t.TempDir(), "missing"))
+	require.ErrorContains(t, err, "unable to read paywall template")
+
+	path := filepath.Join(t.TempDir(), "paywall.html")
+	require.NoError(t, os.WriteFile(path, []byte("{{.Invoice"), 0600))
+	_, err = loadPaywallTemplate(path)
+	require.ErrorContains(t, err, "unable to parse paywall template")
+}
@@ -1,18 +1,24 @@
 package proxy
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"net"
 	"net/http"
 	"net/http/httputil"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/freebie"
 	"github.com/lightninglabs/aperture/l402"
+	"github.com/lightninglabs/aperture/pricer"
 	"google.golang.org/grpc/codes"
 )
 
@@ -27,8 +33,58 @@ const (
 	hdrGrpcStatus  = "Grpc-Status"
 	hdrGrpcMessage = "Grpc-Message"
 	hdrTypeGrpc    = "application/grpc"
+	hdrAccept      = "Accept"
+	hdrTypeJSON    = "application/json"
+	hdrTypeHTML    = "text/html"
+	hdrRetryAfter  = "Retry-After"
+
+	hdrAcceptEncoding = "Accept-Encoding"
+
+	// hdrL402TokenID and hdrL402PaymentHash are the header fields the
+	// identity of the L402 a request was authenticated with is passed to
+	// the backend in.
+	hdrL402TokenID     = "X-L402-Token-ID"
+	hdrL402PaymentHash = "X-L402-Payment-Hash"
 )
 
+// pricerCloseDelay is the time the pricers of replaced services are kept open
+// for requests in flight that still use them.
+var pricerCloseDelay = time.Minute
+
+// serviceContextKey is the key under which the matched backend service of a
+// request is stored in the request context.
+type serviceContextKey struct{}
+
+// serviceFromContext returns the backend service stored in the given context,
+// if any.
+func serviceFromContext(ctx context.Context) (*Service, bool) {
+	service, ok := ctx.Value(serviceContextKey{}).(*Service)
+	return service, ok
+}
+
+// freeRequestContextKey is the key under which a request is marked as free in
+// the request context, if its resource had a price of zero.
+type freeRequestContextKey struct{}
+
+// isFreeRequest returns true if the request with the given context was allowed
+// without payment because its resource had a price of zero.
+func isFreeRequest(ctx context.Context) bool {
+	free, _ := ctx.Value(freeRequestContextKey{}).(bool)
+	return free
+}
+
+// tokenIdentityContextKey is the key under which the identifier of the L402 a
+// request was authenticated with is stored in the request context.
+type tokenIdentityContextKey struct{}
+
+// tokenIdentity returns the identifier of the L402 the request with the given
+// context was authenticated with, or nil if it wasn't authenticated with a
+// verified L402.
+func tokenIdentity(ctx context.Context) *l402.Identifier {
+	id, _ := ctx.Value(tokenIdentityContextKey{}).(*l402.Identifier)
+	return id
+}
+
 // LocalService is an interface that describes a service that is handled
 // internally by aperture and is not proxied to another backend.
 type LocalService interface {
@@ -41,18 +97,40 @@ type LocalService interface {
 	IsHandling(r *http.Request) bool
 }
 
+// PriorityService is an optional interface a LocalService can implement to be
+// dispatched to before a request is matched against the remote backends, so
+// it can't be shadowed by a service with a catch-all host or path regexp.
+type PriorityService interface {
+	// HasPriority returns true if the local service takes precedence over
+	// the remote backends.
+	HasPriority() bool
+}
+
 // localService is a struct that represents a service that is local to aperture
 // and is not proxied to a remote backend.
 type localService struct {
 	handler    http.Handler
 	isHandling func(r *http.Request) bool
+	priority   bool
 }
 
+// A compile time check to ensure localService implements the PriorityService
+// interface.
+var _ PriorityService = (*localService)(nil)
+
 // NewLocalService creates a new local service.
 func NewLocalService(h http.Handler, f func(r *http.Request) bool) LocalService {
 	return &localService{handler: h, isHandling: f}
 }
 
+// NewPriorityLocalService creates a new local service that is dispatched to
+// before any remote backend is matched.
+func NewPriorityLocalService(h http.Handler,
+	f func(r *http.Request) bool) LocalService {
+
+	return &localService{handler: h, isHandling: f, priority: true}
+}
+
 // ServeHTTP is the http.Handler implementation.
 func (l *localService) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	l.handler.ServeHTTP(rw, r)
@@ -64,29 +142,207 @@ func (l *localService) IsHandling(r *http.Request) bool {
 	return l.isHandling(r)
 }
 
+// HasPriority returns true if the local service takes precedence over the
+// remote backends.
+//
+// NOTE: This is part of the PriorityService interface.
+func (l *localService) HasPriority() bool {
+	return l.priority
+}
+
+// Config holds the proxy wide configuration options that aren't specific to any
+// backend service.
+type Config struct {
+	// MaxRequestRate is the maximum number of requests per second that are
+	// admitted in total, across all services. Excess requests are shed
+	// with a 503 response. A value of zero means unlimited.
+	MaxRequestRate float64
+
+	// MaxRequestBurst is the number of requests that are admitted in a
+	// burst above MaxRequestRate. If zero, a burst of the size of one
+	// second's worth of requests is allowed.
+	MaxRequestBurst int
+
+	// MaxConcurrentRequests is the maximum number of requests that are
+	// handled concurrently, across all services. Excess requests are shed
+	// with a 503 response. A value of zero means unlimited.
+	MaxConcurrentRequests int
+
+	// MaxConcurrentVerifications is the maximum number of authentication
+	// verifications that run concurrently. Excess requests wait for up to
+	// VerificationQueueTimeout and are then shed with a 429 response. A
+	// value of zero means unlimited.
+	MaxConcurrentVerifications int
+
+	// VerificationQueueTimeout is the maximum time a request waits for a
+	// free verification slot. If zero, requests are shed right away.
+	VerificationQueueTimeout time.Duration
+
+	// AccessLogFormat is the format in which each request is logged. Valid
+	// values are "text" (the default) for an apache-like log line and
+	// "json" for a structured log line.
+	AccessLogFormat string
+
+	// BackendSourceAddr is the optional local address that connections to
+	// the backend services originate from. It can either be an IP address
+	// or an IP address and port. If empty, the operating system chooses
+	// the address.
+	BackendSourceAddr string
+
+	// TrustedProxies is a list of IP addresses and subnets in CIDR
+	// notation of proxies, such as load balancers, that are trusted to
+	// report the real client IP address in the RealIPHeader. The header is
+	// ignored for requests from any other peer.
+	TrustedProxies []string
+
+	// RealIPHeader is the header field trusted proxies report the real
+	// client IP address in. For X-Forwarded-For (the default), the
+	// rightmost address that isn't a trusted proxy is used. Any other
+	// header field, such as X-Real-IP, must contain a single address.
+	RealIPHeader string
+
+	// Blocklist is a list of remote IP addresses and subnets in CIDR
+	// notation that are denied access to the proxy.
+	Blocklist []string
+
+	// RejectHostMismatch can be set to reject HTTP/2 requests with a Host
+	// header field that conflicts with their :authority pseudo-header.
+	// Services are matched by the authority, so a backend that looks at
+	// the Host header field instead could otherwise be confused about the
+	// target of the request.
+	RejectHostMismatch bool
+
+	// MaxInjectedHeaders is the maximum number of header fields a service
+	// may add to each backend request through its configuration. Services
+	// that exceed it are rejected. If zero, DefaultMaxInjectedHeaders is
+	// used.
+	MaxInjectedHeaders int
+
+	// BackendMetrics can be set to record the duration and the status code
+	// of each request that is proxied to a service backend as Prometheus
+	// metrics, labeled by the service.
+	BackendMetrics bool
+
+	// MaxJSONChallengeSize is the maximum size in bytes of the JSON body of
+	// a 402 response. Optional fields are left out of larger bodies. If the
+	// challenge still doesn't fit, it is only sent in the header fields. If
+	// zero, DefaultMaxJSONChallengeSize is used.
+	MaxJSONChallengeSize int
+
+	// PaywallTemplate is the optional path of an html/template file that
+	// is rendered as the paywall page for services with PaywallPage set.
+	// If empty, a minimal built-in page is used.
+	PaywallTemplate string
+
+	// Authenticators are the named authenticators services can select to
+	// authenticate their requests instead of the default authenticator.
+	Authenticators map[string]auth.Authenticator
+
+	// FreebieStore is the persistent storage backend the free requests of
+	// freebie services are counted in. If nil, they are counted in memory
+	// and reset on every restart.
+	FreebieStore freebie.CounterStore
+
+	// CORS is the Cross Origin Resource Sharing policy applied to the
+	// responses of the proxy. If nil, requests from any origin are
+	// allowed.
+	CORS *CORSConfig
+}
+
+// maxInjectedHeaders returns the configured maximum number of header fields a
+// service may add to backend requests or the default if none is configured.
+func (c *Config) maxInjectedHeaders() int {
+	if c.MaxInjectedHeaders == 0 {
+		return DefaultMaxInjectedHeaders
+	}
+
+	return c.MaxInjectedHeaders
+}
+
+// maxJSONChallengeSize returns the configured maximum size of a JSON challenge
+// body or the default if none is configured.
+func (c *Config) maxJSONChallengeSize() int {
+	if c.MaxJSONChallengeSize == 0 {
+		return DefaultMaxJSONChallengeSize
+	}
+
+	return c.MaxJSONChallengeSize
+}
+
 // Proxy is a HTTP, HTTP/2 and gRPC handler that takes an incoming request,
 // uses its authenticator to validate the request's headers, and either returns
 // a challenge to the client or forwards the request to another server and
 // proxies the response back to the client.
 type Proxy struct {
-	proxyBackend  *httputil.ReverseProxy
+	cfg           *Config
 	localServices []LocalService
 	authenticator auth.Authenticator
-	services      []*Service
+	admission     *admissionController
+	verifications *verificationLimiter
+	realIP        *RealIPResolver
+	paywall       *template.Template
+	cors          *corsPolicy
+
+	// mu guards the fields below, which can be replaced at runtime while
+	// requests are being served.
+	mu           sync.RWMutex
+	proxyBackend *httputil.ReverseProxy
+	transport    *serviceTransport
+	services     []*Service
+	blocklist    *blocklist
 }
 
 // New returns a new Proxy instance that proxies between the services specified,
 // using the auth to validate each request's headers and get new challenge
-// headers if necessary.
+// headers if necessary. The default configuration is used.
 func New(auth auth.Authenticator, services []*Service,
 	localServices ...LocalService) (*Proxy, error) {
 
+	return NewWithConfig(nil, auth, services, localServices...)
+}
+
+// NewWithConfig returns a new Proxy instance like New, using the given proxy
+// wide configuration. If the config is nil, the default configuration is used.
+func NewWithConfig(cfg *Config, auth auth.Authenticator, services []*Service,
+	localServices ...LocalService) (*Proxy, error) {
+
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	realIP, err := NewRealIPResolver(cfg.TrustedProxies, cfg.RealIPHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	paywall, err := loadPaywallTemplate(cfg.PaywallTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	cors, err := newCORSPolicy(cfg.CORS)
+	if err != nil {
+		return nil, err
+	}
+
 	proxy := &Proxy{
+		cfg:           cfg,
 		localServices: localServices,
 		authenticator: auth,
-		services:      services,
+		admission: newAdmissionController(
+			cfg.MaxRequestRate, cfg.MaxRequestBurst,
+			cfg.MaxConcurrentRequests,
+		),
+		verifications: newVerificationLimiter(
+			cfg.MaxConcurrentVerifications,
+			cfg.VerificationQueueTimeout,
+		),
+		blocklist: newBlocklist(cfg.Blocklist),
+		realIP:    realIP,
+		paywall:   paywall,
+		cors:      cors,
 	}
-	err := proxy.UpdateServices(services)
+	err = proxy.UpdateServices(services)
 	if err != nil {
 		return nil, err
 	}
@@ -98,27 +354,116 @@ func New(auth auth.Authenticator, services []*Service,
 // returns a challenge or forwards their request to the target backend service.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Parse and log the remote IP address. We also need the parsed IP
-	// address for the freebie count.
+	// address for the blocklist and the freebie count. If the request was
+	// forwarded by a trusted proxy, we use the real client IP address it
+	// reports instead.
 	remoteIP, prefixLog := NewRemoteIPPrefixLog(log, r.RemoteAddr)
-	logRequest := func() {
-		prefixLog.Infof(formatPattern, r.Method, r.RequestURI, r.Proto,
-			r.Referer(), r.UserAgent())
+	clientIP := p.realIP.ClientIP(remoteIP, r.Header)
+	if !clientIP.Equal(remoteIP) {
+		remoteIP, prefixLog = clientIP, NewIPPrefixLog(log, clientIP)
+	}
+
+	// The structured access log needs to know the outcome of the request,
+	// so we record the status code and size of the response.
+	var (
+		serviceName string
+		authOutcome = authOutcomeNone
+	)
+	if p.cfg.AccessLogFormat == AccessLogFormatJSON {
+		start := time.Now()
+		rec := newResponseRecorder(w)
+		w = rec
+
+		defer func() {
+			newAccessLogEntry(
+				r, remoteIP.String(), serviceName, authOutcome,
+				start, rec,
+			).write()
+		}()
+	} else {
+		logRequest := func() {
+			prefixLog.Infof(formatPattern, r.Method, r.RequestURI,
+				r.Proto, r.Referer(), r.UserAgent())
+		}
+		defer logRequest()
+	}
+
+	// Take a snapshot of the reconfigurable state, so the whole request
+	// is handled with a consistent configuration, even if it is updated
+	// concurrently.
+	p.mu.RLock()
+	services, proxyBackend, blocklist := p.services, p.proxyBackend,
+		p.blocklist
+	transport := p.transport
+	p.mu.RUnlock()
+
+	// Requests from blocked addresses are denied right away.
+	if blocklist.isBlocked(remoteIP) {
+		prefixLog.Infof("Request from blocked address denied")
+		authOutcome = authOutcomeBlocked
+		p.addCorsHeaders(w.Header(), r)
+		sendDirectResponse(w, r, http.StatusForbidden, "access denied")
+		return
+	}
+
+	// Requests that name different hosts in their :authority and Host
+	// header fields are rejected if configured, as it would be ambiguous
+	// which service they are meant for.
+	if p.cfg.RejectHostMismatch && hasConflictingHost(r) {
+		prefixLog.Infof("Request with conflicting host %v denied",
+			r.Header.Values("Host"))
+		p.addCorsHeaders(w.Header(), r)
+		sendDirectResponse(
+			w, r, http.StatusBadRequest, "conflicting host",
+		)
+		return
 	}
-	defer logRequest()
+
+	// Before doing any work, make sure we aren't overwhelmed by the total
+	// number of requests.
+	release, ok := p.admission.admit()
+	if !ok {
+		prefixLog.Warnf("Request shed by admission control")
+		p.addCorsHeaders(w.Header(), r)
+		sendDirectResponse(
+			w, r, http.StatusServiceUnavailable, "server busy",
+		)
+		return
+	}
+	defer release()
 
 	// For OPTIONS requests we only need to set the CORS headers, not serve
-	// any content;
+	// any content. Preflight requests are checked against the CORS policy
+	// first.
 	if r.Method == "OPTIONS" {
-		addCorsHeaders(w.Header())
+		if isPreflightRequest(r) {
+			p.handlePreflight(w, r, prefixLog)
+			return
+		}
+
+		p.addCorsHeaders(w.Header(), r)
 		sendDirectResponse(w, r, http.StatusOK, "")
 		return
 	}
 
+	// Some local services, like the health endpoints, must always be
+	// reachable, so they are dispatched to before any remote backend is
+	// matched.
+	for _, ls := range p.localServices {
+		priority, ok := ls.(PriorityService)
+		if ok && priority.HasPriority() && ls.IsHandling(r) {
+			prefixLog.Debugf("Dispatching request %s to priority "+
+				"local service.", r.URL.Path)
+			ls.ServeHTTP(w, r)
+			return
+		}
+	}
+
 	// Requests that can't be matched to a service backend will be
-	// dispatched to the static file server. If the file exists in the
-	// static file folder it will be served, otherwise the static server
-	// will return a 404 for us.
-	target, ok := matchService(r, p.services)
+	// dispatched to the local services, such as the static file server if
+	// it is enabled. If none of them claims the request, it is answered
+	// with a 404.
+	target, ok := matchService(r, services)
 	if !ok {
 		// This isn't a request for any configured remote backend that
 		// we are proxying for. So we give it to the local service that
@@ -132,19 +477,25 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		// If we get here, something is quite wrong. At least the static
-		// file server should have picked up the request and serve a
-		// 404 response. So nothing we can do here except returning an
-		// error.
-		addCorsHeaders(w.Header())
-		sendDirectResponse(w, r, http.StatusInternalServerError, "")
+		// If we get here, there's nothing that could serve the request.
+		prefixLog.Debugf("No service found for request %s.",
+			r.URL.Path)
+		http.NotFound(w, r)
 		return
 	}
 
+	serviceName = target.Name
 	resourceName := target.ResourceName(r.URL.Path)
 
+	if err := target.applyTimeouts(w); err != nil {
+		prefixLog.Warnf("Unable to apply timeouts of service %s: %v",
+			target.Name, err)
+	}
+
 	// Determine auth level required to access service and dispatch request
-	// accordingly.
+	// accordingly. The identifier of a verified L402 is kept, so it can be
+	// forwarded to the backend.
+	var tokenID *l402.Identifier
 	authLevel := target.AuthRequired(r)
 	switch {
 	case authLevel.IsOn():
@@ -153,38 +504,68 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// called in each case body rather than outside the switch so
 		// as to avoid calling this possibly expensive call for static
 		// resources.
-		acceptAuth := p.authenticator.Accept(&r.Header, resourceName)
+		acceptAuth, id, ok := p.acceptAuth(
+			w, r, target, resourceName, prefixLog,
+		)
+		if !ok {
+			authOutcome = authOutcomeShed
+			return
+		}
 		if !acceptAuth {
 			price, err := target.pricer.GetPrice(r.Context(), r)
 			if err != nil {
-				prefixLog.Errorf("error getting "+
-					"resource price: %v", err)
-				sendDirectResponse(
-					w, r, http.StatusInternalServerError,
-					"failure fetching "+
-						"resource price",
-				)
+				authOutcome = authOutcomeError
+				sendPriceError(w, r, err, prefixLog)
 				return
 			}
 
-			// If the price returned is zero, then break out of the
-			// switch statement and allow access to the service.
+			// A price of zero means the resource is free right now,
+			// so we break out of the switch statement and allow
+			// access to the service without creating an invoice.
 			if price == 0 {
+				authOutcome = authOutcomeZeroPrice
 				break
 			}
 
 			prefixLog.Infof("Authentication failed. Sending 402.")
-			p.handlePaymentRequired(w, r, resourceName, price)
+			authOutcome = authOutcomePaymentRequired
+			p.handlePaymentRequired(
+				w, r, target, resourceName, price,
+			)
+			return
+		}
+		authOutcome = authOutcomeAccepted
+		tokenID = id
+
+	case authLevel.IsAudit():
+		// Requests to services in audit mode are evaluated like
+		// requests that require authentication, but are let through
+		// no matter the decision.
+		acceptAuth, _, ok := p.acceptAuth(
+			w, r, target, resourceName, prefixLog,
+		)
+		if !ok {
+			authOutcome = authOutcomeShed
 			return
 		}
+		authOutcome = p.auditAuth(r, target, acceptAuth, prefixLog)
 
 	case authLevel.IsFreebie():
 		// We only need to respect the freebie counter if the user
 		// is not authenticated at all.
-		acceptAuth := p.authenticator.Accept(&r.Header, resourceName)
+		acceptAuth, id, ok := p.acceptAuth(
+			w, r, target, resourceName, prefixLog,
+		)
+		if !ok {
+			authOutcome = authOutcomeShed
+			return
+		}
+		authOutcome = authOutcomeAccepted
+		tokenID = id
 		if !acceptAuth {
 			ok, err := target.freebieDB.CanPass(r, remoteIP)
 			if err != nil {
+				authOutcome = authOutcomeError
 				prefixLog.Errorf("Error querying freebie db: "+
 					"%v", err)
 				sendDirectResponse(
@@ -198,30 +579,31 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					r.Context(), r,
 				)
 				if err != nil {
-					prefixLog.Errorf("error getting "+
-						"resource price: %v", err)
-					sendDirectResponse(
-						w, r, http.StatusInternalServerError,
-						"failure fetching "+
-							"resource price",
-					)
+					authOutcome = authOutcomeError
+					sendPriceError(w, r, err, prefixLog)
 					return
 				}
 
-				// If the price returned is zero, then break
-				// out of the switch statement and allow access
-				// to the service.
+				// A price of zero means the resource is free
+				// right now, so we break out of the switch
+				// statement and allow access to the service
+				// without creating an invoice.
 				if price == 0 {
+					authOutcome = authOutcomeZeroPrice
 					break
 				}
 
+				authOutcome = authOutcomePaymentRequired
 				p.handlePaymentRequired(
-					w, r, resourceName, target.Price,
+					w, r, target, resourceName,
+					target.Price,
 				)
 				return
 			}
+			authOutcome = authOutcomeFreebie
 			_, err = target.freebieDB.TallyFreebie(r, remoteIP)
 			if err != nil {
+				authOutcome = authOutcomeError
 				prefixLog.Errorf("Error updating freebie db: "+
 					"%v", err)
 				sendDirectResponse(
@@ -230,38 +612,265 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				)
 				return
 			}
+			recordFreebie(target)
 		}
 	}
 
+	// Only authorized requests take up one of the service's backend slots.
+	if target.queue != nil {
+		release, ok := target.queue.acquire(r.Context())
+		if !ok {
+			authOutcome = authOutcomeShed
+			prefixLog.Warnf("Request shed by concurrency limit of "+
+				"service %s", target.Name)
+			p.addCorsHeaders(w.Header(), r)
+			sendDirectResponse(
+				w, r, http.StatusServiceUnavailable,
+				"service busy",
+			)
+			return
+		}
+		defer release()
+	}
+
+	recordCapabilityUsage(target, r, prefixLog)
+
 	// If we got here, it means everything is OK to pass the request to the
-	// service backend via the reverse proxy.
-	p.proxyBackend.ServeHTTP(w, r)
+	// service backend via the reverse proxy. We attach the matched service
+	// to the request context so the transport can apply any per-service
+	// behavior.
+	ctx := context.WithValue(r.Context(), serviceContextKey{}, target)
+
+	// Free requests carry no valid authentication, so we mark them to let
+	// the director know it doesn't need to look for any.
+	if authOutcome == authOutcomeZeroPrice {
+		prefixLog.Debugf("Resource %s is free, skipping payment",
+			resourceName)
+		recordFreeRequest(target)
+		ctx = context.WithValue(ctx, freeRequestContextKey{}, true)
+	}
+
+	// Only the identity of an L402 the authenticator verified is passed on
+	// to the director. Whitelisted, free and freebie requests, as well as
+	// requests authenticated by other means like an API key, might carry an
+	// L402 that was never verified.
+	if authOutcome == authOutcomeAccepted && tokenID != nil {
+		ctx = context.WithValue(ctx, tokenIdentityContextKey{}, tokenID)
+	}
+
+	// WebSocket connections are long-lived and need the connection to be
+	// taken over, so they aren't passed through the reverse proxy.
+	if isWebSocketRequest(r) {
+		p.serveWebSocket(
+			w, r.WithContext(ctx), target, transport, prefixLog,
+		)
+		return
+	}
+
+	if !p.cfg.BackendMetrics {
+		proxyBackend.ServeHTTP(w, r.WithContext(ctx))
+		return
+	}
+
+	rec := newResponseRecorder(w)
+	start := time.Now()
+	proxyBackend.ServeHTTP(rec, r.WithContext(ctx))
+	recordBackendResponse(target, rec.statusCode(), time.Since(start))
+}
+
+// sendPriceError answers a request whose price couldn't be determined because
+// of the given error. Requests that are priced by the size of their body but
+// don't declare it are answered with a 411, so clients know to send the
+// Content-Length header field.
+func sendPriceError(w http.ResponseWriter, r *http.Request, err error,
+	prefixLog *PrefixLog) {
+
+	if errors.Is(err, pricer.ErrUnknownBodySize) {
+		prefixLog.Debugf("Unable to price request: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusLengthRequired,
+			"request body size required",
+		)
+		return
+	}
+
+	prefixLog.Errorf("error getting resource price: %v", err)
+	sendDirectResponse(
+		w, r, http.StatusInternalServerError,
+		"failure fetching resource price",
+	)
+}
+
+// acceptAuth returns whether the request's headers successfully authenticate
+// the user for the given resource and, if the authenticator verified an L402,
+// its identifier. The number of concurrent verifications is bounded, and if no
+// verification slot becomes available in time, a 429 response is sent and
+// false is returned as the last value.
+func (p *Proxy) acceptAuth(w http.ResponseWriter, r *http.Request,
+	target *Service, resourceName string,
+	prefixLog *PrefixLog) (bool, *l402.Identifier, bool) {
+
+	release, ok := p.verifications.acquire(r.Context())
+	if !ok {
+		prefixLog.Warnf("Request shed by verification limit")
+		p.addCorsHeaders(w.Header(), r)
+		sendDirectResponse(
+			w, r, http.StatusTooManyRequests, "too many concurrent "+
+				"verifications",
+		)
+		return false, nil, false
+	}
+	defer release()
+
+	// Authenticators that support it get to check the whole request, so
+	// L402s can be restricted to certain methods.
+	authenticator := p.serviceAuthenticator(target)
+	switch a := authenticator.(type) {
+	case auth.IdentityAuthenticator:
+		id, accepted := a.AcceptRequestIdentity(r, resourceName)
+		return accepted, id, true
+
+	case auth.RequestAuthenticator:
+		return a.AcceptRequest(r, resourceName), nil, true
+	}
+
+	return authenticator.Accept(&r.Header, resourceName), nil, true
+}
+
+// auditAuth logs and records the decision that would have been made for a
+// request to a service in audit mode and returns the auth outcome. The pricer
+// sees the request without its body, as the body still needs to be proxied to
+// the backend.
+func (p *Proxy) auditAuth(r *http.Request, target *Service, acceptAuth bool,
+	prefixLog *PrefixLog) string {
+
+	if acceptAuth {
+		prefixLog.Debugf("Audit: would allow authenticated request to "+
+			"service %s", target.Name)
+		recordAuditDecision(target, auditDecisionAllow, 0)
+
+		return authOutcomeAuditAllow
+	}
+
+	priceReq := r.Clone(r.Context())
+	priceReq.Body = http.NoBody
+	priceReq.ContentLength = 0
+	price, err := target.pricer.GetPrice(r.Context(), priceReq)
+	if err != nil {
+		prefixLog.Errorf("Audit: error getting resource price: %v", err)
+		return authOutcomeError
+	}
+
+	if price == 0 {
+		prefixLog.Debugf("Audit: would allow free request to "+
+			"service %s", target.Name)
+		recordAuditDecision(target, auditDecisionAllow, 0)
+
+		return authOutcomeAuditAllow
+	}
+
+	prefixLog.Debugf("Audit: would charge %d satoshis for request to "+
+		"service %s", price, target.Name)
+	recordAuditDecision(target, auditDecisionCharge, price)
+
+	return authOutcomeAuditCharge
+}
+
+// serviceAuthenticator returns the authenticator of the given service, which
+// is the default authenticator unless the service selects its own.
+func (p *Proxy) serviceAuthenticator(service *Service) auth.Authenticator {
+	if service.authenticator != nil {
+		return service.authenticator
+	}
+
+	return p.authenticator
+}
+
+// prepareAuthenticators combines the named authenticators each service selects
+// into the authenticator of the service.
+func (p *Proxy) prepareAuthenticators(services []*Service) error {
+	for _, service := range services {
+		if len(service.Authenticators) == 0 {
+			continue
+		}
+
+		authenticators := make(
+			[]auth.Authenticator, 0, len(service.Authenticators),
+		)
+		for _, name := range service.Authenticators {
+			a, ok := p.cfg.Authenticators[name]
+			if !ok {
+				return fmt.Errorf("unknown authenticator "+
+					"%s of service %s", name,
+					service.Name)
+			}
+			authenticators = append(authenticators, a)
+		}
+
+		if len(authenticators) == 1 {
+			service.authenticator = authenticators[0]
+			continue
+		}
+
+		composite, err := auth.NewCompositeAuthenticator(
+			authenticators...,
+		)
+		if err != nil {
+			return err
+		}
+		service.authenticator = composite
+	}
+
+	return nil
 }
 
 // UpdateServices re-configures the proxy to use a new set of backend services.
+// It is safe to call while requests are being served. Requests that are
+// already in flight are completed with the previous configuration. If any of
+// the new services can't be initialized, the previous configuration is kept.
+// Otherwise the pricers and idle backend connections of the previous services
+// are closed. The given services must not be shared with the previous
+// configuration.
 func (p *Proxy) UpdateServices(services []*Service) error {
-	err := prepareServices(services)
+	err := prepareServices(
+		services, p.cfg.maxInjectedHeaders(), p.cfg.FreebieStore,
+	)
 	if err != nil {
+		_ = closePricers(services)
 		return err
 	}
 
-	certPool, err := certPool(services)
-	if err != nil {
+	if err := p.prepareAuthenticators(services); err != nil {
+		_ = closePricers(services)
 		return err
 	}
-	transport := &http.Transport{
-		ForceAttemptHTTP2: true,
-		TLSClientConfig: &tls.Config{
-			RootCAs:            certPool,
-			InsecureSkipVerify: true,
-		},
+
+	// Only replace the default dialer of the transports if we need to bind
+	// to a specific local address.
+	var dialer *net.Dialer
+	if p.cfg.BackendSourceAddr != "" {
+		dialer, err = newBackendDialer(p.cfg.BackendSourceAddr)
+		if err != nil {
+			_ = closePricers(services)
+			return err
+		}
+	}
+
+	transport, err := newServiceTransport(services, dialer)
+	if err != nil {
+		_ = closePricers(services)
+		return err
 	}
 
-	p.proxyBackend = &httputil.ReverseProxy{
-		Director:  p.director,
-		Transport: &trailerFixingTransport{next: transport},
+	proxyBackend := &httputil.ReverseProxy{
+		Director: p.director,
+		Transport: &trailerFixingTransport{
+			next: newCacheTransport(newStaleTransport(
+				&retryTransport{next: transport},
+			)),
+		},
 		ModifyResponse: func(res *http.Response) error {
-			addCorsHeaders(res.Header)
+			p.addCorsHeaders(res.Header, res.Request)
 			return nil
 		},
 
@@ -270,13 +879,55 @@ func (p *Proxy) UpdateServices(services []*Service) error {
 		FlushInterval: -1,
 	}
 
+	p.mu.Lock()
+	oldServices, oldTransport := p.services, p.transport
+	carryOverFreebieDBs(oldServices, services)
+	p.services = services
+	p.proxyBackend = proxyBackend
+	p.transport = transport
+	p.mu.Unlock()
+
+	// New requests use the new services from now on, so the resources of
+	// the previous ones can be released. Requests in flight might still
+	// ask the previous pricers for a price, so they are only closed after
+	// a grace period.
+	if oldTransport != nil {
+		oldTransport.closeIdleConnections()
+	}
+	time.AfterFunc(pricerCloseDelay, func() {
+		_ = closePricers(oldServices)
+	})
+
 	return nil
 }
 
+// UpdateBlocklist replaces the list of blocked IP addresses and subnets. It is
+// safe to call while requests are being served.
+func (p *Proxy) UpdateBlocklist(entries []string) {
+	blocklist := newBlocklist(entries)
+
+	p.mu.Lock()
+	p.blocklist = blocklist
+	p.mu.Unlock()
+}
+
 // Close cleans up the Proxy by closing any remaining open connections.
 func (p *Proxy) Close() error {
+	p.mu.RLock()
+	services := p.services
+	p.mu.RUnlock()
+
+	return closePricers(services)
+}
+
+// closePricers closes the pricers of all given services that have one.
+func closePricers(services []*Service) error {
 	var returnErr error
-	for _, s := range p.services {
+	for _, s := range services {
+		if s.pricer == nil {
+			continue
+		}
+
 		if err := s.pricer.Close(); err != nil {
 			log.Errorf("error while closing the pricer of "+
 				"service %s: %v", s.Name, err)
@@ -290,55 +941,112 @@ func (p *Proxy) Close() error {
 // director is a method that rewrites an incoming request to be forwarded to a
 // backend service.
 func (p *Proxy) director(req *http.Request) {
-	target, ok := matchService(req, p.services)
+	// The matched service is attached to the request by ServeHTTP. We use
+	// it instead of matching again, as the services might have been
+	// updated in the meantime.
+	target, ok := serviceFromContext(req.Context())
 	if ok {
 		// Rewrite address and protocol in the request so the
 		// real service is called instead.
-		req.Host = target.Address
-		req.URL.Host = target.Address
-		req.URL.Scheme = target.Protocol
+		address := target.nextAddress()
+		req.Host = address
+		req.URL.Host = address
+		req.URL.Scheme = target.backendScheme()
 
 		// Make sure we always forward the authorization in the correct/
-		// default format so the backend knows what to do with it.
-		mac, preimage, err := l402.FromHeader(&req.Header)
-		if err == nil {
-			// It could be that there is no auth information because
-			// none is needed for this particular request. So we
-			// only continue if no error is set.
-			err := l402.SetHeader(&req.Header, mac, preimage)
-			if err != nil {
-				log.Errorf("could not set header: %v", err)
-			}
+		// default format so the backend knows what to do with it. Free
+		// requests weren't authenticated, so there's nothing to
+		// forward.
+		if !isFreeRequest(req.Context()) {
+			forwardL402Header(req)
+		}
+
+		if target.ForwardTokenIdentity {
+			forwardTokenIdentity(req)
+		}
+
+		// gRPC negotiates message compression end-to-end through the
+		// grpc-encoding and grpc-accept-encoding headers and the
+		// compressed flag of each message frame, all of which we pass
+		// through untouched. We make sure the transport doesn't also
+		// request a gzip encoded response body on its own, which it
+		// would then transparently decompress.
+		if isGRPCRequest(req) && req.Header.Get(hdrAcceptEncoding) == "" {
+			req.Header.Set(hdrAcceptEncoding, "identity")
 		}
 
 		// Now overwrite header fields of the client request
-		// with the fields from the configuration file.
-		for name, value := range target.Headers {
-			req.Header.Add(name, value)
+		// with the fields from the configuration file. They are
+		// added in a fixed order, so backends always see the same
+		// request.
+		for _, name := range target.headerNames {
+			req.Header.Add(name, target.Headers[name])
 		}
 	}
 }
 
-// certPool builds a pool of x509 certificates from the backend services.
-func certPool(services []*Service) (*x509.CertPool, error) {
-	cp := x509.NewCertPool()
-	for _, service := range services {
-		if service.TLSCertPath == "" {
-			continue
-		}
+// forwardL402Header rewrites the L402 of the request, if any, in the default
+// header format.
+func forwardL402Header(req *http.Request) {
+	// It could be that there is no auth information because none is
+	// needed for this particular request. So we only continue if no error
+	// is set.
+	mac, preimage, err := l402.FromHeader(&req.Header)
+	if err != nil {
+		return
+	}
 
-		b, err := os.ReadFile(service.TLSCertPath)
-		if err != nil {
-			return nil, err
-		}
+	err = l402.SetHeader(&req.Header, mac, preimage)
+	if err != nil {
+		log.Errorf("could not set header: %v", err)
+	}
+}
 
-		if !cp.AppendCertsFromPEM(b) {
-			return nil, fmt.Errorf("credentials: failed to " +
-				"append certificate")
-		}
+// forwardTokenIdentity sets the token ID and payment hash of the L402 the
+// request was authenticated with in the identity header fields. Only the
+// identity the authenticator verified is used, never the one in the request's
+// header. Any identity header fields set by the client are removed, so the
+// backend can trust them.
+func forwardTokenIdentity(req *http.Request) {
+	req.Header.Del(hdrL402TokenID)
+	req.Header.Del(hdrL402PaymentHash)
+
+	// Requests can also be authenticated without an L402, for example
+	// with an API key, in which case there's no identity to forward.
+	id := tokenIdentity(req.Context())
+	if id == nil {
+		return
 	}
 
-	return cp, nil
+	req.Header.Set(hdrL402TokenID, id.TokenID.String())
+	req.Header.Set(hdrL402PaymentHash, id.PaymentHash.String())
+}
+
+// newBackendDialer creates a dialer for backend connections that binds to the
+// given local source address. The address can either be an IP address or an IP
+// address and port.
+func newBackendDialer(sourceAddr string) (*net.Dialer, error) {
+	// Without a port, we let the operating system choose one.
+	if net.ParseIP(sourceAddr) != nil {
+		sourceAddr = net.JoinHostPort(sourceAddr, "0")
+	}
+
+	localAddr, err := net.ResolveTCPAddr("tcp", sourceAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend source address %s: %w",
+			sourceAddr, err)
+	}
+	if localAddr.IP == nil {
+		return nil, fmt.Errorf("backend source address %s must "+
+			"contain an IP address", sourceAddr)
+	}
+
+	// These are the same values the default HTTP transport uses.
+	return &net.Dialer{
+		LocalAddr: localAddr,
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}, nil
 }
 
 // matchService tries to match a backend service to an HTTP request by regular
@@ -355,7 +1063,7 @@ func matchService(req *http.Request, services []*Service) (*Service, bool) {
 		if service.PathRegexp == "" {
 			log.Debugf("Host [%s] matched pattern [%s] and path "+
 				"expression is empty. Using service [%s].",
-				req.Host, hostRegexp, service.Address)
+				req.Host, hostRegexp, service.Name)
 			return service, true
 		}
 
@@ -369,7 +1077,7 @@ func matchService(req *http.Request, services []*Service) (*Service, bool) {
 		log.Debugf("Host [%s] matched pattern [%s] and path [%s] "+
 			"matched [%s]. Using service [%s].",
 			req.Host, hostRegexp, req.URL.Path, pathRegexp,
-			service.Address)
+			service.Name)
 		return service, true
 	}
 	log.Debugf("No backend service matched request [%s%s].", req.Host,
@@ -378,29 +1086,42 @@ func matchService(req *http.Request, services []*Service) (*Service, bool) {
 }
 
 // addCorsHeaders adds HTTP header fields that are required for Cross Origin
-// Resource Sharing. These header fields are needed to signal to the browser
-// that it's ok to allow requests to sub domains, even if the JS was served from
-// the top level domain.
-func addCorsHeaders(header http.Header) {
-	log.Debugf("Adding CORS headers to response.")
-
-	header.Add("Access-Control-Allow-Origin", "*")
-	header.Add("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	header.Add("Access-Control-Expose-Headers", "WWW-Authenticate")
-	header.Add(
-		"Access-Control-Allow-Headers",
-		"Authorization, Grpc-Metadata-macaroon, WWW-Authenticate",
-	)
+// Resource Sharing to the response to the given request. These header fields
+// are needed to signal to the browser that it's ok to allow requests to sub
+// domains, even if the JS was served from the top level domain. Which origins
+// are allowed depends on the configured CORS policy.
+func (p *Proxy) addCorsHeaders(header http.Header, r *http.Request) {
+	p.cors.addHeaders(header, r)
 }
 
 // handlePaymentRequired returns fresh challenge header fields and status code
 // to the client signaling that a payment is required to fulfil the request.
+// If the client asks for it or the service is configured to do so, the
+// challenge is also returned as a JSON body to non-gRPC clients. Browsers
+// navigating to a service with a paywall page get an HTML page instead.
 func (p *Proxy) handlePaymentRequired(w http.ResponseWriter, r *http.Request,
-	serviceName string, servicePrice int64) {
+	target *Service, serviceName string, servicePrice int64) {
 
-	header, err := p.authenticator.FreshChallengeHeader(
-		serviceName, servicePrice,
+	tier, price, err := target.requestedTier(r, servicePrice)
+	if err != nil {
+		log.Debugf("Invalid tier requested: %v", err)
+		sendDirectResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	header, err := p.freshChallengeHeader(
+		target, serviceName, tier, price,
 	)
+
+	// Services that only accept credentials that can't be paid for, like
+	// API keys, can't issue a challenge.
+	if errors.Is(err, auth.ErrNoChallenge) {
+		p.addCorsHeaders(w.Header(), r)
+		sendDirectResponse(
+			w, r, http.StatusUnauthorized, "unauthorized",
+		)
+		return
+	}
 	if err != nil {
 		log.Errorf("Error creating new challenge header: %v", err)
 		sendDirectResponse(
@@ -410,7 +1131,10 @@ func (p *Proxy) handlePaymentRequired(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	addCorsHeaders(header)
+	p.addCorsHeaders(header, r)
+	if len(target.Tiers) > 0 {
+		header.Set(hdrTiers, target.tiersHeader(servicePrice))
+	}
 
 	for name, value := range header {
 		w.Header().Set(name, value[0])
@@ -418,6 +1142,53 @@ func (p *Proxy) handlePaymentRequired(w http.ResponseWriter, r *http.Request,
 			w.Header().Add(name, value[i])
 		}
 	}
+	if target.RetryAfter > 0 {
+		w.Header().Set(
+			hdrRetryAfter, retryAfterSeconds(target.RetryAfter),
+		)
+	}
+
+	// Browsers get a page that shows the challenge to the user, unless
+	// they explicitly ask for JSON as well.
+	if target.PaywallPage && !isGRPCRequest(r) && acceptsHTML(r) &&
+		!acceptsJSON(r) {
+
+		data, err := newPaywallPageData(header, target, price)
+		if err != nil {
+			log.Errorf("Error creating paywall page: %v", err)
+		} else {
+			data.Tiers = target.tierPrices(servicePrice)
+			if p.sendPaywallPage(w, data) {
+				return
+			}
+		}
+	}
+
+	// gRPC clients only ever get the challenge in the header fields, as
+	// the body of their response must consist of gRPC messages.
+	if !isGRPCRequest(r) && (target.JSONChallenge || acceptsJSON(r)) {
+		body, err := newPaymentRequiredBody(header, price)
+		if err != nil {
+			log.Errorf("Error creating challenge body: %v", err)
+			sendDirectResponse(
+				w, r, http.StatusInternalServerError,
+				"challenge failure",
+			)
+			return
+		}
+		body.Tiers = target.tierPrices(servicePrice)
+
+		encoded, ok := body.encode(p.cfg.maxJSONChallengeSize())
+		if ok {
+			writeJSONResponse(
+				w, http.StatusPaymentRequired, encoded,
+			)
+			return
+		}
+
+		log.Debugf("JSON challenge exceeds %d bytes, sending it in "+
+			"the header fields only", p.cfg.maxJSONChallengeSize())
+	}
 
 	sendDirectResponse(w, r, http.StatusPaymentRequired, "payment required")
 }
@@ -425,15 +1196,18 @@ func (p *Proxy) handlePaymentRequired(w http.ResponseWriter, r *http.Request,
 // sendDirectResponse sends a response directly to the client without proxying
 // anything to a backend. The given error is transported in a way the client can
 // understand. This means, for a gRPC client it is sent as specific header
-// fields.
+// fields and for a gRPC-Web client as a trailer frame in the body.
 func sendDirectResponse(w http.ResponseWriter, r *http.Request,
 	statusCode int, errInfo string) {
 
-	// Find out if the client is a normal HTTP or a gRPC client. Every gRPC
-	// request should have the Content-Type header field set accordingly
-	// so we can use that.
+	// Find out if the client is a normal HTTP, a gRPC-Web or a gRPC
+	// client. gRPC-Web requests match the gRPC content type as well, so
+	// they need to be checked first.
 	switch {
-	case strings.HasPrefix(r.Header.Get(hdrContentType), hdrTypeGrpc):
+	case isGRPCWebRequest(r):
+		sendGRPCWebError(w, r, codes.Internal, errInfo)
+
+	case isGRPCRequest(r):
 		w.Header().Set(hdrGrpcStatus, strconv.Itoa(int(codes.Internal)))
 		w.Header().Set(hdrGrpcMessage, errInfo)
 
@@ -449,21 +1223,68 @@ func sendDirectResponse(w http.ResponseWriter, r *http.Request,
 	}
 }
 
+// sendJSONResponse sends the given value JSON encoded directly to the client
+// without proxying anything to a backend. This must only be used for non-gRPC
+// clients.
+func sendJSONResponse(w http.ResponseWriter, statusCode int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Error encoding JSON response: %v", err)
+		http.Error(
+			w, "response encoding failure",
+			http.StatusInternalServerError,
+		)
+		return
+	}
+
+	writeJSONResponse(w, statusCode, body)
+}
+
+// writeJSONResponse sends the given JSON encoded body directly to the client.
+func writeJSONResponse(w http.ResponseWriter, statusCode int, body []byte) {
+	w.Header().Set(hdrContentType, hdrTypeJSON)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(body)
+}
+
+// retryAfterSeconds formats the given period as value of the Retry-After
+// header field, which only allows whole seconds, rounding up.
+func retryAfterSeconds(period time.Duration) string {
+	seconds := (period + time.Second - 1) / time.Second
+	return strconv.FormatInt(int64(seconds), 10)
+}
+
+// isGRPCRequest returns true if the given request was sent by a gRPC client.
+// Every gRPC request should have the Content-Type header field set
+// accordingly so we can use that.
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get(hdrContentType), hdrTypeGrpc)
+}
+
 type trailerFixingTransport struct {
 	next http.RoundTripper
 }
 
 // RoundTrip is a transport round tripper implementation that fixes an issue
 // in the official httputil.ReverseProxy implementation. Apparently the HTTP/2
-// trailers aren't properly forwarded in some cases. We fix this by always
-// copying the Grpc-Status and Grpc-Message fields to the trailers, as those are
-// usually expected to be in the trailer fields.
+// trailers aren't properly forwarded in some cases. We fix this by copying the
+// Grpc-Status and Grpc-Message fields to the trailers, as those are usually
+// expected to be in the trailer fields. Whether the fix is applied depends on
+// the trailer fix setting of the backend service the request is sent to.
 // Inspired by https://github.com/elazarl/goproxy/issues/408.
 func (l *trailerFixingTransport) RoundTrip(req *http.Request) (*http.Response,
 	error) {
 
+	// Only gRPC requests get the fix applied by default, unless the
+	// backend service says otherwise.
+	fixTrailers := isGRPCRequest(req)
+	if service, ok := serviceFromContext(req.Context()); ok {
+		fixTrailers = service.fixTrailers(req)
+	}
+
 	resp, err := l.next.RoundTrip(req)
-	if resp != nil && len(resp.Trailer) == 0 {
+	if fixTrailers && resp != nil && len(resp.Trailer) == 0 {
 		if len(resp.Header.Values(hdrGrpcStatus)) > 0 {
 			resp.Trailer = make(http.Header)
 			grpcStatus := resp.Header.Get(hdrGrpcStatus)
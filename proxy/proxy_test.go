@@ -4,13 +4,19 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -24,6 +30,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding/gzip"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"gopkg.in/macaroon.v2"
@@ -391,6 +398,91 @@ func runGRPCTest(t *testing.T, tc *testCase) {
 	}
 }
 
+// TestProxyGRPCCompression makes sure that gzip compressed gRPC messages
+// negotiated between a client and the backend round-trip through the proxy
+// intact.
+func TestProxyGRPCCompression(t *testing.T) {
+	tempDirName, err := os.MkdirTemp("", "proxytest")
+	require.NoError(t, err)
+	certFile := path.Join(tempDirName, "proxy.cert")
+	keyFile := path.Join(tempDirName, "proxy.key")
+	certPool, creds, certData, err := genCertPair(certFile, keyFile)
+	require.NoError(t, err)
+
+	httpListener, err := net.Listen("tcp", testProxyAddr)
+	require.NoError(t, err)
+	tlsListener := tls.NewListener(
+		httpListener, configFromCert(&certData, certPool),
+	)
+	defer closeOrFail(t, tlsListener)
+
+	services := []*proxy.Service{{
+		Address:     testTargetServiceAddress,
+		HostRegexp:  testHostRegexp,
+		PathRegexp:  testPathRegexpGRPC,
+		Protocol:    "https",
+		TLSCertPath: certFile,
+		Auth:        "off",
+	}}
+	p, err := proxy.New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	// We record the encoding headers the proxy sees in both directions to
+	// make sure compression was actually negotiated.
+	encodings := make(chan [2]string, 1)
+	server := &http.Server{
+		Addr: testProxyAddr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request) {
+
+			p.ServeHTTP(w, r)
+
+			encodings <- [2]string{
+				r.Header.Get("Grpc-Encoding"),
+				w.Header().Get("Grpc-Encoding"),
+			}
+		}),
+		TLSConfig: configFromCert(&certData, certPool),
+	}
+	go func() {
+		err := server.Serve(tlsListener)
+		if !isClosedErr(err) {
+			t.Errorf("Error serving on %s: %v", testProxyAddr, err)
+		}
+	}()
+
+	backendService := grpc.NewServer(grpc.Creds(credentials.NewTLS(
+		configFromCert(&certData, certPool),
+	)))
+	go func() { _ = startBackendGRPC(backendService) }()
+	defer backendService.Stop()
+
+	conn, err := grpc.Dial(testProxyAddr, grpc.WithTransportCredentials(
+		creds,
+	))
+	require.NoError(t, err)
+	defer closeOrFail(t, conn)
+	client := proxytest.NewGreeterClient(conn)
+
+	// A large, well compressible message makes sure the compressed frames
+	// are forwarded as they are.
+	name := strings.Repeat("compress me ", 10_000)
+	res, err := client.SayHello(
+		context.Background(), &proxytest.HelloRequest{Name: name},
+		grpc.WaitForReady(true), grpc.UseCompressor(gzip.Name),
+	)
+	require.NoError(t, err)
+	require.Equal(t, "Hello "+name, res.Message)
+
+	select {
+	case e := <-encodings:
+		require.Equal(t, [2]string{gzip.Name, gzip.Name}, e)
+
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for proxied request")
+	}
+}
+
 // startBackendHTTP starts the given HTTP server and blocks until the server
 // is shut down.
 func startBackendHTTP(server *http.Server) error {
@@ -503,3 +595,505 @@ func isClosedErr(err error) bool {
 
 	return false
 }
+
+// TestProxyAdmissionControl makes sure that requests beyond the global
+// admission limits are shed, regardless of the service they target.
+func TestProxyAdmissionControl(t *testing.T) {
+	services := []*proxy.Service{{
+		Address:    testTargetServiceAddress,
+		HostRegexp: "^service1.com$",
+		Protocol:   "http",
+		Auth:       "on",
+	}}
+	localService := proxy.NewLocalService(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}), func(r *http.Request) bool {
+			return true
+		},
+	)
+
+	p, err := proxy.NewWithConfig(&proxy.Config{
+		MaxRequestRate:  1,
+		MaxRequestBurst: 2,
+	}, auth.NewMockAuthenticator(), services, localService)
+	require.NoError(t, err)
+
+	serve := func(host string) int {
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	// The first two requests are within the burst, one for the proxied
+	// service (which requires payment) and one for the local service.
+	require.Equal(t, http.StatusPaymentRequired, serve("service1.com"))
+	require.Equal(t, http.StatusOK, serve("other.com"))
+
+	// Any further request is shed, no matter what service it targets.
+	require.Equal(t, http.StatusServiceUnavailable, serve("service1.com"))
+	require.Equal(t, http.StatusServiceUnavailable, serve("other.com"))
+
+	// Now limit the number of concurrent requests instead.
+	enter, block := make(chan struct{}), make(chan struct{})
+	blockingService := proxy.NewLocalService(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(enter)
+			<-block
+		}), func(r *http.Request) bool {
+			return true
+		},
+	)
+	p, err = proxy.NewWithConfig(&proxy.Config{
+		MaxConcurrentRequests: 1,
+	}, auth.NewMockAuthenticator(), services, blockingService)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve("other.com")
+	}()
+	<-enter
+
+	require.Equal(t, http.StatusServiceUnavailable, serve("service1.com"))
+
+	close(block)
+	<-done
+	require.Equal(t, http.StatusPaymentRequired, serve("service1.com"))
+}
+
+// blockingAuthenticator is an authenticator that blocks each verification until
+// it is released and keeps track of the peak number of concurrent
+// verifications.
+type blockingAuthenticator struct {
+	auth.MockAuthenticator
+
+	entered chan struct{}
+	release chan struct{}
+
+	mu        sync.Mutex
+	active    int
+	maxActive int
+}
+
+// Accept blocks until the verification is released, then delegates to the
+// mock authenticator.
+func (a *blockingAuthenticator) Accept(header *http.Header,
+	serviceName string) bool {
+
+	a.mu.Lock()
+	a.active++
+	if a.active > a.maxActive {
+		a.maxActive = a.active
+	}
+	a.mu.Unlock()
+
+	a.entered <- struct{}{}
+	<-a.release
+
+	a.mu.Lock()
+	a.active--
+	a.mu.Unlock()
+
+	return a.MockAuthenticator.Accept(header, serviceName)
+}
+
+// TestProxyVerificationLimit makes sure that the number of concurrent
+// verifications is bounded, and that excess verifications are queued or shed.
+func TestProxyVerificationLimit(t *testing.T) {
+	services := []*proxy.Service{{
+		Address:    testTargetServiceAddress,
+		HostRegexp: "^service1.com$",
+		Protocol:   "http",
+		Auth:       "on",
+	}}
+	authenticator := &blockingAuthenticator{
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	p, err := proxy.NewWithConfig(&proxy.Config{
+		MaxConcurrentVerifications: 1,
+		VerificationQueueTimeout:   time.Minute,
+	}, authenticator, services)
+	require.NoError(t, err)
+
+	serve := func() int {
+		req := httptest.NewRequest("GET", "http://service1.com/", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	// With a queue timeout, concurrent verifications are serialized.
+	const numRequests = 3
+	results := make(chan int, numRequests)
+	for i := 0; i < numRequests; i++ {
+		go func() {
+			results <- serve()
+		}()
+	}
+	for i := 0; i < numRequests; i++ {
+		<-authenticator.entered
+		authenticator.release <- struct{}{}
+	}
+	for i := 0; i < numRequests; i++ {
+		require.Equal(t, http.StatusPaymentRequired, <-results)
+	}
+	require.Equal(t, 1, authenticator.maxActive)
+
+	// Without a queue timeout, excess verifications are shed right away.
+	p, err = proxy.NewWithConfig(&proxy.Config{
+		MaxConcurrentVerifications: 1,
+	}, authenticator, services)
+	require.NoError(t, err)
+
+	go func() {
+		results <- serve()
+	}()
+	<-authenticator.entered
+
+	require.Equal(t, http.StatusTooManyRequests, serve())
+
+	authenticator.release <- struct{}{}
+	require.Equal(t, http.StatusPaymentRequired, <-results)
+}
+
+// TestProxyJSONChallenge makes sure the payment challenge is returned as JSON
+// body when the client or the service asks for it, but never to gRPC clients,
+// and that the configured Retry-After period is advertised.
+func TestProxyJSONChallenge(t *testing.T) {
+	services := []*proxy.Service{{
+		Name:       "plain",
+		Address:    testTargetServiceAddress,
+		HostRegexp: "^plain.com$",
+		Protocol:   "http",
+		Auth:       "on",
+		Price:      21,
+	}, {
+		Name:          "json",
+		Address:       testTargetServiceAddress,
+		HostRegexp:    "^json.com$",
+		Protocol:      "http",
+		Auth:          "on",
+		Price:         42,
+		JSONChallenge: true,
+		RetryAfter:    1500 * time.Millisecond,
+	}}
+
+	p, err := proxy.New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	serve := func(host string,
+		header http.Header) *httptest.ResponseRecorder {
+
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	type challengeBody struct {
+		Error    string `json:"error"`
+		PriceSat int64  `json:"price_sat"`
+		Invoice  string `json:"invoice"`
+		Macaroon string `json:"macaroon"`
+	}
+	requireJSONChallenge := func(rec *httptest.ResponseRecorder,
+		price int64) {
+
+		require.Equal(t, http.StatusPaymentRequired, rec.Code)
+		require.Equal(
+			t, "application/json", rec.Header().Get("Content-Type"),
+		)
+
+		var body challengeBody
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		require.Equal(t, price, body.PriceSat)
+		require.NotEmpty(t, body.Invoice)
+		require.NotEmpty(t, body.Macaroon)
+
+		// The body must contain the same challenge as the header.
+		require.Contains(
+			t, rec.Header().Values("WWW-Authenticate"),
+			fmt.Sprintf("L402 macaroon=\"%s\", invoice=\"%s\"",
+				body.Macaroon, body.Invoice),
+		)
+	}
+
+	// By default, the plain text body is returned.
+	rec := serve("plain.com", nil)
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	require.Equal(t, "payment required\n", rec.Body.String())
+	require.Empty(t, rec.Header().Get("Retry-After"))
+
+	// The client can ask for a JSON body.
+	rec = serve("plain.com", http.Header{
+		"Accept": []string{"text/html, application/json;q=0.9"},
+	})
+	requireJSONChallenge(rec, 21)
+
+	// The service can be configured to always return a JSON body.
+	rec = serve("json.com", nil)
+	requireJSONChallenge(rec, 42)
+
+	// The Retry-After period is rounded up to whole seconds.
+	require.Equal(t, "2", rec.Header().Get("Retry-After"))
+
+	// gRPC clients still get the challenge in the header fields only.
+	rec = serve("json.com", http.Header{
+		"Content-Type": []string{"application/grpc"},
+		"Accept":       []string{"application/json"},
+	})
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Empty(t, rec.Body.Bytes())
+	require.Equal(
+		t, strconv.Itoa(int(codes.Internal)),
+		rec.Header().Get("Grpc-Status"),
+	)
+	require.Equal(t, "payment required", rec.Header().Get("Grpc-Message"))
+	require.NotEmpty(t, rec.Header().Values("WWW-Authenticate"))
+}
+
+// TestProxyGRPCWebChallenge makes sure gRPC-Web clients receive the payment
+// challenge status in a trailer frame in the body, while the challenge header
+// fields stay readable by browsers.
+func TestProxyGRPCWebChallenge(t *testing.T) {
+	services := []*proxy.Service{{
+		Name:       "grpcweb",
+		Address:    testTargetServiceAddress,
+		HostRegexp: "^grpcweb.com$",
+		Protocol:   "http",
+		Auth:       "on",
+	}}
+
+	p, err := proxy.New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	serve := func(contentType string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			"POST", "http://grpcweb.com/looprpc.SwapServer/LoopOut",
+			nil,
+		)
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	const expectedTrailer = "grpc-status: 13\r\n" +
+		"grpc-message: payment required\r\n"
+	requireTrailerFrame := func(frame []byte) {
+		require.Len(t, frame, 5+len(expectedTrailer))
+		require.EqualValues(t, 0x80, frame[0])
+		length := binary.BigEndian.Uint32(frame[1:5])
+		require.EqualValues(t, len(expectedTrailer), length)
+		require.Equal(t, expectedTrailer, string(frame[5:]))
+	}
+
+	// A binary gRPC-Web client gets the raw trailer frame.
+	const contentType = "application/grpc-web+proto"
+	rec := serve(contentType)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, contentType, rec.Header().Get("Content-Type"))
+	require.NotEmpty(t, rec.Header().Values("WWW-Authenticate"))
+	require.Contains(
+		t, rec.Header().Get("Access-Control-Expose-Headers"),
+		"WWW-Authenticate",
+	)
+	requireTrailerFrame(rec.Body.Bytes())
+
+	// A text gRPC-Web client gets it base64 encoded.
+	rec = serve("application/grpc-web-text")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotEmpty(t, rec.Header().Values("WWW-Authenticate"))
+	frame, err := base64.StdEncoding.DecodeString(rec.Body.String())
+	require.NoError(t, err)
+	requireTrailerFrame(frame)
+
+	// Native gRPC clients still get the status in the header fields.
+	rec = serve("application/grpc")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "13", rec.Header().Get("Grpc-Status"))
+	require.Empty(t, rec.Body.Bytes())
+}
+
+// TestProxyBlocklist makes sure requests from blocked IP addresses and subnets
+// are denied while all others are served.
+func TestProxyBlocklist(t *testing.T) {
+	localService := proxy.NewLocalService(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}), func(r *http.Request) bool {
+			return true
+		},
+	)
+
+	p, err := proxy.NewWithConfig(&proxy.Config{
+		Blocklist: []string{
+			"198.51.100.7", "192.0.2.0/24", "2001:db8::/32",
+			"not-an-ip",
+		},
+	}, auth.NewMockAuthenticator(), nil, localService)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		remoteAddr string
+		status     int
+	}{{
+		remoteAddr: "198.51.100.7:1234",
+		status:     http.StatusForbidden,
+	}, {
+		remoteAddr: "198.51.100.8:1234",
+		status:     http.StatusOK,
+	}, {
+		remoteAddr: "192.0.2.1:1234",
+		status:     http.StatusForbidden,
+	}, {
+		remoteAddr: "192.0.2.255:1234",
+		status:     http.StatusForbidden,
+	}, {
+		remoteAddr: "192.0.3.1:1234",
+		status:     http.StatusOK,
+	}, {
+		remoteAddr: "[2001:db8::1]:1234",
+		status:     http.StatusForbidden,
+	}, {
+		remoteAddr: "[2001:db9::1]:1234",
+		status:     http.StatusOK,
+	}}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "http://other.com/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		require.Equal(t, tc.status, rec.Code, tc.remoteAddr)
+	}
+}
+
+// TestProxyTrustedProxies makes sure the blocklist is applied to the real
+// client IP address reported by a trusted proxy, but can't be bypassed by
+// spoofing the header field.
+func TestProxyTrustedProxies(t *testing.T) {
+	localService := proxy.NewLocalService(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}), func(r *http.Request) bool {
+			return true
+		},
+	)
+
+	p, err := proxy.NewWithConfig(&proxy.Config{
+		TrustedProxies: []string{"10.0.0.0/8"},
+		Blocklist:      []string{"192.0.2.1"},
+	}, auth.NewMockAuthenticator(), nil, localService)
+	require.NoError(t, err)
+
+	serve := func(remoteAddr, forwardedFor string) int {
+		req := httptest.NewRequest("GET", "http://other.com/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	// A blocked client behind the trusted proxy is denied.
+	require.Equal(
+		t, http.StatusForbidden, serve("10.0.0.1:1234", "192.0.2.1"),
+	)
+	require.Equal(t, http.StatusOK, serve("10.0.0.1:1234", "192.0.2.2"))
+
+	// The blocked client can't hide behind a spoofed header when
+	// connecting directly.
+	require.Equal(
+		t, http.StatusForbidden, serve("192.0.2.1:1234", "192.0.2.2"),
+	)
+
+	// And it can't prepend an address to the header either.
+	require.Equal(
+		t, http.StatusForbidden,
+		serve("10.0.0.1:1234", "192.0.2.2, 192.0.2.1"),
+	)
+}
+
+// TestProxyConcurrentUpdateServices makes sure the services can be updated
+// while requests are being served. This test is most useful with the race
+// detector enabled.
+func TestProxyConcurrentUpdateServices(t *testing.T) {
+	newServices := func() []*proxy.Service {
+		return []*proxy.Service{{
+			Name:       "service1",
+			Address:    testTargetServiceAddress,
+			HostRegexp: "^service1.com$",
+			Protocol:   "http",
+			Auth:       "on",
+		}}
+	}
+	localService := proxy.NewLocalService(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}), func(r *http.Request) bool {
+			return true
+		},
+	)
+
+	p, err := proxy.New(
+		auth.NewMockAuthenticator(), newServices(), localService,
+	)
+	require.NoError(t, err)
+
+	const (
+		numClients  = 8
+		numRequests = 100
+		numUpdates  = 50
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < numClients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < numRequests; j++ {
+				host := "service1.com"
+				want := http.StatusPaymentRequired
+				if j%2 == 0 {
+					host, want = "other.com", http.StatusOK
+				}
+
+				req := httptest.NewRequest(
+					"GET", "http://"+host+"/", nil,
+				)
+				rec := httptest.NewRecorder()
+				p.ServeHTTP(rec, req)
+
+				if rec.Code != want {
+					t.Errorf("unexpected status %d for "+
+						"%s, wanted %d", rec.Code, host,
+						want)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < numUpdates; i++ {
+		require.NoError(t, p.UpdateServices(newServices()))
+	}
+
+	wg.Wait()
+	require.NoError(t, p.Close())
+}
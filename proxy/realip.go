@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// HeaderXForwardedFor is the header field that load balancers append
+	// the address of each hop to.
+	HeaderXForwardedFor = "X-Forwarded-For"
+
+	// HeaderXRealIP is the header field that some load balancers set to
+	// the address of the client.
+	HeaderXRealIP = "X-Real-Ip"
+)
+
+// RealIPResolver determines the real IP address of a client if aperture runs
+// behind trusted proxies such as load balancers.
+type RealIPResolver struct {
+	// trusted is the list of subnets of the trusted proxies.
+	trusted []*net.IPNet
+
+	// header is the canonical name of the header field that carries the
+	// real client IP address.
+	header string
+}
+
+// NewRealIPResolver creates a resolver that trusts the given proxies, which
+// can either be single IP addresses or subnets in CIDR notation, to report the
+// real client IP address in the given header field. If no header field is
+// given, X-Forwarded-For is used.
+func NewRealIPResolver(trustedProxies []string,
+	header string) (*RealIPResolver, error) {
+
+	if header == "" {
+		header = HeaderXForwardedFor
+	}
+
+	resolver := &RealIPResolver{
+		header: http.CanonicalHeaderKey(header),
+	}
+	for _, entry := range trustedProxies {
+		entry = strings.TrimSpace(entry)
+
+		// Single IP addresses are turned into a subnet containing only
+		// that address.
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			resolver.trusted = append(resolver.trusted, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(bits, bits),
+			})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q, must "+
+				"be an IP address or CIDR subnet", entry)
+		}
+		resolver.trusted = append(resolver.trusted, ipNet)
+	}
+
+	return resolver, nil
+}
+
+// isTrusted returns true if the given IP address belongs to a trusted proxy.
+func (r *RealIPResolver) isTrusted(ip net.IP) bool {
+	for _, ipNet := range r.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIP returns the real IP address of the client of a request that was
+// received from the given peer. The header field is only honored if the peer
+// is a trusted proxy, otherwise the peer's address is returned, so clients
+// can't spoof their address.
+func (r *RealIPResolver) ClientIP(peer net.IP, header http.Header) net.IP {
+	if !r.isTrusted(peer) {
+		return peer
+	}
+
+	values := header.Values(r.header)
+	if len(values) == 0 {
+		return peer
+	}
+
+	// Anything but X-Forwarded-For is expected to contain a single
+	// address.
+	if r.header != HeaderXForwardedFor {
+		ip := net.ParseIP(strings.TrimSpace(values[len(values)-1]))
+		if ip == nil {
+			return peer
+		}
+
+		return ip
+	}
+
+	// Each proxy appends the address it received the request from, so we
+	// walk the hops from right to left and skip over our trusted proxies.
+	// The first untrusted hop is the client. Everything to its left could
+	// have been forged by the client and is ignored.
+	var hops []string
+	for _, value := range values {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+
+	clientIP := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+
+		clientIP = ip
+		if !r.isTrusted(ip) {
+			break
+		}
+	}
+
+	return clientIP
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRealIPResolver makes sure the real client IP address is only taken from
+// the header fields of requests forwarded by trusted proxies.
+func TestRealIPResolver(t *testing.T) {
+	_, err := NewRealIPResolver([]string{"not-an-ip"}, "")
+	require.Error(t, err)
+
+	trusted := []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}
+	xff, err := NewRealIPResolver(trusted, "")
+	require.NoError(t, err)
+	xRealIP, err := NewRealIPResolver(trusted, "x-real-ip")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		resolver *RealIPResolver
+		peer     string
+		header   http.Header
+		clientIP string
+	}{{
+		name:     "untrusted peer, header ignored",
+		resolver: xff,
+		peer:     "198.51.100.1",
+		header: http.Header{
+			HeaderXForwardedFor: []string{"203.0.113.1"},
+		},
+		clientIP: "198.51.100.1",
+	}, {
+		name:     "trusted peer without header",
+		resolver: xff,
+		peer:     "10.1.2.3",
+		clientIP: "10.1.2.3",
+	}, {
+		name:     "trusted peer, single hop",
+		resolver: xff,
+		peer:     "10.1.2.3",
+		header: http.Header{
+			HeaderXForwardedFor: []string{"203.0.113.1"},
+		},
+		clientIP: "203.0.113.1",
+	}, {
+		name:     "trusted peer, spoofed hops are skipped",
+		resolver: xff,
+		peer:     "192.0.2.1",
+		header: http.Header{
+			HeaderXForwardedFor: []string{
+				"1.1.1.1, 203.0.113.1, 10.0.0.5",
+			},
+		},
+		clientIP: "203.0.113.1",
+	}, {
+		name:     "trusted peer, multiple header fields",
+		resolver: xff,
+		peer:     "10.1.2.3",
+		header: http.Header{
+			HeaderXForwardedFor: []string{
+				"1.1.1.1", "203.0.113.1, 10.0.0.5",
+			},
+		},
+		clientIP: "203.0.113.1",
+	}, {
+		name:     "trusted peer, ipv6",
+		resolver: xff,
+		peer:     "2001:db8::1",
+		header: http.Header{
+			HeaderXForwardedFor: []string{"2001:db9::1"},
+		},
+		clientIP: "2001:db9::1",
+	}, {
+		name:     "trusted peer, invalid hop",
+		resolver: xff,
+		peer:     "10.1.2.3",
+		header: http.Header{
+			HeaderXForwardedFor: []string{"203.0.113.1, foo"},
+		},
+		clientIP: "10.1.2.3",
+	}, {
+		name:     "trusted peer, all hops trusted",
+		resolver: xff,
+		peer:     "10.1.2.3",
+		header: http.Header{
+			HeaderXForwardedFor: []string{"10.0.0.1, 10.0.0.2"},
+		},
+		clientIP: "10.0.0.1",
+	}, {
+		name:     "x-real-ip from trusted peer",
+		resolver: xRealIP,
+		peer:     "10.1.2.3",
+		header: http.Header{
+			HeaderXRealIP:       []string{"203.0.113.1"},
+			HeaderXForwardedFor: []string{"1.1.1.1"},
+		},
+		clientIP: "203.0.113.1",
+	}, {
+		name:     "x-real-ip from untrusted peer",
+		resolver: xRealIP,
+		peer:     "198.51.100.1",
+		header: http.Header{
+			HeaderXRealIP: []string{"203.0.113.1"},
+		},
+		clientIP: "198.51.100.1",
+	}, {
+		name:     "invalid x-real-ip",
+		resolver: xRealIP,
+		peer:     "10.1.2.3",
+		header: http.Header{
+			HeaderXRealIP: []string{"foo"},
+		},
+		clientIP: "10.1.2.3",
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			clientIP := tc.resolver.ClientIP(
+				net.ParseIP(tc.peer), tc.header,
+			)
+			require.Equal(t, tc.clientIP, clientIP.String())
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultRetryBackoff is the time that is waited before the first
+	// retry of a failed backend request if the service doesn't configure
+	// a backoff. The time doubles with each further retry.
+	defaultRetryBackoff = 100 * time.Millisecond
+)
+
+// retryTransport is a round tripper that retries requests to services with
+// MaxRetries set if the backend couldn't be reached or closed the connection
+// before sending a response. Only requests without a body are retried, as the
+// body of the first attempt is consumed. Requests with a method that isn't
+// safe, such as POST, are only retried if the connection to the backend
+// couldn't be established at all.
+type retryTransport struct {
+	next http.RoundTripper
+}
+
+// A compile-time constraint to ensure retryTransport implements
+// http.RoundTripper.
+var _ http.RoundTripper = (*retryTransport)(nil)
+
+// RoundTrip sends the request and retries it with exponential backoff if it
+// failed and can be retried.
+//
+// NOTE: This is part of the http.RoundTripper interface.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+
+	service, ok := serviceFromContext(req.Context())
+	if !ok || service.MaxRetries == 0 ||
+		(req.Body != nil && req.Body != http.NoBody) {
+
+		return t.next.RoundTrip(req)
+	}
+
+	backoff := service.RetryBackoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	for attempt := 1; attempt <= service.MaxRetries; attempt++ {
+		if !retryable(req, err) {
+			break
+		}
+
+		log.Debugf("Request to backend %s of service %s failed, "+
+			"retrying in %v: %v", req.URL.Host, service.Name,
+			backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+
+		// A service with several backend instances may send the retry
+		// to another one.
+		retryReq := req.Clone(req.Context())
+		if service.backends != nil {
+			address := service.nextAddress()
+			retryReq.Host = address
+			retryReq.URL.Host = address
+		}
+
+		resp, err = t.next.RoundTrip(retryReq)
+	}
+
+	return resp, err
+}
+
+// retryable returns true if the given error of a request means it can be sent
+// again. The backend must not have sent a response yet and, unless the
+// connection couldn't be established at all, the request method must be safe,
+// as the backend might have processed the request already.
+func retryable(req *http.Request, err error) bool {
+	// Requests that are canceled by the client aren't retried.
+	if err == nil || req.Context().Err() != nil {
+		return false
+	}
+
+	if isDialError(err) {
+		return true
+	}
+
+	lostConnection := errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+
+	return lostConnection && isSafeMethod(req.Method)
+}
+
+// isSafeMethod returns true if requests with the given method only retrieve
+// data and can therefore be sent several times.
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodTrace:
+
+		return true
+
+	default:
+		return false
+	}
+}
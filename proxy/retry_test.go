@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRetryTransport makes sure requests are retried if the backend closes
+// the connection before responding, unless their method isn't safe or retries
+// are disabled.
+func TestRetryTransport(t *testing.T) {
+	// The backend drops the connection of every request until it's told
+	// to succeed. Connections are never reused, as the transport would
+	// retry requests on reused connections by itself.
+	var (
+		numRequests atomic.Int32
+		failures    atomic.Int32
+	)
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			numRequests.Add(1)
+			if failures.Add(-1) < 0 {
+				w.Header().Set("Connection", "close")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err == nil {
+				_ = conn.Close()
+			}
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:         "retry",
+		Address:      strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp:   "^retry.com$",
+		Protocol:     "http",
+		Auth:         "off",
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+	}, {
+		Name:       "noretry",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: "^noretry.com$",
+		Protocol:   "http",
+		Auth:       "off",
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	serve := func(method, host string, numFailures int32) (int, int32) {
+		numRequests.Store(0)
+		failures.Store(numFailures)
+
+		req := httptest.NewRequest(method, "http://"+host+"/", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec.Code, numRequests.Load()
+	}
+
+	// A GET request succeeds if the backend recovers within the retries.
+	code, attempts := serve(http.MethodGet, "retry.com", 2)
+	require.Equal(t, http.StatusOK, code)
+	require.EqualValues(t, 3, attempts)
+
+	// It fails once the retries are exhausted.
+	code, attempts = serve(http.MethodGet, "retry.com", 3)
+	require.Equal(t, http.StatusBadGateway, code)
+	require.EqualValues(t, 3, attempts)
+
+	// The backend might have processed a POST request already, so it
+	// isn't retried.
+	code, attempts = serve(http.MethodPost, "retry.com", 1)
+	require.Equal(t, http.StatusBadGateway, code)
+	require.EqualValues(t, 1, attempts)
+
+	// Without retries, the first failure is returned.
+	code, attempts = serve(http.MethodGet, "noretry.com", 1)
+	require.Equal(t, http.StatusBadGateway, code)
+	require.EqualValues(t, 1, attempts)
+}
+
+// TestRetryNextAddress makes sure a request that couldn't be sent to one
+// backend instance is retried with the next one, regardless of its method.
+func TestRetryNextAddress(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer backend.Close()
+
+	// We reserve an address nothing listens on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachable := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	services := []*Service{{
+		Name: "service",
+		Addresses: []BackendAddress{{
+			Address: unreachable,
+		}, {
+			Address: strings.TrimPrefix(backend.URL, "http://"),
+		}},
+		HostRegexp:   "^service.com$",
+		Protocol:     "http",
+		Auth:         "off",
+		MaxRetries:   1,
+		RetryBackoff: time.Millisecond,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	// The first request is sent to the unreachable instance first.
+	req := httptest.NewRequest(http.MethodPost, "http://service.com/", nil)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+}
@@ -7,7 +7,9 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/lightninglabs/aperture/auth"
@@ -29,6 +31,38 @@ const (
 	// maxServicePrice is the maximum price in satoshis that can be used
 	// to create an invoice through lnd.
 	maxServicePrice = btcutil.SatoshiPerBitcoin * 100000
+
+	// DefaultMaxInjectedHeaders is the default maximum number of header
+	// fields that are added to each request to a backend service.
+	DefaultMaxInjectedHeaders = 32
+
+	// TrailerFixAuto only copies the gRPC status header fields of a
+	// backend response into its trailers if the request was a gRPC
+	// request.
+	TrailerFixAuto = "auto"
+
+	// TrailerFixOn always copies the gRPC status header fields of a
+	// backend response into its trailers.
+	TrailerFixOn = "on"
+
+	// TrailerFixOff never copies the gRPC status header fields of a
+	// backend response into its trailers.
+	TrailerFixOff = "off"
+
+	// InvoiceStateSettled requires the invoice of an L402 to be settled
+	// before the token grants access to a service.
+	InvoiceStateSettled = "settled"
+
+	// InvoiceStateAccepted only requires the invoice of an L402 to be
+	// accepted (e.g. the HTLCs of a hold invoice are locked in) before the
+	// token grants access to a service.
+	InvoiceStateAccepted = "accepted"
+
+	// ProtocolWS connects to a WebSocket backend service over plain HTTP.
+	ProtocolWS = "ws"
+
+	// ProtocolWSS connects to a WebSocket backend service over HTTPS.
+	ProtocolWSS = "wss"
 )
 
 // Service generically specifies configuration data for backend services to the
@@ -40,11 +74,24 @@ type Service struct {
 	// TLSCertPath is the optional path to the service's TLS certificate.
 	TLSCertPath string `long:"tlscertpath" description:"Path to the service's TLS certificate"`
 
+	// InsecureSkipVerify disables the verification of the backend's TLS
+	// certificate against the one at TLSCertPath. Backends without a
+	// TLSCertPath are never verified.
+	InsecureSkipVerify bool `long:"insecureskipverify" description:"Don't verify the service's TLS certificate against the one at tlscertpath"`
+
 	// Address is the service's IP address and port.
 	Address string `long:"address" description:"service instance rpc address"`
 
+	// Addresses is an alternative to Address for services with several
+	// backend instances. Requests are distributed across the instances
+	// by their weights. An instance that can't be connected to isn't used
+	// for a short cooldown period.
+	Addresses []BackendAddress `long:"addresses" description:"The addresses and weights of several service instances to distribute requests across"`
+
 	// Protocol is the protocol that should be used to connect to the
-	// service. Currently supported is http and https.
+	// service. Currently supported is http and https, as well as ws and
+	// wss for WebSocket backends, which are reached over http and https
+	// respectively.
 	Protocol string `long:"protocol" description:"service instance protocol"`
 
 	// Auth is the authentication level required for this service to be
@@ -53,6 +100,21 @@ type Service struct {
 	// or "off" for no authentication.
 	Auth auth.Level `long:"auth" description:"required authentication"`
 
+	// FreebieByTokenID can be set to count the free requests that carry an
+	// L402 by its token ID as well as by IP address, so a client can't get
+	// additional free requests by changing its IP address.
+	FreebieByTokenID bool `long:"freebiebytokenid" description:"Count free requests by the token ID of their L402 as well as by IP address"`
+
+	// FreebieIPv4Prefix is the prefix length IPv4 addresses are masked
+	// with to count free requests, so all addresses of a network share
+	// the same free requests. If 0, freebie.DefaultIPv4Prefix is used.
+	FreebieIPv4Prefix int `long:"freebieipv4prefix" description:"The prefix length IPv4 addresses are masked with to count free requests, e.g. 24 to share the free requests within a /24 network (the default) or 32 to count each address separately"`
+
+	// FreebieIPv6Prefix is the prefix length IPv6 addresses are masked
+	// with to count free requests, so all addresses of a network share
+	// the same free requests. If 0, freebie.DefaultIPv6Prefix is used.
+	FreebieIPv6Prefix int `long:"freebieipv6prefix" description:"The prefix length IPv6 addresses are masked with to count free requests, e.g. 64 to share the free requests within a /64 network (the default) or 48 to pool them per site"`
+
 	// HostRegexp is a regular expression that is tested against the 'Host'
 	// HTTP header field to find out if this service should be used.
 	HostRegexp string `long:"hostregexp" description:"Regular expression to match the host against"`
@@ -72,21 +134,64 @@ type Service struct {
 	// the file is sent encoded as base64.
 	Headers map[string]string `long:"headers" description:"Header fields to always pass to the service"`
 
+	// ForwardTokenIdentity indicates that the token ID and payment hash of
+	// the L402 a request was authenticated with are passed to the backend
+	// service in the X-L402-Token-ID and X-L402-Payment-Hash header
+	// fields. The fields are removed from all other requests, so clients
+	// can't set them.
+	ForwardTokenIdentity bool `long:"forwardtokenidentity" description:"Pass the token ID and payment hash of the L402 a request was authenticated with to the backend in the X-L402-Token-ID and X-L402-Payment-Hash header fields"`
+
 	// Timeout is an optional value that indicates in how many seconds the
 	// service's caveat should time out relative to the time of creation. So
 	// if a value of 100 is set, then the timeout will be 100 seconds
 	// after creation of the L402.
 	Timeout int64 `long:"timeout" description:"An integer value that indicates the number of seconds until the service access expires"`
 
+	// TimeoutDuration is an optional alternative to Timeout that expresses
+	// the time the service access is valid for after creation of the L402
+	// as a duration, for example 720h. It is rounded down to full seconds.
+	// If both are set, TimeoutDuration takes precedence.
+	TimeoutDuration time.Duration `long:"timeoutduration" description:"The duration after which the service access expires, takes precedence over timeout"`
+
 	// Capabilities is the list of capabilities authorized for the service
 	// at the base tier.
 	Capabilities string `long:"capabilities" description:"A comma-separated list of the service capabilities authorized for the base tier"`
 
+	// DowngradeAfter is an optional value that indicates in how many
+	// seconds after the creation of an L402 its capabilities are
+	// downgraded to DowngradeCapabilities. Until then, all capabilities
+	// remain authorized. This is useful for promotional tokens that grant
+	// premium access for an initial period only.
+	DowngradeAfter int64 `long:"downgradeafter" description:"An integer value that indicates the number of seconds after which the service access is downgraded to the downgrade capabilities"`
+
+	// DowngradeCapabilities is the list of capabilities that remain
+	// authorized once the DowngradeAfter period has passed.
+	DowngradeCapabilities string `long:"downgradecapabilities" description:"A comma-separated list of the service capabilities authorized after the downgrade"`
+
+	// MeterCapabilities can be set to true to record each authorized
+	// request to the service as a Prometheus metric labeled with the
+	// capability that was accessed.
+	MeterCapabilities bool `long:"metercapabilities" description:"Record a metric for each capability of the service that is accessed"`
+
+	// LogCapabilities can be set to true to log the capability accessed by
+	// each authorized request to the service.
+	LogCapabilities bool `long:"logcapabilities" description:"Log each capability of the service that is accessed"`
+
 	// Constraints is the set of constraints that will take form of caveats.
 	// They'll be enforced for a service at the base tier. The key should
 	// correspond to the caveat's condition.
 	Constraints map[string]string `long:"constraints" description:"The service constraints to enforce at the base tier"`
 
+	// Label is an optional operator-defined label, such as a product or
+	// campaign ID, that is added to each L402 minted for the service. It
+	// allows grouping the issued L402s but doesn't restrict access.
+	Label string `long:"label" description:"An optional label, e.g. a product or campaign ID, that is added as a caveat to each token minted for the service"`
+
+	// Tiers are the optional higher tiers of the service that clients can
+	// ask for with the L402-Tier header field. Each grants its own
+	// capabilities and constraints at its own price.
+	Tiers []*Tier `long:"tiers" description:"Higher tiers of the service with their own price, capabilities and constraints"`
+
 	// Price is the custom L402 value in satoshis to be used for the
 	// service's endpoint.
 	Price int64 `long:"price" description:"Static L402 value in satoshis to be used for this service"`
@@ -95,6 +200,25 @@ type Service struct {
 	// the pricer if a gPRC server is to be used for price data.
 	DynamicPrice pricer.Config `long:"dynamicprice" description:"Configuration for connecting to the gRPC server to use for the pricer backend"`
 
+	// RulePrice holds the rules to price requests by their path or the
+	// size of their body without running a gRPC pricer server. Requests
+	// that match none of the rules are charged the static Price.
+	RulePrice pricer.RuleConfig `long:"ruleprice" description:"Rules to price requests by their path or body size"`
+
+	// FiatPrice holds the config options to price the service in a fiat
+	// currency, converted to satoshis with the exchange rate of a rate
+	// source. It takes precedence over the static Price and RulePrice.
+	FiatPrice pricer.FiatPriceConfig `long:"fiatprice" description:"Configuration for pricing the service in a fiat currency"`
+
+	// PriceIncrement is an optional increment in satoshis that all prices
+	// of the service, static or dynamic, are rounded to.
+	PriceIncrement int64 `long:"priceincrement" description:"Round all prices of this service to a multiple of this many satoshis"`
+
+	// PriceRounding is the direction in which prices are rounded to the
+	// PriceIncrement. Valid values are "nearest" (the default), "up" and
+	// "down".
+	PriceRounding string `long:"pricerounding" description:"The direction in which prices are rounded to the price increment" choice:"nearest" choice:"up" choice:"down"`
+
 	// AuthWhitelistPaths is an optional list of regular expressions that
 	// are matched against the path of the URL of a request. If the request
 	// URL matches any of those regular expressions, the call is treated as
@@ -103,8 +227,222 @@ type Service struct {
 	// /package_name.ServiceName/MethodName
 	AuthWhitelistPaths []string `long:"authwhitelistpaths" description:"List of regular expressions for paths that don't require authentication'"`
 
+	// TrailerFix defines whether the Grpc-Status and Grpc-Message header
+	// fields of a backend response should be copied into the trailers of
+	// the response if the backend didn't send any trailers. Valid values
+	// are "auto" (the default) to only apply the fix to gRPC requests,
+	// "on" to always apply it and "off" to never apply it.
+	TrailerFix string `long:"trailerfix" description:"Whether gRPC status headers should be copied into the response trailers" choice:"auto" choice:"on" choice:"off"`
+
+	// JSONChallenge defines whether 402 responses to non-gRPC clients
+	// should always contain a JSON body with the price, invoice and
+	// macaroon of the challenge. Clients can also ask for such a body by
+	// setting the Accept header field to application/json.
+	JSONChallenge bool `long:"jsonchallenge" description:"Always include the L402 challenge as JSON body in 402 responses to non-gRPC clients"`
+
+	// RetryAfter is an optional period that is advertised in the
+	// Retry-After header field of 402 responses, telling clients how long
+	// to wait before retrying the request with a paid L402. If zero, the
+	// header field isn't set.
+	RetryAfter time.Duration `long:"retryafter" description:"The period advertised in the Retry-After header of 402 responses after which the client should retry with a paid L402, 0 omits the header"`
+
+	// PaywallPage defines whether 402 responses to clients that accept
+	// HTML, such as browsers navigating to the service, should contain a
+	// page that shows the price and invoice of the challenge to the user.
+	PaywallPage bool `long:"paywallpage" description:"Send an HTML paywall page showing the price and invoice in 402 responses to clients that accept HTML"`
+
+	// MinInvoiceState is the minimum state the invoice of an L402 must have
+	// reached for the token to grant access to this service. Valid values
+	// are "settled" (the default) and "accepted". With "accepted", L402s
+	// with a zero preimage are accepted as well, since the payer of a hold
+	// invoice only learns the preimage once it's settled.
+	MinInvoiceState string `long:"mininvoicestate" description:"The minimum invoice state required for an L402 to be accepted" choice:"settled" choice:"accepted"`
+
+	// Authenticators is the optional list of names of the authenticators
+	// that can authenticate requests to this service. A request is
+	// accepted if any of them accepts it, and challenges are issued by the
+	// first one that can issue them. If none can, requests without valid
+	// credentials are denied. If empty, the proxy's default authenticator
+	// is used.
+	Authenticators []string `long:"authenticators" description:"The names of the authenticators that can authenticate requests to this service, the first one that can issues the challenges"`
+
+	// InvoiceMemo is the memo of the invoices created for this service.
+	// The placeholder {service} is replaced with the name of the service
+	// and {resource} with the requested path of services with dynamic
+	// prices. If empty, the memo is "L402".
+	InvoiceMemo string `long:"invoicememo" description:"The memo of invoices for this service, {service} and {resource} are replaced with the service name and the requested path"`
+
+	// InvoiceDescriptionHash defines whether the invoices created for this
+	// service commit to the SHA-256 hash of the LNURL-pay metadata of the
+	// memo instead of including the memo itself, as LNURL-pay wallets
+	// expect.
+	InvoiceDescriptionHash bool `long:"invoicedescriptionhash" description:"Include the SHA-256 hash of the LNURL-pay metadata of the memo in invoices for this service instead of the memo itself"`
+
+	// StaleIfError is an optional value that indicates for how many
+	// seconds the last successful response to a GET request is kept to be
+	// served in place of an error while the backend is unavailable. Only
+	// enable this for endpoints whose responses are the same for all
+	// clients, as stored responses are served to any authorized client.
+	StaleIfError int64 `long:"staleiferror" description:"The number of seconds a successful response to a GET request may be served stale while the backend is unavailable"`
+
+	// CacheTTL is an optional period for which successful responses to GET
+	// requests are cached and served to further authorized requests for
+	// the same resource without reaching the backend. Authentication is
+	// still enforced for each request. Only enable this for endpoints
+	// whose responses are the same for all clients and don't depend on
+	// the caller's identity, which is why it can't be combined with
+	// ForwardTokenIdentity. Responses the backend marks with
+	// Cache-Control: no-store or private or that carry a Vary header field
+	// are never cached.
+	CacheTTL time.Duration `long:"cachettl" description:"The period for which successful responses to GET requests are cached, 0 disables caching"`
+
+	// MaxRetries is the maximum number of times a request without a body
+	// is retried if the backend couldn't be reached or closed the
+	// connection before responding. Requests with a method other than
+	// GET, HEAD, OPTIONS and TRACE are only retried if the connection
+	// couldn't be established. Services with several addresses may send
+	// the retry to another backend instance.
+	MaxRetries int `long:"maxretries" description:"The maximum number of retries of a request without a body if the backend is unavailable"`
+
+	// RetryBackoff is the time that is waited before the first retry. It
+	// doubles with each further retry. If zero, 100ms are used.
+	RetryBackoff time.Duration `long:"retrybackoff" description:"The time to wait before the first retry, doubling with each further retry"`
+
+	// MaxConcurrentRequests is the maximum number of requests that are
+	// proxied to the backend concurrently. Excess requests are shed with a
+	// 503 response unless they can be queued. A value of zero means
+	// unlimited.
+	MaxConcurrentRequests int `long:"maxconcurrentrequests" description:"The maximum number of requests that are proxied to the backend concurrently. Set to 0 to disable."`
+
+	// MaxQueueLength is the maximum number of requests that wait for one
+	// of the MaxConcurrentRequests to finish. Queuing is only enabled if
+	// MaxQueueWait is set as well.
+	MaxQueueLength int `long:"maxqueuelength" description:"The maximum number of requests that wait for a free backend slot"`
+
+	// MaxQueueWait is the maximum time a queued request waits for a free
+	// slot before it is shed.
+	MaxQueueWait time.Duration `long:"maxqueuewait" description:"The maximum time a request waits for a free backend slot before it is rejected"`
+
+	// ReadTimeout overrides the server's read timeout for requests to the
+	// service. It is counted from the time the request is matched to the
+	// service, after its header was read. If zero, the server's read
+	// timeout applies.
+	ReadTimeout time.Duration `long:"readtimeout" description:"The maximum time to wait for the body of a request to the service to be read, overriding the global readtimeout"`
+
+	// WriteTimeout overrides the server's write timeout for requests to
+	// the service. It is counted from the time the request is matched to
+	// the service and must include the time the backend takes to respond.
+	// If zero, the server's write timeout applies.
+	WriteTimeout time.Duration `long:"writetimeout" description:"The maximum time to wait for a response of the service to be fully written, overriding the global writetimeout"`
+
 	freebieDB freebie.DB
 	pricer    pricer.Pricer
+
+	// authenticator authenticates requests to this service. It is only set
+	// if the service selects its authenticators.
+	authenticator auth.Authenticator
+
+	// headerNames are the names of the configured header fields in sorted
+	// order, so they are always added to backend requests in the same
+	// order.
+	headerNames []string
+
+	// backends is the pool of backend instances requests are sent to. It
+	// is only set if the service has several addresses.
+	backends *backendPool
+
+	// queue limits the number of concurrent requests to the backend. It is
+	// only set if MaxConcurrentRequests is.
+	queue *requestQueue
+}
+
+// nextAddress returns the address of the backend instance the next request to
+// the service should be sent to.
+func (s *Service) nextAddress() string {
+	if s.backends == nil {
+		return s.Address
+	}
+
+	return s.backends.next()
+}
+
+// applyTimeouts replaces the server's read and write deadlines of the request
+// that is written to the given writer with the ones of the service's timeouts,
+// if it configures any.
+func (s *Service) applyTimeouts(w http.ResponseWriter) error {
+	rc := http.NewResponseController(w)
+	now := time.Now()
+
+	if s.ReadTimeout > 0 {
+		err := rc.SetReadDeadline(now.Add(s.ReadTimeout))
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.WriteTimeout > 0 {
+		err := rc.SetWriteDeadline(now.Add(s.WriteTimeout))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// roundPrices wraps the given pricer so its prices are rounded to the service's
+// price increment, if one is configured.
+func (s *Service) roundPrices(p pricer.Pricer) pricer.Pricer {
+	if s.PriceIncrement == 0 {
+		return p
+	}
+
+	return pricer.NewRoundingPricer(
+		p, s.PriceIncrement,
+		pricer.RoundingMode(strings.ToLower(s.PriceRounding)),
+		maxServicePrice,
+	)
+}
+
+// TimeoutSeconds returns the number of seconds after creation an L402 for the
+// service expires, or zero if it doesn't expire. TimeoutDuration takes
+// precedence over Timeout.
+func (s *Service) TimeoutSeconds() int64 {
+	if s.TimeoutDuration > 0 {
+		return int64(s.TimeoutDuration / time.Second)
+	}
+
+	return s.Timeout
+}
+
+// RequestCapability returns the capability of the service the given request
+// accesses. The elements of the request path are matched against the
+// capabilities configured for the service, its tiers and its downgrade, so
+// only configured capabilities are ever returned. An empty string is returned
+// if no capability matches.
+func (s *Service) RequestCapability(r *http.Request) string {
+	capabilities := []string{s.Capabilities, s.DowngradeCapabilities}
+	for _, tier := range s.Tiers {
+		capabilities = append(capabilities, tier.Capabilities)
+	}
+
+	pathElements := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	for _, list := range capabilities {
+		for _, capability := range strings.Split(list, ",") {
+			capability = strings.TrimSpace(capability)
+			if capability == "" {
+				continue
+			}
+
+			for _, element := range pathElements {
+				if strings.EqualFold(element, capability) {
+					return capability
+				}
+			}
+		}
+	}
+
+	return ""
 }
 
 // ResourceName returns the string to be used to identify which resource a
@@ -136,15 +474,144 @@ func (s *Service) AuthRequired(r *http.Request) auth.Level {
 	return s.Auth
 }
 
+// backendScheme returns the URL scheme used to connect to the service's
+// backend. WebSocket connections are upgraded from HTTP(S) connections.
+func (s *Service) backendScheme() string {
+	switch strings.ToLower(s.Protocol) {
+	case ProtocolWS:
+		return "http"
+
+	case ProtocolWSS:
+		return "https"
+
+	default:
+		return s.Protocol
+	}
+}
+
+// fixTrailers returns true if the gRPC status header fields of a backend
+// response to the given request should be copied into the response trailers.
+func (s *Service) fixTrailers(r *http.Request) bool {
+	switch strings.ToLower(s.TrailerFix) {
+	case TrailerFixOn:
+		return true
+
+	case TrailerFixOff:
+		return false
+
+	default:
+		return isGRPCRequest(r)
+	}
+}
+
+// freebieOptions returns the options of the freebie store of the given
+// service.
+func freebieOptions(service *Service) ([]freebie.MemStoreOption, error) {
+	var opts []freebie.MemStoreOption
+	if service.FreebieByTokenID {
+		opts = append(opts, freebie.WithTokenIDKey())
+	}
+
+	switch {
+	case service.FreebieIPv4Prefix < 0 || service.FreebieIPv4Prefix > 32:
+		return nil, fmt.Errorf("invalid freebie IPv4 prefix length %d "+
+			"of service %s, must be between 0 and 32",
+			service.FreebieIPv4Prefix, service.Name)
+
+	case service.FreebieIPv4Prefix > 0:
+		opts = append(opts, freebie.WithIPv4Prefix(
+			service.FreebieIPv4Prefix,
+		))
+	}
+
+	switch {
+	case service.FreebieIPv6Prefix < 0 || service.FreebieIPv6Prefix > 128:
+		return nil, fmt.Errorf("invalid freebie IPv6 prefix length %d "+
+			"of service %s, must be between 0 and 128",
+			service.FreebieIPv6Prefix, service.Name)
+
+	case service.FreebieIPv6Prefix > 0:
+		opts = append(opts, freebie.WithIPv6Prefix(
+			service.FreebieIPv6Prefix,
+		))
+	}
+
+	return opts, nil
+}
+
+// sameFreebieSettings returns true if both services count free requests the
+// same way.
+func sameFreebieSettings(a, b *Service) bool {
+	return a.Auth.FreebieCount() == b.Auth.FreebieCount() &&
+		a.FreebieByTokenID == b.FreebieByTokenID &&
+		a.FreebieIPv4Prefix == b.FreebieIPv4Prefix &&
+		a.FreebieIPv6Prefix == b.FreebieIPv6Prefix
+}
+
+// carryOverFreebieDBs hands the freebie DBs of the previous services to the
+// new services with the same name and freebie settings. Otherwise reloading
+// the services would grant all clients their free requests again if they are
+// only counted in memory.
+func carryOverFreebieDBs(previous, services []*Service) {
+	byName := make(map[string]*Service, len(previous))
+	for _, service := range previous {
+		byName[service.Name] = service
+	}
+
+	for _, service := range services {
+		old, ok := byName[service.Name]
+		if !ok || old.freebieDB == nil || service.freebieDB == nil ||
+			!sameFreebieSettings(old, service) {
+
+			continue
+		}
+
+		service.freebieDB = old.freebieDB
+	}
+}
+
 // prepareServices prepares the backend service configurations to be used by the
-// proxy.
-func prepareServices(services []*Service) error {
+// proxy. No service may add more than the given number of header fields to
+// backend requests. The free requests of freebie services are counted in the
+// given store, or in memory if it is nil.
+func prepareServices(services []*Service, maxInjectedHeaders int,
+	freebieStore freebie.CounterStore) error {
+
 	for _, service := range services {
+		if len(service.Headers) > maxInjectedHeaders {
+			return fmt.Errorf("service %s adds %d header fields, "+
+				"exceeding the maximum of %d", service.Name,
+				len(service.Headers), maxInjectedHeaders)
+		}
+
+		service.headerNames = make([]string, 0, len(service.Headers))
+		for name := range service.Headers {
+			service.headerNames = append(service.headerNames, name)
+		}
+		sort.Strings(service.headerNames)
+
 		// Each freebie enabled service gets its own store.
 		if service.Auth.IsFreebie() {
-			service.freebieDB = freebie.NewMemIPMaskStore(
-				service.Auth.FreebieCount(),
+			opts, err := freebieOptions(service)
+			if err != nil {
+				return err
+			}
+
+			// The free requests are only counted in memory if
+			// there is no persistent store.
+			var (
+				count = service.Auth.FreebieCount()
+				db    freebie.DB
 			)
+			if freebieStore != nil {
+				db = freebie.NewPersistentIPMaskStore(
+					freebieStore, service.Name, count,
+					opts...,
+				)
+			} else {
+				db = freebie.NewMemIPMaskStore(count, opts...)
+			}
+			service.freebieDB = db
 		}
 
 		// Replace placeholders/directives in the header fields with the
@@ -184,6 +651,96 @@ func prepareServices(services []*Service) error {
 			}
 		}
 
+		if len(service.Addresses) > 0 {
+			if service.Address != "" {
+				return fmt.Errorf("service %s can't have both "+
+					"an address and addresses",
+					service.Name)
+			}
+
+			backends, err := newBackendPool(service.Addresses)
+			if err != nil {
+				return fmt.Errorf("invalid backend of service "+
+					"%s: %w", service.Name, err)
+			}
+			service.backends = backends
+		}
+
+		if err := validateTiers(service); err != nil {
+			return err
+		}
+
+		if service.MaxConcurrentRequests < 0 ||
+			service.MaxQueueLength < 0 || service.MaxQueueWait < 0 {
+
+			return fmt.Errorf("negative concurrency limits for "+
+				"service %s", service.Name)
+		}
+		if service.MaxConcurrentRequests > 0 {
+			service.queue = newRequestQueue(
+				service.MaxConcurrentRequests,
+				service.MaxQueueLength, service.MaxQueueWait,
+			)
+		}
+
+		if service.MaxRetries < 0 || service.RetryBackoff < 0 {
+			return fmt.Errorf("negative retry settings for "+
+				"service %s", service.Name)
+		}
+
+		if service.ReadTimeout < 0 || service.WriteTimeout < 0 {
+			return fmt.Errorf("negative timeouts for service %s",
+				service.Name)
+		}
+
+		// A timeout duration below one second would silently disable
+		// the expiry, as the timeout caveat only has second precision.
+		if service.TimeoutDuration < 0 ||
+			(service.TimeoutDuration > 0 &&
+				service.TimeoutDuration < time.Second) {
+
+			return fmt.Errorf("timeout duration of service %s "+
+				"must be at least one second", service.Name)
+		}
+
+		if service.RetryAfter < 0 {
+			return fmt.Errorf("negative retry after period for "+
+				"service %s", service.Name)
+		}
+
+		if service.CacheTTL < 0 {
+			return fmt.Errorf("negative cache TTL for service %s",
+				service.Name)
+		}
+
+		// Cached responses are served to every client, so they can't
+		// depend on the identity of the caller.
+		if service.CacheTTL > 0 && service.ForwardTokenIdentity {
+			return fmt.Errorf("service %s can't cache responses "+
+				"while forwarding the token identity",
+				service.Name)
+		}
+
+		if service.StaleIfError < 0 {
+			return fmt.Errorf("negative stale if error period for "+
+				"service %s", service.Name)
+		}
+
+		switch strings.ToLower(service.TrailerFix) {
+		case "", TrailerFixAuto, TrailerFixOn, TrailerFixOff:
+		default:
+			return fmt.Errorf("invalid trailer fix value %s for "+
+				"service %s", service.TrailerFix, service.Name)
+		}
+
+		switch strings.ToLower(service.MinInvoiceState) {
+		case "", InvoiceStateSettled, InvoiceStateAccepted:
+		default:
+			return fmt.Errorf("invalid minimum invoice state %s for "+
+				"service %s", service.MinInvoiceState,
+				service.Name)
+		}
+
 		// Make sure all whitelist regular expression entries actually
 		// compile so we run into an eventual panic during startup and
 		// not only when the request happens.
@@ -195,6 +752,25 @@ func prepareServices(services []*Service) error {
 			}
 		}
 
+		if service.PriceIncrement < 0 ||
+			service.PriceIncrement > maxServicePrice {
+
+			return fmt.Errorf("invalid price increment %d for "+
+				"service %s", service.PriceIncrement,
+				service.Name)
+		}
+
+		rounding := pricer.RoundingMode(
+			strings.ToLower(service.PriceRounding),
+		)
+		switch rounding {
+		case "", pricer.RoundNearest, pricer.RoundUp, pricer.RoundDown:
+		default:
+			return fmt.Errorf("invalid price rounding %s for "+
+				"service %s", service.PriceRounding,
+				service.Name)
+		}
+
 		// If dynamic prices are enabled then use the provided
 		// DynamicPrice options to initialise a gRPC backed
 		// pricer client.
@@ -207,7 +783,40 @@ func prepareServices(services []*Service) error {
 					"pricer: %v", err)
 			}
 
-			service.pricer = priceClient
+			service.pricer = service.roundPrices(priceClient)
+			continue
+		}
+
+		// If a fiat price is set, it is converted to satoshis with
+		// the current exchange rate of the configured rate source.
+		if service.FiatPrice.Enabled {
+			fiatPrice := &service.FiatPrice
+			if fiatPrice.RateURL == "" {
+				return fmt.Errorf("fiat price of service %s "+
+					"requires a rate URL", service.Name)
+			}
+
+			fiatCfg := &pricer.FiatConfig{
+				Source: pricer.NewHTTPRateSource(
+					fiatPrice.RateURL,
+				),
+				MaxRateAge: fiatPrice.MaxRateAge,
+				StalePolicy: pricer.StaleRatePolicy(
+					fiatPrice.StalePolicy,
+				),
+				FallbackRate:    fiatPrice.FallbackRate,
+				RefreshInterval: fiatPrice.RefreshInterval,
+			}
+			fiatPricer, err := pricer.NewFiatPricer(
+				fiatPrice.Amount, fiatCfg,
+			)
+			if err != nil {
+				return fmt.Errorf("error initializing fiat "+
+					"pricer of service %s: %v",
+					service.Name, err)
+			}
+
+			service.pricer = service.roundPrices(fiatPricer)
 			continue
 		}
 
@@ -228,9 +837,27 @@ func prepareServices(services []*Service) error {
 				"service %s", service.Name)
 		}
 
+		// If pricing rules are enabled, they determine the price of
+		// the requests they match, all others cost the static price.
+		if service.RulePrice.Enabled {
+			rulePricer, err := pricer.NewRuleBasedPricer(
+				&service.RulePrice, service.Price,
+			)
+			if err != nil {
+				return fmt.Errorf("error initializing rule "+
+					"based pricer of service %s: %v",
+					service.Name, err)
+			}
+
+			service.pricer = service.roundPrices(rulePricer)
+			continue
+		}
+
 		// Initialise a default pricer where all resources in a server
 		// are given the same price.
-		service.pricer = pricer.NewDefaultPricer(service.Price)
+		service.pricer = service.roundPrices(
+			pricer.NewDefaultPricer(service.Price),
+		)
 	}
 	return nil
 }
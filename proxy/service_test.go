@@ -0,0 +1,648 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/freebie"
+	"github.com/lightninglabs/aperture/l402"
+	"github.com/lightninglabs/aperture/pricer"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+// TestInjectedHeaders makes sure the number of header fields a service adds
+// to backend requests is bounded and that they are added in a deterministic
+// order.
+func TestInjectedHeaders(t *testing.T) {
+	newService := func(numHeaders int) *Service {
+		headers := make(map[string]string, numHeaders)
+		for i := 0; i < numHeaders; i++ {
+			headers[fmt.Sprintf("X-Header-%02d", i)] = "value"
+		}
+
+		return &Service{
+			Name:    "service",
+			Address: "127.0.0.1:1",
+			Headers: headers,
+		}
+	}
+
+	// Services with more header fields than allowed are rejected.
+	err := prepareServices([]*Service{newService(3)}, 2, nil)
+	require.ErrorContains(t, err, "exceeding the maximum of 2")
+
+	p, err := NewWithConfig(&Config{MaxInjectedHeaders: 2}, nil, nil)
+	require.NoError(t, err)
+	require.Error(t, p.UpdateServices([]*Service{newService(3)}))
+	require.NoError(t, p.UpdateServices([]*Service{newService(2)}))
+
+	// The default limit applies if none is configured.
+	p, err = New(nil, nil)
+	require.NoError(t, err)
+	err = p.UpdateServices(
+		[]*Service{newService(DefaultMaxInjectedHeaders + 1)},
+	)
+	require.Error(t, err)
+
+	// Header fields that map to the same canonical name are added in
+	// sorted order, regardless of the iteration order of the map.
+	service := newService(0)
+	service.Headers = map[string]string{
+		"x-value": "c",
+		"X-Value": "a",
+		"X-VALUE": "b",
+		"X-Other": "d",
+	}
+	require.NoError(t, prepareServices([]*Service{service}, 4, nil))
+
+	for i := 0; i < 10; i++ {
+		req, err := http.NewRequest("GET", "http://service.com/", nil)
+		require.NoError(t, err)
+		req = req.WithContext(context.WithValue(
+			req.Context(), serviceContextKey{}, service,
+		))
+
+		p.director(req)
+		require.Equal(t, []string{"b", "a", "c"}, req.Header["X-Value"])
+		require.Equal(t, []string{"d"}, req.Header["X-Other"])
+	}
+}
+
+// TestServiceTimeouts makes sure a service with a longer write timeout can
+// respond slower than the server's write timeout allows.
+func TestServiceTimeouts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(300 * time.Millisecond)
+			_, _ = w.Write([]byte("slow"))
+		},
+	))
+	defer backend.Close()
+
+	address := strings.TrimPrefix(backend.URL, "http://")
+	services := []*Service{{
+		Name:       "default",
+		Address:    address,
+		HostRegexp: "^default.com$",
+		Protocol:   "http",
+		Auth:       "off",
+	}, {
+		Name:         "slow",
+		Address:      address,
+		HostRegexp:   "^slow.com$",
+		Protocol:     "http",
+		Auth:         "off",
+		WriteTimeout: 5 * time.Second,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(p)
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	get := func(host string) (*http.Response, error) {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		require.NoError(t, err)
+		req.Host = host
+
+		// Each request gets its own connection, so the deadlines of
+		// one don't affect the other.
+		client := &http.Client{
+			Transport: &http.Transport{DisableKeepAlives: true},
+		}
+		return client.Do(req)
+	}
+
+	// The server's write timeout cuts off the response of the service
+	// without an override.
+	_, err = get("default.com")
+	require.Error(t, err)
+
+	resp, err := get("slow.com")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "slow", string(body))
+}
+
+// TestNegativeServiceTimeouts makes sure services with negative timeouts are
+// rejected.
+func TestNegativeServiceTimeouts(t *testing.T) {
+	_, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:        "negative",
+		Address:     "127.0.0.1:1",
+		HostRegexp:  "^negative.com$",
+		Protocol:    "http",
+		ReadTimeout: -time.Second,
+	}})
+	require.ErrorContains(t, err, "negative timeouts")
+}
+
+// TestServiceTimeoutDuration makes sure the timeout duration takes precedence
+// over the timeout in seconds and must be at least one second.
+func TestServiceTimeoutDuration(t *testing.T) {
+	service := &Service{Timeout: 60}
+	require.Equal(t, int64(60), service.TimeoutSeconds())
+
+	service.TimeoutDuration = 720 * time.Hour
+	require.Equal(t, int64(720*60*60), service.TimeoutSeconds())
+
+	_, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:            "short",
+		Address:         "127.0.0.1:1",
+		HostRegexp:      "^short.com$",
+		Protocol:        "http",
+		TimeoutDuration: 500 * time.Millisecond,
+	}})
+	require.ErrorContains(t, err, "must be at least one second")
+}
+
+// TestServiceAuthenticators makes sure services can select the authenticators
+// that apply to them and that unknown authenticators are rejected.
+func TestServiceAuthenticators(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	))
+	defer backend.Close()
+
+	apiKeyAuth, err := auth.NewAPIKeyAuthenticator("", []string{"key"})
+	require.NoError(t, err)
+	mockAuth := auth.NewMockAuthenticator()
+	cfg := &Config{
+		Authenticators: map[string]auth.Authenticator{
+			"l402":   mockAuth,
+			"apikey": apiKeyAuth,
+		},
+	}
+
+	address := strings.TrimPrefix(backend.URL, "http://")
+	newService := func(name string, authenticators ...string) *Service {
+		return &Service{
+			Name:           name,
+			Address:        address,
+			HostRegexp:     "^" + name + ".com$",
+			Protocol:       "http",
+			Auth:           "on",
+			Price:          10,
+			Authenticators: authenticators,
+		}
+	}
+	p, err := NewWithConfig(cfg, mockAuth, []*Service{
+		newService("default"), newService("keyed", "l402", "apikey"),
+		newService("internal", "apikey"),
+		newService("reordered", "apikey", "l402"),
+	})
+	require.NoError(t, err)
+
+	serve := func(host string, header http.Header) int {
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	apiKey := http.Header{auth.DefaultAPIKeyHeader: []string{"key"}}
+	token := http.Header{"Authorization": []string{"L402 token"}}
+
+	// The API key is only accepted by the service that selects the API key
+	// authenticator, L402s are accepted by both.
+	require.Equal(
+		t, http.StatusPaymentRequired, serve("default.com", apiKey),
+	)
+	require.Equal(t, http.StatusOK, serve("default.com", token))
+	require.Equal(t, http.StatusOK, serve("keyed.com", apiKey))
+	require.Equal(t, http.StatusOK, serve("keyed.com", token))
+
+	// Without credentials, the first authenticator that can issue a
+	// challenge does so. Services that only accept API keys deny the
+	// request instead.
+	require.Equal(t, http.StatusPaymentRequired, serve("keyed.com", nil))
+	require.Equal(
+		t, http.StatusPaymentRequired, serve("reordered.com", nil),
+	)
+	require.Equal(t, http.StatusUnauthorized, serve("internal.com", nil))
+	require.Equal(t, http.StatusOK, serve("internal.com", apiKey))
+
+	_, err = NewWithConfig(
+		cfg, mockAuth, []*Service{newService("unknown", "oauth")},
+	)
+	require.ErrorContains(t, err, "unknown authenticator oauth")
+}
+
+// TestFreebieIPPrefix makes sure services with invalid freebie prefix lengths
+// are rejected.
+func TestFreebieIPPrefix(t *testing.T) {
+	newService := func(ipv4Prefix, ipv6Prefix int) *Service {
+		return &Service{
+			Name:              "service",
+			Address:           "127.0.0.1:1",
+			Auth:              "freebie 1",
+			FreebieIPv4Prefix: ipv4Prefix,
+			FreebieIPv6Prefix: ipv6Prefix,
+		}
+	}
+
+	require.NoError(t, prepareServices(
+		[]*Service{newService(0, 0)}, 0, nil,
+	))
+	require.NoError(t, prepareServices(
+		[]*Service{newService(32, 128)}, 0, nil,
+	))
+
+	err := prepareServices([]*Service{newService(33, 0)}, 0, nil)
+	require.ErrorContains(t, err, "invalid freebie IPv4 prefix length")
+
+	err = prepareServices([]*Service{newService(0, -1)}, 0, nil)
+	require.ErrorContains(t, err, "invalid freebie IPv6 prefix length")
+}
+
+// TestRulePrice makes sure services with pricing rules price requests by the
+// rules and fall back to their static price.
+func TestRulePrice(t *testing.T) {
+	service := &Service{
+		Name:    "service",
+		Address: "127.0.0.1:1",
+		Price:   7,
+		RulePrice: pricer.RuleConfig{
+			Enabled: true,
+			Rules: []*pricer.Rule{{
+				PathRegexp: "^/premium$",
+				Price:      100,
+			}},
+		},
+	}
+	require.NoError(t, prepareServices([]*Service{service}, 0, nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/premium", nil)
+	price, err := service.pricer.GetPrice(context.Background(), req)
+	require.NoError(t, err)
+	require.EqualValues(t, 100, price)
+
+	req = httptest.NewRequest(http.MethodGet, "/other", nil)
+	price, err = service.pricer.GetPrice(context.Background(), req)
+	require.NoError(t, err)
+	require.EqualValues(t, 7, price)
+
+	service.RulePrice.Rules[0].PathRegexp = "("
+	err = prepareServices([]*Service{service}, 0, nil)
+	require.ErrorContains(t, err, "invalid path regexp")
+}
+
+// TestFiatPrice makes sure services with a fiat price convert it with the
+// bitcoin price of their rate source.
+func TestFiatPrice(t *testing.T) {
+	rates := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		_ *http.Request) {
+
+		_, _ = fmt.Fprintf(
+			w, `{"btc_price": 50000, "updated": %d}`,
+			time.Now().Unix(),
+		)
+	}))
+	defer rates.Close()
+
+	service := &Service{
+		Name:    "service",
+		Address: "127.0.0.1:1",
+		Price:   7,
+		FiatPrice: pricer.FiatPriceConfig{
+			Enabled:    true,
+			Amount:     0.5,
+			RateURL:    rates.URL,
+			MaxRateAge: time.Minute,
+		},
+	}
+	require.NoError(t, prepareServices([]*Service{service}, 0, nil))
+
+	// Half a unit at 50,000 units per bitcoin is worth 1,000 satoshis.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	price, err := service.pricer.GetPrice(context.Background(), req)
+	require.NoError(t, err)
+	require.EqualValues(t, 1000, price)
+
+	service.FiatPrice.RateURL = ""
+	err = prepareServices([]*Service{service}, 0, nil)
+	require.ErrorContains(t, err, "requires a rate URL")
+}
+
+// TestRulePriceUnknownBodySize makes sure requests to a service that charges
+// by the size of the request body are answered with a 411 if they don't
+// declare the size of their body.
+func TestRulePriceUnknownBodySize(t *testing.T) {
+	services := []*Service{{
+		Name:       "service",
+		Address:    "127.0.0.1:1",
+		HostRegexp: "^service.com$",
+		Auth:       "on",
+		RulePrice: pricer.RuleConfig{
+			Enabled: true,
+			Rules: []*pricer.Rule{{
+				Price:      1,
+				PricePerKB: 1,
+			}},
+		},
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(
+		http.MethodPost, "http://service.com/upload",
+		strings.NewReader("data"),
+	)
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusLengthRequired, rec.Code)
+
+	req.ContentLength = 4
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+}
+
+// identityAuthenticator is an authenticator that only accepts L402s with a
+// given identifier, which it reports as the identity of accepted requests.
+type identityAuthenticator struct {
+	auth.MockAuthenticator
+
+	id *l402.Identifier
+}
+
+// A compile-time constraint to ensure identityAuthenticator implements
+// auth.IdentityAuthenticator.
+var _ auth.IdentityAuthenticator = (*identityAuthenticator)(nil)
+
+// Accept returns whether or not the header carries an L402 with the expected
+// identifier.
+func (a *identityAuthenticator) Accept(header *http.Header, _ string) bool {
+	mac, _, err := l402.FromHeader(header)
+	if err != nil {
+		return false
+	}
+
+	id, err := l402.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return false
+	}
+
+	return *id == *a.id
+}
+
+// AcceptRequest returns whether or not the request carries an L402 with the
+// expected identifier.
+func (a *identityAuthenticator) AcceptRequest(r *http.Request,
+	serviceName string) bool {
+
+	return a.Accept(&r.Header, serviceName)
+}
+
+// AcceptRequestIdentity returns the expected identifier if the request carries
+// an L402 with it.
+func (a *identityAuthenticator) AcceptRequestIdentity(r *http.Request,
+	serviceName string) (*l402.Identifier, bool) {
+
+	if !a.Accept(&r.Header, serviceName) {
+		return nil, false
+	}
+
+	return a.id, true
+}
+
+// TestForwardTokenIdentity makes sure the identity of the L402 a request was
+// authenticated with is only forwarded to the backend if the authenticator
+// verified the L402 and that clients can't set it on their own.
+func TestForwardTokenIdentity(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprintf(
+				w, "%s/%s", r.Header.Get(hdrL402TokenID),
+				r.Header.Get(hdrL402PaymentHash),
+			)
+		},
+	))
+	defer backend.Close()
+
+	address := strings.TrimPrefix(backend.URL, "http://")
+	services := []*Service{{
+		Name:                 "auth",
+		Address:              address,
+		HostRegexp:           "^auth.com$",
+		Protocol:             "http",
+		Auth:                 "on",
+		ForwardTokenIdentity: true,
+	}, {
+		Name:                 "whitelisted",
+		Address:              address,
+		HostRegexp:           "^whitelisted.com$",
+		Protocol:             "http",
+		Auth:                 "off",
+		ForwardTokenIdentity: true,
+	}}
+
+	newMac := func(tokenID l402.TokenID) *macaroon.Macaroon {
+		var id bytes.Buffer
+		require.NoError(t, l402.EncodeIdentifier(&id, &l402.Identifier{
+			PaymentHash: testPreimage.Hash(),
+			TokenID:     tokenID,
+		}))
+		mac, err := macaroon.New(
+			[]byte("key"), id.Bytes(), "loc",
+			macaroon.LatestVersion,
+		)
+		require.NoError(t, err)
+
+		return mac
+	}
+	tokenID := l402.TokenID{1, 2, 3}
+	mac := newMac(tokenID)
+	forgedMac := newMac(l402.TokenID{4, 5, 6})
+
+	l402Auth := &identityAuthenticator{id: &l402.Identifier{
+		PaymentHash: testPreimage.Hash(),
+		TokenID:     tokenID,
+	}}
+	apiKeyAuth, err := auth.NewAPIKeyAuthenticator("", []string{"key"})
+	require.NoError(t, err)
+	authenticator, err := auth.NewCompositeAuthenticator(
+		l402Auth, apiKeyAuth,
+	)
+	require.NoError(t, err)
+
+	p, err := New(authenticator, services)
+	require.NoError(t, err)
+
+	serve := func(host string, mac *macaroon.Macaroon,
+		apiKey string) string {
+
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		require.NoError(t, l402.SetHeader(
+			&req.Header, mac, testPreimage,
+		))
+		if apiKey != "" {
+			req.Header.Set(auth.DefaultAPIKeyHeader, apiKey)
+		}
+		req.Header.Set(hdrL402TokenID, "spoofed")
+		req.Header.Set(hdrL402PaymentHash, "spoofed")
+
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		return rec.Body.String()
+	}
+
+	// The identity of a verified L402 is forwarded.
+	require.Equal(
+		t, tokenID.String()+"/"+testPreimage.Hash().String(),
+		serve("auth.com", mac, ""),
+	)
+
+	// Whitelisted requests aren't authenticated, so their L402 can't be
+	// trusted.
+	require.Equal(t, "/", serve("whitelisted.com", mac, ""))
+
+	// A request authenticated with an API key can carry a forged L402,
+	// which must not be forwarded as a trusted identity.
+	require.Equal(t, "/", serve("auth.com", forgedMac, "key"))
+}
+
+// closeTrackingPricer is a pricer that records whether it was closed.
+type closeTrackingPricer struct {
+	pricer.Pricer
+
+	closed atomic.Bool
+}
+
+// Close marks the pricer as closed.
+func (c *closeTrackingPricer) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+// TestUpdateServicesReleasesResources makes sure updating the services closes
+// the pricers and idle backend connections of the previous services.
+func TestUpdateServicesReleasesResources(t *testing.T) {
+	connClosed := make(chan struct{}, 1)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			select {
+			case connClosed <- struct{}{}:
+			default:
+			}
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	newServices := func() []*Service {
+		return []*Service{{
+			Name:       "service",
+			Address:    backend.Listener.Addr().String(),
+			HostRegexp: "^service.com$",
+			Protocol:   "http",
+			Auth:       "off",
+		}}
+	}
+
+	services := newServices()
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	oldPricer := &closeTrackingPricer{Pricer: services[0].pricer}
+	services[0].pricer = oldPricer
+
+	// Leave an idle connection to the backend behind.
+	req := httptest.NewRequest("GET", "http://service.com/", nil)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// The previous pricer is only closed after the grace period.
+	oldDelay := pricerCloseDelay
+	pricerCloseDelay = 100 * time.Millisecond
+	defer func() {
+		pricerCloseDelay = oldDelay
+	}()
+
+	require.NoError(t, p.UpdateServices(newServices()))
+	require.False(t, oldPricer.closed.Load())
+	require.Eventually(t, oldPricer.closed.Load, time.Second,
+		10*time.Millisecond)
+
+	select {
+	case <-connClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle backend connection wasn't closed")
+	}
+
+	require.NoError(t, p.Close())
+}
+
+// TestUpdateServicesKeepsFreebies makes sure the free requests counted in
+// memory survive a reload unless the freebie settings of the service change.
+func TestUpdateServicesKeepsFreebies(t *testing.T) {
+	newServices := func(level auth.Level) []*Service {
+		return []*Service{{
+			Name:       "service",
+			Address:    "127.0.0.1:1",
+			HostRegexp: "^service.com$",
+			Protocol:   "http",
+			Auth:       level,
+		}}
+	}
+
+	services := newServices("freebie 2")
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, p.Close())
+	}()
+
+	ip := net.ParseIP("10.0.0.1")
+	req := httptest.NewRequest("GET", "http://service.com/", nil)
+	_, err = services[0].freebieDB.TallyFreebie(req, ip)
+	require.NoError(t, err)
+
+	count := func() freebie.Count {
+		count, err := p.FreebieCount("service", ip)
+		require.NoError(t, err)
+
+		return count
+	}
+	require.EqualValues(t, 1, count())
+
+	// Reloading the same settings keeps the counted free requests.
+	require.NoError(t, p.UpdateServices(newServices("freebie 2")))
+	require.EqualValues(t, 1, count())
+
+	// Different settings start counting from scratch.
+	require.NoError(t, p.UpdateServices(newServices("freebie 3")))
+	require.Zero(t, count())
+}
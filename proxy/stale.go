@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxStaleBodySize is the maximum size of a response body that is
+	// kept to be served stale. Larger responses are passed through without
+	// being stored.
+	maxStaleBodySize = 1 << 20
+
+	// maxStaleResponses is the maximum number of responses that are kept
+	// to be served stale across all services.
+	maxStaleResponses = 1000
+
+	// hdrWarning is the header field that marks a response as stale.
+	hdrWarning = "Warning"
+
+	// staleWarning is the warning that is added to stale responses.
+	staleWarning = `111 - "Revalidation Failed"`
+)
+
+// staleResponse is a successful backend response that is kept to be served in
+// place of an error while the backend is unavailable.
+type staleResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+	stored     time.Time
+	expiry     time.Time
+}
+
+// response creates a new response to the given request from the stored one.
+// The response is marked as stale and its age is set.
+func (s *staleResponse) response(req *http.Request,
+	now time.Time) *http.Response {
+
+	header := s.header.Clone()
+	header.Add(hdrWarning, staleWarning)
+	header.Set("Age", strconv.Itoa(int(now.Sub(s.stored).Seconds())))
+
+	return &http.Response{
+		Status: fmt.Sprintf(
+			"%d %s", s.statusCode, http.StatusText(s.statusCode),
+		),
+		StatusCode:    s.statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(s.body)),
+		ContentLength: int64(len(s.body)),
+		Request:       req,
+	}
+}
+
+// staleTransport is a round tripper that keeps the last successful response to
+// each GET request of services that have StaleIfError set. If the backend of
+// such a service fails to respond or responds with a server error, the stored
+// response is returned instead, as long as it hasn't expired.
+type staleTransport struct {
+	next http.RoundTripper
+
+	mu        sync.Mutex
+	responses map[string]*staleResponse
+
+	now func() time.Time
+}
+
+// A compile-time constraint to ensure staleTransport implements
+// http.RoundTripper.
+var _ http.RoundTripper = (*staleTransport)(nil)
+
+// newStaleTransport creates a new stale response keeping round tripper that
+// sends requests through the given round tripper.
+func newStaleTransport(next http.RoundTripper) *staleTransport {
+	return &staleTransport{
+		next:      next,
+		responses: make(map[string]*staleResponse),
+		now:       time.Now,
+	}
+}
+
+// RoundTrip sends the request to the backend and either stores a successful
+// response or replaces a failure with a stored response.
+//
+// NOTE: This is part of the http.RoundTripper interface.
+func (t *staleTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+
+	service, ok := serviceFromContext(req.Context())
+	if !ok || service.StaleIfError == 0 || req.Method != http.MethodGet {
+		return t.next.RoundTrip(req)
+	}
+
+	// The backend instance isn't part of the key, so a response of one
+	// instance can stand in for another.
+	key := service.Name + " " + req.URL.RequestURI()
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.StatusCode < http.StatusInternalServerError {
+		if resp.StatusCode == http.StatusOK && storable(resp) {
+			period := time.Duration(service.StaleIfError) *
+				time.Second
+			t.store(key, resp, period)
+		}
+
+		return resp, nil
+	}
+
+	stale, ok := t.lookup(key)
+	if !ok {
+		return resp, err
+	}
+
+	if resp != nil {
+		_ = resp.Body.Close()
+	}
+	log.Debugf("Backend of service %s unavailable, serving stale "+
+		"response for %s", service.Name, req.URL.Path)
+
+	return stale.response(req, t.now()), nil
+}
+
+// storable returns true if the given response may be stored to be served
+// stale.
+func storable(resp *http.Response) bool {
+	for _, value := range resp.Header.Values("Cache-Control") {
+		if strings.Contains(strings.ToLower(value), "no-store") {
+			return false
+		}
+	}
+
+	// Event streams don't end, so they can't be read in full.
+	contentType := resp.Header.Get(hdrContentType)
+	return !strings.HasPrefix(contentType, "text/event-stream")
+}
+
+// store reads the body of the given response and keeps the response for the
+// given period. The body of the response is replaced, so it can still be read
+// by the caller. Responses that are too large aren't stored.
+func (t *staleTransport) store(key string, resp *http.Response,
+	period time.Duration) {
+
+	body, ok := readBody(resp, maxStaleBodySize)
+	if !ok {
+		return
+	}
+
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// If there's no more room, we make some by removing the expired
+	// responses. If that's not enough, the response isn't stored.
+	_, replace := t.responses[key]
+	if !replace && len(t.responses) >= maxStaleResponses {
+		for k, r := range t.responses {
+			if now.After(r.expiry) {
+				delete(t.responses, k)
+			}
+		}
+
+		if len(t.responses) >= maxStaleResponses {
+			return
+		}
+	}
+
+	t.responses[key] = &staleResponse{
+		statusCode: resp.StatusCode,
+		header:     resp.Header.Clone(),
+		body:       body,
+		stored:     now,
+		expiry:     now.Add(period),
+	}
+}
+
+// readBody reads the body of the given response if it isn't larger than the
+// given maximum size. The body of the response is replaced, so it can still be
+// read in full by the caller, even if it was too large to be returned.
+func readBody(resp *http.Response, maxSize int64) ([]byte, bool) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil || int64(len(body)) > maxSize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+
+		return nil, false
+	}
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	return body, true
+}
+
+// lookup returns the stored response for the given key if it hasn't expired.
+func (t *staleTransport) lookup(key string) (*staleResponse, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stale, ok := t.responses[key]
+	if !ok {
+		return nil, false
+	}
+
+	if t.now().After(stale.expiry) {
+		delete(t.responses, key)
+		return nil, false
+	}
+
+	return stale, true
+}
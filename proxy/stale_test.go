@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStaleIfError makes sure the last successful response is served while
+// the backend is down if the service has the option enabled, and that an error
+// is returned otherwise.
+func TestStaleIfError(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("hello " + r.URL.Path))
+		},
+	))
+
+	address := strings.TrimPrefix(backend.URL, "http://")
+	services := []*Service{{
+		Name:         "stale",
+		Address:      address,
+		HostRegexp:   "^stale.com$",
+		Protocol:     "http",
+		Auth:         "off",
+		StaleIfError: 60,
+	}, {
+		Name:       "fresh",
+		Address:    address,
+		HostRegexp: "^fresh.com$",
+		Protocol:   "http",
+		Auth:       "off",
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	serve := func(host, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+host+path, nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	for _, host := range []string{"stale.com", "fresh.com"} {
+		rec := serve(host, "/resource")
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "hello /resource", rec.Body.String())
+		require.Empty(t, rec.Header().Get(hdrWarning))
+	}
+
+	backend.Close()
+
+	// With the option enabled, the stored response is served and marked
+	// as stale.
+	rec := serve("stale.com", "/resource")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "hello /resource", rec.Body.String())
+	require.Equal(t, staleWarning, rec.Header().Get(hdrWarning))
+
+	// Resources that were never fetched can't be served stale.
+	rec = serve("stale.com", "/other")
+	require.Equal(t, http.StatusBadGateway, rec.Code)
+
+	// Without the option, the error is returned.
+	rec = serve("fresh.com", "/resource")
+	require.Equal(t, http.StatusBadGateway, rec.Code)
+}
+
+// TestStaleTransportExpiry makes sure stored responses are only served within
+// the configured period and that server errors are replaced as well.
+func TestStaleTransportExpiry(t *testing.T) {
+	next := &staticRoundTripper{}
+	transport := newStaleTransport(next)
+
+	now := time.Unix(1000, 0)
+	transport.now = func() time.Time {
+		return now
+	}
+
+	service := &Service{Name: "service", StaleIfError: 10}
+	roundTrip := func() (*http.Response, error) {
+		req := httptest.NewRequest("GET", "http://service.com/", nil)
+		ctx := context.WithValue(
+			context.Background(), serviceContextKey{}, service,
+		)
+
+		return transport.RoundTrip(req.WithContext(ctx))
+	}
+	newResponse := func(code int, header http.Header) *http.Response {
+		rec := httptest.NewRecorder()
+		for name, values := range header {
+			rec.Header()[name] = values
+		}
+		rec.WriteHeader(code)
+		_, _ = rec.WriteString("body")
+
+		return rec.Result()
+	}
+
+	// Responses that must not be stored aren't served stale.
+	next.resp = newResponse(http.StatusOK, http.Header{
+		"Cache-Control": []string{"no-store"},
+	})
+	_, err := roundTrip()
+	require.NoError(t, err)
+
+	next.resp, next.err = nil, errors.New("connection refused")
+	_, err = roundTrip()
+	require.Error(t, err)
+
+	// A stored response replaces server errors within the period.
+	next.resp, next.err = newResponse(http.StatusOK, nil), nil
+	_, err = roundTrip()
+	require.NoError(t, err)
+
+	now = now.Add(10 * time.Second)
+	next.resp = newResponse(http.StatusServiceUnavailable, nil)
+	resp, err := roundTrip()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "10", resp.Header.Get("Age"))
+
+	// Once the period is over, the error is passed on.
+	now = now.Add(time.Second)
+	resp, err = roundTrip()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net/http"
+)
+
+// staticFileService is a local service that serves the files of a directory.
+type staticFileService struct {
+	root       http.FileSystem
+	fileServer http.Handler
+}
+
+// A compile-time constraint to ensure staticFileService implements
+// LocalService.
+var _ LocalService = (*staticFileService)(nil)
+
+// NewStaticFileService creates a new local service that serves the files of
+// the given root directory. It only claims requests for paths that exist
+// under the root, so it can be registered alongside other local services and
+// requests for unknown paths are answered with a 404 by the proxy.
+func NewStaticFileService(root string) LocalService {
+	dir := http.Dir(root)
+
+	return &staticFileService{
+		root:       dir,
+		fileServer: http.FileServer(dir),
+	}
+}
+
+// ServeHTTP serves the requested file.
+//
+// NOTE: This is part of the http.Handler interface.
+func (s *staticFileService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.fileServer.ServeHTTP(w, r)
+}
+
+// IsHandling returns true if the requested path exists under the root
+// directory.
+//
+// NOTE: This is part of the LocalService interface.
+func (s *staticFileService) IsHandling(r *http.Request) bool {
+	f, err := s.root.Open(r.URL.Path)
+	if err != nil {
+		return false
+	}
+	_ = f.Close()
+
+	return true
+}
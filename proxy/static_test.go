@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStaticFileService makes sure the static file service only claims
+// requests for files that exist, so other local services can handle the rest
+// and unknown paths are answered with a 404.
+func TestStaticFileService(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(
+		filepath.Join(root, "index.html"), []byte("index"), 0600,
+	))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(root, "file.txt"), []byte("file"), 0600,
+	))
+
+	otherService := NewLocalService(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("other"))
+		}),
+		func(r *http.Request) bool {
+			return r.URL.Path == "/other"
+		},
+	)
+
+	p, err := New(
+		auth.NewMockAuthenticator(), nil,
+		NewStaticFileService(root), otherService,
+	)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/", http.StatusOK, "index"},
+		{"/file.txt", http.StatusOK, "file"},
+		{"/other", http.StatusOK, "other"},
+		{"/missing", http.StatusNotFound, "404 page not found\n"},
+		{"/../file.txt", http.StatusOK, "file"},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.URL.Path = tc.path
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		require.Equal(t, tc.code, rec.Code, tc.path)
+		require.Equal(t, tc.body, rec.Body.String(), tc.path)
+	}
+}
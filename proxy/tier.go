@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/l402"
+)
+
+const (
+	// hdrTier is the request header field a client uses to ask for an
+	// L402 of one of the service's higher tiers.
+	hdrTier = "L402-Tier"
+
+	// hdrTiers is the response header field of a 402 response that lists
+	// the tiers of the service and their prices.
+	hdrTiers = "L402-Tiers"
+
+	// baseTierName is the name of the base tier of each service.
+	baseTierName = "base"
+)
+
+var (
+	// errUnknownTier is returned if a client asks for a tier the service
+	// doesn't offer.
+	errUnknownTier = errors.New("unknown tier")
+)
+
+// Tier is a higher tier of a service that grants a different set of
+// capabilities and constraints than the base tier at its own price.
+type Tier struct {
+	// Name is the name of the tier that clients ask for in the L402-Tier
+	// header field.
+	Name string `long:"name" description:"The name of the tier"`
+
+	// Price is the price of an L402 of the tier in satoshis.
+	Price int64 `long:"price" description:"The L402 value in satoshis of the tier"`
+
+	// Capabilities is the list of capabilities authorized for the tier.
+	Capabilities string `long:"capabilities" description:"A comma-separated list of the service capabilities authorized for the tier"`
+
+	// Constraints is the set of constraints that will be added as caveats
+	// to L402s of the tier. The key should correspond to the caveat's
+	// condition.
+	Constraints map[string]string `long:"constraints" description:"The service constraints to enforce at the tier"`
+}
+
+// validateTiers makes sure the tiers of the given service have unique names
+// and positive prices.
+func validateTiers(service *Service) error {
+	// The base tier takes the first value of the tier type.
+	if len(service.Tiers) > math.MaxUint8 {
+		return fmt.Errorf("service %s has more than %d tiers",
+			service.Name, math.MaxUint8)
+	}
+
+	names := map[string]struct{}{baseTierName: {}}
+	for _, tier := range service.Tiers {
+		if _, ok := names[tier.Name]; ok || tier.Name == "" {
+			return fmt.Errorf("invalid or duplicate tier name "+
+				"%q for service %s", tier.Name, service.Name)
+		}
+		names[tier.Name] = struct{}{}
+
+		if tier.Price <= 0 {
+			return fmt.Errorf("tier %s of service %s must have a "+
+				"positive price", tier.Name, service.Name)
+		}
+	}
+
+	return nil
+}
+
+// requestedTier returns the tier the client asks for in the given request
+// along with its price. If the client doesn't ask for a tier, the base tier
+// with the given base price is returned.
+func (s *Service) requestedTier(r *http.Request,
+	basePrice int64) (l402.ServiceTier, int64, error) {
+
+	name := r.Header.Get(hdrTier)
+	if name == "" || name == baseTierName {
+		return l402.BaseTier, basePrice, nil
+	}
+
+	// Each higher tier is numbered by its position after the base tier.
+	for i, tier := range s.Tiers {
+		if tier.Name == name {
+			return l402.ServiceTier(i + 1), tier.Price, nil
+		}
+	}
+
+	return 0, 0, fmt.Errorf("%w %q", errUnknownTier, name)
+}
+
+// tiersHeader returns the value of the header field that advertises the tiers
+// of the service and their prices, starting with the base tier.
+func (s *Service) tiersHeader(basePrice int64) string {
+	tiers := make([]string, 0, len(s.Tiers)+1)
+	tiers = append(tiers, baseTierName+"="+strconv.FormatInt(basePrice, 10))
+	for _, tier := range s.Tiers {
+		tiers = append(
+			tiers, tier.Name+"="+strconv.FormatInt(tier.Price, 10),
+		)
+	}
+
+	return strings.Join(tiers, ", ")
+}
+
+// tierPrices maps the name of each tier of the service to its price, starting
+// with the base tier. It returns nil if the service has no higher tiers.
+func (s *Service) tierPrices(basePrice int64) map[string]int64 {
+	if len(s.Tiers) == 0 {
+		return nil
+	}
+
+	prices := map[string]int64{baseTierName: basePrice}
+	for _, tier := range s.Tiers {
+		prices[tier.Name] = tier.Price
+	}
+
+	return prices
+}
+
+// freshChallengeHeader returns a challenge for an L402 of the given tier of a
+// service from the authenticator of the service. Only authenticators that
+// support tiers can issue challenges for tiers other than the base tier.
+func (p *Proxy) freshChallengeHeader(service *Service, serviceName string,
+	tier l402.ServiceTier, price int64) (http.Header, error) {
+
+	authenticator := p.serviceAuthenticator(service)
+	if ta, ok := authenticator.(auth.TieredAuthenticator); ok {
+		return ta.FreshTierChallengeHeader(serviceName, tier, price)
+	}
+
+	if tier != l402.BaseTier {
+		return nil, fmt.Errorf("authenticator doesn't support tiers")
+	}
+
+	return authenticator.FreshChallengeHeader(serviceName, price)
+}
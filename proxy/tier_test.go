@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/l402"
+	"github.com/stretchr/testify/require"
+)
+
+// tieredAuthenticator is a mock authenticator that records the tier and price
+// of the last challenge it issued.
+type tieredAuthenticator struct {
+	auth.MockAuthenticator
+
+	tier  l402.ServiceTier
+	price int64
+}
+
+// FreshTierChallengeHeader records the tier and price and returns the mock
+// challenge.
+func (a *tieredAuthenticator) FreshTierChallengeHeader(serviceName string,
+	tier l402.ServiceTier, price int64) (http.Header, error) {
+
+	a.tier, a.price = tier, price
+	return a.FreshChallengeHeader(serviceName, price)
+}
+
+// TestServiceTiers makes sure clients can ask for a challenge of a higher tier
+// and that 402 responses advertise the tiers of a service.
+func TestServiceTiers(t *testing.T) {
+	services := []*Service{{
+		Name:       "tiered",
+		Address:    "127.0.0.1:1",
+		HostRegexp: "^tiered.com$",
+		Protocol:   "http",
+		Auth:       "on",
+		Price:      10,
+		Tiers: []*Tier{{
+			Name:         "premium",
+			Price:        100,
+			Capabilities: "add,multiply",
+		}, {
+			Name:  "enterprise",
+			Price: 1000,
+		}},
+	}}
+	authenticator := &tieredAuthenticator{}
+	p, err := New(authenticator, services)
+	require.NoError(t, err)
+
+	serve := func(tier string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://tiered.com/", nil)
+		req.Header.Set(hdrAccept, hdrTypeJSON)
+		if tier != "" {
+			req.Header.Set(hdrTier, tier)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	testCases := []struct {
+		tier          string
+		expectedTier  l402.ServiceTier
+		expectedPrice int64
+	}{{
+		expectedTier:  l402.BaseTier,
+		expectedPrice: 10,
+	}, {
+		tier:          "base",
+		expectedTier:  l402.BaseTier,
+		expectedPrice: 10,
+	}, {
+		tier:          "premium",
+		expectedTier:  1,
+		expectedPrice: 100,
+	}, {
+		tier:          "enterprise",
+		expectedTier:  2,
+		expectedPrice: 1000,
+	}}
+	for _, tc := range testCases {
+		rec := serve(tc.tier)
+		require.Equal(t, http.StatusPaymentRequired, rec.Code)
+		require.Equal(t, tc.expectedTier, authenticator.tier)
+		require.Equal(t, tc.expectedPrice, authenticator.price)
+
+		// All tiers are advertised, no matter which one was asked for.
+		require.Equal(
+			t, "base=10, premium=100, enterprise=1000",
+			rec.Header().Get(hdrTiers),
+		)
+
+		var body paymentRequiredBody
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		require.Equal(t, tc.expectedPrice, body.PriceSat)
+		require.Equal(t, map[string]int64{
+			"base": 10, "premium": 100, "enterprise": 1000,
+		}, body.Tiers)
+	}
+
+	// An unknown tier is rejected.
+	rec := serve("platinum")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "unknown tier")
+
+	// Authenticators without tier support only serve the base tier.
+	p, err = New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusPaymentRequired, serve("").Code)
+	require.Equal(
+		t, http.StatusInternalServerError, serve("premium").Code,
+	)
+}
+
+// TestValidateTiers makes sure invalid tiers are rejected.
+func TestValidateTiers(t *testing.T) {
+	testCases := []struct {
+		name  string
+		tiers []*Tier
+		valid bool
+	}{{
+		name:  "no tiers",
+		valid: true,
+	}, {
+		name:  "valid tiers",
+		tiers: []*Tier{{Name: "a", Price: 1}, {Name: "b", Price: 2}},
+		valid: true,
+	}, {
+		name:  "empty name",
+		tiers: []*Tier{{Price: 1}},
+	}, {
+		name:  "base name",
+		tiers: []*Tier{{Name: "base", Price: 1}},
+	}, {
+		name:  "duplicate name",
+		tiers: []*Tier{{Name: "a", Price: 1}, {Name: "a", Price: 2}},
+	}, {
+		name:  "zero price",
+		tiers: []*Tier{{Name: "a"}},
+	}}
+
+	for _, tc := range testCases {
+		err := validateTiers(&Service{Name: "svc", Tiers: tc.tiers})
+		if tc.valid {
+			require.NoError(t, err, tc.name)
+		} else {
+			require.Error(t, err, tc.name)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// staticRoundTripper is a round tripper that always returns the same response
+// or error.
+type staticRoundTripper struct {
+	resp *http.Response
+	err  error
+}
+
+// RoundTrip returns the static response or error.
+func (s *staticRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return s.resp, s.err
+}
+
+// TestTrailerFixingTransport makes sure the gRPC status header fields are only
+// copied into the trailers for the backends that are configured for it.
+func TestTrailerFixingTransport(t *testing.T) {
+	testCases := []struct {
+		name         string
+		trailerFix   string
+		contentType  string
+		wantTrailers bool
+	}{{
+		name:         "http backend with coincidental grpc status",
+		contentType:  "application/json",
+		wantTrailers: false,
+	}, {
+		name:         "grpc backend",
+		contentType:  hdrTypeGrpc,
+		wantTrailers: true,
+	}, {
+		name:         "http backend forced on",
+		trailerFix:   TrailerFixOn,
+		contentType:  "application/json",
+		wantTrailers: true,
+	}, {
+		name:         "grpc backend forced off",
+		trailerFix:   TrailerFixOff,
+		contentType:  hdrTypeGrpc,
+		wantTrailers: false,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{
+				Header: http.Header{
+					hdrGrpcStatus:  []string{"0"},
+					hdrGrpcMessage: []string{"ok"},
+				},
+			}
+			transport := &trailerFixingTransport{
+				next: &staticRoundTripper{resp: resp},
+			}
+
+			service := &Service{TrailerFix: tc.trailerFix}
+			ctx := context.WithValue(
+				context.Background(), serviceContextKey{},
+				service,
+			)
+			req, err := http.NewRequestWithContext(
+				ctx, "POST", "http://localhost/test", nil,
+			)
+			require.NoError(t, err)
+			req.Header.Set(hdrContentType, tc.contentType)
+
+			resp, err = transport.RoundTrip(req)
+			require.NoError(t, err)
+
+			if !tc.wantTrailers {
+				require.Empty(t, resp.Trailer)
+				return
+			}
+
+			require.Equal(t, "0", resp.Trailer.Get(hdrGrpcStatus))
+			require.Equal(t, "ok", resp.Trailer.Get(hdrGrpcMessage))
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// serviceTransport is a round tripper that sends each request through the
+// transport of the backend service it is destined for, so each service can
+// have its own TLS settings.
+type serviceTransport struct {
+	// transports holds the transport of each backend service.
+	transports map[*Service]*http.Transport
+
+	// fallback is used for requests that aren't attributed to a backend
+	// service.
+	fallback *http.Transport
+
+	// dialer is used to connect to the backends of WebSocket connections.
+	dialer *net.Dialer
+}
+
+// A compile-time constraint to ensure serviceTransport implements
+// http.RoundTripper.
+var _ http.RoundTripper = (*serviceTransport)(nil)
+
+// newServiceTransport creates a transport for each of the given backend
+// services. If a service has a TLS certificate configured, its backend
+// certificate is verified against it, unless the service explicitly opts out
+// of verification. The given dialer is used for all connections if it is set.
+func newServiceTransport(services []*Service,
+	dialer *net.Dialer) (*serviceTransport, error) {
+
+	newTransport := func(tlsConfig *tls.Config) *http.Transport {
+		transport := &http.Transport{
+			ForceAttemptHTTP2: true,
+			TLSClientConfig:   tlsConfig,
+		}
+		if dialer != nil {
+			transport.DialContext = dialer.DialContext
+		}
+
+		return transport
+	}
+
+	// Backends without a TLS certificate configured aren't verified, as
+	// that has always been the behavior for them.
+	st := &serviceTransport{
+		transports: make(map[*Service]*http.Transport, len(services)),
+		fallback: newTransport(&tls.Config{
+			InsecureSkipVerify: true,
+		}),
+		dialer: dialer,
+	}
+	if st.dialer == nil {
+		st.dialer = &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+	}
+	for _, service := range services {
+		if service.TLSCertPath == "" {
+			st.transports[service] = st.fallback
+			continue
+		}
+
+		certPool, err := certPool(service)
+		if err != nil {
+			return nil, err
+		}
+
+		if service.InsecureSkipVerify {
+			log.Warnf("TLS certificate verification disabled for "+
+				"service %s", service.Name)
+		}
+
+		st.transports[service] = newTransport(&tls.Config{
+			RootCAs:            certPool,
+			InsecureSkipVerify: service.InsecureSkipVerify,
+		})
+	}
+
+	return st, nil
+}
+
+// RoundTrip sends the request through the transport of the backend service it
+// is destined for.
+//
+// NOTE: This is part of the http.RoundTripper interface.
+func (s *serviceTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+
+	service, ok := serviceFromContext(req.Context())
+	if !ok {
+		return s.fallback.RoundTrip(req)
+	}
+
+	transport, ok := s.transports[service]
+	if !ok {
+		transport = s.fallback
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if isDialError(err) && service.backends != nil {
+		service.backends.markDown(req.URL.Host)
+	}
+
+	return resp, err
+}
+
+// closeIdleConnections closes the idle connections of the transports of all
+// backend services. Connections that are in use are left alone.
+func (s *serviceTransport) closeIdleConnections() {
+	s.fallback.CloseIdleConnections()
+	for _, transport := range s.transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// dialBackend opens a connection to the backend of the given service at the
+// given address, which is used for WebSocket connections that can't be sent
+// through the transport. If useTLS is set, the TLS settings of the service are
+// applied.
+func (s *serviceTransport) dialBackend(ctx context.Context, service *Service,
+	addr string, useTLS bool) (net.Conn, error) {
+
+	conn, err := s.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil && service.backends != nil {
+		service.backends.markDown(addr)
+	}
+	if err != nil || !useTLS {
+		return conn, err
+	}
+
+	transport, ok := s.transports[service]
+	if !ok {
+		transport = s.fallback
+	}
+
+	// The connection is upgraded from HTTP/1.1, so we must not negotiate
+	// HTTP/2.
+	tlsConfig := transport.TLSClientConfig.Clone()
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		tlsConfig.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// certPool builds a pool of x509 certificates from the TLS certificate of the
+// given backend service.
+func certPool(service *Service) (*x509.CertPool, error) {
+	b, err := os.ReadFile(service.TLSCertPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := x509.NewCertPool()
+	if !cp.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("credentials: failed to append "+
+			"certificate of service %s", service.Name)
+	}
+
+	return cp, nil
+}
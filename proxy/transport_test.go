@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightningnetwork/lnd/cert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestServiceTransportTLSVerification makes sure the backend certificate of a
+// service is verified against its configured certificate, unless the service
+// opts out of verification.
+func TestServiceTransportTLSVerification(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	defer backend.Close()
+
+	tempDir := t.TempDir()
+
+	// Write the backend's actual certificate to a file.
+	backendCertPath := filepath.Join(tempDir, "backend.cert")
+	backendCert := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: backend.Certificate().Raw,
+	})
+	require.NoError(t, os.WriteFile(backendCertPath, backendCert, 0600))
+
+	// And an unrelated certificate to another one.
+	otherCertPath := filepath.Join(tempDir, "other.cert")
+	otherKeyPath := filepath.Join(tempDir, "other.key")
+	certBytes, keyBytes, err := cert.GenCertPair(
+		"aperture test", nil, nil, false, time.Hour,
+	)
+	require.NoError(t, err)
+	require.NoError(t, cert.WriteCertPair(
+		otherCertPath, otherKeyPath, certBytes, keyBytes,
+	))
+
+	backendAddr := strings.TrimPrefix(backend.URL, "https://")
+	newService := func(name, certPath string,
+		skipVerify bool) *Service {
+
+		return &Service{
+			Name:               name,
+			Address:            backendAddr,
+			HostRegexp:         "^" + name + ".com$",
+			Protocol:           "https",
+			Auth:               "off",
+			TLSCertPath:        certPath,
+			InsecureSkipVerify: skipVerify,
+		}
+	}
+	services := []*Service{
+		newService("verified", backendCertPath, false),
+		newService("mismatch", otherCertPath, false),
+		newService("skipverify", otherCertPath, true),
+		newService("nocert", "", false),
+	}
+
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		host   string
+		status int
+	}{{
+		host:   "verified.com",
+		status: http.StatusOK,
+	}, {
+		host:   "mismatch.com",
+		status: http.StatusBadGateway,
+	}, {
+		host:   "skipverify.com",
+		status: http.StatusOK,
+	}, {
+		host:   "nocert.com",
+		status: http.StatusOK,
+	}}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "http://"+tc.host+"/", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		require.Equal(t, tc.status, rec.Code, tc.host)
+
+		// The CORS headers are still added to proxied responses.
+		if tc.status == http.StatusOK {
+			require.Equal(
+				t, "*",
+				rec.Header().Get("Access-Control-Allow-Origin"),
+			)
+		}
+	}
+
+	// A service with an invalid certificate file is rejected.
+	_, err = New(auth.NewMockAuthenticator(), []*Service{
+		newService("invalid", filepath.Join(tempDir, "missing"), false),
+	})
+	require.Error(t, err)
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	hdrConnection = "Connection"
+	hdrUpgrade    = "Upgrade"
+)
+
+// isWebSocketRequest returns true if the client asks to upgrade its connection
+// to the WebSocket protocol.
+func isWebSocketRequest(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get(hdrUpgrade), "websocket") {
+		return false
+	}
+
+	for _, value := range r.Header.Values(hdrConnection) {
+		for _, token := range strings.Split(value, ",") {
+			token = strings.TrimSpace(token)
+			if strings.EqualFold(token, "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// serveWebSocket forwards a WebSocket upgrade request to the backend of the
+// target service. If the backend switches protocols, the client connection is
+// taken over and the bytes are piped between client and backend until either
+// side closes its connection. Any other response of the backend is passed on
+// to the client as is.
+func (p *Proxy) serveWebSocket(w http.ResponseWriter, r *http.Request,
+	target *Service, transport *serviceTransport, prefixLog *PrefixLog) {
+
+	outReq := r.Clone(r.Context())
+	p.director(outReq)
+
+	addr := outReq.URL.Host
+	useTLS := outReq.URL.Scheme == "https"
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "80"
+		if useTLS {
+			port = "443"
+		}
+		addr = net.JoinHostPort(addr, port)
+	}
+
+	backendConn, err := transport.dialBackend(
+		r.Context(), target, addr, useTLS,
+	)
+	if err != nil {
+		prefixLog.Errorf("Unable to connect to WebSocket backend: %v",
+			err)
+		p.addCorsHeaders(w.Header(), r)
+		sendDirectResponse(w, r, http.StatusBadGateway, "bad gateway")
+		return
+	}
+	defer backendConn.Close()
+
+	backendReader := bufio.NewReader(backendConn)
+	resp, err := forwardUpgradeRequest(outReq, backendConn, backendReader)
+	if err != nil {
+		prefixLog.Errorf("WebSocket upgrade with backend failed: %v",
+			err)
+		p.addCorsHeaders(w.Header(), r)
+		sendDirectResponse(w, r, http.StatusBadGateway, "bad gateway")
+		return
+	}
+	defer resp.Body.Close()
+
+	// If the backend refused to switch protocols, its answer is passed on
+	// like any other response.
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		for name, values := range resp.Header {
+			w.Header()[name] = values
+		}
+		p.addCorsHeaders(w.Header(), r)
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+
+	clientConn, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		prefixLog.Errorf("Unable to take over WebSocket client "+
+			"connection: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError, "upgrade failure",
+		)
+		return
+	}
+	defer clientConn.Close()
+
+	// The server's read and write timeouts would otherwise cut off the
+	// long-lived connection.
+	if err := clientConn.SetDeadline(time.Time{}); err != nil {
+		prefixLog.Errorf("Unable to clear WebSocket deadline: %v", err)
+		return
+	}
+
+	_, err = fmt.Fprintf(clientBuf, "HTTP/1.1 %d %s\r\n",
+		resp.StatusCode, http.StatusText(resp.StatusCode))
+	if err == nil {
+		err = resp.Header.Write(clientBuf)
+	}
+	if err == nil {
+		_, err = clientBuf.WriteString("\r\n")
+	}
+	if err == nil {
+		err = clientBuf.Flush()
+	}
+	if err != nil {
+		prefixLog.Errorf("Unable to send WebSocket upgrade: %v", err)
+		return
+	}
+
+	// Any data that was already read into the buffers belongs to the
+	// WebSocket stream, so we pipe from the buffered readers. Once either
+	// direction is done, closing both connections ends the other one.
+	errChan := make(chan error, 2)
+	go pipe(backendConn, clientBuf.Reader, errChan)
+	go pipe(clientConn, backendReader, errChan)
+
+	if err := <-errChan; err != nil {
+		prefixLog.Debugf("WebSocket connection closed: %v", err)
+	}
+}
+
+// forwardUpgradeRequest sends the given upgrade request to the backend and
+// reads its response.
+func forwardUpgradeRequest(req *http.Request, backendConn net.Conn,
+	backendReader *bufio.Reader) (*http.Response, error) {
+
+	if err := req.Write(backendConn); err != nil {
+		return nil, err
+	}
+
+	return http.ReadResponse(backendReader, req)
+}
+
+// pipe copies all data from the reader to the writer and reports the result
+// on the given channel.
+func pipe(dst io.Writer, src io.Reader, errChan chan<- error) {
+	_, err := io.Copy(dst, src)
+	errChan <- err
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestIsWebSocketRequest makes sure WebSocket upgrade requests are detected.
+func TestIsWebSocketRequest(t *testing.T) {
+	testCases := []struct {
+		connection string
+		upgrade    string
+		expected   bool
+	}{{
+		connection: "Upgrade",
+		upgrade:    "websocket",
+		expected:   true,
+	}, {
+		connection: "keep-alive, upgrade",
+		upgrade:    "WebSocket",
+		expected:   true,
+	}, {
+		connection: "keep-alive",
+		upgrade:    "websocket",
+	}, {
+		connection: "Upgrade",
+		upgrade:    "h2c",
+	}, {
+		connection: "Upgrade",
+	}}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "http://service.com/", nil)
+		req.Header.Set("Connection", tc.connection)
+		req.Header.Set("Upgrade", tc.upgrade)
+
+		require.Equal(t, tc.expected, isWebSocketRequest(req), tc)
+	}
+}
+
+// TestProxyWebSocket makes sure authenticated WebSocket connections are piped
+// to the backend, while unauthenticated ones get a payment challenge.
+func TestProxyWebSocket(t *testing.T) {
+	// The backend switches protocols and then echoes everything it
+	// receives.
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if !isWebSocketRequest(r) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			conn, buf, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			_, _ = buf.WriteString("HTTP/1.1 101 Switching " +
+				"Protocols\r\nUpgrade: websocket\r\n" +
+				"Connection: Upgrade\r\n\r\n")
+			_ = buf.Flush()
+			_, _ = io.Copy(conn, buf)
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:       "websocket",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: "^service.com$",
+		Protocol:   ProtocolWS,
+		Auth:       "on",
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	// upgrade opens a connection to the proxy and sends an upgrade request
+	// with the given extra header lines.
+	upgrade := func(extraHeader string) (net.Conn, *bufio.Reader,
+		*http.Response) {
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte("GET /socket HTTP/1.1\r\n" +
+			"Host: service.com\r\nUpgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" + extraHeader + "\r\n"))
+		require.NoError(t, err)
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+
+		return conn, reader, resp
+	}
+
+	// Without authentication, the client gets a payment challenge.
+	conn, _, resp := upgrade("")
+	require.Equal(t, http.StatusPaymentRequired, resp.StatusCode)
+	require.NotEmpty(t, resp.Header.Values("WWW-Authenticate"))
+	conn.Close()
+
+	// With authentication, the connection is upgraded and the data is
+	// piped to the backend and back.
+	conn, reader, resp := upgrade("Authorization: L402 foo:bar\r\n")
+	defer conn.Close()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	require.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	echo := make([]byte, len("hello"))
+	_, err = io.ReadFull(reader, echo)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(echo))
+}
@@ -0,0 +1,368 @@
+package aperture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyProtocolHeaderTimeout is the maximum time a trusted upstream
+	// has to send the PROXY protocol header of a new connection.
+	proxyProtocolHeaderTimeout = 5 * time.Second
+
+	// proxyProtocolV1MaxLen is the maximum length of a version 1 header,
+	// including the trailing CRLF.
+	proxyProtocolV1MaxLen = 107
+
+	// proxyProtocolV2HeaderLen is the length of the fixed part of a
+	// version 2 header.
+	proxyProtocolV2HeaderLen = 16
+)
+
+var (
+	// proxyProtocolV1Sig is the signature a version 1 header starts with.
+	proxyProtocolV1Sig = []byte("PROXY ")
+
+	// proxyProtocolV2Sig is the signature a version 2 header starts with.
+	proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	// errNoProxyProtocolHeader is returned if a connection of a trusted
+	// upstream doesn't start with a PROXY protocol header.
+	errNoProxyProtocolHeader = errors.New("missing PROXY protocol header")
+)
+
+// parseUpstreams parses the given IP addresses and subnets in CIDR notation of
+// the upstreams that are trusted to send PROXY protocol headers.
+func parseUpstreams(upstreams []string) ([]*net.IPNet, error) {
+	var subnets []*net.IPNet
+	for _, entry := range upstreams {
+		entry = strings.TrimSpace(entry)
+
+		// Single IP addresses are turned into a subnet containing only
+		// that address.
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			subnets = append(subnets, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(bits, bits),
+			})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol "+
+				"upstream %q, must be an IP address or CIDR "+
+				"subnet", entry)
+		}
+		subnets = append(subnets, ipNet)
+	}
+
+	return subnets, nil
+}
+
+// proxyProtocolListener is a listener that reads the real client address of
+// connections from trusted upstreams, such as load balancers, from the PROXY
+// protocol header they send. Connections from other peers are passed through
+// as they are, so clients can't spoof their address.
+type proxyProtocolListener struct {
+	net.Listener
+
+	// trusted is the list of subnets of the trusted upstreams.
+	trusted []*net.IPNet
+}
+
+// newProxyProtocolListener wraps the given listener to parse the PROXY
+// protocol headers of connections from the given trusted upstreams.
+func newProxyProtocolListener(lis net.Listener,
+	trusted []*net.IPNet) *proxyProtocolListener {
+
+	return &proxyProtocolListener{
+		Listener: lis,
+		trusted:  trusted,
+	}
+}
+
+// isTrusted returns true if the given address belongs to a trusted upstream.
+func (l *proxyProtocolListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, ipNet := range l.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Accept waits for the next connection. The PROXY protocol header of
+// connections from trusted upstreams is only read once the connection is
+// first used, so a slow upstream can't block the accept loop.
+//
+// NOTE: This is part of the net.Listener interface.
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	return &proxyProtocolConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}, nil
+}
+
+// proxyProtocolConn is a connection of a trusted upstream that starts with a
+// PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+
+	// reader buffers the header and any data that was read along with it.
+	reader *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+
+	// readDeadline is the read deadline set by the user of the connection.
+	// It is restored once the header was read with its own deadline.
+	readDeadline time.Time
+	deadlineMtx  sync.Mutex
+}
+
+// readHeader reads the PROXY protocol header once. If the header is invalid,
+// the connection is closed.
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		// The header must arrive within its timeout, or earlier if
+		// the user of the connection set an earlier deadline.
+		c.deadlineMtx.Lock()
+		deadline := time.Now().Add(proxyProtocolHeaderTimeout)
+		if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+			deadline = c.readDeadline
+		}
+		err := c.Conn.SetReadDeadline(deadline)
+		c.deadlineMtx.Unlock()
+
+		if err == nil {
+			c.remoteAddr, err = readProxyProtocolHeader(c.reader)
+		}
+		if err == nil {
+			c.deadlineMtx.Lock()
+			err = c.Conn.SetReadDeadline(c.readDeadline)
+			c.deadlineMtx.Unlock()
+		}
+
+		if err != nil {
+			log.Debugf("Closing connection from %v with invalid "+
+				"PROXY protocol header: %v",
+				c.Conn.RemoteAddr(), err)
+
+			c.err = err
+			_ = c.Conn.Close()
+		}
+	})
+}
+
+// Read reads data from the connection after the PROXY protocol header.
+//
+// NOTE: This is part of the net.Conn interface.
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(b)
+}
+
+// SetDeadline sets the read and write deadlines of the connection. The read
+// deadline is remembered, so it still applies after the PROXY protocol header
+// was read.
+//
+// NOTE: This is part of the net.Conn interface.
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.deadlineMtx.Lock()
+	defer c.deadlineMtx.Unlock()
+
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection. It is remembered,
+// so it still applies after the PROXY protocol header was read.
+//
+// NOTE: This is part of the net.Conn interface.
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMtx.Lock()
+	defer c.deadlineMtx.Unlock()
+
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// RemoteAddr returns the client address of the PROXY protocol header. If the
+// header doesn't carry an address, the upstream's address is returned.
+//
+// NOTE: This is part of the net.Conn interface.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+
+	return c.remoteAddr
+}
+
+// readProxyProtocolHeader reads a version 1 or 2 PROXY protocol header and
+// returns the source address it carries. A nil address is returned for
+// headers without an address, such as health checks of the upstream itself.
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtocolV1Sig))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, proxyProtocolV1Sig) {
+		return readProxyProtocolV1(r)
+	}
+
+	sig, err = r.Peek(len(proxyProtocolV2Sig))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyProtocolV2Sig) {
+		return readProxyProtocolV2(r)
+	}
+
+	return nil, errNoProxyProtocolHeader
+}
+
+// readProxyProtocolV1 reads a human-readable version 1 header, for example
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyProtocolV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY protocol v1 header too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q",
+			line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	switch {
+	case fields[1] != "TCP4" && fields[1] != "TCP6":
+		return nil, fmt.Errorf("unsupported protocol %s", fields[1])
+
+	case ip == nil:
+		return nil, fmt.Errorf("invalid source address %q", fields[2])
+
+	case fields[1] == "TCP4" && ip.To4() == nil,
+		fields[1] == "TCP6" && ip.To4() != nil:
+
+		return nil, fmt.Errorf("source address %v doesn't match "+
+			"protocol %s", ip, fields[1])
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %q", fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 reads a binary version 2 header.
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	var header [proxyProtocolV2HeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	verCmd, family := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:])
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d",
+			verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	// The LOCAL command is used for connections the upstream initiates
+	// itself, they don't carry a client address.
+	switch verCmd & 0x0f {
+	case 0x0:
+		return nil, nil
+
+	case 0x1:
+
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol command %d",
+			verCmd&0x0f)
+	}
+
+	// Only TCP over IPv4 and IPv6 carries an address we can use. Any TLVs
+	// following the addresses are ignored.
+	var ipLen int
+	switch family {
+	case 0x11:
+		ipLen = net.IPv4len
+
+	case 0x21:
+		ipLen = net.IPv6len
+
+	default:
+		return nil, nil
+	}
+
+	if len(payload) < 2*ipLen+4 {
+		return nil, errors.New("PROXY protocol v2 address block too " +
+			"short")
+	}
+
+	return &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}, nil
+}
@@ -0,0 +1,234 @@
+package aperture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// proxyProtocolV2Header creates a version 2 header with the PROXY command for
+// the given TCP source and destination addresses.
+func proxyProtocolV2Header(src, dst *net.TCPAddr) []byte {
+	family, srcIP, dstIP := byte(0x21), src.IP.To16(), dst.IP.To16()
+	if src.IP.To4() != nil {
+		family, srcIP, dstIP = 0x11, src.IP.To4(), dst.IP.To4()
+	}
+
+	var payload bytes.Buffer
+	payload.Write(srcIP)
+	payload.Write(dstIP)
+	_ = binary.Write(&payload, binary.BigEndian, uint16(src.Port))
+	_ = binary.Write(&payload, binary.BigEndian, uint16(dst.Port))
+
+	var header bytes.Buffer
+	header.Write(proxyProtocolV2Sig)
+	header.WriteByte(0x21)
+	header.WriteByte(family)
+	_ = binary.Write(&header, binary.BigEndian, uint16(payload.Len()))
+	header.Write(payload.Bytes())
+
+	return header.Bytes()
+}
+
+// TestReadProxyProtocolHeader tests parsing of version 1 and 2 headers.
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 56324}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	local := append([]byte{}, proxyProtocolV2Sig...)
+	local = append(local, 0x20, 0x00, 0x00, 0x00)
+
+	testCases := []struct {
+		name    string
+		header  []byte
+		addr    net.Addr
+		errText string
+	}{{
+		name:   "v1 tcp4",
+		header: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"),
+		addr:   v4,
+	}, {
+		name: "v1 tcp6",
+		header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 443 " +
+			"443\r\n"),
+		addr: v6,
+	}, {
+		name:   "v1 unknown",
+		header: []byte("PROXY UNKNOWN\r\n"),
+	}, {
+		name:    "v1 mismatched protocol",
+		header:  []byte("PROXY TCP6 192.0.2.1 192.0.2.2 1 2\r\n"),
+		errText: "doesn't match protocol",
+	}, {
+		name:    "v1 invalid port",
+		header:  []byte("PROXY TCP4 192.0.2.1 192.0.2.2 foo 2\r\n"),
+		errText: "invalid source port",
+	}, {
+		name: "v1 too long",
+		header: []byte("PROXY TCP4 " + strings.Repeat(" ", 100) +
+			"\r\n"),
+		errText: "too long",
+	}, {
+		name:   "v2 tcp4",
+		header: proxyProtocolV2Header(v4, v4),
+		addr:   v4,
+	}, {
+		name:   "v2 tcp6",
+		header: proxyProtocolV2Header(v6, v6),
+		addr:   v6,
+	}, {
+		name:   "v2 local",
+		header: local,
+	}, {
+		name:    "no header",
+		header:  []byte("GET / HTTP/1.1\r\n\r\n"),
+		errText: errNoProxyProtocolHeader.Error(),
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bufio.NewReader(io.MultiReader(
+				bytes.NewReader(tc.header),
+				strings.NewReader("payload"),
+			))
+			addr, err := readProxyProtocolHeader(r)
+			if tc.errText != "" {
+				require.ErrorContains(t, err, tc.errText)
+				return
+			}
+			require.NoError(t, err)
+			if tc.addr == nil {
+				require.Nil(t, addr)
+			} else {
+				require.Equal(
+					t, tc.addr.String(), addr.String(),
+				)
+			}
+
+			// Everything after the header is left to be read.
+			rest, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, "payload", string(rest))
+		})
+	}
+}
+
+// TestProxyProtocolListener makes sure the address of the PROXY protocol
+// header is used as the remote address of requests, but only if the
+// connection comes from a trusted upstream.
+func TestProxyProtocolListener(t *testing.T) {
+	serve := func(upstream string) string {
+		upstreams, err := parseUpstreams([]string{upstream})
+		require.NoError(t, err)
+
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		server := &http.Server{
+			Handler: http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					_, _ = w.Write([]byte(r.RemoteAddr))
+				},
+			),
+		}
+		go func() {
+			_ = server.Serve(newProxyProtocolListener(
+				lis, upstreams,
+			))
+		}()
+		t.Cleanup(func() {
+			_ = server.Close()
+		})
+
+		return lis.Addr().String()
+	}
+
+	request := func(addr, header string) (*http.Response, string,
+		error) {
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte(header + "GET / HTTP/1.1\r\n" +
+			"Host: localhost\r\nConnection: close\r\n\r\n"))
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return resp, string(body), nil
+	}
+
+	const header = "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+
+	// A trusted upstream reports the client address.
+	addr := serve("127.0.0.1")
+	resp, body, err := request(addr, header)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "192.0.2.1:56324", body)
+
+	// A trusted upstream must send a header.
+	_, _, err = request(addr, "")
+	require.Error(t, err)
+
+	// Other peers are served without looking for a header, so one sent by
+	// a client is an invalid request.
+	addr = serve("10.0.0.0/8")
+	resp, _, err = request(addr, header)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	_, body, err = request(addr, "")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(body, "127.0.0.1:"))
+
+	_, err = parseUpstreams([]string{"invalid"})
+	require.ErrorContains(t, err, "invalid PROXY protocol upstream")
+}
+
+// TestProxyProtocolConnDeadline makes sure a read deadline set before the
+// PROXY protocol header is read still applies to the reads after it.
+func TestProxyProtocolConnDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := &proxyProtocolConn{
+		Conn:   server,
+		reader: bufio.NewReader(server),
+	}
+	defer conn.Close()
+
+	go func() {
+		_, _ = client.Write([]byte(
+			"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n",
+		))
+	}()
+
+	require.NoError(t, conn.SetReadDeadline(
+		time.Now().Add(100*time.Millisecond),
+	))
+
+	// The client sends nothing after the header, so the read must time
+	// out instead of blocking forever.
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.Less(t, time.Since(start), 2*time.Second)
+	require.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+}
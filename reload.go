@@ -0,0 +1,133 @@
+package aperture
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"gopkg.in/yaml.v2"
+)
+
+// serviceConfigs maps the name of each configured backend service to its
+// serialized configuration. It is used to find out which services changed
+// between two configurations.
+type serviceConfigs map[string]string
+
+// newServiceConfigs serializes the configuration of the given services. This
+// must be called before the services are prepared by the proxy, since that
+// fills in default values.
+func newServiceConfigs(services []*proxy.Service) serviceConfigs {
+	configs := make(serviceConfigs, len(services))
+	for _, service := range services {
+		serialized, err := yaml.Marshal(service)
+		if err != nil {
+			// This can't really happen for a configuration that
+			// was itself read from YAML. Treat the service as
+			// changed on every reload if it does anyway.
+			log.Warnf("Unable to serialize configuration of "+
+				"service %s: %v", service.Name, err)
+		}
+		configs[service.Name] = string(serialized)
+	}
+
+	return configs
+}
+
+// diff returns the names of the services that were added, removed or changed
+// in the given new configuration compared to this one.
+func (c serviceConfigs) diff(newConfigs serviceConfigs) ([]string, []string,
+	[]string) {
+
+	var added, removed, changed []string
+	for name, newConfig := range newConfigs {
+		oldConfig, ok := c[name]
+		switch {
+		case !ok:
+			added = append(added, name)
+
+		case oldConfig != newConfig || newConfig == "":
+			changed = append(changed, name)
+		}
+	}
+	for name := range c {
+		if _, ok := newConfigs[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+
+	return added, removed, changed
+}
+
+// reloadOnSignal re-reads the configuration each time a SIGHUP signal is
+// received on the given channel, until aperture is shut down.
+func (a *Aperture) reloadOnSignal(sigChan chan os.Signal) {
+	defer a.wg.Done()
+	defer signal.Stop(sigChan)
+
+	for {
+		select {
+		case <-sigChan:
+			log.Infof("Received SIGHUP, reloading configuration.")
+
+			cfg, err := getConfig()
+			if err != nil {
+				log.Errorf("Unable to reload configuration, "+
+					"keeping the current one: %v", err)
+				continue
+			}
+
+			if err := a.reloadConfig(cfg); err != nil {
+				log.Errorf("Unable to reload configuration, "+
+					"keeping the current one: %v", err)
+			}
+
+		case <-a.quit:
+			return
+		}
+	}
+}
+
+// notifyReload installs the SIGHUP handler that triggers a configuration
+// reload.
+func (a *Aperture) notifyReload() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	a.wg.Add(1)
+	go a.reloadOnSignal(sigChan)
+}
+
+// reloadConfig applies the backend services and the blocklist of the given,
+// already validated configuration to the running proxy and the components
+// that depend on the services, like the mint's service limiter. If any of the
+// services can't be initialized, nothing is changed. All other options only
+// take effect after a restart.
+func (a *Aperture) reloadConfig(cfg *Config) error {
+	newConfigs := newServiceConfigs(cfg.Services)
+
+	if err := a.proxy.UpdateServices(cfg.Services); err != nil {
+		return fmt.Errorf("unable to update services: %w", err)
+	}
+	a.proxy.UpdateBlocklist(cfg.Blocklist)
+
+	a.services.set(cfg.Services)
+	a.serviceLimiter.update(cfg.Services)
+
+	added, removed, changed := a.serviceConfigs.diff(newConfigs)
+	a.serviceConfigs = newConfigs
+
+	log.Infof("Configuration reloaded, services added: [%s], removed: "+
+		"[%s], changed: [%s]; blocklist has %d entries",
+		strings.Join(added, ", "), strings.Join(removed, ", "),
+		strings.Join(changed, ", "), len(cfg.Blocklist))
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package aperture
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/l402"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestServiceConfigsDiff makes sure added, removed and changed services are
+// detected between two configurations.
+func TestServiceConfigsDiff(t *testing.T) {
+	oldConfigs := newServiceConfigs([]*proxy.Service{{
+		Name:  "unchanged",
+		Price: 1,
+	}, {
+		Name:  "changed",
+		Price: 1,
+	}, {
+		Name: "removed",
+	}})
+	newConfigs := newServiceConfigs([]*proxy.Service{{
+		Name:  "unchanged",
+		Price: 1,
+	}, {
+		Name:  "changed",
+		Price: 2,
+	}, {
+		Name: "added2",
+	}, {
+		Name: "added1",
+	}})
+
+	added, removed, changed := oldConfigs.diff(newConfigs)
+	require.Equal(t, []string{"added1", "added2"}, added)
+	require.Equal(t, []string{"removed"}, removed)
+	require.Equal(t, []string{"changed"}, changed)
+}
+
+// TestReloadConfig makes sure a reload replaces the services and the blocklist
+// of the proxy, unless one of the new services is invalid.
+func TestReloadConfig(t *testing.T) {
+	newServices := func(host string) []*proxy.Service {
+		return []*proxy.Service{{
+			Name:       "service",
+			Address:    "127.0.0.1:1",
+			HostRegexp: "^" + host + "$",
+			Protocol:   "http",
+			Auth:       "on",
+		}}
+	}
+
+	services := newServices("old.com")
+	a := NewAperture(&Config{Services: services})
+	a.serviceConfigs = newServiceConfigs(services)
+	a.services = newServiceRegistry(services)
+	a.serviceLimiter = newStaticServiceLimiter(services, time.Now)
+
+	var err error
+	a.proxy, err = proxy.NewWithConfig(
+		&proxy.Config{}, auth.NewMockAuthenticator(), services,
+	)
+	require.NoError(t, err)
+
+	serve := func(host, remoteAddr string) int {
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		a.proxy.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	const (
+		paymentRequired = http.StatusPaymentRequired
+
+		blockedAddr = "192.0.2.1:1234"
+		allowedAddr = "192.0.3.1:1234"
+
+		// Requests for unknown hosts aren't found since there is no
+		// local service either.
+		unknownHost = http.StatusNotFound
+	)
+	require.Equal(t, paymentRequired, serve("old.com", blockedAddr))
+	require.Equal(t, unknownHost, serve("new.com", blockedAddr))
+
+	// A configuration with an invalid service is rejected as a whole and
+	// the old one stays in place.
+	invalidServices := newServices("new.com")
+	invalidServices[0].TrailerFix = "invalid"
+	err = a.reloadConfig(&Config{
+		Services:  invalidServices,
+		Blocklist: []string{"192.0.2.0/24"},
+	})
+	require.Error(t, err)
+	require.Equal(t, paymentRequired, serve("old.com", blockedAddr))
+	require.Equal(t, unknownHost, serve("new.com", blockedAddr))
+
+	// A valid configuration replaces both the services and the blocklist,
+	// also for the components outside of the proxy.
+	reloadedServices := newServices("new.com")
+	reloadedServices[0].Label = "reloaded"
+	err = a.reloadConfig(&Config{
+		Services:  reloadedServices,
+		Blocklist: []string{"192.0.2.0/24"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, reloadedServices, a.services.get())
+
+	constraints, err := a.serviceLimiter.ServiceConstraints(
+		context.Background(), l402.Service{Name: "service"},
+	)
+	require.NoError(t, err)
+	require.Equal(t, []l402.Caveat{
+		l402.NewLabelCaveat("service", "reloaded"),
+	}, constraints)
+	require.Equal(t, http.StatusForbidden, serve("new.com", blockedAddr))
+	require.Equal(t, paymentRequired, serve("new.com", allowedAddr))
+	require.Equal(t, unknownHost, serve("old.com", allowedAddr))
+}
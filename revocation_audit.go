@@ -0,0 +1,99 @@
+package aperture
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lightninglabs/aperture/mint"
+)
+
+const (
+	// revocationWebhookTimeout is the maximum time we wait for the
+	// revocation webhook to respond.
+	revocationWebhookTimeout = 10 * time.Second
+)
+
+// revocationAuditRecord is the JSON representation of a revocation event that
+// is posted to the revocation webhook.
+type revocationAuditRecord struct {
+	TokenID     string `json:"token_id"`
+	PaymentHash string `json:"payment_hash"`
+	Timestamp   string `json:"timestamp"`
+	Reason      string `json:"reason"`
+}
+
+// revocationAuditor logs every revoked L402 secret and, if configured, posts
+// the revocation to a webhook so an audit trail can be kept outside of
+// aperture.
+type revocationAuditor struct {
+	webhookURL string
+	client     *http.Client
+}
+
+// A compile time flag to ensure the revocationAuditor satisfies the
+// mint.RevocationAuditor interface.
+var _ mint.RevocationAuditor = (*revocationAuditor)(nil)
+
+// newRevocationAuditor creates a new revocation auditor. If the webhook URL is
+// empty, revocations are only logged.
+func newRevocationAuditor(webhookURL string) *revocationAuditor {
+	return &revocationAuditor{
+		webhookURL: webhookURL,
+		client: &http.Client{
+			Timeout: revocationWebhookTimeout,
+		},
+	}
+}
+
+// AuditRevocation records the given revocation event.
+//
+// NOTE: This is part of the mint.RevocationAuditor interface.
+func (r *revocationAuditor) AuditRevocation(ctx context.Context,
+	event *mint.RevocationEvent) error {
+
+	record := &revocationAuditRecord{
+		TokenID:     event.TokenID.String(),
+		PaymentHash: event.PaymentHash.String(),
+		Timestamp:   event.Timestamp.UTC().Format(time.RFC3339),
+		Reason:      event.Reason,
+	}
+
+	log.Infof("Revoked L402 secret: token_id=%v, payment_hash=%v, "+
+		"timestamp=%v, reason=%q", record.TokenID, record.PaymentHash,
+		record.Timestamp, record.Reason)
+
+	if r.webhookURL == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, r.webhookURL, bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to post revocation to webhook: %w",
+			err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("revocation webhook returned status %d",
+			resp.StatusCode)
+	}
+
+	return nil
+}
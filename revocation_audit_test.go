@@ -0,0 +1,61 @@
+package aperture
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/l402"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRevocationAuditorWebhook tests that revocation events are posted to the
+// configured webhook with the expected fields.
+func TestRevocationAuditorWebhook(t *testing.T) {
+	records := make(chan *revocationAuditRecord, 1)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var record revocationAuditRecord
+			err := json.NewDecoder(r.Body).Decode(&record)
+			require.NoError(t, err)
+
+			records <- &record
+		},
+	))
+	defer server.Close()
+
+	event := &mint.RevocationEvent{
+		TokenID:     l402.TokenID{1, 2, 3},
+		PaymentHash: lntypes.Hash{4, 5, 6},
+		Timestamp:   time.Unix(1700000000, 0),
+		Reason:      "compromised",
+	}
+
+	auditor := newRevocationAuditor(server.URL)
+	err := auditor.AuditRevocation(context.Background(), event)
+	require.NoError(t, err)
+
+	require.Equal(t, &revocationAuditRecord{
+		TokenID:     event.TokenID.String(),
+		PaymentHash: event.PaymentHash.String(),
+		Timestamp:   "2023-11-14T22:13:20Z",
+		Reason:      "compromised",
+	}, <-records)
+
+	// A webhook that fails results in an error.
+	failingServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+	))
+	defer failingServer.Close()
+
+	auditor = newRevocationAuditor(failingServer.URL)
+	err = auditor.AuditRevocation(context.Background(), event)
+	require.ErrorContains(t, err, "returned status 500")
+}
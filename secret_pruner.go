@@ -0,0 +1,47 @@
+package aperture
+
+import (
+	"context"
+	"time"
+
+	"github.com/lightninglabs/aperture/aperturedb"
+	"github.com/lightninglabs/aperture/mint"
+)
+
+// pruneSecrets periodically removes the secrets of expired L402s from the
+// given store until aperture shuts down.
+//
+// NOTE: This must be run as a goroutine.
+func (a *Aperture) pruneSecrets(pruner mint.SecretPruner,
+	interval time.Duration) {
+
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctxt, cancel := context.WithTimeout(
+				context.Background(),
+				aperturedb.DefaultStoreTimeout,
+			)
+			numPruned, err := pruner.PruneSecrets(ctxt, time.Now())
+			cancel()
+			if err != nil {
+				log.Errorf("Unable to prune expired L402 "+
+					"secrets: %v", err)
+				continue
+			}
+
+			if numPruned > 0 {
+				log.Infof("Pruned %d expired L402 secrets",
+					numPruned)
+			}
+
+		case <-a.quit:
+			return
+		}
+	}
+}
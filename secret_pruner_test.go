@@ -0,0 +1,41 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPruneSecrets makes sure the secrets of expired L402s are pruned in the
+// background until aperture shuts down.
+func TestPruneSecrets(t *testing.T) {
+	ctx := context.Background()
+	store := mint.NewInMemorySecretStore()
+
+	expired, err := store.NewExpiringSecret(
+		ctx, [32]byte{1}, time.Now().Add(-time.Minute),
+	)
+	require.NoError(t, err)
+	valid, err := store.NewSecret(ctx, [32]byte{2})
+	require.NoError(t, err)
+
+	a := &Aperture{quit: make(chan struct{})}
+	a.wg.Add(1)
+	go a.pruneSecrets(store, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		_, err := store.GetSecret(ctx, [32]byte{1})
+		return err == mint.ErrSecretNotFound
+	}, time.Second, 10*time.Millisecond)
+
+	secret, err := store.GetSecret(ctx, [32]byte{2})
+	require.NoError(t, err)
+	require.Equal(t, valid, secret)
+	require.NotEqual(t, expired, secret)
+
+	close(a.quit)
+	a.wg.Wait()
+}
@@ -5,11 +5,16 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/lightninglabs/aperture/l402"
 	"github.com/lightninglabs/aperture/mint"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
@@ -17,6 +22,11 @@ var (
 	// secretsPrefix is the key we'll use to prefix all L402 identifiers
 	// with when storing secrets in an etcd cluster.
 	secretsPrefix = "secrets"
+
+	// secretLeaseBucket is the size of the expiry buckets that share an
+	// etcd lease. Secrets are removed at the end of their bucket, so at
+	// most this long after they expired.
+	secretLeaseBucket = time.Minute
 )
 
 // idKey returns the full key to store in the database for an L402 identifier.
@@ -35,29 +45,160 @@ func idKey(id [sha256.Size]byte) string {
 // secretStore is a store of L402 secrets backed by an etcd cluster.
 type secretStore struct {
 	*clientv3.Client
+
+	// leases maps the end of an expiry bucket, in unix nanoseconds, to the
+	// lease shared by all secrets expiring within that bucket.
+	leases    map[int64]clientv3.LeaseID
+	leasesMtx sync.Mutex
 }
 
-// A compile-time constraint to ensure secretStore implements mint.SecretStore.
-var _ mint.SecretStore = (*secretStore)(nil)
+// A compile-time constraint to ensure secretStore implements
+// mint.ExpiringSecretStore.
+var _ mint.ExpiringSecretStore = (*secretStore)(nil)
 
 // newSecretStore instantiates a new L402 secrets store backed by an etcd
 // cluster.
 func newSecretStore(client *clientv3.Client) *secretStore {
-	return &secretStore{Client: client}
+	return &secretStore{
+		Client: client,
+		leases: make(map[int64]clientv3.LeaseID),
+	}
 }
 
 // NewSecret creates a new cryptographically random secret which is keyed by the
-// given hash.
+// given hash. If there already is a secret for the hash, mint.ErrSecretExists
+// is returned and the existing secret is kept. The secret never expires.
 func (s *secretStore) NewSecret(ctx context.Context,
 	id [sha256.Size]byte) ([l402.SecretSize]byte, error) {
 
+	return s.NewExpiringSecret(ctx, id, time.Time{})
+}
+
+// NewExpiringSecret creates a new cryptographically random secret which is
+// keyed by the given hash. If there already is a secret for the hash,
+// mint.ErrSecretExists is returned and the existing secret is kept. Secrets
+// with an expiry are attached to a lease, so etcd removes them once they
+// expired. The lease is shared with all secrets expiring within the same
+// bucket of secretLeaseBucket, which bounds the number of leases.
+func (s *secretStore) NewExpiringSecret(ctx context.Context,
+	id [sha256.Size]byte, expiry time.Time) ([l402.SecretSize]byte,
+	error) {
+
 	var secret [l402.SecretSize]byte
 	if _, err := rand.Read(secret[:]); err != nil {
 		return secret, err
 	}
 
-	_, err := s.Put(ctx, idKey(id), string(secret[:]))
-	return secret, err
+	err := s.putSecret(ctx, id, secret, expiry)
+
+	// A cached lease may have been revoked in the meantime, in which case
+	// we drop it and try once more with a fresh one.
+	if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		s.forgetLease(expiry)
+		err = s.putSecret(ctx, id, secret, expiry)
+	}
+	if err != nil {
+		return [l402.SecretSize]byte{}, err
+	}
+
+	return secret, nil
+}
+
+// putSecret stores the secret for the given hash unless there already is one,
+// attaching it to the lease of its expiry bucket if it expires.
+func (s *secretStore) putSecret(ctx context.Context, id [sha256.Size]byte,
+	secret [l402.SecretSize]byte, expiry time.Time) error {
+
+	var opts []clientv3.OpOption
+	if !expiry.IsZero() {
+		leaseID, err := s.leaseFor(ctx, expiry)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, clientv3.WithLease(leaseID))
+	}
+
+	// Only store the secret if the key doesn't exist yet, which is the
+	// case if it was never created. The lease is shared, so it's kept
+	// even if the secret isn't stored.
+	key := idKey(id)
+	resp, err := s.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(secret[:]), opts...)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return mint.ErrSecretExists
+	}
+
+	return nil
+}
+
+// leaseBucketEnd returns the end of the expiry bucket the given expiry falls
+// into.
+func leaseBucketEnd(expiry time.Time) time.Time {
+	end := expiry.Truncate(secretLeaseBucket)
+	if end.Before(expiry) {
+		end = end.Add(secretLeaseBucket)
+	}
+
+	return end
+}
+
+// leaseFor returns the lease for the expiry bucket of the given expiry,
+// granting a new one if there is none yet.
+func (s *secretStore) leaseFor(ctx context.Context,
+	expiry time.Time) (clientv3.LeaseID, error) {
+
+	end := leaseBucketEnd(expiry)
+
+	s.leasesMtx.Lock()
+	defer s.leasesMtx.Unlock()
+
+	// The leases of buckets that already ended have run out, so they can
+	// be dropped.
+	now := time.Now()
+	for bucket := range s.leases {
+		if bucket <= now.UnixNano() {
+			delete(s.leases, bucket)
+		}
+	}
+
+	if leaseID, ok := s.leases[end.UnixNano()]; ok {
+		return leaseID, nil
+	}
+
+	// Leases have a granularity of seconds, so we round up to never
+	// remove a secret before it expired.
+	ttl := int64(math.Ceil(end.Sub(now).Seconds()))
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	lease, err := s.Grant(ctx, ttl)
+	if err != nil {
+		return clientv3.NoLease, fmt.Errorf("unable to grant secret "+
+			"lease: %w", err)
+	}
+
+	// A bucket that already ended isn't cached, as its lease runs out
+	// right away.
+	if end.After(now) {
+		s.leases[end.UnixNano()] = lease.ID
+	}
+
+	return lease.ID, nil
+}
+
+// forgetLease drops the cached lease of the expiry bucket of the given
+// expiry.
+func (s *secretStore) forgetLease(expiry time.Time) {
+	s.leasesMtx.Lock()
+	defer s.leasesMtx.Unlock()
+
+	delete(s.leases, leaseBucketEnd(expiry).UnixNano())
 }
 
 // GetSecret returns the cryptographically random secret that corresponds to the
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"errors"
 	"net/url"
 	"os"
 	"testing"
@@ -91,6 +92,12 @@ func TestSecretStore(t *testing.T) {
 	defer etcdClient.Close()
 	defer serverCleanup()
 
+	// Use short expiry buckets so expired secrets are removed quickly.
+	defer func(bucket time.Duration) {
+		secretLeaseBucket = bucket
+	}(secretLeaseBucket)
+	secretLeaseBucket = time.Second
+
 	ctx := context.Background()
 	store := newSecretStore(etcdClient)
 
@@ -107,9 +114,67 @@ func TestSecretStore(t *testing.T) {
 	}
 	assertSecretExists(t, store, id, &secret)
 
+	// Another secret can't be created for the same ID, and the existing
+	// one must be kept.
+	_, err = store.NewSecret(ctx, id)
+	if !errors.Is(err, mint.ErrSecretExists) {
+		t.Fatalf("expected ErrSecretExists, got %v", err)
+	}
+	assertSecretExists(t, store, id, &secret)
+
 	// Once revoked, it should no longer exist.
 	if err := store.RevokeSecret(ctx, id); err != nil {
 		t.Fatalf("unable to revoke secret: %v", err)
 	}
 	assertSecretExists(t, store, id, nil)
+	// A secret with an expiry is removed by etcd once it expired.
+	secret, err = store.NewExpiringSecret(
+		ctx, id, time.Now().Add(time.Second),
+	)
+	if err != nil {
+		t.Fatalf("unable to generate new secret: %v", err)
+	}
+	assertSecretExists(t, store, id, &secret)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := store.GetSecret(ctx, id)
+		if errors.Is(err, mint.ErrSecretNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expired secret not removed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Secrets expiring within the same bucket share a lease, while those
+	// of another bucket get their own.
+	leaseOf := func(id [sha256.Size]byte) clientv3.LeaseID {
+		t.Helper()
+
+		resp, err := store.Get(ctx, idKey(id))
+		if err != nil || len(resp.Kvs) != 1 {
+			t.Fatalf("unable to fetch secret: %v", err)
+		}
+
+		return clientv3.LeaseID(resp.Kvs[0].Lease)
+	}
+
+	expiry := time.Now().Add(time.Minute)
+	ids := [][sha256.Size]byte{{1}, {2}, {3}}
+	expiries := []time.Time{expiry, expiry, expiry.Add(2 * time.Second)}
+	for i := range ids {
+		_, err := store.NewExpiringSecret(ctx, ids[i], expiries[i])
+		if err != nil {
+			t.Fatalf("unable to generate new secret: %v", err)
+		}
+	}
+	if leaseOf(ids[0]) != leaseOf(ids[1]) {
+		t.Fatalf("expected secrets of the same bucket to share a lease")
+	}
+	if leaseOf(ids[0]) == leaseOf(ids[2]) {
+		t.Fatalf("expected secrets of another bucket to get a new " +
+			"lease")
+	}
 }
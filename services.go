@@ -2,20 +2,97 @@ package aperture
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/challenger"
 	"github.com/lightninglabs/aperture/l402"
 	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightningnetwork/lnd/invoices"
+	"github.com/lightningnetwork/lnd/lnrpc"
 )
 
+// serviceKey identifies the restrictions of a service tier. The price isn't
+// part of it, as the price an L402 is minted at can differ from the configured
+// one, e.g. if it's rounded or determined by pricing rules.
+type serviceKey struct {
+	name string
+	tier l402.ServiceTier
+}
+
+// newServiceKey returns the key of the restrictions of the given service.
+func newServiceKey(service l402.Service) serviceKey {
+	return serviceKey{name: service.Name, tier: service.Tier}
+}
+
+// unmatchedCapability is the capability of requests that don't match any of
+// the capabilities configured for their service.
+const unmatchedCapability = "unknown"
+
+// serviceRegistry holds the currently configured proxy services. Everything
+// that looks up the settings of a service goes through it, so a reloaded
+// configuration takes effect without a restart.
+type serviceRegistry struct {
+	services atomic.Pointer[[]*proxy.Service]
+}
+
+// newServiceRegistry creates a new registry that holds the given services.
+func newServiceRegistry(proxyServices []*proxy.Service) *serviceRegistry {
+	r := &serviceRegistry{}
+	r.set(proxyServices)
+
+	return r
+}
+
+// get returns the current proxy services.
+func (r *serviceRegistry) get() []*proxy.Service {
+	return *r.services.Load()
+}
+
+// set replaces the current proxy services.
+func (r *serviceRegistry) set(proxyServices []*proxy.Service) {
+	r.services.Store(&proxyServices)
+}
+
 // staticServiceLimiter provides static restrictions for services.
 //
 // TODO(wilmer): use etcd instead.
 type staticServiceLimiter struct {
-	capabilities map[l402.Service]l402.Caveat
-	constraints  map[l402.Service][]l402.Caveat
-	timeouts     map[l402.Service]l402.Caveat
+	// restrictions holds the restrictions of the current services. They
+	// are replaced as a whole when the services are reloaded.
+	restrictions atomic.Pointer[serviceRestrictions]
+
+	// now returns the time the timeout and downgrade caveats are relative
+	// to.
+	now func() time.Time
+}
+
+// serviceRestrictions holds the restrictions of each service tier.
+type serviceRestrictions struct {
+	capabilities map[serviceKey]l402.Caveat
+	constraints  map[serviceKey][]l402.Caveat
+
+	// timeouts holds the number of seconds the access to each service is
+	// valid for. The timeout caveats are created when an L402 is minted.
+	timeouts map[serviceKey]int64
+
+	// downgrades holds the capability downgrade of each service. Like the
+	// timeouts, the downgrade caveats are created when an L402 is minted.
+	downgrades map[serviceKey]*downgrade
+}
+
+// downgrade describes how the capabilities of an L402 for a service are
+// downgraded after it was minted.
+type downgrade struct {
+	afterSeconds int64
+	capabilities string
 }
 
 // A compile-time constraint to ensure staticServiceLimiter implements
@@ -23,27 +100,30 @@ type staticServiceLimiter struct {
 var _ mint.ServiceLimiter = (*staticServiceLimiter)(nil)
 
 // newStaticServiceLimiter instantiates a new static service limiter backed by
-// the given restrictions.
-func newStaticServiceLimiter(
-	proxyServices []*proxy.Service) *staticServiceLimiter {
+// the given restrictions. The timeouts of services are relative to the time
+// returned by now when an L402 is minted.
+func newStaticServiceLimiter(proxyServices []*proxy.Service,
+	now func() time.Time) *staticServiceLimiter {
+
+	l := &staticServiceLimiter{now: now}
+	l.update(proxyServices)
+
+	return l
+}
 
-	capabilities := make(map[l402.Service]l402.Caveat)
-	constraints := make(map[l402.Service][]l402.Caveat)
-	timeouts := make(map[l402.Service]l402.Caveat)
+// update replaces the restrictions of the limiter with the ones of the given
+// services. L402s that were already minted keep their caveats.
+func (l *staticServiceLimiter) update(proxyServices []*proxy.Service) {
+	capabilities := make(map[serviceKey]l402.Caveat)
+	constraints := make(map[serviceKey][]l402.Caveat)
+	timeouts := make(map[serviceKey]int64)
+	downgrades := make(map[serviceKey]*downgrade)
 
 	for _, proxyService := range proxyServices {
-		s := l402.Service{
-			Name:  proxyService.Name,
-			Tier:  l402.BaseTier,
-			Price: proxyService.Price,
-		}
+		s := serviceKey{name: proxyService.Name, tier: l402.BaseTier}
 
-		if proxyService.Timeout > 0 {
-			timeouts[s] = l402.NewTimeoutCaveat(
-				proxyService.Name,
-				proxyService.Timeout,
-				time.Now,
-			)
+		if timeout := proxyService.TimeoutSeconds(); timeout > 0 {
+			timeouts[s] = timeout
 		}
 
 		capabilities[s] = l402.NewCapabilitiesCaveat(
@@ -53,13 +133,60 @@ func newStaticServiceLimiter(
 			caveat := l402.Caveat{Condition: cond, Value: value}
 			constraints[s] = append(constraints[s], caveat)
 		}
+
+		if proxyService.Label != "" {
+			constraints[s] = append(
+				constraints[s], l402.NewLabelCaveat(
+					proxyService.Name, proxyService.Label,
+				),
+			)
+		}
+
+		if proxyService.DowngradeAfter > 0 {
+			capabilities := proxyService.DowngradeCapabilities
+			downgrades[s] = &downgrade{
+				afterSeconds: proxyService.DowngradeAfter,
+				capabilities: capabilities,
+			}
+		}
+
+		// Each higher tier is numbered by its position after the base
+		// tier and shares the timeout and label of the service.
+		for i, tier := range proxyService.Tiers {
+			ts := serviceKey{
+				name: proxyService.Name,
+				tier: l402.ServiceTier(i + 1),
+			}
+
+			if timeout, ok := timeouts[s]; ok {
+				timeouts[ts] = timeout
+			}
+
+			capabilities[ts] = l402.NewCapabilitiesCaveat(
+				proxyService.Name, tier.Capabilities,
+			)
+			for cond, value := range tier.Constraints {
+				caveat := l402.NewCaveat(cond, value)
+				constraints[ts] = append(constraints[ts], caveat)
+			}
+
+			if proxyService.Label != "" {
+				constraints[ts] = append(
+					constraints[ts], l402.NewLabelCaveat(
+						proxyService.Name,
+						proxyService.Label,
+					),
+				)
+			}
+		}
 	}
 
-	return &staticServiceLimiter{
+	l.restrictions.Store(&serviceRestrictions{
 		capabilities: capabilities,
 		constraints:  constraints,
 		timeouts:     timeouts,
-	}
+		downgrades:   downgrades,
+	})
 }
 
 // ServiceCapabilities returns the capabilities caveats for each service. This
@@ -67,9 +194,12 @@ func newStaticServiceLimiter(
 func (l *staticServiceLimiter) ServiceCapabilities(ctx context.Context,
 	services ...l402.Service) ([]l402.Caveat, error) {
 
+	restrictions := l.restrictions.Load()
+
 	res := make([]l402.Caveat, 0, len(services))
 	for _, service := range services {
-		capabilities, ok := l.capabilities[service]
+		key := newServiceKey(service)
+		capabilities, ok := restrictions.capabilities[key]
 		if !ok {
 			continue
 		}
@@ -80,17 +210,24 @@ func (l *staticServiceLimiter) ServiceCapabilities(ctx context.Context,
 }
 
 // ServiceConstraints returns the constraints for each service. This enforces
-// additional constraints on a particular service/service capability.
+// additional constraints on a particular service/service capability. The time
+// of a capability downgrade is relative to the time returned by now.
 func (l *staticServiceLimiter) ServiceConstraints(ctx context.Context,
 	services ...l402.Service) ([]l402.Caveat, error) {
 
+	restrictions := l.restrictions.Load()
+
 	res := make([]l402.Caveat, 0, len(services))
 	for _, service := range services {
-		constraints, ok := l.constraints[service]
-		if !ok {
-			continue
+		key := newServiceKey(service)
+		res = append(res, restrictions.constraints[key]...)
+
+		if d, ok := restrictions.downgrades[key]; ok {
+			res = append(res, l402.NewDowngradeCaveat(
+				service.Name, d.afterSeconds, d.capabilities,
+				l.now,
+			))
 		}
-		res = append(res, constraints...)
 	}
 
 	return res, nil
@@ -101,14 +238,156 @@ func (l *staticServiceLimiter) ServiceConstraints(ctx context.Context,
 func (l *staticServiceLimiter) ServiceTimeouts(ctx context.Context,
 	services ...l402.Service) ([]l402.Caveat, error) {
 
+	restrictions := l.restrictions.Load()
+
 	res := make([]l402.Caveat, 0, len(services))
 	for _, service := range services {
-		timeout, ok := l.timeouts[service]
+		timeout, ok := restrictions.timeouts[newServiceKey(service)]
 		if !ok {
 			continue
 		}
-		res = append(res, timeout)
+		res = append(res, l402.NewTimeoutCaveat(
+			service.Name, timeout, l.now,
+		))
 	}
 
 	return res, nil
 }
+
+// newMinInvoiceStateFunc returns a function that looks up the minimum invoice
+// state the current proxy services require for an L402 to be accepted.
+// Services with dynamic prices are matched by their resource name prefix.
+func newMinInvoiceStateFunc(
+	services *serviceRegistry) auth.MinInvoiceStateFunc {
+
+	return func(serviceName string) lnrpc.Invoice_InvoiceState {
+		proxyService, _ := findProxyService(services.get(), serviceName)
+		if proxyService == nil {
+			return lnrpc.Invoice_SETTLED
+		}
+
+		state := strings.ToLower(proxyService.MinInvoiceState)
+		if state == proxy.InvoiceStateAccepted {
+			return lnrpc.Invoice_ACCEPTED
+		}
+
+		return lnrpc.Invoice_SETTLED
+	}
+}
+
+// newCapabilityFunc returns a function that determines the capability of a
+// proxy service a request accesses, so capability downgrades can be enforced.
+// For services without a downgrade, no capability is returned. Requests that
+// don't match any configured capability get unmatchedCapability, which is
+// never authorized after a downgrade.
+func newCapabilityFunc(services *serviceRegistry) auth.CapabilityFunc {
+	return func(r *http.Request, serviceName string) string {
+		proxyService, _ := findProxyService(services.get(), serviceName)
+		if proxyService == nil || proxyService.DowngradeAfter == 0 {
+			return ""
+		}
+
+		capability := proxyService.RequestCapability(r)
+		if capability != "" {
+			return capability
+		}
+
+		return unmatchedCapability
+	}
+}
+
+// newInvoiceRequestGenerator returns an invoice request generator that uses
+// the memo configured for the service an invoice is created for. Invoices for
+// unknown services get the default memo.
+func newInvoiceRequestGenerator(
+	services *serviceRegistry) challenger.InvoiceRequestGenerator {
+
+	return func(price int64, serviceName string) (*lnrpc.Invoice, error) {
+		invoice := &lnrpc.Invoice{
+			Memo:  defaultInvoiceMemo,
+			Value: price,
+		}
+
+		proxyService, resource := findProxyService(
+			services.get(), serviceName,
+		)
+		if proxyService == nil {
+			return invoice, nil
+		}
+
+		// The resource is chosen by the client, so the memo is cut to
+		// the size lnd accepts.
+		if proxyService.InvoiceMemo != "" {
+			invoice.Memo = truncateMemo(strings.NewReplacer(
+				"{service}", proxyService.Name,
+				"{resource}", resource,
+			).Replace(proxyService.InvoiceMemo))
+		}
+
+		// lnd only puts the description hash into the invoice but still
+		// stores the memo, so it can be used for accounting.
+		if proxyService.InvoiceDescriptionHash {
+			metadata, err := lnurlMetadata(invoice.Memo)
+			if err != nil {
+				return nil, err
+			}
+
+			hash := sha256.Sum256([]byte(metadata))
+			invoice.DescriptionHash = hash[:]
+		}
+
+		return invoice, nil
+	}
+}
+
+// truncateMemo cuts the given memo to the maximum size of a memo lnd accepts
+// without splitting a UTF-8 character.
+func truncateMemo(memo string) string {
+	if len(memo) <= invoices.MaxMemoSize {
+		return memo
+	}
+
+	end := invoices.MaxMemoSize
+	for end > 0 && !utf8.RuneStart(memo[end]) {
+		end--
+	}
+
+	return memo[:end]
+}
+
+// lnurlMetadata returns the LNURL-pay metadata (LUD-06) that describes a
+// payment with the given memo. Its SHA-256 hash is the description hash
+// LNURL-pay wallets expect.
+func lnurlMetadata(memo string) (string, error) {
+	metadata, err := json.Marshal([][]string{{"text/plain", memo}})
+	if err != nil {
+		return "", err
+	}
+
+	return string(metadata), nil
+}
+
+// findProxyService returns the proxy service with the given name and the
+// requested resource path. Services with dynamic prices use the service name
+// followed by the resource path as name, so they are matched by prefix. Nil is
+// returned if no service matches.
+func findProxyService(proxyServices []*proxy.Service,
+	serviceName string) (*proxy.Service, string) {
+
+	for _, proxyService := range proxyServices {
+		if proxyService.Name == serviceName {
+			return proxyService, ""
+		}
+
+		prefix := proxyService.Name + "/"
+		if proxyService.DynamicPrice.Enabled &&
+			strings.HasPrefix(serviceName, prefix) {
+
+			return proxyService, strings.TrimPrefix(
+				serviceName, proxyService.Name,
+			)
+		}
+	}
+
+	return nil, ""
+}
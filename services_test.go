@@ -0,0 +1,325 @@
+package aperture
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lightninglabs/aperture/l402"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightninglabs/aperture/pricer"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightningnetwork/lnd/invoices"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStaticServiceLimiterTiers makes sure each tier of a service gets its own
+// capabilities and constraints, while sharing the timeout and label.
+func TestStaticServiceLimiterTiers(t *testing.T) {
+	ctx := context.Background()
+	limiter := newStaticServiceLimiter([]*proxy.Service{{
+		Name:         "svc",
+		Price:        10,
+		Timeout:      60,
+		Capabilities: "read",
+		Label:        "campaign",
+		Tiers: []*proxy.Tier{{
+			Name:         "premium",
+			Price:        100,
+			Capabilities: "read,write",
+			Constraints: map[string]string{
+				"svc_methods": "GET,POST",
+			},
+		}},
+	}}, time.Now)
+
+	base := l402.Service{Name: "svc", Tier: l402.BaseTier, Price: 10}
+	premium := l402.Service{Name: "svc", Tier: 1, Price: 100}
+
+	capabilities, err := limiter.ServiceCapabilities(ctx, base)
+	require.NoError(t, err)
+	require.Equal(t, []l402.Caveat{
+		l402.NewCapabilitiesCaveat("svc", "read"),
+	}, capabilities)
+
+	capabilities, err = limiter.ServiceCapabilities(ctx, premium)
+	require.NoError(t, err)
+	require.Equal(t, []l402.Caveat{
+		l402.NewCapabilitiesCaveat("svc", "read,write"),
+	}, capabilities)
+
+	constraints, err := limiter.ServiceConstraints(ctx, premium)
+	require.NoError(t, err)
+	require.Equal(t, []l402.Caveat{
+		l402.NewCaveat("svc_methods", "GET,POST"),
+		l402.NewLabelCaveat("svc", "campaign"),
+	}, constraints)
+
+	baseTimeouts, err := limiter.ServiceTimeouts(ctx, base)
+	require.NoError(t, err)
+	premiumTimeouts, err := limiter.ServiceTimeouts(ctx, premium)
+	require.NoError(t, err)
+	require.Len(t, premiumTimeouts, 1)
+	require.Equal(t, baseTimeouts, premiumTimeouts)
+
+	// The restrictions of a tier don't depend on the price it's minted
+	// at, but an unknown tier isn't known.
+	capabilities, err = limiter.ServiceCapabilities(
+		ctx, l402.Service{Name: "svc", Tier: 1, Price: 10},
+	)
+	require.NoError(t, err)
+	require.Equal(t, []l402.Caveat{
+		l402.NewCapabilitiesCaveat("svc", "read,write"),
+	}, capabilities)
+
+	capabilities, err = limiter.ServiceCapabilities(
+		ctx, l402.Service{Name: "svc", Tier: 2, Price: 100},
+	)
+	require.NoError(t, err)
+	require.Empty(t, capabilities)
+}
+
+// TestStaticServiceLimiterRoundedPrice makes sure L402s minted at a price that
+// differs from the configured one, like a rounded price, still get the
+// restrictions of their service.
+func TestStaticServiceLimiterRoundedPrice(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1_700_000_000, 0)
+	clock := func() time.Time {
+		return now
+	}
+
+	limiter := newStaticServiceLimiter([]*proxy.Service{{
+		Name:           "svc",
+		Price:          11,
+		PriceIncrement: 10,
+		PriceRounding:  "up",
+		Timeout:        60,
+		Capabilities:   "read",
+	}}, clock)
+
+	roundingPricer := pricer.NewRoundingPricer(
+		pricer.NewDefaultPricer(11), 10, pricer.RoundUp, 1000,
+	)
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	price, err := roundingPricer.GetPrice(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, int64(20), price)
+
+	preimage := lntypes.Preimage{1}
+	m := mint.New(&mint.Config{
+		Challenger:     &fixedChallenger{hash: preimage.Hash()},
+		Secrets:        mint.NewInMemorySecretStore(),
+		ServiceLimiter: limiter,
+		Now:            clock,
+	})
+	mac, _, err := m.MintL402(ctx, l402.Service{
+		Name:  "svc",
+		Tier:  l402.BaseTier,
+		Price: price,
+	})
+	require.NoError(t, err)
+
+	var conditions []string
+	for _, rawCaveat := range mac.Caveats() {
+		caveat, err := l402.DecodeCaveat(string(rawCaveat.Id))
+		require.NoError(t, err)
+		conditions = append(conditions, caveat.Condition)
+	}
+	require.Contains(t, conditions, "svc"+l402.CondCapabilitiesSuffix)
+	require.Contains(t, conditions, "svc"+l402.CondTimeoutSuffix)
+
+	verify := func() error {
+		return m.VerifyL402(ctx, &mint.VerificationParams{
+			Macaroon:      mac,
+			Preimage:      preimage,
+			TargetService: "svc",
+		})
+	}
+	require.NoError(t, verify())
+
+	now = now.Add(61 * time.Second)
+	require.ErrorContains(t, verify(), "L402 has expired")
+}
+
+// fixedChallenger is a challenger that hands out the same invoice for every
+// challenge.
+type fixedChallenger struct {
+	hash lntypes.Hash
+}
+
+func (c *fixedChallenger) NewChallenge(int64) (string, lntypes.Hash, error) {
+	return "invoice", c.hash, nil
+}
+
+func (c *fixedChallenger) Stop() {}
+
+// TestServiceTimeoutDuration makes sure the timeout of a service is relative to
+// the time an L402 is minted and enforced with the mint's clock.
+func TestServiceTimeoutDuration(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1_700_000_000, 0)
+	clock := func() time.Time {
+		return now
+	}
+
+	limiter := newStaticServiceLimiter([]*proxy.Service{{
+		Name:            "svc",
+		Timeout:         60,
+		TimeoutDuration: time.Hour,
+	}}, clock)
+
+	preimage := lntypes.Preimage{1}
+	m := mint.New(&mint.Config{
+		Challenger:     &fixedChallenger{hash: preimage.Hash()},
+		Secrets:        mint.NewInMemorySecretStore(),
+		ServiceLimiter: limiter,
+		Now:            clock,
+	})
+	service := l402.Service{Name: "svc", Tier: l402.BaseTier}
+
+	// An L402 minted later expires an hour after it was minted, not an
+	// hour after the limiter was created.
+	now = now.Add(2 * time.Hour)
+	mac, _, err := m.MintL402(ctx, service)
+	require.NoError(t, err)
+
+	verify := func() error {
+		return m.VerifyL402(ctx, &mint.VerificationParams{
+			Macaroon:      mac,
+			Preimage:      preimage,
+			TargetService: service.Name,
+		})
+	}
+
+	// The duration takes precedence over the timeout in seconds.
+	now = now.Add(59 * time.Minute)
+	require.NoError(t, verify())
+
+	now = now.Add(2 * time.Minute)
+	require.ErrorContains(t, verify(), "L402 has expired")
+}
+
+// TestServiceDowngrade makes sure the capability downgrade of a service is
+// relative to the time an L402 is minted and enforced for the capability a
+// request accesses.
+func TestServiceDowngrade(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1_700_000_000, 0)
+	clock := func() time.Time {
+		return now
+	}
+
+	services := []*proxy.Service{{
+		Name:                  "svc",
+		Capabilities:          "read,write",
+		DowngradeAfter:        60,
+		DowngradeCapabilities: "read",
+	}, {
+		Name:         "plain",
+		Capabilities: "read",
+	}}
+	limiter := newStaticServiceLimiter(services, clock)
+
+	preimage := lntypes.Preimage{1}
+	m := mint.New(&mint.Config{
+		Challenger:     &fixedChallenger{hash: preimage.Hash()},
+		Secrets:        mint.NewInMemorySecretStore(),
+		ServiceLimiter: limiter,
+		Now:            clock,
+	})
+
+	// An L402 minted later is downgraded a minute after it was minted,
+	// not a minute after the limiter was created.
+	now = now.Add(2 * time.Hour)
+	mac, _, err := m.MintL402(ctx, l402.Service{
+		Name: "svc", Tier: l402.BaseTier,
+	})
+	require.NoError(t, err)
+
+	capabilityFunc := newCapabilityFunc(newServiceRegistry(services))
+	verify := func(path string) error {
+		req := httptest.NewRequest("GET", "http://localhost"+path, nil)
+		return m.VerifyL402(ctx, &mint.VerificationParams{
+			Macaroon:         mac,
+			Preimage:         preimage,
+			TargetService:    "svc",
+			TargetCapability: capabilityFunc(req, "svc"),
+		})
+	}
+
+	now = now.Add(59 * time.Second)
+	require.NoError(t, verify("/write/1"))
+	require.NoError(t, verify("/read/1"))
+	require.NoError(t, verify("/other"))
+
+	// After the downgrade, only the downgrade capabilities are available
+	// and requests that don't match any capability are denied.
+	now = now.Add(2 * time.Second)
+	require.NoError(t, verify("/read/1"))
+	require.ErrorContains(t, verify("/write/1"), "not authorized")
+	require.ErrorContains(t, verify("/other"), "not authorized")
+
+	// Services without a downgrade don't need the capability.
+	req := httptest.NewRequest("GET", "http://localhost/read", nil)
+	require.Empty(t, capabilityFunc(req, "plain"))
+	require.Empty(t, capabilityFunc(req, "unknown"))
+}
+
+// TestInvoiceRequestGenerator makes sure invoices get the memo configured for
+// their service and optionally commit to it with a description hash.
+func TestInvoiceRequestGenerator(t *testing.T) {
+	services := []*proxy.Service{{
+		Name:        "svc",
+		InvoiceMemo: "Access to {service}",
+	}, {
+		Name:                   "dyn",
+		InvoiceMemo:            "{service} at {resource}",
+		InvoiceDescriptionHash: true,
+		DynamicPrice: pricer.Config{
+			Enabled: true,
+		},
+	}, {
+		Name: "plain",
+	}}
+	genInvoiceReq := newInvoiceRequestGenerator(
+		newServiceRegistry(services),
+	)
+
+	invoice, err := genInvoiceReq(10, "svc")
+	require.NoError(t, err)
+	require.Equal(t, "Access to svc", invoice.Memo)
+	require.Equal(t, int64(10), invoice.Value)
+	require.Nil(t, invoice.DescriptionHash)
+
+	// Services with dynamic prices are identified by their resource name.
+	invoice, err = genInvoiceReq(20, "dyn/files/1")
+	require.NoError(t, err)
+	require.Equal(t, "dyn at /files/1", invoice.Memo)
+	hash := sha256.Sum256(
+		[]byte(`[["text/plain","dyn at /files/1"]]`),
+	)
+	require.Equal(t, hash[:], invoice.DescriptionHash)
+
+	// Memos with long resource paths are cut to the size lnd accepts,
+	// without splitting characters.
+	invoice, err = genInvoiceReq(
+		20, "dyn/"+strings.Repeat("ä", invoices.MaxMemoSize),
+	)
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(invoice.Memo), invoices.MaxMemoSize)
+	require.Greater(t, len(invoice.Memo), invoices.MaxMemoSize-2)
+	require.True(t, utf8.ValidString(invoice.Memo))
+
+	// Services without a memo and unknown services use the default one.
+	for _, name := range []string{"plain", "unknown", ""} {
+		invoice, err = genInvoiceReq(30, name)
+		require.NoError(t, err)
+		require.Equal(t, defaultInvoiceMemo, invoice.Memo)
+	}
+}